@@ -0,0 +1,91 @@
+package ublk
+
+import (
+	"context"
+	"errors"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+)
+
+// StopDevice stops device id in the kernel, whichever process serves it:
+// its block device goes away and requests queued to it fail, but the
+// device stays registered so it can be inspected and deleted later with
+// DeleteDevice. It is the by-ID counterpart of Device.Stop for tools that
+// do not own the device; a server still attached sees its queues aborted.
+//
+// If ctx is done before the kernel answers, StopDevice returns an error
+// with ErrCodeTimeout and the command completes in the background.
+func StopDevice(ctx context.Context, id uint32) error {
+	return controlByID(ctx, "STOP_DEV", id, (*ctrl.Controller).StopDevice)
+}
+
+// DeleteDevice removes device id from the kernel, stopping it first if it
+// is live. The kernel does not answer until the device's char device is
+// closed, so DeleteDevice waits for the server to let go of it (or for
+// ctx, as StopDevice does); ForceDelete does not.
+func DeleteDevice(ctx context.Context, id uint32) error {
+	return controlByID(ctx, "DEL_DEV", id, (*ctrl.Controller).DeleteDevice)
+}
+
+// ForceDelete removes device id like DeleteDevice, but with the kernel's
+// asynchronous delete: it returns once the device is stopped and
+// unregistered, without waiting for a server that may never close the
+// char device. It needs Linux 6.9 or later; older kernels reject it.
+func ForceDelete(ctx context.Context, id uint32) error {
+	return controlByID(ctx, "DEL_DEV_ASYNC", id, (*ctrl.Controller).DeleteDeviceAsync)
+}
+
+// controlByID runs the control command op on device id through a
+// controller of its own, closed once the command completes.
+func controlByID(ctx context.Context, op string, id uint32, cmd func(*ctrl.Controller, uint32) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return controlError(op, id, err)
+	}
+	c, err := openController(false)
+	if err != nil {
+		return err
+	}
+	return awaitControl(ctx, op, id, func() error {
+		defer c.Close()
+		return cmd(c, id)
+	})
+}
+
+// awaitControl runs fn in the background and returns its error as an
+// *Error. If ctx is done first it returns at once, leaving fn running.
+func awaitControl(ctx context.Context, op string, id uint32, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return controlError(op, id, err)
+	case <-ctx.Done():
+		return controlError(op, id, ctx.Err())
+	}
+}
+
+// controlError describes the failure of op on device id, with the code of
+// its errno, or returns nil if err is nil.
+func controlError(op string, id uint32, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Op: op, DevID: id, Code: ErrCodeIOError, Msg: err.Error(), Inner: err, Queue: NoQueue}
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		e.Code = ErrCodeTimeout
+		e.Msg = "gave up waiting for the kernel: " + err.Error()
+	case errors.As(err, &errno):
+		e.Errno = errno
+		e.Code = mapErrnoToCode(errno)
+		if errno == syscall.ENODEV {
+			e.Code = ErrCodeDeviceNotFound
+		}
+	}
+	return e
+}
@@ -0,0 +1,77 @@
+package ublk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+)
+
+func TestAwaitControl(t *testing.T) {
+	if err := awaitControl(context.Background(), "STOP_DEV", 3, func() error { return nil }); err != nil {
+		t.Fatalf("successful command = %v", err)
+	}
+
+	err := awaitControl(context.Background(), "DEL_DEV", 3, func() error {
+		return fmt.Errorf("DEL_DEV failed: %w", syscall.ENODEV)
+	})
+	var ublkErr *Error
+	if !errors.As(err, &ublkErr) || ublkErr.Code != ErrCodeDeviceNotFound || ublkErr.Errno != syscall.ENODEV ||
+		ublkErr.DevID != 3 || ublkErr.Op != "DEL_DEV" {
+		t.Errorf("missing device = %#v, want ErrCodeDeviceNotFound with ENODEV", err)
+	}
+
+	// A command the kernel sits on is left running when ctx ends
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = awaitControl(ctx, "DEL_DEV", 3, func() error {
+		defer close(finished)
+		<-release
+		return nil
+	})
+	if !IsCode(err, ErrCodeTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("blocked command = %v, want ErrCodeTimeout wrapping the deadline", err)
+	}
+	close(release)
+	<-finished
+}
+
+func TestControlByIDDoneContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, fn := range map[string]func(context.Context, uint32) error{
+		"StopDevice":   StopDevice,
+		"DeleteDevice": DeleteDevice,
+		"ForceDelete":  ForceDelete,
+	} {
+		if err := fn(ctx, 1); !IsCode(err, ErrCodeTimeout) {
+			t.Errorf("%s with a done context = %v, want ErrCodeTimeout", name, err)
+		}
+	}
+}
+
+func TestControlFailed(t *testing.T) {
+	stuck := fmt.Errorf("START_DEV failed: %w", &ctrl.TimeoutError{Op: "START_DEV", DevID: 4, Timeout: time.Second})
+	err := controlFailed("failed to START_DEV", stuck)
+	var ublkErr *Error
+	if !errors.As(err, &ublkErr) || ublkErr.Code != ErrCodeTimeout || ublkErr.Op != "START_DEV" || ublkErr.DevID != 4 {
+		t.Errorf("stuck START_DEV = %#v, want ErrCodeTimeout naming START_DEV on device 4", err)
+	}
+
+	err = controlFailed("failed to add device", &ctrl.TimeoutError{Op: "ADD_DEV", DevID: math.MaxUint32})
+	if !errors.As(err, &ublkErr) || ublkErr.DevID != 0 {
+		t.Errorf("stuck ADD_DEV of an unassigned ID = %#v, want no device ID", err)
+	}
+
+	err = controlFailed("failed to set parameters", fmt.Errorf("SET_PARAMS failed: %w", syscall.EINVAL))
+	if !errors.Is(err, syscall.EINVAL) || IsCode(err, ErrCodeTimeout) {
+		t.Errorf("failed SET_PARAMS = %v, want it wrapped as is", err)
+	}
+}
@@ -0,0 +1,295 @@
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// alignedLockStripes is how many locks AlignedBackend spreads its blocks
+// over; writes to blocks on different stripes proceed in parallel.
+const alignedLockStripes = 64
+
+// AlignedBackend adapts a backend that can only read and write whole
+// blocks larger than the device's logical block size, such as 4K object
+// chunks or 16K erase blocks. Requests are widened to whole native blocks;
+// a write that covers part of a block reads the block, patches it and
+// writes it back, and is serialized with other writes to the same block
+// so neither update is lost. Only the last block may be short, if the
+// backend's size is not a multiple of the block size.
+//
+// Set DeviceParams.PhysicalBlockSize to the native block size too, so
+// filesystems align their writes and read-modify-write stays rare.
+type AlignedBackend struct {
+	backend   Backend
+	blockSize int64
+	size      int64
+	locks     [alignedLockStripes]sync.Mutex // Block b is guarded by locks[b%alignedLockStripes]
+}
+
+// NewAlignedBackend wraps backend, whose native block size is blockSize
+// bytes. The result also implements DiscardBackend and WriteZeroesBackend
+// if backend does.
+func NewAlignedBackend(backend Backend, blockSize int) (Backend, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("block size %d is not positive", blockSize)
+	}
+	a := &AlignedBackend{backend: backend, blockSize: int64(blockSize), size: backend.Size()}
+	_, discard := backend.(DiscardBackend)
+	_, zeroes := backend.(WriteZeroesBackend)
+	switch {
+	case discard && zeroes:
+		return &alignedDiscardZeroesBackend{a}, nil
+	case discard:
+		return &alignedDiscardBackend{a}, nil
+	case zeroes:
+		return &alignedZeroesBackend{a}, nil
+	}
+	return a, nil
+}
+
+// span returns the native blocks covering [off, off+length), clamped to
+// the backend's size, and the clamped length.
+func (a *AlignedBackend) span(off, length int64) (first, last, n int64) {
+	n = max(min(length, a.size-off), 0)
+	if n == 0 {
+		return 0, -1, 0
+	}
+	return off / a.blockSize, (off + n - 1) / a.blockSize, n
+}
+
+// pieces calls fn for [off, off+n) in pieces: each run of whole native
+// blocks in one call, and each block covered only in part in one call,
+// with the block's range [start, end) and the covered part [lo, hi).
+func (a *AlignedBackend) pieces(off, n int64, fn func(start, end, lo, hi int64) error) error {
+	for pos := off; pos < off+n; {
+		start := pos / a.blockSize * a.blockSize
+		end := min(start+a.blockSize, a.size)
+		hi := min(end, off+n)
+		if pos == start && hi == end {
+			end = start + (off+n-start)/a.blockSize*a.blockSize
+			if off+n == a.size {
+				end = a.size // Including a short last block
+			}
+			hi = end
+		}
+		if err := fn(start, end, pos, hi); err != nil {
+			return err
+		}
+		pos = hi
+	}
+	return nil
+}
+
+// lock locks the stripes of blocks first to last, in stripe order so
+// overlapping writes cannot deadlock, and returns the unlock.
+func (a *AlignedBackend) lock(first, last int64) func() {
+	var held [alignedLockStripes]bool
+	for b := first; b <= last && b-first < alignedLockStripes; b++ {
+		held[b%alignedLockStripes] = true
+	}
+	for i := range held {
+		if held[i] {
+			a.locks[i].Lock()
+		}
+	}
+	return func() {
+		for i := range held {
+			if held[i] {
+				a.locks[i].Unlock()
+			}
+		}
+	}
+}
+
+// readFull reads all of p from the backend at off, which lies within its
+// size. Data the backend ends early with io.EOF reads as zeros.
+func (a *AlignedBackend) readFull(p []byte, off int64) error {
+	for len(p) > 0 {
+		n, err := a.backend.ReadAt(p, off)
+		p, off = p[n:], off+int64(n)
+		if errors.Is(err, io.EOF) {
+			clear(p)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrNoProgress
+		}
+	}
+	return nil
+}
+
+// ReadAt implements Backend. A native block the request covers only in
+// part is read whole into a scratch buffer.
+func (a *AlignedBackend) ReadAt(p []byte, off int64) (int, error) {
+	_, _, n := a.span(off, int64(len(p)))
+	if n == 0 {
+		return 0, io.EOF
+	}
+	var scratch []byte
+	err := a.pieces(off, n, func(start, end, lo, hi int64) error {
+		dst := p[lo-off : hi-off]
+		if lo == start && hi == end {
+			return a.readFull(dst, start)
+		}
+		if scratch == nil {
+			scratch = make([]byte, a.blockSize)
+		}
+		buf := scratch[:end-start]
+		if err := a.readFull(buf, start); err != nil {
+			return err
+		}
+		copy(dst, buf[lo-start:])
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n < int64(len(p)) {
+		return int(n), io.EOF
+	}
+	return int(n), nil
+}
+
+// WriteAt implements Backend. Native blocks the request covers only in
+// part are read, patched and written back.
+func (a *AlignedBackend) WriteAt(p []byte, off int64) (int, error) {
+	first, last, n := a.span(off, int64(len(p)))
+	if n < int64(len(p)) {
+		return 0, fmt.Errorf("write of %d bytes at %d beyond the backend's %d bytes", len(p), off, a.size)
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	unlock := a.lock(first, last)
+	defer unlock()
+	err := a.update(off, n, func(dst []byte, at int64) {
+		copy(dst, p[at-off:])
+	}, func(start, end int64) error {
+		_, err := a.backend.WriteAt(p[start-off:end-off], start)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// update changes [off, off+n). Runs of whole native blocks are passed to
+// whole; a block covered only in part is read, patched by fill with the
+// new bytes from at onwards, and written back. The caller holds the
+// blocks' locks.
+func (a *AlignedBackend) update(
+	off, n int64, fill func(dst []byte, at int64), whole func(start, end int64) error,
+) error {
+	var scratch []byte
+	return a.pieces(off, n, func(start, end, lo, hi int64) error {
+		if lo == start && hi == end {
+			return whole(start, end)
+		}
+		if scratch == nil {
+			scratch = make([]byte, a.blockSize)
+		}
+		buf := scratch[:end-start]
+		if err := a.readFull(buf, start); err != nil {
+			return fmt.Errorf("reading block at %d to update it: %w", start, err)
+		}
+		fill(buf[lo-start:hi-start], lo)
+		_, err := a.backend.WriteAt(buf, start)
+		return err
+	})
+}
+
+// Size implements Backend.
+func (a *AlignedBackend) Size() int64 {
+	return a.size
+}
+
+// Flush implements Backend.
+func (a *AlignedBackend) Flush() error {
+	return a.backend.Flush()
+}
+
+// Close implements Backend.
+func (a *AlignedBackend) Close() error {
+	return a.backend.Close()
+}
+
+// discard discards the native blocks wholly inside [offset,
+// offset+length). Discard is advisory, so the blocks at either end that it
+// covers only in part keep their data.
+func (a *AlignedBackend) discard(offset, length int64) error {
+	first, last, n := a.span(offset, length)
+	if n == 0 {
+		return nil
+	}
+	unlock := a.lock(first, last)
+	defer unlock()
+	return a.pieces(offset, n, func(start, end, lo, hi int64) error {
+		if lo != start || hi != end {
+			return nil
+		}
+		return a.backend.(DiscardBackend).Discard(start, end-start)
+	})
+}
+
+// writeZeroes zeroes [offset, offset+length), with the backend's
+// WriteZeroes for whole native blocks and read-modify-write for the rest.
+func (a *AlignedBackend) writeZeroes(offset, length int64, flags RequestFlags) error {
+	first, last, n := a.span(offset, length)
+	if n == 0 {
+		return nil
+	}
+	unlock := a.lock(first, last)
+	defer unlock()
+	return a.update(offset, n, func(dst []byte, _ int64) {
+		clear(dst)
+	}, func(start, end int64) error {
+		return a.backend.(WriteZeroesBackend).WriteZeroes(start, end-start, flags)
+	})
+}
+
+// alignedDiscardBackend is an AlignedBackend over a DiscardBackend.
+type alignedDiscardBackend struct {
+	*AlignedBackend
+}
+
+func (a *alignedDiscardBackend) Discard(offset, length int64) error {
+	return a.discard(offset, length)
+}
+
+// alignedZeroesBackend is an AlignedBackend over a WriteZeroesBackend.
+type alignedZeroesBackend struct {
+	*AlignedBackend
+}
+
+func (a *alignedZeroesBackend) WriteZeroes(offset, length int64, flags RequestFlags) error {
+	return a.writeZeroes(offset, length, flags)
+}
+
+// alignedDiscardZeroesBackend is an AlignedBackend over a backend with
+// both Discard and WriteZeroes.
+type alignedDiscardZeroesBackend struct {
+	*AlignedBackend
+}
+
+func (a *alignedDiscardZeroesBackend) Discard(offset, length int64) error {
+	return a.discard(offset, length)
+}
+
+func (a *alignedDiscardZeroesBackend) WriteZeroes(offset, length int64, flags RequestFlags) error {
+	return a.writeZeroes(offset, length, flags)
+}
+
+// Compile-time interface checks
+var (
+	_ Backend            = (*AlignedBackend)(nil)
+	_ DiscardBackend     = (*alignedDiscardBackend)(nil)
+	_ WriteZeroesBackend = (*alignedZeroesBackend)(nil)
+	_ DiscardBackend     = (*alignedDiscardZeroesBackend)(nil)
+	_ WriteZeroesBackend = (*alignedDiscardZeroesBackend)(nil)
+)
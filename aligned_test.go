@@ -0,0 +1,169 @@
+package ublk
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// blockOnlyBackend fails any request that does not cover whole blocks,
+// except a short last block. Reads yield the processor, to widen the
+// window for a write between a read-modify-write's read and its write.
+type blockOnlyBackend struct {
+	*MockBackend
+	blockSize int64
+}
+
+func (b blockOnlyBackend) check(off, length int64) error {
+	end := off + length
+	if off%b.blockSize != 0 || (end%b.blockSize != 0 && end != b.Size()) {
+		return fmt.Errorf("unaligned request [%d, %d)", off, end)
+	}
+	return nil
+}
+
+func (b blockOnlyBackend) ReadAt(p []byte, off int64) (int, error) {
+	if err := b.check(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	defer runtime.Gosched()
+	return b.MockBackend.ReadAt(p, off)
+}
+
+func (b blockOnlyBackend) WriteAt(p []byte, off int64) (int, error) {
+	if err := b.check(off, int64(len(p))); err != nil {
+		return 0, err
+	}
+	return b.MockBackend.WriteAt(p, off)
+}
+
+func (b blockOnlyBackend) WriteZeroes(off, length int64, flags RequestFlags) error {
+	if err := b.check(off, length); err != nil {
+		return err
+	}
+	return b.MockBackend.WriteZeroes(off, length, flags)
+}
+
+func TestAlignedBackend(t *testing.T) {
+	const blockSize = 4096
+	const size = 10*blockSize + 1024 // A short last block
+	inner := blockOnlyBackend{NewMockBackend(size), blockSize}
+	b, err := NewAlignedBackend(inner, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zeroer, ok := b.(WriteZeroesBackend)
+	if !ok {
+		t.Fatal("aligned backend lost WriteZeroes")
+	}
+
+	want := make([]byte, size)
+	rng := rand.New(rand.NewSource(1))
+	for i := range 500 {
+		off := rng.Int63n(size)
+		length := 1 + rng.Int63n(min(3*blockSize, size-off))
+		switch i % 3 {
+		case 0:
+			p := make([]byte, length)
+			rng.Read(p)
+			if _, err := b.WriteAt(p, off); err != nil {
+				t.Fatalf("write [%d, %d): %v", off, off+length, err)
+			}
+			copy(want[off:], p)
+		case 1:
+			if err := zeroer.WriteZeroes(off, length, 0); err != nil {
+				t.Fatalf("write zeroes [%d, %d): %v", off, off+length, err)
+			}
+			clear(want[off : off+length])
+		}
+		got := make([]byte, length)
+		if _, err := b.ReadAt(got, off); err != nil {
+			t.Fatalf("read [%d, %d): %v", off, off+length, err)
+		}
+		if !bytes.Equal(got, want[off:off+length]) {
+			t.Fatalf("read [%d, %d) after %d requests does not match what was written", off, off+length, i)
+		}
+	}
+
+	if _, err := b.WriteAt(make([]byte, 2), size-1); err == nil {
+		t.Error("write past the end succeeded")
+	}
+}
+
+func TestAlignedBackendConcurrentPatches(t *testing.T) {
+	const blockSize = 16 << 10
+	inner := blockOnlyBackend{NewMockBackend(4 * blockSize), blockSize}
+	b, err := NewAlignedBackend(inner, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each writer owns 512-byte sectors of the same blocks; a lost update
+	// from an unserialized read-modify-write would leave one of its
+	// sectors stale
+	const writers = 8
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sector := bytes.Repeat([]byte{byte(w + 1)}, 512)
+			for off := int64(w * 512); off < b.Size(); off += writers * 512 {
+				if _, err := b.WriteAt(sector, off); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got := make([]byte, b.Size())
+	if _, err := b.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for off := 0; off < len(got); off += 512 {
+		if w := off / 512 % writers; got[off] != byte(w+1) {
+			t.Fatalf("sector at %d holds %d, want writer %d's data", off, got[off], w+1)
+		}
+	}
+}
+
+func TestAlignedBackendDiscard(t *testing.T) {
+	const blockSize = 4096
+	inner := NewMockBackend(4 * blockSize)
+	_, _ = inner.WriteAt(bytes.Repeat([]byte{1}, 4*blockSize), 0)
+	b, err := NewAlignedBackend(inner, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Blocks 1 and 2 are discarded; the parts of 0 and 3 are kept
+	if err := b.(DiscardBackend).Discard(blockSize/2, 3*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4*blockSize)
+	_, _ = inner.ReadAt(got, 0)
+	for off, v := range got {
+		want := byte(1)
+		if off >= blockSize && off < 3*blockSize {
+			want = 0
+		}
+		if v != want {
+			t.Fatalf("byte %d = %d after the discard, want %d", off, v, want)
+		}
+	}
+
+	plain, err := NewAlignedBackend(struct{ Backend }{inner}, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plain.(*AlignedBackend); !ok {
+		t.Errorf("backend without Discard or WriteZeroes wrapped as %T", plain)
+	}
+	if _, err := NewAlignedBackend(inner, 0); err == nil {
+		t.Error("zero block size accepted")
+	}
+}
@@ -3,15 +3,26 @@ package ublk
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"runtime"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/ehrlich-b/go-ublk/internal/constants"
 	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+	"github.com/ehrlich-b/go-ublk/internal/devnode"
 	"github.com/ehrlich-b/go-ublk/internal/logging"
 	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
 )
 
 // Device represents a ublk block device
@@ -19,10 +30,13 @@ type Device struct {
 	// ID is the device ID assigned by the kernel
 	ID uint32
 
-	// Path is the path to the block device (e.g., "/dev/ublkb0")
+	// Path is the path to the block device (e.g., "/dev/ublkb0"). Once the
+	// device starts, it is the node the kernel registered for the device's
+	// numbers, unless Options.BlockDevicePath names another.
 	Path string
 
-	// CharPath is the path to the character device (e.g., "/dev/ublkc0")
+	// CharPath is the path to the character device (e.g., "/dev/ublkc0"),
+	// resolved the same way as Path
 	CharPath string
 
 	// Backend is the backend implementation
@@ -37,16 +51,58 @@ type Device struct {
 	depth     int
 	blockSize int
 	started   bool
+	paused    bool // queues stopped, kernel device quiesced (EnableRecovery)
+	halted    bool // STOP_DEV issued; the kernel device cannot be restarted
 	closed    bool
 	runners   []*queue.Runner
+	group     *queue.Group // set when params.SharedRing is used
+
+	// life serializes Start, Stop, Close and automatic queue restarts
+	life     sync.Mutex
+	startCtx context.Context // passed to the last Start, for restarts
+	restarts []time.Time     // recent automatic restarts
+	failErr  error           // why the device failed; guarded by failMu
+	failMu   sync.Mutex
+	failed   chan struct{} // closed when the device fails
+
+	// gate is held shared by the queues around every backend call;
+	// holding it exclusively quiesces I/O (see Snapshot)
+	gate sync.RWMutex
+
+	// budget caps the bytes the backend holds; nil unless
+	// DeviceParams.MaxInFlightBytes is set
+	budget *queue.ByteBudget
+
+	// barrier orders FLUSH after writes on every queue; nil unless
+	// DeviceParams.StrictFlush is set
+	barrier *queue.WriteBarrier
+
+	// activity counts requests handed to the backend; the scrubber waits
+	// for it to stop changing
+	activity atomic.Uint64
+	scrub    *scrubber // nil unless DeviceParams.Scrub is enabled
+
+	migrating atomic.Bool // MigrateBackend in progress
+
+	changes *changeTracker // nil unless DeviceParams.ChangeTracking is enabled
 
 	// Configuration preserved for Start()
 	params  DeviceParams
 	options *Options
+	manager *Manager // nil unless created through a Manager
 
 	// Metrics and observability
 	metrics  *Metrics
+	events   *eventLog    // nil if disabled
+	trace    *TraceWriter // nil unless Options.Trace is set
+	slowIO   *slowIOLog   // nil unless Options.SlowIOThreshold is set
 	observer Observer
+	tuner    atomic.Pointer[queueTuner] // nil until the queues first start
+
+	// Bit op of word op/64 is set once an unknown op has been logged
+	unknownOpsLogged [4]atomic.Uint64
+	// UBLK_IO_F_* bits logged as unknown
+	unknownFlagsLogged atomic.Uint32
 }
 
 // DeviceParams contains parameters for creating a ublk device
@@ -56,9 +112,14 @@ type DeviceParams struct {
 
 	// Device configuration
 	QueueDepth       int // Queue depth per queue (default: 128)
-	NumQueues        int // Number of queues (default: number of CPUs)
+	NumQueues        int // Number of queues (default: number of CPUs; capped at the kernel's limit)
 	LogicalBlockSize int // Logical block size in bytes (default: 512)
-	MaxIOSize        int // Maximum I/O size in bytes (default: 1MB)
+	MaxIOSize        int // Maximum I/O size in bytes (default: 1MB, capped at IOBufferSizePerTag)
+
+	// PhysicalBlockSize is the block size writes should be aligned to for
+	// performance, e.g. 4096 for a 512e disk image. Partitioning tools and
+	// filesystems use it for alignment. 0 means LogicalBlockSize.
+	PhysicalBlockSize int
 
 	// Feature flags
 	EnableZeroCopy     bool // Enable zero-copy if supported
@@ -67,7 +128,36 @@ type DeviceParams struct {
 	EnableZoned        bool // Enable zoned storage support
 	EnableIoctlEncode  bool // Use ioctl encoding instead of URING_CMD
 
-	// Device attributes
+	// EnableRecovery makes Stop pause the device instead of removing its
+	// block device. While paused the kernel holds new I/O, so a mounted
+	// filesystem survives; Start resumes serving through the kernel's user
+	// recovery commands. Without it, a stopped device cannot be started
+	// again. Requires UBLK_F_USER_RECOVERY (Linux 6.0+).
+	EnableRecovery bool
+
+	// AutoRestart restarts the queues through the recovery path when one
+	// of them fails, instead of failing the device (see Device.Failed). It
+	// needs EnableRecovery, and gives up after 3 restarts in a minute.
+	// Queues aborted by the kernel are never restarted.
+	AutoRestart bool
+
+	// NoPartitionScan keeps the kernel from scanning the device for
+	// partitions when it starts, so a backend under test cannot surface
+	// partitions the host then probes or mounts. The block node is still
+	// created. Requires UBLK_F_NO_AUTO_PART_SCAN (Linux 6.19+); older
+	// kernels fail device creation with an error wrapping
+	// syscall.EOPNOTSUPP.
+	NoPartitionScan bool
+
+	// EnableResize lets Device.Resize change the size of the running
+	// device. The backend must implement ResizeBackend. Requires
+	// UBLK_F_UPDATE_SIZE; on kernels without it Resize fails.
+	EnableResize bool
+
+	// Device attributes. Without VolatileCache the block layer treats the
+	// device as write-through and sends no flushes, so a backend that
+	// buffers writes needs it for fsync to reach Backend.Flush. EnableFUA
+	// only takes effect with VolatileCache.
 	ReadOnly      bool // Make device read-only
 	Rotational    bool // Device is rotational (HDD-like)
 	VolatileCache bool // Device has volatile cache
@@ -79,12 +169,141 @@ type DeviceParams struct {
 	MaxDiscardSectors  uint32 // Max sectors per discard
 	MaxDiscardSegments uint16 // Max segments per discard
 
+	// MaxWriteZeroesSectors caps a WRITE_ZEROES request, in 512-byte
+	// sectors (only used if backend implements WriteZeroesBackend; 0
+	// disables WRITE_ZEROES)
+	MaxWriteZeroesSectors uint32
+
+	// Scatter/gather limits bound the shape of the requests the kernel
+	// builds, for backends that hand buffers to hardware or to a DMA engine
+	// with constraints of its own (RDMA, SPDK). 0 leaves each at the block
+	// layer default. The segment limits need Linux 6.15+; older kernels
+	// ignore them.
+	MaxSegments         uint16 // Max data segments per request
+	MaxSegmentSize      uint32 // Max bytes per segment (at least 4096)
+	SegmentBoundaryMask uint64 // No segment crosses a multiple of mask+1 (mask+1 a power of two, at least 4096)
+	VirtBoundaryMask    uint64 // Gaps between segments must be aligned to mask+1 (NVMe PRP style); excludes MaxSegmentSize
+
 	// Advanced options
 	DeviceID    int32  // Specific device ID to request (-1 for auto)
 	DeviceName  string // Optional device name
 	CPUAffinity []int  // CPU affinity mask for queue threads
+
+	// DeviceIDRange restricts the IDs this device may use, so services on
+	// a shared host can each own a slice of the ID space. With DeviceID
+	// -1 the lowest free ID in the range is taken; a fixed DeviceID must
+	// fall inside it. The zero value places no restriction.
+	DeviceIDRange IDRange
+
+	// SharedRing serves all queues from one io_uring on one thread instead
+	// of a ring and thread per queue. It saves fds, mmaps and threads on
+	// devices with many queues, but caps throughput at what one CPU can do.
+	SharedRing bool
+
+	// BackendWorkers runs backend calls on this many goroutines per queue
+	// instead of inline on the queue thread. Requests completing in the same
+	// batch then overlap, and each one is committed as soon as its backend
+	// call returns. Worth enabling for backends with real latency (files,
+	// network); in-memory backends are faster inline. 0 disables it.
+	BackendWorkers int
+
+	// IOTimeout bounds each backend call: a request the backend has not
+	// served within it fails with ETIMEDOUT. RequestBackend calls see the
+	// deadline in Request.Deadline, and FlushContext, DiscardContext and
+	// WriteZeroesContext calls in their context. The block layer's timeout for the
+	// device (queue/io_timeout in sysfs) is set a little longer, so blk-mq
+	// never times out a request the backend is still serving. 0 leaves
+	// backend calls unbounded and the kernel default (30s) in place.
+	IOTimeout time.Duration
+
+	// MaxInFlightBytes caps the READ and WRITE data in backend calls at
+	// once, across all queues, for backends that allocate per request,
+	// such as compressing or encrypting wrappers. Requests over the cap
+	// wait for others to finish before reaching the backend, which holds
+	// back the queues' fetches. A request larger than the cap still runs,
+	// alone. 0 means no cap.
+	MaxInFlightBytes int64
+
+	// StrictFlush makes a FLUSH wait for the writes in flight on every
+	// queue, not only those its own queue has completed, before it calls
+	// Backend.Flush. The block layer only asks a flush to cover writes
+	// that completed before it was issued, so this is for backends whose
+	// Flush must also cover writes still racing it on other queues. It
+	// costs the FLUSH the wait for the slowest such write.
+	StrictFlush bool
+
+	// IOWQMaxWorkers caps the io_uring worker threads (iou-wrk) each queue
+	// thread may start, for bounded and unbounded work alike, so a big
+	// machine does not grow hundreds of them; 0 leaves the kernel defaults
+	// (one per CPU for bounded work, RLIMIT_NPROC for unbounded).
+	// IOWQCPUs, if set, keeps those workers on the given CPUs.
+	IOWQMaxWorkers int
+	IOWQCPUs       []int
+
+	// IOWQSharing chooses which queue rings attach to another ring's
+	// io_uring worker pool (IORING_SETUP_ATTACH_WQ). It has no effect on
+	// the kernels this package supports, where each queue thread has its
+	// own pool regardless; the default attaches nothing.
+	IOWQSharing IOWQSharing
+
+	// StallThreshold is how long a request may take between fetch and
+	// commit before QueueObserver.OnQueueStall fires (default: 1s).
+	StallThreshold time.Duration
+
+	// DepthSampleInterval is how often each queue reports the tags it has
+	// in use to Observer.ObserveQueueDepth, which feeds the queue depth in
+	// Metrics (default: 100ms; negative disables sampling).
+	DepthSampleInterval time.Duration
+
+	// MaxReadAhead caps how far ahead of a sequential reader a
+	// ReadAheadBackend is asked to prefetch (default DefaultMaxReadAhead).
+	// A negative value disables the hints.
+	MaxReadAhead int
+
+	// HealthCheckOffset is the byte offset of a block that HealthCheck may
+	// borrow for its end-to-end I/O probe. The block's contents are restored
+	// afterwards, but concurrent writes to it can be lost, so reserve a block
+	// nothing else uses. It must be a multiple of LogicalBlockSize.
+	// 0 disables the I/O probe.
+	HealthCheckOffset int64
+
+	// EventLogSize is how many events Device.Events keeps (default: 256).
+	// A negative value disables the event log.
+	EventLogSize int
+
+	// Scrub configures the background scrubber, which reads the device
+	// while it is idle to find bad blocks early. The zero value disables it.
+	Scrub ScrubParams
+
+	// ChangeTracking enables changed block tracking for incremental
+	// backups (see Device.ChangedBlocks). The zero value disables it.
+	ChangeTracking ChangeTrackingParams
 }
 
+// IOWQSharing is which rings a device's queue rings are created attached
+// to with IORING_SETUP_ATTACH_WQ. Since Linux 5.12 io-wq pools belong to
+// the submitting thread and the kernel only checks that an attachment is
+// allowed, so on the kernels this package runs on (6.8+) no setting
+// shares any workers; use IOWQMaxWorkers to bound them instead.
+type IOWQSharing int
+
+const (
+	// IOWQShareDefault is IOWQShareNone.
+	IOWQShareDefault IOWQSharing = iota
+
+	// IOWQShareNone gives every queue ring a pool of its own.
+	IOWQShareNone
+
+	// IOWQShareDevice attaches the device's queue rings to its first
+	// queue's.
+	IOWQShareDevice
+
+	// IOWQShareManager attaches the device's queue rings to a ring its
+	// Manager keeps until it closes. Without a Manager it is
+	// IOWQShareDevice.
+	IOWQShareManager
+)
+
 // DefaultParams returns default device parameters
 func DefaultParams(backend Backend) DeviceParams {
 	return DeviceParams{
@@ -112,6 +331,8 @@ func DefaultParams(backend Backend) DeviceParams {
 		MaxDiscardSectors:  constants.DefaultMaxDiscardSectors,
 		MaxDiscardSegments: constants.DefaultMaxDiscardSegments,
 
+		MaxWriteZeroesSectors: constants.DefaultMaxWriteZeroesSectors,
+
 		DeviceID: constants.AutoAssignDeviceID,
 	}
 }
@@ -126,6 +347,192 @@ type Options struct {
 
 	// Observer for metrics collection (if nil, uses no-op observer)
 	Observer Observer
+
+	// ErrnoMapper, if set, chooses the errno reported to the kernel for
+	// failed backend requests (see ErrnoMapper for the default mapping).
+	ErrnoMapper ErrnoMapper
+
+	// StateDir, if set, keeps a DeviceRecord of the device in this
+	// directory (conventionally DefaultStateDir) from creation until
+	// Close: its ID, the process serving it, its state, a hash of its
+	// parameters and its backend. The record is replaced atomically at
+	// every create, start and stop, so after a crash ReadDeviceRecords
+	// still finds the devices a process left in the kernel.
+	StateDir string
+
+	// MetricsFile, if set, is replaced every MetricsInterval with the
+	// device's MetricsSnapshot as JSON. The file is written atomically.
+	MetricsFile string
+
+	// LogMetrics logs a one-line summary (IOPS, MB/s, p99) to Logger every
+	// MetricsInterval.
+	LogMetrics bool
+
+	// MetricsInterval is the period for MetricsFile and LogMetrics
+	// (default DefaultMetricsInterval).
+	MetricsInterval time.Duration
+
+	// AutoTune checks every TuneInterval (default DefaultTuneInterval)
+	// whether QueueDepth, NumQueues, BackendWorkers and SharedRing suit the
+	// load, and logs a recommendation to Logger when they do not. See
+	// Device.QueueAdvice.
+	AutoTune     bool
+	TuneInterval time.Duration
+
+	// OnQueueAdvice, if set with AutoTune, is called with each new
+	// recommendation. The queues cannot be reshaped in place; to act on
+	// advice, close the device and create it again with QueueAdvice.Apply.
+	OnQueueAdvice func(QueueAdvice)
+
+	// DeviceDir is the directory udev creates the ublkcN and ublkbN nodes
+	// in (default /dev), for containers that see them elsewhere.
+	DeviceDir string
+
+	// CharDevicePath and BlockDevicePath, if set, are the device's nodes,
+	// overriding DeviceDir. They name one device, so they suit a fixed
+	// DeviceID; a Manager serving several devices should use DeviceDir.
+	CharDevicePath  string
+	BlockDevicePath string
+
+	// CreateNodes creates the character and block device nodes with mknod,
+	// from the device numbers in /sys/class, instead of waiting for udev.
+	// Use it in containers whose /dev no udev populates; it needs
+	// CAP_MKNOD. Nodes that already exist for the device are kept.
+	CreateNodes bool
+
+	// DeviceNodeTimeout bounds the wait for the character device to appear
+	// after ADD_DEV (default DefaultDeviceNodeTimeout).
+	DeviceNodeTimeout time.Duration
+
+	// LoadModule runs 'modprobe ublk_drv' if /dev/ublk-control is missing,
+	// instead of failing with ErrKernelNotSupported. It needs root.
+	LoadModule bool
+
+	// ControlTimeout bounds how long each control command (ADD_DEV,
+	// START_DEV, DEL_DEV...) may wait for the kernel, which can sit on one
+	// forever, e.g. START_DEV when the queues never fetched. A command
+	// that runs out of time fails with ErrCodeTimeout naming it, and is
+	// left to complete in the background. The default is
+	// DefaultControlTimeout; a negative value waits forever.
+	ControlTimeout time.Duration
+
+	// ControlRetry retries ADD_DEV, SET_PARAMS and START_DEV when they fail
+	// transiently (EINTR, EAGAIN, EBUSY by default). The zero value uses
+	// the defaults; set MaxAttempts to 1 to fail on the first error.
+	ControlRetry RetryPolicy
+
+	// RunAs, if set, drops the process to these credentials with
+	// DropPrivileges once the device has started, so the long-running I/O
+	// loops do not run as root. It affects the whole process: with a
+	// Manager serving several devices, call DropPrivileges after creating
+	// them all instead. Privileges are dropped only once per process, so
+	// later starts skip it; but resuming a paused device and AutoRestart
+	// still send START_USER_RECOVERY, which needs CAP_SYS_ADMIN in
+	// KeepCapabilities.
+	RunAs *Credentials
+
+	// FlushOnStop flushes the backend once I/O has stopped in Stop and
+	// Close, so data a buffered backend holds is durable after a clean
+	// shutdown. The flush is given FlushOnStopTimeout (default
+	// DefaultFlushOnStopTimeout); the device stops even if it fails, and
+	// the error is returned.
+	FlushOnStop        bool
+	FlushOnStopTimeout time.Duration
+
+	// StopTimeout bounds how long Stop and Close wait for the queues to
+	// finish the requests they are serving (default DefaultStopTimeout).
+	// Past it, requests still in the backend with BackendWorkers or
+	// DeviceParams.IOTimeout are failed with EIO. A backend call made on
+	// the queue thread cannot be interrupted, so without either Stop
+	// returns an ErrCodeTimeout error and leaves the device to Close.
+	StopTimeout time.Duration
+
+	// Trace, if set, receives a record of every request served (op,
+	// sectors, flags, start time, latency and errno) in the format
+	// NewTraceReader reads, for replaying with ReplayTrace. Records are
+	// buffered and flushed when the device stops; a write error ends the
+	// trace and is returned by Stop or Close. Tracing serializes the queues
+	// on one lock, so it is meant for capturing workloads, not production.
+	Trace io.Writer
+
+	// SlowIOThreshold, if set, logs a warning for every request the
+	// backend takes longer than this to serve, with its op, offset,
+	// length, queue, tag and duration, like a database's slow query log.
+	// At most one line is logged per second; it counts the slow requests
+	// left out since the previous line.
+	SlowIOThreshold time.Duration
+
+	// RingProvider, if set, creates each queue's io_uring in place of the
+	// built-in implementation. See Ring for what it must provide.
+	RingProvider RingProvider
+
+	// BufferAllocator, if set, supplies the memory the queues move I/O
+	// data through in place of anonymous mmap and Go heap buffers, e.g.
+	// pinned, registered or NUMA-local memory.
+	BufferAllocator BufferAllocator
+
+	// UnknownOpHandler, if set, serves requests whose op the queues do not
+	// handle, such as ops added by a kernel newer than this package, in
+	// place of failing them with EOPNOTSUPP. req.Data is nil. Either way
+	// the request is counted in Metrics.UnknownOps, each op is logged the
+	// first time it is seen, and none are reported as I/O errors. Devices
+	// created with ServeRaw pass every op to their handler instead.
+	UnknownOpHandler RawHandler
+}
+
+// blockPath returns the block device node for device id.
+func (o *Options) blockPath(id uint32) string {
+	if o != nil && o.BlockDevicePath != "" {
+		return o.BlockDevicePath
+	}
+	return filepath.Join(o.deviceDir(), fmt.Sprintf("ublkb%d", id))
+}
+
+// charPath returns the character device node for device id.
+func (o *Options) charPath(id uint32) string {
+	if o != nil && o.CharDevicePath != "" {
+		return o.CharDevicePath
+	}
+	return filepath.Join(o.deviceDir(), fmt.Sprintf("ublkc%d", id))
+}
+
+func (o *Options) deviceDir() string {
+	if o == nil || o.DeviceDir == "" {
+		return "/dev"
+	}
+	return o.DeviceDir
+}
+
+func (o *Options) deviceNodeTimeout() time.Duration {
+	if o == nil || o.DeviceNodeTimeout <= 0 {
+		return constants.DeviceNodeTimeout
+	}
+	return o.DeviceNodeTimeout
+}
+
+func (o *Options) stopTimeout() time.Duration {
+	if o == nil || o.StopTimeout <= 0 {
+		return constants.StopTimeout
+	}
+	return o.StopTimeout
+}
+
+// controlTimeout returns the bound on each control command, 0 for none.
+func (o *Options) controlTimeout() time.Duration {
+	switch {
+	case o == nil || o.ControlTimeout == 0:
+		return constants.ControlTimeout
+	case o.ControlTimeout < 0:
+		return 0
+	}
+	return o.ControlTimeout
+}
+
+func (o *Options) flushOnStopTimeout() time.Duration {
+	if o == nil || o.FlushOnStopTimeout <= 0 {
+		return constants.FlushOnStopTimeout
+	}
+	return o.FlushOnStopTimeout
 }
 
 // Logger interface is now defined in interfaces.go
@@ -144,165 +551,39 @@ type Options struct {
 //	params := ublk.DefaultParams(backend)
 //	device, err := ublk.CreateAndServe(context.Background(), params, nil)
 func CreateAndServe(ctx context.Context, params DeviceParams, options *Options) (*Device, error) {
-	if ctx == nil {
-		ctx = context.Background()
-	}
-
-	if options == nil {
-		options = &Options{}
-	}
-
-	if options.Context != nil {
-		ctx = options.Context
-	}
-
 	// Create controller
-	ctrl, err := createController()
+	ctrl, err := createController(options)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create controller: %v", err)
+		return nil, fmt.Errorf("failed to create controller: %w", err)
 	}
 	defer ctrl.Close()
 
-	// Convert params to internal format
-	ctrlParams := convertToCtrlParams(params)
-
-	// Create device using control plane
-	deviceID, err := ctrl.AddDevice(&ctrlParams)
-	if err != nil {
-		return nil, fmt.Errorf("failed to add device: %v", err)
-	}
-
-	// Set parameters
-	err = ctrl.SetParams(deviceID, &ctrlParams)
-	if err != nil {
-		_ = ctrl.DeleteDevice(deviceID) // Cleanup, ignore error
-		return nil, fmt.Errorf("failed to set parameters: %v", err)
-	}
-
-	// Initialize metrics and observer
-	metrics := NewMetrics()
-	var observer Observer
-	if options.Observer != nil {
-		observer = options.Observer
-	} else {
-		// Default to metrics observer if no custom observer provided
-		observer = NewMetricsObserver(metrics)
-	}
-
-	// Determine actual number of queues (default to number of CPUs)
-	numQueues := params.NumQueues
-	if numQueues == 0 {
-		numQueues = runtime.NumCPU()
-	}
+	return createAndServe(ctx, ctrl, nil, params, options)
+}
 
-	// Create Device struct
-	device := &Device{
-		ID:        deviceID,
-		Path:      fmt.Sprintf("/dev/ublkb%d", deviceID),
-		CharPath:  fmt.Sprintf("/dev/ublkc%d", deviceID),
-		Backend:   params.Backend,
-		queues:    numQueues, // Store actual queue count, not params value
-		depth:     params.QueueDepth,
-		blockSize: params.LogicalBlockSize,
-		started:   false, // Not started yet
-		metrics:   metrics,
-		observer:  observer,
+// createAndServe adds, configures and starts a device using ctrl. manager
+// is nil for standalone devices.
+func createAndServe(
+	ctx context.Context, ctrl *ctrl.Controller, manager *Manager, params DeviceParams, options *Options,
+) (*Device, error) {
+	if ctx == nil {
+		ctx = context.Background()
 	}
-
-	device.ctx, device.cancel = context.WithCancel(ctx)
-
-	// Initialize and start queue runners before START_DEV
-	// The kernel waits for initial FETCH_REQ commands from all queues
-	// NOTE: The ublk character device can only be opened once (kernel enforces this)
-	// so we open it once and share the fd among all queues (each queue dups it)
-	logger := logging.Default()
-
-	// Open character device once (kernel only allows single open)
-	charPath := fmt.Sprintf("/dev/ublkc%d", deviceID)
-	charDeviceFd := -1
-	for i := 0; i < constants.CharDeviceOpenRetries; i++ { // Retry for up to 5s waiting for udev
-		var err error
-		charDeviceFd, err = syscall.Open(charPath, syscall.O_RDWR, 0)
-		if err == nil {
-			logger.Info("opened char device for multi-queue", "fd", charDeviceFd, "path", charPath)
-			break
-		}
-		if err != syscall.ENOENT {
-			return nil, fmt.Errorf("failed to open %s: %v", charPath, err)
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	if charDeviceFd < 0 {
-		_ = ctrl.DeleteDevice(deviceID) // Cleanup, ignore error
-		return nil, fmt.Errorf("character device did not appear: %s", charPath)
-	}
-
-	device.runners = make([]*queue.Runner, numQueues)
-	for i := 0; i < numQueues; i++ {
-		runnerConfig := queue.Config{
-			DevID:       deviceID,
-			QueueID:     uint16(i),
-			Depth:       params.QueueDepth,
-			BlockSize:   params.LogicalBlockSize,
-			Backend:     params.Backend,
-			Logger:      options.Logger,
-			Observer:    observer,
-			CPUAffinity: params.CPUAffinity,
-			CharFd:      charDeviceFd, // Share the fd (runner will dup it)
-		}
-
-		runner, err := queue.NewRunner(device.ctx, runnerConfig)
-		if err != nil {
-			// Cleanup already created runners
-			for j := 0; j < i; j++ {
-				if device.runners[j] != nil {
-					device.runners[j].Close()
-				}
-			}
-			_ = ctrl.DeleteDevice(deviceID) // Cleanup, ignore error
-			return nil, fmt.Errorf("failed to create queue runner %d: %v", i, err)
-		}
-		device.runners[i] = runner
-
-		// Start this runner immediately (submit FETCH_REQs)
-		// This must happen before creating the next queue
-		if err := runner.Start(); err != nil {
-			for j := 0; j <= i; j++ {
-				if device.runners[j] != nil {
-					device.runners[j].Close()
-				}
-			}
-			_ = ctrl.DeleteDevice(deviceID) // Cleanup, ignore error
-			return nil, fmt.Errorf("failed to start queue runner %d: %v", i, err)
-		}
+	if options != nil && options.Context != nil {
+		ctx = options.Context
 	}
 
-	// Give kernel time to see FETCH_REQs
-	time.Sleep(constants.QueueInitDelay)
-
-	// Submit START_DEV after FETCH_REQs are in place
-	err = ctrl.StartDevice(deviceID)
+	device, err := create(ctx, ctrl, manager, params, options)
 	if err != nil {
-		for j := 0; j < len(device.runners); j++ {
-			if device.runners[j] != nil {
-				device.runners[j].Close()
-			}
-		}
-		_ = ctrl.DeleteDevice(deviceID) // Cleanup, ignore error
-		return nil, fmt.Errorf("failed to START_DEV: %v", err)
+		return nil, err
 	}
-
-	device.started = true
-
-	// Small delay to ensure kernel has processed FETCH_REQs before declaring ready
-	// The 250ms was too long, but there's a real race condition that needs timing
-	time.Sleep(1 * time.Millisecond) // Minimal delay instead of 250ms * queue_depth
-	logger.Info("device initialization complete")
-
-	if options.Logger != nil {
-		options.Logger.Printf("Device created: %s (ID: %d) with %d queues", device.Path, device.ID, numQueues)
+	device.life.Lock()
+	defer device.life.Unlock()
+	if err := device.startWith(ctx, ctrl.WithTimeout(device.options.controlTimeout())); err != nil {
+		_ = ctrl.DeleteDevice(device.ID) // Cleanup, ignore error
+		device.removeRecord()
+		return nil, err
 	}
-
 	return device, nil
 }
 
@@ -324,208 +605,275 @@ func CreateAndServe(ctx context.Context, params DeviceParams, options *Options)
 //	}
 //	// Device is now serving I/O
 func Create(params DeviceParams, options *Options) (*Device, error) {
+	// Create controller
+	controller, err := createController(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create controller: %w", err)
+	}
+	defer controller.Close()
+
+	return create(context.Background(), controller, nil, params, options)
+}
+
+// create adds and configures a device using controller without starting
+// it. manager is nil for standalone devices; ctx bounds the control
+// command retries.
+func create(
+	ctx context.Context, controller *ctrl.Controller, manager *Manager, params DeviceParams, options *Options,
+) (*Device, error) {
 	if options == nil {
 		options = &Options{}
 	}
+	controller = controller.WithTimeout(options.controlTimeout())
 
-	// Create controller
-	controller, err := createController()
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if err := validateDeviceID(params.DeviceID, params.DeviceIDRange); err != nil {
+		return nil, err
+	}
+	changes, err := newChangeTracker(params)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create controller: %v", err)
+		return nil, err
+	}
+	if err := checkCanAdd(params); err != nil {
+		return nil, err
 	}
-	defer controller.Close()
 
-	// Convert params to internal format
 	ctrlParams := convertToCtrlParams(params)
-
-	// Create device using control plane
-	deviceID, err := controller.AddDevice(&ctrlParams)
+	ctrlParams.NumQueues = resolveNumQueues(params.NumQueues)
+	adder := retryingAdder{ctx: ctx, adder: controller, policy: options.ControlRetry}
+	deviceID, err := addDevice(adder, &ctrlParams, params.DeviceIDRange)
 	if err != nil {
-		return nil, fmt.Errorf("failed to add device: %v", err)
+		return nil, controlFailed("failed to add device", err)
 	}
-
-	// Set parameters
-	err = controller.SetParams(deviceID, &ctrlParams)
+	err = retryControl(ctx, options.ControlRetry, "SET_PARAMS", func() error {
+		return controller.SetParams(deviceID, &ctrlParams)
+	})
 	if err != nil {
 		_ = controller.DeleteDevice(deviceID) // Cleanup, ignore error
-		return nil, fmt.Errorf("failed to set parameters: %v", err)
+		return nil, controlFailed("failed to set parameters", err)
 	}
 
-	// Initialize metrics and observer
+	// ADD_DEV may have settled on fewer queues (see resolveNumQueues)
+	device := newDevice(deviceID, ctrlParams.NumQueues, params, options, manager, changes)
+	device.events.recordDevice(EventCreated)
+	device.saveRecord()
+	if options.Logger != nil {
+		options.Logger.Printf("Device created: %s (ID: %d)", device.Path, device.ID)
+	}
+	return device, nil
+}
+
+// newDevice returns the Device for the kernel device deviceID, not yet
+// serving I/O.
+func newDevice(
+	deviceID uint32, numQueues int, params DeviceParams, options *Options, manager *Manager, changes *changeTracker,
+) *Device {
 	metrics := NewMetrics()
-	var observer Observer
+	var observer Observer = NewMetricsObserver(metrics)
 	if options.Observer != nil {
 		observer = options.Observer
-	} else {
-		observer = NewMetricsObserver(metrics)
 	}
-
-	// Determine actual number of queues (default to number of CPUs)
-	numQueues := params.NumQueues
-	if numQueues == 0 {
-		numQueues = runtime.NumCPU()
-	}
-
-	// Create Device struct
 	device := &Device{
 		ID:        deviceID,
-		Path:      fmt.Sprintf("/dev/ublkb%d", deviceID),
-		CharPath:  fmt.Sprintf("/dev/ublkc%d", deviceID),
+		Path:      options.blockPath(deviceID),
+		CharPath:  options.charPath(deviceID),
 		Backend:   params.Backend,
-		queues:    numQueues,
+		queues:    numQueues, // Store actual queue count, not params value
 		depth:     params.QueueDepth,
 		blockSize: params.LogicalBlockSize,
-		started:   false,
-		closed:    false,
 		params:    params,
 		options:   options,
+		manager:   manager,
 		metrics:   metrics,
 		observer:  observer,
+		events:    newEventLog(params.EventLogSize),
+		changes:   changes,
+		budget:    queue.NewByteBudget(params.MaxInFlightBytes),
+		barrier:   newWriteBarrier(params.StrictFlush),
+		failed:    make(chan struct{}),
 	}
-
-	if options.Logger != nil {
-		options.Logger.Printf("Device created: %s (ID: %d) - call Start() to begin I/O", device.Path, device.ID)
+	if options.Trace != nil {
+		device.trace = NewTraceWriter(options.Trace, params.LogicalBlockSize)
 	}
-
-	return device, nil
+	device.slowIO = newSlowIOLog(device.ID, options.SlowIOThreshold)
+	return device
 }
 
-// Start begins serving I/O requests for a device created with Create().
-// The context controls the lifetime of I/O processing.
-// Returns an error if the device is already started or has been closed.
+// Start begins serving I/O requests for a device created with Create(), or
+// resumes a device paused by Stop(). The context controls the lifetime of
+// I/O processing. Returns an error if the device is already started or has
+// been closed, and ErrRestartNotSupported if it was stopped without
+// DeviceParams.EnableRecovery.
 func (d *Device) Start(ctx context.Context) error {
 	if d == nil {
 		return ErrInvalidParameters
 	}
+	d.life.Lock()
+	defer d.life.Unlock()
+	return d.start(ctx)
+}
+
+// start implements Start; the caller holds d.life.
+func (d *Device) start(ctx context.Context) error {
 	if d.closed {
 		return fmt.Errorf("device is closed")
 	}
 	if d.started {
 		return fmt.Errorf("device is already started")
 	}
-	if ctx == nil {
-		ctx = context.Background()
+	if d.halted {
+		return NewError("START_DEV", ErrCodeRestartNotSupported,
+			"device was stopped without EnableRecovery; close it and create a new one")
 	}
 
-	d.ctx, d.cancel = context.WithCancel(ctx)
-
-	// Open character device once (kernel only allows single open)
-	// Share the fd among all queues (each queue dups it)
-	logger := logging.Default()
-	charPath := fmt.Sprintf("/dev/ublkc%d", d.ID)
-	charDeviceFd := -1
-	for i := 0; i < constants.CharDeviceOpenRetries; i++ {
-		var err error
-		charDeviceFd, err = syscall.Open(charPath, syscall.O_RDWR, 0)
-		if err == nil {
-			logger.Info("opened char device for multi-queue", "fd", charDeviceFd, "path", charPath)
-			break
-		}
-		if err != syscall.ENOENT {
-			return fmt.Errorf("failed to open %s: %v", charPath, err)
-		}
-		time.Sleep(100 * time.Millisecond)
-	}
-	if charDeviceFd < 0 {
-		return fmt.Errorf("character device did not appear: %s", charPath)
+	// Use the manager's controller, or a temporary one
+	controller, release, err := d.controller()
+	if err != nil {
+		return fmt.Errorf("failed to create controller for start: %v", err)
 	}
+	defer release()
+	return d.startWith(ctx, controller)
+}
 
-	// Initialize queue runners
-	d.runners = make([]*queue.Runner, d.queues)
-	for i := 0; i < d.queues; i++ {
-		runnerConfig := queue.Config{
-			DevID:       d.ID,
-			QueueID:     uint16(i),
-			Depth:       d.depth,
-			BlockSize:   d.blockSize,
-			Backend:     d.Backend,
-			Logger:      d.options.Logger,
-			Observer:    d.observer,
-			CPUAffinity: d.params.CPUAffinity,
-			CharFd:      charDeviceFd, // Share the fd (runner will dup it)
-		}
-
-		runner, err := queue.NewRunner(d.ctx, runnerConfig)
-		if err != nil {
-			// Cleanup already created runners
-			for j := 0; j < i; j++ {
-				if d.runners[j] != nil {
-					d.runners[j].Close()
-				}
-			}
-			d.runners = nil
-			return fmt.Errorf("failed to create queue runner %d: %v", i, err)
-		}
-		d.runners[i] = runner
+// startWith starts serving a new or paused device using controller: it
+// readies the backend or puts the device into recovery, starts the queues
+// and sends START_DEV or END_USER_RECOVERY once they have fetched. The
+// caller holds d.life.
+func (d *Device) startWith(ctx context.Context, controller *ctrl.Controller) error {
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	d.startCtx = ctx
 
-	// Start queue runners and submit FETCH_REQs before START_DEV
-	for i := 0; i < d.queues; i++ {
-		if err := d.runners[i].Start(); err != nil {
-			for j := 0; j < len(d.runners); j++ {
-				if d.runners[j] != nil {
-					d.runners[j].Close()
-				}
-			}
-			d.runners = nil
-			return fmt.Errorf("failed to start queue runner %d: %v", i, err)
+	// A paused device must be put into recovery before new queues fetch;
+	// a new one has its backend readied first
+	if d.paused {
+		if err := controller.StartUserRecovery(d.ID); err != nil {
+			return fmt.Errorf("failed to START_USER_RECOVERY: %w", err)
 		}
+	} else if err := preloadBackend(ctx, d.ID, d.Backend); err != nil {
+		return err
 	}
 
+	if err := d.startQueues(ctx); err != nil {
+		return err
+	}
 	// Give kernel time to see FETCH_REQs
 	time.Sleep(constants.QueueInitDelay)
-
-	// Create temporary controller for START_DEV
-	controller, err := createController()
-	if err != nil {
-		for j := 0; j < len(d.runners); j++ {
-			if d.runners[j] != nil {
-				d.runners[j].Close()
-			}
-		}
-		d.runners = nil
-		return fmt.Errorf("failed to create controller for start: %v", err)
-	}
-	defer controller.Close()
-
-	// Submit START_DEV after FETCH_REQs are in place
-	err = controller.StartDevice(d.ID)
-	if err != nil {
-		for j := 0; j < len(d.runners); j++ {
-			if d.runners[j] != nil {
-				d.runners[j].Close()
-			}
-		}
-		d.runners = nil
-		return fmt.Errorf("failed to START_DEV: %v", err)
+	if err := d.goLive(ctx, controller); err != nil {
+		_ = d.closeQueues() // Cleanup, ignore error
+		d.cancel()
+		return err
 	}
 
 	d.started = true
+	d.paused = false
+	d.events.recordDevice(EventStarted)
+	d.saveRecord()
 
 	// Small delay to ensure kernel has processed FETCH_REQs
 	time.Sleep(1 * time.Millisecond)
-	logger.Info("device started")
+	logging.Default().Info("device started")
 
 	if d.options.Logger != nil {
 		d.options.Logger.Printf("Device %s started with %d queues", d.Path, d.queues)
 	}
+	d.startMetricsReporter()
+	d.startTuner()
+	d.startScrubber()
+	d.superviseQueues()
+	return nil
+}
+
+// startQueues opens the character device and starts the queues under a
+// new d.ctx, each submitting its FETCH_REQs.
+func (d *Device) startQueues(ctx context.Context) error {
+	// Open character device once (kernel only allows single open),
+	// waiting for udev to create it unless we create it ourselves, and
+	// share the fd among all queues (each queue dups it)
+	if d.options.CreateNodes {
+		if err := makeCharNode(d.CharPath, d.ID); err != nil {
+			return err
+		}
+	}
+	charDeviceFd, err := devnode.Open(ctx, d.CharPath, d.options.deviceNodeTimeout())
+	if err != nil {
+		return charOpenError(d.ID, d.CharPath, err)
+	}
+	logging.Default().Info("opened char device for multi-queue", "fd", charDeviceFd, "path", d.CharPath)
+
+	// The queues run under d.ctx; a failed start cancels it
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	if d.params.SharedRing {
+		err = d.startGroup(charDeviceFd)
+	} else {
+		err = d.startRunners(charDeviceFd)
+	}
+	closeFd(charDeviceFd) // The queues hold their own dups
+	if err != nil {
+		d.cancel()
+		return err
+	}
+	return nil
+}
 
+// goLive sends START_DEV, or END_USER_RECOVERY for a paused device, once
+// the queues have fetched, and sets up what needs the live block device.
+// On error the caller closes the queues.
+func (d *Device) goLive(ctx context.Context, controller *ctrl.Controller) error {
+	if d.paused {
+		if err := controller.EndUserRecovery(d.ID); err != nil {
+			return controlFailed("failed to END_USER_RECOVERY", err)
+		}
+	} else {
+		err := retryControl(ctx, d.options.ControlRetry, "START_DEV", func() error {
+			return controller.StartDevice(d.ID)
+		})
+		if err != nil {
+			return controlFailed("failed to START_DEV", err)
+		}
+		d.setKernelIOTimeout()
+	}
+	if d.options.CreateNodes {
+		if err := d.MakeBlockNode(d.Path); err != nil {
+			return err
+		}
+	}
+	d.resolveNodes(controller)
+	if d.options.RunAs != nil {
+		// Never keep serving with the privileges the caller wanted gone
+		if err := runAs(*d.options.RunAs); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 // Stop stops I/O processing but keeps the device registered with the kernel.
-// Call Close() for full cleanup, or Start() to resume I/O processing.
+// With DeviceParams.EnableRecovery the block device stays in place and the
+// kernel holds I/O until Start() resumes serving it. Otherwise the block
+// device is removed and the only way forward is Close().
 // Returns an error if the device is not started or has been closed.
 func (d *Device) Stop() error {
 	if d == nil {
 		return ErrInvalidParameters
 	}
+	d.life.Lock()
+	defer d.life.Unlock()
+	return d.stop()
+}
+
+// stop implements Stop; the caller holds d.life.
+func (d *Device) stop() error {
 	if d.closed {
 		return fmt.Errorf("device is closed")
 	}
 	if !d.started {
 		return fmt.Errorf("device is not started")
 	}
+	defer d.saveRecord() // Stopped or paused, however it ends
 
 	// Cancel context to signal goroutines to stop
 	if d.cancel != nil {
@@ -537,48 +885,152 @@ func (d *Device) Stop() error {
 		d.metrics.Stop()
 	}
 
-	// Give goroutines a moment to see the cancellation
-	time.Sleep(10 * time.Millisecond)
-
-	// Stop queue runners
-	for _, runner := range d.runners {
-		if runner != nil {
-			runner.Close()
+	// Stop queue runners (waits for each I/O loop to exit, or for
+	// Options.StopTimeout)
+	queuesErr := d.closeQueues()
+	d.scrub.wait()
+	d.started = false
+	d.events.recordDevice(EventStopped)
+	flushErr := errors.Join(d.flushOnStop(), d.flushTrace())
+	if queuesErr != nil {
+		// STOP_DEV would wait for the requests the stuck queue holds
+		return &Error{
+			Op:    "STOP_DEV",
+			DevID: d.ID,
+			Code:  ErrCodeTimeout,
+			Msg:   "a queue is stuck in a backend call; the device stays in the kernel until Close",
+			Inner: errors.Join(queuesErr, flushErr),
+			Queue: NoQueue,
 		}
 	}
-	d.runners = nil
 
-	// Create controller to stop device
-	controller, err := createController()
+	// Get a controller to stop device
+	controller, release, err := d.controller()
 	if err != nil {
 		return fmt.Errorf("failed to create controller for stop: %v", err)
 	}
-	defer controller.Close()
+	defer release()
+
+	if d.params.EnableRecovery {
+		err = waitQuiesced(controller, d.ID, constants.QuiesceTimeout)
+		if err == nil {
+			d.paused = true
+			if d.options != nil && d.options.Logger != nil {
+				d.options.Logger.Printf("Device %s paused", d.Path)
+			}
+			return flushErr
+		}
+		logging.Default().Warn("device did not quiesce, stopping it instead", "device", d.Path, "error", err)
+	}
 
 	// Stop device in kernel (device stays registered)
-	err = controller.StopDevice(d.ID)
+	d.halted = true
+	if stopErr := controller.StopDevice(d.ID); stopErr != nil {
+		return fmt.Errorf("failed to stop device: %v", stopErr)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to stop device: %v", err)
+		return &Error{
+			Op:    "STOP_DEV",
+			DevID: d.ID,
+			Code:  ErrCodeRestartNotSupported,
+			Msg:   "device could not be paused and was stopped instead",
+			Inner: err,
+			Queue: NoQueue,
+		}
 	}
 
-	d.started = false
-
 	if d.options != nil && d.options.Logger != nil {
 		d.options.Logger.Printf("Device %s stopped", d.Path)
 	}
 
+	return flushErr
+}
+
+// flushOnStop flushes the backend, once I/O has stopped, if
+// Options.FlushOnStop asks for it, and records how long it took. A flush
+// that outlasts the timeout is left running and reported as failed.
+func (d *Device) flushOnStop() error {
+	if d.options == nil || !d.options.FlushOnStop || d.Backend == nil {
+		return nil
+	}
+	timeout := d.options.flushOnStopTimeout()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- d.Backend.Flush() }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case err = <-done:
+	case <-timer.C:
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	elapsed := time.Since(start)
+	if d.metrics != nil {
+		d.metrics.RecordFlush(uint64(elapsed.Nanoseconds()), err == nil)
+		d.metrics.StopFlushNs.Store(uint64(elapsed.Nanoseconds()))
+	}
+	if err != nil {
+		return &Error{
+			Op:    "FLUSH",
+			DevID: d.ID,
+			Code:  ErrCodeIOError,
+			Msg:   "flushing the backend on stop failed",
+			Inner: err,
+			Queue: NoQueue,
+		}
+	}
+	return nil
+}
+
+// flushTrace writes out the buffered part of the I/O trace, if one is
+// being recorded.
+func (d *Device) flushTrace() error {
+	if d.trace == nil {
+		return nil
+	}
+	if err := d.trace.Flush(); err != nil {
+		return fmt.Errorf("writing I/O trace: %w", err)
+	}
 	return nil
 }
 
+// waitQuiesced polls the kernel until the device reaches the quiesced
+// state that user recovery starts from, which happens once all of its
+// queues have been released.
+func waitQuiesced(controller *ctrl.Controller, id uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		info, err := controller.GetDeviceInfo(id)
+		if err != nil {
+			return err
+		}
+		switch info.State {
+		case uapi.UBLK_S_DEV_QUIESCED:
+			return nil
+		case uapi.UBLK_S_DEV_DEAD:
+			return fmt.Errorf("device is dead, not quiesced")
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("device still live after %v", timeout)
+		}
+		time.Sleep(constants.DevicePollingInterval)
+	}
+}
+
 // Close performs full cleanup: stops I/O (if running) and removes the device.
 // After Close(), the device cannot be reused.
 func (d *Device) Close() error {
 	if d == nil {
 		return ErrInvalidParameters
 	}
+	d.life.Lock()
+	defer d.life.Unlock()
 	if d.closed {
 		return nil // Already closed, idempotent
 	}
+	var flushErr error
 
 	// Stop first if running
 	if d.started {
@@ -592,24 +1044,22 @@ func (d *Device) Close() error {
 			d.metrics.Stop()
 		}
 
-		time.Sleep(10 * time.Millisecond)
-
-		// Stop queue runners
-		for _, runner := range d.runners {
-			if runner != nil {
-				runner.Close()
-			}
-		}
-		d.runners = nil
+		// Stop queue runners (waits for each I/O loop to exit, or for
+		// Options.StopTimeout; STOP_DEV below then waits for a stuck
+		// backend call to return)
+		_ = d.closeQueues()
+		d.scrub.wait()
 		d.started = false
+		d.events.recordDevice(EventStopped)
+		flushErr = errors.Join(d.flushOnStop(), d.flushTrace())
 	}
 
-	// Create controller for cleanup
-	controller, err := createController()
+	// Get a controller for cleanup
+	controller, release, err := d.controller()
 	if err != nil {
 		return fmt.Errorf("failed to create controller for close: %v", err)
 	}
-	defer controller.Close()
+	defer release()
 
 	// Stop device if not already stopped
 	// Ignore error here - device might already be stopped
@@ -622,12 +1072,18 @@ func (d *Device) Close() error {
 	}
 
 	d.closed = true
+	d.events.recordDevice(EventClosed)
+	d.removeRecord()
+	d.dumpEvents()
+	if d.manager != nil {
+		d.manager.remove(d)
+	}
 
 	if d.options != nil && d.options.Logger != nil {
 		d.options.Logger.Printf("Device %s closed", d.Path)
 	}
 
-	return nil
+	return flushErr
 }
 
 // DeviceState represents the current state of a ublk device
@@ -640,6 +1096,9 @@ const (
 	DeviceStateRunning DeviceState = "running"
 	// DeviceStateStopped indicates the device has been stopped but is still registered
 	DeviceStateStopped DeviceState = "stopped"
+	// DeviceStatePaused indicates I/O processing is stopped and the kernel
+	// is holding I/O until Start resumes it (DeviceParams.EnableRecovery)
+	DeviceStatePaused DeviceState = "paused"
 	// DeviceStateClosed indicates the device has been fully closed and removed
 	DeviceStateClosed DeviceState = "closed"
 )
@@ -654,6 +1113,14 @@ func (d *Device) State() DeviceState {
 		return DeviceStateClosed
 	}
 
+	if d.paused {
+		return DeviceStatePaused
+	}
+
+	if d.halted && !d.started {
+		return DeviceStateStopped
+	}
+
 	if !d.started {
 		return DeviceStateCreated
 	}
@@ -763,9 +1230,373 @@ func (d *Device) MetricsSnapshot() MetricsSnapshot {
 	return d.metrics.Snapshot()
 }
 
-// createController creates a new control plane controller
-func createController() (*ctrl.Controller, error) {
-	return ctrl.NewController()
+// startMetricsReporter exports metrics as configured in Options until the
+// device context is cancelled by Stop or Close.
+func (d *Device) startMetricsReporter() {
+	reporter := newMetricsReporter(d.metrics, filepath.Base(d.Path), d.options)
+	if reporter != nil {
+		go reporter.run(d.ctx)
+	}
+}
+
+// errnoMapper combines Options.ErrnoMapper with the mapping for *Error
+// values; the queue runner applies its default mapping after both.
+func (d *Device) errnoMapper() func(error) syscall.Errno {
+	var custom ErrnoMapper
+	if d.options != nil {
+		custom = d.options.ErrnoMapper
+	}
+	return func(err error) syscall.Errno {
+		if custom != nil {
+			if errno := custom(err); errno != 0 {
+				return errno
+			}
+		}
+		return errnoForError(err)
+	}
+}
+
+// startRunners creates and starts one runner, ring and thread per queue.
+// Each runner is started (FETCH_REQs submitted) before the next is created.
+func (d *Device) startRunners(charFd int) error {
+	d.runners = make([]*queue.Runner, d.queues)
+	for i := 0; i < d.queues; i++ {
+		runner, err := queue.NewRunner(d.ctx, d.runnerConfig(i, charFd))
+		if err != nil {
+			_ = d.closeQueues() // Cleanup, ignore error
+			return fmt.Errorf("failed to create queue runner %d: %v", i, err)
+		}
+		d.runners[i] = runner
+
+		if err := runner.Start(); err != nil {
+			_ = d.closeQueues() // Cleanup, ignore error
+			return fmt.Errorf("failed to start queue runner %d: %v", i, err)
+		}
+	}
+	d.accountQueueCPU(d.runners)
+	d.accountQueueRings(d.runners)
+	d.watchQueues(d.runners, d.runners)
+	return nil
+}
+
+// startGroup creates and starts all queues on a single shared ring.
+func (d *Device) startGroup(charFd int) error {
+	configs := make([]queue.Config, d.queues)
+	for i := range configs {
+		configs[i] = d.runnerConfig(i, charFd)
+	}
+	group, err := queue.NewGroup(d.ctx, configs)
+	if err != nil {
+		return fmt.Errorf("failed to create shared queue group: %v", err)
+	}
+	if err := group.Start(); err != nil {
+		group.Close()
+		return fmt.Errorf("failed to start shared queue group: %v", err)
+	}
+	d.group = group
+	d.runners = group.Runners()
+	d.accountQueueCPU(d.runners[:1]) // One thread serves them all
+	d.accountQueueRings(d.runners[:1])
+	d.watchQueues(d.runners, d.runners[:1])
+	return nil
+}
+
+// accountQueueCPU points the metrics at the CPU time of the threads
+// serving runners. The runners keep their final times once closed, so the
+// metrics still show them after Stop.
+func (d *Device) accountQueueCPU(runners []*queue.Runner) {
+	if d.metrics == nil {
+		return
+	}
+	runners = slices.Clone(runners)
+	d.metrics.setQueueCPU(func() []QueueCPU {
+		cpu := make([]QueueCPU, len(runners))
+		for i, runner := range runners {
+			user, system := runner.CPUTime()
+			cpu[i] = QueueCPU{Queue: i, UserNs: uint64(user), SystemNs: uint64(system)}
+		}
+		return cpu
+	})
+}
+
+// accountQueueRings points the metrics at the statistics of the rings
+// serving runners, skipping rings that do not keep any. Like the CPU
+// times, they still read after Stop.
+func (d *Device) accountQueueRings(runners []*queue.Runner) {
+	if d.metrics == nil {
+		return
+	}
+	runners = slices.Clone(runners)
+	d.metrics.setQueueRings(func() []QueueRingStats {
+		var rings []QueueRingStats
+		for i, runner := range runners {
+			reporter, ok := runner.Ring().(uring.StatsReporter)
+			if !ok {
+				continue
+			}
+			stats := QueueRingStats{Queue: i, RingStats: reporter.RingStats()}
+			if p, ok := runner.Ring().(uring.ParamsReporter); ok {
+				params := p.Params()
+				stats.SQEntries, stats.CQEntries = params.SQEntries, params.CQEntries
+			}
+			rings = append(rings, stats)
+		}
+		return rings
+	})
+}
+
+// closeQueues releases all queue runners and, in shared mode, the ring,
+// stopping them concurrently within Options.StopTimeout. It returns
+// queue.ErrStopTimeout if a queue is stuck in a backend call; that queue
+// is released once the call returns.
+func (d *Device) closeQueues() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.options.stopTimeout())
+	defer cancel()
+
+	var err error
+	if d.group != nil {
+		err = d.group.CloseContext(ctx)
+		d.group = nil
+	} else {
+		errs := make([]error, len(d.runners))
+		var wg sync.WaitGroup
+		for i, runner := range d.runners {
+			if runner != nil {
+				wg.Go(func() { errs[i] = runner.CloseContext(ctx) })
+			}
+		}
+		wg.Wait()
+		err = errors.Join(errs...)
+	}
+	d.runners = nil
+	return err
+}
+
+// runnerConfig builds the queue runner configuration for queue i.
+// charFd is the shared character device fd (each runner dups it).
+func (d *Device) runnerConfig(i int, charFd int) queue.Config {
+	config := queue.Config{
+		DevID:       d.ID,
+		QueueID:     uint16(i),
+		Depth:       d.depth,
+		Backend:     d.Backend,
+		RawHandler:  d.rawHandler(),
+		Observer:    newEventObserver(d.observer, d.events),
+		CPUAffinity: d.params.CPUAffinity,
+		CharFd:      charFd,
+		Workers:     d.params.BackendWorkers,
+
+		StallThreshold:      d.params.StallThreshold,
+		DepthSampleInterval: d.params.DepthSampleInterval,
+		IOTimeout:           d.params.IOTimeout,
+		MaxIOBytes:          d.params.MaxIOSize,
+		MaxReadAhead:        d.params.MaxReadAhead,
+		ErrnoMapper:         d.errnoMapper(),
+
+		DiscardGranularity: d.params.DiscardGranularity,
+		MaxDiscardSectors:  d.params.MaxDiscardSectors,
+
+		Gate:          &d.gate,
+		InFlightBytes: d.budget,
+		FlushBarrier:  d.barrier,
+		Activity:      &d.activity,
+	}
+	if workers := uint32(max(d.params.IOWQMaxWorkers, 0)); workers > 0 || len(d.params.IOWQCPUs) > 0 {
+		config.IOWQ = uring.IOWQConfig{MaxBounded: workers, MaxUnbounded: workers, CPUs: d.params.IOWQCPUs}
+	}
+	if d.changes != nil {
+		config.OnWrite = d.changes.record
+	}
+	config.AttachWQ = d.workerRing(i)
+	config.Trace = d.requestHook()
+	config.OnCQOverflow = d.cqOverflow
+	config.OnUnknownOp = d.unknownOp
+	config.OnUnknownFlags = d.unknownFlags
+	if d.options != nil {
+		config.Logger = queueLogger(d.options.Logger)
+		config.UnknownOp = d.options.UnknownOpHandler
+		config.NewRing = d.options.RingProvider
+		config.BufferAllocator = d.options.BufferAllocator
+	}
+	return config
+}
+
+// workerRing returns the ring queue i's ring shares workers with under
+// DeviceParams.IOWQSharing, or nil for a pool of its own.
+func (d *Device) workerRing(i int) uring.QueueRing {
+	switch d.params.IOWQSharing {
+	case IOWQShareDefault, IOWQShareNone:
+		return nil
+	case IOWQShareManager:
+		if d.manager != nil {
+			return d.manager.workerRing()
+		}
+	}
+	// IOWQShareDevice: queue 0's ring, once it exists; a shared ring
+	// serves every queue anyway
+	if i == 0 || d.params.SharedRing || len(d.runners) == 0 || d.runners[0] == nil {
+		return nil
+	}
+	return d.runners[0].Ring()
+}
+
+// requestHook returns the queue.Config.Trace hook feeding the I/O trace
+// and the slow I/O log, or nil if neither is on.
+func (d *Device) requestHook() queue.TraceFunc {
+	switch {
+	case d.trace == nil && d.slowIO == nil:
+		return nil
+	case d.slowIO == nil:
+		return d.trace.record
+	case d.trace == nil:
+		return d.slowIO.record
+	}
+	return func(
+		queueID, tag uint16, desc uapi.UblksrvIODesc, start time.Time, latency time.Duration, errno syscall.Errno,
+	) {
+		d.trace.record(queueID, tag, desc, start, latency, errno)
+		d.slowIO.record(queueID, tag, desc, start, latency, errno)
+	}
+}
+
+// queueLogger returns the logger for the queues: the queue component of
+// logger if it is the library's own, so its level can be set apart (see
+// SetComponentLogLevel), and logger itself otherwise.
+func queueLogger(logger Logger) Logger {
+	if l, ok := logger.(*logging.Logger); ok && l != nil {
+		return l.Component(logging.ComponentQueue)
+	}
+	return logger
+}
+
+// newWriteBarrier returns the device's flush barrier, or nil if strict is
+// not set.
+func newWriteBarrier(strict bool) *queue.WriteBarrier {
+	if !strict {
+		return nil
+	}
+	return queue.NewWriteBarrier()
+}
+
+// cqOverflow counts and logs completions a queue's ring had to collect
+// from the kernel's backlog because its CQ was full. It has the signature
+// of queue.Config.OnCQOverflow.
+func (d *Device) cqOverflow(queueID uint16, n uint64) {
+	if d.metrics != nil {
+		d.metrics.CQOverflows.Add(n)
+	}
+	logging.Default().Warn("completion queue overflowed", "device", d.Path, "queue", queueID, "times", n)
+}
+
+// unknownOp counts a request whose op the queues do not handle and logs
+// the op the first time. It has the signature of
+// queue.Config.OnUnknownOp.
+func (d *Device) unknownOp(queueID uint16, op uint8) {
+	if d.metrics != nil {
+		d.metrics.UnknownOps.Add(1)
+	}
+	bit := uint64(1) << (op % 64)
+	if d.unknownOpsLogged[op/64].Or(bit)&bit == 0 {
+		logging.Default().Warn("kernel sent a request op this version does not handle",
+			"device", d.Path, "queue", queueID, "op", op)
+	}
+}
+
+// unknownFlags counts a request carrying UBLK_IO_F_* bits the queues do not
+// know and logs each bit the first time. It has the signature of
+// queue.Config.OnUnknownFlags.
+func (d *Device) unknownFlags(queueID uint16, flags uint32) {
+	if d.metrics != nil {
+		d.metrics.UnknownFlags.Add(1)
+	}
+	if d.unknownFlagsLogged.Or(flags)&flags != flags {
+		logging.Default().Warn("kernel sent request flags this version does not know; serving without them",
+			"device", d.Path, "queue", queueID, "flags", fmt.Sprintf("%#x", flags))
+	}
+}
+
+// charOpenError explains a failure to open device id's char device at
+// path. EBUSY means another server has it open, and is reported as
+// ErrDeviceBusy naming that process if it can be found.
+func charOpenError(id uint32, path string, err error) error {
+	if !errors.Is(err, syscall.EBUSY) {
+		return err
+	}
+	busy := &DeviceBusyError{Path: path, PID: devnode.Holder(path)}
+	return &Error{
+		Op:    "OPEN",
+		DevID: id,
+		Code:  ErrCodeDeviceBusy,
+		Errno: syscall.EBUSY,
+		Msg:   busy.Error() + "; a device takes one server at a time",
+		Inner: busy,
+		Queue: NoQueue,
+	}
+}
+
+// preloadBackend calls backend's Preload, if it has one. A failure is
+// reported as a PRELOAD error of device id.
+func preloadBackend(ctx context.Context, id uint32, backend Backend) error {
+	preloader, ok := backend.(PreloadBackend)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	if err := preloader.Preload(ctx); err != nil {
+		code := ErrCodeIOError
+		if ctx.Err() != nil {
+			code = ErrCodeTimeout
+		}
+		return &Error{
+			Op:    "PRELOAD",
+			DevID: id,
+			Code:  code,
+			Msg:   "backend preload failed",
+			Inner: err,
+			Queue: NoQueue,
+		}
+	}
+	logging.Default().Info("backend preloaded", "device", id, "duration", time.Since(start))
+	return nil
+}
+
+// controlFailed wraps err from a control command in msg, unless the
+// kernel never completed the command: that is an ErrCodeTimeout error
+// naming the stuck command.
+func controlFailed(msg string, err error) error {
+	var timeout *ctrl.TimeoutError
+	if !errors.As(err, &timeout) {
+		return fmt.Errorf("%s: %w", msg, err)
+	}
+	id := timeout.DevID
+	if id == math.MaxUint32 {
+		id = 0 // ADD_DEV with the ID left to the kernel
+	}
+	return controlError(timeout.Op, id, err)
+}
+
+// createController creates a new control plane controller, loading
+// ublk_drv first if options ask for it. Its commands time out after
+// Options.ControlTimeout.
+func createController(options *Options) (*ctrl.Controller, error) {
+	c, err := openController(options != nil && options.LoadModule)
+	if err != nil {
+		return nil, err
+	}
+	return c.WithTimeout(options.controlTimeout()), nil
+}
+
+// controller returns the control plane for d: its Manager's shared
+// controller, or a new one. The caller must call release when done.
+func (d *Device) controller() (c *ctrl.Controller, release func(), err error) {
+	if d.manager != nil {
+		return d.manager.ctrl.WithTimeout(d.options.controlTimeout()), func() {}, nil
+	}
+	c, err = createController(d.options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func() { c.Close() }, nil
 }
 
 // convertToCtrlParams converts public DeviceParams to internal ctrl.DeviceParams
@@ -777,13 +1608,18 @@ func convertToCtrlParams(params DeviceParams) ctrl.DeviceParams {
 	ctrlParams.QueueDepth = params.QueueDepth
 	ctrlParams.NumQueues = params.NumQueues
 	ctrlParams.LogicalBlockSize = params.LogicalBlockSize
-	ctrlParams.MaxIOSize = params.MaxIOSize
+	ctrlParams.PhysicalBlockSize = params.PhysicalBlockSize
+	// Each tag has one fixed-size buffer, so never let the kernel send more
+	ctrlParams.MaxIOSize = min(params.MaxIOSize, constants.IOBufferSizePerTag)
 
 	ctrlParams.EnableZeroCopy = params.EnableZeroCopy
 	ctrlParams.EnableUnprivileged = params.EnableUnprivileged
 	ctrlParams.EnableUserCopy = params.EnableUserCopy
 	ctrlParams.EnableZoned = params.EnableZoned
 	ctrlParams.EnableIoctlEncode = params.EnableIoctlEncode
+	ctrlParams.EnableRecovery = params.EnableRecovery
+	ctrlParams.NoPartitionScan = params.NoPartitionScan
+	ctrlParams.EnableResize = params.EnableResize
 
 	ctrlParams.ReadOnly = params.ReadOnly
 	ctrlParams.Rotational = params.Rotational
@@ -794,6 +1630,12 @@ func convertToCtrlParams(params DeviceParams) ctrl.DeviceParams {
 	ctrlParams.DiscardGranularity = params.DiscardGranularity
 	ctrlParams.MaxDiscardSectors = params.MaxDiscardSectors
 	ctrlParams.MaxDiscardSegments = params.MaxDiscardSegments
+	ctrlParams.MaxWriteZeroesSectors = params.MaxWriteZeroesSectors
+
+	ctrlParams.VirtBoundaryMask = params.VirtBoundaryMask
+	ctrlParams.MaxSegments = params.MaxSegments
+	ctrlParams.MaxSegmentSize = params.MaxSegmentSize
+	ctrlParams.SegmentBoundaryMask = params.SegmentBoundaryMask
 
 	ctrlParams.DeviceName = params.DeviceName
 	ctrlParams.CPUAffinity = params.CPUAffinity
@@ -801,4 +1643,92 @@ func convertToCtrlParams(params DeviceParams) ctrl.DeviceParams {
 	return ctrlParams
 }
 
+// FieldError is a DeviceParams field that Validate rejected.
+type FieldError struct {
+	Field string // The field's name, e.g. "QueueDepth"
+	Msg   string // What is wrong with its value
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Msg
+}
+
+// Validate checks params against what the driver, the block layer and the
+// library accept, so a bad value fails with a reason rather than as a bare
+// EINVAL from the kernel. Create and CreateAndServe call it. It reports
+// every invalid field at once: the error matches ErrInvalidParameters and
+// wraps a *FieldError for each field, which errors.As finds.
+func (params DeviceParams) Validate() error {
+	var errs []error
+	invalid := func(field, format string, args ...any) {
+		errs = append(errs, &FieldError{Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if params.Backend == nil {
+		invalid("Backend", "is nil")
+	}
+	if d := params.QueueDepth; d < 1 || d > MaxQueueDepth {
+		invalid("QueueDepth", "%d is outside 1-%d", d, MaxQueueDepth)
+	}
+	if n := params.NumQueues; n < 0 || n > MaxQueues {
+		invalid("NumQueues", "%d is outside 0-%d (0 = one per CPU)", n, MaxQueues)
+	}
+
+	// The kernel takes block sizes as shifts, from a sector up to a page,
+	// and a block must fit in one tag's buffer
+	logical := params.LogicalBlockSize
+	maxBlock := min(os.Getpagesize(), constants.IOBufferSizePerTag)
+	if !isPowerOfTwo(logical) || logical < MinLogicalBlockSize || logical > maxBlock {
+		invalid("LogicalBlockSize", "%d is not a power of two from %d to %d", logical, MinLogicalBlockSize, maxBlock)
+	} else {
+		if b := params.PhysicalBlockSize; b != 0 && (!isPowerOfTwo(b) || b < logical) {
+			invalid("PhysicalBlockSize", "%d is not a power of two of at least the %d-byte logical block", b, logical)
+		}
+		// Larger values are capped at the tag buffer, which stays a
+		// multiple of any valid block size
+		if s := params.MaxIOSize; s < logical || min(s, constants.IOBufferSizePerTag)%logical != 0 {
+			invalid("MaxIOSize", "%d is not a positive multiple of the %d-byte logical block", s, logical)
+		}
+	}
+
+	if params.EnableZeroCopy && params.EnableUserCopy {
+		invalid("EnableUserCopy", "cannot be combined with EnableZeroCopy")
+	}
+
+	// Scatter/gather limits
+	if m := params.VirtBoundaryMask; m != 0 && m&(m+1) != 0 {
+		invalid("VirtBoundaryMask", "%#x is not a power of two minus one", m)
+	}
+	if m := params.SegmentBoundaryMask; m != 0 && (m&(m+1) != 0 || m < MinSegmentSize-1) {
+		invalid("SegmentBoundaryMask", "%#x is not a power of two minus one of at least %#x",
+			m, MinSegmentSize-1)
+	}
+	if s := params.MaxSegmentSize; s != 0 && s < MinSegmentSize {
+		invalid("MaxSegmentSize", "%d is below the minimum of %d", s, MinSegmentSize)
+	}
+	if params.MaxSegmentSize != 0 && params.VirtBoundaryMask != 0 {
+		invalid("MaxSegmentSize", "cannot be combined with VirtBoundaryMask")
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return &Error{
+		Op:    "CREATE",
+		Queue: NoQueue,
+		Code:  ErrCodeInvalidParameters,
+		Msg:   "invalid device parameters: " + strings.Join(msgs, "; "),
+		Inner: errors.Join(errs...),
+	}
+}
+
+// isPowerOfTwo reports whether n is a positive power of two.
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
 // Error definitions moved to errors.go
@@ -0,0 +1,605 @@
+// Package dedup provides a content-addressed backend. Volumes store their
+// data as 4 KiB blocks keyed by SHA-256 in a shared block store, so
+// identical blocks, within one volume or across many cloned from the same
+// golden image, are kept once.
+//
+// A store is a directory holding a blocks file of fixed-size slots and one
+// map file per volume that points each virtual block at a slot. Reference
+// counts and the hash index are not persisted; Open rebuilds them from the
+// maps, which also reclaims slots leaked by a crash between writing a
+// block and updating a map.
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// BlockSize is the deduplication unit. Devices should use it as their
+// logical block size; smaller writes are read-modify-write.
+const BlockSize = 4096
+
+const (
+	blocksFile   = "blocks"
+	volumeExt    = ".vol"
+	volumeHeader = 16 // magic and size
+	unmapped     = 0  // map entry for a block that reads as zeros; zero blocks are never stored
+)
+
+var volumeMagic = []byte("UBLKDDV1")
+
+type hash = [sha256.Size]byte
+
+// Store is a block store shared by volumes. It is safe for concurrent use.
+type Store struct {
+	dir    string
+	blocks *os.File
+
+	// mu guards everything below and the entries of every volume. Reads
+	// hold it shared so a slot cannot be freed and reused under them.
+	mu      sync.RWMutex
+	index   map[hash]uint64 // content hash to slot
+	hashes  []hash          // per slot
+	refs    []uint32        // per slot; 0 means free
+	free    []uint64        // free slots, reused before the file grows
+	pending []uint64        // freed slots an unsynced map may still point at
+	stored  uint64          // slots in use
+	mapped  uint64          // sum of refs
+	volumes map[string]*volume
+}
+
+// volume is the in-memory map of a volume, loaded for every volume at Open
+// so reference counts cover them all.
+type volume struct {
+	f       *os.File
+	size    int64
+	entries []uint64 // slot+1, or unmapped
+	open    bool
+}
+
+// Open opens or creates the store in dir.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	blocks, err := os.OpenFile(filepath.Join(dir, blocksFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:     dir,
+		blocks:  blocks,
+		index:   make(map[hash]uint64),
+		volumes: make(map[string]*volume),
+	}
+	if err := s.load(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads every volume map, counts references and hashes each slot in
+// use to rebuild the index.
+func (s *Store) load() error {
+	fi, err := s.blocks.Stat()
+	if err != nil {
+		return err
+	}
+	slots := uint64(fi.Size() / BlockSize)
+	s.refs = make([]uint32, slots)
+	s.hashes = make([]hash, slots)
+
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+volumeExt))
+	if err != nil {
+		return err
+	}
+	for _, path := range names {
+		name := strings.TrimSuffix(filepath.Base(path), volumeExt)
+		v, err := loadVolume(path)
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", name, err)
+		}
+		s.volumes[name] = v
+		for i, e := range v.entries {
+			if e == unmapped {
+				continue
+			}
+			if e-1 >= slots {
+				return fmt.Errorf("volume %s: block %d points past the block store", name, i)
+			}
+			s.refs[e-1]++
+			s.mapped++
+		}
+	}
+
+	buf := make([]byte, BlockSize)
+	for slot := range slots {
+		if s.refs[slot] == 0 {
+			s.free = append(s.free, slot)
+			continue
+		}
+		if _, err := s.blocks.ReadAt(buf, int64(slot)*BlockSize); err != nil {
+			return fmt.Errorf("read slot %d: %w", slot, err)
+		}
+		h := sha256.Sum256(buf)
+		s.hashes[slot] = h
+		s.index[h] = slot
+		s.stored++
+	}
+	return nil
+}
+
+func loadVolume(path string) (*volume, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, volumeHeader)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if !bytes.Equal(hdr[:8], volumeMagic) {
+		f.Close()
+		return nil, errors.New("not a volume map")
+	}
+	v := &volume{f: f, size: int64(binary.LittleEndian.Uint64(hdr[8:]))}
+	raw := make([]byte, numBlocks(v.size)*8)
+	if _, err := f.ReadAt(raw, volumeHeader); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read map: %w", err)
+	}
+	v.entries = make([]uint64, numBlocks(v.size))
+	for i := range v.entries {
+		v.entries[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+	return v, nil
+}
+
+// checkName rejects volume names that are empty or not a plain file name.
+func checkName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	return nil
+}
+
+func numBlocks(size int64) int64 {
+	return (size + BlockSize - 1) / BlockSize
+}
+
+// Volume opens the named volume, creating it with the given size if it
+// does not exist. A size of 0 opens an existing volume at its own size.
+// A volume can only be open once at a time.
+func (s *Store) Volume(name string, size int64) (*Volume, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	if size < 0 || size%BlockSize != 0 {
+		return nil, fmt.Errorf("volume size %d is not a multiple of %d", size, BlockSize)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.volumes[name]
+	switch {
+	case !ok && size == 0:
+		return nil, fmt.Errorf("volume %s does not exist", name)
+	case !ok:
+		var err error
+		if v, err = s.createVolume(name, size); err != nil {
+			return nil, err
+		}
+		s.volumes[name] = v
+	case size != 0 && size != v.size:
+		return nil, fmt.Errorf("volume %s is %d bytes, not %d", name, v.size, size)
+	case v.open:
+		return nil, fmt.Errorf("volume %s is already open", name)
+	}
+	v.open = true
+	return &Volume{s: s, name: name, v: v}, nil
+}
+
+func (s *Store) createVolume(name string, size int64) (*volume, error) {
+	path := filepath.Join(s.dir, name+volumeExt)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, volumeHeader)
+	copy(hdr, volumeMagic)
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(size))
+	if _, err := f.WriteAt(hdr, 0); err == nil {
+		err = f.Truncate(volumeHeader + numBlocks(size)*8)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return &volume{f: f, size: size, entries: make([]uint64, numBlocks(size))}, nil
+}
+
+// copyVolume creates volume name with the same blocks as src, taking a
+// reference on each. The caller holds mu.
+func (s *Store) copyVolume(src *volume, name string) (*volume, error) {
+	if _, ok := s.volumes[name]; ok {
+		return nil, fmt.Errorf("volume %s already exists", name)
+	}
+	v, err := s.createVolume(name, src.size)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]byte, len(src.entries)*8)
+	for i, e := range src.entries {
+		binary.LittleEndian.PutUint64(raw[i*8:], e)
+	}
+	if _, err := v.f.WriteAt(raw, volumeHeader); err != nil {
+		v.f.Close()
+		os.Remove(v.f.Name())
+		return nil, err
+	}
+	copy(v.entries, src.entries)
+	for _, e := range v.entries {
+		if e != unmapped {
+			s.refs[e-1]++
+			s.mapped++
+		}
+	}
+	s.volumes[name] = v
+	return v, nil
+}
+
+// Remove deletes a volume that is not open and releases its blocks.
+func (s *Store) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.volumes[name]
+	if !ok {
+		return fmt.Errorf("volume %s does not exist", name)
+	}
+	if v.open {
+		return fmt.Errorf("volume %s is open", name)
+	}
+	if err := os.Remove(v.f.Name()); err != nil {
+		return err
+	}
+	v.f.Close()
+	for _, e := range v.entries {
+		s.release(e)
+	}
+	delete(s.volumes, name)
+	return nil
+}
+
+// Volumes returns the names of all volumes in the store.
+func (s *Store) Volumes() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.volumes))
+	for name := range s.volumes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Close syncs and closes the store. Volumes must be closed first.
+func (s *Store) Close() error {
+	s.mu.RLock()
+	for name, v := range s.volumes {
+		if v.open {
+			s.mu.RUnlock()
+			return fmt.Errorf("volume %s is still open", name)
+		}
+	}
+	s.mu.RUnlock()
+	return errors.Join(s.sync(), s.closeFiles())
+}
+
+func (s *Store) closeFiles() error {
+	var errs []error
+	for _, v := range s.volumes {
+		errs = append(errs, v.f.Close())
+	}
+	errs = append(errs, s.blocks.Close())
+	return errors.Join(errs...)
+}
+
+// store returns the slot holding data, writing it to a new slot if no
+// slot has the same content, and takes a reference on it. The caller
+// holds mu.
+func (s *Store) store(data []byte, h hash) (uint64, error) {
+	slot, ok := s.index[h]
+	if !ok {
+		if n := len(s.free); n > 0 {
+			slot = s.free[n-1]
+			s.free = s.free[:n-1]
+		} else {
+			slot = uint64(len(s.refs))
+			s.refs = append(s.refs, 0)
+			s.hashes = append(s.hashes, hash{})
+		}
+		if _, err := s.blocks.WriteAt(data, int64(slot)*BlockSize); err != nil {
+			s.free = append(s.free, slot)
+			return 0, err
+		}
+		s.index[h] = slot
+		s.hashes[slot] = h
+		s.stored++
+	}
+	s.refs[slot]++
+	s.mapped++
+	return slot, nil
+}
+
+// release drops the reference a map entry holds. The caller holds mu.
+func (s *Store) release(entry uint64) {
+	if entry == unmapped {
+		return
+	}
+	slot := entry - 1
+	s.mapped--
+	if s.refs[slot]--; s.refs[slot] == 0 {
+		delete(s.index, s.hashes[slot])
+		s.pending = append(s.pending, slot)
+		s.stored--
+	}
+}
+
+// sync makes the blocks durable, then the maps that point at them. Slots
+// freed before the sync become reusable after it: until then a map on disk
+// may still refer to them, and overwriting one would corrupt that volume
+// if the machine crashed.
+func (s *Store) sync() error {
+	s.mu.RLock()
+	released := len(s.pending)
+	files := make([]*os.File, 0, len(s.volumes))
+	for _, v := range s.volumes {
+		files = append(files, v.f)
+	}
+	s.mu.RUnlock()
+
+	if err := s.blocks.Sync(); err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.free = append(s.free, s.pending[:released]...)
+	s.pending = append(s.pending[:0], s.pending[released:]...)
+	s.mu.Unlock()
+	return nil
+}
+
+// Volume is a virtual disk in a Store. It implements ublk.Backend,
+// ublk.DiscardBackend, ublk.StatBackend and ublk.SnapshotBackend.
+type Volume struct {
+	s    *Store
+	name string
+	v    *volume
+}
+
+// ReadAt implements ublk.Backend.
+func (vol *Volume) ReadAt(p []byte, off int64) (int, error) {
+	s := vol.s
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		block, inBlock := pos/BlockSize, pos%BlockSize
+		chunk := p[n:min(len(p), n+int(BlockSize-inBlock))]
+		if e := vol.v.entries[block]; e == unmapped {
+			clear(chunk)
+		} else if _, err := s.blocks.ReadAt(chunk, int64(e-1)*BlockSize+inBlock); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// WriteAt implements ublk.Backend.
+func (vol *Volume) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	buf := make([]byte, BlockSize)
+	for n < len(p) {
+		pos := off + int64(n)
+		block, inBlock := pos/BlockSize, pos%BlockSize
+		chunk := p[n:min(len(p), n+int(BlockSize-inBlock))]
+
+		data := chunk
+		if len(chunk) < BlockSize {
+			// Partial block: merge into the current contents
+			if _, err := vol.ReadAt(buf, block*BlockSize); err != nil {
+				return n, err
+			}
+			copy(buf[inBlock:], chunk)
+			data = buf
+		}
+		if err := vol.setBlock(block, data); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
+
+// setBlock points block at data, which is stored unless it is all zeros.
+// The new block is written before the map entry that refers to it, so a
+// crash never leaves the map pointing at data that was not written.
+func (vol *Volume) setBlock(block int64, data []byte) error {
+	zero := isZero(data)
+	var h hash
+	if !zero {
+		h = sha256.Sum256(data)
+	}
+
+	s := vol.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := uint64(unmapped)
+	if !zero {
+		slot, err := s.store(data, h)
+		if err != nil {
+			return err
+		}
+		entry = slot + 1
+	}
+	old := vol.v.entries[block]
+	if old == entry {
+		s.release(entry) // same content as before; drop the extra reference
+		return nil
+	}
+	if err := vol.writeEntry(block, entry); err != nil {
+		s.release(entry)
+		return err
+	}
+	vol.v.entries[block] = entry
+	s.release(old)
+	return nil
+}
+
+func (vol *Volume) writeEntry(block int64, entry uint64) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], entry)
+	_, err := vol.v.f.WriteAt(b[:], volumeHeader+block*8)
+	return err
+}
+
+// Snapshot implements ublk.SnapshotBackend. The snapshot is a new volume
+// called name sharing every block with this one, so it costs only its map.
+func (vol *Volume) Snapshot(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	s := vol.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.copyVolume(vol.v, name)
+	return err
+}
+
+// Clone implements ublk.SnapshotBackend. The clone is a new volume, opened
+// and returned; an empty name picks "<snapshot>-clone", "-clone2" and so on.
+func (vol *Volume) Clone(snapshot, name string) (ublk.Backend, error) {
+	s := vol.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, ok := s.volumes[snapshot]
+	if !ok {
+		return nil, fmt.Errorf("snapshot %s does not exist", snapshot)
+	}
+	if name == "" {
+		name = snapshot + "-clone"
+		for i := 2; s.volumes[name] != nil; i++ {
+			name = fmt.Sprintf("%s-clone%d", snapshot, i)
+		}
+	} else if err := checkName(name); err != nil {
+		return nil, err
+	}
+	v, err := s.copyVolume(src, name)
+	if err != nil {
+		return nil, err
+	}
+	v.open = true
+	return &Volume{s: s, name: name, v: v}, nil
+}
+
+// Discard implements ublk.DiscardBackend. Whole blocks are unmapped and
+// their references released; partial blocks at the edges are zeroed.
+func (vol *Volume) Discard(offset, length int64) error {
+	zeros := make([]byte, BlockSize)
+	for end := offset + length; offset < end; {
+		n := min(end-offset, BlockSize-offset%BlockSize)
+		if _, err := vol.WriteAt(zeros[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// Size implements ublk.Backend.
+func (vol *Volume) Size() int64 {
+	return vol.v.size
+}
+
+// Flush implements ublk.Backend. Maps of other volumes are synced too, so
+// blocks they released can be reused.
+func (vol *Volume) Flush() error {
+	return vol.s.sync()
+}
+
+// Close releases the volume so it can be opened again. The store stays
+// open.
+func (vol *Volume) Close() error {
+	s := vol.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vol.v.open = false
+	return nil
+}
+
+// Stats implements ublk.StatBackend. The dedup ratio is the number of
+// mapped blocks across all volumes per block actually stored.
+func (vol *Volume) Stats() map[string]interface{} {
+	s := vol.s
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var mapped uint64
+	for _, e := range vol.v.entries {
+		if e != unmapped {
+			mapped++
+		}
+	}
+	ratio := 1.0
+	if s.stored > 0 {
+		ratio = float64(s.mapped) / float64(s.stored)
+	}
+	return map[string]interface{}{
+		"volume_blocks": mapped,
+		"mapped_blocks": s.mapped,
+		"stored_blocks": s.stored,
+		"free_slots":    uint64(len(s.free) + len(s.pending)),
+		"dedup_ratio":   ratio,
+	}
+}
+
+// isZero reports whether p is all zero bytes.
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Compile-time interface checks
+var (
+	_ ublk.Backend         = (*Volume)(nil)
+	_ ublk.DiscardBackend  = (*Volume)(nil)
+	_ ublk.StatBackend     = (*Volume)(nil)
+	_ ublk.SnapshotBackend = (*Volume)(nil)
+)
@@ -0,0 +1,348 @@
+package dedup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func pattern(seed byte) []byte {
+	return bytes.Repeat([]byte{seed, seed + 1, seed + 2, seed + 3}, BlockSize/4)
+}
+
+func openVolume(t *testing.T, s *Store, name string, size int64) *Volume {
+	t.Helper()
+	v, err := s.Volume(name, size)
+	if err != nil {
+		t.Fatalf("Volume(%s): %v", name, err)
+	}
+	return v
+}
+
+func stat(v *Volume, key string) uint64 {
+	return v.Stats()[key].(uint64)
+}
+
+func TestDedupWithinVolume(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := openVolume(t, s, "disk", 16*BlockSize)
+
+	// Eight copies of the same block and a zero block store one block
+	for i := range 8 {
+		if _, err := v.WriteAt(pattern(1), int64(i)*BlockSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := v.WriteAt(make([]byte, BlockSize), 8*BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if got := stat(v, "stored_blocks"); got != 1 {
+		t.Errorf("stored_blocks = %d, want 1", got)
+	}
+	if got := v.Stats()["dedup_ratio"].(float64); got != 8 {
+		t.Errorf("dedup_ratio = %v, want 8", got)
+	}
+
+	got := make([]byte, 9*BlockSize)
+	if _, err := v.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 8 {
+		if !bytes.Equal(got[i*BlockSize:(i+1)*BlockSize], pattern(1)) {
+			t.Errorf("block %d has the wrong data", i)
+		}
+	}
+	if !isZero(got[8*BlockSize:]) {
+		t.Error("zero block does not read as zeros")
+	}
+
+	// Overwriting one copy keeps the shared block for the rest
+	if _, err := v.WriteAt(pattern(9), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := stat(v, "stored_blocks"); got != 2 {
+		t.Errorf("stored_blocks = %d after a divergent write, want 2", got)
+	}
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	v := openVolume(t, s, "disk", 4*BlockSize)
+	defer v.Close()
+
+	want := make([]byte, 4*BlockSize)
+	copy(want, pattern(3))
+	copy(want[BlockSize:], pattern(3))
+	v.WriteAt(want[:2*BlockSize], 0)
+
+	// A 1 KiB write straddling two blocks
+	patch := bytes.Repeat([]byte{0xEE}, 1024)
+	copy(want[BlockSize-512:], patch)
+	if _, err := v.WriteAt(patch, BlockSize-512); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := v.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("partial write was not merged")
+	}
+	// The two blocks diverged, so the original content has no references
+	if got := stat(v, "stored_blocks"); got != 2 {
+		t.Errorf("stored_blocks = %d, want 2", got)
+	}
+}
+
+func TestDedupAcrossVolumesAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A golden image and two clones written with the same content
+	golden := make([]byte, 8*BlockSize)
+	for i := range 8 {
+		copy(golden[i*BlockSize:], pattern(byte(i*4)))
+	}
+	for _, name := range []string{"golden", "vm1", "vm2"} {
+		v := openVolume(t, s, name, int64(len(golden)))
+		if _, err := v.WriteAt(golden, 0); err != nil {
+			t.Fatal(err)
+		}
+		v.Close()
+	}
+	v := openVolume(t, s, "vm1", 0)
+	v.WriteAt(pattern(200), 0) // vm1 diverges in one block
+	if got := stat(v, "stored_blocks"); got != 9 {
+		t.Errorf("stored_blocks = %d, want 9", got)
+	}
+	if got := stat(v, "mapped_blocks"); got != 24 {
+		t.Errorf("mapped_blocks = %d, want 24", got)
+	}
+	v.Close()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reference counts and the index are rebuilt from the maps
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := len(s.Volumes()); got != 3 {
+		t.Errorf("%d volumes after reopen, want 3", got)
+	}
+	v = openVolume(t, s, "vm2", 0)
+	if got := stat(v, "stored_blocks"); got != 9 {
+		t.Errorf("stored_blocks after reopen = %d, want 9", got)
+	}
+	got := make([]byte, len(golden))
+	if _, err := v.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, golden) {
+		t.Error("vm2 data changed across reopen")
+	}
+	// Writing known content after reopen finds it through the index
+	v.WriteAt(pattern(200), BlockSize)
+	if got := stat(v, "stored_blocks"); got != 9 {
+		t.Errorf("stored_blocks = %d after writing existing content, want 9", got)
+	}
+	v.Close()
+
+	// Removing a volume releases only the blocks nobody else uses
+	if err := s.Remove("vm1"); err != nil {
+		t.Fatal(err)
+	}
+	v = openVolume(t, s, "golden", 0)
+	defer v.Close()
+	if got := stat(v, "stored_blocks"); got != 9 {
+		t.Errorf("stored_blocks after removing vm1 = %d, want 9 (vm2 still uses its block)", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "vm1"+volumeExt)); !os.IsNotExist(err) {
+		t.Error("removed volume's map file still exists")
+	}
+}
+
+func TestSlotReuseWaitsForFlush(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	v := openVolume(t, s, "disk", 4*BlockSize)
+	defer v.Close()
+
+	v.WriteAt(pattern(1), 0)
+	v.WriteAt(pattern(2), 0) // frees the slot of pattern(1)
+	v.WriteAt(pattern(3), BlockSize)
+	if got := len(s.refs); got != 3 {
+		t.Errorf("%d slots before flush, want 3: freed slot reused early", got)
+	}
+
+	if err := v.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	v.WriteAt(pattern(4), 2*BlockSize)
+	if got := len(s.refs); got != 3 {
+		t.Errorf("%d slots after flush, want 3: freed slot not reused", got)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	v := openVolume(t, s, "disk", 4*BlockSize)
+	defer v.Close()
+
+	for i := range 4 {
+		v.WriteAt(pattern(byte(i*8)), int64(i)*BlockSize)
+	}
+	// Unmaps blocks 1 and 2, zeroes the tail of block 0
+	if err := v.Discard(BlockSize-100, 2*BlockSize+100); err != nil {
+		t.Fatal(err)
+	}
+	if got := stat(v, "volume_blocks"); got != 2 {
+		t.Errorf("volume_blocks = %d, want 2", got)
+	}
+	got := make([]byte, 4*BlockSize)
+	v.ReadAt(got, 0)
+	if !bytes.Equal(got[:BlockSize-100], pattern(0)[:BlockSize-100]) || !isZero(got[BlockSize-100:3*BlockSize]) {
+		t.Error("discarded range does not read as zeros")
+	}
+}
+
+func TestVolumeErrors(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Volume("missing", 0); err == nil {
+		t.Error("opened a missing volume without a size")
+	}
+	if _, err := s.Volume("bad", 1000); err == nil {
+		t.Error("created a volume with a size that is not whole blocks")
+	}
+	if _, err := s.Volume("../escape", BlockSize); err == nil {
+		t.Error("accepted a volume name with a path separator")
+	}
+	v := openVolume(t, s, "disk", BlockSize)
+	if _, err := s.Volume("disk", 0); err == nil {
+		t.Error("opened a volume twice")
+	}
+	if _, err := s.Volume("disk", 2*BlockSize); err == nil {
+		t.Error("reopened a volume with a different size")
+	}
+	if err := s.Remove("disk"); err == nil {
+		t.Error("removed an open volume")
+	}
+	v.Close()
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	v := openVolume(t, s, "disk", 64*BlockSize)
+	defer v.Close()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 8 {
+				block := int64(g*8 + i)
+				// Only four distinct contents across all writers
+				if _, err := v.WriteAt(pattern(byte(block%4)*16), block*BlockSize); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := stat(v, "stored_blocks"); got != 4 {
+		t.Errorf("stored_blocks = %d, want 4", got)
+	}
+}
+
+func TestSnapshotAndClone(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	v := openVolume(t, s, "origin", 4*BlockSize)
+	defer v.Close()
+
+	v.WriteAt(pattern(1), 0)
+	if err := v.Snapshot("snap"); err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if err := v.Snapshot("snap"); err == nil {
+		t.Error("took a second snapshot with the same name")
+	}
+	// The snapshot shares the block instead of copying it
+	if got := stat(v, "stored_blocks"); got != 1 {
+		t.Errorf("stored_blocks = %d after snapshot, want 1", got)
+	}
+
+	v.WriteAt(pattern(2), 0)
+	b, err := v.Clone("snap", "")
+	if err != nil {
+		t.Fatalf("Clone: %v", err)
+	}
+	clone := b.(*Volume)
+	defer clone.Close()
+	if clone.name != "snap-clone" {
+		t.Errorf("clone name = %q, want snap-clone", clone.name)
+	}
+	got := make([]byte, BlockSize)
+	clone.ReadAt(got, 0)
+	if !bytes.Equal(got, pattern(1)) {
+		t.Error("clone does not hold the snapshot's data")
+	}
+
+	// Writing to the clone leaves the snapshot alone
+	clone.WriteAt(pattern(3), 0)
+	snap := openVolume(t, s, "snap", 0)
+	defer snap.Close()
+	snap.ReadAt(got, 0)
+	if !bytes.Equal(got, pattern(1)) {
+		t.Error("write to the clone changed the snapshot")
+	}
+
+	second, err := v.Clone("snap", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if name := second.(*Volume).name; name != "snap-clone2" {
+		t.Errorf("second clone name = %q, want snap-clone2", name)
+	}
+}
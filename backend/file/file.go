@@ -0,0 +1,196 @@
+// Package file provides a backend that serves a regular file or an existing
+// block device.
+package file
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// DiscardMode selects how discards from the kernel reach the backing file.
+type DiscardMode string
+
+const (
+	// DiscardNone leaves discard unsupported; the kernel sees EOPNOTSUPP
+	DiscardNone DiscardMode = "none"
+	// DiscardPunch punches holes in a regular file, or issues BLKDISCARD
+	// on a block device
+	DiscardPunch DiscardMode = "punch"
+	// DiscardZero zeroes the range in place (FALLOC_FL_ZERO_RANGE or
+	// BLKZEROOUT), so discarded blocks reliably read back as zeros
+	DiscardZero DiscardMode = "zero"
+)
+
+// ParseDiscardMode parses a DiscardMode from a flag value.
+func ParseDiscardMode(s string) (DiscardMode, error) {
+	switch m := DiscardMode(s); m {
+	case DiscardNone, DiscardPunch, DiscardZero:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown discard mode %q (want none, punch or zero)", s)
+}
+
+// Options configures Open.
+type Options struct {
+	// ReadOnly opens the file read-only; writes fail with EROFS.
+	ReadOnly bool
+
+	// Direct opens the file with O_DIRECT, bypassing the page cache.
+	// BlockSize must then be at least the backing device's sector size.
+	Direct bool
+
+	// BlockSize is the device's logical block size (default: 512). The
+	// exposed size is rounded down to a whole number of blocks.
+	BlockSize int
+}
+
+// File serves a regular file or block device. os.File's ReadAt and WriteAt
+// use pread/pwrite, so queues and workers share it without locking.
+type File struct {
+	f           *os.File
+	size        int64
+	blockDevice bool
+	readOnly    bool
+}
+
+// Open opens path as a backend.
+func Open(path string, opts Options) (*File, error) {
+	if opts.BlockSize == 0 {
+		opts.BlockSize = ublk.DefaultLogicalBlockSize
+	}
+	if opts.BlockSize < 512 || opts.BlockSize&(opts.BlockSize-1) != 0 {
+		return nil, fmt.Errorf("block size %d is not a power of two of at least 512", opts.BlockSize)
+	}
+
+	flags := os.O_RDWR
+	if opts.ReadOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := openFile(path, flags, opts.Direct)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &File{f: f, readOnly: opts.ReadOnly}
+	if err := b.stat(opts); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *File) stat(opts Options) error {
+	fi, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	switch mode := fi.Mode(); {
+	case mode.IsRegular():
+		size = fi.Size()
+	case mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0:
+		b.blockDevice = true
+		fd := int(b.f.Fd())
+		if size, err = blockDeviceSize(fd); err != nil {
+			return fmt.Errorf("BLKGETSIZE64: %w", err)
+		}
+		if opts.Direct {
+			sector, err := sectorSize(fd)
+			if err != nil {
+				return fmt.Errorf("BLKSSZGET: %w", err)
+			}
+			if opts.BlockSize < sector {
+				return fmt.Errorf("block size %d is smaller than the device's %d-byte sectors, which O_DIRECT requires",
+					opts.BlockSize, sector)
+			}
+		}
+	default:
+		return fmt.Errorf("%s is neither a regular file nor a block device", b.f.Name())
+	}
+
+	// The device is a whole number of blocks; a partial tail is not exposed
+	b.size = size &^ int64(opts.BlockSize-1)
+	if b.size == 0 {
+		return fmt.Errorf("%s is smaller than one %d-byte block", b.f.Name(), opts.BlockSize)
+	}
+	return nil
+}
+
+// ReadAt implements ublk.Backend.
+func (b *File) ReadAt(p []byte, off int64) (int, error) {
+	return b.f.ReadAt(p, off)
+}
+
+// WriteAt implements ublk.Backend.
+func (b *File) WriteAt(p []byte, off int64) (int, error) {
+	if b.readOnly {
+		return 0, syscall.EROFS
+	}
+	return b.f.WriteAt(p, off)
+}
+
+// Size implements ublk.Backend.
+func (b *File) Size() int64 {
+	return b.size
+}
+
+// Close implements ublk.Backend.
+func (b *File) Close() error {
+	return b.f.Close()
+}
+
+// Flush makes written data durable. fdatasync skips the metadata a block
+// device cannot observe anyway.
+func (b *File) Flush() error {
+	if b.readOnly {
+		return nil
+	}
+	return fdatasync(b.f)
+}
+
+// WithDiscard returns a backend that also handles discards in the given
+// mode, and WRITE_ZEROES. DiscardNone and read-only files return b itself,
+// so the device advertises neither.
+func (b *File) WithDiscard(mode DiscardMode) ublk.Backend {
+	if mode == DiscardNone || b.readOnly {
+		return b
+	}
+	return &discardFile{File: b, mode: mode}
+}
+
+// discardFile adds Discard to File. It is a separate type so that a File
+// without a discard mode leaves ublk.DiscardBackend unimplemented.
+type discardFile struct {
+	*File
+	mode DiscardMode
+}
+
+func (b *discardFile) Discard(offset, length int64) error {
+	fd := int(b.f.Fd())
+	if b.blockDevice {
+		return blockRange(fd, b.mode == DiscardZero, offset, length)
+	}
+	return fallocate(fd, b.mode == DiscardZero, offset, length)
+}
+
+// WriteZeroes zeroes the range in place for NOUNMAP requests and punches a
+// hole otherwise. Block devices always use BLKZEROOUT, which keeps the
+// range allocated; BLKDISCARD is not guaranteed to read back as zeros.
+func (b *discardFile) WriteZeroes(offset, length int64, flags ublk.RequestFlags) error {
+	fd := int(b.f.Fd())
+	if b.blockDevice {
+		return blockRange(fd, true, offset, length)
+	}
+	return fallocate(fd, flags.NoUnmap(), offset, length)
+}
+
+// Compile-time interface checks
+var (
+	_ ublk.Backend            = (*File)(nil)
+	_ ublk.DiscardBackend     = (*discardFile)(nil)
+	_ ublk.WriteZeroesBackend = (*discardFile)(nil)
+)
@@ -0,0 +1,194 @@
+//go:build linux
+
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+func tempImage(t *testing.T, size int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, make([]byte, size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOpenRoundsSizeToBlocks(t *testing.T) {
+	path := tempImage(t, 10000)
+
+	b, err := Open(path, Options{BlockSize: 4096})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+	if b.Size() != 8192 {
+		t.Errorf("Size = %d, want 8192", b.Size())
+	}
+
+	if _, err := Open(path, Options{BlockSize: 16384}); err == nil {
+		t.Error("expected an error for a file smaller than one block")
+	}
+	if _, err := Open(path, Options{BlockSize: 1000}); err == nil {
+		t.Error("expected an error for a block size that is not a power of two")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	b, err := Open(tempImage(t, 8192), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	want := []byte("hello, block device")
+	if _, err := b.WriteAt(want, 4096); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := b.ReadAt(got, 4096); err != nil {
+		t.Fatalf("ReadAt: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ReadAt = %q, want %q", got, want)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	b, err := Open(tempImage(t, 4096), Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if _, err := b.WriteAt([]byte{1}, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("WriteAt on read-only file = %v, want EROFS", err)
+	}
+	if _, ok := b.WithDiscard(DiscardPunch).(ublk.DiscardBackend); ok {
+		t.Error("read-only file should not support discard")
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	for _, mode := range []DiscardMode{DiscardPunch, DiscardZero} {
+		t.Run(string(mode), func(t *testing.T) {
+			b, err := Open(tempImage(t, 3*4096), Options{BlockSize: 4096})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+
+			if _, err := b.WriteAt(bytes.Repeat([]byte{0xAA}, 3*4096), 0); err != nil {
+				t.Fatal(err)
+			}
+			db, ok := b.WithDiscard(mode).(ublk.DiscardBackend)
+			if !ok {
+				t.Fatal("expected a DiscardBackend")
+			}
+			if err := db.Discard(4096, 4096); err != nil {
+				if errors.Is(err, syscall.EOPNOTSUPP) {
+					t.Skipf("filesystem does not support %s: %v", mode, err)
+				}
+				t.Fatalf("Discard: %v", err)
+			}
+
+			got := make([]byte, 3*4096)
+			if _, err := b.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got[4095] != 0xAA || got[2*4096] != 0xAA {
+				t.Error("discard touched data outside its range")
+			}
+			if !bytes.Equal(got[4096:2*4096], make([]byte, 4096)) {
+				t.Error("discarded range does not read back as zeros")
+			}
+			if b.Size() != 3*4096 {
+				t.Errorf("discard changed the size to %d", b.Size())
+			}
+		})
+	}
+
+	b, err := Open(tempImage(t, 4096), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, ok := b.WithDiscard(DiscardNone).(ublk.DiscardBackend); ok {
+		t.Error("DiscardNone should not support discard")
+	}
+}
+
+func TestWriteZeroes(t *testing.T) {
+	for _, flags := range []ublk.RequestFlags{0, ublk.RequestNoUnmap} {
+		t.Run(fmt.Sprintf("nounmap=%v", flags.NoUnmap()), func(t *testing.T) {
+			path := tempImage(t, 3*4096)
+			b, err := Open(path, Options{BlockSize: 4096})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			if _, err := b.WriteAt(bytes.Repeat([]byte{0xAA}, 3*4096), 0); err != nil {
+				t.Fatal(err)
+			}
+			b.Flush()
+			before := allocatedBlocks(t, path)
+
+			zb := b.WithDiscard(DiscardPunch).(ublk.WriteZeroesBackend)
+			if err := zb.WriteZeroes(4096, 4096, flags); err != nil {
+				if errors.Is(err, syscall.EOPNOTSUPP) {
+					t.Skipf("filesystem does not support it: %v", err)
+				}
+				t.Fatalf("WriteZeroes: %v", err)
+			}
+
+			got := make([]byte, 3*4096)
+			if _, err := b.ReadAt(got, 0); err != nil {
+				t.Fatal(err)
+			}
+			if got[4095] != 0xAA || got[2*4096] != 0xAA || !bytes.Equal(got[4096:2*4096], make([]byte, 4096)) {
+				t.Error("range not zeroed exactly")
+			}
+			// NOUNMAP keeps the blocks; otherwise they are given back
+			after := allocatedBlocks(t, path)
+			if flags.NoUnmap() && after < before {
+				t.Errorf("NOUNMAP write zeroes deallocated: %d -> %d blocks", before, after)
+			}
+			if !flags.NoUnmap() && after >= before {
+				t.Errorf("write zeroes kept the range allocated: %d -> %d blocks", before, after)
+			}
+		})
+	}
+}
+
+// allocatedBlocks returns the 512-byte blocks allocated to path.
+func allocatedBlocks(t *testing.T, path string) int64 {
+	t.Helper()
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks
+}
+
+func TestParseDiscardMode(t *testing.T) {
+	for _, s := range []string{"none", "punch", "zero"} {
+		if _, err := ParseDiscardMode(s); err != nil {
+			t.Errorf("ParseDiscardMode(%q): %v", s, err)
+		}
+	}
+	if _, err := ParseDiscardMode("trim"); err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,57 @@
+package file
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func openFile(path string, flags int, direct bool) (*os.File, error) {
+	if direct {
+		flags |= syscall.O_DIRECT
+	}
+	return os.OpenFile(path, flags, 0)
+}
+
+func blockDeviceSize(fd int) (int64, error) {
+	var n uint64
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.BLKGETSIZE64, uintptr(unsafe.Pointer(&n)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(n), nil
+}
+
+func sectorSize(fd int) (int, error) {
+	return unix.IoctlGetInt(fd, unix.BLKSSZGET)
+}
+
+func fdatasync(f *os.File) error {
+	return unix.Fdatasync(int(f.Fd()))
+}
+
+// blockRange discards a block device range with BLKDISCARD, or zeroes it
+// with BLKZEROOUT if zero is set.
+func blockRange(fd int, zero bool, offset, length int64) error {
+	req := uint(unix.BLKDISCARD)
+	if zero {
+		req = unix.BLKZEROOUT
+	}
+	r := [2]uint64{uint64(offset), uint64(length)}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fallocate punches a hole in a regular file, or zeroes the range in place
+// if zero is set.
+func fallocate(fd int, zero bool, offset, length int64) error {
+	mode := uint32(unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE)
+	if zero {
+		mode = unix.FALLOC_FL_ZERO_RANGE | unix.FALLOC_FL_KEEP_SIZE
+	}
+	return unix.Fallocate(fd, mode, offset, length)
+}
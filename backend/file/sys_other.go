@@ -0,0 +1,39 @@
+//go:build !linux
+
+package file
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Off Linux regular files can be opened, so the package builds, but block
+// devices, O_DIRECT and discards are not supported.
+
+func openFile(path string, flags int, direct bool) (*os.File, error) {
+	if direct {
+		return nil, errors.New("O_DIRECT is only supported on Linux")
+	}
+	return os.OpenFile(path, flags, 0)
+}
+
+func blockDeviceSize(fd int) (int64, error) {
+	return 0, syscall.ENOSYS
+}
+
+func sectorSize(fd int) (int, error) {
+	return 0, syscall.ENOSYS
+}
+
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+func blockRange(fd int, zero bool, offset, length int64) error {
+	return syscall.ENOSYS
+}
+
+func fallocate(fd int, zero bool, offset, length int64) error {
+	return syscall.ENOSYS
+}
@@ -0,0 +1,367 @@
+// Package httprange provides a read-only backend that serves a remote image
+// over HTTP(S) with Range requests, so ISO images and cloud snapshots can be
+// attached without downloading them first.
+//
+// The image is fetched in fixed-size chunks kept in an LRU cache. Sequential
+// reads prefetch the chunks that follow in the background.
+package httprange
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// Defaults for Options fields left zero.
+const (
+	DefaultChunkSize = 1 << 20
+	DefaultCacheSize = 256 << 20
+	DefaultPrefetch  = 4
+)
+
+// Options configures Open.
+type Options struct {
+	// Client sends the requests (default: http.DefaultClient). Set a
+	// timeout on it; a stalled request stalls the I/O waiting for it.
+	Client *http.Client
+
+	// Header is added to every request, e.g. for authorization.
+	Header http.Header
+
+	// ChunkSize is the unit of fetching and caching (default: 1 MiB). It
+	// must be a multiple of 4096.
+	ChunkSize int64
+
+	// CacheSize bounds the memory used for cached chunks (default:
+	// 256 MiB). At least one chunk per prefetched chunk is kept regardless.
+	CacheSize int64
+
+	// Prefetch is how many chunks to read ahead once reads turn
+	// sequential (default: 4). Negative disables prefetching.
+	Prefetch int
+}
+
+// Backend serves a remote image. It is safe for concurrent use.
+type Backend struct {
+	client    *http.Client
+	url       string
+	header    http.Header
+	size      int64
+	validator string // ETag or Last-Modified, sent as If-Range
+	chunkSize int64
+
+	// Prefetches run in the background until Close cancels ctx. prefetchSem
+	// bounds how many are in flight; nil when prefetching is off.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	prefetch    int
+	prefetchSem chan struct{}
+
+	// mu guards everything below
+	mu        sync.Mutex
+	cache     *lru
+	inflight  map[int64]*fetch
+	lastChunk int64 // last chunk read, for sequential detection
+	hits      uint64
+	misses    uint64
+	fetches   uint64
+	fetched   uint64 // bytes
+	errors    uint64
+}
+
+// fetch is a chunk download that concurrent readers of the chunk wait on.
+type fetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// Open probes url and returns a backend serving it. The server must answer
+// Range requests with 206 Partial Content and report the full size.
+func Open(url string, opts Options) (*Backend, error) {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	if opts.ChunkSize < 4096 || opts.ChunkSize%4096 != 0 {
+		return nil, fmt.Errorf("chunk size %d is not a multiple of 4096", opts.ChunkSize)
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = DefaultCacheSize
+	}
+	if opts.Prefetch == 0 {
+		opts.Prefetch = DefaultPrefetch
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Backend{
+		client:    opts.Client,
+		url:       url,
+		header:    opts.Header,
+		chunkSize: opts.ChunkSize,
+		ctx:       ctx,
+		cancel:    cancel,
+		prefetch:  max(opts.Prefetch, 0),
+		inflight:  make(map[int64]*fetch),
+		lastChunk: -1,
+	}
+	if b.prefetch > 0 {
+		b.prefetchSem = make(chan struct{}, b.prefetch)
+	}
+	b.cache = newLRU(max(int(opts.CacheSize/opts.ChunkSize), b.prefetch+1))
+
+	if err := b.probe(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return b, nil
+}
+
+// probe learns the size and validator from a one-byte range request, which
+// also proves that the server honours ranges.
+func (b *Backend) probe() error {
+	resp, err := b.get("bytes=0-0", false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("%s: range request answered with %q, want 206 Partial Content", b.url, resp.Status)
+	}
+	cr := resp.Header.Get("Content-Range")
+	_, total, ok := strings.Cut(cr, "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if !ok || err != nil || size <= 0 {
+		return fmt.Errorf("%s: cannot determine size from Content-Range %q", b.url, cr)
+	}
+	b.size = size
+
+	// Weak ETags cannot be used with If-Range
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		b.validator = etag
+	} else {
+		b.validator = resp.Header.Get("Last-Modified")
+	}
+	return nil
+}
+
+func (b *Backend) get(rng string, validate bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range b.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", rng)
+	if validate && b.validator != "" {
+		req.Header.Set("If-Range", b.validator)
+	}
+	return b.client.Do(req)
+}
+
+// ReadAt implements ublk.Backend.
+func (b *Backend) ReadAt(p []byte, off int64) (int, error) {
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), b.size)
+	first, last := off/b.chunkSize, (end-1)/b.chunkSize
+
+	b.mu.Lock()
+	sequential := first == b.lastChunk || first == b.lastChunk+1
+	b.lastChunk = last
+	b.mu.Unlock()
+
+	n := 0
+	for idx := first; idx <= last; idx++ {
+		data, err := b.chunk(idx)
+		if err != nil {
+			return n, err
+		}
+		start := max(off+int64(n)-idx*b.chunkSize, 0)
+		n += copy(p[n:end-off], data[start:])
+	}
+
+	if sequential {
+		for idx := last + 1; idx <= last+int64(b.prefetch); idx++ {
+			b.startPrefetch(idx)
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// ReadAhead implements ublk.ReadAheadBackend: it prefetches the chunks
+// covering the hinted range in the background, as many at once as the
+// Prefetch limit allows.
+func (b *Backend) ReadAhead(offset, length int64) {
+	if b.prefetch == 0 {
+		return
+	}
+	end := min(offset+length, b.size)
+	for idx := offset / b.chunkSize; idx*b.chunkSize < end; idx++ {
+		b.startPrefetch(idx)
+	}
+}
+
+// chunk returns chunk idx from the cache, from a fetch already in flight,
+// or by fetching it.
+func (b *Backend) chunk(idx int64) ([]byte, error) {
+	b.mu.Lock()
+	if data, ok := b.cache.get(idx); ok {
+		b.hits++
+		b.mu.Unlock()
+		return data, nil
+	}
+	if f, ok := b.inflight[idx]; ok {
+		b.hits++ // usually a prefetch that has not landed yet
+		b.mu.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+	b.misses++
+	f := b.startFetch(idx)
+	b.mu.Unlock()
+
+	b.runFetch(idx, f)
+	return f.data, f.err
+}
+
+// startFetch registers a fetch of chunk idx. The caller holds mu.
+func (b *Backend) startFetch(idx int64) *fetch {
+	f := &fetch{done: make(chan struct{})}
+	b.inflight[idx] = f
+	return f
+}
+
+func (b *Backend) runFetch(idx int64, f *fetch) {
+	f.data, f.err = b.download(idx)
+
+	b.mu.Lock()
+	delete(b.inflight, idx)
+	b.fetches++
+	if f.err == nil {
+		b.fetched += uint64(len(f.data))
+		b.cache.add(idx, f.data)
+	} else {
+		b.errors++
+	}
+	b.mu.Unlock()
+	close(f.done)
+}
+
+// startPrefetch fetches chunk idx in the background unless it is cached,
+// already being fetched, past the end, or too many prefetches are running.
+func (b *Backend) startPrefetch(idx int64) {
+	if idx*b.chunkSize >= b.size {
+		return
+	}
+	select {
+	case b.prefetchSem <- struct{}{}:
+	default:
+		return
+	}
+
+	b.mu.Lock()
+	_, cached := b.cache.peek(idx)
+	_, fetching := b.inflight[idx]
+	if cached || fetching || b.ctx.Err() != nil {
+		b.mu.Unlock()
+		<-b.prefetchSem
+		return
+	}
+	f := b.startFetch(idx)
+	b.wg.Add(1)
+	b.mu.Unlock()
+
+	go func() {
+		defer b.wg.Done()
+		defer func() { <-b.prefetchSem }()
+		b.runFetch(idx, f)
+	}()
+}
+
+// download fetches chunk idx. If-Range makes a server whose copy changed
+// since Open answer 200 with the whole image, which is reported as an error
+// rather than mixing data from two versions.
+func (b *Backend) download(idx int64) ([]byte, error) {
+	start := idx * b.chunkSize
+	end := min(start+b.chunkSize, b.size)
+
+	resp, err := b.get(fmt.Sprintf("bytes=%d-%d", start, end-1), true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, fmt.Errorf("%s changed since it was opened", b.url)
+	default:
+		return nil, fmt.Errorf("%s: range %d-%d: %s", b.url, start, end-1, resp.Status)
+	}
+
+	data := make([]byte, end-start)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("%s: range %d-%d: %w", b.url, start, end-1, err)
+	}
+	return data, nil
+}
+
+// WriteAt implements ublk.Backend. The image is read-only.
+func (b *Backend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EROFS
+}
+
+// Size implements ublk.Backend.
+func (b *Backend) Size() int64 {
+	return b.size
+}
+
+// Flush implements ublk.Backend. There is nothing to flush.
+func (b *Backend) Flush() error {
+	return nil
+}
+
+// Close cancels outstanding fetches and waits for prefetches to finish.
+func (b *Backend) Close() error {
+	b.cancel()
+	b.wg.Wait()
+	return nil
+}
+
+// Stats implements ublk.StatBackend.
+func (b *Backend) Stats() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return map[string]interface{}{
+		"cache_hits":    b.hits,
+		"cache_misses":  b.misses,
+		"cached_chunks": b.cache.len(),
+		"fetches":       b.fetches,
+		"fetched_bytes": b.fetched,
+		"fetch_errors":  b.errors,
+	}
+}
+
+// Compile-time interface checks
+var (
+	_ ublk.Backend     = (*Backend)(nil)
+	_ ublk.StatBackend = (*Backend)(nil)
+)
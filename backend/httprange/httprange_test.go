@@ -0,0 +1,290 @@
+package httprange
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+const testChunk = 4096
+
+// testImage returns size bytes where every byte depends on its offset.
+func testImage(size int) []byte {
+	img := make([]byte, size)
+	for i := range img {
+		img[i] = byte(i*7 + i/4096)
+	}
+	return img
+}
+
+// testServer serves img with Range support and counts range requests.
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	img      []byte
+	modified time.Time
+	requests atomic.Int64
+}
+
+func newTestServer(t *testing.T, img []byte) *testServer {
+	s := &testServer{img: img, modified: time.Unix(1700000000, 0)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		s.mu.Lock()
+		img, modified := s.img, s.modified
+		s.mu.Unlock()
+		http.ServeContent(w, r, "disk.img", modified, bytes.NewReader(img))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// replace swaps the served image, as if it were rewritten in place.
+func (s *testServer) replace(img []byte) {
+	s.mu.Lock()
+	s.img, s.modified = img, s.modified.Add(time.Hour)
+	s.mu.Unlock()
+}
+
+func TestReadAt(t *testing.T) {
+	img := testImage(10*testChunk + 100) // partial last chunk
+	srv := newTestServer(t, img)
+
+	b, err := Open(srv.URL, Options{ChunkSize: testChunk, Prefetch: -1})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+	if b.Size() != int64(len(img)) {
+		t.Fatalf("Size = %d, want %d", b.Size(), len(img))
+	}
+
+	tests := []struct {
+		name string
+		off  int64
+		n    int
+	}{
+		{"within a chunk", 100, 200},
+		{"across chunks", testChunk - 10, 3 * testChunk},
+		{"tail", int64(len(img)) - 50, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := make([]byte, tt.n)
+			if n, err := b.ReadAt(got, tt.off); err != nil || n != tt.n {
+				t.Fatalf("ReadAt = %d, %v", n, err)
+			}
+			if !bytes.Equal(got, img[tt.off:tt.off+int64(tt.n)]) {
+				t.Error("data mismatch")
+			}
+		})
+	}
+
+	// Reading past the end is short
+	got := make([]byte, 200)
+	if n, err := b.ReadAt(got, int64(len(img))-100); n != 100 || err != io.EOF {
+		t.Errorf("ReadAt past end = %d, %v, want 100, EOF", n, err)
+	}
+
+	if _, err := b.WriteAt(got, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("WriteAt error = %v, want EROFS", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	srv := newTestServer(t, testImage(8*testChunk))
+	b, err := Open(srv.URL, Options{ChunkSize: testChunk, CacheSize: 2 * testChunk, Prefetch: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	buf := make([]byte, 512)
+	read := func(chunk int64) {
+		t.Helper()
+		if _, err := b.ReadAt(buf, chunk*testChunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base := srv.requests.Load()
+	read(0)
+	read(0)
+	read(5)
+	read(0)
+	if got := srv.requests.Load() - base; got != 2 {
+		t.Errorf("%d requests for two distinct chunks, want 2", got)
+	}
+
+	// Chunk 5 is the least recently used and goes when a third arrives
+	read(6)
+	read(5)
+	if got := srv.requests.Load() - base; got != 4 {
+		t.Errorf("%d requests after eviction, want 4", got)
+	}
+
+	stats := b.Stats()
+	if stats["cache_hits"] != uint64(2) || stats["cache_misses"] != uint64(4) {
+		t.Errorf("stats = %v, want 2 hits and 4 misses", stats)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	srv := newTestServer(t, testImage(16*testChunk))
+	b, err := Open(srv.URL, Options{ChunkSize: testChunk, Prefetch: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	buf := make([]byte, testChunk)
+	// The first read has no history; the second is sequential and
+	// prefetches chunks 2-4
+	for _, off := range []int64{0, testChunk} {
+		if _, err := b.ReadAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Stats()["cached_chunks"] != 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetch did not complete: %v", b.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	base := srv.requests.Load()
+	for off := int64(2 * testChunk); off < 5*testChunk; off += testChunk {
+		if _, err := b.ReadAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Close() // wait for the prefetches those reads started
+	if fetched := b.Stats()["fetches"].(uint64); fetched < 5 {
+		t.Errorf("fetches = %d, want at least 5", fetched)
+	}
+	// Chunks 2-4 came from the cache; only new prefetches hit the server
+	if got := srv.requests.Load() - base; got > 3 {
+		t.Errorf("%d requests while reading prefetched chunks, want at most 3 prefetches", got)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	srv := newTestServer(t, testImage(16*testChunk))
+	b, err := Open(srv.URL, Options{ChunkSize: testChunk, Prefetch: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var _ ublk.ReadAheadBackend = b
+
+	// A hint spanning chunks 6-8 fetches them without a read
+	b.ReadAhead(6*testChunk+100, 2*testChunk)
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Stats()["cached_chunks"] != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("read-ahead did not complete: %v", b.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	base := srv.requests.Load()
+	buf := make([]byte, 3*testChunk)
+	if _, err := b.ReadAt(buf, 6*testChunk); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.requests.Load() - base; got != 0 {
+		t.Errorf("%d requests reading hinted chunks, want none", got)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	img := testImage(32 * testChunk)
+	srv := newTestServer(t, img)
+	b, err := Open(srv.URL, Options{ChunkSize: testChunk, CacheSize: 4 * testChunk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 3000)
+			for i := range 50 {
+				off := int64((g*131 + i*977) % (len(img) - len(buf)))
+				if _, err := b.ReadAt(buf, off); err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(buf, img[off:off+int64(len(buf))]) {
+					t.Errorf("data mismatch at %d", off)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestImageChanged(t *testing.T) {
+	srv := newTestServer(t, testImage(4*testChunk))
+	b, err := Open(srv.URL, Options{ChunkSize: testChunk, Prefetch: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	srv.replace(bytes.Repeat([]byte{1}, 4*testChunk))
+	if _, err := b.ReadAt(make([]byte, 512), 0); err == nil {
+		t.Error("read after the image changed succeeded")
+	}
+}
+
+func TestOpenRequiresRanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testImage(testChunk))
+	}))
+	defer srv.Close()
+
+	if _, err := Open(srv.URL, Options{}); err == nil {
+		t.Error("Open succeeded against a server without range support")
+	}
+	if _, err := Open(srv.URL, Options{ChunkSize: 1000}); err == nil {
+		t.Error("Open accepted a chunk size that is not a multiple of 4096")
+	}
+}
+
+func TestHeaderForwarded(t *testing.T) {
+	img := testImage(testChunk)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(img))
+	}))
+	defer srv.Close()
+
+	if _, err := Open(srv.URL, Options{}); err == nil {
+		t.Error("Open succeeded without credentials")
+	}
+	b, err := Open(srv.URL, Options{Header: http.Header{"Authorization": {"Bearer test"}}})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+	if _, err := b.ReadAt(make([]byte, 512), 0); err != nil {
+		t.Error(err)
+	}
+}
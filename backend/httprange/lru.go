@@ -0,0 +1,62 @@
+package httprange
+
+import "container/list"
+
+// lru is a fixed-capacity cache of chunks keyed by index. It is not safe
+// for concurrent use; Backend guards it with its mutex.
+type lru struct {
+	capacity int
+	order    *list.List // front is most recently used
+	items    map[int64]*list.Element
+}
+
+type lruEntry struct {
+	idx  int64
+	data []byte
+}
+
+func newLRU(capacity int) *lru {
+	return &lru{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[int64]*list.Element),
+	}
+}
+
+// get returns chunk idx and marks it most recently used.
+func (c *lru) get(idx int64) ([]byte, bool) {
+	e, ok := c.items[idx]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).data, true
+}
+
+// peek returns chunk idx without changing its position.
+func (c *lru) peek(idx int64) ([]byte, bool) {
+	e, ok := c.items[idx]
+	if !ok {
+		return nil, false
+	}
+	return e.Value.(*lruEntry).data, true
+}
+
+// add inserts chunk idx, evicting the least recently used chunk if full.
+func (c *lru) add(idx int64, data []byte) {
+	if e, ok := c.items[idx]; ok {
+		e.Value.(*lruEntry).data = data
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[idx] = c.order.PushFront(&lruEntry{idx: idx, data: data})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).idx)
+	}
+}
+
+func (c *lru) len() int {
+	return c.order.Len()
+}
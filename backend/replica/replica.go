@@ -0,0 +1,593 @@
+// Package replica mirrors a backend's writes to a secondary backend, in
+// the manner of DRBD. Reads are served by the primary. Writes go to the
+// primary and then to the secondary, either before the write completes
+// (Sync) or through a bounded queue (Async).
+//
+// If the secondary fails, the replica keeps serving from the primary and
+// records which blocks the secondary has missed. A background loop retries
+// the secondary, reopening it through Options.Reconnect if set, and copies
+// the missed blocks across before replication resumes. Writes that overlap
+// while both are in flight have no defined order, on the secondary as on
+// any block device.
+package replica
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// Defaults for zero Options fields
+const (
+	DefaultQueueBytes    = 64 << 20
+	DefaultBlockSize     = 64 << 10
+	DefaultRetryInterval = time.Second
+)
+
+// Mode selects when a write is considered complete.
+type Mode int
+
+const (
+	// Sync completes a write once both backends have it. A secondary that
+	// fails the write is dropped to out of sync; the write still succeeds.
+	Sync Mode = iota
+	// Async completes a write once the primary has it and queues it for
+	// the secondary. Flush does not wait for the queue.
+	Async
+)
+
+// ParseMode parses a Mode from a flag value.
+func ParseMode(s string) (Mode, error) {
+	switch s {
+	case "sync":
+		return Sync, nil
+	case "async":
+		return Async, nil
+	}
+	return 0, fmt.Errorf("unknown replication mode %q (want sync or async)", s)
+}
+
+func (m Mode) String() string {
+	if m == Async {
+		return "async"
+	}
+	return "sync"
+}
+
+// Options configures New.
+type Options struct {
+	Mode Mode
+
+	// QueueBytes bounds the writes queued for the secondary in Async
+	// mode; writers wait once it is full (default: DefaultQueueBytes).
+	QueueBytes int64
+
+	// BlockSize is the granularity at which blocks missed by the secondary
+	// are tracked and resynced (default: DefaultBlockSize).
+	BlockSize int64
+
+	// RetryInterval is how often an out-of-sync secondary is retried
+	// (default: DefaultRetryInterval).
+	RetryInterval time.Duration
+
+	// Reconnect, if set, opens a fresh secondary for each retry, e.g. a new
+	// connection to a remote store; the failed one is closed. If nil the
+	// same secondary is retried.
+	Reconnect func() (ublk.Backend, error)
+
+	// InSync declares that the secondary already holds the primary's data.
+	// Otherwise the whole device is copied across first.
+	InSync bool
+}
+
+// Replica mirrors writes from a primary backend to a secondary. It is safe
+// for concurrent use.
+type Replica struct {
+	primary ublk.Backend
+	opts    Options
+	size    int64
+
+	// secMu is held shared around secondary calls and exclusively to
+	// replace the secondary
+	secMu     sync.RWMutex
+	secondary ublk.Backend
+
+	// mu guards everything below. While outOfSync is set, writes only
+	// mark the blocks they touch; the resync loop clears it once no block
+	// is marked.
+	mu          sync.Mutex
+	cond        *sync.Cond // signalled when the queue shrinks or replication stops
+	outOfSync   bool
+	dirty       []uint64 // one bit per BlockSize block the secondary missed
+	queue       []queuedWrite
+	queuedBytes int64
+	applying    bool   // the async worker is writing the queue head
+	gen         uint64 // bumped by fail, which empties the queue
+	reconnect   bool   // the secondary failed since it was last opened
+	closed      bool
+
+	wake chan struct{} // pokes the resync loop
+	done sync.WaitGroup
+
+	// Statistics, guarded by mu
+	replicated    uint64
+	failures      uint64
+	resyncs       uint64
+	resyncedBytes uint64
+}
+
+type queuedWrite struct {
+	off     int64
+	data    []byte // nil for a discard of length
+	length  int64
+	discard bool
+	queued  time.Time
+}
+
+// New returns a replica of primary onto secondary, which must be at least
+// as large. Unless opts.InSync is set, the secondary starts out of sync and
+// the background loop copies the whole primary to it.
+func New(primary, secondary ublk.Backend, opts Options) (*Replica, error) {
+	if opts.QueueBytes <= 0 {
+		opts.QueueBytes = DefaultQueueBytes
+	}
+	if opts.BlockSize <= 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = DefaultRetryInterval
+	}
+	size := primary.Size()
+	if secondary.Size() < size {
+		return nil, fmt.Errorf("secondary holds %d bytes, the primary %d", secondary.Size(), size)
+	}
+
+	blocks := (size + opts.BlockSize - 1) / opts.BlockSize
+	r := &Replica{
+		primary:   primary,
+		secondary: secondary,
+		opts:      opts,
+		size:      size,
+		dirty:     make([]uint64, (blocks+63)/64),
+		wake:      make(chan struct{}, 1),
+	}
+	r.cond = sync.NewCond(&r.mu)
+	if !opts.InSync {
+		r.outOfSync = true
+		r.markLocked(0, size)
+	}
+
+	r.done.Add(1)
+	go r.resyncLoop()
+	if opts.Mode == Async {
+		r.done.Add(1)
+		go r.worker()
+	}
+	return r, nil
+}
+
+// ReadAt implements ublk.Backend. Reads are served by the primary.
+func (r *Replica) ReadAt(p []byte, off int64) (int, error) {
+	return r.primary.ReadAt(p, off)
+}
+
+// WriteAt implements ublk.Backend.
+func (r *Replica) WriteAt(p []byte, off int64) (int, error) {
+	n, err := r.primary.WriteAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	r.replicate(queuedWrite{off: off, data: p, length: int64(len(p))})
+	return n, nil
+}
+
+// replicate passes a write the primary completed on to the secondary. It
+// never fails: a secondary that cannot take it is marked out of sync.
+func (r *Replica) replicate(w queuedWrite) {
+	r.mu.Lock()
+	if r.outOfSync || r.closed {
+		r.markLocked(w.off, w.length)
+		r.mu.Unlock()
+		return
+	}
+
+	if r.opts.Mode == Async {
+		for !r.outOfSync && r.queuedBytes > 0 && r.queuedBytes+w.length > r.opts.QueueBytes {
+			r.cond.Wait()
+		}
+		if r.outOfSync {
+			r.markLocked(w.off, w.length)
+		} else {
+			if w.data != nil {
+				w.data = append([]byte(nil), w.data...)
+			}
+			w.queued = time.Now()
+			r.queue = append(r.queue, w)
+			r.queuedBytes += w.length
+			r.cond.Broadcast()
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.mu.Unlock()
+
+	if err := r.apply(w); err != nil {
+		r.fail(err, []queuedWrite{w})
+		return
+	}
+	r.mu.Lock()
+	r.replicated++
+	r.mu.Unlock()
+}
+
+// apply performs w on the secondary.
+func (r *Replica) apply(w queuedWrite) error {
+	r.secMu.RLock()
+	defer r.secMu.RUnlock()
+	if w.discard {
+		return r.secondary.(ublk.DiscardBackend).Discard(w.off, w.length)
+	}
+	n, err := r.secondary.WriteAt(w.data, w.off)
+	if err == nil && n < len(w.data) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
+// fail drops the secondary out of sync, marking the writes it missed and
+// everything still queued.
+func (r *Replica) fail(err error, missed []queuedWrite) {
+	r.mu.Lock()
+	r.failures++
+	r.gen++
+	r.reconnect = true
+	wasInSync := !r.outOfSync
+	r.outOfSync = true
+	for _, w := range missed {
+		r.markLocked(w.off, w.length)
+	}
+	for _, w := range r.queue {
+		r.markLocked(w.off, w.length)
+	}
+	r.queue, r.queuedBytes = nil, 0
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	if wasInSync {
+		logging.Default().Warn("replica secondary failed, continuing out of sync", "error", err)
+	}
+	r.poke()
+}
+
+// worker applies queued writes in order in Async mode.
+func (r *Replica) worker() {
+	defer r.done.Done()
+	for {
+		r.mu.Lock()
+		for len(r.queue) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if len(r.queue) == 0 {
+			r.mu.Unlock()
+			return
+		}
+		w, gen := r.queue[0], r.gen
+		r.applying = true
+		r.mu.Unlock()
+
+		err := r.apply(w)
+
+		r.mu.Lock()
+		r.applying = false
+		if err != nil {
+			r.mu.Unlock()
+			// The head is still queued, so fail marks it
+			r.fail(err, nil)
+			continue
+		}
+		// A failure meanwhile emptied the queue, w included, and marked
+		// w's blocks; what is queued now came later
+		if r.gen == gen {
+			r.queue = r.queue[1:]
+			r.queuedBytes -= w.length
+			r.replicated++
+		}
+		r.cond.Broadcast()
+		r.mu.Unlock()
+	}
+}
+
+// resyncLoop brings an out-of-sync secondary back, retrying every
+// RetryInterval, until Close.
+func (r *Replica) resyncLoop() {
+	defer r.done.Done()
+	ticker := time.NewTicker(r.opts.RetryInterval)
+	defer ticker.Stop()
+	for {
+		r.mu.Lock()
+		closed, outOfSync := r.closed, r.outOfSync
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+		if outOfSync {
+			if err := r.resync(); err != nil {
+				logging.Default().Debug("replica resync failed", "error", err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-r.wake:
+		}
+	}
+}
+
+// resync reconnects the secondary if configured to, copies every marked
+// block from the primary and resumes replication. Blocks written during the
+// copy are marked again and picked up before resuming; the last of them are
+// copied with mu held, so no write slips between the copy and the switch.
+func (r *Replica) resync() error {
+	r.mu.Lock()
+	reconnect := r.reconnect && r.opts.Reconnect != nil
+	r.mu.Unlock()
+	if reconnect {
+		secondary, err := r.opts.Reconnect()
+		if err != nil {
+			return fmt.Errorf("reconnect: %w", err)
+		}
+		if secondary.Size() < r.size {
+			secondary.Close()
+			return fmt.Errorf("reconnected secondary holds %d bytes, the primary %d", secondary.Size(), r.size)
+		}
+		r.secMu.Lock()
+		old := r.secondary
+		r.secondary = secondary
+		r.secMu.Unlock()
+		if old != secondary {
+			old.Close()
+		}
+		r.mu.Lock()
+		r.reconnect = false
+		r.mu.Unlock()
+	}
+
+	buf := make([]byte, r.opts.BlockSize)
+	for {
+		block, ok := r.takeDirty()
+		if !ok {
+			break
+		}
+		n, err := r.copyBlock(buf, block)
+		r.mu.Lock()
+		if err != nil {
+			r.markLocked(block*r.opts.BlockSize, n)
+		} else {
+			r.resyncedBytes += uint64(n)
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil
+	}
+	for block := r.nextDirtyLocked(0); block >= 0; block = r.nextDirtyLocked(block + 1) {
+		n, err := r.copyBlock(buf, block)
+		if err != nil {
+			return err
+		}
+		r.clearLocked(block)
+		r.resyncedBytes += uint64(n)
+	}
+	if err := r.flushSecondary(); err != nil {
+		return err
+	}
+	r.outOfSync = false
+	r.resyncs++
+	r.cond.Broadcast()
+	logging.Default().Info("replica secondary back in sync")
+	return nil
+}
+
+// takeDirty clears and returns the first marked block.
+func (r *Replica) takeDirty() (int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	block := r.nextDirtyLocked(0)
+	if block < 0 || r.closed {
+		return 0, false
+	}
+	r.clearLocked(block)
+	return block, true
+}
+
+// copyBlock copies one block from the primary to the secondary and returns
+// its length.
+func (r *Replica) copyBlock(buf []byte, block int64) (int64, error) {
+	off := block * r.opts.BlockSize
+	p := buf[:min(r.opts.BlockSize, r.size-off)]
+	err := readFull(r.primary, p, off)
+	if err == nil {
+		err = r.apply(queuedWrite{off: off, data: p, length: int64(len(p))})
+	}
+	return int64(len(p)), err
+}
+
+func readFull(b ublk.Backend, p []byte, off int64) error {
+	n, err := b.ReadAt(p, off)
+	if err == io.EOF {
+		clear(p[n:])
+		return nil
+	}
+	return err
+}
+
+func (r *Replica) flushSecondary() error {
+	r.secMu.RLock()
+	defer r.secMu.RUnlock()
+	return r.secondary.Flush()
+}
+
+func (r *Replica) poke() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Size implements ublk.Backend.
+func (r *Replica) Size() int64 {
+	return r.size
+}
+
+// Flush flushes the primary and, in Sync mode, the secondary. A secondary
+// that fails the flush is dropped out of sync with everything marked, as it
+// may have lost any write since the last flush.
+func (r *Replica) Flush() error {
+	if err := r.primary.Flush(); err != nil {
+		return err
+	}
+	if r.opts.Mode == Async {
+		return nil
+	}
+	r.mu.Lock()
+	outOfSync := r.outOfSync
+	r.mu.Unlock()
+	if outOfSync {
+		return nil
+	}
+	if err := r.flushSecondary(); err != nil {
+		r.fail(err, []queuedWrite{{off: 0, length: r.size}})
+	}
+	return nil
+}
+
+// Close waits for queued writes to reach the secondary, or for it to
+// fail, then closes both backends. Blocks still out of sync are lost.
+func (r *Replica) Close() error {
+	r.mu.Lock()
+	for !r.outOfSync && (len(r.queue) > 0 || r.applying) {
+		r.cond.Wait()
+	}
+	r.closed = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	r.poke()
+	r.done.Wait()
+
+	r.secMu.Lock()
+	defer r.secMu.Unlock()
+	return errors.Join(r.primary.Close(), r.secondary.Close())
+}
+
+// InSync reports whether the secondary holds every write.
+func (r *Replica) InSync() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.outOfSync && len(r.queue) == 0
+}
+
+// Stats implements ublk.StatBackend. Lag is the queue in Async mode and
+// the marked blocks while out of sync.
+func (r *Replica) Stats() map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var lag float64
+	if len(r.queue) > 0 {
+		lag = time.Since(r.queue[0].queued).Seconds()
+	}
+	var marked int
+	for _, w := range r.dirty {
+		marked += bits.OnesCount64(w)
+	}
+	inSync := 1
+	if r.outOfSync {
+		inSync = 0
+	}
+	return map[string]interface{}{
+		"replica_in_sync":    inSync,
+		"queued_writes":      len(r.queue),
+		"queued_bytes":       r.queuedBytes,
+		"lag_seconds":        lag,
+		"out_of_sync_bytes":  min(int64(marked)*r.opts.BlockSize, r.size),
+		"replicated_writes":  r.replicated,
+		"replication_errors": r.failures,
+		"resyncs":            r.resyncs,
+		"resynced_bytes":     r.resyncedBytes,
+	}
+}
+
+// markLocked flags the blocks overlapping [off, off+length).
+func (r *Replica) markLocked(off, length int64) {
+	if length <= 0 {
+		return
+	}
+	for block := off / r.opts.BlockSize; block <= (off+length-1)/r.opts.BlockSize; block++ {
+		if int(block/64) < len(r.dirty) {
+			r.dirty[block/64] |= 1 << (block % 64)
+		}
+	}
+}
+
+func (r *Replica) clearLocked(block int64) {
+	r.dirty[block/64] &^= 1 << (block % 64)
+}
+
+// nextDirtyLocked returns the first marked block at or after from, or -1.
+func (r *Replica) nextDirtyLocked(from int64) int64 {
+	for w := from / 64; w < int64(len(r.dirty)); w++ {
+		word := r.dirty[w]
+		if w == from/64 {
+			word &^= 1<<(from%64) - 1
+		}
+		if word != 0 {
+			return w*64 + int64(bits.TrailingZeros64(word))
+		}
+	}
+	return -1
+}
+
+// WithDiscard returns a replica that also mirrors discards, or r itself if
+// either backend cannot discard, so the device does not advertise discard
+// at all.
+func (r *Replica) WithDiscard() ublk.Backend {
+	if _, ok := r.primary.(ublk.DiscardBackend); !ok {
+		return r
+	}
+	if _, ok := r.secondary.(ublk.DiscardBackend); !ok {
+		return r
+	}
+	return &discardReplica{Replica: r}
+}
+
+// discardReplica adds Discard to Replica. A discard is replicated like a
+// write, in order with the writes around it.
+type discardReplica struct {
+	*Replica
+}
+
+func (r *discardReplica) Discard(offset, length int64) error {
+	if err := r.primary.(ublk.DiscardBackend).Discard(offset, length); err != nil {
+		return err
+	}
+	r.replicate(queuedWrite{off: offset, length: length, discard: true})
+	return nil
+}
+
+// Compile-time interface checks
+var (
+	_ ublk.Backend        = (*Replica)(nil)
+	_ ublk.StatBackend    = (*Replica)(nil)
+	_ ublk.DiscardBackend = (*discardReplica)(nil)
+)
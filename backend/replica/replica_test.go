@@ -0,0 +1,249 @@
+package replica
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+var errDown = errors.New("secondary down")
+
+// flakyBackend fails every call while down is set. Close is a no-op so the
+// contents can be checked after the replica is closed.
+type flakyBackend struct {
+	*ublk.MockBackend
+	down atomic.Bool
+}
+
+func (b *flakyBackend) WriteAt(p []byte, off int64) (int, error) {
+	if b.down.Load() {
+		return 0, errDown
+	}
+	return b.MockBackend.WriteAt(p, off)
+}
+
+func (b *flakyBackend) Discard(offset, length int64) error {
+	if b.down.Load() {
+		return errDown
+	}
+	return b.MockBackend.Discard(offset, length)
+}
+
+func (b *flakyBackend) Flush() error {
+	if b.down.Load() {
+		return errDown
+	}
+	return b.MockBackend.Flush()
+}
+
+func (b *flakyBackend) Close() error { return nil }
+
+func newFlaky(size int64) *flakyBackend {
+	return &flakyBackend{MockBackend: ublk.NewMockBackend(size)}
+}
+
+func fill(c byte, n int) []byte {
+	return bytes.Repeat([]byte{c}, n)
+}
+
+func assertSame(t *testing.T, primary, secondary ublk.Backend) {
+	t.Helper()
+	a, b := make([]byte, primary.Size()), make([]byte, primary.Size())
+	primary.ReadAt(a, 0)
+	secondary.ReadAt(b, 0)
+	if !bytes.Equal(a, b) {
+		t.Error("secondary differs from the primary")
+	}
+}
+
+func waitInSync(t *testing.T, r *Replica) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !r.InSync() {
+		if time.Now().After(deadline) {
+			t.Fatalf("replica not in sync: %v", r.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSyncReplicates(t *testing.T) {
+	primary, secondary := newFlaky(1<<20), newFlaky(1<<20)
+	r, err := New(primary, secondary, Options{InSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := r.WriteAt(fill(1, 8192), 4096); err != nil {
+		t.Fatal(err)
+	}
+	// Sync mode: the secondary has the write as soon as WriteAt returns
+	assertSame(t, primary, secondary)
+	if err := r.Flush(); err != nil || !secondary.IsFlushed() {
+		t.Errorf("Flush = %v, secondary flushed = %v", err, secondary.IsFlushed())
+	}
+}
+
+func TestInitialSync(t *testing.T) {
+	primary, secondary := newFlaky(1<<20), newFlaky(1<<20)
+	primary.WriteAt(fill(7, 1<<20), 0)
+
+	r, err := New(primary, secondary, Options{BlockSize: 64 << 10, RetryInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	waitInSync(t, r)
+	assertSame(t, primary, secondary)
+	if got := r.Stats()["resynced_bytes"]; got != uint64(1<<20) {
+		t.Errorf("resynced_bytes = %v, want the whole device", got)
+	}
+}
+
+func TestResyncAfterFailure(t *testing.T) {
+	for _, mode := range []Mode{Sync, Async} {
+		t.Run(mode.String(), func(t *testing.T) {
+			primary, secondary := newFlaky(1<<20), newFlaky(1<<20)
+			r, err := New(primary, secondary, Options{
+				Mode:          mode,
+				InSync:        true,
+				BlockSize:     4096,
+				RetryInterval: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			secondary.down.Store(true)
+			// Writes keep succeeding while the secondary is down
+			for i := range 8 {
+				if _, err := r.WriteAt(fill(byte(i+1), 4096), int64(i)*64<<10); err != nil {
+					t.Fatalf("WriteAt with the secondary down: %v", err)
+				}
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for r.Stats()["replication_errors"].(uint64) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("no replication error recorded")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if r.InSync() {
+				t.Error("replica reports in sync with the secondary down")
+			}
+
+			secondary.down.Store(false)
+			waitInSync(t, r)
+			assertSame(t, primary, secondary)
+			if got := r.Stats()["out_of_sync_bytes"]; got != int64(0) {
+				t.Errorf("out_of_sync_bytes = %v after resync", got)
+			}
+		})
+	}
+}
+
+func TestAsyncDrainsOnClose(t *testing.T) {
+	primary, secondary := newFlaky(1<<20), newFlaky(1<<20)
+	r, err := New(primary, secondary, Options{Mode: Async, InSync: true, QueueBytes: 16 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.WriteAt(fill(byte(i+1), 4096), int64(i)*4096)
+		}()
+	}
+	wg.Wait()
+	if queued := r.Stats()["queued_bytes"].(int64); queued > 16<<10 {
+		t.Errorf("queued_bytes = %d, want at most the 16KiB bound", queued)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertSame(t, primary, secondary)
+}
+
+func TestReconnect(t *testing.T) {
+	primary, first := newFlaky(1<<20), newFlaky(1<<20)
+	replacement := newFlaky(1 << 20)
+	var reconnects atomic.Int32
+	r, err := New(primary, first, Options{
+		InSync:        true,
+		BlockSize:     4096,
+		RetryInterval: time.Millisecond,
+		Reconnect: func() (ublk.Backend, error) {
+			reconnects.Add(1)
+			return replacement, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	primary.WriteAt(fill(3, 4096), 0)
+	first.down.Store(true)
+	r.WriteAt(fill(4, 4096), 8192)
+
+	waitInSync(t, r)
+	if reconnects.Load() == 0 {
+		t.Fatal("Reconnect was not called")
+	}
+	// The replacement knows nothing, but only the blocks missed by the
+	// failed secondary are copied
+	want := make([]byte, 1<<20)
+	copy(want[8192:], fill(4, 4096))
+	got := make([]byte, 1<<20)
+	replacement.ReadAt(got, 0)
+	if !bytes.Equal(got, want) {
+		t.Error("replacement does not hold exactly the missed write")
+	}
+}
+
+func TestWithDiscard(t *testing.T) {
+	primary, secondary := newFlaky(1<<20), newFlaky(1<<20)
+	r, err := New(primary, secondary, Options{InSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	b := r.WithDiscard()
+	db, ok := b.(ublk.DiscardBackend)
+	if !ok {
+		t.Fatal("WithDiscard did not add Discard")
+	}
+	b.WriteAt(fill(9, 8192), 0)
+	if err := db.Discard(0, 4096); err != nil {
+		t.Fatal(err)
+	}
+	assertSame(t, primary, secondary)
+
+	plain, err := New(primary, struct{ ublk.Backend }{secondary}, Options{InSync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, ok := plain.WithDiscard().(ublk.DiscardBackend); ok {
+		t.Error("WithDiscard advertised discard the secondary lacks")
+	}
+}
+
+func TestNewRejectsSmallSecondary(t *testing.T) {
+	if _, err := New(newFlaky(1<<20), newFlaky(512<<10), Options{}); err == nil {
+		t.Error("New accepted a secondary smaller than the primary")
+	}
+}
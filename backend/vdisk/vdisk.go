@@ -0,0 +1,128 @@
+// Package vdisk serves virtual disk image formats such as VHD and VHDX.
+//
+// Each format implements Format, so servers can detect and open images
+// without knowing which formats exist. Raw images are not a Format; serve
+// them with package backend/file, which adds discard and O_DIRECT support.
+package vdisk
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// Format is a virtual disk image format.
+type Format interface {
+	// Name is a short identifier such as "vhd", used for flags and logs.
+	Name() string
+
+	// Detect reports whether r, which is size bytes long, holds an image
+	// in this format. It only checks signatures; Open validates the rest.
+	Detect(r io.ReaderAt, size int64) bool
+
+	// Open returns a backend serving the virtual disk stored in f. The
+	// backend owns f and closes it on Close.
+	Open(f *os.File, readOnly bool) (ublk.Backend, error)
+}
+
+// SectorSizer is implemented by backends whose format records the sector
+// sizes the disk was created with. Servers should use them for the device's
+// logical and physical block sizes, since partition tables depend on them.
+type SectorSizer interface {
+	LogicalSectorSize() int
+	PhysicalSectorSize() int
+}
+
+// Formats lists the supported formats in the order Detect tries them.
+func Formats() []Format {
+	return []Format{VHDX, VHD}
+}
+
+// Lookup returns the format called name, or nil.
+func Lookup(name string) Format {
+	for _, f := range Formats() {
+		if f.Name() == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Detect returns the format of the image in f, or nil if it matches none
+// and should be treated as raw.
+func Detect(f *os.File) (Format, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	for _, format := range Formats() {
+		if format.Detect(f, fi.Size()) {
+			return format, nil
+		}
+	}
+	return nil, nil
+}
+
+// Open opens the image at path in the given format, or detects the format
+// if it is nil. It fails for images that match no format.
+func Open(path string, format Format, readOnly bool) (ublk.Backend, error) {
+	flags := os.O_RDWR
+	if readOnly {
+		flags = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flags, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == nil {
+		format, err = Detect(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if format == nil {
+			f.Close()
+			return nil, fmt.Errorf("%s is not a recognized virtual disk image", path)
+		}
+	}
+
+	b, err := format.Open(f, readOnly)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", format.Name(), err)
+	}
+	return b, nil
+}
+
+// segment is the part of a request that falls inside one image block.
+type segment struct {
+	block  uint64 // block index
+	offset int64  // byte offset inside the block
+	buf    []byte // slice of the request buffer
+}
+
+// splitBlocks cuts a request at off into per-block segments.
+func splitBlocks(p []byte, off int64, blockSize int64) []segment {
+	var segs []segment
+	for len(p) > 0 {
+		inBlock := off % blockSize
+		n := min(int64(len(p)), blockSize-inBlock)
+		segs = append(segs, segment{block: uint64(off / blockSize), offset: inBlock, buf: p[:n]})
+		p = p[n:]
+		off += n
+	}
+	return segs
+}
+
+// isZero reports whether p is all zero bytes.
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,310 @@
+package vdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// VHD is the Virtual PC / Hyper-V VHD format, as exported by Azure. Fixed
+// and dynamic disks are supported for reading and writing; differencing
+// disks are rejected.
+var VHD Format = vhdFormat{}
+
+// VHD on-disk layout. All fields are big-endian.
+const (
+	vhdFooterSize      = 512
+	vhdDynHeaderSize   = 1024
+	vhdSectorSize      = 512
+	vhdUnallocated     = 0xFFFFFFFF
+	vhdFixedDataOffset = 0xFFFFFFFFFFFFFFFF
+
+	vhdTypeFixed        = 2
+	vhdTypeDynamic      = 3
+	vhdTypeDifferencing = 4
+
+	// Footer field offsets
+	vhdFooterDataOffset  = 16
+	vhdFooterCurrentSize = 48
+	vhdFooterDiskType    = 60
+	vhdFooterChecksum    = 64
+
+	// Dynamic header field offsets
+	vhdDynTableOffset     = 16
+	vhdDynMaxTableEntries = 28
+	vhdDynBlockSize       = 32
+	vhdDynChecksum        = 36
+)
+
+var (
+	vhdFooterCookie = []byte("conectix")
+	vhdDynCookie    = []byte("cxsparse")
+)
+
+type vhdFormat struct{}
+
+func (vhdFormat) Name() string { return "vhd" }
+
+// Detect looks for the footer at the end of the file. Fixed disks have
+// nothing else to identify them.
+func (vhdFormat) Detect(r io.ReaderAt, size int64) bool {
+	if size < vhdFooterSize {
+		return false
+	}
+	cookie := make([]byte, len(vhdFooterCookie))
+	if _, err := r.ReadAt(cookie, size-vhdFooterSize); err != nil {
+		return false
+	}
+	return bytes.Equal(cookie, vhdFooterCookie)
+}
+
+func (vhdFormat) Open(f *os.File, readOnly bool) (ublk.Backend, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < vhdFooterSize {
+		return nil, errors.New("file too small for a footer")
+	}
+
+	footer := make([]byte, vhdFooterSize)
+	if _, err := f.ReadAt(footer, fi.Size()-vhdFooterSize); err != nil {
+		return nil, fmt.Errorf("read footer: %w", err)
+	}
+	if !bytes.Equal(footer[:8], vhdFooterCookie) {
+		return nil, errors.New("footer cookie missing")
+	}
+	got, want := binary.BigEndian.Uint32(footer[vhdFooterChecksum:]), vhdChecksum(footer, vhdFooterChecksum)
+	if got != want {
+		return nil, fmt.Errorf("footer checksum %#x, want %#x", got, want)
+	}
+
+	size := int64(binary.BigEndian.Uint64(footer[vhdFooterCurrentSize:]))
+	b := &vhdBackend{
+		f:        f,
+		size:     size,
+		readOnly: readOnly,
+		footer:   footer,
+		end:      fi.Size() - vhdFooterSize,
+	}
+
+	switch diskType := binary.BigEndian.Uint32(footer[vhdFooterDiskType:]); diskType {
+	case vhdTypeFixed:
+		if size > b.end {
+			return nil, fmt.Errorf("disk size %d exceeds the %d data bytes in the file", size, b.end)
+		}
+		return b, nil
+	case vhdTypeDynamic:
+		if err := b.readDynamicHeader(binary.BigEndian.Uint64(footer[vhdFooterDataOffset:])); err != nil {
+			return nil, err
+		}
+		return b, nil
+	case vhdTypeDifferencing:
+		return nil, errors.New("differencing disks are not supported")
+	default:
+		return nil, fmt.Errorf("unknown disk type %d", diskType)
+	}
+}
+
+// vhdBackend serves a fixed or dynamic VHD. Fixed disks map the virtual
+// disk 1:1 onto the start of the file. Dynamic disks map fixed-size blocks
+// through the block allocation table (BAT); each allocated block is a
+// sector bitmap followed by the data, and new blocks are appended where
+// the footer was, with the footer rewritten after them.
+type vhdBackend struct {
+	f        *os.File
+	size     int64
+	readOnly bool
+
+	// Dynamic disks only; bat is nil for fixed disks
+	blockSize  int64
+	bitmapSize int64 // sector bitmap in front of each block, sector aligned
+	batOffset  int64
+
+	// mu guards bat, end and footer. Reads and writes of allocated
+	// blocks hold it shared; allocating a block holds it exclusively.
+	mu     sync.RWMutex
+	bat    []uint32 // sector offset of each block, or vhdUnallocated
+	end    int64    // offset of the trailing footer
+	footer []byte
+}
+
+func (b *vhdBackend) readDynamicHeader(offset uint64) error {
+	if offset == vhdFixedDataOffset {
+		return errors.New("dynamic disk without a dynamic header")
+	}
+	hdr := make([]byte, vhdDynHeaderSize)
+	if _, err := b.f.ReadAt(hdr, int64(offset)); err != nil {
+		return fmt.Errorf("read dynamic header: %w", err)
+	}
+	if !bytes.Equal(hdr[:8], vhdDynCookie) {
+		return errors.New("dynamic header cookie missing")
+	}
+	if got, want := binary.BigEndian.Uint32(hdr[vhdDynChecksum:]), vhdChecksum(hdr, vhdDynChecksum); got != want {
+		return fmt.Errorf("dynamic header checksum %#x, want %#x", got, want)
+	}
+
+	b.blockSize = int64(binary.BigEndian.Uint32(hdr[vhdDynBlockSize:]))
+	if b.blockSize < vhdSectorSize || b.blockSize%vhdSectorSize != 0 {
+		return fmt.Errorf("invalid block size %d", b.blockSize)
+	}
+	bitmapBytes := b.blockSize / vhdSectorSize / 8
+	b.bitmapSize = (bitmapBytes + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+
+	entries := int64(binary.BigEndian.Uint32(hdr[vhdDynMaxTableEntries:]))
+	if entries*b.blockSize < b.size {
+		return fmt.Errorf("BAT of %d entries cannot map %d bytes", entries, b.size)
+	}
+	b.batOffset = int64(binary.BigEndian.Uint64(hdr[vhdDynTableOffset:]))
+	raw := make([]byte, entries*4)
+	if _, err := b.f.ReadAt(raw, b.batOffset); err != nil {
+		return fmt.Errorf("read BAT: %w", err)
+	}
+	b.bat = make([]uint32, entries)
+	for i := range b.bat {
+		b.bat[i] = binary.BigEndian.Uint32(raw[i*4:])
+	}
+	return nil
+}
+
+func (b *vhdBackend) ReadAt(p []byte, off int64) (int, error) {
+	if b.bat == nil {
+		return b.f.ReadAt(p, off)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, seg := range splitBlocks(p, off, b.blockSize) {
+		sector := b.bat[seg.block]
+		if sector == vhdUnallocated {
+			clear(seg.buf)
+			continue
+		}
+		if _, err := b.f.ReadAt(seg.buf, b.dataOffset(sector)+seg.offset); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (b *vhdBackend) WriteAt(p []byte, off int64) (int, error) {
+	if b.readOnly {
+		return 0, syscall.EROFS
+	}
+	if b.bat == nil {
+		return b.f.WriteAt(p, off)
+	}
+
+	for _, seg := range splitBlocks(p, off, b.blockSize) {
+		if err := b.writeSegment(seg); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (b *vhdBackend) writeSegment(seg segment) error {
+	b.mu.RLock()
+	sector := b.bat[seg.block]
+	if sector != vhdUnallocated {
+		_, err := b.f.WriteAt(seg.buf, b.dataOffset(sector)+seg.offset)
+		b.mu.RUnlock()
+		return err
+	}
+	b.mu.RUnlock()
+
+	// Unallocated blocks already read as zeros
+	if isZero(seg.buf) {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sector = b.bat[seg.block]
+	if sector == vhdUnallocated {
+		var err error
+		if sector, err = b.allocate(seg.block); err != nil {
+			return err
+		}
+	}
+	_, err := b.f.WriteAt(seg.buf, b.dataOffset(sector)+seg.offset)
+	return err
+}
+
+// allocate appends a zeroed block at the end of the file, moves the footer
+// behind it and points the BAT at it. The BAT entry is written last, so a
+// crash part way leaves at worst an unreferenced block, and the footer copy
+// at the start of the file stands in if the trailing one was lost.
+func (b *vhdBackend) allocate(block uint64) (uint32, error) {
+	start := b.end
+	if start%vhdSectorSize != 0 {
+		return 0, fmt.Errorf("footer at unaligned offset %d", start)
+	}
+	sector := uint32(start / vhdSectorSize)
+
+	// Mark every sector present; the data is written as zeros so the
+	// bitmap is accurate whatever a reader makes of it
+	buf := make([]byte, b.bitmapSize+b.blockSize)
+	for i := range b.blockSize / vhdSectorSize / 8 {
+		buf[i] = 0xFF
+	}
+	if _, err := b.f.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	end := start + int64(len(buf))
+	if _, err := b.f.WriteAt(b.footer, end); err != nil {
+		return 0, err
+	}
+
+	var entry [4]byte
+	binary.BigEndian.PutUint32(entry[:], sector)
+	if _, err := b.f.WriteAt(entry[:], b.batOffset+int64(block)*4); err != nil {
+		return 0, err
+	}
+
+	b.bat[block] = sector
+	b.end = end
+	return sector, nil
+}
+
+// dataOffset returns where the data of the block at sector begins.
+func (b *vhdBackend) dataOffset(sector uint32) int64 {
+	return int64(sector)*vhdSectorSize + b.bitmapSize
+}
+
+func (b *vhdBackend) Size() int64 {
+	return b.size
+}
+
+func (b *vhdBackend) Close() error {
+	return b.f.Close()
+}
+
+func (b *vhdBackend) Flush() error {
+	if b.readOnly {
+		return nil
+	}
+	return b.f.Sync()
+}
+
+// vhdChecksum is the one's complement of the byte sum of a footer or
+// dynamic header, skipping its own checksum field at sumOffset.
+func vhdChecksum(buf []byte, sumOffset int) uint32 {
+	var sum uint32
+	for i, c := range buf {
+		if i >= sumOffset && i < sumOffset+4 {
+			continue
+		}
+		sum += uint32(c)
+	}
+	return ^sum
+}
+
+var _ ublk.Backend = (*vhdBackend)(nil)
@@ -0,0 +1,213 @@
+package vdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// vhdTestFooter builds a VHD footer for a disk of the given size and type.
+func vhdTestFooter(size int64, diskType uint32, dataOffset uint64) []byte {
+	f := make([]byte, vhdFooterSize)
+	copy(f, vhdFooterCookie)
+	binary.BigEndian.PutUint32(f[8:], 2)           // Features: reserved bit
+	binary.BigEndian.PutUint32(f[12:], 0x00010000) // Version 1.0
+	binary.BigEndian.PutUint64(f[vhdFooterDataOffset:], dataOffset)
+	binary.BigEndian.PutUint64(f[40:], uint64(size)) // Original size
+	binary.BigEndian.PutUint64(f[vhdFooterCurrentSize:], uint64(size))
+	binary.BigEndian.PutUint32(f[vhdFooterDiskType:], diskType)
+	binary.BigEndian.PutUint32(f[vhdFooterChecksum:], vhdChecksum(f, vhdFooterChecksum))
+	return f
+}
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeFixedVHD stores data followed by a fixed-disk footer.
+func writeFixedVHD(t *testing.T, data []byte) string {
+	t.Helper()
+	footer := vhdTestFooter(int64(len(data)), vhdTypeFixed, vhdFixedDataOffset)
+	return writeTestFile(t, "fixed.vhd", append(bytes.Clone(data), footer...))
+}
+
+// writeDynamicVHD lays out an empty dynamic disk the way Hyper-V does:
+// footer copy, dynamic header, BAT, footer.
+func writeDynamicVHD(t *testing.T, size, blockSize int64) string {
+	t.Helper()
+	entries := (size + blockSize - 1) / blockSize
+	const batOffset = vhdFooterSize + vhdDynHeaderSize
+	batSize := (entries*4 + vhdSectorSize - 1) / vhdSectorSize * vhdSectorSize
+
+	footer := vhdTestFooter(size, vhdTypeDynamic, vhdFooterSize)
+	hdr := make([]byte, vhdDynHeaderSize)
+	copy(hdr, vhdDynCookie)
+	binary.BigEndian.PutUint64(hdr[8:], vhdFixedDataOffset)
+	binary.BigEndian.PutUint64(hdr[vhdDynTableOffset:], batOffset)
+	binary.BigEndian.PutUint32(hdr[24:], 0x00010000)
+	binary.BigEndian.PutUint32(hdr[vhdDynMaxTableEntries:], uint32(entries))
+	binary.BigEndian.PutUint32(hdr[vhdDynBlockSize:], uint32(blockSize))
+	binary.BigEndian.PutUint32(hdr[vhdDynChecksum:], vhdChecksum(hdr, vhdDynChecksum))
+	bat := bytes.Repeat([]byte{0xFF}, int(batSize))
+
+	var img []byte
+	img = append(img, footer...)
+	img = append(img, hdr...)
+	img = append(img, bat...)
+	img = append(img, footer...)
+	return writeTestFile(t, "dynamic.vhd", img)
+}
+
+func TestVHDFixed(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096) // 64 KiB
+	path := writeFixedVHD(t, data)
+
+	b, err := Open(path, nil, false)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+
+	if b.Size() != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", b.Size(), len(data))
+	}
+	got := make([]byte, 100)
+	if _, err := b.ReadAt(got, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[1000:1100]) {
+		t.Error("read returned the wrong data")
+	}
+
+	if _, err := b.WriteAt([]byte("written"), 512); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(raw[512:519], []byte("written")) {
+		t.Error("fixed disk write did not land at the same file offset")
+	}
+	if !VHD.Detect(bytes.NewReader(raw), int64(len(raw))) {
+		t.Error("footer no longer detected after a write")
+	}
+}
+
+func TestVHDDynamic(t *testing.T) {
+	const blockSize = 64 << 10
+	path := writeDynamicVHD(t, 1<<20, blockSize)
+	before, _ := os.Stat(path)
+
+	b, err := Open(path, VHD, false)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// Unallocated blocks read as zeros, and zero writes do not allocate
+	got := make([]byte, 4096)
+	got[0] = 1
+	if _, err := b.ReadAt(got, 0); err != nil || !isZero(got) {
+		t.Fatalf("unallocated read = %v, zero=%v", err, isZero(got))
+	}
+	if _, err := b.WriteAt(make([]byte, 4096), 0); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(path); after.Size() != before.Size() {
+		t.Error("zero write to an unallocated block grew the file")
+	}
+
+	// A write spanning two blocks allocates both
+	want := bytes.Repeat([]byte{0xAB}, 8192)
+	off := int64(blockSize - 4096)
+	if _, err := b.WriteAt(want, off); err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, 8192)
+	if _, err := b.ReadAt(got, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("read after write returned the wrong data")
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The image must reopen with a valid footer and the data in place
+	b, err = Open(path, nil, true)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer b.Close()
+	got = make([]byte, blockSize*2)
+	if _, err := b.ReadAt(got, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !isZero(got[:off]) || !bytes.Equal(got[off:off+8192], want) || !isZero(got[off+8192:]) {
+		t.Error("data after reopen does not match what was written")
+	}
+	if _, err := b.WriteAt(want, 0); err == nil {
+		t.Error("write to a read-only image succeeded")
+	}
+}
+
+func TestVHDDynamicConcurrentAllocation(t *testing.T) {
+	const blockSize = 4096
+	b, err := Open(writeDynamicVHD(t, 64*blockSize, blockSize), VHD, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	for i := range 64 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := bytes.Repeat([]byte{byte(i + 1)}, 512)
+			if _, err := b.WriteAt(buf, int64(i)*blockSize+512); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range 64 {
+		got := make([]byte, 512)
+		if _, err := b.ReadAt(got, int64(i)*blockSize+512); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, bytes.Repeat([]byte{byte(i + 1)}, 512)) {
+			t.Errorf("block %d holds the wrong data", i)
+		}
+	}
+}
+
+func TestVHDRejects(t *testing.T) {
+	bad := vhdTestFooter(4096, vhdTypeFixed, vhdFixedDataOffset)
+	bad[100] ^= 0xFF
+	if _, err := Open(writeTestFile(t, "bad.vhd", append(make([]byte, 4096), bad...)), VHD, false); err == nil {
+		t.Error("expected a checksum error")
+	}
+
+	diff := vhdTestFooter(4096, vhdTypeDifferencing, vhdFooterSize)
+	if _, err := Open(writeTestFile(t, "diff.vhd", append(make([]byte, 4096), diff...)), VHD, false); err == nil {
+		t.Error("expected differencing disks to be rejected")
+	}
+
+	if _, err := Open(writeTestFile(t, "raw.img", make([]byte, 4096)), nil, false); err == nil {
+		t.Error("expected a raw image to be rejected")
+	}
+}
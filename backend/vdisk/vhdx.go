@@ -0,0 +1,376 @@
+package vdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// VHDX is the Hyper-V VHDX format. Fixed and dynamic disks are supported
+// read-only: writing needs the metadata log, which is not implemented.
+// Images with a pending log and differencing disks are rejected.
+var VHDX Format = vhdxFormat{}
+
+// VHDX on-disk layout. All fields are little-endian.
+const (
+	vhdxHeader1Offset = 64 << 10
+	vhdxHeader2Offset = 128 << 10
+	vhdxHeaderSize    = 4 << 10
+	vhdxRegion1Offset = 192 << 10
+	vhdxRegion2Offset = 256 << 10
+	vhdxRegionSize    = 64 << 10
+
+	vhdxMetadataTableSize = 64 << 10
+
+	// BAT entry states (low 3 bits)
+	vhdxBlockFullyPresent     = 6
+	vhdxBlockPartiallyPresent = 7
+	vhdxBATStateMask          = 7
+	vhdxBATOffsetShift        = 20 // file offset in MB, bits 20-63
+
+	vhdxFileParamHasParent = 1 << 1
+	vhdxEntryRequired      = 1 << 0 // region table entry flag
+	vhdxMetaRequired       = 1 << 2 // metadata table entry flag
+)
+
+var (
+	vhdxFileSignature     = []byte("vhdxfile")
+	vhdxHeaderSignature   = []byte("head")
+	vhdxRegionSignature   = []byte("regi")
+	vhdxMetadataSignature = []byte("metadata")
+
+	vhdxRegionBAT      = vhdxGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	vhdxRegionMetadata = vhdxGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	vhdxMetaFileParameters   = vhdxGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	vhdxMetaVirtualDiskSize  = vhdxGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	vhdxMetaLogicalSector    = vhdxGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	vhdxMetaPhysicalSector   = vhdxGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	vhdxMetaPage83           = vhdxGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	vhdxMetaParentLocator    = vhdxGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+	vhdxKnownMetadataEntries = [][16]byte{
+		vhdxMetaFileParameters, vhdxMetaVirtualDiskSize, vhdxMetaLogicalSector,
+		vhdxMetaPhysicalSector, vhdxMetaPage83, vhdxMetaParentLocator,
+	}
+
+	crc32c = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type vhdxFormat struct{}
+
+func (vhdxFormat) Name() string { return "vhdx" }
+
+func (vhdxFormat) Detect(r io.ReaderAt, size int64) bool {
+	sig := make([]byte, len(vhdxFileSignature))
+	if _, err := r.ReadAt(sig, 0); err != nil {
+		return false
+	}
+	return bytes.Equal(sig, vhdxFileSignature)
+}
+
+func (vhdxFormat) Open(f *os.File, readOnly bool) (ublk.Backend, error) {
+	if !readOnly {
+		return nil, errors.New("VHDX images can only be opened read-only")
+	}
+
+	hdr, err := vhdxCurrentHeader(f)
+	if err != nil {
+		return nil, err
+	}
+	if logGUID := hdr[48:64]; !isZero(logGUID) {
+		return nil, errors.New("image has a pending metadata log; replay it (e.g. qemu-img check -r all) before attaching")
+	}
+
+	regions, err := vhdxRegions(f)
+	if err != nil {
+		return nil, err
+	}
+	bat, ok := regions[vhdxRegionBAT]
+	if !ok {
+		return nil, errors.New("no BAT region")
+	}
+	meta, ok := regions[vhdxRegionMetadata]
+	if !ok {
+		return nil, errors.New("no metadata region")
+	}
+
+	b := &vhdxBackend{f: f}
+	if err := b.readMetadata(meta.offset); err != nil {
+		return nil, err
+	}
+	if err := b.readBAT(bat); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// vhdxBackend serves a VHDX image read-only. Payload blocks are located
+// through the BAT, where every chunkRatio payload entries are followed by
+// one sector bitmap entry that only differencing disks use.
+type vhdxBackend struct {
+	f            *os.File
+	size         int64
+	blockSize    int64
+	logicalSect  int
+	physicalSect int
+	chunkRatio   uint64
+	bat          []uint64
+}
+
+type vhdxRegion struct {
+	offset int64
+	length int64
+}
+
+// vhdxCurrentHeader returns the valid header with the highest sequence
+// number. Writers alternate between the two copies.
+func vhdxCurrentHeader(f *os.File) ([]byte, error) {
+	var best []byte
+	var bestSeq uint64
+	for _, off := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		hdr := make([]byte, vhdxHeaderSize)
+		if _, err := f.ReadAt(hdr, off); err != nil {
+			continue
+		}
+		if !bytes.Equal(hdr[:4], vhdxHeaderSignature) || !vhdxChecksumOK(hdr) {
+			continue
+		}
+		if seq := binary.LittleEndian.Uint64(hdr[8:]); best == nil || seq > bestSeq {
+			best, bestSeq = hdr, seq
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no valid header")
+	}
+	if version := binary.LittleEndian.Uint16(best[66:]); version != 1 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	return best, nil
+}
+
+// vhdxRegions reads the first valid region table. Unknown regions marked
+// required mean the image uses features this reader does not understand.
+func vhdxRegions(f *os.File) (map[[16]byte]vhdxRegion, error) {
+	for _, off := range []int64{vhdxRegion1Offset, vhdxRegion2Offset} {
+		table := make([]byte, vhdxRegionSize)
+		if _, err := f.ReadAt(table, off); err != nil {
+			continue
+		}
+		if !bytes.Equal(table[:4], vhdxRegionSignature) || !vhdxChecksumOK(table) {
+			continue
+		}
+
+		count := int(binary.LittleEndian.Uint32(table[8:]))
+		if 16+count*32 > len(table) {
+			return nil, fmt.Errorf("region table claims %d entries", count)
+		}
+		regions := make(map[[16]byte]vhdxRegion, count)
+		for i := range count {
+			e := table[16+i*32 : 16+(i+1)*32]
+			var id [16]byte
+			copy(id[:], e[:16])
+			required := binary.LittleEndian.Uint32(e[28:])&vhdxEntryRequired != 0
+			if id != vhdxRegionBAT && id != vhdxRegionMetadata && required {
+				return nil, fmt.Errorf("unknown required region %x", id)
+			}
+			regions[id] = vhdxRegion{
+				offset: int64(binary.LittleEndian.Uint64(e[16:])),
+				length: int64(binary.LittleEndian.Uint32(e[24:])),
+			}
+		}
+		return regions, nil
+	}
+	return nil, errors.New("no valid region table")
+}
+
+func (b *vhdxBackend) readMetadata(offset int64) error {
+	table := make([]byte, vhdxMetadataTableSize)
+	if _, err := b.f.ReadAt(table, offset); err != nil {
+		return fmt.Errorf("read metadata table: %w", err)
+	}
+	if !bytes.Equal(table[:8], vhdxMetadataSignature) {
+		return errors.New("metadata table signature missing")
+	}
+
+	items := make(map[[16]byte][]byte)
+	count := int(binary.LittleEndian.Uint16(table[10:]))
+	if 32+count*32 > len(table) {
+		return fmt.Errorf("metadata table claims %d entries", count)
+	}
+	for i := range count {
+		e := table[32+i*32 : 32+(i+1)*32]
+		var id [16]byte
+		copy(id[:], e[:16])
+		itemOff := int64(binary.LittleEndian.Uint32(e[16:]))
+		itemLen := int(binary.LittleEndian.Uint32(e[20:]))
+		flags := binary.LittleEndian.Uint32(e[24:])
+		if flags&vhdxMetaRequired != 0 && !vhdxKnownMetadata(id) {
+			return fmt.Errorf("unknown required metadata item %x", id)
+		}
+		item := make([]byte, itemLen)
+		if _, err := b.f.ReadAt(item, offset+itemOff); err != nil {
+			return fmt.Errorf("read metadata item %x: %w", id, err)
+		}
+		items[id] = item
+	}
+
+	get := func(id [16]byte, name string, size int) ([]byte, error) {
+		item, ok := items[id]
+		if !ok || len(item) < size {
+			return nil, fmt.Errorf("missing %s metadata", name)
+		}
+		return item, nil
+	}
+	params, err := get(vhdxMetaFileParameters, "file parameters", 8)
+	if err != nil {
+		return err
+	}
+	size, err := get(vhdxMetaVirtualDiskSize, "virtual disk size", 8)
+	if err != nil {
+		return err
+	}
+	logical, err := get(vhdxMetaLogicalSector, "logical sector size", 4)
+	if err != nil {
+		return err
+	}
+	physical, err := get(vhdxMetaPhysicalSector, "physical sector size", 4)
+	if err != nil {
+		return err
+	}
+
+	if binary.LittleEndian.Uint32(params[4:])&vhdxFileParamHasParent != 0 {
+		return errors.New("differencing disks are not supported")
+	}
+	b.blockSize = int64(binary.LittleEndian.Uint32(params[0:]))
+	b.size = int64(binary.LittleEndian.Uint64(size))
+	b.logicalSect = int(binary.LittleEndian.Uint32(logical))
+	b.physicalSect = int(binary.LittleEndian.Uint32(physical))
+
+	if b.blockSize < 1<<20 || b.blockSize > 256<<20 || b.blockSize&(b.blockSize-1) != 0 {
+		return fmt.Errorf("invalid block size %d", b.blockSize)
+	}
+	if b.logicalSect != 512 && b.logicalSect != 4096 {
+		return fmt.Errorf("invalid logical sector size %d", b.logicalSect)
+	}
+	b.chunkRatio = uint64((1 << 23) * int64(b.logicalSect) / b.blockSize)
+	return nil
+}
+
+func (b *vhdxBackend) readBAT(region vhdxRegion) error {
+	dataBlocks := uint64((b.size + b.blockSize - 1) / b.blockSize)
+	entries := dataBlocks
+	if dataBlocks > 0 {
+		entries += (dataBlocks - 1) / b.chunkRatio // interleaved bitmap entries
+	}
+	if int64(entries*8) > region.length {
+		return fmt.Errorf("BAT region of %d bytes cannot hold %d entries", region.length, entries)
+	}
+
+	raw := make([]byte, entries*8)
+	if _, err := b.f.ReadAt(raw, region.offset); err != nil {
+		return fmt.Errorf("read BAT: %w", err)
+	}
+	b.bat = make([]uint64, entries)
+	for i := range b.bat {
+		b.bat[i] = binary.LittleEndian.Uint64(raw[i*8:])
+	}
+	return nil
+}
+
+func (b *vhdxBackend) ReadAt(p []byte, off int64) (int, error) {
+	for _, seg := range splitBlocks(p, off, b.blockSize) {
+		entry := b.bat[seg.block+seg.block/b.chunkRatio]
+		switch entry & vhdxBATStateMask {
+		case vhdxBlockFullyPresent:
+			base := int64(entry>>vhdxBATOffsetShift) << 20
+			if _, err := b.f.ReadAt(seg.buf, base+seg.offset); err != nil {
+				return 0, err
+			}
+		case vhdxBlockPartiallyPresent:
+			return 0, fmt.Errorf("block %d is only partially present", seg.block)
+		default:
+			// Not present, zero, unmapped or undefined all read as zeros
+			// on a disk without a parent
+			clear(seg.buf)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *vhdxBackend) WriteAt(p []byte, off int64) (int, error) {
+	return 0, syscall.EROFS
+}
+
+func (b *vhdxBackend) Size() int64 {
+	return b.size
+}
+
+func (b *vhdxBackend) Close() error {
+	return b.f.Close()
+}
+
+func (b *vhdxBackend) Flush() error {
+	return nil
+}
+
+// LogicalSectorSize implements SectorSizer.
+func (b *vhdxBackend) LogicalSectorSize() int {
+	return b.logicalSect
+}
+
+// PhysicalSectorSize implements SectorSizer.
+func (b *vhdxBackend) PhysicalSectorSize() int {
+	return b.physicalSect
+}
+
+// vhdxChecksumOK verifies the CRC-32C in bytes 4-8 of a header or region
+// table, computed with that field zeroed.
+func vhdxChecksumOK(buf []byte) bool {
+	want := binary.LittleEndian.Uint32(buf[4:])
+	return vhdxChecksum(buf) == want
+}
+
+func vhdxChecksum(buf []byte) uint32 {
+	c := make([]byte, len(buf))
+	copy(c, buf)
+	clear(c[4:8])
+	return crc32.Checksum(c, crc32c)
+}
+
+func vhdxKnownMetadata(id [16]byte) bool {
+	for _, known := range vhdxKnownMetadataEntries {
+		if id == known {
+			return true
+		}
+	}
+	return false
+}
+
+// vhdxGUID converts a GUID string to its on-disk form, in which the first
+// three fields are little-endian.
+func vhdxGUID(s string) [16]byte {
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		panic("vdisk: bad GUID " + s)
+	}
+	var g [16]byte
+	g[0], g[1], g[2], g[3] = raw[3], raw[2], raw[1], raw[0]
+	g[4], g[5] = raw[5], raw[4]
+	g[6], g[7] = raw[7], raw[6]
+	copy(g[8:], raw[8:])
+	return g
+}
+
+var (
+	_ ublk.Backend = (*vhdxBackend)(nil)
+	_ SectorSizer  = (*vhdxBackend)(nil)
+)
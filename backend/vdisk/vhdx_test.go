@@ -0,0 +1,224 @@
+package vdisk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// vhdxTestImage describes a synthetic VHDX. Blocks maps data block numbers
+// to their contents; each is stored fully present.
+type vhdxTestImage struct {
+	size        int64
+	blockSize   uint32
+	logical     uint32
+	physical    uint32
+	blocks      map[uint64][]byte
+	pendingLog  bool
+	hasParent   bool
+	extraRegion bool // an unknown required region
+}
+
+// Fixed layout of the test image, in MB: headers and region tables in the
+// first MB, metadata at 1, BAT at 2, payload blocks from 4.
+const (
+	vhdxTestMetadataOffset = 1 << 20
+	vhdxTestBATOffset      = 2 << 20
+	vhdxTestDataOffset     = 4 << 20
+)
+
+func (img vhdxTestImage) write(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	put := func(buf []byte, off int64) {
+		if _, err := f.WriteAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put(vhdxFileSignature, 0)
+
+	// Header 1 is stale; header 2 has the higher sequence number and wins
+	for i, off := range []int64{vhdxHeader1Offset, vhdxHeader2Offset} {
+		hdr := make([]byte, vhdxHeaderSize)
+		copy(hdr, vhdxHeaderSignature)
+		binary.LittleEndian.PutUint64(hdr[8:], uint64(i+1))
+		if img.pendingLog && i == 1 {
+			hdr[48] = 1
+		}
+		binary.LittleEndian.PutUint16(hdr[66:], 1)
+		binary.LittleEndian.PutUint32(hdr[4:], vhdxChecksum(hdr))
+		put(hdr, off)
+	}
+
+	regions := make([]byte, vhdxRegionSize)
+	copy(regions, vhdxRegionSignature)
+	entries := []struct {
+		id     [16]byte
+		offset uint64
+	}{
+		{vhdxRegionBAT, vhdxTestBATOffset},
+		{vhdxRegionMetadata, vhdxTestMetadataOffset},
+	}
+	if img.extraRegion {
+		entries = append(entries, struct {
+			id     [16]byte
+			offset uint64
+		}{vhdxGUID("00000000-0000-0000-0000-000000000001"), 3 << 20})
+	}
+	binary.LittleEndian.PutUint32(regions[8:], uint32(len(entries)))
+	for i, e := range entries {
+		r := regions[16+i*32:]
+		copy(r, e.id[:])
+		binary.LittleEndian.PutUint64(r[16:], e.offset)
+		binary.LittleEndian.PutUint32(r[24:], 1<<20)
+		binary.LittleEndian.PutUint32(r[28:], vhdxEntryRequired)
+	}
+	binary.LittleEndian.PutUint32(regions[4:], vhdxChecksum(regions))
+	put(regions, vhdxRegion1Offset)
+	put(regions, vhdxRegion2Offset)
+
+	// Metadata table with items stored after it
+	var params [8]byte
+	binary.LittleEndian.PutUint32(params[0:], img.blockSize)
+	if img.hasParent {
+		binary.LittleEndian.PutUint32(params[4:], vhdxFileParamHasParent)
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(img.size))
+	var logical, physical [4]byte
+	binary.LittleEndian.PutUint32(logical[:], img.logical)
+	binary.LittleEndian.PutUint32(physical[:], img.physical)
+	items := []struct {
+		id   [16]byte
+		data []byte
+	}{
+		{vhdxMetaFileParameters, params[:]},
+		{vhdxMetaVirtualDiskSize, size[:]},
+		{vhdxMetaLogicalSector, logical[:]},
+		{vhdxMetaPhysicalSector, physical[:]},
+	}
+	meta := make([]byte, vhdxMetadataTableSize)
+	copy(meta, vhdxMetadataSignature)
+	binary.LittleEndian.PutUint16(meta[10:], uint16(len(items)))
+	itemOff := uint32(vhdxMetadataTableSize)
+	for i, item := range items {
+		e := meta[32+i*32:]
+		copy(e, item.id[:])
+		binary.LittleEndian.PutUint32(e[16:], itemOff)
+		binary.LittleEndian.PutUint32(e[20:], uint32(len(item.data)))
+		binary.LittleEndian.PutUint32(e[24:], vhdxMetaRequired)
+		put(item.data, vhdxTestMetadataOffset+int64(itemOff))
+		itemOff += uint32(len(item.data))
+	}
+	put(meta, vhdxTestMetadataOffset)
+
+	// Payload blocks, with the BAT index skipping the bitmap entries
+	chunkRatio := uint64((1 << 23) * int64(img.logical) / int64(img.blockSize))
+	next := int64(vhdxTestDataOffset)
+	for block, data := range img.blocks {
+		var entry [8]byte
+		binary.LittleEndian.PutUint64(entry[:], uint64(next)|vhdxBlockFullyPresent)
+		put(entry[:], vhdxTestBATOffset+int64(block+block/chunkRatio)*8)
+		put(data, next)
+		next += int64(img.blockSize)
+	}
+	if err := f.Truncate(next); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVHDX(t *testing.T) {
+	const blockSize = 1 << 20
+	first := bytes.Repeat([]byte{0x11}, blockSize)
+	// With 4096-byte logical sectors and 1 MiB blocks, a bitmap entry
+	// follows every 32768 payload entries; place a block past one
+	last := uint64(40000)
+	second := bytes.Repeat([]byte{0x22}, blockSize)
+	path := vhdxTestImage{
+		size:      int64(last+1) * blockSize,
+		blockSize: blockSize,
+		logical:   4096,
+		physical:  4096,
+		blocks:    map[uint64][]byte{0: first, last: second},
+	}.write(t)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format, err := Detect(f)
+	f.Close()
+	if err != nil || format != VHDX {
+		t.Fatalf("Detect = %v, %v, want vhdx", format, err)
+	}
+
+	if _, err := Open(path, VHDX, false); err == nil {
+		t.Error("read-write open of a VHDX image succeeded")
+	}
+	b, err := Open(path, VHDX, true)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer b.Close()
+
+	if want := int64(last+1) * blockSize; b.Size() != want {
+		t.Errorf("Size = %d, want %d", b.Size(), want)
+	}
+	ss := b.(SectorSizer)
+	if ss.LogicalSectorSize() != 4096 || ss.PhysicalSectorSize() != 4096 {
+		t.Errorf("sector sizes = %d/%d, want 4096/4096", ss.LogicalSectorSize(), ss.PhysicalSectorSize())
+	}
+
+	// A read spanning the present block 0 and the absent block 1
+	got := make([]byte, 8192)
+	if _, err := b.ReadAt(got, blockSize-4096); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:4096], first[:4096]) || !isZero(got[4096:]) {
+		t.Error("read across present and absent blocks returned the wrong data")
+	}
+	if _, err := b.ReadAt(got, int64(last)*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, second[:8192]) {
+		t.Error("read of a block past a bitmap entry returned the wrong data")
+	}
+
+	if _, err := b.WriteAt(got, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("WriteAt error = %v, want EROFS", err)
+	}
+}
+
+func TestVHDXRejects(t *testing.T) {
+	base := vhdxTestImage{size: 4 << 20, blockSize: 1 << 20, logical: 512, physical: 4096}
+
+	tests := []struct {
+		name   string
+		modify func(*vhdxTestImage)
+	}{
+		{"pending log", func(img *vhdxTestImage) { img.pendingLog = true }},
+		{"differencing", func(img *vhdxTestImage) { img.hasParent = true }},
+		{"unknown required region", func(img *vhdxTestImage) { img.extraRegion = true }},
+		{"bad block size", func(img *vhdxTestImage) { img.blockSize = 3 << 20 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := base
+			tt.modify(&img)
+			if _, err := Open(img.write(t), VHDX, true); err == nil {
+				t.Error("expected Open to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+// Package wal provides a write-ahead journaling wrapper for backends.
+//
+// Every write is appended to a journal file and synced before it is
+// applied to the inner backend, so a crash part way through applying it,
+// which may leave sectors torn on backends without atomic sector writes
+// such as chunked object stores, is repaired by replaying the journal on
+// the next Open. Flush checkpoints: it flushes the inner backend and
+// empties the journal.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// DefaultMaxSize is the journal size that triggers a checkpoint when
+// Options.MaxSize is zero.
+const DefaultMaxSize = 64 << 20
+
+// Record layout, little-endian:
+//
+//	0  magic  u32
+//	4  type   u8, 3 bytes reserved
+//	8  offset u64
+//	16 length u64  (payload length for writes, range length for discards)
+//	24 crc    u32  CRC-32C of the header with crc zeroed, then the payload
+//	28 reserved u32
+//	32 payload
+const (
+	headerSize  = 32
+	recordMagic = 0x4C415755 // "UWAL"
+
+	recordWrite   = 1
+	recordDiscard = 2
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures Open.
+type Options struct {
+	// MaxSize is the journal size in bytes past which a write triggers a
+	// checkpoint (default: 64 MiB).
+	MaxSize int64
+}
+
+// Journal wraps a backend with a write-ahead log. It is safe for
+// concurrent use.
+type Journal struct {
+	inner   ublk.Backend
+	f       *os.File
+	maxSize int64
+
+	// Writes hold cp shared from logging until applied; a checkpoint holds
+	// it exclusively so it never drops a record that is not yet applied.
+	cp sync.RWMutex
+
+	// mu serializes appends, so everything below tail is written
+	mu   sync.Mutex
+	tail int64
+
+	// syncMu lets one sync cover every record appended before it started
+	syncMu sync.Mutex
+	synced int64
+
+	// Statistics, guarded by mu
+	records     uint64
+	syncs       uint64
+	checkpoints uint64
+	replayed    uint64
+}
+
+// Open wraps inner with the journal at path, creating it if needed. Records
+// left by a crash are replayed into inner, which is then flushed before the
+// journal is emptied.
+func Open(inner ublk.Backend, path string, opts Options) (*Journal, error) {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{inner: inner, f: f, maxSize: opts.MaxSize}
+
+	n, err := j.replay()
+	if err == nil && n > 0 {
+		err = inner.Flush()
+	}
+	if err == nil {
+		err = j.truncate()
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("replay %s: %w", path, err)
+	}
+	j.replayed = n
+	return j, nil
+}
+
+// replay applies every complete record in order. The first record that is
+// short or fails its checksum ends the journal: it was being appended when
+// the crash happened, and its write never completed.
+func (j *Journal) replay() (uint64, error) {
+	var n uint64
+	var pos int64
+	hdr := make([]byte, headerSize)
+	for {
+		if _, err := j.f.ReadAt(hdr, pos); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+		if binary.LittleEndian.Uint32(hdr[0:]) != recordMagic {
+			return n, nil
+		}
+		typ := hdr[4]
+		off := int64(binary.LittleEndian.Uint64(hdr[8:]))
+		length := int64(binary.LittleEndian.Uint64(hdr[16:]))
+
+		var payload []byte
+		if typ == recordWrite {
+			if length < 0 || length > j.inner.Size() {
+				return n, nil
+			}
+			payload = make([]byte, length)
+			if _, err := j.f.ReadAt(payload, pos+headerSize); err != nil {
+				if errors.Is(err, io.EOF) {
+					return n, nil
+				}
+				return n, err
+			}
+		}
+		if binary.LittleEndian.Uint32(hdr[24:]) != checksum(hdr, payload) {
+			return n, nil
+		}
+
+		switch typ {
+		case recordWrite:
+			if _, err := j.inner.WriteAt(payload, off); err != nil {
+				return n, err
+			}
+		case recordDiscard:
+			d, ok := j.inner.(ublk.DiscardBackend)
+			if !ok {
+				return n, errors.New("journal has a discard but the backend cannot discard")
+			}
+			if err := d.Discard(off, length); err != nil {
+				return n, err
+			}
+		default:
+			return n, fmt.Errorf("unknown record type %d at %d", typ, pos)
+		}
+		n++
+		pos += headerSize + int64(len(payload))
+	}
+}
+
+// log appends a record and waits until it is durable.
+func (j *Journal) log(typ byte, off, length int64, payload []byte) error {
+	rec := make([]byte, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(rec[0:], recordMagic)
+	rec[4] = typ
+	binary.LittleEndian.PutUint64(rec[8:], uint64(off))
+	binary.LittleEndian.PutUint64(rec[16:], uint64(length))
+	copy(rec[headerSize:], payload)
+	binary.LittleEndian.PutUint32(rec[24:], checksum(rec[:headerSize], payload))
+
+	j.mu.Lock()
+	if _, err := j.f.WriteAt(rec, j.tail); err != nil {
+		j.mu.Unlock()
+		return err
+	}
+	j.tail += int64(len(rec))
+	end := j.tail
+	j.records++
+	j.mu.Unlock()
+
+	return j.syncTo(end)
+}
+
+// syncTo makes the journal durable up to end. Writers that arrive while a
+// sync is running wait for it and are usually covered by it.
+func (j *Journal) syncTo(end int64) error {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	if j.synced >= end {
+		return nil
+	}
+
+	j.mu.Lock()
+	target := j.tail
+	j.syncs++
+	j.mu.Unlock()
+
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.synced = target
+	return nil
+}
+
+// WriteAt implements ublk.Backend.
+func (j *Journal) WriteAt(p []byte, off int64) (int, error) {
+	j.cp.RLock()
+	if err := j.log(recordWrite, off, int64(len(p)), p); err != nil {
+		j.cp.RUnlock()
+		return 0, err
+	}
+	n, err := j.inner.WriteAt(p, off)
+	j.cp.RUnlock()
+	if err != nil {
+		return n, err
+	}
+	return n, j.maybeCheckpoint()
+}
+
+// ReadAt implements ublk.Backend. Writes are applied before they return,
+// so the inner backend is always current.
+func (j *Journal) ReadAt(p []byte, off int64) (int, error) {
+	return j.inner.ReadAt(p, off)
+}
+
+// Size implements ublk.Backend.
+func (j *Journal) Size() int64 {
+	return j.inner.Size()
+}
+
+// Flush checkpoints the journal.
+func (j *Journal) Flush() error {
+	return j.checkpoint()
+}
+
+// Close checkpoints the journal and closes it and the inner backend.
+func (j *Journal) Close() error {
+	err := j.checkpoint()
+	return errors.Join(err, j.f.Close(), j.inner.Close())
+}
+
+func (j *Journal) maybeCheckpoint() error {
+	j.mu.Lock()
+	full := j.tail > j.maxSize
+	j.mu.Unlock()
+	if !full {
+		return nil
+	}
+	return j.checkpoint()
+}
+
+// checkpoint flushes the inner backend, after which no record is needed,
+// and empties the journal.
+func (j *Journal) checkpoint() error {
+	j.cp.Lock()
+	defer j.cp.Unlock()
+
+	j.mu.Lock()
+	empty := j.tail == 0
+	j.mu.Unlock()
+	if err := j.inner.Flush(); err != nil || empty {
+		return err
+	}
+	if err := j.truncate(); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.checkpoints++
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *Journal) truncate() error {
+	if err := j.f.Truncate(0); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.tail = 0
+	j.mu.Unlock()
+	j.syncMu.Lock()
+	j.synced = 0
+	j.syncMu.Unlock()
+	return nil
+}
+
+// Stats implements ublk.StatBackend.
+func (j *Journal) Stats() map[string]interface{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return map[string]interface{}{
+		"journal_bytes":    j.tail,
+		"journal_records":  j.records,
+		"journal_syncs":    j.syncs,
+		"checkpoints":      j.checkpoints,
+		"replayed_records": j.replayed,
+	}
+}
+
+// WithDiscard returns a backend that also journals discards, or j itself
+// if the inner backend cannot discard, so the device does not advertise
+// discard at all.
+func (j *Journal) WithDiscard() ublk.Backend {
+	if _, ok := j.inner.(ublk.DiscardBackend); !ok {
+		return j
+	}
+	return &discardJournal{Journal: j}
+}
+
+// discardJournal adds Discard to Journal. A discard is logged like a write
+// so replay keeps it ordered with the writes around it.
+type discardJournal struct {
+	*Journal
+}
+
+func (j *discardJournal) Discard(offset, length int64) error {
+	j.cp.RLock()
+	defer j.cp.RUnlock()
+	if err := j.log(recordDiscard, offset, length, nil); err != nil {
+		return err
+	}
+	return j.inner.(ublk.DiscardBackend).Discard(offset, length)
+}
+
+func checksum(hdr, payload []byte) uint32 {
+	var h [headerSize]byte
+	copy(h[:], hdr)
+	clear(h[24:28])
+	return crc32.Update(crc32.Checksum(h[:], crc32c), crc32c, payload)
+}
+
+// Compile-time interface checks
+var (
+	_ ublk.Backend        = (*Journal)(nil)
+	_ ublk.StatBackend    = (*Journal)(nil)
+	_ ublk.DiscardBackend = (*discardJournal)(nil)
+)
@@ -0,0 +1,245 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// tearingBackend wraps a backend and, once armed, applies only the first
+// half of the next write before failing, as a crash mid-write would.
+type tearingBackend struct {
+	*ublk.MockBackend
+	armed bool
+}
+
+func (b *tearingBackend) WriteAt(p []byte, off int64) (int, error) {
+	if b.armed {
+		b.armed = false
+		n, _ := b.MockBackend.WriteAt(p[:len(p)/2], off)
+		return n, errCrash
+	}
+	return b.MockBackend.WriteAt(p, off)
+}
+
+func fill(c byte, n int) []byte {
+	return bytes.Repeat([]byte{c}, n)
+}
+
+func readBack(t *testing.T, b ublk.Backend, off int64, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	if _, err := b.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestReplayRepairsTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	inner := &tearingBackend{MockBackend: ublk.NewMockBackend(1 << 20)}
+
+	j, err := Open(inner, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.WriteAt(fill(1, 8192), 0); err != nil {
+		t.Fatal(err)
+	}
+	inner.armed = true
+	if _, err := j.WriteAt(fill(2, 8192), 4096); !errors.Is(err, errCrash) {
+		t.Fatalf("WriteAt error = %v, want the simulated crash", err)
+	}
+	// The process dies here: no Flush, no Close
+
+	if got := readBack(t, inner, 8192, 4096); !bytes.Equal(got, make([]byte, 4096)) {
+		t.Fatal("test setup: second half of the torn write was applied")
+	}
+
+	j, err = Open(inner, path, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer j.Close()
+
+	want := append(fill(1, 4096), fill(2, 8192)...)
+	if got := readBack(t, j, 0, len(want)); !bytes.Equal(got, want) {
+		t.Error("replay did not repair the torn write")
+	}
+	if got := j.Stats()["replayed_records"]; got != uint64(2) {
+		t.Errorf("replayed_records = %v, want 2", got)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != 0 {
+		t.Errorf("journal is %d bytes after replay, want empty", fi.Size())
+	}
+}
+
+func TestReplayIgnoresTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	inner := ublk.NewMockBackend(1 << 20)
+
+	j, err := Open(inner, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := j.WriteAt(fill(1, 4096), 0); err != nil {
+		t.Fatal(err)
+	}
+	// A record whose append was cut short by the crash
+	if _, err := j.WriteAt(fill(2, 4096), 4096); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(path)
+	if err := os.Truncate(path, fi.Size()-100); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := ublk.NewMockBackend(1 << 20)
+	j, err = Open(fresh, path, Options{})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer j.Close()
+	if got := readBack(t, fresh, 0, 8192); !bytes.Equal(got, append(fill(1, 4096), make([]byte, 4096)...)) {
+		t.Error("replay applied a torn record or skipped a complete one")
+	}
+}
+
+func TestReplayIgnoresCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := Open(ublk.NewMockBackend(1<<20), path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.WriteAt(fill(1, 4096), 0)
+
+	raw, _ := os.ReadFile(path)
+	raw[headerSize+10] ^= 0xFF // flip a payload byte
+	os.WriteFile(path, raw, 0o644)
+
+	fresh := ublk.NewMockBackend(1 << 20)
+	j, err = Open(fresh, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if got := readBack(t, fresh, 0, 4096); !bytes.Equal(got, make([]byte, 4096)) {
+		t.Error("replay applied a record with a bad checksum")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	inner := ublk.NewMockBackend(1 << 20)
+	j, err := Open(inner, path, Options{MaxSize: 3 * (4096 + headerSize)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	for i := range 3 {
+		j.WriteAt(fill(byte(i), 4096), int64(i)*4096)
+	}
+	if j.Stats()["checkpoints"] != uint64(0) {
+		t.Fatal("checkpointed before the journal was full")
+	}
+	j.WriteAt(fill(9, 4096), 0)
+	if j.Stats()["checkpoints"] != uint64(1) || j.Stats()["journal_bytes"] != int64(0) {
+		t.Errorf("stats after overflow = %v, want one checkpoint and an empty journal", j.Stats())
+	}
+
+	j.WriteAt(fill(7, 512), 0)
+	if err := j.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != 0 {
+		t.Errorf("journal is %d bytes after Flush, want empty", fi.Size())
+	}
+}
+
+func TestDiscardJournaled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	inner := ublk.NewMockBackend(1 << 20)
+	j, err := Open(inner, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := j.WithDiscard()
+	d, ok := b.(ublk.DiscardBackend)
+	if !ok {
+		t.Fatal("WithDiscard over a discarding backend does not discard")
+	}
+	b.WriteAt(fill(1, 8192), 0)
+	if err := d.Discard(0, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying write then discard onto a fresh backend keeps the order
+	fresh := ublk.NewMockBackend(1 << 20)
+	j, err = Open(fresh, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if got := readBack(t, fresh, 0, 8192); !bytes.Equal(got, append(make([]byte, 4096), fill(1, 4096)...)) {
+		t.Error("replayed discard was lost or reordered")
+	}
+
+	plain := struct{ ublk.Backend }{ublk.NewMockBackend(4096)}
+	j2, err := Open(plain, filepath.Join(t.TempDir(), "j2"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.Close()
+	if _, ok := j2.WithDiscard().(ublk.DiscardBackend); ok {
+		t.Error("WithDiscard advertised discard for a backend without it")
+	}
+}
+
+func TestConcurrentWritesGroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	inner := ublk.NewMockBackend(1 << 20)
+	j, err := Open(inner, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for g := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 8 {
+				off := int64(g*8+i) * 4096
+				if _, err := j.WriteAt(fill(byte(g+1), 4096), off); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if syncs := j.Stats()["journal_syncs"].(uint64); syncs > 128 {
+		t.Errorf("%d syncs for 128 writes", syncs)
+	}
+
+	// Replaying the whole journal onto a fresh backend reproduces it
+	fresh := ublk.NewMockBackend(1 << 20)
+	j2, err := Open(fresh, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j2.Close()
+	for g := range 16 {
+		off := int64(g*8) * 4096
+		if got := readBack(t, fresh, off, 8*4096); !bytes.Equal(got, fill(byte(g+1), 8*4096)) {
+			t.Errorf("writer %d's data not replayed", g)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package ublk
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"testing"
+	"time"
 )
 
 // Tests now use the public MockBackend from testing.go
@@ -111,7 +114,7 @@ func TestWriteZeroesBackend(t *testing.T) {
 	}
 
 	// Write zeros
-	err := writeZeroesBackend.WriteZeroes(0, int64(len(testData)))
+	err := writeZeroesBackend.WriteZeroes(0, int64(len(testData)), RequestNoUnmap)
 	if err != nil {
 		t.Errorf("WriteZeroes failed: %v", err)
 	}
@@ -265,6 +268,112 @@ func TestDefaultParams(t *testing.T) {
 	}
 }
 
+func TestDeviceParamsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		set    func(p *DeviceParams)
+		fields []string // Fields rejected, in order
+	}{
+		{"defaults", func(p *DeviceParams) {}, nil},
+		{"4K blocks", func(p *DeviceParams) {
+			p.LogicalBlockSize = 4096
+			p.PhysicalBlockSize = 4096
+			p.MaxIOSize = 1 << 20 // Capped at the tag buffer
+		}, nil},
+		{"no backend", func(p *DeviceParams) { p.Backend = nil }, []string{"Backend"}},
+		{"zero depth", func(p *DeviceParams) { p.QueueDepth = 0 }, []string{"QueueDepth"}},
+		{"depth over the kernel's", func(p *DeviceParams) { p.QueueDepth = 4097 }, []string{"QueueDepth"}},
+		{"negative queues", func(p *DeviceParams) { p.NumQueues = -1 }, []string{"NumQueues"}},
+		{"block not a power of two", func(p *DeviceParams) { p.LogicalBlockSize = 1000 }, []string{"LogicalBlockSize"}},
+		{"block below a sector", func(p *DeviceParams) { p.LogicalBlockSize = 256 }, []string{"LogicalBlockSize"}},
+		{"physical below logical", func(p *DeviceParams) {
+			p.LogicalBlockSize = 4096
+			p.PhysicalBlockSize = 512
+		}, []string{"PhysicalBlockSize"}},
+		{"io size not a multiple", func(p *DeviceParams) { p.MaxIOSize = 1000 }, []string{"MaxIOSize"}},
+		{"zero io size", func(p *DeviceParams) { p.MaxIOSize = 0 }, []string{"MaxIOSize"}},
+		{"zero-copy and user-copy", func(p *DeviceParams) {
+			p.EnableZeroCopy = true
+			p.EnableUserCopy = true
+		}, []string{"EnableUserCopy"}},
+		{"several at once", func(p *DeviceParams) {
+			p.QueueDepth = -1
+			p.MaxIOSize = 100
+			p.VirtBoundaryMask = 4096
+		}, []string{"QueueDepth", "MaxIOSize", "VirtBoundaryMask"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := DefaultParams(NewMockBackend(1 << 20))
+			tt.set(&params)
+			err := params.Validate()
+			if len(tt.fields) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidParameters) {
+				t.Fatalf("Validate() = %v, want ErrInvalidParameters", err)
+			}
+			var fields []string
+			for _, e := range err.(*Error).Inner.(interface{ Unwrap() []error }).Unwrap() {
+				var fe *FieldError
+				if !errors.As(e, &fe) {
+					t.Fatalf("%v is not a *FieldError", e)
+				}
+				fields = append(fields, fe.Field)
+			}
+			if !slices.Equal(fields, tt.fields) {
+				t.Errorf("rejected fields %v, want %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestValidateSegments(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(p *DeviceParams)
+		wantErr bool
+	}{
+		{"defaults", func(p *DeviceParams) {}, false},
+		{"max segments", func(p *DeviceParams) { p.MaxSegments = 1 }, false},
+		{"all limits", func(p *DeviceParams) {
+			p.MaxSegments = 32
+			p.MaxSegmentSize = 128 << 10
+			p.SegmentBoundaryMask = 1<<20 - 1
+		}, false},
+		{"virt boundary", func(p *DeviceParams) { p.VirtBoundaryMask = 4095; p.MaxSegments = 64 }, false},
+		{"virt boundary not a mask", func(p *DeviceParams) { p.VirtBoundaryMask = 4096 }, true},
+		{"boundary not a mask", func(p *DeviceParams) { p.SegmentBoundaryMask = 0x1ffe }, true},
+		{"boundary too small", func(p *DeviceParams) { p.SegmentBoundaryMask = 2047 }, true},
+		{"segment too small", func(p *DeviceParams) { p.MaxSegmentSize = 512 }, true},
+		{"segment size with virt boundary", func(p *DeviceParams) {
+			p.VirtBoundaryMask = 4095
+			p.MaxSegmentSize = 65536
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := DefaultParams(NewMockBackend(1 << 20))
+			tt.set(&params)
+			err := params.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidParameters) {
+				t.Errorf("error %v is not ErrInvalidParameters", err)
+			}
+			ctrlParams := convertToCtrlParams(params)
+			if ctrlParams.MaxSegments != params.MaxSegments || ctrlParams.VirtBoundaryMask != params.VirtBoundaryMask ||
+				ctrlParams.MaxSegmentSize != params.MaxSegmentSize || ctrlParams.SegmentBoundaryMask != params.SegmentBoundaryMask {
+				t.Errorf("convertToCtrlParams() dropped segment limits: %+v", ctrlParams)
+			}
+		})
+	}
+}
+
 func BenchmarkMockBackendRead(b *testing.B) {
 	backend := NewMockBackend(1024 * 1024) // 1MB
 	buf := make([]byte, 4096)              // 4KB reads
@@ -439,7 +548,18 @@ func TestDeviceLifecycleStates(t *testing.T) {
 		t.Error("Device with cancelled context should not be running")
 	}
 
-	// 4. Closed state
+	// 4. Paused state (stopped with EnableRecovery) and halted state
+	// (stopped without it)
+	devicePaused := &Device{ID: 4, Backend: backend, paused: true, options: options}
+	if devicePaused.State() != DeviceStatePaused {
+		t.Errorf("Paused device should be in Paused state, got %s", devicePaused.State())
+	}
+	deviceHalted := &Device{ID: 5, Backend: backend, halted: true, options: options}
+	if deviceHalted.State() != DeviceStateStopped {
+		t.Errorf("Halted device should be in Stopped state, got %s", deviceHalted.State())
+	}
+
+	// 5. Closed state
 	deviceClosed := &Device{
 		ID:       3,
 		Path:     "/dev/ublkb3",
@@ -499,6 +619,17 @@ func TestDeviceLifecycleAPIPreconditions(t *testing.T) {
 		t.Error("Start on closed device should return error")
 	}
 
+	// Test Start on a device stopped without EnableRecovery
+	haltedDevice := &Device{
+		ID:      4,
+		Backend: backend,
+		halted:  true,
+		options: options,
+	}
+	if err := haltedDevice.Start(context.Background()); !errors.Is(err, ErrRestartNotSupported) {
+		t.Errorf("Start on halted device should return ErrRestartNotSupported, got %v", err)
+	}
+
 	// Test Stop on nil device
 	if err := nilDevice.Stop(); err == nil {
 		t.Error("Stop on nil device should return error")
@@ -577,3 +708,113 @@ func TestDeviceInfoWithStates(t *testing.T) {
 		})
 	}
 }
+
+func TestOptionsDevicePaths(t *testing.T) {
+	var defaults *Options
+	if got := defaults.charPath(3); got != "/dev/ublkc3" {
+		t.Errorf("default charPath = %q", got)
+	}
+	if got := defaults.deviceNodeTimeout(); got != DefaultDeviceNodeTimeout {
+		t.Errorf("default deviceNodeTimeout = %v", got)
+	}
+
+	options := &Options{DeviceDir: "/run/devices", DeviceNodeTimeout: time.Second}
+	if got := options.blockPath(3); got != "/run/devices/ublkb3" {
+		t.Errorf("blockPath = %q", got)
+	}
+	if got := options.charPath(3); got != "/run/devices/ublkc3" {
+		t.Errorf("charPath = %q", got)
+	}
+	if got := options.deviceNodeTimeout(); got != time.Second {
+		t.Errorf("deviceNodeTimeout = %v", got)
+	}
+
+	options.CharDevicePath, options.BlockDevicePath = "/run/c", "/run/b"
+	if options.charPath(3) != "/run/c" || options.blockPath(3) != "/run/b" {
+		t.Errorf("explicit paths ignored: %q, %q", options.charPath(3), options.blockPath(3))
+	}
+}
+
+// blockingFlush is a backend whose Flush waits until release is closed
+type blockingFlush struct {
+	*MockBackend
+	release chan struct{}
+}
+
+func (b *blockingFlush) Flush() error {
+	<-b.release
+	return nil
+}
+
+func TestFlushOnStop(t *testing.T) {
+	backend := NewMockBackend(1 << 20)
+	device := &Device{Backend: backend, metrics: NewMetrics(), options: &Options{}}
+	if err := device.flushOnStop(); err != nil || backend.IsFlushed() {
+		t.Fatalf("flushed without FlushOnStop: err %v", err)
+	}
+
+	device.options.FlushOnStop = true
+	if err := device.flushOnStop(); err != nil {
+		t.Fatal(err)
+	}
+	if !backend.IsFlushed() {
+		t.Error("backend not flushed")
+	}
+	snap := device.metrics.Snapshot()
+	if snap.FlushOps != 1 || snap.StopFlushNs == 0 {
+		t.Errorf("FlushOps = %d, StopFlushNs = %d", snap.FlushOps, snap.StopFlushNs)
+	}
+
+	hung := &blockingFlush{MockBackend: NewMockBackend(1 << 20), release: make(chan struct{})}
+	defer close(hung.release)
+	device = &Device{Backend: hung, metrics: NewMetrics(),
+		options: &Options{FlushOnStop: true, FlushOnStopTimeout: 10 * time.Millisecond}}
+	if err := device.flushOnStop(); !errors.Is(err, ErrIOError) {
+		t.Errorf("hung flush = %v, want ErrIOError", err)
+	}
+	if device.metrics.FlushErrors.Load() != 1 {
+		t.Error("timed out flush not counted as an error")
+	}
+}
+
+// preloader is a backend whose Preload returns err, counting calls
+type preloader struct {
+	*MockBackend
+	calls int
+	err   error
+}
+
+func (b *preloader) Preload(ctx context.Context) error {
+	b.calls++
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return b.err
+}
+
+func TestPreloadBackend(t *testing.T) {
+	if err := preloadBackend(context.Background(), 1, NewMockBackend(1<<20)); err != nil {
+		t.Fatalf("backend without Preload: %v", err)
+	}
+
+	backend := &preloader{MockBackend: NewMockBackend(1 << 20)}
+	if err := preloadBackend(context.Background(), 1, backend); err != nil || backend.calls != 1 {
+		t.Fatalf("Preload: err %v, %d calls", err, backend.calls)
+	}
+
+	backend.err = errors.New("cache warm-up failed")
+	err := preloadBackend(context.Background(), 1, backend)
+	var uerr *Error
+	if !errors.As(err, &uerr) || uerr.Op != "PRELOAD" || uerr.DevID != 1 || !errors.Is(err, backend.err) {
+		t.Fatalf("failed Preload = %v", err)
+	}
+	if !errors.Is(err, ErrIOError) {
+		t.Errorf("failed Preload = %v, want ErrIOError", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := preloadBackend(ctx, 1, backend); !IsCode(err, ErrCodeTimeout) {
+		t.Errorf("cancelled Preload = %v, want ErrCodeTimeout", err)
+	}
+}
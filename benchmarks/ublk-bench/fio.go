@@ -0,0 +1,97 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// fio runs workloads with the fio binary.
+type fio struct {
+	path     string
+	jobs     int
+	iodepth  int
+	runtime  time.Duration
+	ioengine string
+}
+
+// run drives device with one workload and returns fio's view of it; the
+// CPU and identity fields of the result are left for the caller.
+func (f fio) run(device string, wl workload) (Result, error) {
+	cmd := exec.Command(f.path,
+		"--name="+wl.name,
+		"--filename="+device,
+		"--ioengine="+f.ioengine,
+		"--direct=1",
+		"--rw="+wl.rw,
+		"--bs="+strconv.Itoa(wl.bs),
+		"--iodepth="+strconv.Itoa(f.iodepth),
+		"--numjobs="+strconv.Itoa(f.jobs),
+		"--runtime="+strconv.FormatFloat(f.runtime.Seconds(), 'f', -1, 64),
+		"--time_based=1",
+		"--group_reporting=1",
+		"--output-format=json",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return Result{}, fmt.Errorf("fio: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return parseFio(out)
+}
+
+// fioOutput is the part of fio's JSON output the report uses.
+type fioOutput struct {
+	Jobs []struct {
+		Error int      `json:"error"`
+		Read  fioStats `json:"read"`
+		Write fioStats `json:"write"`
+	} `json:"jobs"`
+}
+
+type fioStats struct {
+	IOPS     float64 `json:"iops"`
+	BWBytes  float64 `json:"bw_bytes"`
+	TotalIOs int64   `json:"total_ios"`
+	Clat     struct {
+		Percentile map[string]float64 `json:"percentile"`
+	} `json:"clat_ns"`
+}
+
+// parseFio sums reads and writes of the single group-reported job. The
+// latency percentiles are the worse of the two directions.
+func parseFio(out []byte) (Result, error) {
+	var o fioOutput
+	if err := json.Unmarshal(out, &o); err != nil {
+		return Result{}, fmt.Errorf("parsing fio output: %w", err)
+	}
+	if len(o.Jobs) != 1 {
+		return Result{}, fmt.Errorf("fio reported %d job groups, want 1", len(o.Jobs))
+	}
+	job := o.Jobs[0]
+	if job.Error != 0 {
+		return Result{}, fmt.Errorf("fio job failed with error %d", job.Error)
+	}
+
+	var r Result
+	for _, s := range []fioStats{job.Read, job.Write} {
+		if s.TotalIOs == 0 {
+			continue
+		}
+		r.IOPS += s.IOPS
+		r.Bandwidth += s.BWBytes
+		r.IOs += s.TotalIOs
+		r.P50Ns = max(r.P50Ns, s.Clat.Percentile["50.000000"])
+		r.P99Ns = max(r.P99Ns, s.Clat.Percentile["99.000000"])
+	}
+	if r.IOs == 0 {
+		return Result{}, fmt.Errorf("fio completed no I/O")
+	}
+	return r, nil
+}
@@ -0,0 +1,251 @@
+//go:build linux
+
+// Command ublk-bench serves a memory-backed device in each data-path mode,
+// drives it with fio and reports IOPS, bandwidth, latency percentiles and
+// the server's CPU time per I/O as JSON.
+//
+// Keep a report from a known-good build and pass it as -baseline to fail
+// when a later build regresses:
+//
+//	sudo ublk-bench -out base.json
+//	sudo ublk-bench -baseline base.json -tolerance 0.1
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"golang.org/x/sys/unix"
+)
+
+// mode is one way of moving data between the kernel and the backend.
+type mode struct {
+	name  string
+	setup func(p *ublk.DeviceParams)
+}
+
+var modes = []mode{
+	{"copy", func(p *ublk.DeviceParams) {}},
+	{"user-copy", func(p *ublk.DeviceParams) { p.EnableUserCopy = true }},
+	{"zero-copy", func(p *ublk.DeviceParams) {
+		p.EnableZeroCopy = true
+		p.LogicalBlockSize = 4096 // Zero copy requires 4K blocks
+	}},
+}
+
+// workload is one fio job run against every mode.
+type workload struct {
+	name string
+	rw   string
+	bs   int
+}
+
+var workloads = []workload{
+	{"randread-4k", "randread", 4 << 10},
+	{"randwrite-4k", "randwrite", 4 << 10},
+	{"read-64k", "read", 64 << 10},
+	{"write-64k", "write", 64 << 10},
+}
+
+func main() {
+	var (
+		modeList     = flag.String("modes", names(modes), "Comma-separated data-path modes to run")
+		workloadList = flag.String("workloads", names(workloads), "Comma-separated workloads to run")
+		size         = flag.Int64("size", 256<<20, "Size of the memory device in bytes")
+		queues       = flag.Int("queues", 0, "Number of device queues (0 = one per CPU)")
+		depth        = flag.Int("depth", 64, "Device queue depth")
+		jobs         = flag.Int("jobs", 4, "fio jobs per workload")
+		iodepth      = flag.Int("iodepth", 64, "fio I/O depth per job")
+		runtimeFlag  = flag.Duration("runtime", 10*time.Second, "How long each workload runs")
+		ioengine     = flag.String("ioengine", "libaio", "fio I/O engine")
+		fioPath      = flag.String("fio", "fio", "Path to the fio binary")
+		out          = flag.String("out", "", "Write the JSON report to this file instead of stdout")
+		baseline     = flag.String("baseline", "", "Compare against this earlier report and exit 1 on regressions")
+		tolerance    = flag.Float64("tolerance", 0.1, "Relative IOPS, p99 latency or CPU/IO change counted as a regression")
+	)
+	flag.Parse()
+
+	selectedModes, err := pick(modes, *modeList)
+	if err != nil {
+		log.Fatalf("-modes: %v", err)
+	}
+	selectedWorkloads, err := pick(workloads, *workloadList)
+	if err != nil {
+		log.Fatalf("-workloads: %v", err)
+	}
+
+	// Keep the library's setup chatter out of the report
+	logging.SetDefault(logging.NewLogger(&logging.Config{Level: logging.LevelWarn, Output: os.Stderr}))
+
+	var uname unix.Utsname
+	_ = unix.Uname(&uname) // Best effort; the kernel field stays empty
+	report := Report{
+		Time:      time.Now().UTC(),
+		Kernel:    unix.ByteSliceToString(uname.Release[:]),
+		GoVersion: runtime.Version(),
+		CPUs:      runtime.NumCPU(),
+		Config: Config{
+			Size:     *size,
+			Queues:   *queues,
+			Depth:    *depth,
+			Jobs:     *jobs,
+			IODepth:  *iodepth,
+			Runtime:  runtimeFlag.String(),
+			IOEngine: *ioengine,
+		},
+	}
+
+	f := fio{path: *fioPath, jobs: *jobs, iodepth: *iodepth, runtime: *runtimeFlag, ioengine: *ioengine}
+	for _, m := range selectedModes {
+		log.Printf("mode %s", m.name)
+		report.Results = append(report.Results, runMode(m, selectedWorkloads, f, *size, *queues, *depth)...)
+	}
+
+	if err := writeReport(*out, &report); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+
+	if *baseline != "" {
+		base, err := readReport(*baseline)
+		if err != nil {
+			log.Fatalf("Failed to read baseline: %v", err)
+		}
+		regressions := Compare(base, &report, *tolerance)
+		for _, r := range regressions {
+			fmt.Fprintln(os.Stderr, "regression:", r)
+		}
+		if len(regressions) > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// runMode serves a fresh memory device in mode m and runs every workload
+// against it. A mode the kernel or library rejects yields one failed
+// result per workload, so a comparison notices the mode going missing.
+func runMode(m mode, wls []workload, f fio, size int64, queues, depth int) []Result {
+	backend := newMemoryBackend(size)
+	params := ublk.DefaultParams(backend)
+	params.NumQueues = queues
+	params.QueueDepth = depth
+	params.MaxIOSize = ublk.IOBufferSizePerTag
+	params.EnableIoctlEncode = true
+	m.setup(&params)
+
+	results := make([]Result, 0, len(wls))
+	device, err := ublk.CreateAndServe(context.Background(), params, nil)
+	if err != nil {
+		for _, wl := range wls {
+			results = append(results, Result{Mode: m.name, Workload: wl.name, Error: err.Error()})
+		}
+		return results
+	}
+	defer device.Close()
+
+	for _, wl := range wls {
+		log.Printf("  %s", wl.name)
+		r, err := measure(device, wl, f)
+		r.Mode, r.Workload = m.name, wl.name
+		if err != nil {
+			r.Error = err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// measure runs one workload and charges the CPU this process spent
+// meanwhile, which is the device's queue threads, to its I/Os.
+func measure(device *ublk.Device, wl workload, f fio) (Result, error) {
+	before, err := cpuTime()
+	if err != nil {
+		return Result{}, err
+	}
+	r, err := f.run(device.Path, wl)
+	if err != nil {
+		return Result{}, err
+	}
+	after, err := cpuTime()
+	if err != nil {
+		return Result{}, err
+	}
+	if r.IOs > 0 {
+		r.CPUNsPerIO = float64(after-before) / float64(r.IOs)
+	}
+	return r, nil
+}
+
+// cpuTime returns the user and system CPU time this process has used.
+func cpuTime() (time.Duration, error) {
+	var ru unix.Rusage
+	if err := unix.Getrusage(unix.RUSAGE_SELF, &ru); err != nil {
+		return 0, fmt.Errorf("getrusage: %w", err)
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
+
+// named is implemented by the things selectable by name on the command line.
+type named interface{ label() string }
+
+func (m mode) label() string     { return m.name }
+func (w workload) label() string { return w.name }
+
+// names joins the names of all entries, for flag defaults.
+func names[T named](all []T) string {
+	s := make([]string, len(all))
+	for i, v := range all {
+		s[i] = v.label()
+	}
+	return strings.Join(s, ",")
+}
+
+// pick returns the entries named in the comma-separated list, in list order.
+func pick[T named](all []T, list string) ([]T, error) {
+	var picked []T
+outer:
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		for _, v := range all {
+			if v.label() == name {
+				picked = append(picked, v)
+				continue outer
+			}
+		}
+		return nil, fmt.Errorf("unknown name %q (have %s)", name, names(all))
+	}
+	return picked, nil
+}
+
+func writeReport(path string, report *Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func readReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &report, nil
+}
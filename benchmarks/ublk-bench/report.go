@@ -0,0 +1,87 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Report is the JSON document ublk-bench writes.
+type Report struct {
+	Time      time.Time `json:"time"`
+	Kernel    string    `json:"kernel"`
+	GoVersion string    `json:"go_version"`
+	CPUs      int       `json:"cpus"`
+	Config    Config    `json:"config"`
+	Results   []Result  `json:"results"`
+}
+
+// Config records the settings a report was produced with. Reports are
+// only comparable when these match.
+type Config struct {
+	Size     int64  `json:"size"`
+	Queues   int    `json:"queues"`
+	Depth    int    `json:"depth"`
+	Jobs     int    `json:"jobs"`
+	IODepth  int    `json:"iodepth"`
+	Runtime  string `json:"runtime"`
+	IOEngine string `json:"ioengine"`
+}
+
+// Result is one workload run against one mode.
+type Result struct {
+	Mode     string `json:"mode"`
+	Workload string `json:"workload"`
+
+	// Error is set when the mode could not be served or the workload
+	// failed; the measurements are then zero
+	Error string `json:"error,omitempty"`
+
+	IOPS       float64 `json:"iops"`
+	Bandwidth  float64 `json:"bandwidth_bytes_per_sec"`
+	P50Ns      float64 `json:"p50_latency_ns"`
+	P99Ns      float64 `json:"p99_latency_ns"`
+	IOs        int64   `json:"ios"`
+	CPUNsPerIO float64 `json:"server_cpu_ns_per_io"`
+}
+
+// Compare lists the results in cur that are worse than the same mode and
+// workload in base by more than tolerance (0.1 is 10%): lower IOPS, higher
+// p99 latency, more server CPU per I/O, or failing where base succeeded.
+// Results missing from either report are not compared.
+func Compare(base, cur *Report, tolerance float64) []string {
+	var regressions []string
+	if base.Config != cur.Config {
+		regressions = append(regressions, fmt.Sprintf("config differs from baseline: %+v vs %+v", cur.Config, base.Config))
+	}
+
+	type key struct{ mode, workload string }
+	prev := make(map[key]Result, len(base.Results))
+	for _, r := range base.Results {
+		prev[key{r.Mode, r.Workload}] = r
+	}
+
+	for _, r := range cur.Results {
+		b, ok := prev[key{r.Mode, r.Workload}]
+		if !ok || b.Error != "" {
+			continue
+		}
+		name := r.Mode + "/" + r.Workload
+		if r.Error != "" {
+			regressions = append(regressions, fmt.Sprintf("%s: failed: %s", name, r.Error))
+			continue
+		}
+		if r.IOPS < b.IOPS*(1-tolerance) {
+			regressions = append(regressions, fmt.Sprintf("%s: IOPS %.0f, baseline %.0f", name, r.IOPS, b.IOPS))
+		}
+		if r.P99Ns > b.P99Ns*(1+tolerance) {
+			regressions = append(regressions, fmt.Sprintf("%s: p99 latency %.0fns, baseline %.0fns", name, r.P99Ns, b.P99Ns))
+		}
+		if r.CPUNsPerIO > b.CPUNsPerIO*(1+tolerance) {
+			regressions = append(regressions, fmt.Sprintf("%s: server CPU %.0fns/IO, baseline %.0fns/IO",
+				name, r.CPUNsPerIO, b.CPUNsPerIO))
+		}
+	}
+	return regressions
+}
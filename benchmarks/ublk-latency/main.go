@@ -0,0 +1,92 @@
+// Command ublk-latency splits a device's request latency into block layer,
+// driver and backend time by matching an I/O trace recorded with
+// Options.Trace (or ublk-mem -trace) against blktrace's view of the same
+// run:
+//
+//	sudo ublk-mem -trace dev.trc &
+//	sudo blktrace -d /dev/ublkb0 -o - | blkparse -i - > blk.txt &
+//	sudo fio ... ; kill %2 %1
+//	ublk-latency -trace dev.trc -blkparse blk.txt
+//
+// scripts/ublk-blk.bt produces blk.txt from eBPF where blktrace is missing.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+func main() {
+	var (
+		tracePath = flag.String("trace", "", "Trace recorded by the device (required)")
+		blkPath   = flag.String("blkparse", "", "blkparse output for the device's block node (required)")
+		verbose   = flag.Bool("v", false, "Print every matched request")
+	)
+	flag.Parse()
+	if *tracePath == "" || *blkPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	blk, err := os.Open(*blkPath)
+	if err != nil {
+		log.Fatalf("Could not open blkparse output: %v", err)
+	}
+	defer blk.Close()
+	requests, err := ublk.ParseBlkparse(blk)
+	if err != nil {
+		log.Fatalf("Could not parse blkparse output: %v", err)
+	}
+
+	f, err := os.Open(*tracePath)
+	if err != nil {
+		log.Fatalf("Could not open trace: %v", err)
+	}
+	defer f.Close()
+	trace, err := ublk.NewTraceReader(f)
+	if err != nil {
+		log.Fatalf("Could not read trace: %v", err)
+	}
+	c, err := ublk.Correlate(trace, requests)
+	if err != nil {
+		log.Fatalf("Could not correlate: %v", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	if *verbose {
+		fmt.Fprintln(w, "queue\ttag\top\tsector\tsectors\tblock\tdriver\tbackend\ttotal\t")
+		for _, r := range c.Requests {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%d\t%s\t\n", r.Queue, r.Tag, r.Op, r.Sector, r.Sectors, splitColumns(r.LatencySplit))
+		}
+		fmt.Fprintln(w, "\t")
+	}
+
+	counts := make(map[ublk.TraceOp]int)
+	for _, r := range c.Requests {
+		counts[r.Op]++
+	}
+	fmt.Fprintln(w, "op\tpct\tblock\tdriver\tbackend\ttotal\t")
+	ops := []ublk.TraceOp{ublk.TraceRead, ublk.TraceWrite, ublk.TraceFlush, ublk.TraceDiscard, ublk.TraceWriteZeroes}
+	for _, op := range ops {
+		if counts[op] == 0 {
+			continue
+		}
+		for _, p := range []float64{50, 99} {
+			fmt.Fprintf(w, "%s\tp%g\t%s\t\n", op, p, splitColumns(c.Percentile(p, op)))
+		}
+	}
+	w.Flush()
+	fmt.Printf("\n%d requests matched; %d only in the trace, %d only in blktrace\n",
+		len(c.Requests), c.UnmatchedTrace, c.UnmatchedBlock)
+}
+
+func splitColumns(s ublk.LatencySplit) string {
+	return fmt.Sprintf("%v\t%v\t%v\t%v", s.BlockLayer.Round(time.Microsecond), s.Driver.Round(time.Microsecond),
+		s.Backend.Round(time.Microsecond), s.Total.Round(time.Microsecond))
+}
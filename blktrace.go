@@ -0,0 +1,261 @@
+package ublk
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlockRequest is one request on a ublk block device as blktrace saw it.
+// Sector and Sectors are in 512-byte units, as blktrace reports them; times
+// are since tracing began.
+type BlockRequest struct {
+	Op        TraceOp
+	Sector    uint64
+	Sectors   uint32
+	Queued    time.Duration // Q: the first bio entered the block layer, -1 if not seen
+	Issued    time.Duration // D: the request was handed to the ublk driver
+	Completed time.Duration // C: the driver completed it
+}
+
+// blockKey identifies a request across trace sources.
+type blockKey struct {
+	op      TraceOp
+	sector  uint64
+	sectors uint32
+}
+
+// ParseBlkparse reads blkparse's default text output for one device, as
+// from
+//
+//	blktrace -d /dev/ublkb0 -o - | blkparse -i -
+//
+// and returns the requests that were both issued (D) and completed (C), in
+// issue order. Other lines, such as merges, plugs and the closing summary,
+// are skipped. scripts/ublk-blk.bt writes the same format from eBPF for
+// systems without blktrace.
+func ParseBlkparse(r io.Reader) ([]BlockRequest, error) {
+	var (
+		requests []BlockRequest
+		queued   = make(map[uint64]time.Duration) // Latest Q per sector
+		issued   = make(map[blockKey][]int)       // Requests awaiting C
+	)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		// 259,0  1  7  0.000104820  4242  D  WS 2048 + 8 [fio]
+		f := strings.Fields(scanner.Text())
+		if len(f) < 7 || !strings.Contains(f[0], ",") || len(f[5]) != 1 || !strings.ContainsAny(f[5], "QDC") {
+			continue
+		}
+		at, err := parseBlkTime(f[3])
+		if err != nil {
+			continue // A summary line that happens to look like an event
+		}
+		var sector, sectors uint64
+		if len(f) >= 10 && f[8] == "+" {
+			if sector, err = strconv.ParseUint(f[7], 10, 64); err == nil {
+				sectors, err = strconv.ParseUint(f[9], 10, 32)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("blkparse line %d: bad range %s + %s", line, f[7], f[9])
+			}
+		}
+		op, ok := parseRWBS(f[6], sectors)
+		if !ok {
+			continue
+		}
+		key := blockKey{op, sector, uint32(sectors)}
+
+		switch f[5] {
+		case "Q":
+			queued[sector] = at
+		case "D":
+			req := BlockRequest{Op: op, Sector: sector, Sectors: uint32(sectors), Queued: -1, Issued: at}
+			if q, ok := queued[sector]; ok && q <= at {
+				req.Queued = q
+				delete(queued, sector)
+			}
+			issued[key] = append(issued[key], len(requests))
+			requests = append(requests, req)
+		case "C":
+			pending := issued[key]
+			if len(pending) == 0 {
+				continue // Issued before tracing began
+			}
+			requests[pending[0]].Completed = at
+			issued[key] = pending[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Drop requests still in flight when tracing stopped
+	return slices.DeleteFunc(requests, func(r BlockRequest) bool { return r.Completed == 0 }), nil
+}
+
+// parseBlkTime parses a blkparse timestamp, seconds with up to nine
+// decimals.
+func parseBlkTime(s string) (time.Duration, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	if len(frac) > 9 {
+		return 0, fmt.Errorf("bad timestamp %q", s)
+	}
+	whole, err := strconv.ParseUint(secs, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	var nanos uint64
+	if frac != "" {
+		if nanos, err = strconv.ParseUint(frac+strings.Repeat("0", 9-len(frac)), 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	return time.Duration(whole)*time.Second + time.Duration(nanos), nil
+}
+
+// parseRWBS maps blktrace's RWBS column to the op the ublk server sees. A
+// leading F is a preflush; data-less requests other than discards reach
+// the server as flushes.
+func parseRWBS(rwbs string, sectors uint64) (TraceOp, bool) {
+	if len(rwbs) > 1 && rwbs[0] == 'F' && strings.IndexByte("RWDFN", rwbs[1]) >= 0 {
+		rwbs = rwbs[1:]
+	}
+	if rwbs == "" {
+		return 0, false
+	}
+	switch op := rwbs[0]; {
+	case op == 'D':
+		return TraceDiscard, true
+	case sectors == 0 && strings.IndexByte("WFN", op) >= 0:
+		return TraceFlush, true
+	case op == 'R':
+		return TraceRead, true
+	case op == 'W':
+		return TraceWrite, true
+	case op == 'N':
+		return TraceWriteZeroes, true
+	}
+	return 0, false
+}
+
+// LatencySplit divides a request's latency between the kernel and the
+// backend.
+type LatencySplit struct {
+	BlockLayer time.Duration // Q to D: queued, merged and scheduled before reaching the driver
+	Driver     time.Duration // D to C less Backend: the ublk driver, the io_uring round trip and the queue loop
+	Backend    time.Duration // In the Backend call
+	Total      time.Duration // Q (or D, if Q was not seen) to C
+}
+
+// RequestLatency is one request found in both a trace and blktrace.
+type RequestLatency struct {
+	Queue   uint16
+	Tag     uint16
+	Op      TraceOp
+	Sector  uint64 // In 512-byte units
+	Sectors uint32
+	LatencySplit
+}
+
+// Correlation matches a device's I/O trace against blktrace's view of its
+// block device.
+type Correlation struct {
+	Requests       []RequestLatency // In issue order
+	UnmatchedTrace int              // Trace records blktrace did not see
+	UnmatchedBlock int              // blktrace requests missing from the trace
+}
+
+// Correlate matches the records of trace, recorded with Options.Trace,
+// with blktrace's requests for the same device and run, to split each
+// request's end-to-end latency into kernel and backend time. Requests are
+// matched by op and range, in the order they were issued; the two clocks
+// need not agree.
+func Correlate(trace *TraceReader, block []BlockRequest) (*Correlation, error) {
+	var records []TraceRecord
+	for {
+		rec, err := trace.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	// Traces are written as requests complete; match in start order
+	slices.SortStableFunc(records, func(a, b TraceRecord) int { return cmp.Compare(a.Start, b.Start) })
+
+	scale := uint64(trace.BlockSize()) / 512
+	byKey := make(map[blockKey][]TraceRecord)
+	for _, rec := range records {
+		key := blockKey{rec.Op, rec.Sector * scale, rec.Sectors * uint32(scale)}
+		byKey[key] = append(byKey[key], rec)
+	}
+
+	c := &Correlation{}
+	for _, br := range block {
+		key := blockKey{br.Op, br.Sector, br.Sectors}
+		pending := byKey[key]
+		if len(pending) == 0 {
+			c.UnmatchedBlock++
+			continue
+		}
+		rec := pending[0]
+		byKey[key] = pending[1:]
+
+		begin := br.Queued
+		if begin < 0 {
+			begin = br.Issued
+		}
+		c.Requests = append(c.Requests, RequestLatency{
+			Queue:   rec.Queue,
+			Tag:     rec.Tag,
+			Op:      br.Op,
+			Sector:  br.Sector,
+			Sectors: br.Sectors,
+			LatencySplit: LatencySplit{
+				BlockLayer: br.Issued - begin,
+				Driver:     max(br.Completed-br.Issued-rec.Latency, 0),
+				Backend:    rec.Latency,
+				Total:      br.Completed - begin,
+			},
+		})
+	}
+	for _, pending := range byKey {
+		c.UnmatchedTrace += len(pending)
+	}
+	return c, nil
+}
+
+// Percentile returns the p-th percentile (0 to 100) of each latency
+// component over the matched requests of the given ops, or of all of them
+// if none are given. Each component is ranked on its own, so the parts
+// need not add up to Total.
+func (c *Correlation) Percentile(p float64, ops ...TraceOp) LatencySplit {
+	var parts [4][]time.Duration
+	for _, r := range c.Requests {
+		if len(ops) > 0 && !slices.Contains(ops, r.Op) {
+			continue
+		}
+		parts[0] = append(parts[0], r.BlockLayer)
+		parts[1] = append(parts[1], r.Driver)
+		parts[2] = append(parts[2], r.Backend)
+		parts[3] = append(parts[3], r.Total)
+	}
+	if len(parts[0]) == 0 {
+		return LatencySplit{}
+	}
+	var out [4]time.Duration
+	for i, d := range parts {
+		slices.Sort(d)
+		idx := int(p / 100 * float64(len(d)-1))
+		out[i] = d[min(max(idx, 0), len(d)-1)]
+	}
+	return LatencySplit{BlockLayer: out[0], Driver: out[1], Backend: out[2], Total: out[3]}
+}
@@ -0,0 +1,131 @@
+package ublk
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blkparseOutput is trimmed blkparse output for a 4K-block ublk device: a
+// read, two writes to the same range, a flush, a discard queued before
+// tracing began and a write still in flight when tracing stopped.
+const blkparseOutput = `259,0    1        1     0.000100000  4242  Q   R 2048 + 8 [fio]
+259,0    1        2     0.000102000  4242  G   R 2048 + 8 [fio]
+259,0    1        3     0.000110000  4242  D   R 2048 + 8 [fio]
+259,0    1        4     0.000300000     0  C   R 2048 + 8 [0]
+259,0    1        5     0.001000000  4242  Q  WS 16 + 16 [fio]
+259,0    1        6     0.001010000  4242  D  WS 16 + 16 [fio]
+259,0    1        7     0.001020000  4242  Q  WS 16 + 16 [fio]
+259,0    1        8     0.001030000  4242  D  WS 16 + 16 [fio]
+259,0    1        9     0.001500000     0  C  WS 16 + 16 [0]
+259,0    1       10     0.001600000     0  C  WS 16 + 16 [0]
+259,0    0       11     0.002000000  4242  Q FWS [fio]
+259,0    0       12     0.002005000  4242  D  FF [fio]
+259,0    0       13     0.002105000     0  C  FF [0]
+259,0    0       14     0.002500000  4242  D   D 4096 + 64 [fstrim]
+259,0    0       15     0.002700000     0  C   D 4096 + 64 [0]
+259,0    0       16     0.003000000  4242  D   W 64 + 8 [fio]
+CPU0 (259,0):
+ Reads Queued:           1,        4KiB	 Writes Queued:           2,       16KiB
+Total (259,0):
+ Reads Queued:           1,        4KiB	 Writes Queued:           2,       16KiB
+`
+
+func TestParseBlkparse(t *testing.T) {
+	requests, err := ParseBlkparse(strings.NewReader(blkparseOutput))
+	if err != nil {
+		t.Fatalf("ParseBlkparse: %v", err)
+	}
+	us := time.Microsecond
+	want := []BlockRequest{
+		{Op: TraceRead, Sector: 2048, Sectors: 8, Queued: 100 * us, Issued: 110 * us, Completed: 300 * us},
+		{Op: TraceWrite, Sector: 16, Sectors: 16, Queued: 1000 * us, Issued: 1010 * us, Completed: 1500 * us},
+		{Op: TraceWrite, Sector: 16, Sectors: 16, Queued: 1020 * us, Issued: 1030 * us, Completed: 1600 * us},
+		{Op: TraceFlush, Queued: 2000 * us, Issued: 2005 * us, Completed: 2105 * us},
+		{Op: TraceDiscard, Sector: 4096, Sectors: 64, Queued: -1, Issued: 2500 * us, Completed: 2700 * us},
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("got %d requests, want %d: %+v", len(requests), len(want), requests)
+	}
+	for i := range want {
+		if requests[i] != want[i] {
+			t.Errorf("request %d = %+v, want %+v", i, requests[i], want[i])
+		}
+	}
+
+	if _, err := ParseBlkparse(strings.NewReader("259,0 1 1 0.1 1 D R 8 + x [fio]\n")); err == nil {
+		t.Error("ParseBlkparse accepted a malformed range")
+	}
+}
+
+func TestCorrelate(t *testing.T) {
+	block, err := ParseBlkparse(strings.NewReader(blkparseOutput))
+	if err != nil {
+		t.Fatalf("ParseBlkparse: %v", err)
+	}
+
+	// The device's clock is unrelated to blktrace's; the writes completed
+	// out of order, one read never reached blktrace, and the discard was
+	// not traced
+	var buf bytes.Buffer
+	tw := NewTraceWriter(&buf, 4096)
+	for _, rec := range []TraceRecord{
+		{Queue: 0, Tag: 3, Op: TraceRead, Sector: 256, Sectors: 1, Start: 5 * time.Second, Latency: 50 * time.Microsecond},
+		{
+			Queue: 1, Tag: 1, Op: TraceWrite, Sector: 2, Sectors: 2,
+			Start: 6*time.Second + 20*time.Microsecond, Latency: 100 * time.Microsecond,
+		},
+		{Queue: 1, Tag: 0, Op: TraceWrite, Sector: 2, Sectors: 2, Start: 6 * time.Second, Latency: 400 * time.Microsecond},
+		{Queue: 1, Tag: 2, Op: TraceFlush, Start: 7 * time.Second, Latency: 90 * time.Microsecond},
+		{Queue: 2, Tag: 0, Op: TraceRead, Sector: 1, Sectors: 1, Start: 8 * time.Second},
+	} {
+		if err := tw.Write(rec); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	tr, err := NewTraceReader(&buf)
+	if err != nil {
+		t.Fatalf("NewTraceReader: %v", err)
+	}
+
+	c, err := Correlate(tr, block)
+	if err != nil {
+		t.Fatalf("Correlate: %v", err)
+	}
+	us := time.Microsecond
+	want := []RequestLatency{
+		{Queue: 0, Tag: 3, Op: TraceRead, Sector: 2048, Sectors: 8,
+			LatencySplit: LatencySplit{BlockLayer: 10 * us, Driver: 140 * us, Backend: 50 * us, Total: 200 * us}},
+		{Queue: 1, Tag: 0, Op: TraceWrite, Sector: 16, Sectors: 16,
+			LatencySplit: LatencySplit{BlockLayer: 10 * us, Driver: 90 * us, Backend: 400 * us, Total: 500 * us}},
+		{Queue: 1, Tag: 1, Op: TraceWrite, Sector: 16, Sectors: 16,
+			LatencySplit: LatencySplit{BlockLayer: 10 * us, Driver: 470 * us, Backend: 100 * us, Total: 580 * us}},
+		{Queue: 1, Tag: 2, Op: TraceFlush,
+			LatencySplit: LatencySplit{BlockLayer: 5 * us, Driver: 10 * us, Backend: 90 * us, Total: 105 * us}},
+	}
+	if len(c.Requests) != len(want) {
+		t.Fatalf("got %d requests, want %d: %+v", len(c.Requests), len(want), c.Requests)
+	}
+	for i := range want {
+		if c.Requests[i] != want[i] {
+			t.Errorf("request %d = %+v, want %+v", i, c.Requests[i], want[i])
+		}
+	}
+	if c.UnmatchedTrace != 1 || c.UnmatchedBlock != 1 {
+		t.Errorf("unmatched trace %d, block %d; want 1 each", c.UnmatchedTrace, c.UnmatchedBlock)
+	}
+
+	if got := c.Percentile(100, TraceWrite); got.Backend != 400*us || got.Driver != 470*us {
+		t.Errorf("write p100 = %+v", got)
+	}
+	if got := c.Percentile(0); got.Total != 105*us {
+		t.Errorf("p0 total = %v, want 105µs", got.Total)
+	}
+	if got := c.Percentile(50, TraceDiscard); got != (LatencySplit{}) {
+		t.Errorf("percentile of no requests = %+v, want zero", got)
+	}
+}
@@ -0,0 +1,76 @@
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// BlockOpenFlags select how OpenBlockDevice opens a device's block node.
+type BlockOpenFlags int
+
+const (
+	// OpenReadOnly opens the node read-only instead of read-write.
+	OpenReadOnly BlockOpenFlags = 1 << iota
+	// OpenDirect opens the node with O_DIRECT, bypassing the page cache.
+	// Reads and writes must then be aligned to the logical block size, in
+	// offset, length and buffer address.
+	OpenDirect
+	// OpenExclusive opens the node with O_EXCL, which fails with EBUSY
+	// while the device is mounted or claimed by another exclusive opener,
+	// and keeps others from claiming it while the file is open.
+	OpenExclusive
+)
+
+// OpenBlockDevice opens the block node of a running device, for self-tests
+// and for formatting it, and checks that the kernel reports the size of
+// the device's backend. A mismatch, as when a resize is half done, fails
+// with ErrCodeDeviceBusy rather than handing back a file whose end is
+// not the backend's. The caller closes the file.
+func OpenBlockDevice(dev *Device, flags BlockOpenFlags) (*os.File, error) {
+	if dev == nil {
+		return nil, ErrInvalidParameters
+	}
+	if state := dev.State(); state != DeviceStateRunning {
+		return nil, dev.openBlockError(ErrCodeDeviceOffline, fmt.Sprintf("device is %s", state), nil)
+	}
+
+	f, err := openBlock(dev.Path, flags)
+	if err != nil {
+		code := ErrCodeIOError
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			code = mapErrnoToCode(errno)
+		}
+		return nil, dev.openBlockError(code, "cannot open "+dev.Path, err)
+	}
+	// Seeking to the end gives a block device's size without an ioctl
+	size, err := f.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = f.Close() // Cleanup, ignore error
+		return nil, dev.openBlockError(ErrCodeIOError, "cannot read the size of "+dev.Path, err)
+	}
+	if want := dev.Size(); size != want {
+		_ = f.Close() // Cleanup, ignore error
+		return nil, dev.openBlockError(ErrCodeDeviceBusy,
+			fmt.Sprintf("%s is %d bytes but the backend is %d", dev.Path, size, want), nil)
+	}
+	return f, nil
+}
+
+// openBlockError reports why OpenBlockDevice failed.
+func (d *Device) openBlockError(code UblkErrorCode, msg string, inner error) error {
+	return &Error{
+		Op:    "OPEN_BLOCK",
+		DevID: d.ID,
+		Queue: NoQueue,
+		Code:  code,
+		Msg:   msg,
+		Inner: inner,
+	}
+}
@@ -0,0 +1,53 @@
+package ublk
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenBlockDevice(t *testing.T) {
+	// A regular file stands in for the block node: both report their
+	// size by seeking to the end.
+	path := filepath.Join(t.TempDir(), "ublkb0")
+	if err := os.WriteFile(path, make([]byte, 1<<20), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		device *Device
+		want   UblkErrorCode // "" = success
+	}{
+		{"matching size", &Device{Path: path, Backend: NewMockBackend(1 << 20), started: true}, ""},
+		{"size mismatch", &Device{Path: path, Backend: NewMockBackend(2 << 20), started: true}, ErrCodeDeviceBusy},
+		{"not started", &Device{Path: path, Backend: NewMockBackend(1 << 20)}, ErrCodeDeviceOffline},
+		{"paused", &Device{Path: path, Backend: NewMockBackend(1 << 20), started: true, paused: true},
+			ErrCodeDeviceOffline},
+		{"missing node", &Device{Path: path + ".missing", Backend: NewMockBackend(1 << 20), started: true},
+			ErrCodeDeviceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := OpenBlockDevice(tt.device, OpenReadOnly)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("OpenBlockDevice: %v", err)
+				}
+				defer f.Close()
+				if off, err := f.Seek(0, io.SeekCurrent); err != nil || off != 0 {
+					t.Errorf("file offset = %d, %v; want 0", off, err)
+				}
+				return
+			}
+			var ue *Error
+			if !errors.As(err, &ue) || ue.Code != tt.want || ue.Op != "OPEN_BLOCK" {
+				t.Fatalf("OpenBlockDevice = %v, want an OPEN_BLOCK error with code %q", err, tt.want)
+			}
+			if f != nil {
+				t.Error("returned a file along with the error")
+			}
+		})
+	}
+}
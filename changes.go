@@ -0,0 +1,200 @@
+package ublk
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultChangeEpochs is how many epochs of changes are kept when
+// ChangeTrackingParams.Epochs is 0.
+const DefaultChangeEpochs = 16
+
+// ChangeTrackingParams configures changed block tracking (CBT), which
+// records the blocks written in each epoch so that incremental backups
+// only copy what changed. Tracking is off unless BlockSize is set.
+//
+// Epochs are counted from 0 when the device is created and are kept in
+// memory only; a backup made against a device from another process must
+// start from a full copy.
+type ChangeTrackingParams struct {
+	// BlockSize is the tracking granularity in bytes, a multiple of
+	// LogicalBlockSize. Smaller blocks make incremental backups smaller
+	// and cost one bit of memory per block per epoch. 0 disables tracking.
+	BlockSize int
+
+	// Epochs is how many epochs, the current one included, are kept
+	// (default: DefaultChangeEpochs). Asking for changes since an epoch
+	// that has been dropped fails.
+	Epochs int
+}
+
+// BlockRange is a byte range of a device.
+type BlockRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// Epoch returns the current change-tracking epoch.
+func (d *Device) Epoch() (uint64, error) {
+	if d == nil {
+		return 0, ErrInvalidParameters
+	}
+	if d.changes == nil {
+		return 0, d.changesDisabled()
+	}
+	return d.changes.epoch(), nil
+}
+
+// AdvanceEpoch closes the current change-tracking epoch and returns the
+// number of the one it starts. I/O is quiesced for the switch, so every
+// write belongs to exactly one epoch. Device.Snapshot also advances the
+// epoch; Snapshot.Epoch is the epoch the snapshot starts.
+func (d *Device) AdvanceEpoch() (uint64, error) {
+	if d == nil {
+		return 0, ErrInvalidParameters
+	}
+	if d.changes == nil {
+		return 0, d.changesDisabled()
+	}
+	d.gate.Lock()
+	defer d.gate.Unlock()
+	return d.changes.advance(), nil
+}
+
+// ChangedBlocks returns the ranges written or discarded since epoch began,
+// merged and in offset order. Ranges are whole tracking blocks, so they may
+// cover some unchanged data around a write.
+//
+// A typical incremental backup takes a snapshot, copies
+// ChangedBlocks(previous.Epoch) from it, and keeps the new snapshot's Epoch
+// for next time.
+func (d *Device) ChangedBlocks(since uint64) ([]BlockRange, error) {
+	if d == nil {
+		return nil, ErrInvalidParameters
+	}
+	if d.changes == nil {
+		return nil, d.changesDisabled()
+	}
+	ranges, err := d.changes.since(since)
+	if err != nil {
+		return nil, &Error{
+			Op:    "CHANGED_BLOCKS",
+			DevID: d.ID,
+			Queue: NoQueue,
+			Code:  ErrCodeInvalidParameters,
+			Msg:   err.Error(),
+		}
+	}
+	return ranges, nil
+}
+
+func (d *Device) changesDisabled() error {
+	return &Error{
+		Op:    "CHANGED_BLOCKS",
+		DevID: d.ID,
+		Queue: NoQueue,
+		Code:  ErrCodeNotImplemented,
+		Msg:   "changed block tracking is not enabled (DeviceParams.ChangeTracking)",
+	}
+}
+
+// changeTracker keeps one dirtyMap per epoch. The queues mark the current
+// map under the device gate; advance runs with the gate held exclusively,
+// so no write straddles two epochs.
+type changeTracker struct {
+	size      int64
+	blockSize int64
+	keep      int
+
+	current atomic.Pointer[dirtyMap]
+
+	mu     sync.Mutex
+	first  uint64      // epoch of epochs[0]
+	epochs []*dirtyMap // oldest first; the last is current
+}
+
+// newChangeTracker returns nil if params leave tracking disabled.
+func newChangeTracker(params DeviceParams) (*changeTracker, error) {
+	ct := params.ChangeTracking
+	if ct.BlockSize == 0 {
+		return nil, nil
+	}
+	logical := params.LogicalBlockSize
+	if logical == 0 {
+		logical = DefaultLogicalBlockSize
+	}
+	if ct.BlockSize < 0 || ct.BlockSize%logical != 0 {
+		return nil, NewError("CREATE", ErrCodeInvalidParameters,
+			fmt.Sprintf("change tracking block size %d is not a multiple of the %d-byte logical block", ct.BlockSize, logical))
+	}
+	if ct.Epochs <= 0 {
+		ct.Epochs = DefaultChangeEpochs
+	}
+
+	t := &changeTracker{
+		size:      params.Backend.Size(),
+		blockSize: int64(ct.BlockSize),
+		keep:      ct.Epochs,
+	}
+	first := newDirtyMap(t.size, t.blockSize)
+	t.epochs = []*dirtyMap{first}
+	t.current.Store(first)
+	return t, nil
+}
+
+// record marks a written range in the current epoch.
+func (t *changeTracker) record(offset, length int64) {
+	t.current.Load().mark(offset, length)
+}
+
+func (t *changeTracker) epoch() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.first + uint64(len(t.epochs)) - 1
+}
+
+// advance starts a new epoch, dropping the oldest beyond keep, and returns
+// its number.
+func (t *changeTracker) advance() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := newDirtyMap(t.size, t.blockSize)
+	t.epochs = append(t.epochs, next)
+	if drop := len(t.epochs) - t.keep; drop > 0 {
+		t.epochs = append(t.epochs[:0:0], t.epochs[drop:]...)
+		t.first += uint64(drop)
+	}
+	t.current.Store(next)
+	return t.first + uint64(len(t.epochs)) - 1
+}
+
+// since returns the ranges marked in epoch and every later one.
+func (t *changeTracker) since(epoch uint64) ([]BlockRange, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current := t.first + uint64(len(t.epochs)) - 1
+	if epoch < t.first {
+		return nil, fmt.Errorf("epoch %d is no longer tracked (oldest is %d); a full copy is needed", epoch, t.first)
+	}
+	if epoch > current {
+		return nil, fmt.Errorf("epoch %d has not started (current is %d)", epoch, current)
+	}
+
+	union := newDirtyMap(t.size, t.blockSize)
+	for _, m := range t.epochs[epoch-t.first:] {
+		union.merge(m)
+	}
+
+	var ranges []BlockRange
+	for block := union.next(0); block >= 0; block = union.next(block + 1) {
+		off := block * t.blockSize
+		length := min(t.blockSize, t.size-off)
+		if n := len(ranges); n > 0 && ranges[n-1].Offset+ranges[n-1].Length == off {
+			ranges[n-1].Length += length
+			continue
+		}
+		ranges = append(ranges, BlockRange{Offset: off, Length: length})
+	}
+	return ranges, nil
+}
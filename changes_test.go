@@ -0,0 +1,127 @@
+package ublk
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func newTrackedDevice(t *testing.T, size int64, ct ChangeTrackingParams) (*Device, *MockBackend) {
+	t.Helper()
+	backend := NewMockBackend(size)
+	changes, err := newChangeTracker(DeviceParams{Backend: backend, ChangeTracking: ct})
+	if err != nil {
+		t.Fatalf("newChangeTracker: %v", err)
+	}
+	return &Device{ID: 1, Backend: backend, changes: changes}, backend
+}
+
+func TestChangedBlocks(t *testing.T) {
+	device, _ := newTrackedDevice(t, 1<<20, ChangeTrackingParams{BlockSize: 4096})
+
+	// Epoch 0: two adjacent writes merge, and a write crossing a block
+	// boundary covers both blocks
+	device.changes.record(0, 4096)
+	device.changes.record(4096, 512)
+	device.changes.record(16384-512, 1024)
+
+	epoch, err := device.AdvanceEpoch()
+	if err != nil || epoch != 1 {
+		t.Fatalf("AdvanceEpoch = %d, %v, want 1", epoch, err)
+	}
+	device.changes.record(64<<10, 4096)
+
+	got, err := device.ChangedBlocks(0)
+	if err != nil {
+		t.Fatalf("ChangedBlocks(0): %v", err)
+	}
+	want := []BlockRange{{0, 8192}, {12288, 8192}, {64 << 10, 4096}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ChangedBlocks(0) = %v, want %v", got, want)
+	}
+
+	got, err = device.ChangedBlocks(1)
+	if err != nil {
+		t.Fatalf("ChangedBlocks(1): %v", err)
+	}
+	if want := []BlockRange{{64 << 10, 4096}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ChangedBlocks(1) = %v, want %v", got, want)
+	}
+
+	if _, err := device.ChangedBlocks(2); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("ChangedBlocks(future) err = %v, want invalid parameters", err)
+	}
+}
+
+func TestChangedBlocksPartialLastBlock(t *testing.T) {
+	device, _ := newTrackedDevice(t, 10000, ChangeTrackingParams{BlockSize: 4096})
+	device.changes.record(9000, 1000)
+	got, err := device.ChangedBlocks(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []BlockRange{{8192, 10000 - 8192}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ChangedBlocks = %v, want %v", got, want)
+	}
+}
+
+func TestChangedBlocksDropsOldEpochs(t *testing.T) {
+	device, _ := newTrackedDevice(t, 1<<20, ChangeTrackingParams{BlockSize: 4096, Epochs: 2})
+	device.changes.record(0, 4096)
+	device.AdvanceEpoch()
+	device.AdvanceEpoch()
+
+	if _, err := device.ChangedBlocks(0); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("ChangedBlocks(dropped) err = %v, want invalid parameters", err)
+	}
+	if got, err := device.ChangedBlocks(1); err != nil || len(got) != 0 {
+		t.Errorf("ChangedBlocks(1) = %v, %v, want no changes", got, err)
+	}
+	if epoch, _ := device.Epoch(); epoch != 2 {
+		t.Errorf("Epoch = %d, want 2", epoch)
+	}
+}
+
+func TestChangedBlocksSnapshotEpoch(t *testing.T) {
+	device, backend := newTrackedDevice(t, 1<<20, ChangeTrackingParams{BlockSize: 4096})
+	device.changes.record(0, 4096)
+
+	snap, err := device.Snapshot("full")
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if snap.Epoch != 1 {
+		t.Errorf("snapshot epoch = %d, want 1", snap.Epoch)
+	}
+	backend.WriteAt([]byte("x"), 8192)
+	device.changes.record(8192, 512)
+
+	got, err := device.ChangedBlocks(snap.Epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []BlockRange{{8192, 4096}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changes since snapshot = %v, want %v", got, want)
+	}
+}
+
+func TestChangeTrackingDisabled(t *testing.T) {
+	device := &Device{ID: 1, Backend: NewMockBackend(4096)}
+	if _, err := device.ChangedBlocks(0); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("ChangedBlocks err = %v, want not implemented", err)
+	}
+	if _, err := device.AdvanceEpoch(); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("AdvanceEpoch err = %v, want not implemented", err)
+	}
+}
+
+func TestNewChangeTrackerRejectsBlockSize(t *testing.T) {
+	params := DeviceParams{
+		Backend:          NewMockBackend(1 << 20),
+		LogicalBlockSize: 4096,
+		ChangeTracking:   ChangeTrackingParams{BlockSize: 6144},
+	}
+	if _, err := newChangeTracker(params); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("err = %v, want invalid parameters", err)
+	}
+}
@@ -1,16 +1,62 @@
 package ublk
 
-import "github.com/ehrlich-b/go-ublk/internal/constants"
+import (
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
 
 // Re-export constants for public API
 const (
-	DefaultQueueDepth         = constants.DefaultQueueDepth
-	DefaultLogicalBlockSize   = constants.DefaultLogicalBlockSize
-	DefaultMaxIOSize          = constants.DefaultMaxIOSize
-	DefaultDiscardAlignment   = constants.DefaultDiscardAlignment
-	DefaultDiscardGranularity = constants.DefaultDiscardGranularity
-	DefaultMaxDiscardSectors  = constants.DefaultMaxDiscardSectors
-	DefaultMaxDiscardSegments = constants.DefaultMaxDiscardSegments
-	AutoAssignDeviceID        = constants.AutoAssignDeviceID
-	IOBufferSizePerTag        = constants.IOBufferSizePerTag
+	DefaultQueueDepth            = constants.DefaultQueueDepth
+	DefaultLogicalBlockSize      = constants.DefaultLogicalBlockSize
+	DefaultMaxIOSize             = constants.DefaultMaxIOSize
+	DefaultDiscardAlignment      = constants.DefaultDiscardAlignment
+	DefaultDiscardGranularity    = constants.DefaultDiscardGranularity
+	DefaultMaxDiscardSectors     = constants.DefaultMaxDiscardSectors
+	DefaultMaxDiscardSegments    = constants.DefaultMaxDiscardSegments
+	DefaultMaxWriteZeroesSectors = constants.DefaultMaxWriteZeroesSectors
+	AutoAssignDeviceID           = constants.AutoAssignDeviceID
+	MaxDeviceID                  = constants.MaxDeviceID
+	IOBufferSizePerTag           = constants.IOBufferSizePerTag
+	DefaultDeviceNodeTimeout     = constants.DeviceNodeTimeout
+	DefaultControlTimeout        = constants.ControlTimeout
+	DefaultFlushOnStopTimeout    = constants.FlushOnStopTimeout
+	DefaultStopTimeout           = constants.StopTimeout
+	DefaultMaxReadAhead          = constants.DefaultMaxReadAhead
+)
+
+// Limits of the ublk driver and of this library, for checking a
+// configuration before creating a device; see DeviceParams.Validate.
+const (
+	// MaxQueueDepth is the largest DeviceParams.QueueDepth the driver
+	// accepts.
+	MaxQueueDepth = uapi.UBLK_MAX_QUEUE_DEPTH
+	// MaxQueues is the largest DeviceParams.NumQueues the driver accepts.
+	MaxQueues = uapi.UBLK_MAX_NR_QUEUES
+	// MinLogicalBlockSize is the smallest DeviceParams.LogicalBlockSize, a
+	// sector. The largest is the page size, and at most IOBufferSizePerTag.
+	MinLogicalBlockSize = 512
+	// MinSegmentSize is the smallest DeviceParams.MaxSegmentSize, and one
+	// more than the smallest SegmentBoundaryMask.
+	MinSegmentSize = uapi.UBLK_MIN_SEGMENT_SIZE
+	// MaxDriverIOSize is the most data the driver can address for one
+	// request in its user-copy buffer layout (UBLK_IO_BUF_BITS). This
+	// library caps requests at IOBufferSizePerTag, well below it.
+	MaxDriverIOSize = 1 << uapi.UBLK_IO_BUF_BITS
+)
+
+// Feature flag bits of the ublk driver (UBLK_F_*). A device asks for the
+// ones its DeviceParams enable, as noted beside each, when it is created.
+const (
+	FeatureZeroCopy        = uapi.UBLK_F_SUPPORT_ZERO_COPY      // DeviceParams.EnableZeroCopy
+	FeatureCompInTask      = uapi.UBLK_F_URING_CMD_COMP_IN_TASK // Completions run in task context
+	FeatureNeedGetData     = uapi.UBLK_F_NEED_GET_DATA          // Two-phase writes
+	FeatureUserRecovery    = uapi.UBLK_F_USER_RECOVERY          // DeviceParams.EnableRecovery
+	FeatureRecoveryReissue = uapi.UBLK_F_USER_RECOVERY_REISSUE  // Requeue in-flight I/O on recovery
+	FeatureUnprivileged    = uapi.UBLK_F_UNPRIVILEGED_DEV       // DeviceParams.EnableUnprivileged
+	FeatureIoctlEncode     = uapi.UBLK_F_CMD_IOCTL_ENCODE       // DeviceParams.EnableIoctlEncode
+	FeatureUserCopy        = uapi.UBLK_F_USER_COPY              // DeviceParams.EnableUserCopy
+	FeatureZoned           = uapi.UBLK_F_ZONED                  // DeviceParams.EnableZoned
+	FeatureUpdateSize      = uapi.UBLK_F_UPDATE_SIZE            // DeviceParams.EnableResize
+	FeatureNoAutoPartScan  = uapi.UBLK_F_NO_AUTO_PART_SCAN      // DeviceParams.NoPartitionScan
 )
@@ -0,0 +1,152 @@
+package ublk
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// DebugInfo is the layout of a device's shared memory and rings, as
+// Device.DebugDump reports it. Addresses are hex strings in this process's
+// address space, to be compared with the kernel's view in debugfs and
+// /proc/<pid>/maps.
+type DebugInfo struct {
+	ID       uint32      `json:"id"`
+	CharPath string      `json:"char_path"`
+	State    DeviceState `json:"state"`
+	Kernel   *KernelInfo `json:"kernel,omitempty"` // nil if the kernel could not be asked
+	// KernelError says why Kernel is nil
+	KernelError string        `json:"kernel_error,omitempty"`
+	Queues      []QueueLayout `json:"queues"`
+}
+
+// KernelInfo is the kernel's record of a device, from GET_DEV_INFO.
+type KernelInfo struct {
+	State         uint16   `json:"state"` // UBLK_S_DEV_*
+	NrHwQueues    uint16   `json:"nr_hw_queues"`
+	QueueDepth    uint16   `json:"queue_depth"`
+	MaxIOBufBytes uint32   `json:"max_io_buf_bytes"`
+	ServerPID     int32    `json:"server_pid"`
+	Flags         string   `json:"flags"` // UBLK_F_* flags the kernel accepted
+	Features      []string `json:"features"`
+}
+
+// QueueLayout is where one queue's descriptors and tag buffers live and
+// how its io_uring was set up.
+type QueueLayout struct {
+	QueueID    int         `json:"queue_id"`
+	Depth      int         `json:"depth"`
+	DescAddr   string      `json:"desc_addr"`
+	DescSize   int         `json:"desc_size"`
+	DescOffset int64       `json:"desc_offset"` // mmap offset in the char device
+	BufAddr    string      `json:"buf_addr"`
+	BufStride  int         `json:"buf_stride"`
+	Tags       []TagLayout `json:"tags,omitempty"` // nil once the queue is closed
+	Ring       RingLayout  `json:"ring"`
+}
+
+// TagLayout is where one tag's I/O buffer lives: the address its
+// FETCH_REQ and COMMIT_AND_FETCH_REQ commands pass to the kernel.
+type TagLayout struct {
+	Tag       int    `json:"tag"`
+	BufAddr   string `json:"buf_addr"`
+	BufOffset int    `json:"buf_offset"` // From the queue's BufAddr
+}
+
+// RingLayout is a queue's io_uring setup. The sizes and flags are zero for
+// rings that do not report them, such as those from Options.RingProvider.
+type RingLayout struct {
+	Shared    bool   `json:"shared"` // One ring serves every queue (SharedRing)
+	SQEntries uint32 `json:"sq_entries"`
+	CQEntries uint32 `json:"cq_entries"`
+	Flags     string `json:"flags"`    // IORING_SETUP_*
+	Features  string `json:"features"` // IORING_FEAT_*
+}
+
+// DebugDump returns the device's queue layouts, mapping addresses and
+// sizes, per-tag buffer addresses, ring parameters and the feature flags
+// the kernel accepted, as an indented JSON document of a DebugInfo. It is
+// meant for diagnosing protocol problems by hand; nothing in it is stable.
+//
+// The kernel is asked for the device's record with GET_DEV_INFO; if that
+// fails the dump says why and carries the rest.
+func (d *Device) DebugDump() ([]byte, error) {
+	if d == nil {
+		return nil, ErrInvalidParameters
+	}
+	d.life.Lock()
+	defer d.life.Unlock()
+
+	info := DebugInfo{
+		ID:       d.ID,
+		CharPath: d.CharPath,
+		State:    d.State(),
+		Queues:   make([]QueueLayout, 0, len(d.runners)),
+	}
+	if kernel, err := d.kernelInfo(); err != nil {
+		info.KernelError = err.Error()
+	} else {
+		info.Kernel = kernel
+	}
+	for _, runner := range d.runners {
+		info.Queues = append(info.Queues, queueLayout(runner.Layout()))
+	}
+	return json.MarshalIndent(info, "", "  ")
+}
+
+// kernelInfo asks the kernel for d's record.
+func (d *Device) kernelInfo() (*KernelInfo, error) {
+	controller, release, err := d.controller()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	devInfo, err := controller.GetDeviceInfo(d.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &KernelInfo{
+		State:         devInfo.State,
+		NrHwQueues:    devInfo.NrHwQueues,
+		QueueDepth:    devInfo.QueueDepth,
+		MaxIOBufBytes: devInfo.MaxIOBufBytes,
+		ServerPID:     devInfo.UblksrvPID,
+		Flags:         fmt.Sprintf("%#x", devInfo.Flags),
+		Features:      uapi.FeatureNames(devInfo.Flags),
+	}, nil
+}
+
+// queueLayout converts a runner's layout for DebugInfo.
+func queueLayout(l queue.Layout) QueueLayout {
+	layout := QueueLayout{
+		QueueID:    int(l.QueueID),
+		Depth:      l.Depth,
+		DescAddr:   fmt.Sprintf("%#x", l.DescAddr),
+		DescSize:   l.DescSize,
+		DescOffset: l.DescOffset,
+		BufAddr:    fmt.Sprintf("%#x", l.BufAddr),
+		BufStride:  l.BufStride,
+		Ring: RingLayout{
+			Shared:    l.SharedRing,
+			SQEntries: l.Ring.SQEntries,
+			CQEntries: l.Ring.CQEntries,
+			Flags:     fmt.Sprintf("%#x", l.Ring.Flags),
+			Features:  fmt.Sprintf("%#x", l.Ring.Features),
+		},
+	}
+	if l.BufAddr == 0 {
+		return layout // No buffers to list
+	}
+	layout.Tags = make([]TagLayout, l.Depth)
+	for tag := range layout.Tags {
+		offset := tag * l.BufStride
+		layout.Tags[tag] = TagLayout{
+			Tag:       tag,
+			BufAddr:   fmt.Sprintf("%#x", l.BufAddr+uintptr(offset)),
+			BufOffset: offset,
+		}
+	}
+	return layout
+}
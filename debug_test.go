@@ -0,0 +1,60 @@
+package ublk
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+func TestQueueLayout(t *testing.T) {
+	layout := queueLayout(queue.Layout{
+		QueueID:    1,
+		Depth:      2,
+		DescAddr:   0x7f0000000000,
+		DescSize:   4096,
+		DescOffset: 4096,
+		BufAddr:    0x7f1000000000,
+		BufStride:  1 << 20,
+		Ring:       uring.Params{SQEntries: 2, CQEntries: 4, Flags: 0x1000},
+	})
+	if layout.DescAddr != "0x7f0000000000" || layout.Ring.Flags != "0x1000" || layout.Ring.CQEntries != 4 {
+		t.Errorf("layout = %+v", layout)
+	}
+	want := []TagLayout{
+		{Tag: 0, BufAddr: "0x7f1000000000", BufOffset: 0},
+		{Tag: 1, BufAddr: "0x7f1000100000", BufOffset: 1 << 20},
+	}
+	if len(layout.Tags) != len(want) || layout.Tags[0] != want[0] || layout.Tags[1] != want[1] {
+		t.Errorf("Tags = %+v, want %+v", layout.Tags, want)
+	}
+
+	if closed := queueLayout(queue.Layout{Depth: 2, BufStride: 1 << 20}); closed.Tags != nil {
+		t.Errorf("closed queue Tags = %+v, want nil", closed.Tags)
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner := queue.NewStubRunner(ctx, queue.Config{QueueID: 0, Depth: 8, Backend: NewMockBackend(1 << 20)})
+	defer runner.Close()
+
+	device := &Device{ID: 1, CharPath: "/dev/ublkc1", started: true, ctx: ctx, runners: []*queue.Runner{runner}}
+	data, err := device.DebugDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info DebugInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatalf("DebugDump is not JSON: %v\n%s", err, data)
+	}
+	if info.ID != 1 || info.State != DeviceStateRunning || len(info.Queues) != 1 || info.Queues[0].Depth != 8 {
+		t.Errorf("DebugDump = %s", data)
+	}
+	if info.Kernel == nil && info.KernelError == "" {
+		t.Error("DebugDump has neither the kernel's record nor why it is missing")
+	}
+}
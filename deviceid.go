@@ -0,0 +1,104 @@
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+)
+
+// IDRange is a contiguous block of Count device IDs starting at First.
+// A zero Count means the range is unset.
+type IDRange struct {
+	First uint32
+	Count uint32
+}
+
+// IsZero reports whether the range is unset.
+func (r IDRange) IsZero() bool {
+	return r.Count == 0
+}
+
+// Last returns the highest ID in the range. It is only meaningful for a
+// range that is not zero.
+func (r IDRange) Last() uint32 {
+	return r.First + r.Count - 1
+}
+
+// Contains reports whether id falls inside the range.
+func (r IDRange) Contains(id uint32) bool {
+	return !r.IsZero() && id >= r.First && id-r.First < r.Count
+}
+
+// String formats the range as "first-last".
+func (r IDRange) String() string {
+	if r.IsZero() {
+		return "unset"
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last())
+}
+
+// validateDeviceID checks a requested device ID and range against each
+// other and against the kernel's ID limit.
+func validateDeviceID(id int32, r IDRange) error {
+	if id < constants.AutoAssignDeviceID || id > constants.MaxDeviceID {
+		return NewError("ADD_DEV", ErrCodeInvalidParameters,
+			fmt.Sprintf("device ID %d out of range (use -1 or 0-%d)", id, constants.MaxDeviceID))
+	}
+	if r.IsZero() {
+		return nil
+	}
+	if r.First > constants.MaxDeviceID || r.Count > constants.MaxDeviceID+1-r.First {
+		return NewError("ADD_DEV", ErrCodeInvalidParameters,
+			fmt.Sprintf("device ID range %d+%d exceeds the maximum ID %d", r.First, r.Count, constants.MaxDeviceID))
+	}
+	if id != constants.AutoAssignDeviceID && !r.Contains(uint32(id)) {
+		return NewError("ADD_DEV", ErrCodeInvalidParameters,
+			fmt.Sprintf("device ID %d is outside the allowed range %s", id, r))
+	}
+	return nil
+}
+
+// deviceAdder is the part of ctrl.Controller that addDevice needs.
+type deviceAdder interface {
+	AddDevice(params *ctrl.DeviceParams) (uint32, error)
+}
+
+// addDevice issues ADD_DEV according to the ID policy. An auto-assigned ID
+// restricted to a range walks the range from the bottom, moving on
+// whenever the kernel reports the ID as taken. An ID that is already in
+// use comes back as ErrDeviceBusy wrapping syscall.EEXIST.
+func addDevice(adder deviceAdder, params *ctrl.DeviceParams, r IDRange) (uint32, error) {
+	if params.DeviceID != constants.AutoAssignDeviceID || r.IsZero() {
+		id, err := adder.AddDevice(params)
+		if errors.Is(err, syscall.EEXIST) {
+			return 0, &Error{
+				Op:    "ADD_DEV",
+				Code:  ErrCodeDeviceBusy,
+				Errno: syscall.EEXIST,
+				Msg:   fmt.Sprintf("device ID %d is already in use", params.DeviceID),
+				Inner: err,
+				Queue: NoQueue,
+			}
+		}
+		return id, err
+	}
+
+	for i := uint32(0); i < r.Count; i++ {
+		params.DeviceID = int32(r.First + i)
+		id, err := adder.AddDevice(params)
+		if errors.Is(err, syscall.EEXIST) {
+			continue
+		}
+		return id, err
+	}
+	return 0, &Error{
+		Op:    "ADD_DEV",
+		Code:  ErrCodeDeviceBusy,
+		Errno: syscall.EEXIST,
+		Msg:   fmt.Sprintf("no free device ID in range %s", r),
+		Queue: NoQueue,
+	}
+}
@@ -0,0 +1,100 @@
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+)
+
+func TestValidateDeviceID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      int32
+		r       IDRange
+		wantErr bool
+	}{
+		{"auto", AutoAssignDeviceID, IDRange{}, false},
+		{"fixed", 7, IDRange{}, false},
+		{"max", MaxDeviceID, IDRange{}, false},
+		{"negative", -2, IDRange{}, true},
+		{"too large", MaxDeviceID + 1, IDRange{}, true},
+		{"auto in range", AutoAssignDeviceID, IDRange{First: 100, Count: 10}, false},
+		{"fixed in range", 109, IDRange{First: 100, Count: 10}, false},
+		{"fixed below range", 99, IDRange{First: 100, Count: 10}, true},
+		{"fixed above range", 110, IDRange{First: 100, Count: 10}, true},
+		{"range at limit", AutoAssignDeviceID, IDRange{First: MaxDeviceID, Count: 1}, false},
+		{"range past limit", AutoAssignDeviceID, IDRange{First: MaxDeviceID, Count: 2}, true},
+		{"range wraps", AutoAssignDeviceID, IDRange{First: 1, Count: ^uint32(0)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDeviceID(tt.id, tt.r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateDeviceID(%d, %v) = %v, wantErr %v", tt.id, tt.r, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidParameters) {
+				t.Errorf("error %v is not ErrInvalidParameters", err)
+			}
+		})
+	}
+}
+
+// fakeAdder accepts any ID not in taken and records the IDs tried
+type fakeAdder struct {
+	taken map[int32]bool
+	tried []int32
+}
+
+func (f *fakeAdder) AddDevice(params *ctrl.DeviceParams) (uint32, error) {
+	f.tried = append(f.tried, params.DeviceID)
+	if f.taken[params.DeviceID] {
+		return 0, fmt.Errorf("ADD_DEV failed: %w", syscall.EEXIST)
+	}
+	if params.DeviceID < 0 {
+		return 42, nil
+	}
+	return uint32(params.DeviceID), nil
+}
+
+func TestAddDeviceRange(t *testing.T) {
+	adder := &fakeAdder{taken: map[int32]bool{10: true, 11: true}}
+	params := &ctrl.DeviceParams{DeviceID: AutoAssignDeviceID}
+	id, err := addDevice(adder, params, IDRange{First: 10, Count: 4})
+	if err != nil {
+		t.Fatalf("addDevice: %v", err)
+	}
+	if id != 12 {
+		t.Errorf("got ID %d, want 12", id)
+	}
+	if len(adder.tried) != 3 {
+		t.Errorf("tried %v, want 10, 11, 12", adder.tried)
+	}
+
+	// Every ID taken
+	adder = &fakeAdder{taken: map[int32]bool{10: true, 11: true}}
+	params.DeviceID = AutoAssignDeviceID
+	_, err = addDevice(adder, params, IDRange{First: 10, Count: 2})
+	if !errors.Is(err, ErrDeviceBusy) || !IsErrno(err, syscall.EEXIST) {
+		t.Errorf("exhausted range: got %v, want ErrDeviceBusy with EEXIST", err)
+	}
+}
+
+func TestAddDeviceFixed(t *testing.T) {
+	adder := &fakeAdder{taken: map[int32]bool{5: true}}
+
+	id, err := addDevice(adder, &ctrl.DeviceParams{DeviceID: AutoAssignDeviceID}, IDRange{})
+	if err != nil || id != 42 {
+		t.Errorf("auto: got (%d, %v), want kernel-assigned 42", id, err)
+	}
+
+	_, err = addDevice(adder, &ctrl.DeviceParams{DeviceID: 5}, IDRange{First: 0, Count: 10})
+	if !errors.Is(err, ErrDeviceBusy) || !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("taken fixed ID: got %v, want ErrDeviceBusy wrapping EEXIST", err)
+	}
+	if len(adder.tried) != 2 {
+		t.Errorf("fixed ID was retried: tried %v", adder.tried)
+	}
+}
@@ -0,0 +1,83 @@
+package ublk
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+// dirtyMap is a bitmap of fixed-size chunks that the queues mark while
+// they serve writes. All methods are safe for concurrent use; MigrateBackend
+// and changed block tracking build on it.
+type dirtyMap struct {
+	chunkSize int64
+	chunks    int64
+	words     []atomic.Uint64
+}
+
+// newDirtyMap returns a clean map covering size bytes.
+func newDirtyMap(size, chunkSize int64) *dirtyMap {
+	chunks := (size + chunkSize - 1) / chunkSize
+	return &dirtyMap{
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		words:     make([]atomic.Uint64, (chunks+63)/64),
+	}
+}
+
+// markAll flags every chunk as dirty.
+func (dm *dirtyMap) markAll() {
+	for i := range dm.words {
+		dm.words[i].Store(^uint64(0))
+	}
+	if tail := dm.chunks % 64; tail != 0 {
+		dm.words[len(dm.words)-1].Store(1<<tail - 1)
+	}
+}
+
+// mark flags the chunks overlapping [off, off+length) as dirty.
+func (dm *dirtyMap) mark(off, length int64) {
+	if length <= 0 {
+		return
+	}
+	last := min((off+length-1)/dm.chunkSize, dm.chunks-1)
+	for chunk := off / dm.chunkSize; chunk <= last; chunk++ {
+		dm.words[chunk/64].Or(1 << (chunk % 64))
+	}
+}
+
+// clear unflags chunk and reports whether it was dirty.
+func (dm *dirtyMap) clear(chunk int64) bool {
+	bit := uint64(1) << (chunk % 64)
+	return dm.words[chunk/64].And(^bit)&bit != 0
+}
+
+// next returns the first dirty chunk at or after from, or -1.
+func (dm *dirtyMap) next(from int64) int64 {
+	for w := from / 64; w < int64(len(dm.words)); w++ {
+		word := dm.words[w].Load()
+		if w == from/64 {
+			word &^= 1<<(from%64) - 1
+		}
+		if word != 0 {
+			return w*64 + int64(bits.TrailingZeros64(word))
+		}
+	}
+	return -1
+}
+
+// merge flags every chunk that is dirty in other, which must have the same
+// geometry.
+func (dm *dirtyMap) merge(other *dirtyMap) {
+	for i := range dm.words {
+		dm.words[i].Or(other.words[i].Load())
+	}
+}
+
+// count returns the number of dirty chunks.
+func (dm *dirtyMap) count() int64 {
+	var n int
+	for i := range dm.words {
+		n += bits.OnesCount64(dm.words[i].Load())
+	}
+	return int64(n)
+}
@@ -0,0 +1,53 @@
+package ublk
+
+import "testing"
+
+func TestDirtyMap(t *testing.T) {
+	dm := newDirtyMap(100*4096, 4096)
+	if got := dm.count(); got != 0 {
+		t.Fatalf("new map has %d dirty chunks, want 0", got)
+	}
+	dm.markAll()
+	if got := dm.count(); got != 100 {
+		t.Fatalf("markAll flagged %d chunks, want 100", got)
+	}
+	for chunk := dm.next(0); chunk >= 0; chunk = dm.next(chunk + 1) {
+		dm.clear(chunk)
+	}
+	if got := dm.count(); got != 0 {
+		t.Fatalf("%d chunks dirty after clearing all", got)
+	}
+
+	dm.mark(4095, 2)       // straddles chunks 0 and 1
+	dm.mark(70*4096, 4096) // exactly chunk 70
+	dm.mark(99*4096, 8192) // clamped to the last chunk
+	var got []int64
+	for chunk := dm.next(0); chunk >= 0; chunk = dm.next(chunk + 1) {
+		got = append(got, chunk)
+	}
+	want := []int64{0, 1, 70, 99}
+	if len(got) != len(want) {
+		t.Fatalf("dirty chunks = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("dirty chunks = %v, want %v", got, want)
+		}
+	}
+	if !dm.clear(70) || dm.clear(70) {
+		t.Error("clear did not report the chunk's previous state")
+	}
+}
+
+func TestDirtyMapMerge(t *testing.T) {
+	a, b := newDirtyMap(200*4096, 4096), newDirtyMap(200*4096, 4096)
+	a.mark(0, 4096)
+	b.mark(130*4096, 4096)
+	a.merge(b)
+	if a.count() != 2 || a.next(1) != 130 {
+		t.Errorf("merged map has %d chunks, next after 0 is %d", a.count(), a.next(1))
+	}
+	if b.count() != 1 {
+		t.Error("merge changed its source")
+	}
+}
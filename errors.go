@@ -3,6 +3,7 @@ package ublk
 import (
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"syscall"
 )
@@ -78,32 +79,58 @@ func (e *Error) Is(target error) bool {
 type UblkErrorCode string
 
 const (
-	ErrCodeNotImplemented     UblkErrorCode = "not implemented"
-	ErrCodeDeviceNotFound     UblkErrorCode = "device not found"
-	ErrCodeDeviceBusy         UblkErrorCode = "device busy"
-	ErrCodeInvalidParameters  UblkErrorCode = "invalid parameters"
-	ErrCodeKernelNotSupported UblkErrorCode = "kernel does not support ublk"
-	ErrCodePermissionDenied   UblkErrorCode = "permission denied"
-	ErrCodeInsufficientMemory UblkErrorCode = "insufficient memory"
-	ErrCodeIOError            UblkErrorCode = "I/O error"
-	ErrCodeTimeout            UblkErrorCode = "timeout"
-	ErrCodeDeviceOffline      UblkErrorCode = "device offline"
+	ErrCodeNotImplemented      UblkErrorCode = "not implemented"
+	ErrCodeDeviceNotFound      UblkErrorCode = "device not found"
+	ErrCodeDeviceBusy          UblkErrorCode = "device busy"
+	ErrCodeInvalidParameters   UblkErrorCode = "invalid parameters"
+	ErrCodeKernelNotSupported  UblkErrorCode = "kernel does not support ublk"
+	ErrCodePermissionDenied    UblkErrorCode = "permission denied"
+	ErrCodeInsufficientMemory  UblkErrorCode = "insufficient memory"
+	ErrCodeIOError             UblkErrorCode = "I/O error"
+	ErrCodeTimeout             UblkErrorCode = "timeout"
+	ErrCodeDeviceOffline       UblkErrorCode = "device offline"
+	ErrCodeRestartNotSupported UblkErrorCode = "device cannot be restarted"
 )
 
 // Sentinel errors for use with errors.Is()
 var (
-	ErrNotImplemented     = &Error{Code: ErrCodeNotImplemented, Msg: "not implemented", Queue: NoQueue}
-	ErrDeviceNotFound     = &Error{Code: ErrCodeDeviceNotFound, Msg: "device not found", Queue: NoQueue}
-	ErrDeviceBusy         = &Error{Code: ErrCodeDeviceBusy, Msg: "device busy", Queue: NoQueue}
-	ErrInvalidParameters  = &Error{Code: ErrCodeInvalidParameters, Msg: "invalid parameters", Queue: NoQueue}
-	ErrKernelNotSupported = &Error{Code: ErrCodeKernelNotSupported, Msg: "kernel does not support ublk", Queue: NoQueue}
-	ErrPermissionDenied   = &Error{Code: ErrCodePermissionDenied, Msg: "permission denied", Queue: NoQueue}
-	ErrInsufficientMemory = &Error{Code: ErrCodeInsufficientMemory, Msg: "insufficient memory", Queue: NoQueue}
-	ErrIOError            = &Error{Code: ErrCodeIOError, Msg: "I/O error", Queue: NoQueue}
-	ErrTimeout            = &Error{Code: ErrCodeTimeout, Msg: "timeout", Queue: NoQueue}
-	ErrDeviceOffline      = &Error{Code: ErrCodeDeviceOffline, Msg: "device offline", Queue: NoQueue}
+	ErrNotImplemented      = &Error{Code: ErrCodeNotImplemented, Msg: "not implemented", Queue: NoQueue}
+	ErrDeviceNotFound      = &Error{Code: ErrCodeDeviceNotFound, Msg: "device not found", Queue: NoQueue}
+	ErrDeviceBusy          = &Error{Code: ErrCodeDeviceBusy, Msg: "device busy", Queue: NoQueue}
+	ErrInvalidParameters   = &Error{Code: ErrCodeInvalidParameters, Msg: "invalid parameters", Queue: NoQueue}
+	ErrKernelNotSupported  = &Error{Code: ErrCodeKernelNotSupported, Msg: "kernel does not support ublk", Queue: NoQueue}
+	ErrPermissionDenied    = &Error{Code: ErrCodePermissionDenied, Msg: "permission denied", Queue: NoQueue}
+	ErrInsufficientMemory  = &Error{Code: ErrCodeInsufficientMemory, Msg: "insufficient memory", Queue: NoQueue}
+	ErrIOError             = &Error{Code: ErrCodeIOError, Msg: "I/O error", Queue: NoQueue}
+	ErrTimeout             = &Error{Code: ErrCodeTimeout, Msg: "timeout", Queue: NoQueue}
+	ErrDeviceOffline       = &Error{Code: ErrCodeDeviceOffline, Msg: "device offline", Queue: NoQueue}
+	ErrRestartNotSupported = &Error{Code: ErrCodeRestartNotSupported, Msg: "device cannot be restarted", Queue: NoQueue}
 )
 
+// DeviceBusyError reports that a device's char device is already open. The
+// kernel admits one server per device, so another process, or another
+// Device in this one, is serving it. It unwraps to syscall.EBUSY and is
+// found inside an error matching ErrDeviceBusy.
+type DeviceBusyError struct {
+	Path string // The char device node, e.g. "/dev/ublkc0"
+	PID  int    // The process holding it open, or 0 if it was not found
+}
+
+func (e *DeviceBusyError) Error() string {
+	if e.PID == 0 {
+		return e.Path + " is already open in another process"
+	}
+	if e.PID == os.Getpid() {
+		return e.Path + " is already open in this process"
+	}
+	return fmt.Sprintf("%s is already open in process %d", e.Path, e.PID)
+}
+
+// Unwrap returns syscall.EBUSY, the kernel's error for a second opener.
+func (e *DeviceBusyError) Unwrap() error {
+	return syscall.EBUSY
+}
+
 // Error constructors
 
 // NewError creates a new structured error
@@ -180,6 +207,46 @@ func mapErrnoToCode(errno syscall.Errno) UblkErrorCode {
 	}
 }
 
+// ErrnoMapper chooses the errno the kernel reports for a failed backend
+// request, so the guest sees e.g. ENOSPC instead of a generic EIO. Returning
+// 0 leaves the error to the default mapping:
+//
+//   - errors wrapping a syscall.Errno report it, so a backend can return
+//     fmt.Errorf("volume full: %w", syscall.ENOSPC), syscall.EROFS or
+//     syscall.EILSEQ for an integrity failure;
+//   - context.DeadlineExceeded and os.ErrDeadlineExceeded report ETIMEDOUT;
+//   - an *Error reports its Errno, or one derived from its Code;
+//   - anything else reports EIO.
+type ErrnoMapper func(err error) syscall.Errno
+
+// errnoForError maps a structured *Error to an errno, or returns 0 if err is
+// not one or its code has no natural errno.
+func errnoForError(err error) syscall.Errno {
+	var ublkErr *Error
+	if !errors.As(err, &ublkErr) {
+		return 0
+	}
+	if ublkErr.Errno != 0 {
+		return ublkErr.Errno
+	}
+	switch ublkErr.Code {
+	case ErrCodeNotImplemented:
+		return syscall.EOPNOTSUPP
+	case ErrCodeInvalidParameters:
+		return syscall.EINVAL
+	case ErrCodePermissionDenied:
+		return syscall.EACCES
+	case ErrCodeInsufficientMemory:
+		return syscall.ENOMEM
+	case ErrCodeTimeout:
+		return syscall.ETIMEDOUT
+	case ErrCodeDeviceOffline:
+		return syscall.ENODEV
+	default:
+		return 0
+	}
+}
+
 // IsCode checks if an error matches a specific error code
 func IsCode(err error, code UblkErrorCode) bool {
 	var ublkErr *Error
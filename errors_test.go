@@ -2,6 +2,7 @@ package ublk
 
 import (
 	"errors"
+	"fmt"
 	"syscall"
 	"testing"
 )
@@ -121,3 +122,65 @@ func TestErrnoMapping(t *testing.T) {
 		}
 	}
 }
+
+func TestErrnoForError(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected syscall.Errno
+	}{
+		{&Error{Code: ErrCodeIOError, Errno: syscall.EROFS}, syscall.EROFS},
+		{ErrTimeout, syscall.ETIMEDOUT},
+		{ErrNotImplemented, syscall.EOPNOTSUPP},
+		{WrapError("WRITE", ErrDeviceOffline), syscall.ENODEV},
+		{ErrIOError, 0},
+		{errors.New("plain"), 0},
+	}
+
+	for _, tc := range testCases {
+		if errno := errnoForError(tc.err); errno != tc.expected {
+			t.Errorf("errnoForError(%v) = %v, want %v", tc.err, errno, tc.expected)
+		}
+	}
+}
+
+func TestDeviceErrnoMapper(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	d := &Device{options: &Options{ErrnoMapper: func(err error) syscall.Errno {
+		if errors.Is(err, errQuota) {
+			return syscall.EDQUOT
+		}
+		return 0
+	}}}
+	mapper := d.errnoMapper()
+
+	if errno := mapper(errQuota); errno != syscall.EDQUOT {
+		t.Errorf("custom error mapped to %v, want EDQUOT", errno)
+	}
+	if errno := mapper(ErrTimeout); errno != syscall.ETIMEDOUT {
+		t.Errorf("ErrTimeout mapped to %v, want ETIMEDOUT", errno)
+	}
+	if errno := mapper(errors.New("other")); errno != 0 {
+		t.Errorf("unknown error mapped to %v, want 0 for the runner default", errno)
+	}
+}
+
+func TestCharOpenError(t *testing.T) {
+	other := errors.New("no such node")
+	if err := charOpenError(2, "/dev/ublkc2", other); err != other {
+		t.Errorf("non-EBUSY error = %v, want it unchanged", err)
+	}
+
+	err := charOpenError(2, "/nonexistent/ublkc2", fmt.Errorf("open: %w", syscall.EBUSY))
+	var busy *DeviceBusyError
+	if !errors.Is(err, ErrDeviceBusy) || !errors.As(err, &busy) || !errors.Is(err, syscall.EBUSY) {
+		t.Fatalf("EBUSY open = %v, want ErrDeviceBusy wrapping a DeviceBusyError and EBUSY", err)
+	}
+	if busy.Path != "/nonexistent/ublkc2" || busy.PID != 0 {
+		t.Errorf("DeviceBusyError = %+v, want the path and no holder", busy)
+	}
+
+	busy.PID = 4242
+	if got, want := busy.Error(), "/nonexistent/ublkc2 is already open in process 4242"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
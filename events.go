@@ -0,0 +1,280 @@
+package ublk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// EventType identifies an entry in a device's event log.
+type EventType string
+
+const (
+	// EventCreated is recorded when the device is added to the kernel
+	EventCreated EventType = "created"
+	// EventStarted is recorded when the device begins serving I/O
+	EventStarted EventType = "started"
+	// EventStopped is recorded when I/O processing stops
+	EventStopped EventType = "stopped"
+	// EventClosed is recorded when the device is removed from the kernel
+	EventClosed EventType = "closed"
+	// EventSnapshot is recorded when Device.Snapshot takes a snapshot
+	EventSnapshot EventType = "snapshot"
+	// EventMigrated is recorded when Device.MigrateBackend switches the
+	// device to its new backend
+	EventMigrated EventType = "migrated"
+	// EventQueueStall is recorded when a request stays in userspace longer
+	// than DeviceParams.StallThreshold
+	EventQueueStall EventType = "queue_stall"
+	// EventRingFull is recorded when a commit could not be queued because
+	// the submission ring was full
+	EventRingFull EventType = "ring_full"
+	// EventIOError is recorded when the backend fails a request
+	EventIOError EventType = "io_error"
+	// EventScrubError is recorded when a background scrub read fails or
+	// does not verify
+	EventScrubError EventType = "scrub_error"
+	// EventQueueFailed is recorded when a queue's I/O loop exits with an
+	// error
+	EventQueueFailed EventType = "queue_failed"
+	// EventQueuesRestarted is recorded when the queues are restarted after
+	// a failure (DeviceParams.AutoRestart)
+	EventQueuesRestarted EventType = "queues_restarted"
+)
+
+// Event is one entry in a device's event log. Fields that do not apply to
+// the event type are left at their zero value (Queue and Tag are -1).
+type Event struct {
+	Time     time.Time     `json:"time"`
+	Type     EventType     `json:"type"`
+	Queue    int           `json:"queue"`
+	Tag      int           `json:"tag"`
+	Op       string        `json:"op,omitempty"`
+	Offset   uint64        `json:"offset,omitempty"`
+	Length   uint32        `json:"length,omitempty"`
+	Duration time.Duration `json:"duration_ns,omitempty"` // stall time for EventQueueStall
+	Error    string        `json:"error,omitempty"`
+}
+
+// String formats the event as a single log line.
+func (e Event) String() string {
+	s := e.Time.Format(time.RFC3339Nano) + " " + string(e.Type)
+	if e.Queue >= 0 {
+		s += fmt.Sprintf(" queue=%d", e.Queue)
+	}
+	if e.Tag >= 0 {
+		s += fmt.Sprintf(" tag=%d", e.Tag)
+	}
+	if e.Op != "" {
+		s += fmt.Sprintf(" op=%s offset=%d length=%d", e.Op, e.Offset, e.Length)
+	}
+	if e.Duration > 0 {
+		s += fmt.Sprintf(" duration=%v", e.Duration)
+	}
+	if e.Error != "" {
+		s += " error=" + e.Error
+	}
+	return s
+}
+
+// isError reports whether the event indicates something went wrong.
+func (e Event) isError() bool {
+	switch e.Type {
+	case EventQueueStall, EventRingFull, EventIOError, EventScrubError, EventQueueFailed:
+		return true
+	}
+	return false
+}
+
+// eventLog is a bounded ring buffer of events. Once full, each new event
+// overwrites the oldest. A nil eventLog records nothing.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+	next   int  // index the next event is written to
+	full   bool // events has wrapped at least once
+	errors int  // error events recorded, including overwritten ones
+}
+
+// newEventLog returns a log holding size events (0 = default), or nil if
+// size is negative.
+func newEventLog(size int) *eventLog {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = constants.DefaultEventLogSize
+	}
+	return &eventLog{events: make([]Event, size)}
+}
+
+// record appends e, stamping it with the current time.
+func (l *eventLog) record(e Event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = e
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+	if e.isError() {
+		l.errors++
+	}
+}
+
+// recordDevice appends a device-wide event.
+func (l *eventLog) recordDevice(t EventType) {
+	l.record(Event{Type: t, Queue: -1, Tag: -1})
+}
+
+// snapshot returns the retained events, oldest first.
+func (l *eventLog) snapshot() []Event {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]Event(nil), l.events[:l.next]...)
+	}
+	out := make([]Event, 0, len(l.events))
+	out = append(out, l.events[l.next:]...)
+	return append(out, l.events[:l.next]...)
+}
+
+// hasErrors reports whether any error event was ever recorded.
+func (l *eventLog) hasErrors() bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.errors > 0
+}
+
+// Events returns the device's recent lifecycle and error events, oldest
+// first. The log keeps the last DeviceParams.EventLogSize events; it is
+// printed when the device is closed if any errors were recorded.
+func (d *Device) Events() []Event {
+	if d == nil {
+		return nil
+	}
+	return d.events.snapshot()
+}
+
+// dumpEvents logs the event history if any errors were recorded, so a
+// device that misbehaved leaves a trail even without debug logging.
+func (d *Device) dumpEvents() {
+	if !d.events.hasErrors() {
+		return
+	}
+	events := d.events.snapshot()
+	logger := logging.Default()
+	logger.Warn("device had errors, event history follows", "device", d.Path, "events", len(events))
+	for _, e := range events {
+		logger.Warn(e.String())
+	}
+}
+
+// eventObserver records queue events in the device's event log and passes
+// all callbacks on to the configured observer.
+type eventObserver struct {
+	Observer
+	queue  QueueObserver // nil if the configured observer has no queue events
+	events *eventLog
+}
+
+// newEventObserver wraps observer so queue events reach events. It returns
+// observer unchanged if there is no log.
+func newEventObserver(observer Observer, events *eventLog) Observer {
+	if events == nil {
+		return observer
+	}
+	qo, _ := observer.(QueueObserver)
+	o := &eventObserver{Observer: observer, queue: qo, events: events}
+	if po, ok := observer.(PhaseObserver); ok {
+		return &phaseEventObserver{eventObserver: o, phases: po}
+	}
+	return o
+}
+
+// phaseEventObserver is an eventObserver whose observer also takes
+// request phases. It is a separate type so the queues only time the
+// phases for observers that want them.
+type phaseEventObserver struct {
+	*eventObserver
+	phases PhaseObserver
+}
+
+func (o *phaseEventObserver) ObservePhases(dispatchNs, backendNs, refetchNs uint64) {
+	o.phases.ObservePhases(dispatchNs, backendNs, refetchNs)
+}
+
+func (o *eventObserver) OnFetchCompleted(queueID, tag uint16, result int32) {
+	if o.queue != nil {
+		o.queue.OnFetchCompleted(queueID, tag, result)
+	}
+}
+
+func (o *eventObserver) OnCommitSubmitted(queueID, tag uint16, result int32) {
+	if o.queue != nil {
+		o.queue.OnCommitSubmitted(queueID, tag, result)
+	}
+}
+
+func (o *eventObserver) OnQueueStall(queueID, tag uint16, stalled time.Duration) {
+	o.events.record(Event{Type: EventQueueStall, Queue: int(queueID), Tag: int(tag), Duration: stalled})
+	if o.queue != nil {
+		o.queue.OnQueueStall(queueID, tag, stalled)
+	}
+}
+
+func (o *eventObserver) OnRingFull(queueID uint16) {
+	o.events.record(Event{Type: EventRingFull, Queue: int(queueID), Tag: -1})
+	if o.queue != nil {
+		o.queue.OnRingFull(queueID)
+	}
+}
+
+func (o *eventObserver) OnIOError(queueID, tag uint16, op uint8, offset uint64, length uint32, err error) {
+	o.events.record(Event{
+		Type:   EventIOError,
+		Queue:  int(queueID),
+		Tag:    int(tag),
+		Op:     opName(op),
+		Offset: offset,
+		Length: length,
+		Error:  err.Error(),
+	})
+	if o.queue != nil {
+		o.queue.OnIOError(queueID, tag, op, offset, length, err)
+	}
+}
+
+// opName returns a short name for a UBLK_IO_OP_* code.
+func opName(op uint8) string {
+	switch op {
+	case uapi.UBLK_IO_OP_READ:
+		return "read"
+	case uapi.UBLK_IO_OP_WRITE:
+		return "write"
+	case uapi.UBLK_IO_OP_FLUSH:
+		return "flush"
+	case uapi.UBLK_IO_OP_DISCARD:
+		return "discard"
+	case uapi.UBLK_IO_OP_WRITE_ZEROES:
+		return "write_zeroes"
+	default:
+		return fmt.Sprintf("op%d", op)
+	}
+}
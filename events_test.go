@@ -0,0 +1,119 @@
+package ublk
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEventLogWraps(t *testing.T) {
+	l := newEventLog(3)
+	l.recordDevice(EventCreated)
+	l.recordDevice(EventStarted)
+	if got := l.snapshot(); len(got) != 2 || got[0].Type != EventCreated || got[1].Type != EventStarted {
+		t.Fatalf("snapshot = %v, want created, started", got)
+	}
+
+	l.record(Event{Type: EventRingFull, Queue: 0, Tag: -1})
+	l.recordDevice(EventStopped)
+	l.recordDevice(EventClosed)
+
+	got := l.snapshot()
+	want := []EventType{EventRingFull, EventStopped, EventClosed}
+	if len(got) != len(want) {
+		t.Fatalf("snapshot has %d events, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Type != want[i] {
+			t.Errorf("event %d = %s, want %s", i, got[i].Type, want[i])
+		}
+	}
+
+	// Push the ring-full event out; errors stay counted after they leave
+	// the log
+	l.recordDevice(EventStarted)
+	if got := l.snapshot(); got[0].Type != EventStopped {
+		t.Errorf("oldest event = %s, want %s", got[0].Type, EventStopped)
+	}
+	if !l.hasErrors() {
+		t.Error("hasErrors = false after a ring-full event was recorded")
+	}
+}
+
+func TestEventLogDisabled(t *testing.T) {
+	l := newEventLog(-1)
+	l.recordDevice(EventCreated)
+	if l.snapshot() != nil || l.hasErrors() {
+		t.Error("disabled event log recorded an event")
+	}
+	if obs := newEventObserver(NoOpObserver{}, l); obs != (NoOpObserver{}) {
+		t.Error("expected the observer to be returned unwrapped")
+	}
+}
+
+// countingQueueObserver counts forwarded queue events
+type countingQueueObserver struct {
+	NoOpObserver
+	calls int
+}
+
+func (c *countingQueueObserver) OnFetchCompleted(uint16, uint16, int32)                 { c.calls++ }
+func (c *countingQueueObserver) OnCommitSubmitted(uint16, uint16, int32)                { c.calls++ }
+func (c *countingQueueObserver) OnQueueStall(uint16, uint16, time.Duration)             { c.calls++ }
+func (c *countingQueueObserver) OnRingFull(uint16)                                      { c.calls++ }
+func (c *countingQueueObserver) OnIOError(uint16, uint16, uint8, uint64, uint32, error) { c.calls++ }
+
+func TestEventObserver(t *testing.T) {
+	inner := &countingQueueObserver{}
+	l := newEventLog(0)
+	obs := newEventObserver(inner, l).(QueueObserver)
+
+	obs.OnFetchCompleted(0, 1, 0)
+	obs.OnCommitSubmitted(0, 1, 4096)
+	obs.OnQueueStall(1, 2, 3*time.Second)
+	obs.OnIOError(0, 5, 1, 8192, 4096, errors.New("disk on fire"))
+
+	if inner.calls != 4 {
+		t.Errorf("inner observer got %d calls, want 4", inner.calls)
+	}
+
+	got := l.snapshot()
+	if len(got) != 2 {
+		t.Fatalf("recorded %d events, want stall and I/O error: %v", len(got), got)
+	}
+	if e := got[0]; e.Type != EventQueueStall || e.Queue != 1 || e.Tag != 2 || e.Duration != 3*time.Second {
+		t.Errorf("stall event = %+v", e)
+	}
+	e := got[1]
+	if e.Type != EventIOError || e.Op != "write" || e.Offset != 8192 || e.Length != 4096 || e.Error != "disk on fire" {
+		t.Errorf("I/O error event = %+v", e)
+	}
+	if !l.hasErrors() {
+		t.Error("hasErrors = false after an I/O error")
+	}
+}
+
+func TestEventObserverWithoutQueueObserver(t *testing.T) {
+	l := newEventLog(0)
+	obs := newEventObserver(NoOpObserver{}, l).(QueueObserver)
+	obs.OnFetchCompleted(0, 0, 0)
+	obs.OnRingFull(0)
+	if got := l.snapshot(); len(got) != 1 || got[0].Type != EventRingFull {
+		t.Errorf("snapshot = %v, want one ring-full event", got)
+	}
+}
+
+func TestEventObserverKeepsPhases(t *testing.T) {
+	m := NewMetrics()
+	obs, ok := newEventObserver(NewMetricsObserver(m), newEventLog(0)).(PhaseObserver)
+	if !ok {
+		t.Fatal("wrapped MetricsObserver no longer takes request phases")
+	}
+	obs.ObservePhases(1000, 2000, 3000)
+	if n := m.BackendLatency.Count.Load(); n != 1 {
+		t.Errorf("backend phase recorded %d times, want 1", n)
+	}
+	if _, ok := newEventObserver(NoOpObserver{}, newEventLog(0)).(PhaseObserver); ok {
+		t.Error("wrapped observer takes phases its observer does not")
+	}
+}
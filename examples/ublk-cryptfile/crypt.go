@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/aes"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/xts"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// cryptBackend encrypts another backend's data with AES-XTS, so the
+// backing file only ever holds ciphertext. Each logical block is one XTS
+// data unit, tweaked with the block's number, as dm-crypt does with
+// plain64 IVs. The block layer only sends whole logical blocks, so every
+// request covers whole units.
+//
+// It forwards no discards: a discarded range would read back as zeros
+// decrypted into garbage, and would tell an observer which blocks are in
+// use.
+type cryptBackend struct {
+	ublk.Backend
+	cipher    *xts.Cipher
+	blockSize int64
+	scratch   sync.Pool // *[]byte of ublk.IOBufferSizePerTag, for writes
+}
+
+// newCryptBackend wraps backend with a key of 32 bytes (AES-128-XTS) or
+// 64 bytes (AES-256-XTS).
+func newCryptBackend(backend ublk.Backend, key []byte, blockSize int) (*cryptBackend, error) {
+	if len(key) != 32 && len(key) != 64 {
+		return nil, fmt.Errorf("key is %d bytes, want 32 (AES-128-XTS) or 64 (AES-256-XTS)", len(key))
+	}
+	if backend.Size()%int64(blockSize) != 0 {
+		return nil, fmt.Errorf("backend size %d is not a multiple of the %d-byte block", backend.Size(), blockSize)
+	}
+	cipher, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, err
+	}
+	c := &cryptBackend{Backend: backend, cipher: cipher, blockSize: int64(blockSize)}
+	c.scratch.New = func() any {
+		buf := make([]byte, ublk.IOBufferSizePerTag)
+		return &buf
+	}
+	return c, nil
+}
+
+// ReadAt reads ciphertext into p and decrypts it in place.
+func (c *cryptBackend) ReadAt(p []byte, off int64) (int, error) {
+	if err := c.check(p, off); err != nil {
+		return 0, err
+	}
+	n, err := c.Backend.ReadAt(p, off)
+	whole := int64(n) / c.blockSize * c.blockSize
+	for i := int64(0); i < whole; i += c.blockSize {
+		unit := p[i : i+c.blockSize]
+		c.cipher.Decrypt(unit, unit, uint64((off+i)/c.blockSize))
+	}
+	return n, err
+}
+
+// WriteAt encrypts p into a scratch buffer and writes that, leaving p,
+// the device's request buffer, as it was.
+func (c *cryptBackend) WriteAt(p []byte, off int64) (int, error) {
+	if err := c.check(p, off); err != nil {
+		return 0, err
+	}
+	bufp := c.scratch.Get().(*[]byte)
+	defer c.scratch.Put(bufp)
+	buf := (*bufp)[:len(p)]
+	for i := int64(0); i < int64(len(p)); i += c.blockSize {
+		c.cipher.Encrypt(buf[i:i+c.blockSize], p[i:i+c.blockSize], uint64((off+i)/c.blockSize))
+	}
+	return c.Backend.WriteAt(buf, off)
+}
+
+// check rejects requests that are not whole blocks or do not fit the
+// scratch buffer; the device's parameters rule both out.
+func (c *cryptBackend) check(p []byte, off int64) error {
+	if off%c.blockSize != 0 || int64(len(p))%c.blockSize != 0 || len(p) > ublk.IOBufferSizePerTag {
+		return fmt.Errorf("request of %d bytes at %d is not whole %d-byte blocks", len(p), off, c.blockSize)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+func TestCryptBackendRoundTrip(t *testing.T) {
+	const blockSize = 4096
+	inner := ublk.NewMockBackend(16 * blockSize)
+	key := bytes.Repeat([]byte{0x5a}, 64)
+	c, err := newCryptBackend(inner, key, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("plaintext block!"), 2*blockSize/16)
+	orig := bytes.Clone(data)
+	if _, err := c.WriteAt(data, 3*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, orig) {
+		t.Error("WriteAt changed the caller's buffer")
+	}
+
+	// The backing store holds ciphertext, different for identical blocks
+	stored := make([]byte, 2*blockSize)
+	if _, err := inner.ReadAt(stored, 3*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("plaintext block!")) {
+		t.Error("plaintext reached the backing store")
+	}
+	if bytes.Equal(stored[:blockSize], stored[blockSize:]) {
+		t.Error("identical blocks encrypted identically; the tweak is not the block number")
+	}
+
+	got := make([]byte, 2*blockSize)
+	if _, err := c.ReadAt(got, 3*blockSize); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, orig) {
+		t.Error("ReadAt did not return what was written")
+	}
+
+	if _, err := c.ReadAt(make([]byte, 512), 0); err == nil {
+		t.Error("ReadAt accepted a partial block")
+	}
+	if _, err := newCryptBackend(inner, key[:16], blockSize); err == nil {
+		t.Error("newCryptBackend accepted a 16-byte key")
+	}
+}
+
+func TestThrottledBackendRate(t *testing.T) {
+	const rate = 1 << 20 // 1 MiB/s, so the 64K burst is 64ms of traffic
+	th := newThrottledBackend(ublk.NewMockBackend(1<<20), rate)
+
+	buf := make([]byte, 64<<10)
+	start := time.Now()
+	for range 4 { // The burst, then three more at 62.5ms each
+		if _, err := th.WriteAt(buf, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("256K at 1 MiB/s with a 64K burst took %v, want at least 150ms", elapsed)
+	}
+}
@@ -0,0 +1,15 @@
+module github.com/ehrlich-b/go-ublk/examples/ublk-cryptfile
+
+go 1.25
+
+require (
+	github.com/ehrlich-b/go-ublk v0.0.0
+	golang.org/x/crypto v0.31.0
+)
+
+require (
+	golang.org/x/sync v0.16.0 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
+
+replace github.com/ehrlich-b/go-ublk => ../..
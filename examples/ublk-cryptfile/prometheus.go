@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// metricsHandler serves the device's metrics in the Prometheus text
+// exposition format, labelled with the device's name, for scraping
+// without a client library.
+func metricsHandler(device *ublk.Device) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := device.MetricsSnapshot()
+		label := fmt.Sprintf("{device=%q}", filepath.Base(device.Path))
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		metric := func(name, kind, help string, value any) {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %v\n", name, help, name, kind, name, label, value)
+		}
+		metric("ublk_read_ops_total", "counter", "Read requests served.", s.ReadOps)
+		metric("ublk_write_ops_total", "counter", "Write requests served.", s.WriteOps)
+		metric("ublk_flush_ops_total", "counter", "Flush requests served.", s.FlushOps)
+		metric("ublk_read_bytes_total", "counter", "Bytes read.", s.ReadBytes)
+		metric("ublk_write_bytes_total", "counter", "Bytes written.", s.WriteBytes)
+		failed := s.ReadErrors + s.WriteErrors + s.DiscardErrors + s.FlushErrors
+		metric("ublk_errors_total", "counter", "Requests that failed.", failed)
+		metric("ublk_queue_stalls_total", "counter", "Requests held past the stall threshold.", s.QueueStalls)
+		metric("ublk_latency_p99_seconds", "gauge", "99th percentile request latency.", float64(s.LatencyP99Ns)/1e9)
+		metric("ublk_uptime_seconds", "gauge", "Time since the device started.", float64(s.UptimeNs)/1e9)
+	})
+}
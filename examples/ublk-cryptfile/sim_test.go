@@ -0,0 +1,47 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// TestCryptBackendKernelSectors serves the crypt backend, with 4K
+// blocks, through a simulated queue with the 512-byte sectors the kernel
+// always sends: every request must map onto whole blocks.
+func TestCryptBackendKernelSectors(t *testing.T) {
+	const blockSize, size = 4096, 1 << 20
+	c, err := newCryptBackend(ublk.NewMockBackend(size), bytes.Repeat([]byte{0x5a}, 64), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner, sim, err := queue.NewSimRunner(ctx, queue.Config{Depth: 4, Backend: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Close()
+
+	data := bytes.Repeat([]byte("plaintext block!"), 2*blockSize/16)
+	for _, sector := range []uint64{8, size/512 - 16} { // The second and the last two blocks
+		write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: sector, NrSectors: 16}
+		if res, err := sim.Do(ctx, write, bytes.Clone(data)); err != nil || res != 2*blockSize {
+			t.Fatalf("write at sector %d = %d, %v", sector, res, err)
+		}
+		got := make([]byte, 2*blockSize)
+		read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: sector, NrSectors: 16}
+		if res, err := sim.Do(ctx, read, got); err != nil || res != 2*blockSize || !bytes.Equal(got, data) {
+			t.Errorf("read at sector %d = %d, %v, want the data written", sector, res, err)
+		}
+	}
+}
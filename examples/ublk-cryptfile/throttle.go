@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// throttledBackend caps the bytes per second read from and written to
+// another backend with a token bucket, so one device cannot take all of
+// a disk it shares. A request larger than the bucket goes through and
+// leaves it in debt, which the requests after it wait out.
+type throttledBackend struct {
+	ublk.Backend
+	rate  float64 // Bytes per second
+	burst float64 // Bucket size in bytes
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newThrottledBackend caps backend at rate bytes per second, with bursts
+// of up to a tenth of a second's worth.
+func newThrottledBackend(backend ublk.Backend, rate int64) *throttledBackend {
+	burst := max(float64(rate)/10, ublk.IOBufferSizePerTag)
+	return &throttledBackend{Backend: backend, rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (t *throttledBackend) ReadAt(p []byte, off int64) (int, error) {
+	t.wait(len(p))
+	return t.Backend.ReadAt(p, off)
+}
+
+func (t *throttledBackend) WriteAt(p []byte, off int64) (int, error) {
+	t.wait(len(p))
+	return t.Backend.WriteAt(p, off)
+}
+
+// wait takes n bytes from the bucket, sleeping until the bucket has paid
+// for them.
+func (t *throttledBackend) wait(n int) {
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens = min(t.burst, t.tokens+now.Sub(t.last).Seconds()*t.rate)
+	t.last = now
+	t.tokens -= float64(n)
+	debt := -t.tokens
+	t.mu.Unlock()
+
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / t.rate * float64(time.Second)))
+	}
+}
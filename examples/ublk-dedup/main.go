@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/backend/dedup"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+func main() {
+	var (
+		storeDir   = flag.String("store", "", "Block store directory (required; created if missing)")
+		volume     = flag.String("volume", "disk", "Volume to serve; created on first use")
+		sizeStr    = flag.String("size", "", "Size of a new volume (e.g., 10G); omit to open an existing one")
+		numQueues  = flag.Int("queues", 0, "Number of I/O queues (0 = auto-detect based on CPU count)")
+		queueDepth = flag.Int("depth", 64, "Queue depth (number of concurrent I/Os per queue)")
+		workers    = flag.Int("workers", 4, "Backend worker goroutines per queue (0 = call the backend inline)")
+		statsEvery = flag.Duration("stats", 0, "Log dedup statistics at this interval (0 = only at exit)")
+		verbose    = flag.Bool("v", false, "Verbose output")
+	)
+	flag.Parse()
+
+	// Set up logging
+	logConfig := logging.DefaultConfig()
+	if *verbose {
+		logConfig.Level = logging.LevelDebug
+	}
+	logger := logging.NewLogger(logConfig)
+	logging.SetDefault(logger)
+
+	if *storeDir == "" {
+		logger.Error("-store is required")
+		os.Exit(2)
+	}
+	var size int64
+	if *sizeStr != "" {
+		var err error
+		if size, err = parseSize(*sizeStr); err != nil || size <= 0 {
+			logger.Error("invalid size", "size", *sizeStr, "error", err)
+			os.Exit(2)
+		}
+	}
+
+	store, err := dedup.Open(*storeDir)
+	if err != nil {
+		logger.Error("failed to open store", "store", *storeDir, "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	vol, err := store.Volume(*volume, size)
+	if err != nil {
+		logger.Error("failed to open volume", "volume", *volume, "error", err)
+		os.Exit(1)
+	}
+	defer vol.Close()
+
+	params := ublk.DefaultParams(vol)
+	params.QueueDepth = *queueDepth
+	params.NumQueues = *numQueues // 0 = auto-detect based on CPU count
+	params.LogicalBlockSize = dedup.BlockSize
+	params.MaxIOSize = ublk.IOBufferSizePerTag
+	params.BackendWorkers = *workers
+	params.DiscardGranularity = dedup.BlockSize
+
+	// Critical for kernel 6.11+: use ioctl-encoded control commands
+	params.EnableIoctlEncode = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, &ublk.Options{})
+	if err != nil {
+		logger.Error("failed to create device", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("device created successfully",
+		"block_device", device.Path,
+		"volume", *volume,
+		"size_bytes", vol.Size())
+
+	fmt.Printf("Device created: %s\n", device.Path)
+	fmt.Printf("Volume: %s in %s (%d bytes)\n", *volume, *storeDir, vol.Size())
+	fmt.Printf("\nPress Ctrl+C to stop...\n")
+
+	var tick <-chan time.Time
+	if *statsEvery > 0 {
+		ticker := time.NewTicker(*statsEvery)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+loop:
+	for {
+		select {
+		case <-tick:
+			logStats(logger, vol)
+		case <-sigCh:
+			break loop
+		}
+	}
+
+	logger.Info("received shutdown signal")
+	cancel()
+
+	if err := device.Close(); err != nil {
+		logger.Error("error stopping device", "error", err)
+	}
+	if err := vol.Flush(); err != nil {
+		logger.Error("failed to flush volume", "error", err)
+		os.Exit(1)
+	}
+	logStats(logger, vol)
+	logger.Info("device stopped successfully")
+}
+
+func logStats(logger *logging.Logger, vol *dedup.Volume) {
+	s := vol.Stats()
+	logger.Info("dedup statistics",
+		"volume_blocks", s["volume_blocks"],
+		"mapped_blocks", s["mapped_blocks"],
+		"stored_blocks", s["stored_blocks"],
+		"dedup_ratio", fmt.Sprintf("%.2f", s["dedup_ratio"]))
+}
+
+// parseSize parses a size string like "64M", "1G", "512K"
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(s)
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	num, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return num * multiplier, nil
+}
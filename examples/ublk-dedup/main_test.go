@@ -0,0 +1,60 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/backend/dedup"
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// TestVolumeKernelSectors serves a volume, whose blocks are 4K, through a
+// simulated queue with the 512-byte sectors the kernel always sends.
+func TestVolumeKernelSectors(t *testing.T) {
+	const size = 1 << 20
+	store, err := dedup.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	vol, err := store.Volume("disk", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vol.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner, sim, err := queue.NewSimRunner(ctx, queue.Config{Depth: 4, Backend: vol})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Close()
+
+	// The same data in the second and the last block
+	data := bytes.Repeat([]byte("dedup"), dedup.BlockSize/5+1)[:dedup.BlockSize]
+	for _, sector := range []uint64{8, size/512 - 8} {
+		write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: sector, NrSectors: 8}
+		if res, err := sim.Do(ctx, write, bytes.Clone(data)); err != nil || res != dedup.BlockSize {
+			t.Fatalf("write at sector %d = %d, %v", sector, res, err)
+		}
+	}
+	for _, sector := range []uint64{8, size/512 - 8} {
+		buf := make([]byte, dedup.BlockSize)
+		if _, err := vol.ReadAt(buf, int64(sector)<<9); err != nil || !bytes.Equal(buf, data) {
+			t.Errorf("block at sector %d does not hold the data written: %v", sector, err)
+		}
+	}
+	// Nothing landed past the first block
+	buf := make([]byte, dedup.BlockSize)
+	if _, err := vol.ReadAt(buf, 8*dedup.BlockSize); err != nil || !bytes.Equal(buf, make([]byte, dedup.BlockSize)) {
+		t.Errorf("write spilled into block 8: %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/backend/file"
+	"github.com/ehrlich-b/go-ublk/backend/replica"
+	"github.com/ehrlich-b/go-ublk/backend/wal"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+func main() {
+	var (
+		readOnly   = flag.Bool("ro", false, "Expose the device read-only")
+		direct     = flag.Bool("direct", false, "Open the backing file with O_DIRECT, bypassing the page cache")
+		numQueues  = flag.Int("queues", 0, "Number of I/O queues (0 = auto-detect based on CPU count)")
+		queueDepth = flag.Int("depth", 64, "Queue depth (number of concurrent I/Os per queue)")
+		blockSize  = flag.Int("block-size", ublk.DefaultLogicalBlockSize, "Logical block size (power of two, 512-4096)")
+		discard    = flag.String("discard", string(file.DiscardPunch), "Discard mode: none, punch (deallocate) or zero")
+		workers    = flag.Int("workers", 4, "Backend worker goroutines per queue (0 = call the backend inline)")
+		journal    = flag.String("journal", "", "Write-ahead journal file; writes are logged and synced before being applied")
+		mirror     = flag.String("mirror", "", "File or block device to replicate every write to")
+		mirrorMode = flag.String("mirror-mode", "sync", "Replication: sync (ack after both) or async (ack after the file)")
+		verbose    = flag.Bool("v", false, "Verbose output")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] FILE\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Expose a regular file or block device as a ublk block device.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	// Set up logging
+	logConfig := logging.DefaultConfig()
+	if *verbose {
+		logConfig.Level = logging.LevelDebug
+	}
+	logger := logging.NewLogger(logConfig)
+	logging.SetDefault(logger)
+
+	if *blockSize > 4096 {
+		logger.Error("invalid block size", "block_size", *blockSize)
+		os.Exit(2)
+	}
+	mode, err := file.ParseDiscardMode(*discard)
+	if err != nil {
+		logger.Error("invalid discard mode", "error", err)
+		os.Exit(2)
+	}
+	if *readOnly {
+		mode = file.DiscardNone // The kernel sends no discards to a read-only disk
+	}
+	replication, err := replica.ParseMode(*mirrorMode)
+	if err != nil {
+		logger.Error("invalid mirror mode", "error", err)
+		os.Exit(2)
+	}
+
+	fileBackend, err := file.Open(path, file.Options{
+		ReadOnly:  *readOnly,
+		Direct:    *direct,
+		BlockSize: *blockSize,
+	})
+	if err != nil {
+		logger.Error("failed to open backing file", "path", path, "error", err)
+		os.Exit(1)
+	}
+	defer fileBackend.Close()
+
+	backend := fileBackend.WithDiscard(mode)
+	if *mirror != "" && !*readOnly {
+		mirrorBackend, err := file.Open(*mirror, file.Options{Direct: *direct, BlockSize: *blockSize})
+		if err != nil {
+			logger.Error("failed to open mirror", "path", *mirror, "error", err)
+			os.Exit(1)
+		}
+		r, err := replica.New(backend, mirrorBackend.WithDiscard(mode), replica.Options{Mode: replication})
+		if err != nil {
+			logger.Error("failed to set up mirror", "path", *mirror, "error", err)
+			os.Exit(1)
+		}
+		defer r.Close() // Waits for queued writes to reach the mirror
+		backend = r.WithDiscard()
+	}
+	if *journal != "" && !*readOnly {
+		j, err := wal.Open(backend, *journal, wal.Options{})
+		if err != nil {
+			logger.Error("failed to open journal", "path", *journal, "error", err)
+			os.Exit(1)
+		}
+		if n := j.Stats()["replayed_records"]; n != uint64(0) {
+			logger.Info("replayed journal", "path", *journal, "records", n)
+		}
+		backend = j.WithDiscard()
+	}
+
+	params := ublk.DefaultParams(backend)
+	params.QueueDepth = *queueDepth
+	params.NumQueues = *numQueues // 0 = auto-detect based on CPU count
+	params.LogicalBlockSize = *blockSize
+	params.MaxIOSize = ublk.IOBufferSizePerTag
+	params.ReadOnly = *readOnly
+	params.BackendWorkers = *workers
+	params.DiscardGranularity = max(params.DiscardGranularity, uint32(*blockSize))
+	params.DiscardAlignment = 0
+
+	// Critical for kernel 6.11+: use ioctl-encoded control commands
+	params.EnableIoctlEncode = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, &ublk.Options{})
+	if err != nil {
+		logger.Error("failed to create device", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("device created successfully",
+		"block_device", device.Path,
+		"backing_file", path,
+		"size_bytes", fileBackend.Size(),
+		"read_only", *readOnly,
+		"direct", *direct,
+		"discard", mode)
+
+	fmt.Printf("Device created: %s\n", device.Path)
+	fmt.Printf("Backing file: %s (%d bytes)\n", path, fileBackend.Size())
+	fmt.Printf("Queues: %d, Depth: %d, Block size: %d\n", device.NumQueues(), params.QueueDepth, *blockSize)
+	fmt.Printf("\nPress Ctrl+C to stop...\n")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	logger.Info("received shutdown signal")
+	cancel()
+
+	if err := device.Close(); err != nil {
+		logger.Error("error stopping device", "error", err)
+	}
+	if err := backend.Flush(); err != nil {
+		logger.Error("failed to flush backing file", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("device stopped successfully")
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/backend/file"
+	"github.com/ehrlich-b/go-ublk/backend/httprange"
+	"github.com/ehrlich-b/go-ublk/backend/vdisk"
+)
+
+// remoteTimeout bounds each range request for remote images.
+const remoteTimeout = 30 * time.Second
+
+// image is an opened disk image and the block sizes to expose it with.
+type image struct {
+	backend  ublk.Backend
+	format   string
+	logical  int
+	physical int // 0 unless the format records it
+}
+
+// openImage opens path as format: "raw", a vdisk format name, or "auto" to
+// detect a vdisk format and fall back to raw. A zero opts.BlockSize is
+// taken from the image: the format's metadata, or the GPT header for raw
+// images. An http(s) URL is served as a raw image through Range requests,
+// keeping up to cacheSize bytes in memory.
+func openImage(path, format string, opts file.Options, discard file.DiscardMode, cacheSize int64) (*image, error) {
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return openRemote(path, format, opts, cacheSize)
+	}
+
+	var vf vdisk.Format
+	switch format {
+	case "raw":
+	case "auto":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		vf, err = vdisk.Detect(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		if vf = vdisk.Lookup(format); vf == nil {
+			return nil, fmt.Errorf("unknown image format %q", format)
+		}
+	}
+
+	if vf == nil {
+		if opts.BlockSize == 0 {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, err
+			}
+			opts.BlockSize = detectBlockSize(f)
+			f.Close()
+		}
+		raw, err := file.Open(path, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &image{backend: raw.WithDiscard(discard), format: "raw", logical: opts.BlockSize}, nil
+	}
+
+	if opts.Direct {
+		return nil, errors.New("O_DIRECT is only supported for raw images")
+	}
+	b, err := vdisk.Open(path, vf, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	img := &image{backend: b, format: vf.Name(), logical: opts.BlockSize}
+	if ss, ok := b.(vdisk.SectorSizer); ok {
+		if img.logical == 0 {
+			img.logical = ss.LogicalSectorSize()
+		}
+		img.physical = ss.PhysicalSectorSize()
+	}
+	if img.logical == 0 {
+		img.logical = ublk.DefaultLogicalBlockSize
+	}
+	return img, nil
+}
+
+func openRemote(url, format string, opts file.Options, cacheSize int64) (*image, error) {
+	switch {
+	case format != "auto" && format != "raw":
+		return nil, fmt.Errorf("remote images must be raw, not %s", format)
+	case !opts.ReadOnly:
+		return nil, errors.New("remote images are read-only; use -ro")
+	case opts.Direct:
+		return nil, errors.New("O_DIRECT is only supported for local images")
+	}
+
+	b, err := httprange.Open(url, httprange.Options{
+		Client:    &http.Client{Timeout: remoteTimeout},
+		CacheSize: cacheSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = detectBlockSize(b)
+	}
+	return &image{backend: b, format: "remote", logical: opts.BlockSize}, nil
+}
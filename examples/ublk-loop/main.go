@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/backend/file"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+func main() {
+	var (
+		format        = flag.String("format", "auto", "Image format: auto, raw, vhd or vhdx (VHDX is read-only)")
+		readOnly      = flag.Bool("ro", false, "Expose the image read-only")
+		direct        = flag.Bool("direct", false, "Open the image with O_DIRECT, bypassing the page cache")
+		numQueues     = flag.Int("queues", 0, "Number of I/O queues (0 = auto-detect based on CPU count)")
+		queueDepth    = flag.Int("depth", 64, "Queue depth (number of concurrent I/Os per queue)")
+		blockSize     = flag.Int("block-size", 0, "Logical block size (0 = detect from the image format or GPT header)")
+		physBlockSize = flag.Int("physical-block-size", 4096, "Physical block size reported for partition alignment")
+		discard       = flag.String("discard", string(file.DiscardPunch), "Discard mode: none, punch (deallocate) or zero")
+		workers       = flag.Int("workers", 4, "Backend worker goroutines per queue (0 = call the backend inline)")
+		remoteCache   = flag.Int64("remote-cache", 256, "Memory cache for remote images, in MiB")
+		partWait      = flag.Duration("partition-wait", 5*time.Second, "How long to wait for partition devices to appear")
+		verbose       = flag.Bool("v", false, "Verbose output")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] IMAGE|URL\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Attach a disk image, partition table included, as a ublk block device.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "An http(s) URL is attached read-only (-ro) and fetched on demand.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	path := flag.Arg(0)
+
+	// Set up logging
+	logConfig := logging.DefaultConfig()
+	if *verbose {
+		logConfig.Level = logging.LevelDebug
+	}
+	logger := logging.NewLogger(logConfig)
+	logging.SetDefault(logger)
+
+	mode, err := file.ParseDiscardMode(*discard)
+	if err != nil {
+		logger.Error("invalid discard mode", "error", err)
+		os.Exit(2)
+	}
+	if *readOnly {
+		mode = file.DiscardNone // The kernel sends no discards to a read-only disk
+	}
+
+	img, err := openImage(path, *format, file.Options{
+		ReadOnly:  *readOnly,
+		Direct:    *direct,
+		BlockSize: *blockSize,
+	}, mode, *remoteCache<<20)
+	if err != nil {
+		logger.Error("failed to open image", "path", path, "error", err)
+		os.Exit(1)
+	}
+	defer img.backend.Close()
+	logger.Info("opened image", "format", img.format, "block_size", img.logical)
+
+	params := ublk.DefaultParams(img.backend)
+	params.QueueDepth = *queueDepth
+	params.NumQueues = *numQueues // 0 = auto-detect based on CPU count
+	params.LogicalBlockSize = img.logical
+	params.PhysicalBlockSize = max(*physBlockSize, img.physical, img.logical)
+	params.MaxIOSize = ublk.IOBufferSizePerTag
+	params.ReadOnly = *readOnly
+	params.BackendWorkers = *workers
+	params.DiscardGranularity = uint32(params.PhysicalBlockSize)
+	params.DiscardAlignment = 0
+
+	// The kernel suppresses partition scanning on unprivileged devices, so
+	// this example must stay privileged for /dev/ublkbNpM to appear
+	params.EnableUnprivileged = false
+
+	// Critical for kernel 6.11+: use ioctl-encoded control commands
+	params.EnableIoctlEncode = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, &ublk.Options{})
+	if err != nil {
+		logger.Error("failed to create device", "error", err)
+		os.Exit(1)
+	}
+
+	partitions := waitPartitions(filepath.Base(device.Path), *partWait)
+	logger.Info("device created successfully",
+		"block_device", device.Path,
+		"image", path,
+		"format", img.format,
+		"size_bytes", img.backend.Size(),
+		"partitions", len(partitions))
+
+	fmt.Printf("Device created: %s\n", device.Path)
+	fmt.Printf("Image: %s (%s, %d bytes)\n", path, img.format, img.backend.Size())
+	fmt.Printf("Block size: %d logical, %d physical\n", params.LogicalBlockSize, params.PhysicalBlockSize)
+	if len(partitions) == 0 {
+		fmt.Printf("No partitions found\n")
+	}
+	for _, p := range partitions {
+		fmt.Printf("Partition: %s\n", p)
+	}
+	fmt.Printf("\nPress Ctrl+C to stop...\n")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	logger.Info("received shutdown signal")
+	cancel()
+
+	if err := device.Close(); err != nil {
+		logger.Error("error stopping device", "error", err)
+	}
+	if err := img.backend.Flush(); err != nil {
+		logger.Error("failed to flush image", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("device stopped successfully")
+}
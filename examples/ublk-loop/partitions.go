@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gptSignature opens the GPT header, which sits in the second logical block
+var gptSignature = []byte("EFI PART")
+
+// detectBlockSize returns the logical block size a GPT image was written
+// for, found from where its header lives: LBA 1 is byte 512 on 512-byte
+// sector disks and byte 4096 on 4Kn disks. Images without a GPT (MBR,
+// unpartitioned) report 512, as MBR always assumes it.
+func detectBlockSize(r io.ReaderAt) int {
+	for _, size := range []int{512, 4096} {
+		sig := make([]byte, len(gptSignature))
+		if _, err := r.ReadAt(sig, int64(size)); err == nil && bytes.Equal(sig, gptSignature) {
+			return size
+		}
+	}
+	return 512
+}
+
+// waitPartitions waits up to timeout for the kernel's partition scan of
+// disk (e.g. "ublkb0") to show up and returns the partition device paths.
+// It returns as soon as partitions appear and their nodes exist; an image
+// without a partition table just waits out the timeout.
+func waitPartitions(disk string, timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		parts := listPartitions(disk)
+		if len(parts) > 0 && nodesExist(parts) {
+			return parts
+		}
+		if time.Now().After(deadline) {
+			return parts
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// listPartitions reads the partitions the kernel created for disk from
+// sysfs. Every partition is a subdirectory named after the disk plus
+// "p<N>" with a "partition" attribute.
+func listPartitions(disk string) []string {
+	entries, err := os.ReadDir(filepath.Join("/sys/block", disk))
+	if err != nil {
+		return nil
+	}
+	var parts []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, disk+"p") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join("/sys/block", disk, name, "partition")); err == nil {
+			parts = append(parts, filepath.Join("/dev", name))
+		}
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		// ublkb0p2 before ublkb0p10
+		if len(parts[i]) != len(parts[j]) {
+			return len(parts[i]) < len(parts[j])
+		}
+		return parts[i] < parts[j]
+	})
+	return parts
+}
+
+// nodesExist reports whether udev has created every path yet.
+func nodesExist(paths []string) bool {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/backend/file"
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// TestOpenImage4KGPT serves a 4Kn GPT image the way the kernel's partition
+// scan reads it: LBA 1, the GPT header, is sectors 8-15 in the 512-byte
+// sectors descriptors always use.
+func TestOpenImage4KGPT(t *testing.T) {
+	const size = 1 << 20
+	data := make([]byte, size)
+	copy(data[4096:], gptSignature)
+	copy(data[size-4096:], "backup header")
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := openImage(path, "raw", file.Options{}, file.DiscardNone, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.backend.Close()
+	if img.logical != 4096 {
+		t.Fatalf("logical block size = %d, want 4096", img.logical)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runner, sim, err := queue.NewSimRunner(ctx, queue.Config{Depth: 4, Backend: img.backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Close()
+
+	for _, tt := range []struct {
+		sector uint64
+		want   []byte
+	}{
+		{8, gptSignature},
+		{size/512 - 8, []byte("backup header")}, // The last LBA
+	} {
+		buf := make([]byte, 4096)
+		desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: tt.sector, NrSectors: 8}
+		if res, err := sim.Do(ctx, desc, buf); err != nil || res != 4096 {
+			t.Fatalf("read at sector %d = %d, %v", tt.sector, res, err)
+		}
+		if !bytes.HasPrefix(buf, tt.want) {
+			t.Errorf("sector %d starts %q, want %q", tt.sector, buf[:len(tt.want)], tt.want)
+		}
+	}
+}
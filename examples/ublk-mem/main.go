@@ -1,3 +1,5 @@
+//go:build linux
+
 package main
 
 import (
@@ -20,13 +22,22 @@ import (
 
 func main() {
 	var (
-		sizeStr    = flag.String("size", "64M", "Size of the memory disk (e.g., 64M, 1G)")
-		verbose    = flag.Bool("v", false, "Verbose output")
-		minimal    = flag.Bool("minimal", false, "Use minimal resource parameters for debugging")
-		numQueues  = flag.Int("queues", 0, "Number of I/O queues (0 = auto-detect based on CPU count)")
-		queueDepth = flag.Int("depth", 64, "Queue depth (number of concurrent I/Os per queue)")
-		cpuprofile = flag.String("cpuprofile", "", "Write CPU profile to file")
-		memprofile = flag.String("memprofile", "", "Write memory profile to file")
+		sizeStr         = flag.String("size", "64M", "Size of the memory disk (e.g., 64M, 1G)")
+		verbose         = flag.Bool("v", false, "Verbose output")
+		minimal         = flag.Bool("minimal", false, "Use minimal resource parameters for debugging")
+		numQueues       = flag.Int("queues", 0, "Number of I/O queues (0 = auto-detect based on CPU count)")
+		queueDepth      = flag.Int("depth", 64, "Queue depth (number of concurrent I/Os per queue)")
+		sharedRing      = flag.Bool("shared-ring", false, "Serve all queues from one io_uring and thread")
+		workers         = flag.Int("workers", 0, "Backend worker goroutines per queue (0 = call the backend inline)")
+		cpuprofile      = flag.String("cpuprofile", "", "Write CPU profile to file")
+		memprofile      = flag.String("memprofile", "", "Write memory profile to file")
+		metricsFile     = flag.String("metrics-file", "", "Periodically write a JSON metrics snapshot to this file")
+		metricsLog      = flag.Bool("metrics-log", false, "Periodically log IOPS, MB/s and p99 latency")
+		metricsInterval = flag.Duration("metrics-interval", ublk.DefaultMetricsInterval, "Reporting period for -metrics-*")
+		traceFile       = flag.String("trace", "", "Record every I/O to this file for later replay")
+		autoTune        = flag.Bool("autotune", false, "Log queue depth, queue count and worker recommendations for the load")
+		storageFlag     = flag.String("storage", "heap", storageUsage)
+		populate        = flag.Bool("populate", false, "Allocate all of the memory up front instead of as it is written")
 	)
 	flag.Parse()
 
@@ -51,7 +62,10 @@ func main() {
 	}
 
 	// Create memory backend
-	memBackend := newMemoryBackend(size)
+	memBackend, err := newMemoryBackend(size, storageOptions{kind: storageKind(*storageFlag), populate: *populate})
+	if err != nil {
+		log.Fatalf("Could not allocate memory disk: %v", err)
+	}
 	defer memBackend.Close()
 
 	// Create device parameters
@@ -65,6 +79,8 @@ func main() {
 		params.NumQueues = *numQueues // 0 = auto-detect based on CPU count
 	}
 	params.MaxIOSize = ublk.IOBufferSizePerTag // Match buffer size for all modes
+	params.SharedRing = *sharedRing
+	params.BackendWorkers = *workers
 
 	// Critical for kernel 6.11+: use ioctl-encoded control commands
 	// This sets UBLK_F_CMD_IOCTL_ENCODE in the feature flags sent at ADD_DEV.
@@ -79,7 +95,23 @@ func main() {
 	logging.SetDefault(logger)
 
 	// Create options
-	options := &ublk.Options{}
+	options := &ublk.Options{
+		MetricsFile:     *metricsFile,
+		LogMetrics:      *metricsLog,
+		MetricsInterval: *metricsInterval,
+		AutoTune:        *autoTune,
+	}
+	if *metricsLog || *autoTune {
+		options.Logger = logger
+	}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err != nil {
+			log.Fatalf("Could not create trace file: %v", err)
+		}
+		defer f.Close()
+		options.Trace = f
+	}
 
 	if *minimal {
 		logger.Info("using minimal queue depth for faster initialization", "depth", params.QueueDepth)
@@ -114,6 +146,9 @@ func main() {
 	fmt.Printf("Character device: %s\n", device.CharPath)
 	fmt.Printf("Size: %s (%d bytes)\n", formatSize(size), size)
 	fmt.Printf("Queues: %d, Depth: %d\n", device.NumQueues(), params.QueueDepth)
+	if path := memBackend.mem.path(); path != "" {
+		fmt.Printf("Memory: %s\n", path)
+	}
 	fmt.Printf("\nYou can now use the device:\n")
 	fmt.Printf("  sudo mkfs.ext4 %s\n", device.Path)
 	fmt.Printf("  sudo mkdir -p /mnt/ublk\n")
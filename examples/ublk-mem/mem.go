@@ -1,3 +1,5 @@
+//go:build linux
+
 package main
 
 import (
@@ -13,19 +15,30 @@ const shardSize = 64 * 1024
 
 // memoryBackend provides a RAM-based backend for ublk devices.
 // Uses sharded locking to allow parallel I/O from multiple queues.
+//
+// Every request is atomic, even across shards: it holds the lock of every
+// shard it covers for the whole copy, so no reader sees half of a write.
+// Locks are always taken in ascending shard order, so requests that
+// overlap on several shards cannot deadlock.
 type memoryBackend struct {
+	mem    *storage
 	data   []byte
 	size   int64
 	shards []sync.RWMutex
 }
 
-func newMemoryBackend(size int64) *memoryBackend {
+func newMemoryBackend(size int64, opts storageOptions) (*memoryBackend, error) {
+	mem, err := newStorage(size, opts)
+	if err != nil {
+		return nil, err
+	}
 	numShards := (size + shardSize - 1) / shardSize
 	return &memoryBackend{
-		data:   make([]byte, size),
+		mem:    mem,
+		data:   mem.data,
 		size:   size,
 		shards: make([]sync.RWMutex, numShards),
-	}
+	}, nil
 }
 
 func (m *memoryBackend) shardRange(off, length int64) (start, end int) {
@@ -91,7 +104,7 @@ func (m *memoryBackend) Size() int64 {
 
 func (m *memoryBackend) Close() error {
 	m.data = nil
-	return nil
+	return m.mem.close()
 }
 
 func (m *memoryBackend) Flush() error {
@@ -114,7 +127,7 @@ func (m *memoryBackend) Discard(offset, length int64) error {
 		m.shards[i].Lock()
 	}
 
-	clear(m.data[offset:end])
+	m.mem.discard(offset, end)
 
 	for i := startShard; i <= endShard; i++ {
 		m.shards[i].Unlock()
@@ -123,7 +136,7 @@ func (m *memoryBackend) Discard(offset, length int64) error {
 	return nil
 }
 
-func (m *memoryBackend) WriteZeroes(offset, length int64) error {
+func (m *memoryBackend) WriteZeroes(offset, length int64, flags ublk.RequestFlags) error {
 	return m.Discard(offset, length)
 }
 
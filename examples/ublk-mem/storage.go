@@ -0,0 +1,160 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// storageKind selects where memoryBackend keeps the disk's data.
+type storageKind string
+
+const (
+	// storageHeap is a Go slice. The GC accounts for it in the heap goal,
+	// so a large disk lets the rest of the heap grow as large before a
+	// collection.
+	storageHeap storageKind = "heap"
+	// storageMmap is an anonymous mapping outside the Go heap.
+	storageMmap storageKind = "mmap"
+	// storageHugepage is an anonymous mapping of huge pages reserved in
+	// /proc/sys/vm/nr_hugepages (MAP_HUGETLB), for fewer TLB misses.
+	storageHugepage storageKind = "hugepage"
+	// storageMemfd is a shared mapping of a memfd, which other processes
+	// can open at /proc/<pid>/fd/<fd> to see the disk's contents.
+	storageMemfd storageKind = "memfd"
+)
+
+// storageUsage is the help for the -storage flag.
+const storageUsage = "Where to keep the data: heap, mmap (off the Go heap), hugepage (reserved huge pages) " +
+	"or memfd (shareable with other processes)"
+
+// hugePageSize is the huge page size assumed for storageHugepage mappings,
+// the default on x86-64 and arm64 with 4K pages.
+const hugePageSize = 2 << 20
+
+// storageOptions configures newStorage.
+type storageOptions struct {
+	kind storageKind
+	// populate faults in every page up front. Otherwise pages are
+	// allocated as they are first written, and reads of pages never
+	// written see the kernel's shared zero page.
+	populate bool
+}
+
+// storage is the memory holding a disk's data.
+type storage struct {
+	data    []byte // The disk, size bytes
+	mapping []byte // The whole mapping, nil for storageHeap
+	kind    storageKind
+	fd      int // The memfd, -1 for other kinds
+}
+
+func newStorage(size int64, opts storageOptions) (*storage, error) {
+	s := &storage{kind: opts.kind, fd: -1}
+	if s.kind == "" {
+		s.kind = storageHeap
+	}
+
+	flags := unix.MAP_PRIVATE | unix.MAP_ANONYMOUS
+	length := size
+	switch s.kind {
+	case storageHeap:
+		s.data = make([]byte, size)
+		if opts.populate {
+			for i := 0; i < len(s.data); i += os.Getpagesize() {
+				s.data[i] = 0
+			}
+		}
+		return s, nil
+	case storageMmap:
+		flags |= unix.MAP_NORESERVE
+	case storageHugepage:
+		// Reserved up front: with huge pages short, faulting one in later
+		// would be SIGBUS rather than an error here
+		flags |= unix.MAP_HUGETLB
+		length = (size + hugePageSize - 1) / hugePageSize * hugePageSize
+	case storageMemfd:
+		fd, err := unix.MemfdCreate("ublk-mem", unix.MFD_CLOEXEC)
+		if err != nil {
+			return nil, fmt.Errorf("memfd_create: %w", err)
+		}
+		if err := unix.Ftruncate(fd, size); err != nil {
+			_ = unix.Close(fd) // Cleanup, ignore error
+			return nil, fmt.Errorf("sizing memfd: %w", err)
+		}
+		s.fd = fd
+		flags = unix.MAP_SHARED
+	default:
+		return nil, fmt.Errorf("unknown storage %q (want heap, mmap, hugepage or memfd)", s.kind)
+	}
+	if opts.populate {
+		flags |= unix.MAP_POPULATE
+	}
+
+	mapping, err := unix.Mmap(s.fd, 0, int(length), unix.PROT_READ|unix.PROT_WRITE, flags)
+	if err != nil {
+		if s.fd >= 0 {
+			_ = unix.Close(s.fd) // Cleanup, ignore error
+		}
+		if s.kind == storageHugepage {
+			return nil, fmt.Errorf("mapping huge pages (are enough reserved in /proc/sys/vm/nr_hugepages?): %w", err)
+		}
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	s.mapping = mapping
+	s.data = mapping[:size]
+	return s, nil
+}
+
+// path returns where another process can open the disk's memory, or "" if
+// it cannot.
+func (s *storage) path() string {
+	if s.fd < 0 {
+		return ""
+	}
+	return fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), s.fd)
+}
+
+// discard zeroes data[off:end], handing whole pages back to the kernel
+// where the storage allows it, so discarded ranges stop using memory.
+func (s *storage) discard(off, end int64) {
+	page := int64(os.Getpagesize())
+	first := (off + page - 1) / page * page
+	last := end / page * page
+	if s.mapping == nil || s.kind == storageHugepage || first >= last {
+		clear(s.data[off:end])
+		return
+	}
+
+	var err error
+	if s.kind == storageMemfd {
+		err = unix.Fallocate(s.fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, first, last-first)
+	} else {
+		err = unix.Madvise(s.data[first:last], unix.MADV_DONTNEED)
+	}
+	if err != nil {
+		clear(s.data[first:last])
+	}
+	clear(s.data[off:first])
+	clear(s.data[last:end])
+}
+
+// close releases the memory. The data must not be used afterwards.
+func (s *storage) close() error {
+	data := s.mapping
+	s.data, s.mapping = nil, nil
+	if data == nil {
+		return nil
+	}
+	err := unix.Munmap(data)
+	if s.fd >= 0 {
+		if closeErr := unix.Close(s.fd); err == nil {
+			err = closeErr
+		}
+		s.fd = -1
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+func main() {
+	var (
+		sizeStr    = flag.String("size", "250G", "Size of the device (e.g., 64M, 1G); no memory is allocated")
+		numQueues  = flag.Int("queues", 0, "Number of I/O queues (0 = auto-detect based on CPU count)")
+		queueDepth = flag.Int("depth", 128, "Queue depth (number of concurrent I/Os per queue)")
+		workers    = flag.Int("workers", 0, "Backend worker goroutines per queue (0 = call the backend inline)")
+		sharedRing = flag.Bool("shared-ring", false, "Serve all queues from one io_uring and thread")
+		latency    = flag.Duration("latency", 0, "Artificial latency added to every request (e.g., 100us)")
+		iops       = flag.Int("iops", 0, "Cap on requests per second across the device (0 = unlimited)")
+		metricsLog = flag.Bool("metrics-log", false, "Periodically log IOPS, MB/s and p99 latency")
+		verbose    = flag.Bool("v", false, "Verbose output")
+	)
+	flag.Parse()
+
+	// Set up logging
+	logConfig := logging.DefaultConfig()
+	if *verbose {
+		logConfig.Level = logging.LevelDebug
+	}
+	logger := logging.NewLogger(logConfig)
+	logging.SetDefault(logger)
+
+	size, err := parseSize(*sizeStr)
+	if err != nil || size <= 0 {
+		logger.Error("invalid size", "size", *sizeStr, "error", err)
+		os.Exit(2)
+	}
+	if *latency > 0 && *workers == 0 {
+		logger.Info("latency is served inline, so each queue completes one request at a time; use -workers to overlap them")
+	}
+
+	backend := &nullBackend{
+		size:    size,
+		latency: *latency,
+		limiter: newRateLimiter(*iops),
+	}
+
+	params := ublk.DefaultParams(backend)
+	params.QueueDepth = *queueDepth
+	params.NumQueues = *numQueues // 0 = auto-detect based on CPU count
+	params.MaxIOSize = ublk.IOBufferSizePerTag
+	params.SharedRing = *sharedRing
+	params.BackendWorkers = *workers
+
+	// Critical for kernel 6.11+: use ioctl-encoded control commands
+	params.EnableIoctlEncode = true
+
+	options := &ublk.Options{LogMetrics: *metricsLog}
+	if *metricsLog {
+		options.Logger = logger
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, options)
+	if err != nil {
+		logger.Error("failed to create device", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("device created successfully",
+		"block_device", device.Path,
+		"size_bytes", size,
+		"latency", *latency,
+		"iops_cap", *iops)
+
+	fmt.Printf("Device created: %s\n", device.Path)
+	fmt.Printf("Queues: %d, Depth: %d\n", device.NumQueues(), params.QueueDepth)
+	fmt.Printf("\nMeasure framework overhead with e.g.:\n")
+	fmt.Printf("  sudo fio --name=null --filename=%s --direct=1 --rw=randread --bs=4k --iodepth=64"+
+		" --ioengine=io_uring --runtime=10 --time_based\n", device.Path)
+	fmt.Printf("\nPress Ctrl+C to stop...\n")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	logger.Info("received shutdown signal")
+	cancel()
+
+	if err := device.Close(); err != nil {
+		logger.Error("error stopping device", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("device stopped successfully")
+}
+
+// parseSize parses a size string like "64M", "1G", "512K"
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(s)
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	num, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return num * multiplier, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// nullBackend reads zeros and discards writes. Optional per-request latency
+// and an IOPS cap make it a calibrated stand-in for a real device, so the
+// framework's own overhead can be measured against known backend costs.
+type nullBackend struct {
+	size    int64
+	latency time.Duration // added to every request; 0 for none
+	limiter *rateLimiter  // nil for no IOPS cap
+}
+
+func (n *nullBackend) wait() {
+	if n.limiter != nil {
+		n.limiter.wait()
+	}
+	if n.latency > 0 {
+		time.Sleep(n.latency)
+	}
+}
+
+func (n *nullBackend) ReadAt(p []byte, off int64) (int, error) {
+	n.wait()
+	clear(p)
+	return len(p), nil
+}
+
+func (n *nullBackend) WriteAt(p []byte, off int64) (int, error) {
+	n.wait()
+	return len(p), nil
+}
+
+func (n *nullBackend) Size() int64 {
+	return n.size
+}
+
+func (n *nullBackend) Close() error {
+	return nil
+}
+
+func (n *nullBackend) Flush() error {
+	n.wait()
+	return nil
+}
+
+func (n *nullBackend) Discard(offset, length int64) error {
+	n.wait()
+	return nil
+}
+
+func (n *nullBackend) WriteZeroes(offset, length int64, flags ublk.RequestFlags) error {
+	n.wait()
+	return nil
+}
+
+// rateLimiter spaces requests evenly at a fixed rate. Each caller reserves
+// the next free slot and sleeps until it, so bursts are smoothed rather
+// than rejected.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+func (l *rateLimiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	slot := l.next
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if d := time.Until(slot); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// Compile-time interface checks
+var (
+	_ ublk.Backend            = (*nullBackend)(nil)
+	_ ublk.DiscardBackend     = (*nullBackend)(nil)
+	_ ublk.WriteZeroesBackend = (*nullBackend)(nil)
+)
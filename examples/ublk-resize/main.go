@@ -0,0 +1,177 @@
+//go:build linux
+
+// Command ublk-resize serves a RAM disk that grows while it is in use, to
+// show Device.Resize end to end. Each SIGUSR2 grows the disk by -step; the
+// kernel resizes the block device at once, and with -resize2fs the ext4
+// filesystem on it is grown online too:
+//
+//	sudo ublk-resize -size=256M -step=128M -resize2fs &
+//	sudo mkfs.ext4 /dev/ublkb0 && sudo mount /dev/ublkb0 /mnt
+//	df -h /mnt
+//	sudo kill -USR2 $(pidof ublk-resize)
+//	df -h /mnt
+//
+// Resizing needs a kernel with UBLK_F_UPDATE_SIZE; on older kernels the
+// device serves at its first size and each SIGUSR2 logs the error.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+func main() {
+	var (
+		sizeStr    = flag.String("size", "256M", "Initial size of the memory disk (e.g., 256M, 1G)")
+		stepStr    = flag.String("step", "128M", "How much each SIGUSR2 grows the disk by")
+		maxStr     = flag.String("max", "4G", "Size the disk never grows past")
+		runResize  = flag.Bool("resize2fs", false, "Run resize2fs after growing the disk, to grow a mounted ext4 filesystem")
+		numQueues  = flag.Int("queues", 0, "Number of I/O queues (0 = auto-detect based on CPU count)")
+		queueDepth = flag.Int("depth", 64, "Queue depth (number of concurrent I/Os per queue)")
+		verbose    = flag.Bool("v", false, "Verbose output")
+	)
+	flag.Parse()
+
+	// Set up logging
+	logConfig := logging.DefaultConfig()
+	if *verbose {
+		logConfig.Level = logging.LevelDebug
+	}
+	logger := logging.NewLogger(logConfig)
+	logging.SetDefault(logger)
+
+	size, step, maxSize, err := parseSizes(*sizeStr, *stepStr, *maxStr)
+	if err != nil {
+		logger.Error("invalid size", "error", err)
+		os.Exit(2)
+	}
+
+	backend := newMemoryBackend(size)
+
+	params := ublk.DefaultParams(backend)
+	params.QueueDepth = *queueDepth
+	params.NumQueues = *numQueues // 0 = auto-detect based on CPU count
+	params.MaxIOSize = ublk.IOBufferSizePerTag
+	params.EnableResize = true
+
+	// Critical for kernel 6.11+: use ioctl-encoded control commands
+	params.EnableIoctlEncode = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, &ublk.Options{})
+	if err != nil {
+		logger.Error("failed to create device", "error", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Device created: %s (%d MiB)\n", device.Path, size>>20)
+	fmt.Printf("Grow it by %d MiB with: kill -USR2 %d\n", step>>20, os.Getpid())
+	fmt.Printf("\nPress Ctrl+C to stop...\n")
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	for sig := range sigCh {
+		if sig != syscall.SIGUSR2 {
+			break
+		}
+		grow(device, step, maxSize, *runResize, logger)
+	}
+
+	logger.Info("received shutdown signal")
+	cancel()
+
+	if err := device.Close(); err != nil {
+		logger.Error("error stopping device", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("device stopped successfully")
+}
+
+// grow resizes device by step, up to maxSize, and then runs resize2fs on
+// it if runResize is set.
+func grow(device *ublk.Device, step, maxSize int64, runResize bool, logger *logging.Logger) {
+	oldSize := device.Size()
+	newSize := min(oldSize+step, maxSize)
+	if newSize == oldSize {
+		logger.Warn("device is already at its maximum size", "size", maxSize)
+		return
+	}
+	if err := device.Resize(newSize); err != nil {
+		logger.Error("failed to resize device", "size", newSize, "error", err)
+		return
+	}
+	fmt.Printf("Grew %s from %d MiB to %d MiB\n", device.Path, oldSize>>20, newSize>>20)
+
+	if !runResize {
+		return
+	}
+	// resize2fs grows a mounted ext4 filesystem online; on an unmounted
+	// one it asks for an fsck first and changes nothing
+	out, err := exec.Command("resize2fs", device.Path).CombinedOutput()
+	os.Stdout.Write(out)
+	if err != nil {
+		logger.Error("resize2fs failed", "device", device.Path, "error", err)
+	}
+}
+
+// parseSizes parses the initial size, step and maximum size, which must be
+// whole multiples of the 512-byte logical block with the step positive and
+// the initial size no larger than the maximum.
+func parseSizes(sizeStr, stepStr, maxStr string) (size, step, maxSize int64, err error) {
+	for _, s := range []struct {
+		name string
+		str  string
+		dst  *int64
+	}{{"size", sizeStr, &size}, {"step", stepStr, &step}, {"max", maxStr, &maxSize}} {
+		if *s.dst, err = parseSize(s.str); err != nil {
+			return 0, 0, 0, fmt.Errorf("-%s %q: %w", s.name, s.str, err)
+		}
+		if *s.dst <= 0 || *s.dst%ublk.DefaultLogicalBlockSize != 0 {
+			return 0, 0, 0, fmt.Errorf("-%s %q is not a positive multiple of %d bytes",
+				s.name, s.str, ublk.DefaultLogicalBlockSize)
+		}
+	}
+	if size > maxSize {
+		return 0, 0, 0, fmt.Errorf("-size %s is larger than -max %s", sizeStr, maxStr)
+	}
+	return size, step, maxSize, nil
+}
+
+// parseSize parses a byte count such as "256M" (K, M, G and T suffixes,
+// powers of 1024).
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(s)
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(s, "T"):
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	num, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return num * multiplier, nil
+}
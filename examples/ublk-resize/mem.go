@@ -0,0 +1,116 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ehrlich-b/go-ublk"
+)
+
+// chunkSize is the unit the disk's memory is allocated in. Chunks are
+// allocated on first write, so growing the disk costs nothing until the new
+// space is written.
+const chunkSize = 1 << 20
+
+// memoryBackend is a RAM disk that can change size while it is served.
+// Resize holds the lock exclusively, so no request sees the disk half
+// resized; Device.Resize also quiesces I/O around it.
+type memoryBackend struct {
+	mu     sync.RWMutex
+	size   int64
+	chunks [][]byte // nil until first written
+}
+
+func newMemoryBackend(size int64) *memoryBackend {
+	m := &memoryBackend{}
+	_ = m.Resize(size) // Cannot fail for a new backend
+	return m
+}
+
+func (m *memoryBackend) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if err := m.check(p, off); err != nil {
+		return 0, err
+	}
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		chunk, within := m.chunks[pos/chunkSize], pos%chunkSize
+		dst := p[n:min(len(p), n+int(chunkSize-within))]
+		if chunk == nil {
+			clear(dst)
+		} else {
+			copy(dst, chunk[within:])
+		}
+		n += len(dst)
+	}
+	return len(p), nil
+}
+
+func (m *memoryBackend) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.check(p, off); err != nil {
+		return 0, err
+	}
+	for n := 0; n < len(p); {
+		pos := off + int64(n)
+		i, within := pos/chunkSize, pos%chunkSize
+		if m.chunks[i] == nil {
+			m.chunks[i] = make([]byte, chunkSize)
+		}
+		n += copy(m.chunks[i][within:], p[n:])
+	}
+	return len(p), nil
+}
+
+// check rejects requests past the end of the disk.
+func (m *memoryBackend) check(p []byte, off int64) error {
+	if off < 0 || off+int64(len(p)) > m.size {
+		return fmt.Errorf("request of %d bytes at %d is past the end of the %d-byte disk", len(p), off, m.size)
+	}
+	return nil
+}
+
+// Resize grows the disk with space that reads as zeros, or shrinks it and
+// frees the memory past the new end.
+func (m *memoryBackend) Resize(newSize int64) error {
+	if newSize < 0 {
+		return fmt.Errorf("negative size %d", newSize)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := int((newSize + chunkSize - 1) / chunkSize)
+	if n <= len(m.chunks) {
+		clear(m.chunks[n:])
+		m.chunks = m.chunks[:n]
+		// Zero the tail of the last chunk, so growing again reads zeros there
+		if within := newSize % chunkSize; within != 0 && m.chunks[n-1] != nil {
+			clear(m.chunks[n-1][within:])
+		}
+	} else {
+		m.chunks = append(m.chunks, make([][]byte, n-len(m.chunks))...)
+	}
+	m.size = newSize
+	return nil
+}
+
+func (m *memoryBackend) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+func (m *memoryBackend) Close() error {
+	return nil
+}
+
+func (m *memoryBackend) Flush() error {
+	return nil
+}
+
+// Compile-time interface checks
+var _ ublk.ResizeBackend = (*memoryBackend)(nil)
@@ -0,0 +1,65 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryBackendResize(t *testing.T) {
+	m := newMemoryBackend(chunkSize + 4096)
+
+	// A write straddling the chunk boundary lands in two chunks
+	data := bytes.Repeat([]byte{0xAB}, 8192)
+	if _, err := m.WriteAt(data, chunkSize-4096); err != nil {
+		t.Fatalf("WriteAt: %v", err)
+	}
+	if _, err := m.WriteAt(data, chunkSize); err == nil {
+		t.Error("write past the end succeeded")
+	}
+
+	// Grown space reads as zeros, and existing data stays
+	if err := m.Resize(3 * chunkSize); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	buf := make([]byte, 8192)
+	if _, err := m.ReadAt(buf, chunkSize-4096); err != nil || !bytes.Equal(buf, data) {
+		t.Errorf("data across the boundary after growing: %v", err)
+	}
+	if _, err := m.ReadAt(buf, 2*chunkSize); err != nil || !bytes.Equal(buf, make([]byte, 8192)) {
+		t.Errorf("grown space does not read as zeros: %v", err)
+	}
+
+	// Shrinking into a written chunk and growing again exposes zeros, not
+	// the data that was cut off
+	if err := m.Resize(chunkSize); err != nil {
+		t.Fatalf("shrink: %v", err)
+	}
+	if err := m.Resize(chunkSize + 4096); err != nil {
+		t.Fatalf("regrow: %v", err)
+	}
+	if _, err := m.ReadAt(buf[:4096], chunkSize); err != nil || !bytes.Equal(buf[:4096], make([]byte, 4096)) {
+		t.Errorf("space regrown after a shrink does not read as zeros: %v", err)
+	}
+	if got := m.Size(); got != chunkSize+4096 {
+		t.Errorf("Size = %d, want %d", got, chunkSize+4096)
+	}
+}
+
+func TestParseSizes(t *testing.T) {
+	size, step, maxSize, err := parseSizes("256M", "128M", "1G")
+	if err != nil || size != 256<<20 || step != 128<<20 || maxSize != 1<<30 {
+		t.Errorf("parseSizes = %d, %d, %d, %v", size, step, maxSize, err)
+	}
+	for _, tt := range [][3]string{
+		{"2G", "128M", "1G"}, // Larger than the maximum
+		{"256M", "0", "1G"},  // No step
+		{"1000", "128M", "1G"},
+		{"256M", "x", "1G"},
+	} {
+		if _, _, _, err := parseSizes(tt[0], tt[1], tt[2]); err == nil {
+			t.Errorf("parseSizes%q succeeded", tt)
+		}
+	}
+}
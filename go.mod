@@ -2,4 +2,7 @@ module github.com/ehrlich-b/go-ublk
 
 go 1.25
 
-require golang.org/x/sys v0.28.0
+require (
+	golang.org/x/sync v0.16.0
+	golang.org/x/sys v0.28.0
+)
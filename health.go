@@ -0,0 +1,183 @@
+package ublk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+)
+
+// HealthReport is the result of Device.HealthCheck. It is JSON-friendly so it
+// can be served directly from a liveness endpoint.
+type HealthReport struct {
+	Healthy   bool          `json:"healthy"`
+	State     DeviceState   `json:"state"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Duration  time.Duration `json:"duration_ns"`
+	Queues    []QueueHealth `json:"queues"`
+	Probe     *ProbeResult  `json:"probe,omitempty"` // nil if no scratch block is configured
+	Problems  []string      `json:"problems,omitempty"`
+}
+
+// QueueHealth describes one queue as seen from its I/O loop.
+type QueueHealth struct {
+	QueueID        int  `json:"queue_id"`
+	Responsive     bool `json:"responsive"`       // loop answered within the check's deadline
+	InFlightFetch  int  `json:"in_flight_fetch"`  // tags waiting for the kernel to send a request
+	Owned          int  `json:"owned"`            // tags being processed in userspace
+	InFlightCommit int  `json:"in_flight_commit"` // tags whose result is on its way to the kernel
+}
+
+// ProbeResult describes the end-to-end I/O probe on the scratch block.
+type ProbeResult struct {
+	Offset  int64         `json:"offset"`
+	Latency time.Duration `json:"latency_ns"` // block device write to backend read-back
+	Error   string        `json:"error,omitempty"`
+}
+
+// healthQueueTimeout bounds how long HealthCheck waits for each queue loop
+// when ctx has no earlier deadline.
+const healthQueueTimeout = time.Second
+
+// HealthCheck probes a running device end to end and reports what it found.
+// It never returns an error for an unhealthy device; errors are reserved for
+// checks that could not be run at all. It:
+//
+//   - asks every queue loop for its tag states, which also proves the loop is
+//     alive, and checks them for consistency;
+//   - if DeviceParams.HealthCheckOffset is set, writes a magic block there
+//     through the block device with O_DIRECT, reads it back through the
+//     backend, and restores the previous contents.
+func (d *Device) HealthCheck(ctx context.Context) (*HealthReport, error) {
+	if d == nil {
+		return nil, ErrInvalidParameters
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	start := time.Now()
+	report := &HealthReport{
+		State:     d.State(),
+		CheckedAt: start,
+	}
+	if report.State != DeviceStateRunning {
+		report.Problems = append(report.Problems, fmt.Sprintf("device is %s", report.State))
+	}
+
+	for i, runner := range d.runners {
+		report.Queues = append(report.Queues, d.checkQueue(ctx, i, runner, &report.Problems))
+	}
+
+	if d.params.HealthCheckOffset > 0 && report.State == DeviceStateRunning {
+		report.Probe = d.probeIO(d.params.HealthCheckOffset)
+		if report.Probe.Error != "" {
+			report.Problems = append(report.Problems, "I/O probe: "+report.Probe.Error)
+		}
+	}
+
+	report.Healthy = len(report.Problems) == 0
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+// checkQueue snapshots one queue's tag states and appends any problems.
+func (d *Device) checkQueue(ctx context.Context, id int, runner *queue.Runner, problems *[]string) QueueHealth {
+	health := QueueHealth{QueueID: id}
+
+	ctx, cancel := context.WithTimeout(ctx, healthQueueTimeout)
+	defer cancel()
+	states, err := runner.TagStates(ctx)
+	if err != nil {
+		*problems = append(*problems, fmt.Sprintf("queue %d: %v", id, err))
+		return health
+	}
+	health.Responsive = true
+
+	for tag, state := range states {
+		switch state {
+		case queue.TagStateInFlightFetch:
+			health.InFlightFetch++
+		case queue.TagStateOwned:
+			health.Owned++
+		case queue.TagStateInFlightCommit:
+			health.InFlightCommit++
+		default:
+			*problems = append(*problems, fmt.Sprintf("queue %d: tag %d in invalid state %d", id, tag, state))
+		}
+	}
+
+	// Without workers every owned tag is committed before the loop takes
+	// the next batch, so none can be owned between batches.
+	if runner.Workers() == 0 && health.Owned > 0 {
+		*problems = append(*problems, fmt.Sprintf("queue %d: %d tags owned between batches", id, health.Owned))
+	}
+	return health
+}
+
+// healthMagic prefixes the probe block so a stale or misdirected read is
+// easy to recognise.
+var healthMagic = []byte("go-ublk health probe")
+
+// probeIO writes a magic block at offset through the block device, reads it
+// back through the backend and restores the original data.
+func (d *Device) probeIO(offset int64) *ProbeResult {
+	result := &ProbeResult{Offset: offset}
+	if err := d.probeBlock(offset, &result.Latency); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (d *Device) probeBlock(offset int64, latency *time.Duration) error {
+	bs := int64(d.blockSize)
+	if offset%bs != 0 || offset+bs > d.Size() {
+		return fmt.Errorf("offset %d is not a block inside the device", offset)
+	}
+
+	f, err := openDirect(d.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// O_DIRECT needs an aligned buffer
+	mem, err := mmapAnon(int(2 * bs))
+	if err != nil {
+		return err
+	}
+	defer munmapAnon(mem)
+	saved, probe := mem[:bs], mem[bs:]
+
+	if _, err := f.ReadAt(saved, offset); err != nil {
+		return fmt.Errorf("read original block: %w", err)
+	}
+
+	copy(probe, healthMagic)
+	stamp := fmt.Appendf(nil, " %d", time.Now().UnixNano())
+	copy(probe[len(healthMagic):], stamp)
+
+	start := time.Now()
+	if _, err := f.WriteAt(probe, offset); err != nil {
+		return fmt.Errorf("write probe block: %w", err)
+	}
+	check := make([]byte, bs)
+	_, readErr := d.Backend.ReadAt(check, offset)
+	*latency = time.Since(start)
+
+	// Put the original data back before judging the result
+	if _, err := f.WriteAt(saved, offset); err != nil {
+		return fmt.Errorf("restore original block: %w", err)
+	}
+
+	if readErr != nil {
+		return fmt.Errorf("backend read: %w", readErr)
+	}
+	if !bytes.Equal(check, probe) {
+		return errors.New("backend returned different data than was written")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package ublk
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+)
+
+func TestHealthCheck(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runner := queue.NewStubRunner(ctx, queue.Config{Depth: 8, Backend: NewMockBackend(1 << 20)})
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Close()
+
+	device := &Device{
+		ID:        1,
+		Path:      "/dev/ublkb1",
+		Backend:   NewMockBackend(1 << 20),
+		queues:    1,
+		depth:     8,
+		blockSize: 512,
+		started:   true,
+		ctx:       ctx,
+		cancel:    cancel,
+		runners:   []*queue.Runner{runner},
+	}
+
+	report, err := device.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Healthy {
+		t.Fatalf("running device reported unhealthy: %v", report.Problems)
+	}
+	if len(report.Queues) != 1 || !report.Queues[0].Responsive || report.Queues[0].InFlightFetch != 8 {
+		t.Errorf("queues = %+v, want one responsive queue with 8 tags in flight", report.Queues)
+	}
+	if report.Probe != nil {
+		t.Error("I/O probe ran without a HealthCheckOffset")
+	}
+
+	// A queue whose loop is gone is reported, not hidden
+	runner.Stop()
+	report, err = device.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Healthy || report.Queues[0].Responsive {
+		t.Fatal("stopped queue loop reported healthy")
+	}
+	if !strings.Contains(strings.Join(report.Problems, "; "), "queue 0") {
+		t.Errorf("problems = %v, want a queue 0 entry", report.Problems)
+	}
+}
+
+func TestHealthCheck_NotRunning(t *testing.T) {
+	device := &Device{ID: 1, Backend: NewMockBackend(1 << 20)}
+
+	report, err := device.HealthCheck(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Healthy || report.State != DeviceStateCreated {
+		t.Errorf("created device: healthy=%v state=%s, want unhealthy and created", report.Healthy, report.State)
+	}
+}
@@ -1,5 +1,12 @@
 package ublk
 
+import (
+	"context"
+
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
 // Backend defines the interface that all ublk backends must implement.
 // This interface is intentionally similar to standard Go interfaces like
 // io.ReaderAt and io.WriterAt for familiarity and composability.
@@ -12,6 +19,10 @@ type Backend interface {
 	// If the n = len(p) bytes returned by ReadAt are at the end of the input source,
 	// ReadAt may return either err == nil or err == io.EOF.
 	//
+	// The queue runner retries short reads and zero-fills the rest of the
+	// request after io.EOF, so a backend whose data ends before Size()
+	// reads as zeros past that point. Requests beyond Size() never reach it.
+	//
 	// Implementations must not retain p.
 	ReadAt(p []byte, off int64) (n int, err error)
 
@@ -51,13 +62,55 @@ type DiscardBackend interface {
 }
 
 // WriteZeroesBackend is an optional interface for efficient zero-writing.
+// Implementing it makes the device advertise WRITE_ZEROES.
 type WriteZeroesBackend interface {
 	Backend
 
 	// WriteZeroes efficiently writes zeros to the given range.
 	// This is more efficient than WriteAt with a zero-filled buffer.
 	// offset and length are in bytes.
-	WriteZeroes(offset, length int64) error
+	//
+	// The range must read back as zeros afterwards either way, but
+	// flags.NoUnmap() tells the two variants filesystems rely on apart:
+	// with it the range must stay allocated, so later writes to it cannot
+	// fail for lack of space (as for FALLOC_FL_ZERO_RANGE); without it the
+	// backend may deallocate the range (as for FALLOC_FL_PUNCH_HOLE).
+	WriteZeroes(offset, length int64, flags RequestFlags) error
+}
+
+// FlushContextBackend is an optional interface for backends whose flushes
+// can take long enough to need cancelling, such as a network backend
+// waiting on a remote commit. The queue runner calls FlushContext instead
+// of Flush.
+type FlushContextBackend interface {
+	Backend
+
+	// FlushContext is Flush, giving up once ctx is done. ctx ends when the
+	// device stops and, with DeviceParams.IOTimeout, at the request's
+	// deadline; a call that returns early should return ctx.Err().
+	FlushContext(ctx context.Context) error
+}
+
+// DiscardContextBackend is an optional interface for backends whose
+// discards can take long, such as trims forwarded over the network. The
+// queue runner calls DiscardContext instead of Discard.
+type DiscardContextBackend interface {
+	DiscardBackend
+
+	// DiscardContext is Discard, giving up once ctx is done (see
+	// FlushContextBackend).
+	DiscardContext(ctx context.Context, offset, length int64) error
+}
+
+// WriteZeroesContextBackend is an optional interface for backends whose
+// WRITE_ZEROES calls can take long. The queue runner calls
+// WriteZeroesContext instead of WriteZeroes.
+type WriteZeroesContextBackend interface {
+	WriteZeroesBackend
+
+	// WriteZeroesContext is WriteZeroes, giving up once ctx is done (see
+	// FlushContextBackend).
+	WriteZeroesContext(ctx context.Context, offset, length int64, flags RequestFlags) error
 }
 
 // SyncBackend is an optional interface for fine-grained sync control.
@@ -93,6 +146,140 @@ type ResizeBackend interface {
 	Resize(newSize int64) error
 }
 
+// PreloadBackend is an optional interface for backends that need warming
+// up before they serve I/O at full speed: opening connections, reading
+// superblocks, populating caches. Preload is called once the device's
+// parameters are set and before START_DEV, so the block device only
+// appears once the backend is ready instead of taking a burst of slow I/O
+// right after it is mounted. It is not called again when a paused device
+// resumes.
+type PreloadBackend interface {
+	Backend
+
+	// Preload readies the backend, giving up once ctx is done. The
+	// context is the one the device is created or started with. An error
+	// fails the device's creation or start.
+	Preload(ctx context.Context) error
+}
+
+// Zone describes one zone reported by a ZonedBackend.
+// Start, Length, WritePointer and Capacity are in bytes; Capacity may be
+// left at 0 when the whole zone is usable.
+type Zone = interfaces.Zone
+
+// Zone types and conditions reported in Zone.Type and Zone.Cond.
+// Values match include/uapi/linux/blkzoned.h.
+const (
+	ZoneTypeConventional = uapi.BLK_ZONE_TYPE_CONVENTIONAL
+	ZoneTypeSeqWriteReq  = uapi.BLK_ZONE_TYPE_SEQWRITE_REQ
+	ZoneTypeSeqWritePref = uapi.BLK_ZONE_TYPE_SEQWRITE_PREF
+	ZoneCondNotWP        = uapi.BLK_ZONE_COND_NOT_WP
+	ZoneCondEmpty        = uapi.BLK_ZONE_COND_EMPTY
+	ZoneCondImplicitOpen = uapi.BLK_ZONE_COND_IMP_OPEN
+	ZoneCondExplicitOpen = uapi.BLK_ZONE_COND_EXP_OPEN
+	ZoneCondClosed       = uapi.BLK_ZONE_COND_CLOSED
+	ZoneCondReadOnly     = uapi.BLK_ZONE_COND_READONLY
+	ZoneCondFull         = uapi.BLK_ZONE_COND_FULL
+	ZoneCondOffline      = uapi.BLK_ZONE_COND_OFFLINE
+)
+
+// ZonedBackend is an optional interface for backends that expose a zoned
+// block device. It answers the kernel's REPORT_ZONES requests.
+type ZonedBackend interface {
+	Backend
+
+	// ReportZones returns up to nrZones zones, starting with the zone that
+	// contains offset. Returning fewer zones ends the report early.
+	ReportZones(offset int64, nrZones int) ([]Zone, error)
+}
+
+// VerifyBackend is an optional interface for backends that keep checksums
+// of their data. The background scrubber (DeviceParams.Scrub) calls Verify
+// instead of ReadAt, so latent corruption is found before a reader hits it.
+type VerifyBackend interface {
+	Backend
+
+	// Verify reads len(p) bytes at off into p and checks them against the
+	// stored checksums. A mismatch should return an error wrapping
+	// syscall.EILSEQ.
+	Verify(p []byte, off int64) error
+}
+
+// SnapshotBackend is an optional interface for backends that can take
+// point-in-time snapshots and serve writable clones of them. It is what
+// Device.Snapshot and CloneDevice build on.
+type SnapshotBackend interface {
+	Backend
+
+	// Snapshot records the current contents under name. Device.Snapshot
+	// calls it with I/O quiesced and after Flush, so no request is half
+	// applied.
+	Snapshot(name string) error
+
+	// Clone returns a new backend that starts with the contents of the
+	// named snapshot and is independent of it and of this backend. name
+	// identifies the clone where the backend needs one; if empty, the
+	// backend picks it.
+	Clone(snapshot, name string) (Backend, error)
+}
+
+// ReadAheadBackend is an optional interface for backends that can prefetch,
+// such as network or object-store backends. When a queue sees a sequential
+// read stream it calls ReadAhead with the range the stream is expected to
+// read next, growing the window while the stream continues (up to
+// DeviceParams.MaxReadAhead).
+type ReadAheadBackend interface {
+	Backend
+
+	// ReadAhead hints that [offset, offset+length) will probably be read
+	// soon. It is called on the queue's I/O thread, so it must not block:
+	// start the fetch in the background and return. It may be ignored.
+	ReadAhead(offset, length int64)
+}
+
+// RequestFlags are the kernel's flags on a block request, as passed to a
+// RequestBackend.
+type RequestFlags = interfaces.RequestFlags
+
+// Request flags, matching UBLK_IO_F_* in include/uapi/linux/ublk_cmd.h.
+const (
+	RequestFailFastDev       RequestFlags = uapi.UBLK_IO_F_FAILFAST_DEV
+	RequestFailFastTransport RequestFlags = uapi.UBLK_IO_F_FAILFAST_TRANSPORT
+	RequestFailFastDriver    RequestFlags = uapi.UBLK_IO_F_FAILFAST_DRIVER
+	RequestMeta              RequestFlags = uapi.UBLK_IO_F_META
+	RequestFUA               RequestFlags = uapi.UBLK_IO_F_FUA
+	RequestNoUnmap           RequestFlags = uapi.UBLK_IO_F_NOUNMAP
+	RequestSwap              RequestFlags = uapi.UBLK_IO_F_SWAP
+)
+
+// Request describes the block request behind a RequestBackend call: the
+// queue and tag serving it, its flags and, with DeviceParams.IOTimeout, the
+// deadline the call should give up by.
+type Request = interfaces.Request
+
+// RequestBackend is an optional interface for backends that act on how
+// the kernel flagged a request, for example serving filesystem metadata
+// (Flags.Meta) ahead of bulk data, or not replicating swap traffic
+// (Flags.Swap). The queue runner calls these instead of ReadAt and WriteAt.
+type RequestBackend interface {
+	Backend
+
+	// ReadAtRequest is ReadAt for the read request req.
+	ReadAtRequest(p []byte, off int64, req Request) (n int, err error)
+
+	// WriteAtRequest is WriteAt for the write request req.
+	WriteAtRequest(p []byte, off int64, req Request) (n int, err error)
+}
+
+// BufferAllocator supplies the memory the queues move I/O data through
+// (see Options.BufferAllocator). Alloc must return at least size bytes
+// that stay valid and in place until passed to Free, which may get them
+// resliced to size. Each queue allocates its per-tag buffer region once,
+// DeviceParams.QueueDepth times IOBufferSizePerTag bytes, and requests
+// under DeviceParams.IOTimeout allocate a scratch buffer each, so Alloc
+// should pool. Both methods must be safe for concurrent use.
+type BufferAllocator = interfaces.BufferAllocator
+
 // Logger interface for optional logging.
 type Logger interface {
 	Printf(format string, args ...interface{})
@@ -39,9 +39,52 @@ const (
 	// memory overhead for tracking discard bio segments.
 	DefaultMaxDiscardSegments = 256
 
+	// DefaultMaxWriteZeroesSectors is the default maximum sectors per
+	// WRITE_ZEROES. Like discard, zeroing is cheap for a backend regardless
+	// of size, so the kernel may send requests as large as it likes.
+	DefaultMaxWriteZeroesSectors = 0xffffffff
+
 	// AutoAssignDeviceID is passed to ADD_DEV to let the kernel auto-assign
 	// a device ID. This is the kernel's API contract (-1 means auto-assign).
 	AutoAssignDeviceID = -1
+
+	// MaxDeviceID is the highest device ID the kernel accepts. The driver
+	// allocates IDs from UBLK_MINORS (1 << 20) char device minors.
+	MaxDeviceID = 1<<20 - 1
+
+	// DefaultStallThreshold is how long a request may stay in userspace
+	// (fetched but not yet committed) before a QueueObserver is told the
+	// queue stalled. Healthy backends answer in micro- to milliseconds; a
+	// full second means something is stuck.
+	DefaultStallThreshold = time.Second
+
+	// DefaultDepthSampleInterval is how often each queue reports its tags
+	// in use to the Observer. Ten samples a second track load changes
+	// without costing anything measurable.
+	DefaultDepthSampleInterval = 100 * time.Millisecond
+
+	// DefaultMaxReadAhead caps the window hinted to a ReadAheadBackend for
+	// a sequential read stream. 4MiB keeps a few round trips' worth of data
+	// in flight for object stores without prefetching much that is never
+	// read once the stream ends.
+	DefaultMaxReadAhead = 4 << 20
+
+	// DefaultEventLogSize is how many lifecycle and error events a device
+	// keeps for Device.Events.
+	DefaultEventLogSize = 256
+
+	// RingHeadroom is the number of SQEs a queue ring has beyond one per tag
+	// and the command wakeup poll, so a burst of extra submissions does not
+	// fill it.
+	RingHeadroom = 8
+
+	// RingFullRetries bounds how often a queue loop flushes and retries
+	// commits that found the submission ring full before it gives up.
+	RingFullRetries = 10
+
+	// RingFullBackoff is the initial pause between those retries. It doubles
+	// on every attempt.
+	RingFullBackoff = 10 * time.Microsecond
 )
 
 // Timing constants for device lifecycle
@@ -74,11 +117,42 @@ const (
 	// sufficient; shorter delays risk START_DEV timeout on loaded systems.
 	QueueInitDelay = 100 * time.Millisecond
 
-	// CharDeviceOpenRetries is the number of times to retry opening the
-	// character device before giving up. With a 100ms sleep between retries,
-	// 50 retries = 5 seconds total timeout, which accounts for slow udev
-	// processing on heavily loaded systems.
-	CharDeviceOpenRetries = 50
+	// DeviceNodeTimeout bounds the wait for udev to create the character
+	// device after ADD_DEV. Nodes usually appear in well under 100ms; 5s
+	// accounts for slow udev processing on heavily loaded systems.
+	DeviceNodeTimeout = 5 * time.Second
+
+	// ControlTimeout bounds each control command. Commands normally
+	// complete in milliseconds; a kernel that sits on one longer than
+	// this is stuck on it.
+	ControlTimeout = 30 * time.Second
+
+	// QuiesceTimeout bounds how long pausing a recovery-enabled device
+	// waits for the kernel to quiesce it after its queues are released.
+	QuiesceTimeout = 5 * time.Second
+
+	// IOTimeoutSlack is how much longer than DeviceParams.IOTimeout the
+	// block layer waits for a request, so the backend deadline always
+	// fires first and the request fails with the backend's error.
+	IOTimeoutSlack = time.Second
+
+	// QueueRestartLimit and QueueRestartWindow bound automatic queue
+	// restarts (DeviceParams.AutoRestart): a device whose queues fail more
+	// than 3 times in a minute has a problem restarting will not fix.
+	QueueRestartLimit  = 3
+	QueueRestartWindow = time.Minute
+
+	// StopTimeout bounds how long stopping a device waits for its queues
+	// to finish the requests they are serving. Past it, requests still in
+	// the backend are failed with EIO; StopAbortGrace is how long the
+	// queues then get to exit before the stop gives up on them.
+	StopTimeout    = 10 * time.Second
+	StopAbortGrace = time.Second
+
+	// FlushOnStopTimeout bounds the final backend flush when a device stops.
+	// It is generous because a backend may have a large write cache to
+	// push out, but keeps a hung backend from blocking shutdown forever.
+	FlushOnStopTimeout = 30 * time.Second
 )
 
 // Memory allocation constants
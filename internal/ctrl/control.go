@@ -1,13 +1,19 @@
 package ctrl
 
 import (
+	"cmp"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
 	"github.com/ehrlich-b/go-ublk/internal/logging"
 	"github.com/ehrlich-b/go-ublk/internal/uapi"
 	"github.com/ehrlich-b/go-ublk/internal/uring"
@@ -17,14 +23,58 @@ const (
 	UblkControlPath = "/dev/ublk-control"
 )
 
+// Block layer defaults for the segment limits a device leaves unset
+// (BLK_SEG_BOUNDARY_MASK, BLK_MAX_SEGMENT_SIZE, BLK_MAX_SEGMENTS)
+const (
+	defaultSegBoundaryMask = 0xffffffff
+	defaultMaxSegmentSize  = 65536
+	defaultMaxSegments     = 128
+)
+
+// Controller issues ublk control commands over one /dev/ublk-control fd.
+// It is safe for concurrent use: commands are serialized on its ring, so
+// several devices can be added or removed from different goroutines.
 type Controller struct {
+	*channel
+	timeout time.Duration // Bound on each command (0 = none); see WithTimeout
+	logger  *logging.Logger
+}
+
+// channel is the control fd and ring a Controller shares with the copies
+// WithTimeout makes of it.
+type channel struct {
 	controlFd int
 	ring      uring.Ring
-	logger    *logging.Logger
+	mu        sync.Mutex // serializes commands on ring
+
+	// Guarded by mu. Once a command times out, its completion may still
+	// arrive, so every later command is matched by its own userData, and
+	// the buffer the kernel may yet write stays referenced.
+	seq   uint64
+	async bool
+	stuck [][]byte
+}
+
+// TimeoutError reports a control command the kernel did not complete
+// within the Controller's timeout. The command may still complete later.
+// It unwraps to syscall.ETIMEDOUT.
+type TimeoutError struct {
+	Op      string // The command, e.g. "START_DEV"
+	DevID   uint32
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("no completion from the kernel within %v", e.Timeout)
+}
+
+// Unwrap returns syscall.ETIMEDOUT.
+func (e *TimeoutError) Unwrap() error {
+	return syscall.ETIMEDOUT
 }
 
 func NewController() (*Controller, error) {
-	fd, err := syscall.Open(UblkControlPath, syscall.O_RDWR, 0)
+	fd, err := openFd(UblkControlPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open %s: %v", UblkControlPath, err)
 	}
@@ -37,27 +87,74 @@ func NewController() (*Controller, error) {
 
 	ring, err := uring.NewRing(config)
 	if err != nil {
-		syscall.Close(fd)
+		closeFd(fd)
 		return nil, fmt.Errorf("failed to create io_uring: %v", err)
 	}
 
 	return &Controller{
-		controlFd: fd,
-		ring:      ring,
-		logger:    logging.Default(),
+		channel: &channel{controlFd: fd, ring: ring},
+		logger:  logging.For(logging.ComponentCtrl),
 	}, nil
 }
 
+// WithTimeout returns a Controller on the same channel whose commands
+// fail with a *TimeoutError if the kernel has not completed them within
+// timeout, instead of waiting forever (0 waits forever). Closing either
+// closes both.
+func (c *Controller) WithTimeout(timeout time.Duration) *Controller {
+	view := *c
+	view.timeout = timeout
+	return &view
+}
+
 func (c *Controller) Close() error {
 	if c.ring != nil {
 		c.ring.Close()
 	}
 	if c.controlFd >= 0 {
-		return syscall.Close(c.controlFd)
+		return closeFd(c.controlFd)
 	}
 	return nil
 }
 
+// resultError converts a negative control command result into an error
+// wrapping its errno, so callers can test for e.g. syscall.EEXIST. Its
+// message names the errno and what it means for op.
+func resultError(op string, result int32) error {
+	return uring.NewResultError(op, result)
+}
+
+// submit issues the control command name and waits for its completion,
+// for at most c.timeout if it is set. buf is the memory cmd.Addr points
+// at, if any, which is kept alive if the command times out.
+func (c *Controller) submit(name string, op uint32, cmd *uapi.UblksrvCtrlCmd, buf []byte) (uring.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timeout <= 0 && !c.async {
+		return c.ring.SubmitCtrlCmd(op, cmd, 0)
+	}
+
+	c.seq++
+	handle, err := c.ring.SubmitCtrlCmdAsync(op, cmd, c.seq)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.timeout
+	if timeout <= 0 {
+		timeout = math.MaxInt64
+	}
+	result, err := handle.Wait(timeout)
+	if err != nil {
+		c.async = true
+		if buf != nil {
+			c.stuck = append(c.stuck, buf)
+		}
+		c.logger.Warn("control command timed out", "op", name, "dev_id", cmd.DevID, "timeout", timeout)
+		return nil, &TimeoutError{Op: name, DevID: cmd.DevID, Timeout: timeout}
+	}
+	return result, nil
+}
+
 func (c *Controller) AddDevice(params *DeviceParams) (uint32, error) {
 	// Auto-detect number of queues if not specified
 	numQueues := params.NumQueues
@@ -111,16 +208,16 @@ func (c *Controller) AddDevice(params *DeviceParams) (uint32, error) {
 	c.logger.Debug("device info buffer", "size", len(deviceInfoBytes), "data", fmt.Sprintf("%x", deviceInfoBytes))
 
 	// Use ioctl encoding - required by modern kernels (6.11+)
-	op := uapi.UblkCtrlCmd(uapi.UBLK_CMD_ADD_DEV)
-	result, err := c.ring.SubmitCtrlCmd(op, cmd, 0)
+	op := uapi.UBLK_U_CMD_ADD_DEV
+	result, err := c.submit("ADD_DEV", op, cmd, deviceInfoBytes)
 	if err != nil {
-		return 0, fmt.Errorf("ADD_DEV submit failed: %v", err)
+		return 0, fmt.Errorf("ADD_DEV submit failed: %w", err)
 	}
 
 	c.logger.Info("ADD_DEV completed", "result", result.Value())
 
 	if result.Value() < 0 {
-		return 0, fmt.Errorf("ADD_DEV failed with error: %d", result.Value())
+		return 0, resultError("ADD_DEV", result.Value())
 	}
 
 	// Ensure device info buffer stays alive until after kernel copies it
@@ -128,6 +225,20 @@ func (c *Controller) AddDevice(params *DeviceParams) (uint32, error) {
 
 	info := uapi.UnmarshalCtrlDevInfo(deviceInfoBytes)
 	c.logger.Info("device created", "dev_id", info.DevID)
+
+	// The kernel caps the queues at its CPU count and reports the count it
+	// kept; serve that many
+	if info.NrHwQueues > 0 && int(info.NrHwQueues) < numQueues {
+		c.logger.Warn("kernel reduced the queue count", "requested", numQueues, "queues", info.NrHwQueues)
+		params.NumQueues = int(info.NrHwQueues)
+	}
+
+	// The kernel clears flags it does not know instead of failing, and
+	// would scan the device anyway
+	if params.NoPartitionScan && info.Flags&uapi.UBLK_F_NO_AUTO_PART_SCAN == 0 {
+		_ = c.DeleteDevice(info.DevID) // Cleanup, ignore error
+		return 0, fmt.Errorf("ADD_DEV: kernel cannot skip the partition scan: %w", syscall.EOPNOTSUPP)
+	}
 	return info.DevID, nil
 }
 
@@ -137,28 +248,12 @@ func (c *Controller) SetParams(deviceID uint32, params *DeviceParams) error {
 		"max_io", params.MaxIOSize,
 		"backend_size", params.Backend.Size())
 
-	ublkParams := &uapi.UblkParams{
-		Types: uapi.UBLK_PARAM_TYPE_BASIC,
-		Basic: uapi.UblkParamBasic{
-			Attrs:            0,
-			LogicalBSShift:   uint8(sizeToShift(params.LogicalBlockSize)),
-			PhysicalBSShift:  uint8(sizeToShift(params.LogicalBlockSize)),
-			IOOptShift:       0,
-			IOMinShift:       uint8(sizeToShift(params.LogicalBlockSize)),
-			MaxSectors:       uint32(params.MaxIOSize / params.LogicalBlockSize),
-			ChunkSectors:     0,
-			DevSectors:       uint64(params.Backend.Size() / int64(params.LogicalBlockSize)),
-			VirtBoundaryMask: 0,
-		},
-	}
-
+	ublkParams := buildParams(params)
 	c.logger.Debug("calculated basic parameters",
 		"logical_bs_shift", ublkParams.Basic.LogicalBSShift,
 		"max_sectors", ublkParams.Basic.MaxSectors,
 		"dev_sectors", ublkParams.Basic.DevSectors)
 
-	// TODO: Add discard parameters if backend supports it
-
 	// Marshal params - the Len field is set automatically by the marshal function
 	buf := uapi.Marshal(ublkParams)
 
@@ -167,7 +262,7 @@ func (c *Controller) SetParams(deviceID uint32, params *DeviceParams) error {
 		padded := make([]byte, 128)
 		copy(padded, buf)
 		buf = padded
-		binary.LittleEndian.PutUint32(buf[0:4], 128)
+		binary.NativeEndian.PutUint32(buf[0:4], 128)
 		c.logger.Debug("padded parameter buffer", "size", 128)
 	}
 
@@ -187,18 +282,141 @@ func (c *Controller) SetParams(deviceID uint32, params *DeviceParams) error {
 		Reserved:   0,
 	}
 
-	op := uapi.UblkCtrlCmd(uapi.UBLK_CMD_SET_PARAMS)
-	result, err := c.ring.SubmitCtrlCmd(op, cmd, 0)
+	op := uapi.UBLK_U_CMD_SET_PARAMS
+	result, err := c.submit("SET_PARAMS", op, cmd, buf)
 	if err != nil {
-		return fmt.Errorf("SET_PARAMS failed: %v", err)
+		return fmt.Errorf("SET_PARAMS failed: %w", err)
 	}
 
 	c.logger.Info("SET_PARAMS completed", "result", result.Value())
 
 	if result.Value() < 0 {
-		return fmt.Errorf("SET_PARAMS failed with error: %d", result.Value())
+		return resultError("SET_PARAMS", result.Value())
+	}
+
+	// The kernel may accept parameters it does not fully honor, e.g. drop
+	// a type it does not know, so read them back
+	applied, err := c.GetParams(deviceID)
+	if err != nil {
+		return fmt.Errorf("reading back parameters: %w", err)
+	}
+	return verifyParams(ublkParams, applied)
+}
+
+// buildParams translates params into the parameters SET_PARAMS sends.
+func buildParams(params *DeviceParams) *uapi.UblkParams {
+	physicalBlockSize := max(params.PhysicalBlockSize, params.LogicalBlockSize)
+
+	ublkParams := &uapi.UblkParams{
+		Types: uapi.UBLK_PARAM_TYPE_BASIC,
+		Basic: uapi.UblkParamBasic{
+			Attrs:            0,
+			LogicalBSShift:   uint8(sizeToShift(params.LogicalBlockSize)),
+			PhysicalBSShift:  uint8(sizeToShift(physicalBlockSize)),
+			IOOptShift:       0,
+			IOMinShift:       uint8(sizeToShift(physicalBlockSize)),
+			MaxSectors:       uint32(params.MaxIOSize >> 9), // 512-byte sectors, whatever the block size
+			ChunkSectors:     0,
+			DevSectors:       uint64(params.Backend.Size() >> 9), // 512-byte sectors too
+			VirtBoundaryMask: params.VirtBoundaryMask,
+		},
+	}
+
+	if params.ReadOnly {
+		ublkParams.Basic.Attrs |= uapi.UBLK_ATTR_READ_ONLY
+	}
+	if params.Rotational {
+		ublkParams.Basic.Attrs |= uapi.UBLK_ATTR_ROTATIONAL
+	}
+	if params.VolatileCache {
+		ublkParams.Basic.Attrs |= uapi.UBLK_ATTR_VOLATILE_CACHE
+	}
+	if params.EnableFUA {
+		ublkParams.Basic.Attrs |= uapi.UBLK_ATTR_FUA
+	}
+
+	// Advertise discard and write zeroes only when the backend can service
+	// them; both live in the discard parameters
+	_, discard := params.Backend.(interfaces.DiscardBackend)
+	discard = discard && params.MaxDiscardSectors > 0
+	_, writeZeroes := params.Backend.(interfaces.WriteZeroesBackend)
+	writeZeroes = writeZeroes && params.MaxWriteZeroesSectors > 0
+	if discard || writeZeroes {
+		ublkParams.SetDiscard()
+		ublkParams.Discard.DiscardGranularity = max(params.DiscardGranularity, uint32(params.LogicalBlockSize))
+	}
+	if discard {
+		ublkParams.Discard.DiscardAlignment = params.DiscardAlignment
+		ublkParams.Discard.MaxDiscardSectors = params.MaxDiscardSectors
+		// The driver only supports single-segment discards and rejects
+		// SET_PARAMS with any other value
+		ublkParams.Discard.MaxDiscardSegments = 1
+	}
+	if writeZeroes {
+		ublkParams.Discard.MaxWriteZeroesSectors = params.MaxWriteZeroesSectors
+	}
+
+	// The kernel leaves segment limits undefined if any is 0, so fill the
+	// ones not set with the block layer defaults
+	if params.MaxSegments > 0 || params.MaxSegmentSize > 0 || params.SegmentBoundaryMask > 0 {
+		ublkParams.SetSegment()
+		ublkParams.Seg = uapi.UblkParamSegment{
+			SegBoundaryMask: cmp.Or(params.SegmentBoundaryMask, defaultSegBoundaryMask),
+			MaxSegmentSize:  cmp.Or(params.MaxSegmentSize, defaultMaxSegmentSize),
+			MaxSegments:     cmp.Or(params.MaxSegments, defaultMaxSegments),
+		}
+		// A virt boundary makes the block layer require unlimited segments
+		if params.VirtBoundaryMask != 0 {
+			ublkParams.Seg.MaxSegmentSize = math.MaxUint32
+		}
 	}
 
+	return ublkParams
+}
+
+// verifyParams checks that the parameters the kernel applied match those
+// set, for every type set, and describes each difference.
+func verifyParams(set, applied *uapi.UblkParams) error {
+	var diffs []string
+	diff := func(name string, got, want any) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s %v, want %v", name, got, want))
+		}
+	}
+
+	if missing := set.Types &^ applied.Types; missing != 0 {
+		diffs = append(diffs, fmt.Sprintf("parameter types %#x dropped", missing))
+	}
+	if set.HasBasic() && applied.HasBasic() {
+		want, got := set.Basic, applied.Basic
+		diff("attrs", got.Attrs, want.Attrs)
+		diff("logical_bs_shift", got.LogicalBSShift, want.LogicalBSShift)
+		diff("physical_bs_shift", got.PhysicalBSShift, want.PhysicalBSShift)
+		diff("io_opt_shift", got.IOOptShift, want.IOOptShift)
+		diff("io_min_shift", got.IOMinShift, want.IOMinShift)
+		diff("max_sectors", got.MaxSectors, want.MaxSectors)
+		diff("chunk_sectors", got.ChunkSectors, want.ChunkSectors)
+		diff("dev_sectors", got.DevSectors, want.DevSectors)
+		diff("virt_boundary_mask", got.VirtBoundaryMask, want.VirtBoundaryMask)
+	}
+	if set.HasDiscard() && applied.HasDiscard() {
+		want, got := set.Discard, applied.Discard
+		diff("discard_alignment", got.DiscardAlignment, want.DiscardAlignment)
+		diff("discard_granularity", got.DiscardGranularity, want.DiscardGranularity)
+		diff("max_discard_sectors", got.MaxDiscardSectors, want.MaxDiscardSectors)
+		diff("max_write_zeroes_sectors", got.MaxWriteZeroesSectors, want.MaxWriteZeroesSectors)
+		diff("max_discard_segments", got.MaxDiscardSegments, want.MaxDiscardSegments)
+	}
+	if set.HasSegment() && applied.HasSegment() {
+		want, got := set.Seg, applied.Seg
+		diff("seg_boundary_mask", got.SegBoundaryMask, want.SegBoundaryMask)
+		diff("max_segment_size", got.MaxSegmentSize, want.MaxSegmentSize)
+		diff("max_segments", got.MaxSegments, want.MaxSegments)
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("kernel did not apply the device parameters as set: %s", strings.Join(diffs, "; "))
+	}
 	return nil
 }
 
@@ -214,16 +432,16 @@ func (c *Controller) StartDevice(deviceID uint32) error {
 		Pad:        0,
 		Reserved:   0,
 	}
-	op := uapi.UblkCtrlCmd(uapi.UBLK_CMD_START_DEV)
-	result, err := c.ring.SubmitCtrlCmd(op, cmd, 0)
+	op := uapi.UBLK_U_CMD_START_DEV
+	result, err := c.submit("START_DEV", op, cmd, nil)
 	if err != nil {
-		return fmt.Errorf("START_DEV failed: %v", err)
+		return fmt.Errorf("START_DEV failed: %w", err)
 	}
 
-	c.logger.Info("START_DEV completed", "result", result.Value())
+	c.logger.Info("START_DEV completed", "dev_id", deviceID, "result", result.Value())
 
 	if result.Value() < 0 {
-		return fmt.Errorf("START_DEV failed with error: %d", result.Value())
+		return resultError("START_DEV", result.Value())
 	}
 
 	return nil
@@ -240,14 +458,80 @@ func (c *Controller) StopDevice(deviceID uint32) error {
 		Pad:        0,
 		Reserved:   0,
 	}
-	op := uapi.UblkCtrlCmd(uapi.UBLK_CMD_STOP_DEV)
-	result, err := c.ring.SubmitCtrlCmd(op, cmd, 0)
+	op := uapi.UBLK_U_CMD_STOP_DEV
+	result, err := c.submit("STOP_DEV", op, cmd, nil)
+	if err != nil {
+		return fmt.Errorf("STOP_DEV failed: %w", err)
+	}
+
+	if result.Value() < 0 {
+		return resultError("STOP_DEV", result.Value())
+	}
+
+	return nil
+}
+
+// StartUserRecovery begins recovering a quiesced device so a new set of
+// queues can be attached. The device must have been added with
+// EnableRecovery and must be in the UBLK_S_DEV_QUIESCED state.
+func (c *Controller) StartUserRecovery(deviceID uint32) error {
+	cmd := &uapi.UblksrvCtrlCmd{
+		DevID:   deviceID,
+		QueueID: 0xFFFF,
+	}
+	result, err := c.submit("START_USER_RECOVERY", uapi.UBLK_U_CMD_START_USER_RECOVERY, cmd, nil)
 	if err != nil {
-		return fmt.Errorf("STOP_DEV failed: %v", err)
+		return fmt.Errorf("START_USER_RECOVERY failed: %w", err)
 	}
 
 	if result.Value() < 0 {
-		return fmt.Errorf("STOP_DEV failed with error: %d", result.Value())
+		return resultError("START_USER_RECOVERY", result.Value())
+	}
+
+	return nil
+}
+
+// EndUserRecovery completes recovery once every queue has fetch requests
+// in place again, and puts the device back in the UBLK_S_DEV_LIVE state.
+func (c *Controller) EndUserRecovery(deviceID uint32) error {
+	c.logger.Debug("ending user recovery", "dev_id", deviceID)
+	cmd := &uapi.UblksrvCtrlCmd{
+		DevID:   deviceID,
+		QueueID: 0xFFFF,
+		Data:    uint64(os.Getpid()),
+	}
+	result, err := c.submit("END_USER_RECOVERY", uapi.UBLK_U_CMD_END_USER_RECOVERY, cmd, nil)
+	if err != nil {
+		return fmt.Errorf("END_USER_RECOVERY failed: %w", err)
+	}
+
+	c.logger.Info("END_USER_RECOVERY completed", "dev_id", deviceID, "result", result.Value())
+
+	if result.Value() < 0 {
+		return resultError("END_USER_RECOVERY", result.Value())
+	}
+
+	return nil
+}
+
+// UpdateSize sets the capacity of a live device to sectors 512-byte
+// sectors and tells the block layer, which resizes the block node and
+// sends a change uevent. The device must have been added with
+// EnableResize.
+func (c *Controller) UpdateSize(deviceID uint32, sectors uint64) error {
+	c.logger.Debug("updating device size", "dev_id", deviceID, "dev_sectors", sectors)
+	cmd := &uapi.UblksrvCtrlCmd{
+		DevID:   deviceID,
+		QueueID: 0xFFFF,
+		Data:    sectors,
+	}
+	result, err := c.submit("UPDATE_SIZE", uapi.UBLK_U_CMD_UPDATE_SIZE, cmd, nil)
+	if err != nil {
+		return fmt.Errorf("UPDATE_SIZE failed: %w", err)
+	}
+
+	if result.Value() < 0 {
+		return resultError("UPDATE_SIZE", result.Value())
 	}
 
 	return nil
@@ -264,14 +548,35 @@ func (c *Controller) DeleteDevice(deviceID uint32) error {
 		Pad:        0,
 		Reserved:   0,
 	}
-	op := uapi.UblkCtrlCmd(uapi.UBLK_CMD_DEL_DEV)
-	result, err := c.ring.SubmitCtrlCmd(op, cmd, 0)
+	op := uapi.UBLK_U_CMD_DEL_DEV
+	result, err := c.submit("DEL_DEV", op, cmd, nil)
 	if err != nil {
-		return fmt.Errorf("DEL_DEV failed: %v", err)
+		return fmt.Errorf("DEL_DEV failed: %w", err)
 	}
 
 	if result.Value() < 0 {
-		return fmt.Errorf("DEL_DEV failed with error: %d", result.Value())
+		return resultError("DEL_DEV", result.Value())
+	}
+
+	return nil
+}
+
+// DeleteDeviceAsync removes the device like DeleteDevice but returns
+// without waiting for its char device to be released, so it does not hang
+// on a server that never closes it. It needs Linux 6.9 or later; older
+// kernels reject the command.
+func (c *Controller) DeleteDeviceAsync(deviceID uint32) error {
+	cmd := &uapi.UblksrvCtrlCmd{
+		DevID:   deviceID,
+		QueueID: 0xFFFF,
+	}
+	result, err := c.submit("DEL_DEV_ASYNC", uapi.UBLK_U_CMD_DEL_DEV_ASYNC, cmd, nil)
+	if err != nil {
+		return fmt.Errorf("DEL_DEV_ASYNC failed: %w", err)
+	}
+
+	if result.Value() < 0 {
+		return resultError("DEL_DEV_ASYNC", result.Value())
 	}
 
 	return nil
@@ -291,14 +596,14 @@ func (c *Controller) GetDeviceInfo(deviceID uint32) (*uapi.UblksrvCtrlDevInfo, e
 		Reserved:   0,
 	}
 
-	op := uapi.UblkCtrlCmd(uapi.UBLK_CMD_GET_DEV_INFO)
-	result, err := c.ring.SubmitCtrlCmd(op, cmd, 0)
+	op := uapi.UBLK_U_CMD_GET_DEV_INFO
+	result, err := c.submit("GET_DEV_INFO", op, cmd, buf)
 	if err != nil {
-		return nil, fmt.Errorf("GET_DEV_INFO failed: %v", err)
+		return nil, fmt.Errorf("GET_DEV_INFO failed: %w", err)
 	}
 
 	if result.Value() < 0 {
-		return nil, fmt.Errorf("GET_DEV_INFO failed with error: %d", result.Value())
+		return nil, resultError("GET_DEV_INFO", result.Value())
 	}
 
 	devInfo := uapi.UnmarshalCtrlDevInfo(buf)
@@ -307,8 +612,9 @@ func (c *Controller) GetDeviceInfo(deviceID uint32) (*uapi.UblksrvCtrlDevInfo, e
 
 // GetParams retrieves current device parameters (including devt majors/minors when available)
 func (c *Controller) GetParams(deviceID uint32) (*uapi.UblkParams, error) {
-	// Allocate a buffer big enough for common parameter sets (basic + devt)
-	buf := make([]byte, 128)
+	// The kernel copies at most the length in the buffer's header
+	buf := make([]byte, uapi.UblkParamsSize)
+	binary.NativeEndian.PutUint32(buf[0:4], uint32(len(buf)))
 
 	cmd := &uapi.UblksrvCtrlCmd{
 		DevID:      deviceID,
@@ -321,17 +627,17 @@ func (c *Controller) GetParams(deviceID uint32) (*uapi.UblkParams, error) {
 		Reserved:   0,
 	}
 
-	op := uapi.UblkCtrlCmd(uapi.UBLK_CMD_GET_PARAMS)
-	result, err := c.ring.SubmitCtrlCmd(op, cmd, 0)
+	op := uapi.UBLK_U_CMD_GET_PARAMS
+	result, err := c.submit("GET_PARAMS", op, cmd, buf)
 	if err != nil {
-		return nil, fmt.Errorf("GET_PARAMS failed: %v", err)
+		return nil, fmt.Errorf("GET_PARAMS failed: %w", err)
 	}
 	if result.Value() < 0 {
-		return nil, fmt.Errorf("GET_PARAMS failed with error: %d", result.Value())
+		return nil, resultError("GET_PARAMS", result.Value())
 	}
 	params := &uapi.UblkParams{}
 	if err := uapi.Unmarshal(buf, params); err != nil {
-		params.Len = uint32(len(buf))
+		return nil, fmt.Errorf("GET_PARAMS returned malformed parameters: %w", err)
 	}
 	return params, nil
 }
@@ -360,6 +666,20 @@ func (c *Controller) buildFeatureFlags(params *DeviceParams) uint64 {
 		flags |= uapi.UBLK_F_CMD_IOCTL_ENCODE
 	}
 
+	// Reissue requests that were in flight when the queues went away, so a
+	// pause cannot drop writes the old queues had not committed
+	if params.EnableRecovery {
+		flags |= uapi.UBLK_F_USER_RECOVERY | uapi.UBLK_F_USER_RECOVERY_REISSUE
+	}
+
+	if params.NoPartitionScan {
+		flags |= uapi.UBLK_F_NO_AUTO_PART_SCAN
+	}
+
+	if params.EnableResize {
+		flags |= uapi.UBLK_F_UPDATE_SIZE
+	}
+
 	return flags
 }
 
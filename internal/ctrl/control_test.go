@@ -0,0 +1,194 @@
+package ctrl
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+func TestVerifyParams(t *testing.T) {
+	set := &uapi.UblkParams{
+		Types: uapi.UBLK_PARAM_TYPE_BASIC,
+		Basic: uapi.UblkParamBasic{LogicalBSShift: 12, PhysicalBSShift: 12, MaxSectors: 2048, DevSectors: 1 << 20},
+	}
+	set.SetDiscard()
+	set.Discard = uapi.UblkParamDiscard{DiscardGranularity: 4096, MaxDiscardSectors: 1 << 16, MaxDiscardSegments: 1}
+
+	applied := *set
+	applied.Types |= uapi.UBLK_PARAM_TYPE_DEVT // Added by GET_PARAMS
+	if err := verifyParams(set, &applied); err != nil {
+		t.Errorf("parameters applied as set: %v", err)
+	}
+
+	clamped := applied
+	clamped.Basic.MaxSectors = 1024
+	err := verifyParams(set, &clamped)
+	if err == nil || !strings.Contains(err.Error(), "max_sectors 1024, want 2048") {
+		t.Errorf("clamped max_sectors: %v", err)
+	}
+
+	dropped := applied
+	dropped.Types &^= uapi.UBLK_PARAM_TYPE_DISCARD
+	if err := verifyParams(set, &dropped); err == nil || !strings.Contains(err.Error(), "dropped") {
+		t.Errorf("dropped discard parameters: %v", err)
+	}
+}
+
+func TestBuildFeatureFlags(t *testing.T) {
+	c := &Controller{}
+	params := DefaultDeviceParams(nil)
+	if flags := c.buildFeatureFlags(&params); flags&uapi.UBLK_F_NO_AUTO_PART_SCAN != 0 {
+		t.Errorf("flags %#x skip the partition scan by default", flags)
+	}
+	params.NoPartitionScan = true
+	if flags := c.buildFeatureFlags(&params); flags&uapi.UBLK_F_NO_AUTO_PART_SCAN == 0 {
+		t.Errorf("flags %#x scan partitions with NoPartitionScan", flags)
+	}
+	params.EnableResize = true
+	if flags := c.buildFeatureFlags(&params); flags&uapi.UBLK_F_UPDATE_SIZE == 0 {
+		t.Errorf("flags %#x cannot update the size with EnableResize", flags)
+	}
+}
+
+func TestBuildParamsDevSectors(t *testing.T) {
+	// dev_sectors and max_sectors count 512-byte sectors for every logical
+	// block size
+	for _, bs := range []int{512, 4096} {
+		params := DefaultDeviceParams(sizedBackend(1 << 30))
+		params.LogicalBlockSize = bs
+		params.MaxIOSize = 512 << 10
+		basic := buildParams(&params).Basic
+		if basic.DevSectors != 1<<21 {
+			t.Errorf("%d-byte blocks: dev_sectors = %d, want %d", bs, basic.DevSectors, 1<<21)
+		}
+		if basic.MaxSectors != 1024 {
+			t.Errorf("%d-byte blocks: max_sectors = %d, want 1024", bs, basic.MaxSectors)
+		}
+	}
+}
+
+func TestBuildParamsAttrs(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*DeviceParams)
+		want   uint32
+	}{
+		{"none", func(*DeviceParams) {}, 0},
+		{"read-only", func(p *DeviceParams) { p.ReadOnly = true }, uapi.UBLK_ATTR_READ_ONLY},
+		{"rotational", func(p *DeviceParams) { p.Rotational = true }, uapi.UBLK_ATTR_ROTATIONAL},
+		{"write-back cache with FUA", func(p *DeviceParams) { p.VolatileCache, p.EnableFUA = true, true },
+			uapi.UBLK_ATTR_VOLATILE_CACHE | uapi.UBLK_ATTR_FUA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := DefaultDeviceParams(sizedBackend(1 << 20))
+			params.MaxIOSize = 1 << 20
+			tt.modify(&params)
+			if got := buildParams(&params).Basic.Attrs; got != tt.want {
+				t.Errorf("attrs = %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+}
+
+// sizedBackend is a backend that only reports its size
+type sizedBackend int64
+
+func (b sizedBackend) ReadAt(p []byte, off int64) (int, error)  { return len(p), nil }
+func (b sizedBackend) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+func (b sizedBackend) Size() int64                              { return int64(b) }
+func (b sizedBackend) Close() error                             { return nil }
+func (b sizedBackend) Flush() error                             { return nil }
+
+// ctrlRing answers control commands: submitted ones at once, and
+// asynchronous ones once their userData is in completed. ADD_DEV replies
+// with kernelQueues hardware queues, if set, as a kernel with fewer CPUs.
+type ctrlRing struct {
+	uring.Ring
+	sync         int
+	completed    map[uint64]bool
+	submitted    []uint64
+	kernelQueues uint16
+}
+
+type ctrlResult struct{ userData uint64 }
+
+func (r ctrlResult) UserData() uint64 { return r.userData }
+func (r ctrlResult) Value() int32     { return 0 }
+func (r ctrlResult) Error() error     { return nil }
+
+func (f *ctrlRing) SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (uring.Result, error) {
+	f.sync++
+	if cmd == uapi.UBLK_U_CMD_ADD_DEV && f.kernelQueues > 0 {
+		// The kernel writes the device info back to the command's buffer
+		info := (*uapi.UblksrvCtrlDevInfo)(*(*unsafe.Pointer)(unsafe.Pointer(&ctrlCmd.Addr)))
+		info.NrHwQueues = f.kernelQueues
+	}
+	return ctrlResult{userData}, nil
+}
+
+func (f *ctrlRing) SubmitCtrlCmdAsync(
+	cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64,
+) (*uring.AsyncHandle, error) {
+	f.submitted = append(f.submitted, userData)
+	return uring.NewAsyncHandle(func() (uring.Result, error) {
+		if !f.completed[userData] {
+			return nil, errors.New("not completed")
+		}
+		return ctrlResult{userData}, nil
+	}), nil
+}
+
+func TestControllerTimeout(t *testing.T) {
+	ring := &ctrlRing{completed: map[uint64]bool{}}
+	c := &Controller{channel: &channel{controlFd: -1, ring: ring}, logger: logging.For(logging.ComponentCtrl)}
+
+	if err := c.StartDevice(3); err != nil || ring.sync != 1 {
+		t.Fatalf("StartDevice without a timeout = %v after %d waits, want a plain wait", err, ring.sync)
+	}
+
+	bounded := c.WithTimeout(20 * time.Millisecond)
+	err := bounded.StartDevice(3)
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || timeout.Op != "START_DEV" || timeout.DevID != 3 || !errors.Is(err, syscall.ETIMEDOUT) {
+		t.Fatalf("stuck START_DEV = %v, want a TimeoutError naming it", err)
+	}
+
+	// The stuck command may still complete, so even the unbounded
+	// controller now waits for its own userData
+	ring.completed[2] = true
+	if err := c.StopDevice(3); err != nil {
+		t.Fatalf("StopDevice after a timeout = %v", err)
+	}
+	if ring.sync != 1 || !slices.Equal(ring.submitted, []uint64{1, 2}) {
+		t.Errorf("commands after a timeout: %d plain waits, userData %v; want none and [1 2]", ring.sync, ring.submitted)
+	}
+}
+
+func TestAddDeviceKernelQueues(t *testing.T) {
+	ring := &ctrlRing{kernelQueues: 4}
+	c := &Controller{channel: &channel{controlFd: -1, ring: ring}, logger: logging.For(logging.ComponentCtrl)}
+
+	// More queues than the kernel's CPUs: serve the count it kept
+	params := DefaultDeviceParams(sizedBackend(1 << 20))
+	params.NumQueues = 16
+	if _, err := c.AddDevice(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.NumQueues != 4 {
+		t.Errorf("NumQueues = %d after ADD_DEV kept 4", params.NumQueues)
+	}
+
+	params.NumQueues = 2
+	if _, err := c.AddDevice(&params); err != nil || params.NumQueues != 2 {
+		t.Errorf("NumQueues = %d, %v; want 2 kept", params.NumQueues, err)
+	}
+}
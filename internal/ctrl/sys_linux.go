@@ -0,0 +1,12 @@
+package ctrl
+
+import "syscall"
+
+// openFd opens the control device read-write.
+func openFd(path string) (int, error) {
+	return syscall.Open(path, syscall.O_RDWR, 0)
+}
+
+func closeFd(fd int) error {
+	return syscall.Close(fd)
+}
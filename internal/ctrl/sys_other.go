@@ -0,0 +1,14 @@
+//go:build !linux
+
+package ctrl
+
+import "syscall"
+
+// openFd fails with ENOSYS: there is no control device off Linux.
+func openFd(path string) (int, error) {
+	return -1, syscall.ENOSYS
+}
+
+func closeFd(fd int) error {
+	return nil
+}
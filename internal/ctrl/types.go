@@ -5,17 +5,21 @@ import "github.com/ehrlich-b/go-ublk/internal/interfaces"
 type DeviceParams struct {
 	Backend interfaces.Backend
 
-	DeviceID         int32
-	QueueDepth       int
-	NumQueues        int
-	LogicalBlockSize int
-	MaxIOSize        int
+	DeviceID          int32
+	QueueDepth        int
+	NumQueues         int
+	LogicalBlockSize  int
+	PhysicalBlockSize int
+	MaxIOSize         int
 
 	EnableZeroCopy     bool
 	EnableUnprivileged bool
 	EnableUserCopy     bool
 	EnableZoned        bool
 	EnableIoctlEncode  bool
+	EnableRecovery     bool
+	NoPartitionScan    bool
+	EnableResize       bool
 
 	ReadOnly      bool
 	Rotational    bool
@@ -27,6 +31,14 @@ type DeviceParams struct {
 	MaxDiscardSectors  uint32
 	MaxDiscardSegments uint16
 
+	MaxWriteZeroesSectors uint32
+
+	// Scatter/gather limits; 0 leaves each at the block layer default
+	VirtBoundaryMask    uint64
+	MaxSegments         uint16
+	MaxSegmentSize      uint32
+	SegmentBoundaryMask uint64
+
 	DeviceName  string
 	CPUAffinity []int
 }
@@ -55,6 +67,8 @@ func DefaultDeviceParams(backend interfaces.Backend) DeviceParams {
 		DiscardGranularity: 4096,
 		MaxDiscardSectors:  0xffffffff,
 		MaxDiscardSegments: 256,
+
+		MaxWriteZeroesSectors: 0xffffffff,
 	}
 }
 
@@ -72,5 +86,5 @@ type DeviceInfo struct {
 }
 
 func (d *DeviceInfo) Size() int64 {
-	return int64(d.DevSectors) * int64(d.BlockSize)
+	return int64(d.DevSectors) << 9
 }
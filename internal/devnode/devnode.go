@@ -0,0 +1,198 @@
+//go:build linux
+
+// Package devnode waits for device nodes that udev creates asynchronously,
+// such as /dev/ublkcN after ADD_DEV, and creates them where no udev runs.
+package devnode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// pollInterval is how often the node is retried even without an inotify
+// event, so a directory inotify cannot watch (another mount namespace, a
+// filesystem without inotify support) still works, just more slowly.
+const pollInterval = 100 * time.Millisecond
+
+// Open opens path read-write, waiting up to timeout for it to appear. It
+// watches the parent directory with inotify, so the open is retried as soon
+// as udev creates the node or fixes its permissions. Errors other than
+// ENOENT are returned at once; if the node never appears the error wraps
+// syscall.ENOENT.
+func Open(ctx context.Context, path string, timeout time.Duration) (int, error) {
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if !errors.Is(err, syscall.ENOENT) {
+		return fd, openError(path, err)
+	}
+
+	// Watch before retrying, so a node created in between is not missed
+	watch := newWatcher(filepath.Dir(path))
+	defer watch.close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		fd, err = syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+		if !errors.Is(err, syscall.ENOENT) {
+			return fd, openError(path, err)
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return -1, fmt.Errorf("%s did not appear within %v: %w", path, timeout, syscall.ENOENT)
+		}
+		if err := ctx.Err(); err != nil {
+			return -1, fmt.Errorf("waiting for %s: %w", path, err)
+		}
+		watch.wait(min(remaining, pollInterval))
+	}
+}
+
+func openError(path string, err error) error {
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return nil
+}
+
+// watcher reports changes in a directory. With no inotify it just sleeps.
+type watcher struct {
+	fd int
+}
+
+func newWatcher(dir string) *watcher {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return &watcher{fd: -1}
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CREATE|unix.IN_ATTRIB|unix.IN_MOVED_TO); err != nil {
+		unix.Close(fd)
+		return &watcher{fd: -1}
+	}
+	return &watcher{fd: fd}
+}
+
+// wait returns after an event in the directory or after d. Events are
+// drained, not parsed: the caller simply retries its open.
+func (w *watcher) wait(d time.Duration) {
+	if w.fd < 0 {
+		time.Sleep(d)
+		return
+	}
+	fds := []unix.PollFd{{Fd: int32(w.fd), Events: unix.POLLIN}}
+	if n, _ := unix.Poll(fds, int(d.Milliseconds())+1); n > 0 {
+		var buf [4096]byte
+		for {
+			if n, err := unix.Read(w.fd, buf[:]); n <= 0 || err != nil {
+				break
+			}
+		}
+	}
+}
+
+func (w *watcher) close() {
+	if w.fd >= 0 {
+		unix.Close(w.fd)
+	}
+}
+
+// Devt returns the device number sysfs publishes in sysDir/dev as
+// "major:minor", e.g. for /sys/class/ublk-char/ublkc0. Sysfs entries exist
+// as soon as the kernel registers a device, before udev creates its node.
+func Devt(sysDir string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(sysDir, "dev"))
+	if err != nil {
+		return 0, err
+	}
+	var major, minor uint32
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &major, &minor); err != nil {
+		return 0, fmt.Errorf("bad device number %q in %s: %w", data, sysDir, err)
+	}
+	return unix.Mkdev(major, minor), nil
+}
+
+// Holder returns the PID of a process that has the device node path open,
+// or 0 if none is found. Fds are matched by device number, so a process
+// that opened another node for the same device counts. Only processes the
+// caller can see in /proc, and whose fds it may read, are searched.
+func Holder(path string) int {
+	return holder("/proc", path)
+}
+
+func holder(proc, path string) int {
+	var want unix.Stat_t
+	if err := unix.Stat(path, &want); err != nil {
+		return 0
+	}
+	entries, err := os.ReadDir(proc)
+	if err != nil {
+		return 0
+	}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(proc, e.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue // Exited, or not ours to inspect
+		}
+		for _, fd := range fds {
+			var st unix.Stat_t
+			if unix.Stat(filepath.Join(fdDir, fd.Name()), &st) != nil {
+				continue
+			}
+			if st.Mode&unix.S_IFMT == want.Mode&unix.S_IFMT && st.Rdev == want.Rdev {
+				return pid
+			}
+		}
+	}
+	return 0
+}
+
+// Name returns the kernel's name for device dev, of class "block" or
+// "char", from the DEVNAME in sysDev/class/major:minor/uevent (sysDev is
+// normally /sys/dev). It is the path of the device's node relative to
+// /dev, wherever udev rules add links to it.
+func Name(sysDev, class string, dev uint64) (string, error) {
+	dir := filepath.Join(sysDev, class, fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev)))
+	data, err := os.ReadFile(filepath.Join(dir, "uevent"))
+	if err != nil {
+		return "", err
+	}
+	for line := range strings.Lines(string(data)) {
+		if name, ok := strings.CutPrefix(strings.TrimSpace(line), "DEVNAME="); ok && name != "" {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no DEVNAME in %s/uevent", dir)
+}
+
+// Mknod creates a device node at path with file type mode (unix.S_IFCHR
+// or unix.S_IFBLK) and permissions 0600. A node already there for the same
+// device is kept; anything else at path is an error. It needs CAP_MKNOD.
+func Mknod(path string, mode uint32, dev uint64) error {
+	err := unix.Mknod(path, mode|0o600, int(dev))
+	if errors.Is(err, unix.EEXIST) {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			return err
+		}
+		if st.Mode&unix.S_IFMT == mode && uint64(st.Rdev) == dev {
+			return nil
+		}
+		return fmt.Errorf("%s exists and is not device %d:%d", path, unix.Major(dev), unix.Minor(dev))
+	}
+	if err != nil {
+		return fmt.Errorf("mknod %s: %w", path, err)
+	}
+	return nil
+}
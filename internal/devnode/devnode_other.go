@@ -0,0 +1,39 @@
+//go:build !linux
+
+package devnode
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// errNotLinux is returned off Linux, which has neither ublk device nodes
+// nor the sysfs entries describing them. It wraps ENOSYS.
+var errNotLinux = fmt.Errorf("ublk device nodes require Linux: %w", syscall.ENOSYS)
+
+// Open returns an error wrapping ENOSYS.
+func Open(ctx context.Context, path string, timeout time.Duration) (int, error) {
+	return -1, errNotLinux
+}
+
+// Holder returns 0: no process can hold a ublk device node open.
+func Holder(path string) int {
+	return 0
+}
+
+// Devt returns an error wrapping ENOSYS.
+func Devt(sysDir string) (uint64, error) {
+	return 0, errNotLinux
+}
+
+// Name returns an error wrapping ENOSYS.
+func Name(sysDev, class string, dev uint64) (string, error) {
+	return "", errNotLinux
+}
+
+// Mknod returns an error wrapping ENOSYS.
+func Mknod(path string, mode uint32, dev uint64) error {
+	return errNotLinux
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package devnode
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ublkc0")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := Open(context.Background(), path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+}
+
+func TestOpenWaitsForNode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ublkc0")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		os.WriteFile(path, nil, 0o644)
+	}()
+
+	start := time.Now()
+	fd, err := Open(context.Background(), path, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+	// inotify wakes the wait well before the 100ms poll would
+	if elapsed := time.Since(start); elapsed > 90*time.Millisecond {
+		t.Logf("node opened after %v; inotify may be unavailable", elapsed)
+	}
+}
+
+func TestOpenTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing")
+	_, err := Open(context.Background(), path, 50*time.Millisecond)
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("err = %v, want ENOENT", err)
+	}
+}
+
+func TestOpenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Open(ctx, filepath.Join(t.TempDir(), "missing"), time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestDevt(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "dev"), []byte("259:3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := Devt(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unix.Major(dev) != 259 || unix.Minor(dev) != 3 {
+		t.Errorf("Devt = %d:%d, want 259:3", unix.Major(dev), unix.Minor(dev))
+	}
+}
+
+func TestName(t *testing.T) {
+	sysDev := t.TempDir()
+	dir := filepath.Join(sysDev, "block", "259:3")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	uevent := "MAJOR=259\nMINOR=3\nDEVNAME=ublkb3\nDEVTYPE=disk\n"
+	if err := os.WriteFile(filepath.Join(dir, "uevent"), []byte(uevent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := Name(sysDev, "block", unix.Mkdev(259, 3))
+	if err != nil || name != "ublkb3" {
+		t.Errorf("Name = %q, %v; want ublkb3", name, err)
+	}
+	if _, err := Name(sysDev, "char", unix.Mkdev(259, 3)); err == nil {
+		t.Error("Name succeeded for a device sysfs does not have")
+	}
+}
+
+func TestMknod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "null")
+	null := unix.Mkdev(1, 3)
+	if err := Mknod(path, unix.S_IFCHR, null); errors.Is(err, syscall.EPERM) {
+		t.Skip("mknod needs CAP_MKNOD")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	// Existing node for the same device is kept, another device is refused
+	if err := Mknod(path, unix.S_IFCHR, null); err != nil {
+		t.Errorf("Mknod over the same node: %v", err)
+	}
+	if err := Mknod(path, unix.S_IFCHR, unix.Mkdev(1, 5)); err == nil {
+		t.Error("Mknod replaced a node for another device")
+	}
+}
+
+func TestHolder(t *testing.T) {
+	if _, err := os.Stat("/dev/null"); err != nil {
+		t.Skip("no /dev/null")
+	}
+	proc := t.TempDir()
+	for _, link := range []struct{ pid, fd, target string }{
+		{"self", "0", "/dev/null"}, // Not a PID
+		{"41", "0", "/dev/zero"},
+		{"41", "1", proc},
+		{"42", "3", "/dev/null"},
+	} {
+		dir := filepath.Join(proc, link.pid, "fd")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(link.target, filepath.Join(dir, link.fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := holder(proc, "/dev/null"); got != 42 {
+		t.Errorf("holder(/dev/null) = %d, want 42", got)
+	}
+	if got := holder(proc, "/dev/full"); got != 0 {
+		t.Errorf("holder(/dev/full) = %d, want 0", got)
+	}
+	if got := holder(proc, filepath.Join(proc, "missing")); got != 0 {
+		t.Errorf("holder of a missing node = %d, want 0", got)
+	}
+}
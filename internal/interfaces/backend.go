@@ -3,6 +3,13 @@
 // between the main package and internal packages.
 package interfaces
 
+import (
+	"context"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
 // Backend defines the interface that all ublk backends must implement.
 type Backend interface {
 	ReadAt(p []byte, off int64) (n int, err error)
@@ -18,6 +25,112 @@ type DiscardBackend interface {
 	Discard(offset, length int64) error
 }
 
+// ReadAheadBackend is an optional interface for sequential read hints.
+type ReadAheadBackend interface {
+	Backend
+	ReadAhead(offset, length int64)
+}
+
+// WriteZeroesBackend is an optional interface for WRITE_ZEROES support.
+type WriteZeroesBackend interface {
+	Backend
+	WriteZeroes(offset, length int64, flags RequestFlags) error
+}
+
+// FlushContextBackend is an optional interface for flushes that can be
+// cancelled.
+type FlushContextBackend interface {
+	Backend
+	FlushContext(ctx context.Context) error
+}
+
+// DiscardContextBackend is an optional interface for discards that can be
+// cancelled.
+type DiscardContextBackend interface {
+	DiscardBackend
+	DiscardContext(ctx context.Context, offset, length int64) error
+}
+
+// WriteZeroesContextBackend is an optional interface for WRITE_ZEROES
+// calls that can be cancelled.
+type WriteZeroesContextBackend interface {
+	WriteZeroesBackend
+	WriteZeroesContext(ctx context.Context, offset, length int64, flags RequestFlags) error
+}
+
+// RequestFlags are the UBLK_IO_F_* flags of a block request.
+type RequestFlags uint32
+
+// FailFast reports whether the request asked not to be retried
+// (FAILFAST_DEV, FAILFAST_TRANSPORT or FAILFAST_DRIVER).
+func (f RequestFlags) FailFast() bool {
+	return f&(uapi.UBLK_IO_F_FAILFAST_DEV|uapi.UBLK_IO_F_FAILFAST_TRANSPORT|uapi.UBLK_IO_F_FAILFAST_DRIVER) != 0
+}
+
+// Meta reports whether the request carries filesystem metadata.
+func (f RequestFlags) Meta() bool { return f&uapi.UBLK_IO_F_META != 0 }
+
+// FUA reports whether a write must be durable before it completes.
+func (f RequestFlags) FUA() bool { return f&uapi.UBLK_IO_F_FUA != 0 }
+
+// NoUnmap reports whether a WRITE_ZEROES must keep the range allocated.
+func (f RequestFlags) NoUnmap() bool { return f&uapi.UBLK_IO_F_NOUNMAP != 0 }
+
+// Swap reports whether the request is swap traffic.
+func (f RequestFlags) Swap() bool { return f&uapi.UBLK_IO_F_SWAP != 0 }
+
+// Request describes the block request behind a RequestBackend call.
+type Request struct {
+	Queue uint16
+	Tag   uint16
+	Flags RequestFlags
+	// Deadline is when the request times out (see DeviceParams.IOTimeout);
+	// zero if it never does
+	Deadline time.Time
+}
+
+// RawRequest is a block request as the kernel sent it, for a raw handler
+// serving requests in place of a Backend.
+type RawRequest struct {
+	Queue   uint16
+	Tag     uint16
+	Op      uint8 // UBLK_IO_OP_*
+	Flags   RequestFlags
+	Sector  uint64 // Start sector, as in the descriptor
+	Sectors uint32 // Sector count, as in the descriptor
+	Offset  int64  // Start in bytes
+	Length  int64  // Length in bytes
+	// Data is the tag buffer for a READ, to be filled, or holds the data
+	// of a WRITE; nil for other ops. It must not be retained.
+	Data []byte
+	// Deadline is when the request times out; zero if it never does
+	Deadline time.Time
+}
+
+// RequestBackend is an optional interface for backends that want the
+// request behind each read and write.
+type RequestBackend interface {
+	Backend
+	ReadAtRequest(p []byte, off int64, req Request) (n int, err error)
+	WriteAtRequest(p []byte, off int64, req Request) (n int, err error)
+}
+
+// Zone describes one zone of a zoned backend. Positions and lengths are in bytes.
+type Zone struct {
+	Start        int64 // Zone start offset
+	Length       int64 // Zone length
+	WritePointer int64 // Write pointer offset
+	Capacity     int64 // Usable capacity (0 = same as Length)
+	Type         uint8 // Zone type (BLK_ZONE_TYPE_*)
+	Cond         uint8 // Zone condition (BLK_ZONE_COND_*)
+}
+
+// ZonedBackend is an optional interface for zoned block device support.
+type ZonedBackend interface {
+	Backend
+	ReportZones(offset int64, nrZones int) ([]Zone, error)
+}
+
 // Logger interface for optional logging.
 type Logger interface {
 	Printf(format string, args ...interface{})
@@ -33,3 +146,32 @@ type Observer interface {
 	ObserveFlush(latencyNs uint64, success bool)
 	ObserveQueueDepth(depth uint32)
 }
+
+// QueueObserver is an optional extension of Observer for ublk protocol events.
+// Implementations must be thread-safe as methods are called from the I/O loop
+// and, for OnIOError, from backend workers.
+type QueueObserver interface {
+	OnFetchCompleted(queueID, tag uint16, result int32)
+	OnCommitSubmitted(queueID, tag uint16, result int32)
+	OnQueueStall(queueID, tag uint16, stalled time.Duration)
+	OnRingFull(queueID uint16)
+	OnIOError(queueID, tag uint16, op uint8, offset uint64, length uint32, err error)
+}
+
+// PhaseObserver is an optional extension of Observer that splits each
+// request's time between the ublk plumbing and the backend. It is called
+// from the I/O loop or backend workers and must be thread-safe.
+type PhaseObserver interface {
+	ObservePhases(dispatchNs, backendNs, refetchNs uint64)
+}
+
+// BufferAllocator supplies the memory queues move I/O data through, in
+// place of anonymous mmap and Go heap buffers. Alloc must return at least
+// size bytes that stay valid and in place until passed to Free, which may
+// get them resliced to size. It is called once per queue for the per-tag
+// buffer region, and on the I/O path for scratch buffers (requests under
+// an IOTimeout), so it should pool.
+type BufferAllocator interface {
+	Alloc(size int) ([]byte, error)
+	Free(buf []byte)
+}
@@ -7,13 +7,20 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
-// Logger wraps stdlib log with level support
+// Logger wraps stdlib log with level support. Its level can be changed at
+// runtime, and component loggers (see Component) filter one part of the
+// library at a level of their own.
 type Logger struct {
 	logger *log.Logger
-	level  LogLevel
+	level  atomic.Int32 // A LogLevel, or levelInherit
 	mu     sync.Mutex
+
+	component string   // "" for a root logger
+	parent    *Logger  // The root logger of a component logger
+	scopes    sync.Map // Component name -> *Logger; root loggers only
 }
 
 var (
@@ -31,6 +38,43 @@ const (
 	LevelError
 )
 
+// levelInherit is the level of a component logger that has none of its
+// own and follows its root logger's.
+const levelInherit = -1
+
+// Components of the library that log through their own component logger.
+const (
+	ComponentCtrl  = "ctrl"  // Control plane: device add, start, stop
+	ComponentQueue = "queue" // Queue runners and their I/O loops
+	ComponentUring = "uring" // io_uring setup and submission
+)
+
+// String returns the level's name as ParseLevel accepts it.
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// ParseLevel returns the level named s: "debug", "info", "warn" or
+// "error".
+func ParseLevel(s string) (LogLevel, error) {
+	for _, level := range []LogLevel{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if s == level.String() {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", s)
+}
+
 // Config holds logging configuration
 type Config struct {
 	Level  LogLevel
@@ -54,10 +98,53 @@ func NewLogger(config *Config) *Logger {
 	if output == nil {
 		output = os.Stderr
 	}
-	return &Logger{
-		logger: log.New(output, "", log.LstdFlags),
-		level:  config.Level,
+	l := &Logger{logger: log.New(output, "", log.LstdFlags)}
+	l.level.Store(int32(config.Level))
+	return l
+}
+
+// Component returns the logger for one component of the library, such as
+// ComponentUring. It writes to the same output, prefixing messages with
+// the component's name, and follows l's level until given one of its own
+// with SetLevel. Asking again for the same component returns the same
+// logger.
+func (l *Logger) Component(name string) *Logger {
+	if l.parent != nil {
+		l = l.parent
+	}
+	if c, ok := l.scopes.Load(name); ok {
+		return c.(*Logger)
 	}
+	c := &Logger{logger: l.logger, component: name, parent: l}
+	c.level.Store(levelInherit)
+	actual, _ := l.scopes.LoadOrStore(name, c)
+	return actual.(*Logger)
+}
+
+// SetLevel changes the level of l at runtime. On a root logger it also
+// changes the level of its component loggers that have none of their own.
+func (l *Logger) SetLevel(level LogLevel) {
+	l.level.Store(int32(level))
+}
+
+// SetComponentLevel sets the level of the named component's logger; see
+// Component.
+func (l *Logger) SetComponentLevel(name string, level LogLevel) {
+	l.Component(name).SetLevel(level)
+}
+
+// Level returns the level l logs at.
+func (l *Logger) Level() LogLevel {
+	level := l.level.Load()
+	if level == levelInherit {
+		return l.parent.Level()
+	}
+	return LogLevel(level)
+}
+
+// For returns the default logger's logger for the named component.
+func For(component string) *Logger {
+	return Default().Component(component)
 }
 
 // Default returns the default logger, creating it if necessary
@@ -105,11 +192,15 @@ func formatArgs(args []any) string {
 }
 
 func (l *Logger) log(level LogLevel, prefix, msg string, args ...any) {
-	if level < l.level {
+	if level < l.Level() {
 		return
 	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.component != "" {
+		l.logger.Printf("%s %s: %s%s", prefix, l.component, msg, formatArgs(args))
+		return
+	}
 	l.logger.Printf("%s %s%s", prefix, msg, formatArgs(args))
 }
 
@@ -143,3 +143,53 @@ func TestGlobalLoggerFunctions(t *testing.T) {
 		t.Errorf("Expected error message, got: %s", output)
 	}
 }
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&Config{Level: LevelInfo, Output: &buf})
+	uring := logger.Component(ComponentUring)
+	queue := logger.Component(ComponentQueue)
+	if logger.Component(ComponentUring) != uring {
+		t.Error("Component returned a new logger for the same component")
+	}
+
+	// Components follow the root level until given their own
+	uring.Debug("hidden")
+	if buf.Len() > 0 {
+		t.Errorf("debug message at info level: %s", buf.String())
+	}
+	logger.SetComponentLevel(ComponentUring, LevelDebug)
+	uring.Debug("submitted", "n", 1)
+	if !strings.Contains(buf.String(), "[DEBUG] uring: submitted n=1") {
+		t.Errorf("component debug message = %q", buf.String())
+	}
+
+	buf.Reset()
+	queue.Debug("hidden")
+	logger.Debug("hidden")
+	if buf.Len() > 0 {
+		t.Errorf("debug message from an info-level logger: %s", buf.String())
+	}
+
+	// A runtime change of the root level reaches components without their own
+	logger.SetLevel(LevelError)
+	queue.Warn("hidden")
+	uring.Debug("shown")
+	if got := buf.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "shown") {
+		t.Errorf("after SetLevel(LevelError) got %q", got)
+	}
+	if queue.Level() != LevelError || uring.Level() != LevelDebug {
+		t.Errorf("levels = %v, %v, want error, debug", queue.Level(), uring.Level())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []LogLevel{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if got, err := ParseLevel(level.String()); err != nil || got != level {
+			t.Errorf("ParseLevel(%q) = %v, %v", level.String(), got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel accepted an unknown level")
+	}
+}
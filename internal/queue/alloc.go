@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"fmt"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
+)
+
+// allocTagBuffers allocates the I/O buffers of depth tags from alloc, or
+// as anonymous memory if alloc is nil.
+func allocTagBuffers(alloc interfaces.BufferAllocator, depth int) ([]byte, error) {
+	size := depth * constants.IOBufferSizePerTag // 64KB per request buffer
+	if alloc == nil {
+		buf, err := mmapAnon(size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate I/O buffers: %v", err)
+		}
+		return buf, nil
+	}
+	buf, err := alloc.Alloc(size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate I/O buffers: %w", err)
+	}
+	if len(buf) < size {
+		alloc.Free(buf)
+		return nil, fmt.Errorf("buffer allocator returned %d bytes for %d tags, want %d", len(buf), depth, size)
+	}
+	return buf[:size], nil
+}
+
+// freeTagBuffers releases buffers from allocTagBuffers.
+func freeTagBuffers(alloc interfaces.BufferAllocator, buf []byte) {
+	if alloc == nil {
+		munmapAnon(buf)
+		return
+	}
+	alloc.Free(buf)
+}
+
+// getBuffer returns a scratch buffer of size bytes, from the runner's
+// BufferAllocator or the shared BufferPool. Return it with putBuffer.
+func (r *Runner) getBuffer(size uint32) ([]byte, error) {
+	if r.allocator == nil {
+		return GetBuffer(size), nil
+	}
+	buf, err := r.allocator.Alloc(int(size))
+	if err != nil {
+		return nil, fmt.Errorf("allocating a %d-byte buffer: %w", size, err)
+	}
+	if len(buf) < int(size) {
+		r.allocator.Free(buf)
+		return nil, fmt.Errorf("buffer allocator returned %d bytes, want %d", len(buf), size)
+	}
+	return buf[:size], nil
+}
+
+// putBuffer returns a buffer from getBuffer.
+func (r *Runner) putBuffer(buf []byte) {
+	if r.allocator == nil {
+		PutBuffer(buf)
+		return
+	}
+	r.allocator.Free(buf)
+}
@@ -0,0 +1,88 @@
+//go:build linux
+
+package queue
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// countingAllocator allocates from the Go heap, short by short bytes, and
+// counts buffers not yet freed
+type countingAllocator struct {
+	mu     sync.Mutex
+	live   int
+	allocs int
+	short  int
+}
+
+func (a *countingAllocator) Alloc(size int) ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.live++
+	a.allocs++
+	return make([]byte, size-a.short), nil
+}
+
+func (a *countingAllocator) Free([]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.live--
+}
+
+func TestAllocTagBuffers(t *testing.T) {
+	alloc := &countingAllocator{}
+	buf, err := allocTagBuffers(alloc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 4*constants.IOBufferSizePerTag {
+		t.Errorf("got %d bytes for 4 tags", len(buf))
+	}
+	freeTagBuffers(alloc, buf)
+
+	alloc.short = 1
+	if _, err := allocTagBuffers(alloc, 4); err == nil {
+		t.Error("short allocation accepted")
+	}
+	if alloc.live != 0 {
+		t.Errorf("%d buffers not freed", alloc.live)
+	}
+
+	buf, err = allocTagBuffers(nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] = 1 // The anonymous mapping is writable to the end
+	freeTagBuffers(nil, buf)
+}
+
+func TestSimBufferAllocator(t *testing.T) {
+	alloc := &countingAllocator{}
+	r, sim := startSim(t, Config{
+		Depth: 1, Backend: newMockBackend(1 << 20), IOTimeout: time.Second, BufferAllocator: alloc,
+	})
+
+	data := bytes.Repeat([]byte{0x5a}, 4096)
+	write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8}
+	if res := simDo(t, sim, write, data); res != 4096 {
+		t.Fatalf("write result = %d, want 4096", res)
+	}
+	got := make([]byte, 4096)
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	if res := simDo(t, sim, read, got); res != 4096 || !bytes.Equal(got, data) {
+		t.Fatalf("read result = %d, data match %v", res, bytes.Equal(got, data))
+	}
+	r.Close()
+
+	alloc.mu.Lock()
+	defer alloc.mu.Unlock()
+	if alloc.allocs != 2 || alloc.live != 0 {
+		t.Errorf("%d scratch buffers allocated and %d not freed, want 2 and 0", alloc.allocs, alloc.live)
+	}
+}
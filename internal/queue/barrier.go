@@ -0,0 +1,78 @@
+package queue
+
+import (
+	"context"
+	"sync"
+)
+
+// WriteBarrier lets a FLUSH wait for the writes in flight on every queue
+// of a device, not just its own. Writes are grouped into epochs; a Wait
+// closes the current epoch and returns once no write from it or an
+// earlier one is still in the backend. Writes that start after the Wait
+// do not hold it up.
+type WriteBarrier struct {
+	mu       sync.Mutex
+	epoch    uint64
+	inFlight map[uint64]int // Writes still running, by epoch
+	done     chan struct{}  // Closed and replaced whenever an epoch drains
+}
+
+// NewWriteBarrier returns an empty barrier.
+func NewWriteBarrier() *WriteBarrier {
+	return &WriteBarrier{inFlight: make(map[uint64]int), done: make(chan struct{})}
+}
+
+// Begin records a write starting and returns its epoch, to be passed to
+// End when the write's backend call returns.
+func (b *WriteBarrier) Begin() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inFlight[b.epoch]++
+	return b.epoch
+}
+
+// End records the end of a write begun in epoch.
+func (b *WriteBarrier) End(epoch uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inFlight[epoch]--; b.inFlight[epoch] > 0 {
+		return
+	}
+	delete(b.inFlight, epoch)
+	close(b.done)
+	b.done = make(chan struct{})
+}
+
+// Wait returns once every write begun before it has ended, or with ctx's
+// error if ctx is done first.
+func (b *WriteBarrier) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	target := b.epoch
+	b.epoch++
+	for {
+		if !b.pendingLocked(target) {
+			b.mu.Unlock()
+			return nil
+		}
+		done := b.done
+		b.mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		b.mu.Lock()
+	}
+}
+
+// pendingLocked reports whether a write from epoch target or earlier is
+// still running.
+func (b *WriteBarrier) pendingLocked(target uint64) bool {
+	for epoch := range b.inFlight {
+		if epoch <= target {
+			return true
+		}
+	}
+	return false
+}
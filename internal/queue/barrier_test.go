@@ -0,0 +1,42 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWriteBarrier(t *testing.T) {
+	b := NewWriteBarrier()
+	ctx := context.Background()
+	if err := b.Wait(ctx); err != nil {
+		t.Fatalf("Wait with no writes = %v", err)
+	}
+
+	first := b.Begin()
+	waited := make(chan error, 1)
+	go func() { waited <- b.Wait(ctx) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("Wait returned %v with a write in flight", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// A write begun after the Wait does not hold it up
+	later := b.Begin()
+	b.End(first)
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Wait(cancelled); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait with a write in flight and a done context = %v, want Canceled", err)
+	}
+	b.End(later)
+	if err := b.Wait(ctx); err != nil {
+		t.Fatalf("Wait after every write ended = %v", err)
+	}
+}
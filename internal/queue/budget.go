@@ -0,0 +1,64 @@
+package queue
+
+import (
+	"context"
+	"sync"
+)
+
+// ByteBudget caps the bytes of READ and WRITE data a device's backend
+// holds at once, across all of its queues. A request that would take the
+// total over the cap waits for others to finish; one larger than the cap
+// runs when nothing else is in flight, so it cannot wait forever.
+type ByteBudget struct {
+	limit int64
+
+	mu    sync.Mutex
+	used  int64
+	freed chan struct{} // Closed and replaced whenever bytes are released
+}
+
+// NewByteBudget returns a budget of limit bytes, or nil if limit does not
+// enable one.
+func NewByteBudget(limit int64) *ByteBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &ByteBudget{limit: limit, freed: make(chan struct{})}
+}
+
+// Acquire takes n bytes from the budget, waiting until they fit or ctx
+// is done.
+func (b *ByteBudget) Acquire(ctx context.Context, n int64) error {
+	for {
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Release returns n bytes taken by Acquire.
+func (b *ByteBudget) Release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+}
+
+// InFlight returns the bytes currently taken from the budget.
+func (b *ByteBudget) InFlight() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
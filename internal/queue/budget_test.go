@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestByteBudget(t *testing.T) {
+	if NewByteBudget(0) != nil {
+		t.Error("NewByteBudget(0) is not nil")
+	}
+
+	b := NewByteBudget(8192)
+	ctx := context.Background()
+	if err := b.Acquire(ctx, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Acquire(ctx, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- b.Acquire(ctx, 4096) }()
+	select {
+	case err := <-acquired:
+		t.Fatalf("Acquire over the budget returned %v without waiting", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	b.Release(4096)
+	if err := <-acquired; err != nil {
+		t.Fatal(err)
+	}
+	if got := b.InFlight(); got != 8192 {
+		t.Errorf("InFlight = %d, want 8192", got)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := b.Acquire(cancelled, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire with a full budget and a done context = %v, want Canceled", err)
+	}
+
+	// A request larger than the whole budget runs once nothing else does
+	b.Release(8192)
+	if err := b.Acquire(ctx, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.InFlight(); got != 1<<20 {
+		t.Errorf("InFlight = %d, want %d", got, 1<<20)
+	}
+}
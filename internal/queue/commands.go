@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// udWakeup marks the completion of the command eventfd poll. Bit 62 is never
+// set in FETCH/COMMIT userData (queue ID and tag only use the low 32 bits).
+const udWakeup uint64 = 1 << 62
+
+// ErrLoopNotRunning is returned when a command is sent to a queue loop that
+// has exited or was never started.
+var ErrLoopNotRunning = errors.New("queue loop not running")
+
+// ErrAborted is returned by Wait when the kernel aborted the queue's
+// commands, which it does when the device is stopped or deleted behind the
+// runner's back. Restarting the queue cannot help.
+var ErrAborted = errors.New("queue aborted by the kernel")
+
+// ErrStopTimeout is returned by StopContext when the loop is still running
+// after being told to abort, which happens when it is stuck in a backend
+// call made on the queue thread. Its resources are released once the call
+// returns and the loop exits.
+var ErrStopTimeout = errors.New("queue loop did not stop in time")
+
+// queueCmd is a request sent to a queue loop from another goroutine.
+type queueCmd struct {
+	stop bool   // Exit the loop after the current batch
+	run  func() // Executed on the loop goroutine, e.g. to read tag states
+}
+
+// commandQueue is the only way other goroutines talk to a running queue
+// loop. All tag state belongs to the loop goroutine and is never locked;
+// anything that needs the loop to act posts a command instead.
+//
+// The loop usually sits in io_uring_enter waiting for CQEs, so posting also
+// signals an eventfd. The loop keeps a one-shot POLL_ADD armed on it, which
+// turns the signal into a udWakeup completion on the loop's own ring.
+type commandQueue struct {
+	cmds chan queueCmd
+	efd  int
+	done chan struct{} // closed when the loop exits
+	err  error         // why the loop exited unasked; written before done is closed
+	cpu  threadCPU     // CPU time of the loop's thread
+
+	// abort is closed when a stop runs out of time, telling the exiting
+	// loop to fail requests still in the backend instead of waiting
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+// newCommandQueue creates the command channel and its wakeup eventfd.
+func newCommandQueue() (*commandQueue, error) {
+	efd, err := newEventfd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create wakeup eventfd: %v", err)
+	}
+	return &commandQueue{
+		cmds:  make(chan queueCmd, 4),
+		efd:   efd,
+		done:  make(chan struct{}),
+		abort: make(chan struct{}),
+	}, nil
+}
+
+// arm prepares the wakeup poll on ring. The caller flushes it with the rest
+// of the batch.
+func (c *commandQueue) arm(ring uring.QueueRing) error {
+	return ring.PreparePollAdd(int32(c.efd), udWakeup)
+}
+
+// post sends cmd to the loop and wakes it. It reports false if the loop has
+// already exited.
+func (c *commandQueue) post(cmd queueCmd) bool {
+	select {
+	case c.cmds <- cmd:
+	case <-c.done:
+		return false
+	}
+	c.notify()
+	return true
+}
+
+// notify wakes the loop without a command, e.g. when a backend worker has
+// finished a request.
+func (c *commandQueue) notify() {
+	signalEventfd(c.efd)
+}
+
+// receive drains the eventfd and the pending commands. It reports whether
+// the loop was asked to stop. Finished worker requests are collected by the
+// caller.
+func (c *commandQueue) receive() (stop bool) {
+	drainEventfd(c.efd)
+
+	for {
+		select {
+		case cmd := <-c.cmds:
+			if cmd.run != nil {
+				cmd.run()
+			}
+			stop = stop || cmd.stop
+		default:
+			return stop
+		}
+	}
+}
+
+// stop asks the loop to exit and waits until it has. Safe to call after the
+// loop is gone.
+func (c *commandQueue) stop() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.post(queueCmd{stop: true})
+	<-c.done
+}
+
+// stopContext is stop bounded by ctx. If the loop has not exited when ctx
+// ends it is told to abort and given constants.StopAbortGrace more, after
+// which ErrStopTimeout is returned. The caller has cancelled the loop's
+// context, so a full command channel cannot keep it running.
+func (c *commandQueue) stopContext(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return nil
+	case c.cmds <- queueCmd{stop: true}:
+	default:
+	}
+	c.notify()
+
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+	}
+	c.abortOnce.Do(func() {
+		close(c.abort)
+		c.notify()
+	})
+
+	grace := time.NewTimer(constants.StopAbortGrace)
+	defer grace.Stop()
+	select {
+	case <-c.done:
+		return nil
+	case <-grace.C:
+		return ErrStopTimeout
+	}
+}
+
+// call runs fn on the loop goroutine and waits for it to finish. It fails if
+// ctx ends first or the loop exits before getting to fn.
+func (c *commandQueue) call(ctx context.Context, fn func()) error {
+	ran := make(chan struct{})
+	if !c.post(queueCmd{run: func() { fn(); close(ran) }}) {
+		return ErrLoopNotRunning
+	}
+	select {
+	case <-ran:
+		return nil
+	case <-c.done:
+		return ErrLoopNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close releases the eventfd. The loop must have exited.
+func (c *commandQueue) close() {
+	if c.efd >= 0 {
+		closeFd(c.efd)
+		c.efd = -1
+	}
+}
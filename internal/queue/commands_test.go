@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// TestCommandQueueWakesRing checks that a post from another goroutine wakes a
+// loop blocked in WaitForCompletion on a real io_uring.
+func TestCommandQueueWakesRing(t *testing.T) {
+	ring, err := uring.NewMinimalRing(4, -1)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+
+	commands, err := newCommandQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer commands.close()
+
+	if err := commands.arm(ring); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.FlushSubmissions(); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		commands.post(queueCmd{stop: true})
+	}()
+
+	results, err := ring.WaitForCompletion(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].UserData() != udWakeup {
+		t.Fatalf("got %d completions, want one wakeup", len(results))
+	}
+	if !commands.receive() {
+		t.Error("receive() = false after a Stop was posted")
+	}
+	if commands.receive() {
+		t.Error("receive() = true with no commands pending")
+	}
+}
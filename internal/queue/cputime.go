@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// threadCPU accounts the CPU time of the OS thread a queue loop is locked
+// to. Linux lets any thread read the CPU clocks of the others in its
+// process, so readers never involve the loop. The thread ran other
+// goroutines before the loop locked it, so times count from attach; after
+// detach the final times are kept.
+type threadCPU struct {
+	mu           sync.Mutex
+	tid          int // loop thread while attached, 0 otherwise
+	user, system time.Duration
+	baseUser     time.Duration // thread's times at attach
+	baseSystem   time.Duration
+}
+
+// attach starts accounting the calling thread, which must be locked to the
+// loop goroutine.
+func (t *threadCPU) attach() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tid = gettid()
+	t.baseUser, t.baseSystem = threadTimes(t.tid)
+}
+
+// detach stops accounting and keeps the thread's times. It must be called
+// from the attached thread before it is unlocked.
+func (t *threadCPU) detach() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.user, t.system = t.readLocked()
+	t.tid = 0
+}
+
+// read returns the user and system time the loop thread has used.
+func (t *threadCPU) read() (user, system time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.readLocked()
+}
+
+func (t *threadCPU) readLocked() (user, system time.Duration) {
+	if t.tid == 0 {
+		return t.user, t.system
+	}
+	u, s := threadTimes(t.tid)
+	return t.user + u - t.baseUser, t.system + s - t.baseSystem
+}
+
+// setProfileLabels labels the calling goroutine with the device and queue
+// it serves, so CPU profiles can be split per queue with pprof's -tagfocus
+// or -tagshow. Goroutines it starts inherit the labels.
+func setProfileLabels(ctx context.Context, devID uint32, queue string) {
+	pprof.SetGoroutineLabels(pprof.WithLabels(ctx, pprof.Labels(
+		"ublk_device", strconv.FormatUint(uint64(devID), 10),
+		"ublk_queue", queue,
+	)))
+}
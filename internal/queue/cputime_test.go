@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+// spin keeps the calling thread busy for d of wall time.
+func spin(d time.Duration) {
+	for end := time.Now().Add(d); time.Now().Before(end); {
+	}
+}
+
+func TestThreadCPU(t *testing.T) {
+	var cpu threadCPU
+	attached := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(done)
+
+		spin(100 * time.Millisecond) // Before attach; must not count
+		cpu.attach()
+		close(attached)
+		spin(200 * time.Millisecond)
+		<-release
+		cpu.detach()
+	}()
+
+	<-attached
+	if user, system := cpu.read(); user+system > 50*time.Millisecond {
+		t.Errorf("read() right after attach = %v + %v, want about 0", user, system)
+	}
+
+	// Read from this goroutine while the thread is still attached
+	var live time.Duration
+	for deadline := time.Now().Add(5 * time.Second); live < 100*time.Millisecond; {
+		if time.Now().After(deadline) {
+			t.Fatalf("read() = %v after the thread spun for 200ms", live)
+		}
+		user, system := cpu.read()
+		live = user + system
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	<-done
+
+	user, system := cpu.read()
+	if user+system < live || user+system > time.Second {
+		t.Errorf("read() after detach = %v + %v, want between %v and 1s", user, system, live)
+	}
+	spin(50 * time.Millisecond)
+	if u, s := cpu.read(); u != user || s != system {
+		t.Errorf("read() changed after detach: %v + %v, then %v + %v", user, system, u, s)
+	}
+}
+
+func TestRunnerCPUTime(t *testing.T) {
+	r := NewStubRunner(t.Context(), Config{DevID: 1, QueueID: 0, Depth: 4})
+	if user, system := r.CPUTime(); user != 0 || system != 0 {
+		t.Errorf("CPUTime() before Start = %v + %v, want 0", user, system)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	// The loop thread is released; its final times stay put
+	user, system := r.CPUTime()
+	spin(20 * time.Millisecond)
+	if u, s := r.CPUTime(); u != user || s != system {
+		t.Errorf("CPUTime() changed after Close: %v + %v, then %v + %v", user, system, u, s)
+	}
+}
@@ -0,0 +1,305 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// Group serves several queues of one device from a single io_uring and a
+// single OS thread. Compared to ring-per-queue this saves one ring fd, three
+// ring mmaps and one pinned thread per queue, at the cost of serializing all
+// queues onto one CPU.
+//
+// ublk binds each queue to the task that issues its first FETCH_REQ, so all
+// queues in a group must be primed and served from the same thread; Group
+// does both from its own loop goroutine.
+type Group struct {
+	ring     uring.QueueRing
+	ringFd   int       // char device fd the ring targets
+	runners  []*Runner // indexed by queue ID
+	ctx      context.Context
+	cancel   context.CancelFunc
+	logger   interfaces.Logger
+	commands *commandQueue // nil until Start
+	stopping bool
+}
+
+// NewGroup creates one runner per config, all sharing a ring sized to the
+// sum of their depths. Every queue can therefore keep its full depth of
+// commands in flight without competing for SQEs. The configs must describe
+// queues 0..len(configs)-1 of the same device and carry a valid CharFd.
+func NewGroup(ctx context.Context, configs []Config) (*Group, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("queue group needs at least one queue")
+	}
+	if configs[0].CharFd <= 0 {
+		return nil, fmt.Errorf("queue group requires an open char device fd")
+	}
+
+	var entries uint32
+	for i, config := range configs {
+		if int(config.QueueID) != i {
+			return nil, fmt.Errorf("queue group config %d has queue ID %d", i, config.QueueID)
+		}
+		entries += uint32(config.Depth)
+	}
+	entries += 1 + constants.RingHeadroom // command wakeup poll and spare SQEs
+
+	fd, err := dupFd(configs[0].CharFd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dup char fd: %v", err)
+	}
+	ring, err := configs[0].newRing(uring.Config{
+		Entries: entries, FD: int32(fd), SingleIssuer: true, IOWQ: configs[0].IOWQ, AttachWQ: configs[0].AttachWQ,
+	})
+	if err != nil {
+		closeFd(fd)
+		return nil, fmt.Errorf("failed to create shared io_uring: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	g := &Group{
+		ring:    ring,
+		ringFd:  fd,
+		runners: make([]*Runner, 0, len(configs)),
+		ctx:     ctx,
+		cancel:  cancel,
+		logger:  configs[0].Logger,
+	}
+	for _, config := range configs {
+		config.Ring = ring
+		runner, err := NewRunner(ctx, config)
+		if err != nil {
+			g.Close()
+			return nil, fmt.Errorf("failed to create queue runner %d: %w", config.QueueID, err)
+		}
+		g.runners = append(g.runners, runner)
+	}
+
+	return g, nil
+}
+
+// Runners returns the group's runners, indexed by queue ID.
+func (g *Group) Runners() []*Runner {
+	return g.runners
+}
+
+// Start primes every queue from the group's thread and begins serving I/O.
+// It returns once all initial FETCH_REQs are submitted.
+func (g *Group) Start() error {
+	if g.logger != nil {
+		g.logger.Printf("Starting %d queues on a shared io_uring", len(g.runners))
+	}
+
+	commands, err := newCommandQueue()
+	if err != nil {
+		return err
+	}
+	g.commands = commands
+	for _, runner := range g.runners {
+		runner.loop = commands
+		runner.startWorkers()
+		runner.sampleDepth()
+	}
+
+	startErr := make(chan error, 1)
+	go g.ioLoop(startErr)
+
+	return <-startErr
+}
+
+// Stop stops the group's I/O loop and waits for it to exit.
+func (g *Group) Stop() error {
+	g.cancel()
+	if g.commands != nil {
+		g.commands.stop()
+	}
+	return nil
+}
+
+// StopContext is Stop bounded by ctx, like Runner.StopContext.
+func (g *Group) StopContext(ctx context.Context) error {
+	g.cancel()
+	if g.commands == nil {
+		return nil
+	}
+	return g.commands.stopContext(ctx)
+}
+
+// Close stops the group and releases the runners and the shared ring.
+func (g *Group) Close() error {
+	_ = g.Stop() // Cleanup, ignore error
+	g.release()
+	return nil
+}
+
+// CloseContext is Close with the stop bounded by ctx, like
+// Runner.CloseContext.
+func (g *Group) CloseContext(ctx context.Context) error {
+	err := g.StopContext(ctx)
+	abandoned := err != nil
+	for _, runner := range g.runners {
+		// Only read once the loop is done with it
+		abandoned = abandoned || (err == nil && runner.abandoned)
+	}
+	if abandoned {
+		go func() {
+			if g.commands != nil {
+				<-g.commands.done
+			}
+			for _, runner := range g.runners {
+				runner.inflight.Wait()
+			}
+			g.release()
+		}()
+		return err
+	}
+	g.release()
+	return nil
+}
+
+// release frees the runners, the command queue and the shared ring. The
+// loop and the workers must be done with them.
+func (g *Group) release() {
+	for _, runner := range g.runners {
+		runner.Close()
+	}
+	g.runners = nil
+
+	if g.commands != nil {
+		g.commands.close()
+	}
+	if g.ring != nil {
+		g.ring.Close()
+		g.ring = nil
+	}
+	if g.ringFd >= 0 {
+		closeFd(g.ringFd)
+		g.ringFd = -1
+	}
+}
+
+// ioLoop primes all queues and then demultiplexes completions by queue ID.
+func (g *Group) ioLoop(started chan<- error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	defer close(g.commands.done)
+	defer func() {
+		for _, runner := range g.runners {
+			runner.stopWorkers()
+		}
+	}()
+	g.commands.cpu.attach()
+	defer g.commands.cpu.detach()
+
+	// One thread serves every queue; pin it like queue 0 would be pinned.
+	g.runners[0].pinCPU()
+	setProfileLabels(g.ctx, g.runners[0].deviceID, "shared")
+
+	primeErr := g.ring.Enable()
+	if primeErr == nil {
+		primeErr = g.commands.arm(g.ring)
+	}
+	for _, runner := range g.runners {
+		if primeErr != nil {
+			break
+		}
+		if err := runner.Prime(); err != nil {
+			primeErr = fmt.Errorf("failed to prime queue %d: %w", runner.queueID, err)
+		}
+	}
+	started <- primeErr
+	if primeErr != nil {
+		g.commands.err = primeErr
+		return
+	}
+
+	if g.logger != nil {
+		g.logger.Printf("Shared io_uring ready for %d queues", len(g.runners))
+	}
+
+	for {
+		select {
+		case <-g.ctx.Done():
+			if g.logger != nil {
+				g.logger.Debugf("Shared I/O loop stopping")
+			}
+			return
+		default:
+			if err := g.processRequests(); err != nil {
+				if g.logger != nil {
+					g.logger.Printf("Shared I/O loop: Error processing requests: %v", err)
+				}
+				g.commands.err = err
+				return
+			}
+			if g.stopping {
+				if g.logger != nil {
+					g.logger.Debugf("Shared I/O loop stopping")
+				}
+				return
+			}
+		}
+	}
+}
+
+// handleCommands runs pending commands, commits every queue's finished
+// worker requests and re-arms the wakeup poll unless the group is stopping.
+func (g *Group) handleCommands() error {
+	stop := g.commands.receive()
+	for _, runner := range g.runners {
+		if err := runner.commitFinished(); err != nil {
+			return err
+		}
+	}
+	if stop {
+		g.stopping = true
+		return nil
+	}
+	return g.commands.arm(g.ring)
+}
+
+// processRequests waits for completions on the shared ring, routes each to
+// the runner named in its userData, and flushes all resulting SQEs at once.
+func (g *Group) processRequests() error {
+	completions, err := g.ring.WaitForCompletion(0)
+	if err != nil {
+		return fmt.Errorf("failed to wait for completions: %w", err)
+	}
+	g.runners[0].checkCQOverflow(g.ring)
+
+	for _, r := range g.runners {
+		r.beginBatch()
+	}
+	for _, completion := range completions {
+		if completion == nil {
+			continue
+		}
+		if completion.UserData() == udWakeup {
+			if err := g.handleCommands(); err != nil {
+				return err
+			}
+			continue
+		}
+		qid := int(queueFromUserData(completion.UserData()))
+		if qid >= len(g.runners) {
+			continue
+		}
+		if err := g.runners[qid].handleResult(completion); err != nil {
+			return err
+		}
+	}
+
+	if _, err := g.ring.FlushSubmissions(); err != nil {
+		return fmt.Errorf("failed to flush submissions: %w", err)
+	}
+	for _, r := range g.runners {
+		r.endBatch()
+	}
+	return retryDeferred(g.ring, g.runners...)
+}
@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// newTestGroup builds a group of test runners that share one fakeRing
+func newTestGroup(t *testing.T, queues, depth int) (*Group, []*testRunner, *fakeRing) {
+	t.Helper()
+	ring := &fakeRing{}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	g := &Group{ring: ring, ringFd: -1, ctx: ctx, cancel: cancel}
+	var trs []*testRunner
+	for q := 0; q < queues; q++ {
+		tr := newTestRunner(t, Config{QueueID: uint16(q), Depth: depth, Backend: newMockBackend(1 << 20)})
+		tr.ring = ring
+		tr.Runner.ring = ring
+		tr.Runner.sharedRing = true
+		g.runners = append(g.runners, tr.Runner)
+		trs = append(trs, tr)
+	}
+	return g, trs, ring
+}
+
+func TestGroupDemuxesCompletionsByQueue(t *testing.T) {
+	g, trs, ring := newTestGroup(t, 2, 4)
+
+	for _, tr := range trs {
+		for tag := range tr.tagStates {
+			tr.tagStates[tag] = TagStateInFlightFetch
+		}
+	}
+
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	trs[1].descs[2] = read
+	trs[0].descs[3] = read
+	ring.completions = []uring.Result{
+		fakeResult{userData: udOpFetch | 1<<16 | 2},
+		fakeResult{userData: udOpFetch | 0<<16 | 3},
+	}
+
+	if err := g.processRequests(); err != nil {
+		t.Fatalf("processRequests: %v", err)
+	}
+
+	if len(ring.prepared) != 2 {
+		t.Fatalf("prepared %d commits, want 2", len(ring.prepared))
+	}
+	want := []struct{ qid, tag uint16 }{{1, 2}, {0, 3}}
+	for i, w := range want {
+		got := ring.prepared[i].ioCmd
+		if got.QID != w.qid || got.Tag != w.tag {
+			t.Errorf("commit %d went to q%d/tag%d, want q%d/tag%d", i, got.QID, got.Tag, w.qid, w.tag)
+		}
+		if queueFromUserData(ring.prepared[i].userData) != w.qid {
+			t.Errorf("commit %d userData %#x does not encode queue %d", i, ring.prepared[i].userData, w.qid)
+		}
+	}
+	if trs[1].tagStates[2] != TagStateInFlightCommit || trs[0].tagStates[3] != TagStateInFlightCommit {
+		t.Error("tag states not advanced on the owning runners")
+	}
+	if trs[0].tagStates[2] != TagStateInFlightFetch {
+		t.Error("completion for queue 1 touched queue 0's tag state")
+	}
+}
+
+func TestGroupIgnoresUnknownQueue(t *testing.T) {
+	g, _, ring := newTestGroup(t, 1, 2)
+	ring.completions = []uring.Result{fakeResult{userData: 5 << 16}}
+
+	if err := g.processRequests(); err != nil {
+		t.Fatalf("processRequests: %v", err)
+	}
+	if len(ring.prepared) != 0 {
+		t.Errorf("prepared %d commands for an unknown queue", len(ring.prepared))
+	}
+}
+
+func TestNewGroupValidatesConfigs(t *testing.T) {
+	if _, err := NewGroup(context.Background(), nil); err == nil {
+		t.Error("NewGroup(nil) succeeded")
+	}
+	if _, err := NewGroup(context.Background(), []Config{{Depth: 1}}); err == nil {
+		t.Error("NewGroup without CharFd succeeded")
+	}
+}
@@ -6,8 +6,15 @@ import "sync"
 // Uses size-bucketed pools with power-of-2 sizes (128KB, 256KB, 512KB, 1MB)
 // to balance memory efficiency with allocation reduction.
 //
-// The 64KB case is not pooled because runner.go uses mmap'd per-tag buffers
-// for I/O <= 64KB. This pool handles the overflow case (64KB < size <= 1MB).
+// Requests are served in the mmap'd per-tag buffers, and ones larger than a
+// tag buffer (64KB) are rejected, so the pool only supplies the scratch
+// copies of requests under an IOTimeout (see Runner.callWithTimeout).
+//
+// io_uring provided buffer rings (IORING_REGISTER_PBUF_RING) are not a
+// replacement: they supply buffers to io_uring ops issued with
+// IOSQE_BUFFER_SELECT, and the data never moves through such an op here.
+// The kernel copies it to and from the tag buffers for FETCH and COMMIT,
+// and backends are called with Go slices.
 //
 // Uses *[]byte pattern to avoid sync.Pool interface allocation overhead.
 
@@ -0,0 +1,121 @@
+package queue
+
+import (
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+const (
+	// readAheadStreams is how many sequential streams a queue follows at
+	// once; the least recently read one is forgotten for a new stream.
+	readAheadStreams = 8
+
+	// readAheadTrigger is how many back-to-back reads make a stream, so a
+	// single read next to another one does not start a prefetch.
+	readAheadTrigger = 3
+
+	// minReadAheadWindow is the first window hinted for a new stream. It
+	// doubles with every hint up to the maximum.
+	minReadAheadWindow = 128 << 10
+)
+
+// stream is a run of reads, each starting where the last one ended.
+type stream struct {
+	next   int64  // where the next read of the stream starts
+	ahead  int64  // end of the range already hinted
+	window int64  // size of the next hint, 0 until the stream is confirmed
+	reads  int    // back-to-back reads so far
+	used   uint64 // detector clock at the last read, 0 = free slot
+}
+
+// streamDetector spots sequential read streams among a queue's reads. Only
+// the queue's I/O loop uses it, so it is not locked.
+type streamDetector struct {
+	streams   [readAheadStreams]stream
+	clock     uint64
+	maxWindow int64
+}
+
+// newStreamDetector returns nil if maxWindow is negative.
+func newStreamDetector(maxWindow int) *streamDetector {
+	if maxWindow < 0 {
+		return nil
+	}
+	if maxWindow == 0 {
+		maxWindow = constants.DefaultMaxReadAhead
+	}
+	return &streamDetector{maxWindow: int64(maxWindow)}
+}
+
+// observe records a read of length bytes at off and returns the range to
+// hint, or a zero length if there is nothing to hint. A stream is hinted
+// again once the reader is within half a window of the end of the last
+// hint, so the prefetch stays ahead without being repeated.
+func (d *streamDetector) observe(off, length int64) (hintOff, hintLen int64) {
+	d.clock++
+	s := d.find(off)
+	if s == nil {
+		s = d.oldest()
+		*s = stream{next: off + length, reads: 1, used: d.clock}
+		return 0, 0
+	}
+	s.next = off + length
+	s.reads++
+	s.used = d.clock
+	if s.reads < readAheadTrigger {
+		return 0, 0
+	}
+	if s.window == 0 {
+		s.window = min(max(minReadAheadWindow, 2*length), d.maxWindow)
+	}
+	if s.ahead-s.next >= s.window/2 {
+		return 0, 0
+	}
+	start := max(s.ahead, s.next)
+	end := s.next + s.window
+	s.ahead = end
+	s.window = min(2*s.window, d.maxWindow)
+	return start, end - start
+}
+
+// find returns the stream that a read at off continues, if any.
+func (d *streamDetector) find(off int64) *stream {
+	for i := range d.streams {
+		if s := &d.streams[i]; s.used != 0 && s.next == off {
+			return s
+		}
+	}
+	return nil
+}
+
+// oldest returns a free slot or else the least recently read stream.
+func (d *streamDetector) oldest() *stream {
+	oldest := &d.streams[0]
+	for i := range d.streams {
+		if d.streams[i].used < oldest.used {
+			oldest = &d.streams[i]
+		}
+	}
+	return oldest
+}
+
+// hintReadAhead feeds a READ to the stream detector and passes the range
+// it predicts to the backend, if the backend takes read-ahead hints.
+func (r *Runner) hintReadAhead(desc uapi.UblksrvIODesc) {
+	if r.readAhead == nil || desc.GetOp() != uapi.UBLK_IO_OP_READ {
+		return
+	}
+	if r.gate != nil {
+		r.gate.RLock()
+		defer r.gate.RUnlock()
+	}
+	backend, ok := r.currentBackend().(interfaces.ReadAheadBackend)
+	if !ok {
+		return
+	}
+	off, length := r.readAhead.observe(int64(desc.StartSector)<<9, int64(desc.NrSectors)<<9)
+	if length = min(length, backend.Size()-off); length > 0 {
+		backend.ReadAhead(off, length)
+	}
+}
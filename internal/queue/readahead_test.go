@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+func TestStreamDetectorSequential(t *testing.T) {
+	d := newStreamDetector(1 << 20)
+	const length = 64 << 10
+
+	var hints [][2]int64
+	for i := range int64(32) {
+		if off, n := d.observe(i*length, length); n > 0 {
+			hints = append(hints, [2]int64{off, n})
+		}
+	}
+	if len(hints) == 0 || hints[0][0] != 3*length {
+		t.Fatalf("hints = %v, want the first after the third read", hints)
+	}
+	// Hints are contiguous, never overlap and grow to the cap
+	for i := 1; i < len(hints); i++ {
+		if hints[i][0] != hints[i-1][0]+hints[i-1][1] {
+			t.Errorf("hint %d at %d does not follow %v", i, hints[i][0], hints[i-1])
+		}
+	}
+	if last := hints[len(hints)-1]; last[1] > 1<<20 {
+		t.Errorf("hint of %d bytes exceeds the 1MiB cap", last[1])
+	}
+}
+
+func TestStreamDetectorRandom(t *testing.T) {
+	d := newStreamDetector(0)
+	for _, off := range []int64{0, 1 << 30, 4096, 1 << 20, 8192 * 3, 1 << 25} {
+		if _, n := d.observe(off, 4096); n > 0 {
+			t.Errorf("random read at %d produced a hint", off)
+		}
+	}
+}
+
+func TestStreamDetectorInterleaved(t *testing.T) {
+	d := newStreamDetector(0)
+	hinted := map[int64]bool{}
+	for i := range int64(4) {
+		for _, base := range []int64{0, 1 << 30} {
+			if off, n := d.observe(base+i*4096, 4096); n > 0 {
+				hinted[off&^(1<<30-1)] = true
+			}
+		}
+	}
+	if !hinted[0] || !hinted[1<<30] {
+		t.Errorf("hinted streams = %v, want both", hinted)
+	}
+}
+
+func TestStreamDetectorDisabled(t *testing.T) {
+	if newStreamDetector(-1) != nil {
+		t.Error("negative MaxReadAhead did not disable the detector")
+	}
+}
+
+// mockReadAheadBackend records read-ahead hints
+type mockReadAheadBackend struct {
+	*mockBackend
+	hints [][2]int64
+}
+
+func (m *mockReadAheadBackend) ReadAhead(offset, length int64) {
+	m.hints = append(m.hints, [2]int64{offset, length})
+}
+
+func TestRunnerReadAhead(t *testing.T) {
+	backend := &mockReadAheadBackend{mockBackend: newMockBackend(1 << 20)}
+	tr := newTestRunner(t, Config{Depth: 1, Backend: backend})
+
+	// Sequential 64KiB reads up to the end of the 1MiB device
+	for sector := uint64(0); sector < 2048; sector += 128 {
+		tr.issue(t, 0, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: sector, NrSectors: 128})
+	}
+	if len(backend.hints) == 0 {
+		t.Fatal("no read-ahead hints for a sequential stream")
+	}
+	for _, h := range backend.hints {
+		if h[0]+h[1] > 1<<20 {
+			t.Errorf("hint %v reaches past the device", h)
+		}
+	}
+
+	// Writes never feed the detector
+	hints := len(backend.hints)
+	for sector := uint64(0); sector < 1024; sector += 128 {
+		tr.issue(t, 0, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: sector, NrSectors: 128})
+	}
+	if len(backend.hints) != hints {
+		t.Error("writes produced read-ahead hints")
+	}
+}
@@ -2,18 +2,21 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
 
-	"golang.org/x/sys/unix"
-
 	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/devnode"
 	"github.com/ehrlich-b/go-ublk/internal/interfaces"
 	"github.com/ehrlich-b/go-ublk/internal/uapi"
 	"github.com/ehrlich-b/go-ublk/internal/uring"
@@ -48,24 +51,96 @@ type Runner struct {
 	deviceID     uint32
 	queueID      uint16
 	depth        int
-	blockSize    int // Logical block size in bytes
-	backend      interfaces.Backend
+	backend      atomic.Pointer[interfaces.Backend]
 	charDeviceFd int
-	ring         uring.Ring
+	ring         uring.QueueRing
+	sharedRing   bool           // ring is owned by a Group, not this runner
 	descPtr      unsafe.Pointer // mmap'd descriptor array
 	bufPtr       unsafe.Pointer // I/O buffer base
+	bufRegion    []byte         // The memory at bufPtr, nil if the runner did not allocate it
 	ctx          context.Context
 	cancel       context.CancelFunc
 	logger       interfaces.Logger
 	observer     interfaces.Observer // Metrics observer (may be nil)
 	cpuAffinity  []int               // CPU affinity mask (nil = no affinity)
-	// Per-tag state tracking for proper serialization
-	tagStates  []TagState
-	tagMutexes []sync.Mutex // Per-tag mutexes to prevent double submission
+	// Protocol events, if the observer implements QueueObserver
+	queueObserver  interfaces.QueueObserver
+	stallThreshold time.Duration
+	ownedAt        []time.Time // when each tag's current request was fetched (queueObserver or phaseObserver only)
+	phaseObserver  interfaces.PhaseObserver
+	committedAt    []time.Time // when each tag's last commit was prepared (phaseObserver only)
+	// Request validation and error reporting
+	maxIOBytes  int                       // Largest READ/WRITE accepted, at most one tag buffer
+	errnoMapper func(error) syscall.Errno // nil = default mapping only
+	// Held shared around backend calls (nil = none); see Config.Gate
+	gate *sync.RWMutex
+	// Caps READ and WRITE bytes in the backend (nil = none); see Config.InFlightBytes
+	budget *ByteBudget
+	// Orders FLUSH after writes on every queue (nil = own queue only); see Config.FlushBarrier
+	barrier *WriteBarrier
+	// Bound on each backend call (0 = none); see Config.IOTimeout
+	ioTimeout time.Duration
+	// Memory for I/O buffers (nil = anonymous mmap and the shared BufferPool); see Config.BufferAllocator
+	allocator interfaces.BufferAllocator
+	// Counts requests handed to the backend (nil = none); see Config.Activity
+	activity *atomic.Uint64
+	// Told about every range written or discarded (nil = none); see Config.OnWrite
+	onWrite func(offset, length int64)
+	// Serves requests in place of the backend (nil = none); see Config.RawHandler
+	raw func(req *interfaces.RawRequest) error
+	// Told about every request served (nil = none); see Config.Trace
+	trace TraceFunc
+	// Serves ops the runner does not know (nil = fail them); see Config.UnknownOp
+	unknownOp func(req *interfaces.RawRequest) error
+	// Told about every request with an op the runner does not know (nil = none); see Config.OnUnknownOp
+	onUnknownOp func(queueID uint16, op uint8)
+	// Told about every request with flags the runner does not know (nil = none); see Config.OnUnknownFlags
+	onUnknownFlags func(queueID uint16, flags uint32)
+	// Told about CQ overflows (nil = none); see Config.OnCQOverflow
+	onCQOverflow func(queueID uint16, n uint64)
+	cqOverflows  uint64 // The ring's overflow count when last checked; loop only
+	// Sequential read detection for ReadAheadBackend (nil = disabled)
+	readAhead *streamDetector
+	// Discard limits advertised to the kernel
+	discardGranularity int64 // Required discard alignment in bytes (0 = none)
+	maxDiscardBytes    int64 // Largest range passed to a single Discard call (0 = unlimited)
+	// Per-tag state. Owned by the goroutine running the I/O loop and never
+	// locked; other goroutines go through commands.
+	tagStates []TagState
+	owned     int           // tags in TagStateOwned
+	committed int           // commits prepared since the loop last flushed
+	commands  *commandQueue // nil until Start
+	stopping  bool          // set by a Stop command; loop exits after the batch
+	loop      *commandQueue // commands of the loop serving this queue (own or Group's)
+	// Pipelined backend dispatch (workers > 0). Owned tags are handed to
+	// worker goroutines; finished requests come back on finished and the
+	// loop, woken through loop, prepares their commits.
+	workers int
+	// Tag use at each request's arrival; see DepthStats
+	depthSamples atomic.Uint64
+	depthSum     atomic.Uint64
+	depthFull    atomic.Uint64
+	depthPeak    atomic.Uint32
+	// Tags in use now, for the Observer's periodic samples; only the loop stores
+	inUse         atomic.Int32
+	depthInterval time.Duration // 0 = no sampling
+	jobs          chan ioRequest
+	finished      chan ioRequest
+	inflight      sync.WaitGroup // dispatched requests whose worker has not signalled yet
+	abandoned     bool           // an abort left workers in the backend; set before the loop exits
+	// Commits that found the submission ring full. Their tags stay Owned
+	// until the loop flushes the ring and prepares them again.
+	deferred []deferredCommit
 	// Pre-allocated per-tag command structs to avoid hot path allocations
 	ioCmds []uapi.UblksrvIOCmd
 }
 
+// deferredCommit is a COMMIT_AND_FETCH_REQ waiting for room in the ring.
+type deferredCommit struct {
+	tag    uint16
+	result int32
+}
+
 const (
 	descOpFlagsOffset     = uintptr(0)
 	descNrSectorsOffset   = uintptr(4)
@@ -73,16 +148,206 @@ const (
 	descAddrOffset        = uintptr(16)
 )
 
+// TraceFunc is the type of Config.Trace.
+type TraceFunc func(
+	queueID, tag uint16, desc uapi.UblksrvIODesc, start time.Time, latency time.Duration, errno syscall.Errno,
+)
+
 type Config struct {
 	DevID       uint32
 	QueueID     uint16
 	Depth       int
-	BlockSize   int // Logical block size in bytes (default: 512)
 	Backend     interfaces.Backend
 	Logger      interfaces.Logger
 	Observer    interfaces.Observer // Metrics observer (may be nil)
 	CPUAffinity []int               // Optional CPU affinity (nil = no affinity)
 	CharFd      int                 // Character device fd (if 0, will open device)
+
+	// CharPath is the character device opened when CharFd is 0
+	// (default: uapi.UblkDevicePath(DevID)), and CharOpenTimeout how long
+	// to wait for udev to create it (default: constants.DeviceNodeTimeout).
+	CharPath        string
+	CharOpenTimeout time.Duration
+
+	// Workers is the number of goroutines per queue that run backend calls.
+	// With 0 the backend is called inline on the queue thread and a batch's
+	// commits wait for every request in it. With Workers > 0 requests in a
+	// batch run concurrently and each commit is prepared as soon as its
+	// backend call returns, while the loop keeps fetching.
+	Workers int
+
+	// MaxIOBytes is the negotiated max_io_buf_bytes. READ and WRITE
+	// requests larger than this, or than a tag buffer, fail with EINVAL
+	// (0 = constants.IOBufferSizePerTag).
+	MaxIOBytes int
+
+	// ErrnoMapper, if set, chooses the errno reported to the kernel for a
+	// failed request. Returning 0 falls back to the default mapping.
+	ErrnoMapper func(error) syscall.Errno
+
+	// StallThreshold is reported to a QueueObserver when a request stays
+	// owned longer than this (0 = constants.DefaultStallThreshold).
+	StallThreshold time.Duration
+
+	// DepthSampleInterval is how often the tags in use are passed to
+	// Observer.ObserveQueueDepth (0 = constants.DefaultDepthSampleInterval,
+	// negative = never).
+	DepthSampleInterval time.Duration
+
+	// RawHandler, if set, is called for every request that would go to
+	// the Backend, custom ops included, in its place. Backend then only
+	// sizes the device; requests are still validated against its Size.
+	RawHandler func(req *interfaces.RawRequest) error
+
+	// BufferAllocator, if set, supplies the per-tag buffer region and the
+	// scratch buffers for requests that cannot use it, in place of
+	// anonymous mmap and the shared BufferPool, e.g. for pinned or
+	// NUMA-local memory.
+	BufferAllocator interfaces.BufferAllocator
+
+	// Ring, if set, is an io_uring shared with other queues of the same
+	// device (see Group). The runner neither creates nor closes it.
+	Ring uring.QueueRing
+
+	// NewRing, if set, creates the runner's ring (a Group's, from its
+	// first queue's config) in place of uring.NewRing.
+	NewRing func(uring.Config) (uring.QueueRing, error)
+
+	// IOWQ limits the kernel worker threads of the ring the runner
+	// creates; a Group uses its first queue's.
+	IOWQ uring.IOWQConfig
+
+	// AttachWQ, if set, is a ring whose kernel workers the ring the runner
+	// creates shares (see uring.Config.AttachWQ); a Group uses its first
+	// queue's.
+	AttachWQ uring.QueueRing
+
+	// MaxReadAhead caps the window hinted to a ReadAheadBackend when the
+	// queue sees a sequential read stream (0 = constants.DefaultMaxReadAhead,
+	// negative = no hints).
+	MaxReadAhead int
+
+	// Discard limits (only used if Backend implements DiscardBackend)
+	DiscardGranularity uint32 // Discard granularity in bytes (0 = no alignment check)
+	MaxDiscardSectors  uint32 // Max 512-byte sectors per Discard call (0 = unlimited)
+
+	// IOTimeout, if set, bounds every READ, WRITE, FLUSH, DISCARD and
+	// WRITE_ZEROES backend call. A request whose call has not returned by
+	// then fails with ETIMEDOUT; the call is left to finish in the
+	// background on a copy of the data, holding Gate until it does.
+	// RequestBackend calls see the deadline in Request.Deadline, and the
+	// context-taking FLUSH, DISCARD and WRITE_ZEROES calls in their ctx.
+	IOTimeout time.Duration
+
+	// Gate, if set, is held shared around every backend call. Holding it
+	// exclusively waits for calls in progress and holds back new ones, so
+	// the backend can be snapshotted with no request half applied.
+	Gate *sync.RWMutex
+
+	// InFlightBytes, if set, caps the READ and WRITE bytes in backend calls
+	// at once. A request over it waits before its call, holding back the
+	// queue's loop or a worker, and takes its bytes until the call returns.
+	// A device's queues share one.
+	InFlightBytes *ByteBudget
+
+	// FlushBarrier, if set, makes a FLUSH wait for the WRITE, DISCARD and
+	// WRITE_ZEROES calls in flight on every queue sharing it before it
+	// calls the backend, so it covers writes the kernel has not yet seen
+	// complete on other queues too. Without it a FLUSH only follows the
+	// writes its own queue has finished.
+	FlushBarrier *WriteBarrier
+
+	// Activity, if set, is incremented for every request handed to the
+	// backend, so background work can tell when the device is idle.
+	Activity *atomic.Uint64
+
+	// OnWrite, if set, is called with the byte range of every WRITE and
+	// DISCARD once the backend call returns, failed ones included, and
+	// with Gate still held. It must be safe for concurrent use.
+	OnWrite func(offset, length int64)
+
+	// Trace, if set, is called after every request doIO serves (READ,
+	// WRITE, FLUSH, DISCARD, WRITE_ZEROES and unsupported ops) with its
+	// tag, descriptor, start time, latency and the errno committed for it
+	// (0 on success). It must be safe for concurrent use.
+	Trace TraceFunc
+
+	// OnCQOverflow, if set, is called from the I/O loop with the number of
+	// times completions overflowed the ring's CQ since the last call, if
+	// the ring counts them (uring.OverflowCounter). The queue's ring has a
+	// CQ twice its SQ, and a tag has at most one command in the kernel, so
+	// this only fires for rings sized some other way (Config.NewRing). A
+	// Group reports its shared ring's overflows as its first queue's.
+	OnCQOverflow func(queueID uint16, n uint64)
+
+	// UnknownOp, if set, serves requests whose op the runner does not
+	// handle, such as ops added by a newer kernel, in place of failing
+	// them with ErrUnknownOp. req.Data is nil. With RawHandler set every
+	// op goes there instead.
+	UnknownOp func(req *interfaces.RawRequest) error
+
+	// OnUnknownOp, if set, is called for every request whose op the
+	// runner does not handle, before UnknownOp. It must be safe for
+	// concurrent use.
+	OnUnknownOp func(queueID uint16, op uint8)
+
+	// OnUnknownFlags, if set, is called with the UBLK_IO_F_* bits the
+	// runner does not know for every request that carries some. The
+	// request is served as if they were clear. It must be safe for
+	// concurrent use.
+	OnUnknownFlags func(queueID uint16, flags uint32)
+}
+
+// knownIOFlags are the UBLK_IO_F_* bits the runner knows. The rest come
+// from a newer kernel.
+const knownIOFlags = uapi.UBLK_IO_F_FAILFAST_DEV | uapi.UBLK_IO_F_FAILFAST_TRANSPORT |
+	uapi.UBLK_IO_F_FAILFAST_DRIVER | uapi.UBLK_IO_F_META | uapi.UBLK_IO_F_FUA |
+	uapi.UBLK_IO_F_NOUNMAP | uapi.UBLK_IO_F_SWAP
+
+// ErrUnknownOp fails requests whose op the runner does not handle. It
+// wraps EOPNOTSUPP, the errno the kernel completes them with.
+var ErrUnknownOp = fmt.Errorf("unknown operation: %w", syscall.EOPNOTSUPP)
+
+// depthSampleInterval returns how often to sample the tags in use, or 0
+// if there is no Observer to sample for.
+func (c Config) depthSampleInterval() time.Duration {
+	switch {
+	case c.Observer == nil || c.DepthSampleInterval < 0:
+		return 0
+	case c.DepthSampleInterval == 0:
+		return constants.DefaultDepthSampleInterval
+	}
+	return c.DepthSampleInterval
+}
+
+// newRing creates a ring with NewRing, or uring.NewRing if it is unset.
+func (c Config) newRing(config uring.Config) (uring.QueueRing, error) {
+	if c.NewRing != nil {
+		return c.NewRing(config)
+	}
+	return uring.NewRing(config)
+}
+
+// maxIOBytes returns the largest data transfer the runner accepts: the
+// negotiated limit, capped at the size of one tag buffer.
+func (c Config) maxIOBytes() int {
+	if c.MaxIOBytes <= 0 {
+		return constants.IOBufferSizePerTag
+	}
+	return min(c.MaxIOBytes, constants.IOBufferSizePerTag)
+}
+
+// maxDiscardBytes converts the MaxDiscardSectors limit into a byte count that
+// is a multiple of the discard granularity, so split chunks stay aligned.
+func (c Config) maxDiscardBytes() int64 {
+	if c.MaxDiscardSectors == 0 {
+		return 0
+	}
+	limit := int64(c.MaxDiscardSectors) << 9 // Kernel discard limits are in 512-byte sectors
+	if g := int64(c.DiscardGranularity); g > 0 && limit >= g {
+		limit -= limit % g
+	}
+	return limit
 }
 
 // NewRunner creates a new queue runner
@@ -97,72 +362,68 @@ func NewRunner(ctx context.Context, config Config) (*Runner, error) {
 	// Use provided fd or open the character device
 	if config.CharFd > 0 {
 		// Use the provided fd (duplicate it so each queue has its own)
-		fd, err = syscall.Dup(config.CharFd)
+		fd, err = dupFd(config.CharFd)
 		if err != nil {
 			return nil, fmt.Errorf("failed to dup char fd: %v", err)
 		}
 	} else {
-		// The character device (/dev/ublkcN) should exist after ADD_DEV.
-		// We may need to retry briefly until udev creates the node.
-		charPath := uapi.UblkDevicePath(config.DevID)
+		// The character device (/dev/ublkcN) should exist after ADD_DEV,
+		// but udev may not have created the node yet.
+		charPath := config.CharPath
+		if charPath == "" {
+			charPath = uapi.UblkDevicePath(config.DevID)
+		}
+		timeout := config.CharOpenTimeout
+		if timeout <= 0 {
+			timeout = constants.DeviceNodeTimeout
+		}
 		if config.Logger != nil {
 			config.Logger.Debugf("opening character device %s", charPath)
 		}
-
-		// Wait up to ~5s for udev to create the character device after ADD_DEV.
-		// udev typically creates the node in <100ms, but slow systems or high
-		// udev queue depth can cause delays. 50 * 100ms = 5s is generous.
-		const maxRetries = 50
-		const retryDelayNs = 100 * 1_000_000 // 100ms in nanoseconds
-		for i := 0; i < maxRetries; i++ {
-			fd, err = syscall.Open(charPath, syscall.O_RDWR, 0)
-			if err == nil {
-				if config.Logger != nil {
-					config.Logger.Debugf("opened %s successfully, fd=%d", charPath, fd)
-				}
-				break
-			}
-			if err != syscall.ENOENT {
-				return nil, fmt.Errorf("failed to open %s: %v", charPath, err)
-			}
-			ts := syscall.Timespec{Sec: 0, Nsec: retryDelayNs}
-			_ = syscall.Nanosleep(&ts, nil) // Best effort sleep
-		}
+		fd, err = devnode.Open(ctx, charPath, timeout)
 		if err != nil {
-			return nil, fmt.Errorf("character device did not appear: %s", charPath)
+			return nil, err
 		}
 	}
 
-	// Create io_uring for this queue
-	ringConfig := uring.Config{
-		Entries: uint32(config.Depth),
-		FD:      int32(fd),
-		Flags:   0,
-	}
+	// Create io_uring for this queue unless one is shared with us
+	ring := config.Ring
+	if ring == nil {
+		// Only ioLoop's pinned thread touches the ring
+		ringConfig := uring.Config{
+			Entries:      uint32(config.Depth) + 1 + constants.RingHeadroom, // +1 for the command wakeup poll
+			FD:           int32(fd),
+			SingleIssuer: true,
+			IOWQ:         config.IOWQ,
+			AttachWQ:     config.AttachWQ,
+		}
 
-	if config.Logger != nil {
-		config.Logger.Debugf("creating io_uring for queue with fd=%d", fd)
-	}
-	ring, err := uring.NewRing(ringConfig)
-	if err != nil {
-		syscall.Close(fd)
-		return nil, fmt.Errorf("failed to create io_uring: %v", err)
-	}
-	if config.Logger != nil {
-		config.Logger.Debugf("io_uring created successfully for queue")
+		if config.Logger != nil {
+			config.Logger.Debugf("creating io_uring for queue with fd=%d", fd)
+		}
+		ring, err = config.newRing(ringConfig)
+		if err != nil {
+			closeFd(fd)
+			return nil, fmt.Errorf("failed to create io_uring: %v", err)
+		}
+		if config.Logger != nil {
+			config.Logger.Debugf("io_uring created successfully for queue")
+		}
 	}
 
 	// Memory map the descriptor array and I/O buffers
 	if config.Logger != nil {
 		config.Logger.Debugf("mmapping queues for fd=%d", fd)
 	}
-	descPtr, bufPtr, err := mmapQueues(fd, config.QueueID, config.Depth)
+	descPtr, bufRegion, err := mmapQueues(fd, config.QueueID, config.Depth, config.BufferAllocator)
 	if err != nil {
 		if config.Logger != nil {
 			config.Logger.Debugf("mmapQueues failed: %v", err)
 		}
-		ring.Close()
-		syscall.Close(fd)
+		if config.Ring == nil {
+			ring.Close()
+		}
+		closeFd(fd)
 		return nil, fmt.Errorf("failed to mmap queues: %v", err)
 	}
 	if config.Logger != nil {
@@ -171,45 +432,90 @@ func NewRunner(ctx context.Context, config Config) (*Runner, error) {
 
 	ctx, cancel := context.WithCancel(ctx)
 
-	// Default block size to 512 if not specified
-	blockSize := config.BlockSize
-	if blockSize <= 0 {
-		blockSize = 512
-	}
-
 	runner := &Runner{
 		deviceID:     config.DevID,
 		queueID:      config.QueueID,
 		depth:        config.Depth,
-		blockSize:    blockSize,
-		backend:      config.Backend,
 		charDeviceFd: fd,
 		ring:         ring,
+		sharedRing:   config.Ring != nil,
 		descPtr:      descPtr,
-		bufPtr:       bufPtr,
+		bufPtr:       unsafe.Pointer(&bufRegion[0]),
+		bufRegion:    bufRegion,
+		allocator:    config.BufferAllocator,
 		ctx:          ctx,
 		cancel:       cancel,
 		logger:       config.Logger,
 		observer:     config.Observer,
 		cpuAffinity:  config.CPUAffinity,
+		workers:      config.Workers,
 		tagStates:    make([]TagState, config.Depth),
-		tagMutexes:   make([]sync.Mutex, config.Depth),
 		ioCmds:       make([]uapi.UblksrvIOCmd, config.Depth),
+
+		discardGranularity: int64(config.DiscardGranularity),
+		maxDiscardBytes:    config.maxDiscardBytes(),
+		errnoMapper:        config.ErrnoMapper,
+		maxIOBytes:         config.maxIOBytes(),
+		ioTimeout:          config.IOTimeout,
+		depthInterval:      config.depthSampleInterval(),
+		gate:               config.Gate,
+		budget:             config.InFlightBytes,
+		barrier:            config.FlushBarrier,
+		activity:           config.Activity,
+		onWrite:            config.OnWrite,
+		raw:                config.RawHandler,
+		trace:              config.Trace,
+		onCQOverflow:       config.OnCQOverflow,
+		unknownOp:          config.UnknownOp,
+		onUnknownOp:        config.OnUnknownOp,
+		onUnknownFlags:     config.OnUnknownFlags,
+		readAhead:          newStreamDetector(config.MaxReadAhead),
 	}
 
+	runner.backend.Store(&config.Backend)
+	runner.setQueueObserver(config)
+
 	return runner, nil
 }
 
+// setQueueObserver enables protocol events if the observer supports them.
+func (r *Runner) setQueueObserver(config Config) {
+	if po, ok := config.Observer.(interfaces.PhaseObserver); ok {
+		r.phaseObserver = po
+		r.ownedAt = make([]time.Time, r.depth)
+		r.committedAt = make([]time.Time, r.depth)
+	}
+	qo, ok := config.Observer.(interfaces.QueueObserver)
+	if !ok {
+		return
+	}
+	r.queueObserver = qo
+	r.stallThreshold = config.StallThreshold
+	if r.stallThreshold <= 0 {
+		r.stallThreshold = constants.DefaultStallThreshold
+	}
+	r.ownedAt = make([]time.Time, r.depth)
+}
+
 // Start begins processing I/O requests
 func (r *Runner) Start() error {
 	if r.logger != nil {
 		r.logger.Printf("Starting queue %d for device %d", r.queueID, r.deviceID)
 	}
 
+	commands, err := newCommandQueue()
+	if err != nil {
+		return err
+	}
+	r.commands = commands
+	r.loop = commands
+	r.startWorkers()
+	r.sampleDepth()
+
 	startErr := make(chan error, 1)
 	go r.ioLoop(startErr)
 
-	err := <-startErr
+	err = <-startErr
 	if err != nil {
 		return fmt.Errorf("failed to prime queue %d: %w", r.queueID, err)
 	}
@@ -219,7 +525,7 @@ func (r *Runner) Start() error {
 // Prime submits initial FETCH_REQ commands to fill the queue.
 // Can now handle START_DEV in progress by checking for EOPNOTSUPP.
 func (r *Runner) Prime() error {
-	if r.charDeviceFd < 0 || r.ring == nil {
+	if r.ring == nil {
 		return fmt.Errorf("runner not initialized")
 	}
 
@@ -239,41 +545,87 @@ func (r *Runner) Prime() error {
 	return nil
 }
 
-// Stop stops the runner
+// Stop stops the runner and, if its I/O loop is running, waits for the loop
+// to exit so the ring and mappings can be released safely.
 func (r *Runner) Stop() error {
 	if r.cancel != nil {
 		r.cancel()
 	}
+	if r.commands != nil {
+		r.commands.stop()
+	}
 	return nil
 }
 
+// StopContext is Stop bounded by ctx. When ctx ends before the loop exits,
+// the loop fails the requests its workers are still serving with EIO and
+// exits without waiting for them. A loop stuck in a backend call on its
+// own thread cannot be interrupted; StopContext then returns
+// ErrStopTimeout shortly after ctx ends.
+func (r *Runner) StopContext(ctx context.Context) error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.commands == nil {
+		return nil
+	}
+	return r.commands.stopContext(ctx)
+}
+
 // Close cleans up resources
 func (r *Runner) Close() error {
 	_ = r.Stop() // Cleanup, ignore error
+	r.release()
+	return nil
+}
 
-	if r.ring != nil {
+// CloseContext is Close with the stop bounded by ctx (see StopContext).
+// If the loop or its workers are left in the backend, the ring, buffers
+// and fds they may still touch are released once they return.
+func (r *Runner) CloseContext(ctx context.Context) error {
+	err := r.StopContext(ctx)
+	if err != nil || r.abandoned {
+		go func() {
+			if r.commands != nil {
+				<-r.commands.done
+			}
+			r.inflight.Wait()
+			r.release()
+		}()
+		return err
+	}
+	r.release()
+	return nil
+}
+
+// release frees the runner's command queue, ring, mappings and fd. The
+// loop and its workers must be done with them.
+func (r *Runner) release() {
+	if r.commands != nil {
+		r.commands.close()
+	}
+
+	if r.ring != nil && !r.sharedRing {
 		r.ring.Close()
 	}
 
-	// Unmap memory-mapped regions
-	if r.descPtr != nil {
+	// Unmap memory-mapped regions. Only a runner on the char device has
+	// them; a simulated one uses its Sim's Go memory.
+	if r.descPtr != nil && r.charDeviceFd >= 0 {
 		descSize := r.depth * int(unsafe.Sizeof(uapi.UblksrvIODesc{}))
-		_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, uintptr(r.descPtr), uintptr(descSize), 0)
+		munmapDescs(r.descPtr, descSize)
 		r.descPtr = nil
 	}
 
-	if r.bufPtr != nil {
-		bufSize := r.depth * constants.IOBufferSizePerTag // 64KB per request buffer
-		_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, uintptr(r.bufPtr), uintptr(bufSize), 0)
-		r.bufPtr = nil
+	if r.bufRegion != nil {
+		freeTagBuffers(r.allocator, r.bufRegion)
+		r.bufPtr, r.bufRegion = nil, nil
 	}
 
 	if r.charDeviceFd >= 0 {
-		syscall.Close(r.charDeviceFd)
+		closeFd(r.charDeviceFd)
 		r.charDeviceFd = -1
 	}
-
-	return nil
 }
 
 // ioLoop is the main I/O processing loop
@@ -282,29 +634,20 @@ func (r *Runner) ioLoop(started chan<- error) {
 	// ublk_drv records one thread per queue and rejects commands from different threads
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
+	defer close(r.commands.done)
+	defer r.stopWorkers()
+	r.commands.cpu.attach()
+	defer r.commands.cpu.detach()
 
-	// Set CPU affinity if configured
-	// Uses round-robin assignment: queue N -> CPU (CPUAffinity[N % len(CPUAffinity)])
-	if len(r.cpuAffinity) > 0 {
-		cpuIdx := r.cpuAffinity[int(r.queueID)%len(r.cpuAffinity)]
-		var mask unix.CPUSet
-		mask.Set(cpuIdx)
-		if err := unix.SchedSetaffinity(0, &mask); err != nil {
-			if r.logger != nil {
-				r.logger.Printf("Queue %d: Failed to set CPU affinity to CPU %d: %v", r.queueID, cpuIdx, err)
-			}
-			// Continue without affinity - not fatal
-		} else if r.logger != nil {
-			r.logger.Debugf("Queue %d: Set CPU affinity to CPU %d", r.queueID, cpuIdx)
-		}
-	}
+	r.pinCPU()
+	setProfileLabels(r.ctx, r.deviceID, strconv.Itoa(int(r.queueID)))
 
 	if r.logger != nil {
 		r.logger.Debugf("Queue %d: Starting I/O loop (pinned to OS thread)", r.queueID)
 	}
 
 	// Check if we're in stub mode
-	if r.charDeviceFd == -1 || r.ring == nil {
+	if r.ring == nil {
 		if started != nil {
 			started <- nil
 		}
@@ -312,8 +655,19 @@ func (r *Runner) ioLoop(started chan<- error) {
 		return
 	}
 
-	// Submit initial FETCH_REQs from the pinned thread to honor kernel expectations
-	primeErr := r.Prime()
+	// Submit initial FETCH_REQs from the pinned thread to honor kernel expectations.
+	// The wakeup poll goes out with them. A ring of our own is enabled
+	// first, making this thread its single issuer.
+	var primeErr error
+	if !r.sharedRing {
+		primeErr = r.ring.Enable()
+	}
+	if primeErr == nil {
+		primeErr = r.commands.arm(r.ring)
+	}
+	if primeErr == nil {
+		primeErr = r.Prime()
+	}
 	if started != nil {
 		started <- primeErr
 	}
@@ -321,6 +675,7 @@ func (r *Runner) ioLoop(started chan<- error) {
 		if r.logger != nil {
 			r.logger.Printf("Queue %d: Failed to prime queue: %v", r.queueID, primeErr)
 		}
+		r.commands.err = primeErr
 		return
 	}
 
@@ -344,18 +699,39 @@ func (r *Runner) ioLoop(started chan<- error) {
 				if r.logger != nil {
 					r.logger.Printf("Queue %d: Error processing requests: %v", r.queueID, err)
 				}
+				r.commands.err = fmt.Errorf("queue %d: %w", r.queueID, err)
+				return
+			}
+			if r.stopping {
+				if r.logger != nil {
+					r.logger.Debugf("Queue %d: I/O loop stopping", r.queueID)
+				}
 				return
 			}
 		}
 	}
 }
 
+// pinCPU applies the configured CPU affinity to the calling thread.
+// Uses round-robin assignment: queue N -> CPU (CPUAffinity[N % len(CPUAffinity)])
+func (r *Runner) pinCPU() {
+	if len(r.cpuAffinity) == 0 {
+		return
+	}
+	cpuIdx := r.cpuAffinity[int(r.queueID)%len(r.cpuAffinity)]
+	if err := setAffinity(cpuIdx); err != nil {
+		if r.logger != nil {
+			r.logger.Printf("Queue %d: Failed to set CPU affinity to CPU %d: %v", r.queueID, cpuIdx, err)
+		}
+		// Continue without affinity - not fatal
+	} else if r.logger != nil {
+		r.logger.Debugf("Queue %d: Set CPU affinity to CPU %d", r.queueID, cpuIdx)
+	}
+}
+
 // submitInitialFetchReq submits the initial FETCH_REQ command (ONLY at startup)
 func (r *Runner) submitInitialFetchReq(tag uint16) error {
 	// Guard against double submission
-	r.tagMutexes[tag].Lock()
-	defer r.tagMutexes[tag].Unlock()
-
 	if r.tagStates[tag] != TagState(0) { // Should be uninitialized
 		return fmt.Errorf("tag %d already initialized (state=%d)", tag, r.tagStates[tag])
 	}
@@ -371,14 +747,16 @@ func (r *Runner) submitInitialFetchReq(tag uint16) error {
 	ioCmd.Addr = uint64(bufferAddr)
 
 	// Encode FETCH operation in userData
-	userData := udOpFetch | (uint64(r.queueID) << 16) | uint64(tag)
+	userData := ioUserData(udOpFetch, r.queueID, tag)
 	// Use the IOCTL-encoded command
-	cmd := uapi.UblkIOCmd(uapi.UBLK_IO_FETCH_REQ) // This creates UBLK_U_IO_FETCH_REQ
-	_, err := r.ring.SubmitIOCmd(cmd, ioCmd, userData)
-	if err != nil {
+	cmd := uapi.UBLK_U_IO_FETCH_REQ
+	if err := r.ring.PrepareIOCmd(cmd, ioCmd, userData); err != nil {
 		// Don't update state on submission failure
 		return err
 	}
+	if _, err := r.ring.FlushSubmissions(); err != nil {
+		return err
+	}
 
 	// ONLY set state to InFlightFetch after successful submission
 	r.tagStates[tag] = TagStateInFlightFetch
@@ -390,6 +768,19 @@ func (r *Runner) submitInitialFetchReq(tag uint16) error {
 	return nil
 }
 
+// checkCQOverflow reports to onCQOverflow if ring's CQ overflowed since
+// the last check.
+func (r *Runner) checkCQOverflow(ring uring.QueueRing) {
+	counter, ok := ring.(uring.OverflowCounter)
+	if !ok || r.onCQOverflow == nil {
+		return
+	}
+	if n := counter.CQOverflows(); n != r.cqOverflows {
+		r.onCQOverflow(r.queueID, n-r.cqOverflows)
+		r.cqOverflows = n
+	}
+}
+
 // processRequests processes completed I/O requests using proper per-tag state machine.
 // Uses batched io_uring submissions: all completion handlers prepare SQEs, then
 // one FlushSubmissions() call submits them all with a single syscall.
@@ -399,6 +790,7 @@ func (r *Runner) processRequests() error {
 	if err != nil {
 		return fmt.Errorf("failed to wait for completions: %w", err)
 	}
+	r.checkCQOverflow(r.ring)
 
 	// Handle empty completions as no-work, not an error
 	if len(completions) == 0 {
@@ -407,24 +799,19 @@ func (r *Runner) processRequests() error {
 
 	// Process each completion event using per-tag state machine.
 	// Each handler prepares an SQE but doesn't submit - we batch them.
+	r.beginBatch()
 	for _, completion := range completions {
 		// Guard against nil completions (should never happen)
 		if completion == nil {
 			continue
 		}
-
-		userData := completion.UserData()
-		tag := uint16(userData & 0xFFFF)
-		isCommit := (userData & udOpCommit) != 0
-		result := completion.Value()
-
-		// Validate tag range (should never fail)
-		if tag >= uint16(r.depth) {
+		if completion.UserData() == udWakeup {
+			if err := r.handleCommands(); err != nil {
+				return err
+			}
 			continue
 		}
-
-		// Process completion based on per-tag state machine
-		if err := r.handleCompletion(tag, isCommit, result); err != nil {
+		if err := r.handleResult(completion); err != nil {
 			return err
 		}
 	}
@@ -435,18 +822,160 @@ func (r *Runner) processRequests() error {
 	if _, err := r.ring.FlushSubmissions(); err != nil {
 		return fmt.Errorf("failed to flush submissions: %w", err)
 	}
+	r.endBatch()
 
-	return nil
+	return retryDeferred(r.ring, r)
+}
+
+// handleCommands runs the commands that woke the loop and re-arms the wakeup
+// poll unless the loop is stopping.
+func (r *Runner) handleCommands() error {
+	stop := r.commands.receive()
+	if err := r.commitFinished(); err != nil {
+		return err
+	}
+	if stop {
+		r.stopping = true
+		return nil
+	}
+	return r.commands.arm(r.ring)
+}
+
+// Wait blocks until the loop serving the queue exits, and returns the
+// error that ended it, or nil if it was stopped. With a Group, every
+// runner reports the shared loop.
+func (r *Runner) Wait() error {
+	if r.loop == nil {
+		return ErrLoopNotRunning
+	}
+	<-r.loop.done
+	return r.loop.err
+}
+
+// TagStates returns a copy of the queue's tag states. The copy is taken on the
+// loop goroutine between batches, so it is consistent; it fails with
+// ErrLoopNotRunning if no loop serves the queue.
+func (r *Runner) TagStates(ctx context.Context) ([]TagState, error) {
+	if r.loop == nil {
+		return nil, ErrLoopNotRunning
+	}
+	states := make([]TagState, len(r.tagStates))
+	if err := r.loop.call(ctx, func() { copy(states, r.tagStates) }); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// SetBackend replaces the backend that serves the queue's requests. The
+// caller must hold Config.Gate exclusively, so that no request is half
+// served by each backend.
+func (r *Runner) SetBackend(backend interfaces.Backend) {
+	r.backend.Store(&backend)
+}
+
+// currentBackend returns the backend requests are served from.
+func (r *Runner) currentBackend() interfaces.Backend {
+	return *r.backend.Load()
+}
+
+// CPUTime returns the user and system CPU time used by the thread serving
+// the queue since it started, and after it stopped, the final times. With
+// a Group every queue reports the shared thread. Backend calls made by
+// workers run on other threads and are not included.
+func (r *Runner) CPUTime() (user, system time.Duration) {
+	if r.loop == nil {
+		return 0, 0
+	}
+	return r.loop.cpu.read()
+}
+
+// Ring returns the io_uring the runner serves its queue on, which is a
+// Group's if the runner belongs to one.
+func (r *Runner) Ring() uring.QueueRing {
+	return r.ring
+}
+
+// Workers returns the configured number of backend workers.
+func (r *Runner) Workers() int {
+	return r.workers
+}
+
+// Layout describes where a queue's descriptors and buffers live and how
+// its ring was set up, for checking against the kernel's view in debugfs.
+type Layout struct {
+	QueueID    uint16
+	Depth      int
+	DescAddr   uintptr // The mapped descriptor array, 0 if there is none
+	DescSize   int     // Bytes mapped for the descriptors, whole pages
+	DescOffset int64   // Offset of the mapping in the char device
+	BufAddr    uintptr // Tag 0's I/O buffer; tag t's is at BufAddr + t*BufStride
+	BufStride  int
+	SharedRing bool         // The ring serves every queue of a Group
+	Ring       uring.Params // Zero if the ring does not report its parameters
+}
+
+// Layout returns the queue's layout. The addresses are 0 once the runner
+// is closed; Layout must not be called concurrently with Close.
+func (r *Runner) Layout() Layout {
+	descSize, descOffset := descMapping(r.queueID, r.depth)
+	layout := Layout{
+		QueueID:    r.queueID,
+		Depth:      r.depth,
+		DescAddr:   uintptr(r.descPtr),
+		DescSize:   descSize,
+		DescOffset: descOffset,
+		BufAddr:    uintptr(r.bufPtr),
+		BufStride:  constants.IOBufferSizePerTag,
+		SharedRing: r.sharedRing,
+	}
+	if reporter, ok := r.ring.(uring.ParamsReporter); ok {
+		layout.Ring = reporter.Params()
+	}
+	return layout
+}
+
+// ioUserData encodes an I/O command's operation, queue ID and tag into its
+// userData. The layout leaves bit 62 clear, so it never matches udWakeup.
+func ioUserData(op uint64, queueID, tag uint16) uint64 {
+	return op | uint64(queueID)<<16 | uint64(tag)
+}
+
+// queueFromUserData extracts the queue ID encoded in a CQE's userData.
+func queueFromUserData(userData uint64) uint16 {
+	return uint16(userData >> 16)
+}
+
+// tagFromUserData extracts the tag encoded in a CQE's userData.
+func tagFromUserData(userData uint64) uint16 {
+	return uint16(userData)
+}
+
+// handleResult decodes a CQE's userData and feeds it to the tag state machine.
+func (r *Runner) handleResult(completion uring.Result) error {
+	userData := completion.UserData()
+	tag := tagFromUserData(userData)
+	isCommit := (userData & udOpCommit) != 0
+
+	// Validate tag range (should never fail)
+	if tag >= uint16(r.depth) {
+		return nil
+	}
+
+	// Process completion based on per-tag state machine
+	return r.handleCompletion(tag, isCommit, completion.Value())
 }
 
 // handleCompletion processes a single CQE using the per-tag state machine
 func (r *Runner) handleCompletion(tag uint16, isCommit bool, result int32) error {
-	// Guard this tag to prevent concurrent state changes
-	r.tagMutexes[tag].Lock()
-	defer r.tagMutexes[tag].Unlock()
-
 	currentState := r.tagStates[tag]
 
+	if r.ownedAt != nil && currentState != TagStateOwned {
+		if r.queueObserver != nil {
+			r.queueObserver.OnFetchCompleted(r.queueID, tag, result)
+		}
+		r.ownedAt[tag] = time.Now()
+	}
+
 	// State machine transitions
 	switch currentState {
 	case TagStateInFlightFetch:
@@ -454,11 +983,16 @@ func (r *Runner) handleCompletion(tag uint16, isCommit bool, result int32) error
 		if result == 0 {
 			// UBLK_IO_RES_OK: I/O request available - transition to Owned and process
 			r.tagStates[tag] = TagStateOwned
+			r.noteArrival()
 			return r.processIOAndCommit(tag)
 		} else if result == 1 {
 			// UBLK_IO_RES_NEED_GET_DATA: Two-step write path (not implemented yet)
 			r.tagStates[tag] = TagStateOwned
 			return fmt.Errorf("NEED_GET_DATA not implemented")
+		} else if result == uapi.UBLK_IO_RES_ABORT {
+			return fmt.Errorf("FETCH_REQ for tag %d: %w", tag, ErrAborted)
+		} else if result < 0 {
+			return fmt.Errorf("tag %d: %w", tag, uring.NewResultError("FETCH_REQ", result))
 		} else {
 			// Unexpected result code
 			return fmt.Errorf("unexpected FETCH result: %d", result)
@@ -471,15 +1005,19 @@ func (r *Runner) handleCompletion(tag uint16, isCommit bool, result int32) error
 		if result == 0 {
 			// UBLK_IO_RES_OK: Next I/O request available - transition to Owned and process immediately
 			r.tagStates[tag] = TagStateOwned
+			r.noteArrival()
 			return r.processIOAndCommit(tag)
 		} else if result == 1 {
 			// UBLK_IO_RES_NEED_GET_DATA: Two-step write path
 			r.tagStates[tag] = TagStateOwned
 			return fmt.Errorf("NEED_GET_DATA not implemented")
+		} else if result == uapi.UBLK_IO_RES_ABORT {
+			r.tagStates[tag] = TagStateOwned
+			return fmt.Errorf("COMMIT_AND_FETCH_REQ for tag %d: %w", tag, ErrAborted)
 		} else if result < 0 {
-			// Error/abort path
+			// Error path
 			r.tagStates[tag] = TagStateOwned // Tag can be reused after error
-			return fmt.Errorf("COMMIT_AND_FETCH error: %d", result)
+			return fmt.Errorf("tag %d: %w", tag, uring.NewResultError("COMMIT_AND_FETCH_REQ", result))
 		} else {
 			// Should never happen
 			return fmt.Errorf("unexpected COMMIT result: %d", result)
@@ -494,36 +1032,91 @@ func (r *Runner) handleCompletion(tag uint16, isCommit bool, result int32) error
 	}
 }
 
-// loadDescriptor reads a descriptor with acquire semantics to avoid stale data.
-func (r *Runner) loadDescriptor(tag uint16) uapi.UblksrvIODesc {
-	descSize := unsafe.Sizeof(uapi.UblksrvIODesc{})
-	base := unsafe.Add(r.descPtr, uintptr(tag)*descSize)
+// beginBatch starts a batch of completions. The previous batch's commits
+// have been flushed, so their tags are waiting in the kernel again.
+func (r *Runner) beginBatch() {
+	r.committed = 0
+}
 
-	return uapi.UblksrvIODesc{
-		OpFlags:     atomic.LoadUint32((*uint32)(base)),
-		NrSectors:   atomic.LoadUint32((*uint32)(unsafe.Add(base, descNrSectorsOffset))),
-		StartSector: atomic.LoadUint64((*uint64)(unsafe.Add(base, descStartSectorOffset))),
-		Addr:        atomic.LoadUint64((*uint64)(unsafe.Add(base, descAddrOffset))),
-	}
+// endBatch notes that the batch's commits have been flushed, so only the
+// tags still owned are in use.
+func (r *Runner) endBatch() {
+	r.inUse.Store(int32(r.owned))
 }
 
-// processIOAndCommit reads descriptor, processes I/O, and submits COMMIT_AND_FETCH_REQ
-func (r *Runner) processIOAndCommit(tag uint16) error {
-	// Read descriptor for this tag using atomic loads to avoid stale cache lines
-	desc := r.loadDescriptor(tag)
+// noteArrival counts a tag that just became Owned with a request and
+// samples how many tags the kernel is waiting on: those still Owned and
+// those whose commits are not yet flushed.
+func (r *Runner) noteArrival() {
+	r.owned++
+	inUse := r.owned + r.committed
+	r.depthSamples.Add(1)
+	r.depthSum.Add(uint64(inUse))
+	if inUse == r.depth {
+		r.depthFull.Add(1)
+	}
+	if uint32(inUse) > r.depthPeak.Load() { // Only the loop stores
+		r.depthPeak.Store(uint32(inUse))
+	}
+	r.inUse.Store(int32(inUse))
+}
 
-	// Handle empty descriptor - submit COMMIT_AND_FETCH with result=0
-	// to acknowledge and wait for next I/O
-	if desc.OpFlags == 0 && desc.NrSectors == 0 {
-		return r.submitCommitAndFetch(tag, nil, desc)
+// sampleDepth passes the tags in use to the Observer every depthInterval
+// until the runner's context ends. Sampling on a clock rather than per
+// request weights the average by time, so idle periods count as idle.
+func (r *Runner) sampleDepth() {
+	if r.depthInterval <= 0 {
+		return
 	}
+	go func() {
+		ticker := time.NewTicker(r.depthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+				r.observer.ObserveQueueDepth(uint32(r.inUse.Load()))
+			}
+		}
+	}()
+}
 
-	// Process real I/O request
-	if err := r.handleIORequest(tag, desc); err != nil {
-		return err
+// DepthStats describes how busy a queue's tags have been. A tag is in use
+// from the arrival of its request until its commit is flushed to the kernel.
+type DepthStats struct {
+	Requests uint64 // Requests that arrived
+	InUse    uint64 // Sum over arrivals of the tags in use, counting the new one
+	Full     uint64 // Arrivals that left every tag in use
+	Peak     int    // Most tags ever in use at once
+}
+
+// DepthStats returns the queue's tag use since it was created. Safe to
+// call from any goroutine, including after Close.
+func (r *Runner) DepthStats() DepthStats {
+	return DepthStats{
+		Requests: r.depthSamples.Load(),
+		InUse:    r.depthSum.Load(),
+		Full:     r.depthFull.Load(),
+		Peak:     int(r.depthPeak.Load()),
 	}
+}
 
-	return nil
+// loadDescriptor reads tag's descriptor. The kernel writes it before it
+// posts the CQE handing the tag back, so one acquire load (of OpFlags)
+// orders the read after the CQE's, and the 24 bytes are then copied
+// plainly rather than each field being loaded atomically. Go has no
+// prefetch to issue for the next tags' descriptors; they are contiguous,
+// so the hardware prefetcher covers a batch.
+func (r *Runner) loadDescriptor(tag uint16) uapi.UblksrvIODesc {
+	base := unsafe.Add(r.descPtr, uintptr(tag)*unsafe.Sizeof(uapi.UblksrvIODesc{}))
+	_ = atomic.LoadUint32((*uint32)(base))
+	return *(*uapi.UblksrvIODesc)(base)
+}
+
+// processIOAndCommit reads descriptor, processes I/O, and submits COMMIT_AND_FETCH_REQ
+func (r *Runner) processIOAndCommit(tag uint16) error {
+	return r.handleIORequest(tag, r.loadDescriptor(tag))
 }
 
 // handleIORequest processes a single I/O request
@@ -533,78 +1126,686 @@ func (r *Runner) handleIORequest(tag uint16, desc uapi.UblksrvIODesc) error {
 		return r.submitCommitAndFetch(tag, nil, desc)
 	}
 
-	// Extract I/O parameters from descriptor
-	op := desc.GetOp()                                     // Use the provided method to get operation
-	offset := desc.StartSector * uint64(r.blockSize)       // Convert sectors to bytes
-	length := uint32(desc.NrSectors) * uint32(r.blockSize) // Convert sectors to bytes
+	// REPORT_ZONES carries nr_zones in NrSectors; the reply is written
+	// straight into the tag buffer, so it never goes through the pool.
+	if desc.GetOp() == uapi.UBLK_IO_OP_REPORT_ZONES {
+		bufPtr := unsafe.Add(r.bufPtr, int(tag)*constants.IOBufferSizePerTag)
+		zoneBuf := (*[constants.IOBufferSizePerTag]byte)(bufPtr)[:]
+		written, err := r.reportZones(zoneBuf, int64(desc.StartSector)<<9, int(desc.NrSectors))
+		if err != nil {
+			return r.submitCommitAndFetch(tag, err, desc)
+		}
+		return r.commitResult(tag, int32(written))
+	}
+
+	if err := r.validateRequest(desc); err != nil {
+		return r.submitCommitAndFetch(tag, err, desc)
+	}
+	r.hintReadAhead(desc)
+
+	// Hand the request to a worker; its commit is prepared once it returns
+	if r.jobs != nil {
+		r.inflight.Add(1)
+		r.jobs <- ioRequest{tag: tag, desc: desc}
+		return nil
+	}
 
-	// Calculate buffer pointer for this tag
-	bufOffset := int(tag) * constants.IOBufferSizePerTag // 64KB per buffer
-	bufPtr := unsafe.Add(r.bufPtr, bufOffset)
+	// Submit COMMIT_AND_FETCH_REQ with result
+	return r.submitCommitAndFetch(tag, r.doIO(tag, desc), desc)
+}
 
-	// Check if length exceeds buffer size (64KB)
-	const maxBufferSize = constants.IOBufferSizePerTag
+// doIO runs a READ, WRITE, FLUSH, DISCARD or WRITE_ZEROES request against the
+// backend.
+// It only touches the tag's own buffer, so workers may call it concurrently.
+func (r *Runner) doIO(tag uint16, desc uapi.UblksrvIODesc) error {
+	if r.activity != nil {
+		r.activity.Add(1)
+	}
 
-	var buffer []byte
+	// Extract I/O parameters from descriptor
+	op := desc.GetOp()                    // Use the provided method to get operation
+	offset := desc.StartSector << 9       // Sectors are 512 bytes whatever the block size
+	length := uint32(desc.NrSectors) << 9 // Checked against maxIOBytes, so it fits
 
-	if length > maxBufferSize {
-		// Use buffer pool for large I/Os to avoid hot-path allocations
-		buffer = GetBuffer(length)
-		defer PutBuffer(buffer)
-	} else {
-		buffer = (*[constants.IOBufferSizePerTag]byte)(bufPtr)[:length:length]
+	// Only measure time if someone uses it (avoid syscall overhead)
+	var startTime time.Time
+	if r.observer != nil || r.trace != nil || r.phaseObserver != nil {
+		startTime = time.Now()
 	}
 
+	held := r.budgetBytes(op, length)
+	if held > 0 {
+		if err := r.budget.Acquire(r.ctx, held); err != nil {
+			return err
+		}
+	}
+	if r.gate != nil {
+		r.gate.RLock()
+	}
 	var err error
+	if r.ioTimeout > 0 {
+		err = r.callWithTimeout(tag, desc, length, held)
+	} else {
+		var buf []byte
+		if op == uapi.UBLK_IO_OP_READ || op == uapi.UBLK_IO_OP_WRITE {
+			buf = r.tagBuffer(tag, length)
+		}
+		err = r.callBackend(tag, desc, buf)
+		r.endCall(held)
+	}
 
-	// Only measure time if observer is set (avoid syscall overhead)
-	var startTime time.Time
 	if r.observer != nil {
-		startTime = time.Now()
+		latency := uint64(time.Since(startTime).Nanoseconds())
+		switch op {
+		case uapi.UBLK_IO_OP_READ:
+			r.observer.ObserveRead(uint64(length), latency, err == nil)
+		case uapi.UBLK_IO_OP_WRITE, uapi.UBLK_IO_OP_WRITE_ZEROES:
+			r.observer.ObserveWrite(uint64(length), latency, err == nil)
+		case uapi.UBLK_IO_OP_FLUSH:
+			r.observer.ObserveFlush(latency, err == nil)
+		case uapi.UBLK_IO_OP_DISCARD:
+			r.observer.ObserveDiscard(uint64(length), latency, err == nil)
+		}
+	}
+	if r.phaseObserver != nil {
+		r.observePhases(tag, startTime)
+	}
+	// A kernel newer than the runner is not a data error
+	if err != nil && r.queueObserver != nil && (r.raw != nil || knownOp(op)) {
+		r.queueObserver.OnIOError(r.queueID, tag, op, offset, length, err)
+	}
+	if r.trace != nil {
+		var errno syscall.Errno
+		if err != nil {
+			errno = r.errnoFor(err)
+		}
+		r.trace(r.queueID, tag, desc, startTime, time.Since(startTime), errno)
+	}
+	return err
+}
+
+// observePhases reports the request on tag, whose backend call started at
+// start and just returned, to the PhaseObserver. The loop does not touch
+// the tag's timestamps until the request is committed.
+func (r *Runner) observePhases(tag uint16, start time.Time) {
+	fetched := r.ownedAt[tag]
+	var refetch time.Duration
+	if committed := r.committedAt[tag]; !committed.IsZero() {
+		refetch = fetched.Sub(committed)
+	}
+	r.phaseObserver.ObservePhases(uint64(start.Sub(fetched)), uint64(time.Since(start)), uint64(max(refetch, 0)))
+}
+
+// callBackend makes the backend call for the request in desc, or passes
+// it to the raw handler, with buf as the data of a READ or WRITE, and
+// reports written ranges to onWrite. The caller holds the gate.
+func (r *Runner) callBackend(tag uint16, desc uapi.UblksrvIODesc, buf []byte) error {
+	op := desc.GetOp()
+	offset := int64(desc.StartSector) << 9
+	length := int64(desc.NrSectors) << 9
+
+	if r.barrier != nil {
+		switch op {
+		case uapi.UBLK_IO_OP_WRITE, uapi.UBLK_IO_OP_DISCARD, uapi.UBLK_IO_OP_WRITE_ZEROES:
+			defer r.barrier.End(r.barrier.Begin())
+		case uapi.UBLK_IO_OP_FLUSH:
+			if err := r.waitForWrites(tag, desc); err != nil {
+				return err
+			}
+		}
+	}
+
+	if r.raw != nil {
+		req := r.request(tag, desc)
+		err := r.raw(&interfaces.RawRequest{
+			Queue:    req.Queue,
+			Tag:      req.Tag,
+			Op:       op,
+			Flags:    req.Flags,
+			Sector:   desc.StartSector,
+			Sectors:  desc.NrSectors,
+			Offset:   offset,
+			Length:   length,
+			Data:     buf,
+			Deadline: req.Deadline,
+		})
+		switch op {
+		case uapi.UBLK_IO_OP_WRITE, uapi.UBLK_IO_OP_DISCARD, uapi.UBLK_IO_OP_WRITE_ZEROES:
+			if r.onWrite != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+				r.onWrite(offset, length)
+			}
+		}
+		return err
 	}
 
+	var err error
 	switch op {
 	case uapi.UBLK_IO_OP_READ:
-		_, err = r.backend.ReadAt(buffer, int64(offset))
-		if r.observer != nil {
-			r.observer.ObserveRead(uint64(length), uint64(time.Since(startTime).Nanoseconds()), err == nil)
+		if rb, ok := r.currentBackend().(interfaces.RequestBackend); ok {
+			err = readFull(requestIO{rb, r.request(tag, desc)}, buf, offset)
+		} else {
+			err = readFull(r.currentBackend(), buf, offset)
 		}
 	case uapi.UBLK_IO_OP_WRITE:
-		_, err = r.backend.WriteAt(buffer, int64(offset))
-		if r.observer != nil {
-			r.observer.ObserveWrite(uint64(length), uint64(time.Since(startTime).Nanoseconds()), err == nil)
+		if rb, ok := r.currentBackend().(interfaces.RequestBackend); ok {
+			err = writeFull(requestIO{rb, r.request(tag, desc)}, buf, offset)
+		} else {
+			err = writeFull(r.currentBackend(), buf, offset)
 		}
-	case uapi.UBLK_IO_OP_FLUSH:
-		err = r.backend.Flush()
-		if r.observer != nil {
-			r.observer.ObserveFlush(uint64(time.Since(startTime).Nanoseconds()), err == nil)
+		// A failed write may still have changed part of the range
+		if r.onWrite != nil {
+			r.onWrite(offset, length)
 		}
+	case uapi.UBLK_IO_OP_FLUSH:
+		err = r.flush(tag, desc)
 	case uapi.UBLK_IO_OP_DISCARD:
-		// Handle discard if backend supports it
-		if discardBackend, ok := r.backend.(interfaces.DiscardBackend); ok {
-			err = discardBackend.Discard(int64(offset), int64(length))
+		err = r.discard(tag, desc, offset, length)
+		if r.onWrite != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+			r.onWrite(offset, length)
 		}
-		if r.observer != nil {
-			r.observer.ObserveDiscard(uint64(length), uint64(time.Since(startTime).Nanoseconds()), err == nil)
+	case uapi.UBLK_IO_OP_WRITE_ZEROES:
+		err = r.writeZeroes(tag, desc, offset, length)
+		if r.onWrite != nil && !errors.Is(err, syscall.EOPNOTSUPP) {
+			r.onWrite(offset, length)
 		}
 	default:
-		err = fmt.Errorf("unsupported operation: %d", op)
+		err = r.serveUnknownOp(tag, desc)
 	}
+	return err
+}
 
-	// Submit COMMIT_AND_FETCH_REQ with result
-	return r.submitCommitAndFetch(tag, err, desc)
+// knownOp reports whether callBackend serves op itself.
+func knownOp(op uint8) bool {
+	switch op {
+	case uapi.UBLK_IO_OP_READ, uapi.UBLK_IO_OP_WRITE, uapi.UBLK_IO_OP_FLUSH,
+		uapi.UBLK_IO_OP_DISCARD, uapi.UBLK_IO_OP_WRITE_ZEROES:
+		return true
+	}
+	return false
+}
+
+// serveUnknownOp passes a request with an op the runner does not handle
+// to Config.UnknownOp, or fails it with ErrUnknownOp.
+func (r *Runner) serveUnknownOp(tag uint16, desc uapi.UblksrvIODesc) error {
+	op := desc.GetOp()
+	if r.onUnknownOp != nil {
+		r.onUnknownOp(r.queueID, op)
+	}
+	if r.unknownOp == nil {
+		return fmt.Errorf("op %d: %w", op, ErrUnknownOp)
+	}
+	req := r.request(tag, desc)
+	return r.unknownOp(&interfaces.RawRequest{
+		Queue:    req.Queue,
+		Tag:      req.Tag,
+		Op:       op,
+		Flags:    req.Flags,
+		Sector:   desc.StartSector,
+		Sectors:  desc.NrSectors,
+		Offset:   int64(desc.StartSector) << 9,
+		Length:   int64(desc.NrSectors) << 9,
+		Deadline: req.Deadline,
+	})
+}
+
+// callWithTimeout runs callBackend on a goroutine of its own and gives up
+// on it after r.ioTimeout, failing the request with ETIMEDOUT. The call
+// works on a copy of the data, since a call given up on may still be
+// running when the tag serves its next request, and it releases the gate
+// and the held budget bytes only when it returns (or at once if no buffer
+// can be had for the copy).
+func (r *Runner) callWithTimeout(tag uint16, desc uapi.UblksrvIODesc, length uint32, held int64) error {
+	op := desc.GetOp()
+	var buf []byte
+	if op == uapi.UBLK_IO_OP_READ || op == uapi.UBLK_IO_OP_WRITE {
+		var err error
+		if buf, err = r.getBuffer(length); err != nil {
+			r.endCall(held)
+			return err
+		}
+		if op == uapi.UBLK_IO_OP_WRITE {
+			copy(buf, r.tagBuffer(tag, length))
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.callBackend(tag, desc, buf)
+		r.endCall(held)
+	}()
+
+	timer := time.NewTimer(r.ioTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if buf != nil {
+			if op == uapi.UBLK_IO_OP_READ && err == nil {
+				copy(r.tagBuffer(tag, length), buf)
+			}
+			r.putBuffer(buf)
+		}
+		return err
+	case <-timer.C:
+		if buf != nil {
+			go func() {
+				<-done
+				r.putBuffer(buf)
+			}()
+		}
+		return fmt.Errorf("backend call for tag %d did not return within %v: %w", tag, r.ioTimeout, context.DeadlineExceeded)
+	}
+}
+
+// budgetBytes returns the bytes a request with op and length takes from
+// the in-flight budget: its data for a READ or WRITE, and none otherwise
+// or without a budget.
+func (r *Runner) budgetBytes(op uint8, length uint32) int64 {
+	if r.budget == nil || (op != uapi.UBLK_IO_OP_READ && op != uapi.UBLK_IO_OP_WRITE) {
+		return 0
+	}
+	return int64(length)
+}
+
+// endCall releases the gate and the held budget bytes after a backend call.
+func (r *Runner) endCall(held int64) {
+	if r.gate != nil {
+		r.gate.RUnlock()
+	}
+	if held > 0 {
+		r.budget.Release(held)
+	}
+}
+
+// tagBuffer returns the first length bytes of tag's I/O buffer. Requests
+// are checked against maxIOBytes before they get here, so length always fits.
+func (r *Runner) tagBuffer(tag uint16, length uint32) []byte {
+	bufPtr := unsafe.Add(r.bufPtr, int(tag)*constants.IOBufferSizePerTag)
+	return (*[constants.IOBufferSizePerTag]byte)(bufPtr)[:length:length]
+}
+
+// validateRequest rejects descriptors the runner cannot serve safely: data
+// transfers larger than the I/O limit fail with EINVAL, and ranges that end
+// beyond the backend fail with ENOSPC. Other ops carry no range to check.
+// The kernel counts sectors in 512-byte units whatever the logical block
+// size. Flags the runner does not know are reported, not rejected.
+func (r *Runner) validateRequest(desc uapi.UblksrvIODesc) error {
+	if flags := desc.GetFlags() &^ knownIOFlags; flags != 0 && r.onUnknownFlags != nil {
+		r.onUnknownFlags(r.queueID, flags)
+	}
+	length := uint64(desc.NrSectors) << 9
+
+	switch desc.GetOp() {
+	case uapi.UBLK_IO_OP_READ, uapi.UBLK_IO_OP_WRITE:
+		if length > uint64(r.maxIOBytes) {
+			return fmt.Errorf("%d-byte request exceeds the %d-byte I/O limit: %w",
+				length, r.maxIOBytes, syscall.EINVAL)
+		}
+	case uapi.UBLK_IO_OP_DISCARD, uapi.UBLK_IO_OP_WRITE_ZEROES:
+		// No data moves through the tag buffer, so only the range is checked
+	default:
+		return nil
+	}
+
+	// Compare in sectors first so a huge StartSector cannot overflow offset
+	size := uint64(r.currentBackend().Size())
+	if desc.StartSector > size>>9 || length > size-desc.StartSector<<9 {
+		return fmt.Errorf("request at sector %d length %d ends beyond the %d-byte device: %w",
+			desc.StartSector, length, size, syscall.ENOSPC)
+	}
+	return nil
+}
+
+// readFull fills buf from the backend starting at off, retrying short reads.
+// If the backend reaches EOF the rest of buf is zeroed, so data left in the
+// tag buffer by an earlier request never reaches the guest.
+func readFull[R io.ReaderAt](backend R, buf []byte, off int64) error {
+	for done := 0; done < len(buf); {
+		n, err := backend.ReadAt(buf[done:], off+int64(done))
+		done += n
+		if err == io.EOF {
+			clear(buf[done:])
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("read at %d: %w", off+int64(done), io.ErrNoProgress)
+		}
+	}
+	return nil
+}
+
+// writeFull writes all of buf to the backend at off, retrying short writes.
+// A write that makes no progress without an error fails with
+// io.ErrShortWrite rather than reporting success for data never stored.
+func writeFull[W io.WriterAt](backend W, buf []byte, off int64) error {
+	for done := 0; done < len(buf); {
+		n, err := backend.WriteAt(buf[done:], off+int64(done))
+		done += n
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("write at %d: %w", off+int64(done), io.ErrShortWrite)
+		}
+	}
+	return nil
+}
+
+// requestIO adapts a RequestBackend to io.ReaderAt and io.WriterAt for one
+// request. readFull and writeFull are generic so passing it by value does
+// not allocate.
+type requestIO struct {
+	backend interfaces.RequestBackend
+	req     interfaces.Request
+}
+
+func (r requestIO) ReadAt(p []byte, off int64) (int, error) {
+	return r.backend.ReadAtRequest(p, off, r.req)
+}
+
+func (r requestIO) WriteAt(p []byte, off int64) (int, error) {
+	return r.backend.WriteAtRequest(p, off, r.req)
+}
+
+// request describes the request in tag's descriptor to a RequestBackend.
+func (r *Runner) request(tag uint16, desc uapi.UblksrvIODesc) interfaces.Request {
+	req := interfaces.Request{Queue: r.queueID, Tag: tag, Flags: interfaces.RequestFlags(desc.GetFlags())}
+	if r.ioTimeout > 0 {
+		req.Deadline = time.Now().Add(r.ioTimeout)
+	}
+	return req
+}
+
+// ioRequest is an owned tag handed to a backend worker. The worker sets err
+// before sending the request back on finished.
+type ioRequest struct {
+	tag  uint16
+	desc uapi.UblksrvIODesc
+	err  error
+}
+
+// startWorkers launches the backend workers, if configured. Workers signal
+// r.loop each time a request finishes, so it must be set first.
+func (r *Runner) startWorkers() {
+	if r.workers <= 0 {
+		return
+	}
+	// At most depth requests are in flight, so neither channel ever blocks.
+	r.jobs = make(chan ioRequest, r.depth)
+	r.finished = make(chan ioRequest, r.depth)
+	for range r.workers {
+		go r.worker(r.jobs)
+	}
+}
+
+// worker runs backend calls until jobs is closed.
+func (r *Runner) worker(jobs <-chan ioRequest) {
+	setProfileLabels(r.ctx, r.deviceID, strconv.Itoa(int(r.queueID)))
+	for req := range jobs {
+		req.err = r.doIO(req.tag, req.desc)
+		r.finished <- req
+		r.loop.notify()
+		r.inflight.Done()
+	}
+}
+
+// stopWorkers shuts the workers down once their current requests are done.
+// The loop calls it on exit, so commits for requests finishing now are
+// dropped along with the queue. If the stop runs out of time first (see
+// StopContext), the requests still owned are failed with EIO instead and
+// the workers are abandoned to finish on their own.
+func (r *Runner) stopWorkers() {
+	if r.jobs == nil {
+		return
+	}
+	close(r.jobs)
+	r.jobs = nil
+
+	idle := make(chan struct{})
+	go func() {
+		r.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return
+	case <-r.loop.abort:
+	}
+	select {
+	case <-idle:
+		return // Finished just as the abort came
+	default:
+	}
+	r.abandoned = true
+	if err := r.failOwned(); err != nil && r.logger != nil {
+		r.logger.Printf("Queue %d: Failed to fail requests on abort: %v", r.queueID, err)
+	}
+}
+
+// failOwned commits the results of finished requests and EIO for every
+// other tag the queue still owns, and submits the commits.
+func (r *Runner) failOwned() error {
+	if err := r.commitFinished(); err != nil {
+		return err
+	}
+	r.deferred = r.deferred[:0]
+	for tag, state := range r.tagStates {
+		if state != TagStateOwned {
+			continue
+		}
+		err := r.prepareCommit(uint16(tag), -int32(syscall.EIO))
+		if errors.Is(err, uring.ErrRingFull) {
+			if _, err = r.ring.FlushSubmissions(); err == nil {
+				err = r.prepareCommit(uint16(tag), -int32(syscall.EIO))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := r.ring.FlushSubmissions()
+	return err
+}
+
+// commitFinished prepares COMMIT_AND_FETCH_REQ for every request the
+// workers have finished since the last call.
+func (r *Runner) commitFinished() error {
+	for {
+		select {
+		case req := <-r.finished:
+			if err := r.submitCommitAndFetch(req.tag, req.err, req.desc); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// reportZones answers a REPORT_ZONES request by encoding the backend's zones
+// into buf as struct blk_zone entries. It returns the number of bytes written.
+func (r *Runner) reportZones(buf []byte, offset int64, nrZones int) (int, error) {
+	if r.gate != nil {
+		r.gate.RLock()
+		defer r.gate.RUnlock()
+	}
+	zonedBackend, ok := r.currentBackend().(interfaces.ZonedBackend)
+	if !ok {
+		return 0, syscall.EOPNOTSUPP
+	}
+
+	nrZones = min(nrZones, len(buf)/uapi.BlkZoneSize)
+	zones, err := zonedBackend.ReportZones(offset, nrZones)
+	if err != nil {
+		return 0, err
+	}
+
+	blkZones := make([]uapi.BlkZone, min(len(zones), nrZones))
+	for i := range blkZones {
+		z := &zones[i]
+		blkZones[i] = uapi.BlkZone{
+			Start:        uint64(z.Start) >> 9, // blk_zone uses 512-byte sectors
+			Len:          uint64(z.Length) >> 9,
+			WritePointer: uint64(z.WritePointer) >> 9,
+			Type:         z.Type,
+			Cond:         z.Cond,
+			Capacity:     uint64(z.Capacity) >> 9,
+		}
+		if blkZones[i].Capacity == 0 {
+			blkZones[i].Capacity = blkZones[i].Len
+		}
+	}
+
+	return uapi.EncodeBlkZones(buf, blkZones) * uapi.BlkZoneSize, nil
+}
+
+// discard passes a DISCARD request to the backend, enforcing the advertised
+// granularity and splitting ranges larger than the MaxDiscardSectors limit.
+// Backends without DiscardBackend fail with EOPNOTSUPP so the kernel sees
+// that the operation is unsupported instead of a silent success.
+func (r *Runner) discard(tag uint16, desc uapi.UblksrvIODesc, offset, length int64) error {
+	discardBackend, ok := r.currentBackend().(interfaces.DiscardBackend)
+	if !ok {
+		return syscall.EOPNOTSUPP
+	}
+
+	if g := r.discardGranularity; g > 0 && (offset%g != 0 || length%g != 0) {
+		return fmt.Errorf("discard at %d length %d not aligned to granularity %d: %w",
+			offset, length, g, syscall.EINVAL)
+	}
+
+	call := discardBackend.Discard
+	if cb, ok := discardBackend.(interfaces.DiscardContextBackend); ok {
+		ctx, cancel := r.callContext(tag, desc)
+		defer cancel()
+		call = func(offset, length int64) error {
+			return cb.DiscardContext(ctx, offset, length)
+		}
+	}
+
+	chunk := length
+	if r.maxDiscardBytes > 0 {
+		chunk = r.maxDiscardBytes
+	}
+	for length > 0 {
+		n := min(length, chunk)
+		if err := call(offset, n); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// writeZeroes passes a WRITE_ZEROES to the backend. The kernel only sends
+// it when the backend implements WriteZeroesBackend, and splits it at the
+// advertised limit itself.
+func (r *Runner) writeZeroes(tag uint16, desc uapi.UblksrvIODesc, offset, length int64) error {
+	zeroesBackend, ok := r.currentBackend().(interfaces.WriteZeroesBackend)
+	if !ok {
+		return syscall.EOPNOTSUPP
+	}
+	flags := interfaces.RequestFlags(desc.GetFlags())
+	if cb, ok := zeroesBackend.(interfaces.WriteZeroesContextBackend); ok {
+		ctx, cancel := r.callContext(tag, desc)
+		defer cancel()
+		return cb.WriteZeroesContext(ctx, offset, length, flags)
+	}
+	return zeroesBackend.WriteZeroes(offset, length, flags)
+}
+
+// flush passes a FLUSH to the backend.
+func (r *Runner) flush(tag uint16, desc uapi.UblksrvIODesc) error {
+	backend := r.currentBackend()
+	if cb, ok := backend.(interfaces.FlushContextBackend); ok {
+		ctx, cancel := r.callContext(tag, desc)
+		defer cancel()
+		return cb.FlushContext(ctx)
+	}
+	return backend.Flush()
+}
+
+// waitForWrites waits at the flush barrier for the writes in flight on
+// every queue, bounded like the FLUSH call itself.
+func (r *Runner) waitForWrites(tag uint16, desc uapi.UblksrvIODesc) error {
+	ctx, cancel := r.callContext(tag, desc)
+	defer cancel()
+	if err := r.barrier.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for writes on other queues: %w", err)
+	}
+	return nil
+}
+
+// callContext returns the context for a cancellable backend call serving
+// the request in tag's descriptor: it ends when the runner stops and, with
+// an IOTimeout, at the request's deadline.
+func (r *Runner) callContext(tag uint16, desc uapi.UblksrvIODesc) (context.Context, context.CancelFunc) {
+	if req := r.request(tag, desc); !req.Deadline.IsZero() {
+		return context.WithDeadline(r.ctx, req.Deadline)
+	}
+	return context.WithCancel(r.ctx)
+}
+
+// errnoFor returns the errno reported to the kernel for a failed request.
+// The configured ErrnoMapper is asked first; if it has no answer, errors
+// wrapping a syscall.Errno keep it, deadline errors become ETIMEDOUT and
+// anything else becomes EIO.
+func (r *Runner) errnoFor(err error) syscall.Errno {
+	if r.errnoMapper != nil {
+		if errno := r.errnoMapper(err); errno != 0 {
+			return errno
+		}
+	}
+	return errnoFor(err)
+}
+
+// errnoFor is the default error mapping used when no ErrnoMapper is set or
+// it returns 0.
+func errnoFor(err error) syscall.Errno {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return syscall.ETIMEDOUT
+	}
+	return syscall.EIO
 }
 
 // submitCommitAndFetch prepares COMMIT_AND_FETCH_REQ with proper state tracking.
 // Note: This only prepares the SQE - caller must call FlushSubmissions() to submit.
 func (r *Runner) submitCommitAndFetch(tag uint16, ioErr error, desc uapi.UblksrvIODesc) error {
-	// Calculate result: bytes processed for success, negative errno for error
-	// Always set result = nr_sectors << 9 (nr_sectors * 512) as per expert guidance
-	result := int32(desc.NrSectors) << 9 // Success: return bytes processed
+	// Calculate result: bytes processed for success, negative errno for error.
+	// Only READ and WRITE lengths are bounded by the tag buffer; the others
+	// are capped so a large FLUSH or DISCARD cannot wrap into an errno.
+	result := int32(min(int64(desc.NrSectors)<<9, math.MaxInt32))
 	if ioErr != nil {
-		result = -5 // -EIO
+		result = -int32(r.errnoFor(ioErr))
 	}
+	return r.commitResult(tag, result)
+}
+
+// commitResult prepares COMMIT_AND_FETCH_REQ for tag carrying an explicit
+// result value (bytes transferred or negative errno). If the submission ring
+// is full the commit is deferred: the tag stays Owned and the loop prepares
+// it again after its next flush (see retryDeferred).
+func (r *Runner) commitResult(tag uint16, result int32) error {
+	err := r.prepareCommit(tag, result)
+	if errors.Is(err, uring.ErrRingFull) {
+		r.deferred = append(r.deferred, deferredCommit{tag: tag, result: result})
+		if r.queueObserver != nil {
+			r.queueObserver.OnRingFull(r.queueID)
+		}
+		return nil
+	}
+	return err
+}
 
+// prepareCommit fills in tag's command and prepares its SQE.
+func (r *Runner) prepareCommit(tag uint16, result int32) error {
 	// Only submit if we're in Owned state
 	if r.tagStates[tag] != TagStateOwned {
 		return fmt.Errorf("cannot submit COMMIT for tag %d in state %d (not Owned)", tag, r.tagStates[tag])
@@ -621,9 +1822,9 @@ func (r *Runner) submitCommitAndFetch(tag uint16, ioErr error, desc uapi.Ublksrv
 	ioCmd.Addr = uint64(bufferAddr)
 
 	// Encode COMMIT operation in userData
-	userData := udOpCommit | (uint64(r.queueID) << 16) | uint64(tag)
+	userData := ioUserData(udOpCommit, r.queueID, tag)
 	// Use the IOCTL-encoded command
-	cmd := uapi.UblkIOCmd(uapi.UBLK_IO_COMMIT_AND_FETCH_REQ) // This creates UBLK_U_IO_COMMIT_AND_FETCH_REQ
+	cmd := uapi.UBLK_U_IO_COMMIT_AND_FETCH_REQ
 
 	// Prepare SQE without submitting - enables batching multiple completions
 	// into a single io_uring_enter syscall
@@ -634,76 +1835,121 @@ func (r *Runner) submitCommitAndFetch(tag uint16, ioErr error, desc uapi.Ublksrv
 
 	// Update state: COMMIT_AND_FETCH_REQ is now prepared (will be in flight after flush)
 	r.tagStates[tag] = TagStateInFlightCommit
+	r.owned--
+	r.committed++
+	if r.committedAt != nil {
+		r.committedAt[tag] = time.Now()
+	}
+
+	if r.queueObserver != nil {
+		r.queueObserver.OnCommitSubmitted(r.queueID, tag, result)
+		if held := time.Since(r.ownedAt[tag]); held > r.stallThreshold {
+			r.queueObserver.OnQueueStall(r.queueID, tag, held)
+		}
+	}
 	return nil
 }
 
-// mmapQueues maps the descriptor array and allocates I/O buffers
-func mmapQueues(fd int, queueID uint16, depth int) (unsafe.Pointer, unsafe.Pointer, error) {
-	// Calculate sizes
-	descSize := depth * int(unsafe.Sizeof(uapi.UblksrvIODesc{}))
-	bufSize := depth * constants.IOBufferSizePerTag // 64KB per request buffer
+// prepareDeferred prepares as many deferred commits as the ring has room
+// for, in the order they were deferred.
+func (r *Runner) prepareDeferred() error {
+	for i, c := range r.deferred {
+		err := r.prepareCommit(c.tag, c.result)
+		if errors.Is(err, uring.ErrRingFull) {
+			r.deferred = r.deferred[:copy(r.deferred, r.deferred[i:])]
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	r.deferred = r.deferred[:0]
+	return nil
+}
 
-	// Page-round the mmap size
-	pageSize := os.Getpagesize()
-	if rem := descSize % pageSize; rem != 0 {
-		descSize += pageSize - rem
+// retryDeferred runs after a loop has flushed ring. Flushing hands every
+// queued SQE to the kernel, so deferred commits normally fit on the first
+// try. If they still do not, it flushes again with a doubling pause, and
+// fails after constants.RingFullRetries attempts.
+func retryDeferred(ring uring.QueueRing, runners ...*Runner) error {
+	pending := countDeferred(runners)
+	backoff := constants.RingFullBackoff
+	for attempt := 0; pending > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > constants.RingFullRetries {
+				return fmt.Errorf("%d commits still waiting for ring space: %w", pending, uring.ErrRingFull)
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		for _, r := range runners {
+			if err := r.prepareDeferred(); err != nil {
+				return err
+			}
+		}
+		if _, err := ring.FlushSubmissions(); err != nil {
+			return fmt.Errorf("failed to flush submissions: %w", err)
+		}
+		pending = countDeferred(runners)
 	}
+	return nil
+}
 
-	// Calculate per-queue offset for mmap
-	// Formula: offset = queueID * round_up(queue_depth * sizeof(desc), PAGE_SIZE)
-	mmapOffset := uintptr(queueID) * uintptr(descSize)
+// countDeferred returns the number of deferred commits across runners.
+func countDeferred(runners []*Runner) int {
+	n := 0
+	for _, r := range runners {
+		n += len(r.deferred)
+	}
+	return n
+}
+
+// mmapQueues maps the descriptor array and allocates I/O buffers, from
+// alloc if it is set
+func mmapQueues(fd int, queueID uint16, depth int, alloc interfaces.BufferAllocator) (unsafe.Pointer, []byte, error) {
+	descSize, mmapOffset := descMapping(queueID, depth)
 
 	// Map descriptor array as READ-ONLY from userspace perspective
 	// The kernel writes to descriptors internally, userspace only reads
-	descPtr, _, errno := syscall.Syscall6(
-		syscall.SYS_MMAP,
-		0,                 // addr
-		uintptr(descSize), // length (page-rounded)
-		syscall.PROT_READ, // prot - READ ONLY from userspace!
-		syscall.MAP_SHARED|syscall.MAP_POPULATE, // flags - populate to avoid page faults
-		uintptr(fd), // fd
-		mmapOffset,  // per-queue offset
-	)
+	descPtr, errno := mmapDescs(fd, descSize, uintptr(mmapOffset))
 	if errno != 0 {
 		return nil, nil, fmt.Errorf("failed to mmap descriptor array: %v", errno)
 	}
 
 	// Allocate I/O buffers in userspace memory (NOT mapped from device)
 	// The kernel doesn't expose I/O buffers via mmap; we manage them ourselves
-	bufPtr, _, errno := syscall.Syscall6(
-		syscall.SYS_MMAP,
-		0,                                    // addr
-		uintptr(bufSize),                     // length
-		syscall.PROT_READ|syscall.PROT_WRITE, // prot
-		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS, // flags - anonymous memory
-		^uintptr(0), // fd = -1 for anonymous
-		0,           // offset
-	)
-	if errno != 0 {
-		_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, descPtr, uintptr(descSize), 0)
-		return nil, nil, fmt.Errorf("failed to allocate I/O buffers: %v", errno)
+	bufs, err := allocTagBuffers(alloc, depth)
+	if err != nil {
+		munmapDescs(pointerFromMmap(descPtr), descSize)
+		return nil, nil, err
 	}
 
 	// Convert uintptr to unsafe.Pointer using helper to avoid go vet false positive
-	return pointerFromMmap(descPtr), pointerFromMmap(bufPtr), nil
+	return pointerFromMmap(descPtr), bufs, nil
 }
 
-// NewStubRunner creates a stub runner for simulation/testing
-func NewStubRunner(ctx context.Context, config Config) *Runner {
-	ctx, cancel := context.WithCancel(ctx)
+// descMapping returns the size and char device offset of queueID's
+// descriptor array: offset = queueID * round_up(depth * sizeof(desc), PAGE_SIZE).
+func descMapping(queueID uint16, depth int) (size int, offset int64) {
+	size = depth * int(unsafe.Sizeof(uapi.UblksrvIODesc{}))
 
-	// Default block size to 512 if not specified
-	blockSize := config.BlockSize
-	if blockSize <= 0 {
-		blockSize = 512
+	// Page-round the mmap size
+	pageSize := os.Getpagesize()
+	if rem := size % pageSize; rem != 0 {
+		size += pageSize - rem
 	}
+	return size, int64(queueID) * int64(size)
+}
 
-	return &Runner{
+// NewStubRunner creates a stub runner for testing. It serves commands but
+// never sees I/O; NewSimRunner runs the real loop against a simulated driver.
+func NewStubRunner(ctx context.Context, config Config) *Runner {
+	ctx, cancel := context.WithCancel(ctx)
+
+	runner := &Runner{
 		deviceID:     config.DevID,
 		queueID:      config.QueueID,
 		depth:        config.Depth,
-		blockSize:    blockSize,
-		backend:      config.Backend,
 		charDeviceFd: -1,  // No real device
 		ring:         nil, // No real ring
 		descPtr:      nil,
@@ -711,10 +1957,32 @@ func NewStubRunner(ctx context.Context, config Config) *Runner {
 		ctx:          ctx,
 		cancel:       cancel,
 		logger:       config.Logger,
+		workers:      config.Workers,
 		tagStates:    make([]TagState, config.Depth),
-		tagMutexes:   make([]sync.Mutex, config.Depth),
 		ioCmds:       make([]uapi.UblksrvIOCmd, config.Depth),
+
+		discardGranularity: int64(config.DiscardGranularity),
+		maxDiscardBytes:    config.maxDiscardBytes(),
+		errnoMapper:        config.ErrnoMapper,
+		maxIOBytes:         config.maxIOBytes(),
+		ioTimeout:          config.IOTimeout,
+		allocator:          config.BufferAllocator,
+		gate:               config.Gate,
+		budget:             config.InFlightBytes,
+		barrier:            config.FlushBarrier,
+		activity:           config.Activity,
+		onWrite:            config.OnWrite,
+		raw:                config.RawHandler,
+		trace:              config.Trace,
+		onCQOverflow:       config.OnCQOverflow,
+		unknownOp:          config.UnknownOp,
+		onUnknownOp:        config.OnUnknownOp,
+		onUnknownFlags:     config.OnUnknownFlags,
+		readAhead:          newStreamDetector(config.MaxReadAhead),
 	}
+	runner.backend.Store(&config.Backend)
+	runner.setQueueObserver(config)
+	return runner
 }
 
 // stubLoop simulates the I/O processing loop for testing
@@ -723,9 +1991,19 @@ func (r *Runner) stubLoop() {
 		r.logger.Debugf("Queue %d: Starting stub I/O loop (simulation mode)", r.queueID)
 	}
 
-	// In stub mode, we just wait for cancellation
+	// In stub mode, we just serve commands until cancelled.
 	// This simulates a working queue without doing real I/O
-	<-r.ctx.Done()
+	for !r.stopping {
+		select {
+		case <-r.ctx.Done():
+			r.stopping = true
+		case cmd := <-r.commands.cmds:
+			if cmd.run != nil {
+				cmd.run()
+			}
+			r.stopping = cmd.stop
+		}
+	}
 
 	if r.logger != nil {
 		r.logger.Debugf("Queue %d: Stopping stub I/O loop (simulation mode)", r.queueID)
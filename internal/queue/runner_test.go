@@ -1,11 +1,26 @@
 package queue
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unsafe"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
 )
 
 // Mock backend for testing
@@ -94,6 +109,157 @@ func (m *mockBackend) setReadError(err error) {
 	m.readErr = err
 }
 
+// mockDiscardBackend records Discard calls
+type mockDiscardBackend struct {
+	*mockBackend
+	discards [][2]int64
+}
+
+func (m *mockDiscardBackend) Discard(offset, length int64) error {
+	m.discards = append(m.discards, [2]int64{offset, length})
+	return nil
+}
+
+// mockZonedBackend reports fixed-size sequential zones
+type mockZonedBackend struct {
+	*mockBackend
+	zoneSize int64
+}
+
+func (m *mockZonedBackend) ReportZones(offset int64, nrZones int) ([]interfaces.Zone, error) {
+	var zones []interfaces.Zone
+	for start := offset - offset%m.zoneSize; start < m.size && len(zones) < nrZones; start += m.zoneSize {
+		zones = append(zones, interfaces.Zone{
+			Start:        start,
+			Length:       m.zoneSize,
+			WritePointer: start,
+			Type:         uapi.BLK_ZONE_TYPE_SEQWRITE_REQ,
+			Cond:         uapi.BLK_ZONE_COND_EMPTY,
+		})
+	}
+	return zones, nil
+}
+
+// preparedCmd is an I/O command captured by fakeRing
+type preparedCmd struct {
+	cmd      uint32
+	ioCmd    uapi.UblksrvIOCmd
+	userData uint64
+}
+
+// fakeRing records prepared I/O commands instead of talking to the kernel
+type fakeRing struct {
+	prepared    []preparedCmd
+	polls       []uint64       // userData of prepared POLL_ADDs
+	completions []uring.Result // returned by the next WaitForCompletion
+	full        bool           // PrepareIOCmd fails with ErrRingFull
+	fullUntil   int            // ... until this many more flushes have happened
+	flushes     int
+}
+
+func (f *fakeRing) Close() error { return nil }
+
+func (f *fakeRing) SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (uring.Result, error) {
+	return nil, errors.New("not supported by fakeRing")
+}
+
+func (f *fakeRing) SubmitCtrlCmdAsync(
+	cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64,
+) (*uring.AsyncHandle, error) {
+	return nil, errors.New("not supported by fakeRing")
+}
+
+func (f *fakeRing) SubmitIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData uint64) (uring.Result, error) {
+	return nil, f.PrepareIOCmd(cmd, ioCmd, userData)
+}
+
+func (f *fakeRing) PrepareIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData uint64) error {
+	if f.full || f.fullUntil > 0 {
+		return uring.ErrRingFull
+	}
+	f.prepared = append(f.prepared, preparedCmd{cmd: cmd, ioCmd: *ioCmd, userData: userData})
+	return nil
+}
+
+func (f *fakeRing) PreparePollAdd(fd int32, userData uint64) error {
+	f.polls = append(f.polls, userData)
+	return nil
+}
+
+func (f *fakeRing) FlushSubmissions() (uint32, error) {
+	f.flushes++
+	if f.fullUntil > 0 {
+		f.fullUntil--
+	}
+	return uint32(len(f.prepared)), nil
+}
+
+func (f *fakeRing) WaitForCompletion(timeout int) ([]uring.Result, error) {
+	completions := f.completions
+	f.completions = nil
+	return completions, nil
+}
+
+// fakeResult is a CQE delivered by fakeRing
+type fakeResult struct {
+	userData uint64
+	value    int32
+}
+
+func (r fakeResult) UserData() uint64 { return r.userData }
+func (r fakeResult) Value() int32     { return r.value }
+func (r fakeResult) Error() error     { return nil }
+
+func (f *fakeRing) NewBatch() uring.Batch { return nil }
+
+func (f *fakeRing) Enable() error { return nil }
+
+// lastResult returns the result of the most recently prepared command
+func (f *fakeRing) lastResult(t *testing.T) int32 {
+	t.Helper()
+	if len(f.prepared) == 0 {
+		t.Fatal("no command was prepared")
+	}
+	return f.prepared[len(f.prepared)-1].ioCmd.Result
+}
+
+// testRunner is a Runner wired to Go-allocated descriptor and buffer memory
+type testRunner struct {
+	*Runner
+	ring  *fakeRing
+	descs []uapi.UblksrvIODesc
+	bufs  []byte
+}
+
+// newTestRunner creates a runner whose descriptors and buffers live in Go
+// memory and whose ring is a fakeRing, so the request path can be exercised
+// without a kernel.
+func newTestRunner(t testing.TB, config Config) *testRunner {
+	t.Helper()
+	tr := &testRunner{
+		ring:  &fakeRing{},
+		descs: make([]uapi.UblksrvIODesc, config.Depth),
+		bufs:  make([]byte, config.Depth*constants.IOBufferSizePerTag),
+	}
+	tr.Runner = NewStubRunner(context.Background(), config)
+	tr.Runner.ring = tr.ring
+	tr.Runner.descPtr = unsafe.Pointer(&tr.descs[0])
+	tr.Runner.bufPtr = unsafe.Pointer(&tr.bufs[0])
+	t.Cleanup(tr.cancel)
+	return tr
+}
+
+// issue places a descriptor for tag and delivers its FETCH completion
+func (tr *testRunner) issue(t *testing.T, tag uint16, desc uapi.UblksrvIODesc) int32 {
+	t.Helper()
+	tr.descs[tag] = desc
+	tr.tagStates[tag] = TagStateInFlightFetch
+	if err := tr.handleCompletion(tag, false, 0); err != nil {
+		t.Fatalf("handleCompletion: %v", err)
+	}
+	return tr.ring.lastResult(t)
+}
+
 // Mock logger for testing
 type mockLogger struct {
 	messages []string
@@ -160,7 +326,7 @@ func TestRunnerCreation(t *testing.T) {
 		t.Errorf("Expected depth=64, got %d", runner.depth)
 	}
 
-	if runner.backend != backend {
+	if runner.currentBackend() != backend {
 		t.Error("Backend not set correctly")
 	}
 
@@ -169,10 +335,6 @@ func TestRunnerCreation(t *testing.T) {
 		t.Errorf("Expected 64 tag states, got %d", len(runner.tagStates))
 	}
 
-	if len(runner.tagMutexes) != 64 {
-		t.Errorf("Expected 64 tag mutexes, got %d", len(runner.tagMutexes))
-	}
-
 	// All tag states should be initialized to 0 (TagStateInFlightFetch)
 	for i, state := range runner.tagStates {
 		if state != TagState(0) {
@@ -184,6 +346,40 @@ func TestRunnerCreation(t *testing.T) {
 	runner.Close()
 }
 
+func TestRunnerNewRing(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []uring.Config
+	providerErr := errors.New("no ring today")
+	anchor := &fakeRing{}
+	_, err = NewRunner(context.Background(), Config{
+		Depth:    16,
+		Backend:  newMockBackend(1 << 20),
+		CharFd:   int(f.Fd()),
+		IOWQ:     uring.IOWQConfig{MaxBounded: 2},
+		AttachWQ: anchor,
+		NewRing: func(c uring.Config) (uring.QueueRing, error) {
+			got = append(got, c)
+			return nil, providerErr
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), providerErr.Error()) {
+		t.Errorf("NewRunner error = %v, want the provider's", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("provider called %d times, want 1", len(got))
+	}
+	c := got[0]
+	if c.Entries != 16+1+constants.RingHeadroom || c.FD <= 0 || int(c.FD) == int(f.Fd()) ||
+		!c.SingleIssuer || c.IOWQ.MaxBounded != 2 || c.AttachWQ != anchor {
+		t.Errorf("provider got %+v, want the queue's own fd, depth+1+headroom entries, SingleIssuer, IOWQ and AttachWQ", c)
+	}
+}
+
 func TestRunnerTagStateTracking(t *testing.T) {
 	backend := newMockBackend(1024 * 1024)
 	logger := &mockLogger{}
@@ -212,110 +408,268 @@ func TestRunnerTagStateTracking(t *testing.T) {
 
 	// Simulate: submitInitialFetchReq -> TagStateInFlightFetch
 	tag := 0
-	runner.tagMutexes[tag].Lock()
 	runner.tagStates[tag] = TagStateInFlightFetch
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateInFlightFetch {
 		t.Errorf("Tag %d should be in TagStateInFlightFetch, got %d", tag, runner.tagStates[tag])
 	}
 
 	// Simulate: handleCompletion(FETCH_REQ) -> TagStateOwned
-	runner.tagMutexes[tag].Lock()
 	if runner.tagStates[tag] == TagStateInFlightFetch {
 		runner.tagStates[tag] = TagStateOwned
 	}
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateOwned {
 		t.Errorf("Tag %d should be in TagStateOwned, got %d", tag, runner.tagStates[tag])
 	}
 
 	// Simulate: processIOAndCommit -> TagStateInFlightCommit
-	runner.tagMutexes[tag].Lock()
 	if runner.tagStates[tag] == TagStateOwned {
 		runner.tagStates[tag] = TagStateInFlightCommit
 	}
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateInFlightCommit {
 		t.Errorf("Tag %d should be in TagStateInFlightCommit, got %d", tag, runner.tagStates[tag])
 	}
 
 	// Simulate: handleCompletion(COMMIT_AND_FETCH_REQ) -> TagStateOwned (next cycle)
-	runner.tagMutexes[tag].Lock()
 	if runner.tagStates[tag] == TagStateInFlightCommit {
 		runner.tagStates[tag] = TagStateOwned
 	}
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateOwned {
 		t.Errorf("Tag %d should be back in TagStateOwned, got %d", tag, runner.tagStates[tag])
 	}
 }
 
-func TestRunnerConcurrentTagAccess(t *testing.T) {
-	backend := newMockBackend(1024 * 1024)
-	logger := &mockLogger{}
+func TestRunnerStopCommand(t *testing.T) {
+	tr := newTestRunner(t, Config{Depth: 4, Backend: newMockBackend(1 << 20)})
+	commands, err := newCommandQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer commands.close()
+	tr.commands = commands
 
-	config := Config{
-		DevID:   0,
-		QueueID: 0,
-		Depth:   16,
-		Backend: backend,
-		Logger:  logger,
+	// A wakeup without a command just re-arms the poll
+	tr.ring.completions = []uring.Result{fakeResult{userData: udWakeup}}
+	if err := tr.processRequests(); err != nil {
+		t.Fatalf("processRequests: %v", err)
+	}
+	if tr.stopping || len(tr.ring.polls) != 1 {
+		t.Fatalf("spurious wakeup: stopping=%v polls=%d, want false and 1", tr.stopping, len(tr.ring.polls))
 	}
 
-	ctx := context.Background()
-	runner := NewStubRunner(ctx, config)
-	defer runner.Close()
+	// A Stop command ends the loop and leaves the poll disarmed
+	commands.post(queueCmd{stop: true})
+	tr.ring.completions = []uring.Result{fakeResult{userData: udWakeup}}
+	if err := tr.processRequests(); err != nil {
+		t.Fatalf("processRequests: %v", err)
+	}
+	if !tr.stopping || len(tr.ring.polls) != 1 {
+		t.Fatalf("after Stop: stopping=%v polls=%d, want true and 1", tr.stopping, len(tr.ring.polls))
+	}
+}
+
+// overflowRing is a fakeRing that counts CQ overflows.
+type overflowRing struct {
+	*fakeRing
+	overflows uint64
+}
+
+func (o *overflowRing) CQOverflows() uint64 { return o.overflows }
+
+func TestRunnerCQOverflow(t *testing.T) {
+	var reported []uint64
+	tr := newTestRunner(t, Config{
+		Depth:   4,
+		Backend: newMockBackend(1 << 20),
+		OnCQOverflow: func(queueID uint16, n uint64) {
+			reported = append(reported, n)
+		},
+	})
+	ring := &overflowRing{fakeRing: tr.ring}
+	tr.Runner.ring = ring
+
+	for _, total := range []uint64{0, 2, 2, 5} {
+		ring.overflows = total
+		if err := tr.processRequests(); err != nil {
+			t.Fatalf("processRequests: %v", err)
+		}
+	}
+	if want := []uint64{2, 3}; !slices.Equal(reported, want) {
+		t.Errorf("OnCQOverflow got %v, want %v", reported, want)
+	}
+}
+
+func TestRunnerPipelinedCommits(t *testing.T) {
+	backend := newMockBackend(1 << 20)
+	copy(backend.data[4096:], "tag1")
+	tr := newTestRunner(t, Config{Depth: 4, Backend: backend, Workers: 2})
+	commands, err := newCommandQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer commands.close()
+	tr.commands = commands
+	tr.loop = commands
+	tr.startWorkers()
+	defer tr.stopWorkers()
+
+	// Both FETCHes complete in one batch; neither commit is prepared inline
+	for tag := uint16(0); tag < 2; tag++ {
+		tr.descs[tag] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: uint64(tag) * 8}
+		tr.tagStates[tag] = TagStateInFlightFetch
+		if err := tr.handleCompletion(tag, false, 0); err != nil {
+			t.Fatalf("handleCompletion: %v", err)
+		}
+	}
+	if len(tr.ring.prepared) != 0 {
+		t.Fatalf("%d commits prepared before the workers finished", len(tr.ring.prepared))
+	}
+
+	// Worker wakeups turn into commits on the loop
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tr.ring.prepared) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of 2 commits prepared", len(tr.ring.prepared))
+		}
+		tr.ring.completions = []uring.Result{fakeResult{userData: udWakeup}}
+		if err := tr.processRequests(); err != nil {
+			t.Fatalf("processRequests: %v", err)
+		}
+	}
+
+	for _, p := range tr.ring.prepared {
+		if p.cmd != uapi.UBLK_U_IO_COMMIT_AND_FETCH_REQ || p.ioCmd.Result != 4096 {
+			t.Errorf("tag %d: cmd 0x%x result %d, want COMMIT_AND_FETCH with 4096", p.ioCmd.Tag, p.cmd, p.ioCmd.Result)
+		}
+		if tr.tagStates[p.ioCmd.Tag] != TagStateInFlightCommit {
+			t.Errorf("tag %d in state %d after commit", p.ioCmd.Tag, tr.tagStates[p.ioCmd.Tag])
+		}
+	}
+	if got := string(tr.bufs[constants.IOBufferSizePerTag : constants.IOBufferSizePerTag+4]); got != "tag1" {
+		t.Errorf("tag 1 buffer = %q, want %q", got, "tag1")
+	}
+}
+
+// nopObserver ignores backend operation metrics
+type nopObserver struct{}
+
+func (nopObserver) ObserveRead(uint64, uint64, bool)    {}
+func (nopObserver) ObserveWrite(uint64, uint64, bool)   {}
+func (nopObserver) ObserveDiscard(uint64, uint64, bool) {}
+func (nopObserver) ObserveFlush(uint64, bool)           {}
+func (nopObserver) ObserveQueueDepth(uint32)            {}
 
-	// Test concurrent access to different tags (should not block)
-	var wg sync.WaitGroup
+// queueEvents records QueueObserver callbacks
+type queueEvents struct {
+	nopObserver
+	events []string
+}
 
-	for tag := 0; tag < 4; tag++ {
-		wg.Add(1)
-		go func(t int) {
-			defer wg.Done()
+func (q *queueEvents) OnFetchCompleted(queueID, tag uint16, result int32) {
+	q.events = append(q.events, fmt.Sprintf("fetch q%d t%d %d", queueID, tag, result))
+}
 
-			// Simulate state transitions for this tag
-			runner.tagMutexes[t].Lock()
-			runner.tagStates[t] = TagStateInFlightFetch
-			runner.tagMutexes[t].Unlock()
+func (q *queueEvents) OnCommitSubmitted(queueID, tag uint16, result int32) {
+	q.events = append(q.events, fmt.Sprintf("commit q%d t%d %d", queueID, tag, result))
+}
+
+func (q *queueEvents) OnQueueStall(queueID, tag uint16, stalled time.Duration) {
+	q.events = append(q.events, fmt.Sprintf("stall q%d t%d", queueID, tag))
+}
 
-			time.Sleep(1 * time.Millisecond) // Simulate work
+func (q *queueEvents) OnRingFull(queueID uint16) {
+	q.events = append(q.events, fmt.Sprintf("full q%d", queueID))
+}
 
-			runner.tagMutexes[t].Lock()
-			runner.tagStates[t] = TagStateOwned
-			runner.tagMutexes[t].Unlock()
+func (q *queueEvents) OnIOError(queueID, tag uint16, op uint8, offset uint64, length uint32, err error) {
+	q.events = append(q.events, fmt.Sprintf("error q%d t%d op%d %d+%d: %v", queueID, tag, op, offset, length, err))
+}
 
-			time.Sleep(1 * time.Millisecond)
+func TestRunnerQueueObserver(t *testing.T) {
+	obs := &queueEvents{}
+	tr := newTestRunner(t, Config{
+		QueueID: 1, Depth: 4, Backend: newMockBackend(1 << 20), Observer: obs, StallThreshold: time.Hour,
+	})
 
-			runner.tagMutexes[t].Lock()
-			runner.tagStates[t] = TagStateInFlightCommit
-			runner.tagMutexes[t].Unlock()
-		}(tag)
+	tr.issue(t, 2, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8})
+	want := []string{"fetch q1 t2 0", "commit q1 t2 4096"}
+	if fmt.Sprint(obs.events) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", obs.events, want)
 	}
 
-	// Wait for all goroutines to complete
-	done := make(chan bool)
-	go func() {
-		wg.Wait()
-		done <- true
-	}()
+	// Any request outlives a 1ns threshold
+	obs.events = nil
+	tr.stallThreshold = time.Nanosecond
+	tr.issue(t, 3, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_FLUSH})
+	if n := len(obs.events); n != 3 || obs.events[2] != "stall q1 t3" {
+		t.Errorf("events = %v, want fetch, commit, stall", obs.events)
+	}
 
-	select {
-	case <-done:
-		// Success - no deadlock
-	case <-time.After(5 * time.Second):
-		t.Fatal("Deadlock detected - concurrent tag access took too long")
+	obs.events = nil
+	tr.ring.full = true
+	tr.descs[0] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_FLUSH}
+	tr.tagStates[0] = TagStateInFlightFetch
+	if err := tr.handleCompletion(0, false, 0); err != nil {
+		t.Fatalf("handleCompletion with a full ring: %v", err)
+	}
+	if len(obs.events) != 2 || obs.events[1] != "full q1" {
+		t.Errorf("events = %v, want fetch, full", obs.events)
+	}
+	tr.ring.full = false
+	if err := retryDeferred(tr.ring, tr.Runner); err != nil {
+		t.Fatalf("retryDeferred: %v", err)
 	}
 
-	// Verify final states
-	for tag := 0; tag < 4; tag++ {
-		if runner.tagStates[tag] != TagStateInFlightCommit {
-			t.Errorf("Tag %d should be in TagStateInFlightCommit, got %d", tag, runner.tagStates[tag])
-		}
+	obs.events = nil
+	tr.stallThreshold = time.Hour
+	tr.currentBackend().(*mockBackend).setReadError(errors.New("bad sector"))
+	tr.issue(t, 1, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: 2})
+	want = []string{"fetch q1 t1 0", "error q1 t1 op0 1024+4096: bad sector", "commit q1 t1 -5"}
+	if fmt.Sprint(obs.events) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", obs.events, want)
+	}
+}
+
+func TestRunnerRingFullDefersCommit(t *testing.T) {
+	tr := newTestRunner(t, Config{Depth: 4, Backend: newMockBackend(1 << 20)})
+
+	// The ring frees up on the second flush: the loop's own flush plus one
+	// retry with backoff
+	tr.ring.fullUntil = 2
+	tr.descs[1] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	tr.tagStates[1] = TagStateInFlightFetch
+	if err := tr.handleCompletion(1, false, 0); err != nil {
+		t.Fatalf("handleCompletion with a full ring: %v", err)
+	}
+	if tr.tagStates[1] != TagStateOwned || len(tr.deferred) != 1 {
+		t.Fatalf("tag state %v with %d deferred commits, want Owned with 1", tr.tagStates[1], len(tr.deferred))
+	}
+
+	if _, err := tr.ring.FlushSubmissions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := retryDeferred(tr.ring, tr.Runner); err != nil {
+		t.Fatalf("retryDeferred: %v", err)
+	}
+	if tr.tagStates[1] != TagStateInFlightCommit || len(tr.deferred) != 0 {
+		t.Errorf("tag state %v with %d deferred commits after retry", tr.tagStates[1], len(tr.deferred))
+	}
+	if got := tr.ring.lastResult(t); got != 4096 {
+		t.Errorf("deferred commit result = %d, want 4096", got)
+	}
+
+	// A ring that never drains is fatal once the retries run out
+	tr.ring.full = true
+	tr.descs[2] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_FLUSH}
+	tr.tagStates[2] = TagStateInFlightFetch
+	if err := tr.handleCompletion(2, false, 0); err != nil {
+		t.Fatalf("handleCompletion with a full ring: %v", err)
+	}
+	if err := retryDeferred(tr.ring, tr.Runner); !errors.Is(err, uring.ErrRingFull) {
+		t.Errorf("retryDeferred on a stuck ring = %v, want ErrRingFull", err)
 	}
 }
 
@@ -340,11 +694,9 @@ func TestRunnerBackendErrorHandling(t *testing.T) {
 
 	// Even with backend errors, tag state transitions should remain consistent
 	tag := 0
-	runner.tagMutexes[tag].Lock()
 	initialState := runner.tagStates[tag]
 	runner.tagStates[tag] = TagStateOwned
 	finalState := runner.tagStates[tag]
-	runner.tagMutexes[tag].Unlock()
 
 	if initialState == finalState && finalState != TagStateOwned {
 		t.Error("State transition failed even without I/O operation")
@@ -463,17 +815,60 @@ func BenchmarkTagStateTransition(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		tag := i % runner.depth
 
-		runner.tagMutexes[tag].Lock()
 		runner.tagStates[tag] = TagStateInFlightFetch
-		runner.tagMutexes[tag].Unlock()
 
-		runner.tagMutexes[tag].Lock()
 		runner.tagStates[tag] = TagStateOwned
-		runner.tagMutexes[tag].Unlock()
 
-		runner.tagMutexes[tag].Lock()
 		runner.tagStates[tag] = TagStateInFlightCommit
-		runner.tagMutexes[tag].Unlock()
+	}
+}
+
+// nopBackend completes every request without touching the data, so
+// benchmarks measure only the runner's own overhead.
+type nopBackend struct{}
+
+func (nopBackend) ReadAt(p []byte, off int64) (int, error)  { return len(p), nil }
+func (nopBackend) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+func (nopBackend) Size() int64                              { return 1 << 30 }
+func (nopBackend) Close() error                             { return nil }
+func (nopBackend) Flush() error                             { return nil }
+
+// BenchmarkHandleCompletion measures the per-IOP cost of the completion
+// path: FETCH CQE -> descriptor load -> 4K read -> COMMIT prepare.
+func BenchmarkHandleCompletion(b *testing.B) {
+	const depth = 64
+	tr := newTestRunner(b, Config{Depth: depth, Backend: nopBackend{}})
+	for tag := range tr.descs {
+		tr.descs[tag] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: uint64(tag) * 8}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tag := uint16(i % depth)
+		tr.tagStates[tag] = TagStateInFlightFetch
+		if err := tr.handleCompletion(tag, false, 0); err != nil {
+			b.Fatal(err)
+		}
+		tr.ring.prepared = tr.ring.prepared[:0]
+	}
+}
+
+// BenchmarkLoadDescriptor measures reading a tag's descriptor, done once
+// per request.
+func BenchmarkLoadDescriptor(b *testing.B) {
+	const depth = 64
+	tr := newTestRunner(b, Config{Depth: depth, Backend: nopBackend{}})
+	for tag := range tr.descs {
+		tr.descs[tag] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: uint64(tag) * 8}
+	}
+
+	var sectors uint64
+	for i := 0; i < b.N; i++ {
+		sectors += tr.loadDescriptor(uint16(i % depth)).StartSector
+	}
+	if sectors == 1 {
+		b.Log(sectors) // Keeps the loads from being optimized away
 	}
 }
 
@@ -502,44 +897,36 @@ func TestTagStateMachineFlow(t *testing.T) {
 	}
 
 	// Flow 1: Submit initial FETCH_REQ -> InFlightFetch
-	runner.tagMutexes[tag].Lock()
 	if runner.tagStates[tag] == TagState(0) {
 		runner.tagStates[tag] = TagStateInFlightFetch
 	}
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateInFlightFetch {
 		t.Errorf("Should be InFlightFetch, got %d", runner.tagStates[tag])
 	}
 
 	// Flow 2: FETCH_REQ completes with I/O ready -> Owned
-	runner.tagMutexes[tag].Lock()
 	if runner.tagStates[tag] == TagStateInFlightFetch {
 		runner.tagStates[tag] = TagStateOwned
 	}
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateOwned {
 		t.Errorf("Should be Owned, got %d", runner.tagStates[tag])
 	}
 
 	// Flow 3: Process I/O and submit COMMIT_AND_FETCH_REQ -> InFlightCommit
-	runner.tagMutexes[tag].Lock()
 	if runner.tagStates[tag] == TagStateOwned {
 		runner.tagStates[tag] = TagStateInFlightCommit
 	}
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateInFlightCommit {
 		t.Errorf("Should be InFlightCommit, got %d", runner.tagStates[tag])
 	}
 
 	// Flow 4: COMMIT_AND_FETCH_REQ completes with next I/O ready -> Owned (cycle continues)
-	runner.tagMutexes[tag].Lock()
 	if runner.tagStates[tag] == TagStateInFlightCommit {
 		runner.tagStates[tag] = TagStateOwned
 	}
-	runner.tagMutexes[tag].Unlock()
 
 	if runner.tagStates[tag] != TagStateOwned {
 		t.Errorf("Should be back to Owned, got %d", runner.tagStates[tag])
@@ -547,3 +934,649 @@ func TestTagStateMachineFlow(t *testing.T) {
 
 	// This demonstrates the steady-state cycle: Owned -> InFlightCommit -> Owned -> ...
 }
+
+func TestRunnerGate(t *testing.T) {
+	var gate sync.RWMutex
+	backend := newMockBackend(1 << 20)
+	tr := newTestRunner(t, Config{Depth: 1, Backend: backend, Gate: &gate})
+	tr.bufs[0] = 0xAB
+
+	// With the gate held exclusively the write must wait
+	gate.Lock()
+	tr.descs[0] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 1}
+	tr.tagStates[0] = TagStateInFlightFetch
+	done := make(chan error, 1)
+	go func() { done <- tr.handleCompletion(0, false, 0) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("write completed through a held gate: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	backend.mu.RLock()
+	written := backend.data[0]
+	backend.mu.RUnlock()
+	if written != 0 {
+		t.Fatal("backend was written while the gate was held")
+	}
+
+	gate.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("handleCompletion: %v", err)
+	}
+	if result := tr.ring.lastResult(t); result != 512 {
+		t.Errorf("result = %d, want 512", result)
+	}
+	if backend.data[0] != 0xAB {
+		t.Error("write did not reach the backend after the gate opened")
+	}
+}
+
+func TestRunnerActivity(t *testing.T) {
+	var activity atomic.Uint64
+	tr := newTestRunner(t, Config{Depth: 1, Backend: newMockBackend(1 << 20), Activity: &activity})
+
+	for i := 0; i < 3; i++ {
+		tr.descs[0] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 1}
+		tr.tagStates[0] = TagStateInFlightFetch
+		if err := tr.handleCompletion(0, false, 0); err != nil {
+			t.Fatalf("handleCompletion: %v", err)
+		}
+	}
+	if got := activity.Load(); got != 3 {
+		t.Errorf("activity = %d, want 3", got)
+	}
+}
+
+func TestRunnerSetBackend(t *testing.T) {
+	first, second := newMockBackend(1<<20), newMockBackend(1<<20)
+	tr := newTestRunner(t, Config{Depth: 1, Backend: first})
+	tr.bufs[0] = 0xCD
+
+	tr.SetBackend(second)
+	tr.descs[0] = uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 1}
+	tr.tagStates[0] = TagStateInFlightFetch
+	if err := tr.handleCompletion(0, false, 0); err != nil {
+		t.Fatalf("handleCompletion: %v", err)
+	}
+	if first.data[0] != 0 || second.data[0] != 0xCD {
+		t.Error("write did not go to the replacement backend")
+	}
+}
+
+func TestRunnerOnWrite(t *testing.T) {
+	var got [][2]int64
+	tr := newTestRunner(t, Config{
+		Depth:   1,
+		Backend: newMockBackend(1 << 20),
+		OnWrite: func(offset, length int64) { got = append(got, [2]int64{offset, length}) },
+	})
+
+	for _, desc := range []uapi.UblksrvIODesc{
+		{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: 8, NrSectors: 2},
+		{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 1},
+		{OpFlags: uapi.UBLK_IO_OP_DISCARD, NrSectors: 8}, // unsupported, nothing changed
+	} {
+		tr.descs[0] = desc
+		tr.tagStates[0] = TagStateInFlightFetch
+		if err := tr.handleCompletion(0, false, 0); err != nil {
+			t.Fatalf("handleCompletion: %v", err)
+		}
+	}
+	if len(got) != 1 || got[0] != [2]int64{4096, 1024} {
+		t.Errorf("OnWrite calls = %v, want one for the write", got)
+	}
+}
+
+func TestRunnerDiscard_Split(t *testing.T) {
+	backend := &mockDiscardBackend{mockBackend: newMockBackend(1 << 20)}
+	tr := newTestRunner(t, Config{
+		Depth:              1,
+		Backend:            backend,
+		DiscardGranularity: 4096,
+		MaxDiscardSectors:  16, // 8KB per Discard call
+	})
+
+	result := tr.issue(t, 0, uapi.UblksrvIODesc{
+		OpFlags:     uapi.UBLK_IO_OP_DISCARD,
+		NrSectors:   40, // 20KB
+		StartSector: 8,
+	})
+
+	if result != 40<<9 {
+		t.Errorf("result = %d, want %d", result, 40<<9)
+	}
+	want := [][2]int64{{4096, 8192}, {12288, 8192}, {20480, 4096}}
+	if len(backend.discards) != len(want) {
+		t.Fatalf("discards = %v, want %v", backend.discards, want)
+	}
+	for i := range want {
+		if backend.discards[i] != want[i] {
+			t.Errorf("discard %d = %v, want %v", i, backend.discards[i], want[i])
+		}
+	}
+}
+
+func TestRunnerDiscard_Misaligned(t *testing.T) {
+	backend := &mockDiscardBackend{mockBackend: newMockBackend(1 << 20)}
+	tr := newTestRunner(t, Config{
+		Depth:              1,
+		Backend:            backend,
+		DiscardGranularity: 4096,
+	})
+
+	result := tr.issue(t, 0, uapi.UblksrvIODesc{
+		OpFlags:     uapi.UBLK_IO_OP_DISCARD,
+		NrSectors:   8,
+		StartSector: 1,
+	})
+
+	if result != -int32(syscall.EINVAL) {
+		t.Errorf("result = %d, want -EINVAL", result)
+	}
+	if len(backend.discards) != 0 {
+		t.Errorf("backend saw discards %v for misaligned request", backend.discards)
+	}
+}
+
+func TestRunnerDiscard_Unsupported(t *testing.T) {
+	tr := newTestRunner(t, Config{
+		Depth:   1,
+		Backend: newMockBackend(1 << 20),
+	})
+
+	result := tr.issue(t, 0, uapi.UblksrvIODesc{
+		OpFlags:   uapi.UBLK_IO_OP_DISCARD,
+		NrSectors: 8,
+	})
+
+	if result != -int32(syscall.EOPNOTSUPP) {
+		t.Errorf("result = %d, want -EOPNOTSUPP", result)
+	}
+}
+
+func TestRunnerReadError_ReportsEIO(t *testing.T) {
+	backend := newMockBackend(1 << 20)
+	backend.setReadError(errors.New("mock read error"))
+	tr := newTestRunner(t, Config{Depth: 1, Backend: backend})
+
+	result := tr.issue(t, 0, uapi.UblksrvIODesc{
+		OpFlags:   uapi.UBLK_IO_OP_READ,
+		NrSectors: 8,
+	})
+
+	if result != -int32(syscall.EIO) {
+		t.Errorf("result = %d, want -EIO", result)
+	}
+}
+
+func TestRunnerErrnoMapping(t *testing.T) {
+	errFull := errors.New("volume full")
+	mapper := func(err error) syscall.Errno {
+		if errors.Is(err, errFull) {
+			return syscall.ENOSPC
+		}
+		return 0
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want syscall.Errno
+	}{
+		{"mapped", fmt.Errorf("write: %w", errFull), syscall.ENOSPC},
+		{"wrapped errno", fmt.Errorf("checksum mismatch: %w", syscall.EILSEQ), syscall.EILSEQ},
+		{"read-only", syscall.EROFS, syscall.EROFS},
+		{"deadline", fmt.Errorf("remote: %w", context.DeadlineExceeded), syscall.ETIMEDOUT},
+		{"unknown", errors.New("boom"), syscall.EIO},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newMockBackend(1 << 20)
+			backend.setReadError(tt.err)
+			tr := newTestRunner(t, Config{Depth: 1, Backend: backend, ErrnoMapper: mapper})
+
+			result := tr.issue(t, 0, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8})
+			if result != -int32(tt.want) {
+				t.Errorf("result = %d, want -%d (%v)", result, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+// shortBackend transfers at most chunk bytes per call and reports io.EOF
+// for reads that reach the end of data, like a file shorter than the device.
+// A write with stall set stores nothing and returns no error.
+type shortBackend struct {
+	data  []byte
+	chunk int
+	stall bool
+}
+
+func (b *shortBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), b.chunk)], b.data[off:])
+	if n < len(p) && off+int64(n) == int64(len(b.data)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *shortBackend) WriteAt(p []byte, off int64) (int, error) {
+	if b.stall {
+		return 0, nil
+	}
+	return copy(b.data[off:], p[:min(len(p), b.chunk)]), nil
+}
+
+func (b *shortBackend) Size() int64  { return 1 << 20 }
+func (b *shortBackend) Close() error { return nil }
+func (b *shortBackend) Flush() error { return nil }
+
+func TestRunnerPartialReads(t *testing.T) {
+	data := make([]byte, 10240)
+	for i := range data {
+		data[i] = byte(i%251) + 1 // never zero
+	}
+
+	tests := []struct {
+		name   string
+		sector uint64 // 512-byte start sector
+		want   int    // bytes expected from data; the rest must be zero
+	}{
+		{"inside", 0, 4096},
+		{"ends at EOF", 12, 4096},
+		{"straddles EOF", 16, 2048},
+		{"beyond EOF", 24, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := newTestRunner(t, Config{Depth: 1, Backend: &shortBackend{data: data, chunk: 1000}})
+			for i := range tr.bufs {
+				tr.bufs[i] = 0xAA // stale data from an earlier request
+			}
+
+			result := tr.issue(t, 0, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: tt.sector})
+			if result != 4096 {
+				t.Fatalf("result = %d, want 4096", result)
+			}
+			off := min(int(tt.sector)*512, len(data))
+			if !bytes.Equal(tr.bufs[:tt.want], data[off:off+tt.want]) {
+				t.Error("buffer does not hold the backend data")
+			}
+			if !bytes.Equal(tr.bufs[tt.want:4096], make([]byte, 4096-tt.want)) {
+				t.Error("buffer beyond EOF is not zero-filled")
+			}
+		})
+	}
+}
+
+func TestRunnerPartialWrites(t *testing.T) {
+	backend := &shortBackend{data: make([]byte, 8192), chunk: 1000}
+	tr := newTestRunner(t, Config{Depth: 1, Backend: backend})
+	for i := range 4096 {
+		tr.bufs[i] = byte(i%251) + 1
+	}
+
+	result := tr.issue(t, 0, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8, StartSector: 8})
+	if result != 4096 {
+		t.Fatalf("result = %d, want 4096", result)
+	}
+	if !bytes.Equal(backend.data[4096:], tr.bufs[:4096]) {
+		t.Error("short writes were not continued to completion")
+	}
+
+	// A write that stores nothing without an error must not report success
+	backend.stall = true
+	result = tr.issue(t, 0, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8})
+	if result != -int32(syscall.EIO) {
+		t.Errorf("result = %d, want -EIO", result)
+	}
+}
+
+func TestRunnerValidateRequest(t *testing.T) {
+	const size = 1 << 20 // 2048 sectors
+	tests := []struct {
+		name string
+		desc uapi.UblksrvIODesc
+		want int32
+	}{
+		{"read at limit", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 64}, 64 << 9},
+		{"read over limit", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 65}, -int32(syscall.EINVAL)},
+		{"write over buffer", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 1024}, -int32(syscall.EINVAL)},
+		{"read ends at size", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: 2040}, 8 << 9},
+		{"read past size", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: 2041},
+			-int32(syscall.ENOSPC)},
+		{"write past size", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 1, StartSector: 2048},
+			-int32(syscall.ENOSPC)},
+		{"huge start sector", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: 1 << 62},
+			-int32(syscall.ENOSPC)},
+		{"discard past size", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_DISCARD, NrSectors: 16, StartSector: 2040},
+			-int32(syscall.ENOSPC)},
+		{"zeroes past size", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE_ZEROES, NrSectors: 16, StartSector: 2040},
+			-int32(syscall.ENOSPC)},
+		{"flush", uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_FLUSH}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// MaxIOBytes below a tag buffer: the negotiated limit wins
+			tr := newTestRunner(t, Config{Depth: 1, Backend: newMockBackend(size), MaxIOBytes: 32 << 10})
+			if got := tr.issue(t, 0, tt.desc); got != tt.want {
+				t.Errorf("result = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// A limit above the tag buffer size is capped to it
+	if got := (Config{MaxIOBytes: 1 << 20}).maxIOBytes(); got != constants.IOBufferSizePerTag {
+		t.Errorf("maxIOBytes = %d, want %d", got, constants.IOBufferSizePerTag)
+	}
+}
+
+// TestRunnerSectorUnits serves the requests of a device with 4K logical
+// blocks: descriptors still count 512-byte sectors, so the runner never
+// needs the block size.
+func TestRunnerSectorUnits(t *testing.T) {
+	backend := newMockBackend(1 << 20)
+	for i := range backend.data {
+		backend.data[i] = byte(i / 4096)
+	}
+	tr := newTestRunner(t, Config{Depth: 1, Backend: backend})
+
+	// A 4K read at byte 512K
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8, StartSector: 1024}
+	if result := tr.issue(t, 0, read); result != 4096 {
+		t.Fatalf("read result = %d, want 4096", result)
+	}
+	if !bytes.Equal(tr.bufs[:4096], backend.data[512<<10:][:4096]) {
+		t.Error("read returned data from the wrong offset")
+	}
+
+	// A 4K write at byte 4K touches only that block
+	for i := range 4096 {
+		tr.bufs[i] = 0xAA
+	}
+	write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8, StartSector: 8}
+	if result := tr.issue(t, 0, write); result != 4096 {
+		t.Fatalf("write result = %d, want 4096", result)
+	}
+	if !bytes.Equal(backend.data[4096:8192], bytes.Repeat([]byte{0xAA}, 4096)) || backend.data[8192] != 2 {
+		t.Error("write did not land on exactly the 4K block at byte 4096")
+	}
+
+	// The last block is in range; the sector after it is not
+	read.StartSector = 2040
+	if result := tr.issue(t, 0, read); result != 4096 {
+		t.Errorf("read of the last block result = %d, want 4096", result)
+	}
+	read.StartSector = 2048
+	if result := tr.issue(t, 0, read); result != -int32(syscall.ENOSPC) {
+		t.Errorf("read past the end result = %d, want -ENOSPC", result)
+	}
+}
+
+func TestRunnerReportZones(t *testing.T) {
+	backend := &mockZonedBackend{mockBackend: newMockBackend(4 << 20), zoneSize: 1 << 20}
+	tr := newTestRunner(t, Config{Depth: 1, Backend: backend})
+
+	result := tr.issue(t, 0, uapi.UblksrvIODesc{
+		OpFlags:     uapi.UBLK_IO_OP_REPORT_ZONES,
+		NrSectors:   8,    // nr_zones
+		StartSector: 2048, // second zone
+	})
+
+	// Only three zones remain after the requested start
+	if result != 3*uapi.BlkZoneSize {
+		t.Fatalf("result = %d, want %d", result, 3*uapi.BlkZoneSize)
+	}
+	var zone uapi.BlkZone
+	zone.Start = binary.NativeEndian.Uint64(tr.bufs[0:8])
+	zone.Len = binary.NativeEndian.Uint64(tr.bufs[8:16])
+	zone.Capacity = binary.NativeEndian.Uint64(tr.bufs[32:40])
+	if zone.Start != 2048 || zone.Len != 2048 || zone.Capacity != 2048 {
+		t.Errorf("first zone = %+v, want start=len=capacity=2048 sectors", zone)
+	}
+}
+
+func TestRunnerReportZones_Unsupported(t *testing.T) {
+	tr := newTestRunner(t, Config{Depth: 1, Backend: newMockBackend(1 << 20)})
+
+	result := tr.issue(t, 0, uapi.UblksrvIODesc{
+		OpFlags:   uapi.UBLK_IO_OP_REPORT_ZONES,
+		NrSectors: 1,
+	})
+
+	if result != -int32(syscall.EOPNOTSUPP) {
+		t.Errorf("result = %d, want -EOPNOTSUPP", result)
+	}
+}
+
+func TestRunnerTagStates(t *testing.T) {
+	runner := NewStubRunner(context.Background(), Config{Depth: 4, Backend: newMockBackend(1 << 20)})
+	defer runner.Close()
+
+	if _, err := runner.TagStates(context.Background()); !errors.Is(err, ErrLoopNotRunning) {
+		t.Fatalf("TagStates before Start = %v, want ErrLoopNotRunning", err)
+	}
+
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	states, err := runner.TagStates(context.Background())
+	if err != nil {
+		t.Fatalf("TagStates: %v", err)
+	}
+	if len(states) != 4 {
+		t.Errorf("got %d tag states, want 4", len(states))
+	}
+
+	runner.Stop()
+	if _, err := runner.TagStates(context.Background()); !errors.Is(err, ErrLoopNotRunning) {
+		t.Errorf("TagStates after Stop = %v, want ErrLoopNotRunning", err)
+	}
+}
+
+// mockRequestBackend records the request behind each read and write
+type mockRequestBackend struct {
+	*mockBackend
+	reqs []interfaces.Request
+}
+
+func (m *mockRequestBackend) ReadAtRequest(p []byte, off int64, req interfaces.Request) (int, error) {
+	m.reqs = append(m.reqs, req)
+	return m.ReadAt(p, off)
+}
+
+func (m *mockRequestBackend) WriteAtRequest(p []byte, off int64, req interfaces.Request) (int, error) {
+	m.reqs = append(m.reqs, req)
+	return m.WriteAt(p, off)
+}
+
+func TestRunnerRequestFlags(t *testing.T) {
+	backend := &mockRequestBackend{mockBackend: newMockBackend(1 << 20)}
+	tr := newTestRunner(t, Config{QueueID: 2, Depth: 4, Backend: backend})
+
+	tr.issue(t, 1, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ | uapi.UBLK_IO_F_META, NrSectors: 8})
+	tr.issue(t, 3, uapi.UblksrvIODesc{
+		OpFlags:   uapi.UBLK_IO_OP_WRITE | uapi.UBLK_IO_F_SWAP | uapi.UBLK_IO_F_FAILFAST_DEV,
+		NrSectors: 8,
+	})
+
+	if len(backend.reqs) != 2 {
+		t.Fatalf("got %d requests, want 2", len(backend.reqs))
+	}
+	read, write := backend.reqs[0], backend.reqs[1]
+	if read.Queue != 2 || read.Tag != 1 || !read.Flags.Meta() || read.Flags.Swap() {
+		t.Errorf("read request = %+v", read)
+	}
+	if write.Tag != 3 || !write.Flags.Swap() || !write.Flags.FailFast() || write.Flags.Meta() {
+		t.Errorf("write request = %+v", write)
+	}
+}
+
+func TestRunnerRequestBackendNoAllocs(t *testing.T) {
+	backend := &mockRequestBackend{mockBackend: newMockBackend(1 << 20)}
+	tr := newTestRunner(t, Config{Depth: 1, Backend: backend})
+	desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8}
+	backend.reqs = make([]interfaces.Request, 0, 1000)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := tr.doIO(0, desc); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("doIO allocates %.1f times per request", allocs)
+	}
+}
+
+// mockZeroesBackend records WriteZeroes calls
+type mockZeroesBackend struct {
+	*mockBackend
+	calls []interfaces.RequestFlags
+}
+
+func (m *mockZeroesBackend) WriteZeroes(offset, length int64, flags interfaces.RequestFlags) error {
+	m.calls = append(m.calls, flags)
+	clear(m.data[offset : offset+length])
+	return nil
+}
+
+func TestRunnerWriteZeroes(t *testing.T) {
+	backend := &mockZeroesBackend{mockBackend: newMockBackend(1 << 20)}
+	backend.data[4096] = 0xAA
+	var written [][2]int64
+	tr := newTestRunner(t, Config{
+		Depth:   1,
+		Backend: backend,
+		OnWrite: func(offset, length int64) { written = append(written, [2]int64{offset, length}) },
+	})
+
+	for _, opFlags := range []uint32{0, uapi.UBLK_IO_F_NOUNMAP} {
+		result := tr.issue(t, 0, uapi.UblksrvIODesc{
+			OpFlags:     uapi.UBLK_IO_OP_WRITE_ZEROES | opFlags,
+			StartSector: 8,
+			NrSectors:   8,
+		})
+		if result != 8<<9 {
+			t.Errorf("result = %d, want %d", result, 8<<9)
+		}
+	}
+	if len(backend.calls) != 2 || backend.calls[0].NoUnmap() || !backend.calls[1].NoUnmap() {
+		t.Errorf("WriteZeroes flags = %v, want plain then NOUNMAP", backend.calls)
+	}
+	if backend.data[4096] != 0 || len(written) != 2 {
+		t.Errorf("range not zeroed or not reported written: %v", written)
+	}
+
+	// Beyond the device, and on a backend without WriteZeroes
+	beyond := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE_ZEROES, StartSector: 1 << 20, NrSectors: 8}
+	if result := tr.issue(t, 0, beyond); result != -int32(syscall.ENOSPC) {
+		t.Errorf("out of range result = %d, want -ENOSPC", result)
+	}
+	plain := newTestRunner(t, Config{Depth: 1, Backend: newMockBackend(1 << 20)})
+	zeroes := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE_ZEROES, NrSectors: 8}
+	if result := plain.issue(t, 0, zeroes); result != -int32(syscall.EOPNOTSUPP) {
+		t.Errorf("unsupported result = %d, want -EOPNOTSUPP", result)
+	}
+}
+
+func FuzzUserData(f *testing.F) {
+	f.Add(false, uint16(0), uint16(0))
+	f.Add(true, uint16(0xffff), uint16(0xffff))
+
+	f.Fuzz(func(t *testing.T, commit bool, queueID, tag uint16) {
+		op := udOpFetch
+		if commit {
+			op = udOpCommit
+		}
+		userData := ioUserData(op, queueID, tag)
+		if userData == udWakeup || userData&udWakeup != 0 {
+			t.Fatalf("userData %#x collides with the wakeup poll", userData)
+		}
+		if got := queueFromUserData(userData); got != queueID {
+			t.Errorf("queueFromUserData(%#x) = %d, want %d", userData, got, queueID)
+		}
+		if got := tagFromUserData(userData); got != tag {
+			t.Errorf("tagFromUserData(%#x) = %d, want %d", userData, got, tag)
+		}
+		if got := userData&udOpCommit != 0; got != commit {
+			t.Errorf("userData %#x decodes as commit=%v, want %v", userData, got, commit)
+		}
+	})
+}
+
+func FuzzRunnerDescriptor(f *testing.F) {
+	f.Add(uint32(uapi.UBLK_IO_OP_READ), uint32(8), uint64(0), uint64(0))
+	f.Add(uint32(uapi.UBLK_IO_OP_WRITE|uapi.UBLK_IO_F_FUA), uint32(128), uint64(2040), uint64(0))
+	f.Add(uint32(uapi.UBLK_IO_OP_FLUSH), uint32(0), uint64(0), uint64(0))
+	f.Add(uint32(uapi.UBLK_IO_OP_DISCARD), uint32(1<<22), uint64(0), uint64(0))
+	f.Add(uint32(uapi.UBLK_IO_OP_REPORT_ZONES), uint32(4), ^uint64(0), uint64(0))
+	f.Add(uint32(0xff), ^uint32(0), ^uint64(0), ^uint64(0))
+
+	f.Fuzz(func(t *testing.T, opFlags, nrSectors uint32, startSector, addr uint64) {
+		tr := newTestRunner(t, Config{Depth: 1, Backend: &mockDiscardBackend{mockBackend: newMockBackend(1 << 20)}})
+		desc := uapi.UblksrvIODesc{OpFlags: opFlags, NrSectors: nrSectors, StartSector: startSector, Addr: addr}
+
+		tr.descs[0] = desc
+		if got := tr.loadDescriptor(0); got != desc {
+			t.Fatalf("loadDescriptor() = %+v, want %+v", got, desc)
+		}
+
+		// Whatever the descriptor says, the tag is committed and the loop
+		// carries on
+		res := tr.issue(t, 0, desc)
+		if tr.tagStates[0] != TagStateInFlightCommit {
+			t.Fatalf("tag state = %d after commit, want InFlightCommit", tr.tagStates[0])
+		}
+		if len(tr.ring.prepared) != 1 {
+			t.Fatalf("prepared %d commands, want 1", len(tr.ring.prepared))
+		}
+
+		switch desc.GetOp() {
+		case uapi.UBLK_IO_OP_READ, uapi.UBLK_IO_OP_WRITE:
+			if res >= 0 && res != int32(nrSectors)<<9 {
+				t.Errorf("result = %d for %d sectors", res, nrSectors)
+			}
+			if res > constants.IOBufferSizePerTag {
+				t.Errorf("result %d exceeds the tag buffer", res)
+			}
+		case uapi.UBLK_IO_OP_FLUSH:
+			if res < 0 {
+				t.Errorf("flush failed with %d", res)
+			}
+		}
+	})
+}
+
+func TestRunnerTrace(t *testing.T) {
+	type event struct {
+		desc  uapi.UblksrvIODesc
+		errno syscall.Errno
+	}
+	var events []event
+	backend := newMockBackend(1 << 20)
+	tr := newTestRunner(t, Config{
+		Depth:   1,
+		Backend: backend,
+		Trace: func(_, _ uint16, desc uapi.UblksrvIODesc, start time.Time, latency time.Duration, errno syscall.Errno) {
+			if start.IsZero() || latency < 0 {
+				t.Errorf("trace start %v latency %v", start, latency)
+			}
+			events = append(events, event{desc, errno})
+		},
+	})
+
+	write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: 8, NrSectors: 8}
+	tr.issue(t, 0, write)
+	backend.setReadError(errors.New("media error"))
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	tr.issue(t, 0, read)
+
+	want := []event{{write, 0}, {read, syscall.EIO}}
+	if !slices.Equal(events, want) {
+		t.Errorf("traced %+v, want %+v", events, want)
+	}
+}
@@ -0,0 +1,472 @@
+//go:build linux
+
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// simTag is the simulated driver's view of one tag.
+type simTag int
+
+const (
+	simTagIdle    simTag = iota // No FETCH seen yet
+	simTagWaiting               // FETCH or COMMIT_AND_FETCH pending; can take a request
+	simTagBusy                  // Request handed to the server, awaiting its commit
+	simTagAborted               // Completed with UBLK_IO_RES_ABORT
+)
+
+// SimStats counts what a Sim has seen from the runner.
+type SimStats struct {
+	Flushes  int // FlushSubmissions calls
+	Fetches  int // FETCH_REQ commands
+	Commits  int // COMMIT_AND_FETCH_REQ commands
+	MaxBatch int // Most commits submitted by one flush
+	Rejected int // Commands completed with -EINVAL for breaking the protocol
+}
+
+// SimRequest is a block request submitted to a Sim.
+type SimRequest struct {
+	desc   uapi.UblksrvIODesc
+	data   []byte
+	tag    uint16
+	result int32
+	done   chan struct{}
+}
+
+// Done is closed once the server has committed the request.
+func (q *SimRequest) Done() <-chan struct{} { return q.done }
+
+// Result is the committed result: bytes transferred or a negative errno.
+// It is valid once Done is closed.
+func (q *SimRequest) Result() int32 { return q.result }
+
+// Tag is the tag the request was served on. It is valid once Done is closed.
+func (q *SimRequest) Tag() uint16 { return q.tag }
+
+// simResult is a CQE posted by a Sim.
+type simResult struct {
+	userData uint64
+	value    int32
+}
+
+func (r simResult) UserData() uint64 { return r.userData }
+func (r simResult) Value() int32     { return r.value }
+func (r simResult) Error() error     { return nil }
+
+// simSQE is a prepared, not yet flushed, submission.
+type simSQE struct {
+	cmd      uint32
+	ioCmd    uapi.UblksrvIOCmd
+	userData uint64
+	pollFd   int32 // POLL_ADD target, -1 for I/O commands
+}
+
+// Sim stands in for ublk_drv and a queue's io_uring, so a Runner can run its
+// real I/O loop in process: FETCH and COMMIT_AND_FETCH go through the same
+// state machine, batching and deferral as against the kernel. Tests drive it
+// like the block layer would, by submitting requests and waiting for their
+// results, and inject the failures the kernel can produce.
+//
+// Like the kernel, a Sim only hands a request to a tag with a FETCH (or
+// COMMIT_AND_FETCH) outstanding, writes descriptors with release stores, and
+// completes commands that break the protocol with -EINVAL. All of its state
+// is under one mutex, and buffer copies happen with it held on both sides of
+// a completion, so runs are clean under the race detector.
+type Sim struct {
+	depth int
+	descs []uapi.UblksrvIODesc
+	bufs  []byte
+	kick  int // eventfd waking WaitForCompletion
+
+	mu       sync.Mutex
+	tags     []simTag
+	userData []uint64 // command each waiting or busy tag completes
+	busy     []*SimRequest
+	queued   []*SimRequest // waiting for a tag
+	sq       []simSQE
+	cq       []uring.Result
+	pollFd   int32 // armed POLL_ADD target, -1 if none
+	stats    SimStats
+	aborted  bool
+	closed   bool
+	fullFor  int   // Number of PrepareIOCmd calls still to fail with ErrRingFull
+	waitErr  error // Returned once by the next WaitForCompletion
+}
+
+// ErrSimClosed is returned by a Sim's ring methods after Close.
+var ErrSimClosed = errors.New("simulated ring closed")
+
+// NewSimRunner creates a runner whose character device and ring are a Sim.
+// Unlike a stub runner it runs the real I/O loop once started. Closing the
+// runner closes the Sim.
+func NewSimRunner(ctx context.Context, config Config) (*Runner, *Sim, error) {
+	kick, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create sim eventfd: %v", err)
+	}
+	s := &Sim{
+		depth:    config.Depth,
+		descs:    make([]uapi.UblksrvIODesc, config.Depth),
+		bufs:     make([]byte, config.Depth*constants.IOBufferSizePerTag),
+		kick:     kick,
+		tags:     make([]simTag, config.Depth),
+		userData: make([]uint64, config.Depth),
+		busy:     make([]*SimRequest, config.Depth),
+		pollFd:   -1,
+	}
+
+	r := NewStubRunner(ctx, config)
+	r.ring = s
+	r.descPtr = unsafe.Pointer(&s.descs[0])
+	r.bufPtr = unsafe.Pointer(&s.bufs[0])
+	return r, s, nil
+}
+
+// Submit queues a request for the server. For writes, data is copied into
+// the tag buffer when the request is dispatched; for reads, the data the
+// server returns is copied into it on commit. After Abort or Close, the
+// request fails at once with -EIO.
+func (s *Sim) Submit(desc uapi.UblksrvIODesc, data []byte) *SimRequest {
+	q := &SimRequest{desc: desc, data: data, done: make(chan struct{})}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.aborted || s.closed {
+		q.result = -int32(syscall.EIO)
+		close(q.done)
+		return q
+	}
+	s.queued = append(s.queued, q)
+	s.dispatchLocked()
+	return q
+}
+
+// Do submits a request and waits for its result.
+func (s *Sim) Do(ctx context.Context, desc uapi.UblksrvIODesc, data []byte) (int32, error) {
+	q := s.Submit(desc, data)
+	select {
+	case <-q.done:
+		return q.result, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Abort tears the queue down the way the driver does when the device is
+// deleted: waiting tags complete with UBLK_IO_RES_ABORT, requests not yet
+// dispatched fail with -EIO, and tags serving a request abort once it is
+// committed.
+func (s *Sim) Abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aborted = true
+	for tag, state := range s.tags {
+		if state == simTagWaiting {
+			s.abortTagLocked(uint16(tag))
+		}
+	}
+	s.failQueuedLocked()
+	s.kickLocked()
+}
+
+// Inject posts a raw completion, e.g. an unexpected result for a tag.
+func (s *Sim) Inject(userData uint64, value int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cq = append(s.cq, simResult{userData: userData, value: value})
+	s.kickLocked()
+}
+
+// FailPrepare makes the next n PrepareIOCmd calls fail with
+// uring.ErrRingFull, as a submission queue with no room would.
+func (s *Sim) FailPrepare(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fullFor = n
+}
+
+// FailWait makes the next WaitForCompletion return err.
+func (s *Sim) FailWait(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.waitErr = err
+	s.kickLocked()
+}
+
+// Stats returns what the Sim has seen so far.
+func (s *Sim) Stats() SimStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Close fails the requests still outstanding with -EIO and releases the
+// Sim. The runner's loop must have exited.
+func (s *Sim) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.failQueuedLocked()
+	for tag, q := range s.busy {
+		if q != nil {
+			s.finishLocked(uint16(tag), -int32(syscall.EIO))
+		}
+	}
+	return unix.Close(s.kick)
+}
+
+// SubmitCtrlCmd is not supported: a Sim only serves a queue.
+func (s *Sim) SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (uring.Result, error) {
+	return nil, errors.New("control commands not supported by Sim")
+}
+
+// SubmitCtrlCmdAsync is not supported: a Sim only serves a queue.
+func (s *Sim) SubmitCtrlCmdAsync(
+	cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64,
+) (*uring.AsyncHandle, error) {
+	return nil, errors.New("control commands not supported by Sim")
+}
+
+// SubmitIOCmd prepares and flushes one I/O command. Its completion, if any,
+// is delivered by WaitForCompletion.
+func (s *Sim) SubmitIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData uint64) (uring.Result, error) {
+	if err := s.PrepareIOCmd(cmd, ioCmd, userData); err != nil {
+		return nil, err
+	}
+	_, err := s.FlushSubmissions()
+	return nil, err
+}
+
+// PrepareIOCmd queues an I/O command for the next flush.
+func (s *Sim) PrepareIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSimClosed
+	}
+	if s.fullFor > 0 || len(s.sq) >= s.depth+1+constants.RingHeadroom {
+		s.fullFor = max(s.fullFor-1, 0)
+		return uring.ErrRingFull
+	}
+	s.sq = append(s.sq, simSQE{cmd: cmd, ioCmd: *ioCmd, userData: userData, pollFd: -1})
+	return nil
+}
+
+// PreparePollAdd queues a one-shot poll for POLLIN on fd.
+func (s *Sim) PreparePollAdd(fd int32, userData uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrSimClosed
+	}
+	s.sq = append(s.sq, simSQE{userData: userData, pollFd: fd})
+	return nil
+}
+
+// FlushSubmissions runs the prepared commands through the simulated driver
+// and dispatches queued requests to the tags that became free.
+func (s *Sim) FlushSubmissions() (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, ErrSimClosed
+	}
+	s.stats.Flushes++
+	commits := 0
+	for _, sqe := range s.sq {
+		if sqe.pollFd >= 0 {
+			s.pollFd = sqe.pollFd
+			continue
+		}
+		if sqe.cmd == uapi.UBLK_U_IO_COMMIT_AND_FETCH_REQ {
+			commits++
+		}
+		s.runCommandLocked(sqe)
+	}
+	n := uint32(len(s.sq))
+	s.sq = s.sq[:0]
+	s.stats.MaxBatch = max(s.stats.MaxBatch, commits)
+	s.dispatchLocked()
+	return n, nil
+}
+
+// WaitForCompletion blocks until there are completions to return, the armed
+// poll fires, or a failure injected with FailWait. The timeout is ignored;
+// the runner always blocks.
+func (s *Sim) WaitForCompletion(timeout int) ([]uring.Result, error) {
+	for {
+		s.mu.Lock()
+		if s.waitErr != nil {
+			err := s.waitErr
+			s.waitErr = nil
+			s.mu.Unlock()
+			return nil, err
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return nil, ErrSimClosed
+		}
+		if len(s.cq) > 0 {
+			cq := s.cq
+			s.cq = nil
+			s.mu.Unlock()
+			return cq, nil
+		}
+		fds := []unix.PollFd{{Fd: int32(s.kick), Events: unix.POLLIN}}
+		if s.pollFd >= 0 {
+			fds = append(fds, unix.PollFd{Fd: s.pollFd, Events: unix.POLLIN})
+		}
+		s.mu.Unlock()
+
+		if _, err := unix.Poll(fds, -1); err != nil && err != unix.EINTR {
+			return nil, fmt.Errorf("sim poll: %w", err)
+		}
+		var buf [8]byte
+		_, _ = unix.Read(int(fds[0].Fd), buf[:]) // EAGAIN if already drained
+		if len(fds) > 1 && fds[1].Revents&unix.POLLIN != 0 {
+			s.mu.Lock()
+			s.pollFd = -1
+			s.cq = append(s.cq, simResult{userData: udWakeup, value: unix.POLLIN})
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Enable does nothing: a Sim has no single-issuer restriction.
+func (s *Sim) Enable() error { return nil }
+
+// NewBatch is not supported: the runner does not use batches.
+func (s *Sim) NewBatch() uring.Batch { return nil }
+
+// runCommandLocked applies one I/O command to the tag it names.
+func (s *Sim) runCommandLocked(sqe simSQE) {
+	tag := sqe.ioCmd.Tag
+	if int(tag) >= s.depth {
+		s.rejectLocked(sqe.userData)
+		return
+	}
+
+	switch sqe.cmd {
+	case uapi.UBLK_U_IO_FETCH_REQ:
+		s.stats.Fetches++
+		if s.tags[tag] != simTagIdle {
+			s.rejectLocked(sqe.userData)
+			return
+		}
+	case uapi.UBLK_U_IO_COMMIT_AND_FETCH_REQ:
+		s.stats.Commits++
+		if s.tags[tag] != simTagBusy {
+			s.rejectLocked(sqe.userData)
+			return
+		}
+		s.finishLocked(tag, sqe.ioCmd.Result)
+	default:
+		s.stats.Rejected++
+		s.cq = append(s.cq, simResult{userData: sqe.userData, value: -int32(syscall.EOPNOTSUPP)})
+		return
+	}
+
+	s.userData[tag] = sqe.userData
+	s.tags[tag] = simTagWaiting
+	if s.aborted {
+		s.abortTagLocked(tag)
+	}
+}
+
+// finishLocked completes tag's request with result, copying read data back
+// to the submitter.
+func (s *Sim) finishLocked(tag uint16, result int32) {
+	q := s.busy[tag]
+	s.busy[tag] = nil
+	if q.desc.GetOp() == uapi.UBLK_IO_OP_READ && result > 0 {
+		copy(q.data[:min(int(result), len(q.data))], s.tagBuffer(tag))
+	}
+	q.tag = tag
+	q.result = result
+	close(q.done)
+}
+
+// dispatchLocked hands queued requests to waiting tags, lowest tag first.
+func (s *Sim) dispatchLocked() {
+	posted := false
+	for tag := 0; tag < s.depth && len(s.queued) > 0; tag++ {
+		if s.tags[tag] != simTagWaiting {
+			continue
+		}
+		q := s.queued[0]
+		s.queued = s.queued[1:]
+
+		if q.desc.GetOp() == uapi.UBLK_IO_OP_WRITE {
+			copy(s.tagBuffer(uint16(tag)), q.data)
+		}
+		s.storeDescriptor(uint16(tag), q.desc)
+		s.busy[tag] = q
+		s.tags[tag] = simTagBusy
+		s.cq = append(s.cq, simResult{userData: s.userData[tag], value: uapi.UBLK_IO_RES_OK})
+		posted = true
+	}
+	if posted {
+		s.kickLocked()
+	}
+}
+
+// rejectLocked completes a command that broke the protocol.
+func (s *Sim) rejectLocked(userData uint64) {
+	s.stats.Rejected++
+	s.cq = append(s.cq, simResult{userData: userData, value: -int32(syscall.EINVAL)})
+}
+
+func (s *Sim) abortTagLocked(tag uint16) {
+	s.tags[tag] = simTagAborted
+	s.cq = append(s.cq, simResult{userData: s.userData[tag], value: uapi.UBLK_IO_RES_ABORT})
+}
+
+func (s *Sim) failQueuedLocked() {
+	for _, q := range s.queued {
+		q.result = -int32(syscall.EIO)
+		close(q.done)
+	}
+	s.queued = nil
+}
+
+// kickLocked wakes a WaitForCompletion blocked in poll.
+func (s *Sim) kickLocked() {
+	if s.closed {
+		return
+	}
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	_, _ = unix.Write(s.kick, one[:]) // EAGAIN only if the counter saturates
+}
+
+func (s *Sim) tagBuffer(tag uint16) []byte {
+	off := int(tag) * constants.IOBufferSizePerTag
+	return s.bufs[off : off+constants.IOBufferSizePerTag]
+}
+
+// storeDescriptor publishes tag's descriptor with the atomic stores
+// loadDescriptor pairs with.
+func (s *Sim) storeDescriptor(tag uint16, desc uapi.UblksrvIODesc) {
+	base := unsafe.Pointer(&s.descs[tag])
+	atomic.StoreUint32((*uint32)(base), desc.OpFlags)
+	atomic.StoreUint32((*uint32)(unsafe.Add(base, descNrSectorsOffset)), desc.NrSectors)
+	atomic.StoreUint64((*uint64)(unsafe.Add(base, descStartSectorOffset)), desc.StartSector)
+	atomic.StoreUint64((*uint64)(unsafe.Add(base, descAddrOffset)), desc.Addr)
+}
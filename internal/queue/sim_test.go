@@ -0,0 +1,775 @@
+//go:build linux
+
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// startSim starts a runner on a Sim and closes it when the test ends
+func startSim(t *testing.T, config Config) (*Runner, *Sim) {
+	t.Helper()
+	r, sim, err := NewSimRunner(t.Context(), config)
+	if err != nil {
+		t.Fatalf("NewSimRunner: %v", err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, sim
+}
+
+// waitLoopExit fails the test unless r's loop exits soon
+func waitLoopExit(t *testing.T, r *Runner) {
+	t.Helper()
+	select {
+	case <-r.commands.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop did not exit")
+	}
+}
+
+func simDo(t *testing.T, sim *Sim, desc uapi.UblksrvIODesc, data []byte) int32 {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+	defer cancel()
+	res, err := sim.Do(ctx, desc, data)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	return res
+}
+
+func TestSimReadWrite(t *testing.T) {
+	backend := newMockBackend(1 << 20)
+	_, sim := startSim(t, Config{Depth: 4, Backend: backend})
+
+	data := bytes.Repeat([]byte("ublk"), 1024)
+	write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: 16, NrSectors: 8}
+	if res := simDo(t, sim, write, data); res != int32(len(data)) {
+		t.Fatalf("write result = %d, want %d", res, len(data))
+	}
+	if !bytes.Equal(backend.data[16<<9:16<<9+len(data)], data) {
+		t.Error("backend does not hold the written data")
+	}
+
+	got := make([]byte, len(data))
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: 16, NrSectors: 8}
+	if res := simDo(t, sim, read, got); res != int32(len(data)) {
+		t.Fatalf("read result = %d, want %d", res, len(data))
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read returned different data")
+	}
+}
+
+func TestSimBatchesCommits(t *testing.T) {
+	const depth = 8
+	r, sim, err := NewSimRunner(t.Context(), Config{Depth: depth, Backend: newMockBackend(1 << 20)})
+	if err != nil {
+		t.Fatalf("NewSimRunner: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	// Queued before the loop starts, every request is ready as soon as its
+	// tag is fetched, so the first wait returns them all
+	var reqs []*SimRequest
+	for i := range depth {
+		desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: uint64(i * 8), NrSectors: 8}
+		reqs = append(reqs, sim.Submit(desc, make([]byte, 4096)))
+	}
+	if err := r.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	for i, q := range reqs {
+		<-q.Done()
+		if q.Result() != 4096 {
+			t.Errorf("request %d result = %d, want 4096", i, q.Result())
+		}
+	}
+
+	if ds := r.DepthStats(); ds.Requests != depth || ds.Full != 1 || ds.Peak != depth || ds.InUse != depth*(depth+1)/2 {
+		t.Errorf("DepthStats = %+v, want every tag in use by the last of %d arrivals", ds, depth)
+	}
+
+	stats := sim.Stats()
+	if stats.MaxBatch != depth {
+		t.Errorf("MaxBatch = %d, want %d commits in one flush", stats.MaxBatch, depth)
+	}
+	if stats.Fetches != depth || stats.Commits != depth || stats.Rejected != 0 {
+		t.Errorf("stats = %+v, want %d fetches and commits, none rejected", stats, depth)
+	}
+}
+
+func TestSimWorkers(t *testing.T) {
+	backend := newMockBackend(1 << 20)
+	_, sim := startSim(t, Config{Depth: 8, Workers: 4, Backend: backend})
+
+	const requests = 32
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(i)}, 4096)
+			desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: uint64(i * 8), NrSectors: 8}
+			if res, err := sim.Do(t.Context(), desc, data); err != nil || res != 4096 {
+				t.Errorf("write %d: result %d, err %v", i, res, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range requests {
+		got := make([]byte, 4096)
+		desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: uint64(i * 8), NrSectors: 8}
+		simDo(t, sim, desc, got)
+		if !bytes.Equal(got, bytes.Repeat([]byte{byte(i)}, 4096)) {
+			t.Errorf("request %d read back wrong data", i)
+		}
+	}
+}
+
+func TestSimBackendError(t *testing.T) {
+	backend := newMockBackend(1 << 20)
+	backend.setReadError(errors.New("media error"))
+	_, sim := startSim(t, Config{Depth: 2, Backend: backend})
+
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	if res := simDo(t, sim, read, make([]byte, 4096)); res != -int32(syscall.EIO) {
+		t.Errorf("result = %d, want -EIO", res)
+	}
+	// The loop keeps serving after a failed request
+	write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8}
+	if res := simDo(t, sim, write, make([]byte, 4096)); res != 4096 {
+		t.Errorf("write result = %d, want 4096", res)
+	}
+}
+
+func TestSimIOTimeout(t *testing.T) {
+	backend := newMockBackend(1 << 20)
+	backend.readDelay = 200 * time.Millisecond
+	var gate sync.RWMutex
+	_, sim := startSim(t, Config{Depth: 1, Backend: backend, IOTimeout: 20 * time.Millisecond, Gate: &gate})
+
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: 8, NrSectors: 8}
+	if res := simDo(t, sim, read, make([]byte, 4096)); res != -int32(syscall.ETIMEDOUT) {
+		t.Fatalf("slow read result = %d, want -ETIMEDOUT", res)
+	}
+	// The read still running holds the gate
+	if gate.TryLock() {
+		t.Fatal("gate free while a timed out call is still running")
+	}
+	gate.Lock()
+	gate.Unlock()
+	backend.mu.Lock()
+	backend.readDelay = 0
+	backend.mu.Unlock()
+
+	// The tag serves on, through a copy of its buffer
+	data := bytes.Repeat([]byte{0xa5}, 4096)
+	write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: 8, NrSectors: 8}
+	if res := simDo(t, sim, write, data); res != 4096 {
+		t.Fatalf("write result = %d, want 4096", res)
+	}
+	got := make([]byte, 4096)
+	if res := simDo(t, sim, read, got); res != 4096 {
+		t.Fatalf("read result = %d, want 4096", res)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read back wrong data")
+	}
+}
+
+// cancelBackend blocks in its context-taking calls until their context
+// ends, signalling calls when one starts and sending why it ended on ended
+type cancelBackend struct {
+	*mockBackend
+	calls chan struct{}
+	ended chan error
+}
+
+func (b cancelBackend) Discard(offset, length int64) error { return nil }
+
+func (b cancelBackend) DiscardContext(ctx context.Context, offset, length int64) error {
+	b.calls <- struct{}{}
+	<-ctx.Done()
+	b.ended <- ctx.Err()
+	return ctx.Err()
+}
+
+func (b cancelBackend) FlushContext(ctx context.Context) error {
+	b.calls <- struct{}{}
+	<-ctx.Done()
+	b.ended <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestSimContextCalls(t *testing.T) {
+	backend := cancelBackend{newMockBackend(1 << 20), make(chan struct{}, 1), make(chan error, 1)}
+	_, sim := startSim(t, Config{Depth: 1, Backend: backend, IOTimeout: 20 * time.Millisecond})
+
+	discard := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_DISCARD, StartSector: 8, NrSectors: 8}
+	if res := simDo(t, sim, discard, nil); res != -int32(syscall.ETIMEDOUT) {
+		t.Fatalf("stuck discard result = %d, want -ETIMEDOUT", res)
+	}
+	<-backend.calls
+	select {
+	case err := <-backend.ended:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("discard context ended with %v, want the deadline", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("discard context did not end at the deadline")
+	}
+
+	// Without a timeout, stopping the queue ends the call
+	r, sim := startSim(t, Config{Depth: 1, Backend: backend})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(t.Context(), 5*time.Second)
+		defer cancel()
+		_, _ = sim.Do(ctx, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_FLUSH}, nil)
+	}()
+	<-backend.calls
+	r.Close()
+	select {
+	case err := <-backend.ended:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("flush context ended with %v, want cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flush context did not end when the queue stopped")
+	}
+	<-done
+}
+
+// stuckBackend holds every read until release is closed, signalling calls
+// when one starts
+type stuckBackend struct {
+	*mockBackend
+	calls   chan struct{}
+	release chan struct{}
+}
+
+func newStuckBackend() stuckBackend {
+	return stuckBackend{newMockBackend(1 << 20), make(chan struct{}, 16), make(chan struct{})}
+}
+
+func (b stuckBackend) ReadAt(p []byte, off int64) (int, error) {
+	b.calls <- struct{}{}
+	<-b.release
+	return b.mockBackend.ReadAt(p, off)
+}
+
+func TestSimInFlightBytes(t *testing.T) {
+	backend := newStuckBackend()
+	budget := NewByteBudget(8192)
+	_, sim := startSim(t, Config{Depth: 4, Backend: backend, Workers: 4, InFlightBytes: budget})
+
+	results := make(chan int32, 4)
+	for i := range 4 {
+		go func() {
+			read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: uint64(8 * i), NrSectors: 8}
+			res, _ := sim.Do(t.Context(), read, make([]byte, 4096))
+			results <- res
+		}()
+	}
+	<-backend.calls
+	<-backend.calls
+	select {
+	case <-backend.calls:
+		t.Fatal("third read reached the backend over the in-flight budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := budget.InFlight(); got != 8192 {
+		t.Errorf("InFlight = %d, want 8192", got)
+	}
+
+	close(backend.release)
+	for range 4 {
+		if res := <-results; res != 4096 {
+			t.Errorf("read result = %d, want 4096", res)
+		}
+	}
+	if got := budget.InFlight(); got != 0 {
+		t.Errorf("InFlight after the reads = %d, want 0", got)
+	}
+}
+
+// stuckWriter is a backend whose writes wait for release and whose
+// flushes are reported on flushes.
+type stuckWriter struct {
+	*mockBackend
+	writes  chan struct{}
+	release chan struct{}
+	flushes chan struct{}
+}
+
+func (b stuckWriter) WriteAt(p []byte, off int64) (int, error) {
+	b.writes <- struct{}{}
+	<-b.release
+	return b.mockBackend.WriteAt(p, off)
+}
+
+func (b stuckWriter) Flush() error {
+	b.flushes <- struct{}{}
+	return nil
+}
+
+func TestSimFlushBarrier(t *testing.T) {
+	backend := stuckWriter{newMockBackend(1 << 20), make(chan struct{}, 1), make(chan struct{}), make(chan struct{}, 1)}
+	barrier := NewWriteBarrier()
+	_, q0 := startSim(t, Config{QueueID: 0, Depth: 4, Backend: backend, FlushBarrier: barrier})
+	_, q1 := startSim(t, Config{QueueID: 1, Depth: 4, Backend: backend, FlushBarrier: barrier})
+	release := sync.OnceFunc(func() { close(backend.release) })
+	t.Cleanup(release) // Before the runners close, should the test fail
+
+	wrote := make(chan int32, 1)
+	go func() {
+		write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8}
+		res, _ := q0.Do(t.Context(), write, make([]byte, 4096))
+		wrote <- res
+	}()
+	<-backend.writes
+
+	flushed := make(chan int32, 1)
+	go func() {
+		res, _ := q1.Do(t.Context(), uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_FLUSH}, nil)
+		flushed <- res
+	}()
+	select {
+	case <-backend.flushes:
+		t.Fatal("FLUSH on queue 1 reached the backend with a write in flight on queue 0")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	if res := <-wrote; res != 4096 {
+		t.Errorf("write result = %d, want 4096", res)
+	}
+	<-backend.flushes
+	if res := <-flushed; res != 0 {
+		t.Errorf("flush result = %d, want 0", res)
+	}
+}
+
+// depthObserver passes on queue depth samples
+type depthObserver struct {
+	nopObserver
+	depths chan uint32
+}
+
+func (o depthObserver) ObserveQueueDepth(depth uint32) {
+	select {
+	case o.depths <- depth:
+	default:
+	}
+}
+
+func TestSimSampleDepth(t *testing.T) {
+	backend := newStuckBackend()
+	r, sim, err := NewSimRunner(t.Context(), Config{Depth: 4, Backend: backend, Workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := depthObserver{depths: make(chan uint32, 1)}
+	r.observer = obs
+	r.depthInterval = time.Millisecond
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// awaitDepth waits for a sample of want tags in use
+	awaitDepth := func(want uint32) {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			select {
+			case got := <-obs.depths:
+				if got == want {
+					return
+				}
+			case <-deadline:
+				t.Fatalf("no sample of %d tags in use", want)
+			}
+		}
+	}
+
+	awaitDepth(0)
+	var reqs []*SimRequest
+	for range 2 {
+		reqs = append(reqs, sim.Submit(uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}, make([]byte, 4096)))
+		<-backend.calls
+	}
+	awaitDepth(2)
+
+	close(backend.release)
+	for _, q := range reqs {
+		<-q.Done()
+	}
+	awaitDepth(0)
+}
+
+// phaseObserver passes on request phases
+type phaseObserver struct {
+	nopObserver
+	phases chan [3]uint64
+}
+
+func (o phaseObserver) ObservePhases(dispatchNs, backendNs, refetchNs uint64) {
+	o.phases <- [3]uint64{dispatchNs, backendNs, refetchNs}
+}
+
+func TestSimPhaseObserver(t *testing.T) {
+	backend := newStuckBackend()
+	r, sim, err := NewSimRunner(t.Context(), Config{Depth: 1, Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obs := phaseObserver{phases: make(chan [3]uint64, 2)}
+	r.observer = obs
+	r.setQueueObserver(Config{Observer: obs})
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	const held = 10 * time.Millisecond
+	desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	q := sim.Submit(desc, make([]byte, 4096))
+	<-backend.calls
+	time.Sleep(held)
+	close(backend.release)
+	<-q.Done()
+	first := <-obs.phases
+	if first[1] < uint64(held) {
+		t.Errorf("backend time %v, want at least %v", time.Duration(first[1]), held)
+	}
+	if first[2] != 0 {
+		t.Errorf("refetch time %v for the tag's first request, want 0", time.Duration(first[2]))
+	}
+
+	// The one tag is fetched again after the commit
+	time.Sleep(held)
+	<-sim.Submit(desc, make([]byte, 4096)).Done()
+	second := <-obs.phases
+	if second[2] < uint64(held) {
+		t.Errorf("refetch time %v, want at least %v", time.Duration(second[2]), held)
+	}
+	if second[1] >= uint64(held) {
+		t.Errorf("backend time %v for a request the backend did not hold", time.Duration(second[1]))
+	}
+}
+
+func TestSimStopAbortsStuckWorkers(t *testing.T) {
+	backend := newStuckBackend()
+	r, sim, err := NewSimRunner(t.Context(), Config{Depth: 2, Backend: backend, Workers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer close(backend.release)
+
+	q := sim.Submit(uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}, make([]byte, 4096))
+	<-backend.calls
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.CloseContext(ctx); err != nil {
+		t.Fatalf("CloseContext = %v, want the stuck request aborted", err)
+	}
+	select {
+	case <-q.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stuck request was never committed")
+	}
+	if q.Result() != -int32(syscall.EIO) {
+		t.Errorf("stuck request result = %d, want -EIO", q.Result())
+	}
+}
+
+func TestSimStopTimesOutOnStuckLoop(t *testing.T) {
+	backend := newStuckBackend()
+	r, sim, err := NewSimRunner(t.Context(), Config{Depth: 2, Backend: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := sim.Submit(uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}, make([]byte, 4096))
+	<-backend.calls
+
+	// The backend call is on the loop's own thread, so nothing can fail it
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.CloseContext(ctx); !errors.Is(err, ErrStopTimeout) {
+		t.Fatalf("CloseContext = %v, want ErrStopTimeout", err)
+	}
+
+	// Once the call returns the loop exits and the runner is released
+	close(backend.release)
+	waitLoopExit(t, r)
+	<-q.Done()
+}
+
+func TestSimRingFullDefersCommits(t *testing.T) {
+	_, sim := startSim(t, Config{Depth: 4, Backend: newMockBackend(1 << 20)})
+
+	sim.FailPrepare(3)
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	for i := range 4 {
+		if res := simDo(t, sim, read, make([]byte, 4096)); res != 4096 {
+			t.Errorf("request %d result = %d, want 4096", i, res)
+		}
+	}
+}
+
+func TestSimAbortEndsLoop(t *testing.T) {
+	r, sim := startSim(t, Config{Depth: 4, Backend: newMockBackend(1 << 20)})
+
+	sim.Abort()
+	waitLoopExit(t, r)
+	if err := r.Wait(); !errors.Is(err, ErrAborted) {
+		t.Errorf("Wait = %v, want ErrAborted", err)
+	}
+
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}
+	if res := simDo(t, sim, read, make([]byte, 4096)); res != -int32(syscall.EIO) {
+		t.Errorf("request after abort: result = %d, want -EIO", res)
+	}
+}
+
+func TestSimErrorsEndLoop(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject func(*Sim)
+	}{
+		{"need get data", func(s *Sim) { s.Inject(udOpFetch|1, uapi.UBLK_IO_RES_NEED_GET_DATA) }},
+		{"unexpected fetch result", func(s *Sim) { s.Inject(udOpFetch|2, 7) }},
+		{"wait failure", func(s *Sim) { s.FailWait(syscall.EBADF) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, sim := startSim(t, Config{Depth: 4, Backend: newMockBackend(1 << 20)})
+			tt.inject(sim)
+			waitLoopExit(t, r)
+			if err := r.Wait(); err == nil || errors.Is(err, ErrAborted) {
+				t.Errorf("Wait = %v, want the error that ended the loop", err)
+			}
+		})
+	}
+}
+
+func TestSimCommandsWakeLoop(t *testing.T) {
+	r, _ := startSim(t, Config{Depth: 4, Backend: newMockBackend(1 << 20)})
+
+	states, err := r.TagStates(t.Context())
+	if err != nil {
+		t.Fatalf("TagStates: %v", err)
+	}
+	for tag, s := range states {
+		if s != TagStateInFlightFetch {
+			t.Errorf("tag %d state = %d, want InFlightFetch", tag, s)
+		}
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	waitLoopExit(t, r)
+	if err := r.Wait(); err != nil {
+		t.Errorf("Wait after Stop = %v, want nil", err)
+	}
+}
+
+func TestSimRawHandler(t *testing.T) {
+	const customOp = 0x22
+	var (
+		mu      sync.Mutex
+		ops     []uint8
+		written [][2]int64
+	)
+	handler := func(req *interfaces.RawRequest) error {
+		mu.Lock()
+		ops = append(ops, req.Op)
+		mu.Unlock()
+		switch req.Op {
+		case uapi.UBLK_IO_OP_READ:
+			for i := range req.Data {
+				req.Data[i] = byte(req.Sector)
+			}
+		case uapi.UBLK_IO_OP_WRITE:
+			if req.Length != int64(len(req.Data)) || req.Offset != int64(req.Sector)*512 {
+				return fmt.Errorf("write of %d bytes at %d with %d bytes of data", req.Length, req.Offset, len(req.Data))
+			}
+		case customOp:
+			return nil
+		default:
+			return syscall.EOPNOTSUPP
+		}
+		return nil
+	}
+	_, sim := startSim(t, Config{
+		Depth:      2,
+		Backend:    newMockBackend(1 << 20),
+		RawHandler: handler,
+		OnWrite: func(offset, length int64) {
+			mu.Lock()
+			written = append(written, [2]int64{offset, length})
+			mu.Unlock()
+		},
+	})
+
+	got := make([]byte, 4096)
+	read := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, StartSector: 7, NrSectors: 8}
+	if res := simDo(t, sim, read, got); res != 4096 || got[4095] != 7 {
+		t.Errorf("raw read result %d, data %d; want 4096 and the handler's data", res, got[4095])
+	}
+	write := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: 8, NrSectors: 8}
+	if res := simDo(t, sim, write, make([]byte, 4096)); res != 4096 {
+		t.Errorf("raw write result = %d, want 4096", res)
+	}
+	if res := simDo(t, sim, uapi.UblksrvIODesc{OpFlags: customOp, NrSectors: 1}, nil); res != 512 {
+		t.Errorf("custom op result = %d, want 512", res)
+	}
+	discard := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_DISCARD, NrSectors: 8}
+	if res := simDo(t, sim, discard, nil); res != -int32(syscall.EOPNOTSUPP) {
+		t.Errorf("declined discard result = %d, want -EOPNOTSUPP", res)
+	}
+	// Validation still applies
+	beyond := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: 1 << 40, NrSectors: 8}
+	if res := simDo(t, sim, beyond, make([]byte, 4096)); res != -int32(syscall.ENOSPC) {
+		t.Errorf("write beyond the device result = %d, want -ENOSPC", res)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []uint8{uapi.UBLK_IO_OP_READ, uapi.UBLK_IO_OP_WRITE, customOp, uapi.UBLK_IO_OP_DISCARD}
+	if !slices.Equal(ops, want) {
+		t.Errorf("handler saw ops %v, want %v", ops, want)
+	}
+	if len(written) != 1 || written[0] != [2]int64{8 * 512, 4096} {
+		t.Errorf("OnWrite saw %v, want the write only", written)
+	}
+}
+
+func TestSimUnknownOp(t *testing.T) {
+	const newOp = 0x30 // An op from a kernel newer than the runner
+	var (
+		mu   sync.Mutex
+		seen []uint8
+	)
+	noteOp := func(queueID uint16, op uint8) {
+		mu.Lock()
+		seen = append(seen, op)
+		mu.Unlock()
+	}
+	desc := uapi.UblksrvIODesc{OpFlags: newOp, StartSector: 8, NrSectors: 2}
+
+	_, sim := startSim(t, Config{Depth: 2, Backend: newMockBackend(1 << 20), OnUnknownOp: noteOp})
+	if res := simDo(t, sim, desc, nil); res != -int32(syscall.EOPNOTSUPP) {
+		t.Errorf("unknown op result = %d, want -EOPNOTSUPP", res)
+	}
+
+	var got *interfaces.RawRequest
+	_, sim = startSim(t, Config{
+		Depth:       2,
+		Backend:     newMockBackend(1 << 20),
+		OnUnknownOp: noteOp,
+		UnknownOp: func(req *interfaces.RawRequest) error {
+			got = req
+			return nil
+		},
+	})
+	if res := simDo(t, sim, desc, nil); res != 1024 {
+		t.Errorf("handled unknown op result = %d, want 1024", res)
+	}
+	if got == nil || got.Op != newOp || got.Offset != 8*512 || got.Length != 1024 || got.Data != nil {
+		t.Errorf("UnknownOp got %+v, want op %#x at 4096 for 1024 bytes without data", got, newOp)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(seen, []uint8{newOp, newOp}) {
+		t.Errorf("OnUnknownOp saw %v, want the op twice", seen)
+	}
+}
+
+func TestSimUnknownFlags(t *testing.T) {
+	const newFlag = 1 << 20 // A flag from a kernel newer than the runner
+	var (
+		mu   sync.Mutex
+		seen []uint32
+	)
+	_, sim := startSim(t, Config{
+		Depth:   2,
+		Backend: newMockBackend(1 << 20),
+		OnUnknownFlags: func(queueID uint16, flags uint32) {
+			mu.Lock()
+			seen = append(seen, flags)
+			mu.Unlock()
+		},
+	})
+
+	// Served as if the flag were clear; known flags are not reported
+	desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE | uapi.UBLK_IO_F_FUA | newFlag, NrSectors: 8}
+	if res := simDo(t, sim, desc, make([]byte, 4096)); res != 4096 {
+		t.Errorf("write with an unknown flag = %d, want 4096", res)
+	}
+	desc.OpFlags = uapi.UBLK_IO_OP_READ | uapi.UBLK_IO_F_FAILFAST_DEV
+	if res := simDo(t, sim, desc, make([]byte, 4096)); res != 4096 {
+		t.Errorf("read with known flags = %d, want 4096", res)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(seen, []uint32{newFlag}) {
+		t.Errorf("OnUnknownFlags saw %#x, want %#x once", seen, newFlag)
+	}
+}
+
+func TestRunnerLayout(t *testing.T) {
+	r, sim := startSim(t, Config{QueueID: 2, Depth: 4, Backend: newMockBackend(1 << 20)})
+
+	layout := r.Layout()
+	if layout.QueueID != 2 || layout.Depth != 4 || layout.SharedRing {
+		t.Errorf("layout = %+v, want queue 2 of depth 4 on its own ring", layout)
+	}
+	descs, bufs := uintptr(unsafe.Pointer(&sim.descs[0])), uintptr(unsafe.Pointer(&sim.bufs[0]))
+	if layout.DescAddr != descs || layout.BufAddr != bufs {
+		t.Errorf("layout addresses = %#x/%#x, want the Sim's %#x/%#x", layout.DescAddr, layout.BufAddr, descs, bufs)
+	}
+	if layout.BufStride != constants.IOBufferSizePerTag {
+		t.Errorf("BufStride = %d, want %d", layout.BufStride, constants.IOBufferSizePerTag)
+	}
+	pageSize := os.Getpagesize()
+	if layout.DescSize != pageSize || layout.DescOffset != int64(2*pageSize) {
+		t.Errorf("descriptor mapping = %d bytes at %d, want one page at %d", layout.DescSize, layout.DescOffset, 2*pageSize)
+	}
+	if layout.Ring != (uring.Params{}) {
+		t.Errorf("Ring = %+v, want zero for a ring without parameters", layout.Ring)
+	}
+}
@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The system calls the queues make, kept here so the package builds where
+// they do not exist (see sys_other.go).
+
+func closeFd(fd int) {
+	_ = syscall.Close(fd) // Cleanup, ignore error
+}
+
+func dupFd(fd int) (int, error) {
+	return syscall.Dup(fd)
+}
+
+// mmapAnon allocates size bytes of anonymous memory outside the Go heap.
+func mmapAnon(size int) ([]byte, error) {
+	return syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+}
+
+func munmapAnon(buf []byte) {
+	_ = syscall.Munmap(buf) // Cleanup, ignore error
+}
+
+// mmapDescs maps size bytes of a queue's descriptor array from the char
+// device fd at offset, read-only and populated to avoid page faults.
+func mmapDescs(fd int, size int, offset uintptr) (uintptr, syscall.Errno) {
+	ptr, _, errno := syscall.Syscall6(
+		syscall.SYS_MMAP,
+		0,                 // addr
+		uintptr(size),     // length (page-rounded)
+		syscall.PROT_READ, // prot - READ ONLY from userspace!
+		syscall.MAP_SHARED|syscall.MAP_POPULATE, // flags - populate to avoid page faults
+		uintptr(fd), // fd
+		offset,      // per-queue offset
+	)
+	return ptr, errno
+}
+
+func munmapDescs(ptr unsafe.Pointer, size int) {
+	_, _, _ = syscall.Syscall(syscall.SYS_MUNMAP, uintptr(ptr), uintptr(size), 0)
+}
+
+// newEventfd creates a non-blocking eventfd for waking a queue loop.
+func newEventfd() (int, error) {
+	return unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+}
+
+// signalEventfd adds one to the eventfd's counter.
+func signalEventfd(fd int) {
+	var one [8]byte
+	binary.NativeEndian.PutUint64(one[:], 1)
+	_, _ = unix.Write(fd, one[:]) // EAGAIN only if the counter saturates
+}
+
+// drainEventfd resets the eventfd's counter.
+func drainEventfd(fd int) {
+	var buf [8]byte
+	_, _ = unix.Read(fd, buf[:]) // EAGAIN if already drained
+}
+
+// setAffinity pins the calling thread to cpu.
+func setAffinity(cpu int) error {
+	var mask unix.CPUSet
+	mask.Set(cpu)
+	return unix.SchedSetaffinity(0, &mask)
+}
+
+func gettid() int {
+	return unix.Gettid()
+}
+
+// Per-thread CPU clock IDs, as built by MAKE_THREAD_CPUCLOCK in the kernel.
+// CPUCLOCK_PROF counts user and system time, CPUCLOCK_VIRT user time only.
+const (
+	cpuClockProf      = 0
+	cpuClockVirt      = 1
+	cpuClockPerThread = 4
+)
+
+func threadClock(tid int, clock int32) int32 {
+	return int32(^uint32(tid)<<3) | clock | cpuClockPerThread
+}
+
+// threadTimes reads a thread's user and system time. A failed read, which
+// only happens if the thread is gone, reports zero.
+func threadTimes(tid int) (user, system time.Duration) {
+	var virt, prof unix.Timespec
+	if unix.ClockGettime(threadClock(tid, cpuClockVirt), &virt) != nil ||
+		unix.ClockGettime(threadClock(tid, cpuClockProf), &prof) != nil {
+		return 0, 0
+	}
+	user = time.Duration(virt.Nano())
+	return user, max(time.Duration(prof.Nano())-user, 0)
+}
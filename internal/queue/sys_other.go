@@ -0,0 +1,53 @@
+//go:build !linux
+
+package queue
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Off Linux there is no ublk char device to serve, so nothing here is
+// reached once device creation has failed; the allocations fail with
+// ENOSYS and the rest do nothing.
+
+func closeFd(fd int) {}
+
+func dupFd(fd int) (int, error) {
+	return -1, syscall.ENOSYS
+}
+
+func mmapAnon(size int) ([]byte, error) {
+	return nil, syscall.ENOSYS
+}
+
+func munmapAnon(buf []byte) {}
+
+func mmapDescs(fd int, size int, offset uintptr) (uintptr, syscall.Errno) {
+	return 0, syscall.ENOSYS
+}
+
+func munmapDescs(ptr unsafe.Pointer, size int) {}
+
+func newEventfd() (int, error) {
+	return -1, syscall.ENOSYS
+}
+
+func signalEventfd(fd int) {}
+
+func drainEventfd(fd int) {}
+
+func setAffinity(cpu int) error {
+	return syscall.ENOSYS
+}
+
+// gettid returns 0, which threadCPU takes for no thread: queue CPU time
+// reads as zero.
+func gettid() int {
+	return 0
+}
+
+func threadTimes(tid int) (user, system time.Duration) {
+	return 0, 0
+}
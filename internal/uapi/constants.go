@@ -1,6 +1,8 @@
 // Package uapi provides Linux kernel UAPI definitions for ublk
 package uapi
 
+import "strconv"
+
 // Control Commands (Legacy - don't use in new applications)
 const (
 	UBLK_CMD_GET_QUEUE_AFFINITY  = 0x01
@@ -14,6 +16,7 @@ const (
 	UBLK_CMD_START_USER_RECOVERY = 0x10
 	UBLK_CMD_END_USER_RECOVERY   = 0x11
 	UBLK_CMD_GET_DEV_INFO2       = 0x12
+	UBLK_CMD_UPDATE_SIZE         = 0x15
 )
 
 // I/O Commands (Legacy)
@@ -32,17 +35,57 @@ const (
 
 // Feature Flags (64-bit)
 const (
-	UBLK_F_SUPPORT_ZERO_COPY      = 1 << 0 // Zero copy with 4k blocks
-	UBLK_F_URING_CMD_COMP_IN_TASK = 1 << 1 // Force task_work completion
-	UBLK_F_NEED_GET_DATA          = 1 << 2 // Two-phase write support
-	UBLK_F_USER_RECOVERY          = 1 << 3 // User recovery support
-	UBLK_F_USER_RECOVERY_REISSUE  = 1 << 4 // Reissue on recovery
-	UBLK_F_UNPRIVILEGED_DEV       = 1 << 5 // Unprivileged device creation
-	UBLK_F_CMD_IOCTL_ENCODE       = 1 << 6 // Use ioctl encoding
-	UBLK_F_USER_COPY              = 1 << 7 // pread/pwrite for data
-	UBLK_F_ZONED                  = 1 << 8 // Zoned storage support
+	UBLK_F_SUPPORT_ZERO_COPY      = 1 << 0  // Zero copy with 4k blocks
+	UBLK_F_URING_CMD_COMP_IN_TASK = 1 << 1  // Force task_work completion
+	UBLK_F_NEED_GET_DATA          = 1 << 2  // Two-phase write support
+	UBLK_F_USER_RECOVERY          = 1 << 3  // User recovery support
+	UBLK_F_USER_RECOVERY_REISSUE  = 1 << 4  // Reissue on recovery
+	UBLK_F_UNPRIVILEGED_DEV       = 1 << 5  // Unprivileged device creation
+	UBLK_F_CMD_IOCTL_ENCODE       = 1 << 6  // Use ioctl encoding
+	UBLK_F_USER_COPY              = 1 << 7  // pread/pwrite for data
+	UBLK_F_ZONED                  = 1 << 8  // Zoned storage support
+	UBLK_F_UPDATE_SIZE            = 1 << 10 // UPDATE_SIZE allowed while live
+	UBLK_F_NO_AUTO_PART_SCAN      = 1 << 18 // No partition scan at START_DEV
 )
 
+// featureNames names the feature flags, lowest bit first
+var featureNames = []struct {
+	flag uint64
+	name string
+}{
+	{UBLK_F_SUPPORT_ZERO_COPY, "SUPPORT_ZERO_COPY"},
+	{UBLK_F_URING_CMD_COMP_IN_TASK, "URING_CMD_COMP_IN_TASK"},
+	{UBLK_F_NEED_GET_DATA, "NEED_GET_DATA"},
+	{UBLK_F_USER_RECOVERY, "USER_RECOVERY"},
+	{UBLK_F_USER_RECOVERY_REISSUE, "USER_RECOVERY_REISSUE"},
+	{UBLK_F_UNPRIVILEGED_DEV, "UNPRIVILEGED_DEV"},
+	{UBLK_F_CMD_IOCTL_ENCODE, "CMD_IOCTL_ENCODE"},
+	{UBLK_F_USER_COPY, "USER_COPY"},
+	{UBLK_F_ZONED, "ZONED"},
+	{UBLK_F_UPDATE_SIZE, "UPDATE_SIZE"},
+	{UBLK_F_NO_AUTO_PART_SCAN, "NO_AUTO_PART_SCAN"},
+}
+
+// FeatureNames returns the names of the feature flags set in flags without
+// their UBLK_F_ prefix, in bit order, followed by any bits without a
+// constant here, named by number (e.g. "BIT_12").
+func FeatureNames(flags uint64) []string {
+	var names []string
+	for _, f := range featureNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+			flags &^= f.flag
+		}
+	}
+	for bit := 0; flags != 0; bit++ {
+		if flags&(1<<bit) != 0 {
+			names = append(names, "BIT_"+strconv.Itoa(bit))
+			flags &^= 1 << bit
+		}
+	}
+	return names
+}
+
 // Device States
 const (
 	UBLK_S_DEV_DEAD     = 0
@@ -78,6 +121,25 @@ const (
 	UBLK_IO_F_SWAP               = 1 << 16
 )
 
+// Zone types reported in struct blk_zone (include/uapi/linux/blkzoned.h)
+const (
+	BLK_ZONE_TYPE_CONVENTIONAL  = 0x1
+	BLK_ZONE_TYPE_SEQWRITE_REQ  = 0x2
+	BLK_ZONE_TYPE_SEQWRITE_PREF = 0x3
+)
+
+// Zone conditions reported in struct blk_zone
+const (
+	BLK_ZONE_COND_NOT_WP   = 0x0
+	BLK_ZONE_COND_EMPTY    = 0x1
+	BLK_ZONE_COND_IMP_OPEN = 0x2
+	BLK_ZONE_COND_EXP_OPEN = 0x3
+	BLK_ZONE_COND_CLOSED   = 0x4
+	BLK_ZONE_COND_READONLY = 0xD
+	BLK_ZONE_COND_FULL     = 0xE
+	BLK_ZONE_COND_OFFLINE  = 0xF
+)
+
 // Limits and Constants
 const (
 	UBLK_MAX_QUEUE_DEPTH = 4096 // Max IOs per queue
@@ -118,12 +180,18 @@ const (
 
 // Parameter Type Flags
 const (
-	UBLK_PARAM_TYPE_BASIC   = 1 << 0
-	UBLK_PARAM_TYPE_DISCARD = 1 << 1
-	UBLK_PARAM_TYPE_DEVT    = 1 << 2
-	UBLK_PARAM_TYPE_ZONED   = 1 << 3
+	UBLK_PARAM_TYPE_BASIC     = 1 << 0
+	UBLK_PARAM_TYPE_DISCARD   = 1 << 1
+	UBLK_PARAM_TYPE_DEVT      = 1 << 2
+	UBLK_PARAM_TYPE_ZONED     = 1 << 3
+	UBLK_PARAM_TYPE_DMA_ALIGN = 1 << 4
+	UBLK_PARAM_TYPE_SEGMENT   = 1 << 5
 )
 
+// UBLK_MIN_SEGMENT_SIZE is the smallest max_segment_size and
+// seg_boundary_mask+1 the driver accepts
+const UBLK_MIN_SEGMENT_SIZE = 4096
+
 // ioctl encoding constants
 const (
 	_IOC_WRITE     = 1
@@ -146,13 +214,49 @@ func IoctlEncode(dir, typ, nr, size uint32) uint32 {
 		(nr << _IOC_NRSHIFT)
 }
 
-// Helper function to create ublk ioctl commands
+// UblkCtrlCmd returns the ioctl-encoded form of a legacy control opcode,
+// _IOWR('u', cmd, struct ublksrv_ctrl_cmd).
 func UblkCtrlCmd(cmd uint32) uint32 {
-	// Use 32-byte control header size to match UblksrvCtrlCmd (32 bytes)
-	// This aligns with working references and our SQE layout.
-	return IoctlEncode(_IOC_READ|_IOC_WRITE, 'u', cmd, 32)
+	return IoctlEncode(_IOC_READ|_IOC_WRITE, 'u', cmd, UblksrvCtrlCmdSize)
 }
 
+// UblkIOCmd returns the ioctl-encoded form of a legacy I/O opcode,
+// _IOWR('u', cmd, struct ublksrv_io_cmd).
 func UblkIOCmd(cmd uint32) uint32 {
-	return IoctlEncode(_IOC_READ|_IOC_WRITE, 'u', cmd, 16) // sizeof(UblksrvIOCmd)
+	return IoctlEncode(_IOC_READ|_IOC_WRITE, 'u', cmd, UblksrvIOCmdSize)
 }
+
+// Base values for _IOWR('u', nr, ...) with the ublk command structs, and
+// for the one _IOR control command.
+const (
+	ublkCtrlIOWR = (_IOC_READ|_IOC_WRITE)<<_IOC_DIRSHIFT | UblksrvCtrlCmdSize<<_IOC_SIZESHIFT | 'u'<<_IOC_TYPESHIFT
+	ublkCtrlIOR  = _IOC_READ<<_IOC_DIRSHIFT | UblksrvCtrlCmdSize<<_IOC_SIZESHIFT | 'u'<<_IOC_TYPESHIFT
+	ublkIOIOWR   = (_IOC_READ|_IOC_WRITE)<<_IOC_DIRSHIFT | UblksrvIOCmdSize<<_IOC_SIZESHIFT | 'u'<<_IOC_TYPESHIFT
+)
+
+// Ioctl-encoded control commands (UBLK_U_CMD_*), as defined in ublk_cmd.h
+const (
+	UBLK_U_CMD_GET_QUEUE_AFFINITY  uint32 = ublkCtrlIOWR | UBLK_CMD_GET_QUEUE_AFFINITY
+	UBLK_U_CMD_GET_DEV_INFO        uint32 = ublkCtrlIOWR | UBLK_CMD_GET_DEV_INFO
+	UBLK_U_CMD_ADD_DEV             uint32 = ublkCtrlIOWR | UBLK_CMD_ADD_DEV
+	UBLK_U_CMD_DEL_DEV             uint32 = ublkCtrlIOWR | UBLK_CMD_DEL_DEV
+	UBLK_U_CMD_START_DEV           uint32 = ublkCtrlIOWR | UBLK_CMD_START_DEV
+	UBLK_U_CMD_STOP_DEV            uint32 = ublkCtrlIOWR | UBLK_CMD_STOP_DEV
+	UBLK_U_CMD_SET_PARAMS          uint32 = ublkCtrlIOWR | UBLK_CMD_SET_PARAMS
+	UBLK_U_CMD_GET_PARAMS          uint32 = ublkCtrlIOWR | UBLK_CMD_GET_PARAMS
+	UBLK_U_CMD_START_USER_RECOVERY uint32 = ublkCtrlIOWR | UBLK_CMD_START_USER_RECOVERY
+	UBLK_U_CMD_END_USER_RECOVERY   uint32 = ublkCtrlIOWR | UBLK_CMD_END_USER_RECOVERY
+	UBLK_U_CMD_GET_DEV_INFO2       uint32 = ublkCtrlIOWR | UBLK_CMD_GET_DEV_INFO2
+	UBLK_U_CMD_UPDATE_SIZE         uint32 = ublkCtrlIOWR | UBLK_CMD_UPDATE_SIZE
+
+	// UBLK_U_CMD_DEL_DEV_ASYNC removes a device without waiting for its
+	// char device to be released (Linux 6.9+). It has no legacy opcode.
+	UBLK_U_CMD_DEL_DEV_ASYNC uint32 = ublkCtrlIOR | 0x14
+)
+
+// Ioctl-encoded I/O commands (UBLK_U_IO_*), as defined in ublk_cmd.h
+const (
+	UBLK_U_IO_FETCH_REQ            uint32 = ublkIOIOWR | UBLK_IO_FETCH_REQ
+	UBLK_U_IO_COMMIT_AND_FETCH_REQ uint32 = ublkIOIOWR | UBLK_IO_COMMIT_AND_FETCH_REQ
+	UBLK_U_IO_NEED_GET_DATA        uint32 = ublkIOIOWR | UBLK_IO_NEED_GET_DATA
+)
@@ -0,0 +1,537 @@
+package uapi
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+// The tests in this file verify the hand-written bindings against the
+// kernel UAPI headers installed on the build host. CI runners ship
+// linux-libc-dev, so drift between this package and
+// include/uapi/linux/ublk_cmd.h fails the build. Point UBLK_CMD_H and
+// BLKZONED_H at a kernel tree to check against newer headers.
+//
+// constants.go is deliberately not generated from the header. The build
+// must not depend on kernel headers (the module builds on macOS and in
+// header-less containers), and the file groups and documents the
+// constants in ways a generator would throw away. These tests catch the
+// drift a generator would have prevented; new constants are added by hand
+// and listed in goConstants.
+
+const (
+	defaultUblkCmdHeader  = "/usr/include/linux/ublk_cmd.h"
+	defaultBlkzonedHeader = "/usr/include/linux/blkzoned.h"
+)
+
+// goConstants lists every exported constant mirrored from the headers.
+var goConstants = map[string]int64{
+	"UBLK_CMD_GET_QUEUE_AFFINITY":  UBLK_CMD_GET_QUEUE_AFFINITY,
+	"UBLK_CMD_GET_DEV_INFO":        UBLK_CMD_GET_DEV_INFO,
+	"UBLK_CMD_ADD_DEV":             UBLK_CMD_ADD_DEV,
+	"UBLK_CMD_DEL_DEV":             UBLK_CMD_DEL_DEV,
+	"UBLK_CMD_START_DEV":           UBLK_CMD_START_DEV,
+	"UBLK_CMD_STOP_DEV":            UBLK_CMD_STOP_DEV,
+	"UBLK_CMD_SET_PARAMS":          UBLK_CMD_SET_PARAMS,
+	"UBLK_CMD_GET_PARAMS":          UBLK_CMD_GET_PARAMS,
+	"UBLK_CMD_START_USER_RECOVERY": UBLK_CMD_START_USER_RECOVERY,
+	"UBLK_CMD_END_USER_RECOVERY":   UBLK_CMD_END_USER_RECOVERY,
+	"UBLK_CMD_GET_DEV_INFO2":       UBLK_CMD_GET_DEV_INFO2,
+
+	"UBLK_IO_FETCH_REQ":            UBLK_IO_FETCH_REQ,
+	"UBLK_IO_COMMIT_AND_FETCH_REQ": UBLK_IO_COMMIT_AND_FETCH_REQ,
+	"UBLK_IO_NEED_GET_DATA":        UBLK_IO_NEED_GET_DATA,
+
+	"UBLK_U_CMD_GET_QUEUE_AFFINITY":  int64(UBLK_U_CMD_GET_QUEUE_AFFINITY),
+	"UBLK_U_CMD_GET_DEV_INFO":        int64(UBLK_U_CMD_GET_DEV_INFO),
+	"UBLK_U_CMD_ADD_DEV":             int64(UBLK_U_CMD_ADD_DEV),
+	"UBLK_U_CMD_DEL_DEV":             int64(UBLK_U_CMD_DEL_DEV),
+	"UBLK_U_CMD_START_DEV":           int64(UBLK_U_CMD_START_DEV),
+	"UBLK_U_CMD_STOP_DEV":            int64(UBLK_U_CMD_STOP_DEV),
+	"UBLK_U_CMD_SET_PARAMS":          int64(UBLK_U_CMD_SET_PARAMS),
+	"UBLK_U_CMD_GET_PARAMS":          int64(UBLK_U_CMD_GET_PARAMS),
+	"UBLK_U_CMD_START_USER_RECOVERY": int64(UBLK_U_CMD_START_USER_RECOVERY),
+	"UBLK_U_CMD_END_USER_RECOVERY":   int64(UBLK_U_CMD_END_USER_RECOVERY),
+	"UBLK_U_CMD_GET_DEV_INFO2":       int64(UBLK_U_CMD_GET_DEV_INFO2),
+	"UBLK_U_CMD_UPDATE_SIZE":         int64(UBLK_U_CMD_UPDATE_SIZE),
+	"UBLK_U_CMD_DEL_DEV_ASYNC":       int64(UBLK_U_CMD_DEL_DEV_ASYNC),
+
+	"UBLK_U_IO_FETCH_REQ":            int64(UBLK_U_IO_FETCH_REQ),
+	"UBLK_U_IO_COMMIT_AND_FETCH_REQ": int64(UBLK_U_IO_COMMIT_AND_FETCH_REQ),
+	"UBLK_U_IO_NEED_GET_DATA":        int64(UBLK_U_IO_NEED_GET_DATA),
+
+	"UBLK_IO_RES_OK":            UBLK_IO_RES_OK,
+	"UBLK_IO_RES_NEED_GET_DATA": UBLK_IO_RES_NEED_GET_DATA,
+
+	"UBLK_F_SUPPORT_ZERO_COPY":      UBLK_F_SUPPORT_ZERO_COPY,
+	"UBLK_F_URING_CMD_COMP_IN_TASK": UBLK_F_URING_CMD_COMP_IN_TASK,
+	"UBLK_F_NEED_GET_DATA":          UBLK_F_NEED_GET_DATA,
+	"UBLK_F_USER_RECOVERY":          UBLK_F_USER_RECOVERY,
+	"UBLK_F_USER_RECOVERY_REISSUE":  UBLK_F_USER_RECOVERY_REISSUE,
+	"UBLK_F_UNPRIVILEGED_DEV":       UBLK_F_UNPRIVILEGED_DEV,
+	"UBLK_F_CMD_IOCTL_ENCODE":       UBLK_F_CMD_IOCTL_ENCODE,
+	"UBLK_F_USER_COPY":              UBLK_F_USER_COPY,
+	"UBLK_F_ZONED":                  UBLK_F_ZONED,
+
+	"UBLK_S_DEV_DEAD":     UBLK_S_DEV_DEAD,
+	"UBLK_S_DEV_LIVE":     UBLK_S_DEV_LIVE,
+	"UBLK_S_DEV_QUIESCED": UBLK_S_DEV_QUIESCED,
+
+	"UBLK_IO_OP_READ":           UBLK_IO_OP_READ,
+	"UBLK_IO_OP_WRITE":          UBLK_IO_OP_WRITE,
+	"UBLK_IO_OP_FLUSH":          UBLK_IO_OP_FLUSH,
+	"UBLK_IO_OP_DISCARD":        UBLK_IO_OP_DISCARD,
+	"UBLK_IO_OP_WRITE_SAME":     UBLK_IO_OP_WRITE_SAME,
+	"UBLK_IO_OP_WRITE_ZEROES":   UBLK_IO_OP_WRITE_ZEROES,
+	"UBLK_IO_OP_ZONE_OPEN":      UBLK_IO_OP_ZONE_OPEN,
+	"UBLK_IO_OP_ZONE_CLOSE":     UBLK_IO_OP_ZONE_CLOSE,
+	"UBLK_IO_OP_ZONE_FINISH":    UBLK_IO_OP_ZONE_FINISH,
+	"UBLK_IO_OP_ZONE_APPEND":    UBLK_IO_OP_ZONE_APPEND,
+	"UBLK_IO_OP_ZONE_RESET_ALL": UBLK_IO_OP_ZONE_RESET_ALL,
+	"UBLK_IO_OP_ZONE_RESET":     UBLK_IO_OP_ZONE_RESET,
+	"UBLK_IO_OP_REPORT_ZONES":   UBLK_IO_OP_REPORT_ZONES,
+
+	"UBLK_IO_F_FAILFAST_DEV":       UBLK_IO_F_FAILFAST_DEV,
+	"UBLK_IO_F_FAILFAST_TRANSPORT": UBLK_IO_F_FAILFAST_TRANSPORT,
+	"UBLK_IO_F_FAILFAST_DRIVER":    UBLK_IO_F_FAILFAST_DRIVER,
+	"UBLK_IO_F_META":               UBLK_IO_F_META,
+	"UBLK_IO_F_FUA":                UBLK_IO_F_FUA,
+	"UBLK_IO_F_NOUNMAP":            UBLK_IO_F_NOUNMAP,
+	"UBLK_IO_F_SWAP":               UBLK_IO_F_SWAP,
+
+	"UBLK_MAX_QUEUE_DEPTH":      UBLK_MAX_QUEUE_DEPTH,
+	"UBLK_MAX_NR_QUEUES":        UBLK_MAX_NR_QUEUES,
+	"UBLK_FEATURES_LEN":         UBLK_FEATURES_LEN,
+	"UBLKSRV_CMD_BUF_OFFSET":    UBLKSRV_CMD_BUF_OFFSET,
+	"UBLKSRV_IO_BUF_OFFSET":     UBLKSRV_IO_BUF_OFFSET,
+	"UBLK_IO_BUF_OFF":           UBLK_IO_BUF_OFF,
+	"UBLK_IO_BUF_BITS":          UBLK_IO_BUF_BITS,
+	"UBLK_IO_BUF_BITS_MASK":     UBLK_IO_BUF_BITS_MASK,
+	"UBLK_TAG_OFF":              UBLK_TAG_OFF,
+	"UBLK_TAG_BITS":             UBLK_TAG_BITS,
+	"UBLK_TAG_BITS_MASK":        UBLK_TAG_BITS_MASK,
+	"UBLK_QID_OFF":              UBLK_QID_OFF,
+	"UBLK_QID_BITS":             UBLK_QID_BITS,
+	"UBLK_QID_BITS_MASK":        UBLK_QID_BITS_MASK,
+	"UBLKSRV_IO_BUF_TOTAL_BITS": UBLKSRV_IO_BUF_TOTAL_BITS,
+	"UBLKSRV_IO_BUF_TOTAL_SIZE": UBLKSRV_IO_BUF_TOTAL_SIZE,
+
+	"UBLK_ATTR_READ_ONLY":      UBLK_ATTR_READ_ONLY,
+	"UBLK_ATTR_ROTATIONAL":     UBLK_ATTR_ROTATIONAL,
+	"UBLK_ATTR_VOLATILE_CACHE": UBLK_ATTR_VOLATILE_CACHE,
+	"UBLK_ATTR_FUA":            UBLK_ATTR_FUA,
+
+	"UBLK_PARAM_TYPE_BASIC":     UBLK_PARAM_TYPE_BASIC,
+	"UBLK_PARAM_TYPE_DISCARD":   UBLK_PARAM_TYPE_DISCARD,
+	"UBLK_PARAM_TYPE_DEVT":      UBLK_PARAM_TYPE_DEVT,
+	"UBLK_PARAM_TYPE_ZONED":     UBLK_PARAM_TYPE_ZONED,
+	"UBLK_PARAM_TYPE_DMA_ALIGN": UBLK_PARAM_TYPE_DMA_ALIGN,
+	"UBLK_PARAM_TYPE_SEGMENT":   UBLK_PARAM_TYPE_SEGMENT,
+	"UBLK_MIN_SEGMENT_SIZE":     UBLK_MIN_SEGMENT_SIZE,
+}
+
+// goStructs maps kernel struct names to their Go mirrors.
+var goStructs = map[string]reflect.Type{
+	"ublksrv_ctrl_cmd":      reflect.TypeOf(UblksrvCtrlCmd{}),
+	"ublksrv_ctrl_dev_info": reflect.TypeOf(UblksrvCtrlDevInfo{}),
+	"ublksrv_io_desc":       reflect.TypeOf(UblksrvIODesc{}),
+	"ublksrv_io_cmd":        reflect.TypeOf(UblksrvIOCmd{}),
+	"ublk_param_basic":      reflect.TypeOf(UblkParamBasic{}),
+	"ublk_param_discard":    reflect.TypeOf(UblkParamDiscard{}),
+	"ublk_param_devt":       reflect.TypeOf(UblkParamDevt{}),
+	"ublk_param_zoned":      reflect.TypeOf(UblkParamZoned{}),
+	"ublk_param_dma_align":  reflect.TypeOf(UblkParamDMAAlign{}),
+	"ublk_param_segment":    reflect.TypeOf(UblkParamSegment{}),
+	"ublk_params":           reflect.TypeOf(UblkParams{}),
+	"blk_zone":              reflect.TypeOf(BlkZone{}),
+}
+
+// extensibleStructs grow as the kernel adds parameter types; only the
+// prefix shared with the Go mirror is compared.
+var extensibleStructs = map[string]bool{
+	"ublk_params": true,
+}
+
+func TestHeaderConstants(t *testing.T) {
+	h := loadHeader(t, "UBLK_CMD_H", defaultUblkCmdHeader)
+
+	var missing []string
+	for name, expr := range h.defines {
+		if !strings.HasPrefix(name, "UBLK") {
+			continue
+		}
+		want, err := h.eval(expr)
+		if err != nil {
+			continue // Not an integer constant (e.g. -ENODEV)
+		}
+		got, ok := goConstants[name]
+		if !ok {
+			missing = append(missing, fmt.Sprintf("%s = %#x", name, want))
+			continue
+		}
+		if got != want {
+			t.Errorf("%s = %#x, header says %#x", name, got, want)
+		}
+	}
+
+	// New kernel features are not an error, but list them so they can be added
+	sort.Strings(missing)
+	for _, m := range missing {
+		t.Logf("header constant not mirrored in uapi: %s", m)
+	}
+}
+
+func TestHeaderStructLayout(t *testing.T) {
+	h := loadHeader(t, "UBLK_CMD_H", defaultUblkCmdHeader)
+	if zoned, err := os.ReadFile(headerPath("BLKZONED_H", defaultBlkzonedHeader)); err == nil {
+		h.parse(string(zoned))
+	}
+
+	for name, goType := range goStructs {
+		c, ok := h.structs[name]
+		if !ok {
+			continue // Older header without this struct
+		}
+		t.Run(name, func(t *testing.T) {
+			limit := c.size
+			if extensibleStructs[name] {
+				limit = min(c.size, goType.Size())
+			} else if c.size != goType.Size() {
+				t.Errorf("size = %d, header says %d", goType.Size(), c.size)
+			}
+
+			// Every C field boundary must also be a Go field boundary. Go
+			// mirrors may split a C field (e.g. a reserved array) but must
+			// never straddle one.
+			goBounds := fieldBoundaries(goType, 0)
+			for _, b := range c.bounds {
+				if b > limit {
+					continue
+				}
+				if !goBounds[b] {
+					t.Errorf("no Go field boundary at offset %d (header field boundary)", b)
+				}
+			}
+		})
+	}
+}
+
+// fieldBoundaries returns the start and end offsets of every leaf field.
+func fieldBoundaries(typ reflect.Type, base uintptr) map[uintptr]bool {
+	bounds := map[uintptr]bool{base: true, base + typ.Size(): true}
+	if typ.Kind() != reflect.Struct {
+		return bounds
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		for b := range fieldBoundaries(f.Type, base+f.Offset) {
+			bounds[b] = true
+		}
+	}
+	return bounds
+}
+
+func headerPath(env, def string) string {
+	if p := os.Getenv(env); p != "" {
+		return p
+	}
+	return def
+}
+
+func loadHeader(t *testing.T, env, def string) *cHeader {
+	t.Helper()
+	path := headerPath(env, def)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		t.Skipf("kernel header not available: %v", err)
+	}
+	h := &cHeader{defines: map[string]string{}, structs: map[string]cStruct{}}
+	h.parse(string(src))
+	return h
+}
+
+// cHeader is a minimal parser for the subset of C used by the UAPI headers:
+// object-like #defines and structs of fixed-width integer members.
+type cHeader struct {
+	defines map[string]string
+	structs map[string]cStruct
+}
+
+// cStruct is the computed C layout of a struct.
+type cStruct struct {
+	size   uintptr
+	align  uintptr
+	bounds []uintptr // start and end offsets of every leaf field
+}
+
+var (
+	blockComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	lineComment  = regexp.MustCompile(`//[^\n]*`)
+	defineLine   = regexp.MustCompile(`^\s*#\s*define\s+([A-Za-z_]\w*)\s+(.+)$`)
+)
+
+var scalarSizes = map[string]uintptr{
+	"__u8": 1, "__s8": 1, "__u16": 2, "__s16": 2,
+	"__u32": 4, "__s32": 4, "__u64": 8, "__s64": 8,
+}
+
+func (h *cHeader) parse(src string) {
+	src = blockComment.ReplaceAllString(src, "")
+	src = lineComment.ReplaceAllString(src, "")
+
+	var code []string
+	for _, line := range strings.Split(src, "\n") {
+		if m := defineLine.FindStringSubmatch(line); m != nil {
+			h.defines[m[1]] = strings.TrimSpace(m[2])
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		code = append(code, line)
+	}
+
+	toks := tokenize(strings.Join(code, "\n"))
+	for i := 0; i+2 < len(toks); i++ {
+		if toks[i] == "struct" && toks[i+2] == "{" && (i == 0 || toks[i-1] != "(") {
+			name := toks[i+1]
+			layout, next := h.parseMembers(toks, i+3, false)
+			h.structs[name] = layout
+			i = next
+		}
+	}
+}
+
+// parseMembers lays out members starting at toks[i] up to the closing brace
+// and returns the layout and the index of that brace.
+func (h *cHeader) parseMembers(toks []string, i int, union bool) (cStruct, int) {
+	var s cStruct
+	s.align = 1
+	var offset uintptr
+	for i < len(toks) && toks[i] != "}" {
+		var size, align uintptr
+		var bounds []uintptr
+
+		switch {
+		case toks[i] == "struct" || toks[i] == "union":
+			isUnion := toks[i] == "union"
+			i++
+			if toks[i] == "{" {
+				inner, end := h.parseMembers(toks, i+1, isUnion)
+				size, align, bounds = inner.size, inner.align, inner.bounds
+				i = end + 1
+			} else {
+				inner := h.structs[toks[i]]
+				size, align, bounds = inner.size, inner.align, inner.bounds
+				i++
+			}
+		default:
+			size = scalarSizes[toks[i]]
+			align = size
+			bounds = []uintptr{0, size}
+			i++
+		}
+
+		// Optional declarator name and array dimension
+		count := uintptr(1)
+		if i < len(toks) && toks[i] != ";" {
+			i++ // member name
+		}
+		if i < len(toks) && toks[i] == "[" {
+			n, _ := h.eval(toks[i+1])
+			count = uintptr(n)
+			i += 3
+		}
+		i++ // ';'
+
+		if align == 0 {
+			continue // Unknown type, ignore
+		}
+		if union {
+			offset = 0
+		} else if rem := offset % align; rem != 0 {
+			offset += align - rem
+		}
+		if count > 1 {
+			// Arrays are compared as a single field, as on the Go side
+			bounds = []uintptr{0, size * count}
+		}
+		for _, b := range bounds {
+			s.bounds = append(s.bounds, offset+b)
+		}
+		s.align = max(s.align, align)
+		if union {
+			s.size = max(s.size, size*count)
+		} else {
+			offset += size * count
+			s.size = offset
+		}
+	}
+	if rem := s.size % s.align; rem != 0 {
+		s.size += s.align - rem
+	}
+	s.bounds = append(s.bounds, 0, s.size)
+	return s, i
+}
+
+func tokenize(src string) []string {
+	var toks []string
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		case c == '\'':
+			j := strings.IndexByte(src[i+1:], '\'')
+			toks = append(toks, src[i:i+j+2])
+			i += j + 2
+		case c == '<' || c == '>':
+			toks = append(toks, src[i:i+2])
+			i += 2
+		default:
+			toks = append(toks, string(c))
+			i++
+		}
+	}
+	return toks
+}
+
+// eval evaluates an integer constant expression from a #define body.
+func (h *cHeader) eval(expr string) (int64, error) {
+	p := &exprParser{h: h, toks: tokenize(expr)}
+	v, err := p.or()
+	if err != nil {
+		return 0, err
+	}
+	if p.pos != len(p.toks) {
+		return 0, fmt.Errorf("trailing tokens in %q", expr)
+	}
+	return v, nil
+}
+
+// exprParser is a recursive-descent evaluator for | + - << >> and the
+// _IO/_IOR/_IOW/_IOWR ioctl macros.
+type exprParser struct {
+	h    *cHeader
+	toks []string
+	pos  int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) or() (int64, error) {
+	v, err := p.shift()
+	for err == nil && p.peek() == "|" {
+		p.next()
+		var r int64
+		r, err = p.shift()
+		v |= r
+	}
+	return v, err
+}
+
+func (p *exprParser) shift() (int64, error) {
+	v, err := p.additive()
+	for err == nil && (p.peek() == "<<" || p.peek() == ">>") {
+		op := p.next()
+		var r int64
+		r, err = p.additive()
+		if op == "<<" {
+			v <<= r
+		} else {
+			v >>= r
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) additive() (int64, error) {
+	v, err := p.unary()
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.next()
+		var r int64
+		r, err = p.unary()
+		if op == "+" {
+			v += r
+		} else {
+			v -= r
+		}
+	}
+	return v, err
+}
+
+func (p *exprParser) unary() (int64, error) {
+	tok := p.next()
+	switch {
+	case tok == "-":
+		v, err := p.unary()
+		return -v, err
+	case tok == "(":
+		v, err := p.or()
+		if p.next() != ")" {
+			return 0, fmt.Errorf("unbalanced parentheses")
+		}
+		return v, err
+	case len(tok) == 3 && tok[0] == '\'':
+		return int64(tok[1]), nil
+	case tok == "_IO" || tok == "_IOR" || tok == "_IOW" || tok == "_IOWR":
+		return p.ioctl(tok)
+	case tok != "" && unicode.IsDigit(rune(tok[0])):
+		return strconv.ParseInt(strings.TrimRight(tok, "uUlL"), 0, 64)
+	case p.h.defines[tok] != "":
+		return p.h.eval(p.h.defines[tok])
+	}
+	return 0, fmt.Errorf("cannot evaluate token %q", tok)
+}
+
+// ioctl evaluates the asm-generic ioctl encoding macros.
+func (p *exprParser) ioctl(macro string) (int64, error) {
+	if p.next() != "(" {
+		return 0, fmt.Errorf("malformed %s", macro)
+	}
+	typ, err := p.or()
+	if err != nil || p.next() != "," {
+		return 0, fmt.Errorf("malformed %s", macro)
+	}
+	nr, err := p.or()
+	if err != nil {
+		return 0, err
+	}
+	var size uintptr
+	if p.peek() == "," {
+		p.next()
+		if p.next() == "struct" {
+			size = p.h.structs[p.next()].size
+		}
+	}
+	if p.next() != ")" {
+		return 0, fmt.Errorf("malformed %s", macro)
+	}
+
+	dir := map[string]uint32{"_IO": 0, "_IOR": _IOC_READ, "_IOW": _IOC_WRITE, "_IOWR": _IOC_READ | _IOC_WRITE}[macro]
+	return int64(IoctlEncode(dir, uint32(typ), uint32(nr), uint32(size))), nil
+}
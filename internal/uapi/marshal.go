@@ -2,11 +2,12 @@ package uapi
 
 import (
 	"encoding/binary"
-	"reflect"
 	"unsafe"
 )
 
-// Marshal converts a struct to bytes using the system's native byte order
+// Marshal encodes a ublk UAPI struct field by field in the host's native
+// byte order, which is what the kernel expects. It returns nil for types it
+// does not know how to encode.
 func Marshal(v interface{}) []byte {
 	switch val := v.(type) {
 	case *UblksrvCtrlCmd:
@@ -18,12 +19,12 @@ func Marshal(v interface{}) []byte {
 	case *UblksrvCtrlDevInfo:
 		return marshalCtrlDevInfo(val)
 	default:
-		// Fallback: direct memory copy (unsafe but fast)
-		return directMarshal(v)
+		return nil
 	}
 }
 
-// Unmarshal converts bytes back to a struct
+// Unmarshal decodes a ublk UAPI struct encoded by Marshal or the kernel.
+// It returns ErrInvalidType for types it does not know how to decode.
 func Unmarshal(data []byte, v interface{}) error {
 	switch val := v.(type) {
 	case *UblksrvCtrlCmd:
@@ -35,200 +36,271 @@ func Unmarshal(data []byte, v interface{}) error {
 	case *UblksrvCtrlDevInfo:
 		return unmarshalCtrlDevInfo(data, val)
 	default:
-		// Fallback: direct memory copy
-		return directUnmarshal(data, v)
+		return ErrInvalidType
 	}
 }
 
-// marshalCtrlCmd manually marshals UblksrvCtrlCmd (32-byte C-compatible variant)
+// marshalCtrlCmd manually marshals UblksrvCtrlCmd
 func marshalCtrlCmd(cmd *UblksrvCtrlCmd) []byte {
-	buf := make([]byte, 32)
+	buf := make([]byte, UblksrvCtrlCmdSize)
 
-	binary.LittleEndian.PutUint32(buf[0:4], cmd.DevID)
-	binary.LittleEndian.PutUint16(buf[4:6], cmd.QueueID)
-	binary.LittleEndian.PutUint16(buf[6:8], cmd.Len)
-	binary.LittleEndian.PutUint64(buf[8:16], cmd.Addr)
-	binary.LittleEndian.PutUint64(buf[16:24], cmd.Data)
-	binary.LittleEndian.PutUint16(buf[24:26], cmd.DevPathLen)
-	binary.LittleEndian.PutUint16(buf[26:28], cmd.Pad)
-	binary.LittleEndian.PutUint32(buf[28:32], cmd.Reserved)
+	binary.NativeEndian.PutUint32(buf[0:4], cmd.DevID)
+	binary.NativeEndian.PutUint16(buf[4:6], cmd.QueueID)
+	binary.NativeEndian.PutUint16(buf[6:8], cmd.Len)
+	binary.NativeEndian.PutUint64(buf[8:16], cmd.Addr)
+	binary.NativeEndian.PutUint64(buf[16:24], cmd.Data)
+	binary.NativeEndian.PutUint16(buf[24:26], cmd.DevPathLen)
+	binary.NativeEndian.PutUint16(buf[26:28], cmd.Pad)
+	binary.NativeEndian.PutUint32(buf[28:32], cmd.Reserved)
 
 	return buf
 }
 
-// unmarshalCtrlCmd manually unmarshals UblksrvCtrlCmd (32-byte C-compatible variant)
+// unmarshalCtrlCmd manually unmarshals UblksrvCtrlCmd
 func unmarshalCtrlCmd(data []byte, cmd *UblksrvCtrlCmd) error {
-	if len(data) < 32 {
+	if len(data) < UblksrvCtrlCmdSize {
 		return ErrInsufficientData
 	}
 
-	cmd.DevID = binary.LittleEndian.Uint32(data[0:4])
-	cmd.QueueID = binary.LittleEndian.Uint16(data[4:6])
-	cmd.Len = binary.LittleEndian.Uint16(data[6:8])
-	cmd.Addr = binary.LittleEndian.Uint64(data[8:16])
-	cmd.Data = binary.LittleEndian.Uint64(data[16:24])
-	cmd.DevPathLen = binary.LittleEndian.Uint16(data[24:26])
-	cmd.Pad = binary.LittleEndian.Uint16(data[26:28])
-	cmd.Reserved = binary.LittleEndian.Uint32(data[28:32])
+	cmd.DevID = binary.NativeEndian.Uint32(data[0:4])
+	cmd.QueueID = binary.NativeEndian.Uint16(data[4:6])
+	cmd.Len = binary.NativeEndian.Uint16(data[6:8])
+	cmd.Addr = binary.NativeEndian.Uint64(data[8:16])
+	cmd.Data = binary.NativeEndian.Uint64(data[16:24])
+	cmd.DevPathLen = binary.NativeEndian.Uint16(data[24:26])
+	cmd.Pad = binary.NativeEndian.Uint16(data[26:28])
+	cmd.Reserved = binary.NativeEndian.Uint32(data[28:32])
 
 	return nil
 }
 
 // marshalIOCmd manually marshals UblksrvIOCmd
 func marshalIOCmd(cmd *UblksrvIOCmd) []byte {
-	buf := make([]byte, 16)
+	buf := make([]byte, UblksrvIOCmdSize)
 
-	binary.LittleEndian.PutUint16(buf[0:2], cmd.QID)
-	binary.LittleEndian.PutUint16(buf[2:4], cmd.Tag)
-	binary.LittleEndian.PutUint32(buf[4:8], uint32(cmd.Result))
-	binary.LittleEndian.PutUint64(buf[8:16], cmd.Addr)
+	binary.NativeEndian.PutUint16(buf[0:2], cmd.QID)
+	binary.NativeEndian.PutUint16(buf[2:4], cmd.Tag)
+	binary.NativeEndian.PutUint32(buf[4:8], uint32(cmd.Result))
+	binary.NativeEndian.PutUint64(buf[8:16], cmd.Addr)
 
 	return buf
 }
 
 // unmarshalIOCmd manually unmarshals UblksrvIOCmd
 func unmarshalIOCmd(data []byte, cmd *UblksrvIOCmd) error {
-	if len(data) < 16 {
+	if len(data) < UblksrvIOCmdSize {
 		return ErrInsufficientData
 	}
 
-	cmd.QID = binary.LittleEndian.Uint16(data[0:2])
-	cmd.Tag = binary.LittleEndian.Uint16(data[2:4])
-	cmd.Result = int32(binary.LittleEndian.Uint32(data[4:8]))
-	cmd.Addr = binary.LittleEndian.Uint64(data[8:16])
+	cmd.QID = binary.NativeEndian.Uint16(data[0:2])
+	cmd.Tag = binary.NativeEndian.Uint16(data[2:4])
+	cmd.Result = int32(binary.NativeEndian.Uint32(data[4:8]))
+	cmd.Addr = binary.NativeEndian.Uint64(data[8:16])
 
 	return nil
 }
 
-// marshalParams handles the complex UblkParams structure
-func marshalParams(params *UblkParams) []byte {
-	// Calculate actual size based on types
-	size := 8 // len + types
-	if params.HasBasic() {
-		size += int(unsafe.Sizeof(params.Basic))
-	}
-	if params.HasDiscard() {
-		size += int(unsafe.Sizeof(params.Discard))
-	}
-	if params.HasDevt() {
-		size += int(unsafe.Sizeof(params.Devt))
-	}
-	if params.HasZoned() {
-		size += int(unsafe.Sizeof(params.Zoned))
-	}
+// Offsets of each parameter type within struct ublk_params. The kernel
+// reads every type at a fixed position regardless of which types are
+// present, so absent types leave a zeroed hole rather than being packed out.
+const (
+	ublkParamsHeaderSize   = 8
+	ublkParamBasicOffset   = int(unsafe.Offsetof(UblkParams{}.Basic))
+	ublkParamDiscardOffset = int(unsafe.Offsetof(UblkParams{}.Discard))
+	ublkParamDevtOffset    = int(unsafe.Offsetof(UblkParams{}.Devt))
+	ublkParamZonedOffset   = int(unsafe.Offsetof(UblkParams{}.Zoned))
+	ublkParamDMAOffset     = int(unsafe.Offsetof(UblkParams{}.DMA))
+	ublkParamSegOffset     = int(unsafe.Offsetof(UblkParams{}.Seg))
+
+	ublkParamBasicSize   = int(unsafe.Sizeof(UblkParamBasic{}))
+	ublkParamDiscardSize = int(unsafe.Sizeof(UblkParamDiscard{}))
+	ublkParamDevtSize    = int(unsafe.Sizeof(UblkParamDevt{}))
+	ublkParamZonedSize   = int(unsafe.Sizeof(UblkParamZoned{}))
+	ublkParamDMASize     = int(unsafe.Sizeof(UblkParamDMAAlign{}))
+	ublkParamSegSize     = int(unsafe.Sizeof(UblkParamSegment{}))
+
+	// UblkParamsSize is sizeof(struct ublk_params) for the parameter
+	// types this package knows about.
+	UblkParamsSize = int(unsafe.Sizeof(UblkParams{}))
+)
 
-	buf := make([]byte, size)
-	offset := 0
+// marshalParams encodes UblkParams in the kernel's fixed layout. Len is
+// always the full struct size; only the types flagged in Types are filled.
+func marshalParams(params *UblkParams) []byte {
+	buf := make([]byte, UblkParamsSize)
 
-	// Marshal len and types
-	binary.LittleEndian.PutUint32(buf[offset:offset+4], uint32(size))
-	offset += 4
-	binary.LittleEndian.PutUint32(buf[offset:offset+4], params.Types)
-	offset += 4
+	binary.NativeEndian.PutUint32(buf[0:4], uint32(UblkParamsSize))
+	binary.NativeEndian.PutUint32(buf[4:8], params.Types)
 
-	// Marshal each parameter type that's present
 	if params.HasBasic() {
-		basicBytes := directMarshal(&params.Basic)
-		copy(buf[offset:], basicBytes)
-		offset += len(basicBytes)
+		putParamBasic(buf[ublkParamBasicOffset:], &params.Basic)
 	}
-
 	if params.HasDiscard() {
-		discardBytes := directMarshal(&params.Discard)
-		copy(buf[offset:], discardBytes)
-		offset += len(discardBytes)
+		putParamDiscard(buf[ublkParamDiscardOffset:], &params.Discard)
 	}
-
 	if params.HasDevt() {
-		devtBytes := directMarshal(&params.Devt)
-		copy(buf[offset:], devtBytes)
-		offset += len(devtBytes)
+		putParamDevt(buf[ublkParamDevtOffset:], &params.Devt)
 	}
-
 	if params.HasZoned() {
-		zonedBytes := directMarshal(&params.Zoned)
-		copy(buf[offset:], zonedBytes)
+		putParamZoned(buf[ublkParamZonedOffset:], &params.Zoned)
+	}
+	if params.HasDMAAlign() {
+		putParamDMAAlign(buf[ublkParamDMAOffset:], &params.DMA)
+	}
+	if params.HasSegment() {
+		putParamSegment(buf[ublkParamSegOffset:], &params.Seg)
 	}
 
 	return buf
 }
 
-// unmarshalParams handles the complex UblkParams structure
+// unmarshalParams decodes UblkParams from the kernel's fixed layout. Types
+// flagged as present must lie entirely within both data and Len.
 func unmarshalParams(data []byte, params *UblkParams) error {
-	if len(data) < 8 {
+	if len(data) < ublkParamsHeaderSize {
 		return ErrInsufficientData
 	}
 
-	length := binary.LittleEndian.Uint32(data[0:4])
-	params.Len = length
-	params.Types = binary.LittleEndian.Uint32(data[4:8])
+	params.Len = binary.NativeEndian.Uint32(data[0:4])
+	params.Types = binary.NativeEndian.Uint32(data[4:8])
 
-	if int(length) > len(data) {
+	if int(params.Len) > len(data) {
 		return ErrInsufficientData
 	}
+	data = data[:params.Len]
 
-	offset := 8
-
-	// Unmarshal each parameter type that's present
 	if params.HasBasic() {
-		if err := directUnmarshal(data[offset:], &params.Basic); err != nil {
-			return err
+		if len(data) < ublkParamBasicOffset+ublkParamBasicSize {
+			return ErrInsufficientData
 		}
-		offset += int(unsafe.Sizeof(params.Basic))
+		getParamBasic(data[ublkParamBasicOffset:], &params.Basic)
 	}
-
 	if params.HasDiscard() {
-		if err := directUnmarshal(data[offset:], &params.Discard); err != nil {
-			return err
+		if len(data) < ublkParamDiscardOffset+ublkParamDiscardSize {
+			return ErrInsufficientData
 		}
-		offset += int(unsafe.Sizeof(params.Discard))
+		getParamDiscard(data[ublkParamDiscardOffset:], &params.Discard)
 	}
-
 	if params.HasDevt() {
-		if err := directUnmarshal(data[offset:], &params.Devt); err != nil {
-			return err
+		if len(data) < ublkParamDevtOffset+ublkParamDevtSize {
+			return ErrInsufficientData
 		}
-		offset += int(unsafe.Sizeof(params.Devt))
+		getParamDevt(data[ublkParamDevtOffset:], &params.Devt)
 	}
-
 	if params.HasZoned() {
-		if err := directUnmarshal(data[offset:], &params.Zoned); err != nil {
-			return err
+		if len(data) < ublkParamZonedOffset+ublkParamZonedSize {
+			return ErrInsufficientData
 		}
+		getParamZoned(data[ublkParamZonedOffset:], &params.Zoned)
+	}
+	if params.HasDMAAlign() {
+		if len(data) < ublkParamDMAOffset+ublkParamDMASize {
+			return ErrInsufficientData
+		}
+		getParamDMAAlign(data[ublkParamDMAOffset:], &params.DMA)
+	}
+	if params.HasSegment() {
+		if len(data) < ublkParamSegOffset+ublkParamSegSize {
+			return ErrInsufficientData
+		}
+		getParamSegment(data[ublkParamSegOffset:], &params.Seg)
 	}
 
 	return nil
 }
 
-// directMarshal performs direct memory copy for marshaling
-func directMarshal(v interface{}) []byte {
-	// Dereference the interface to get actual struct pointer
-	ptr := reflect.ValueOf(v).UnsafePointer()
-	size := int(reflect.TypeOf(v).Elem().Size())
+func putParamBasic(b []byte, p *UblkParamBasic) {
+	binary.NativeEndian.PutUint32(b[0:4], p.Attrs)
+	b[4] = p.LogicalBSShift
+	b[5] = p.PhysicalBSShift
+	b[6] = p.IOOptShift
+	b[7] = p.IOMinShift
+	binary.NativeEndian.PutUint32(b[8:12], p.MaxSectors)
+	binary.NativeEndian.PutUint32(b[12:16], p.ChunkSectors)
+	binary.NativeEndian.PutUint64(b[16:24], p.DevSectors)
+	binary.NativeEndian.PutUint64(b[24:32], p.VirtBoundaryMask)
+}
 
-	// Create a copy of the bytes from the actual struct
-	buf := make([]byte, size)
-	src := (*[1 << 20]byte)(ptr)
-	copy(buf, src[:size])
+func getParamBasic(b []byte, p *UblkParamBasic) {
+	p.Attrs = binary.NativeEndian.Uint32(b[0:4])
+	p.LogicalBSShift = b[4]
+	p.PhysicalBSShift = b[5]
+	p.IOOptShift = b[6]
+	p.IOMinShift = b[7]
+	p.MaxSectors = binary.NativeEndian.Uint32(b[8:12])
+	p.ChunkSectors = binary.NativeEndian.Uint32(b[12:16])
+	p.DevSectors = binary.NativeEndian.Uint64(b[16:24])
+	p.VirtBoundaryMask = binary.NativeEndian.Uint64(b[24:32])
+}
 
-	return buf
+func putParamDiscard(b []byte, p *UblkParamDiscard) {
+	binary.NativeEndian.PutUint32(b[0:4], p.DiscardAlignment)
+	binary.NativeEndian.PutUint32(b[4:8], p.DiscardGranularity)
+	binary.NativeEndian.PutUint32(b[8:12], p.MaxDiscardSectors)
+	binary.NativeEndian.PutUint32(b[12:16], p.MaxWriteZeroesSectors)
+	binary.NativeEndian.PutUint16(b[16:18], p.MaxDiscardSegments)
+	binary.NativeEndian.PutUint16(b[18:20], p.Reserved0)
 }
 
-// directUnmarshal performs direct memory copy for unmarshaling
-func directUnmarshal(data []byte, v interface{}) error {
-	// Get the actual pointer and size from the interface (must be a pointer type)
-	ptr := reflect.ValueOf(v).UnsafePointer()
-	size := int(reflect.TypeOf(v).Elem().Size())
+func getParamDiscard(b []byte, p *UblkParamDiscard) {
+	p.DiscardAlignment = binary.NativeEndian.Uint32(b[0:4])
+	p.DiscardGranularity = binary.NativeEndian.Uint32(b[4:8])
+	p.MaxDiscardSectors = binary.NativeEndian.Uint32(b[8:12])
+	p.MaxWriteZeroesSectors = binary.NativeEndian.Uint32(b[12:16])
+	p.MaxDiscardSegments = binary.NativeEndian.Uint16(b[16:18])
+	p.Reserved0 = binary.NativeEndian.Uint16(b[18:20])
+}
 
-	if len(data) < size {
-		return ErrInsufficientData
-	}
+func putParamDevt(b []byte, p *UblkParamDevt) {
+	binary.NativeEndian.PutUint32(b[0:4], p.CharMajor)
+	binary.NativeEndian.PutUint32(b[4:8], p.CharMinor)
+	binary.NativeEndian.PutUint32(b[8:12], p.DiskMajor)
+	binary.NativeEndian.PutUint32(b[12:16], p.DiskMinor)
+}
+
+func getParamDevt(b []byte, p *UblkParamDevt) {
+	p.CharMajor = binary.NativeEndian.Uint32(b[0:4])
+	p.CharMinor = binary.NativeEndian.Uint32(b[4:8])
+	p.DiskMajor = binary.NativeEndian.Uint32(b[8:12])
+	p.DiskMinor = binary.NativeEndian.Uint32(b[12:16])
+}
 
-	// Direct memory copy to the struct
-	dst := (*[1 << 20]byte)(ptr)
-	copy(dst[:size], data[:size])
+func putParamZoned(b []byte, p *UblkParamZoned) {
+	binary.NativeEndian.PutUint32(b[0:4], p.MaxOpenZones)
+	binary.NativeEndian.PutUint32(b[4:8], p.MaxActiveZones)
+	binary.NativeEndian.PutUint32(b[8:12], p.MaxZoneAppendSectors)
+	copy(b[12:32], p.Reserved[:])
+}
 
-	return nil
+func getParamZoned(b []byte, p *UblkParamZoned) {
+	p.MaxOpenZones = binary.NativeEndian.Uint32(b[0:4])
+	p.MaxActiveZones = binary.NativeEndian.Uint32(b[4:8])
+	p.MaxZoneAppendSectors = binary.NativeEndian.Uint32(b[8:12])
+	copy(p.Reserved[:], b[12:32])
+}
+
+func putParamDMAAlign(b []byte, p *UblkParamDMAAlign) {
+	binary.NativeEndian.PutUint32(b[0:4], p.Alignment)
+	copy(b[4:8], p.Pad[:])
+}
+
+func getParamDMAAlign(b []byte, p *UblkParamDMAAlign) {
+	p.Alignment = binary.NativeEndian.Uint32(b[0:4])
+	copy(p.Pad[:], b[4:8])
+}
+
+func putParamSegment(b []byte, p *UblkParamSegment) {
+	binary.NativeEndian.PutUint64(b[0:8], p.SegBoundaryMask)
+	binary.NativeEndian.PutUint32(b[8:12], p.MaxSegmentSize)
+	binary.NativeEndian.PutUint16(b[12:14], p.MaxSegments)
+	copy(b[14:16], p.Pad[:])
+}
+
+func getParamSegment(b []byte, p *UblkParamSegment) {
+	p.SegBoundaryMask = binary.NativeEndian.Uint64(b[0:8])
+	p.MaxSegmentSize = binary.NativeEndian.Uint32(b[8:12])
+	p.MaxSegments = binary.NativeEndian.Uint16(b[12:14])
+	copy(p.Pad[:], b[14:16])
 }
 
 // Error definitions
@@ -240,22 +312,22 @@ func (e MarshalError) Error() string {
 
 // marshalCtrlDevInfo manually marshals UblksrvCtrlDevInfo
 func marshalCtrlDevInfo(info *UblksrvCtrlDevInfo) []byte {
-	buf := make([]byte, 64) // Now exactly 64 bytes to match kernel 6.6+
-
-	binary.LittleEndian.PutUint16(buf[0:2], info.NrHwQueues)
-	binary.LittleEndian.PutUint16(buf[2:4], info.QueueDepth)
-	binary.LittleEndian.PutUint16(buf[4:6], info.State)
-	binary.LittleEndian.PutUint16(buf[6:8], info.Pad0)
-	binary.LittleEndian.PutUint32(buf[8:12], info.MaxIOBufBytes)
-	binary.LittleEndian.PutUint32(buf[12:16], info.DevID)
-	binary.LittleEndian.PutUint32(buf[16:20], uint32(info.UblksrvPID))
-	binary.LittleEndian.PutUint32(buf[20:24], info.Pad1)
-	binary.LittleEndian.PutUint64(buf[24:32], info.Flags)
-	binary.LittleEndian.PutUint64(buf[32:40], info.UblksrvFlags)
-	binary.LittleEndian.PutUint32(buf[40:44], info.OwnerUID)
-	binary.LittleEndian.PutUint32(buf[44:48], info.OwnerGID)
-	binary.LittleEndian.PutUint64(buf[48:56], info.Reserved1)
-	binary.LittleEndian.PutUint64(buf[56:64], info.Reserved2)
+	buf := make([]byte, 64)
+
+	binary.NativeEndian.PutUint16(buf[0:2], info.NrHwQueues)
+	binary.NativeEndian.PutUint16(buf[2:4], info.QueueDepth)
+	binary.NativeEndian.PutUint16(buf[4:6], info.State)
+	binary.NativeEndian.PutUint16(buf[6:8], info.Pad0)
+	binary.NativeEndian.PutUint32(buf[8:12], info.MaxIOBufBytes)
+	binary.NativeEndian.PutUint32(buf[12:16], info.DevID)
+	binary.NativeEndian.PutUint32(buf[16:20], uint32(info.UblksrvPID))
+	binary.NativeEndian.PutUint32(buf[20:24], info.Pad1)
+	binary.NativeEndian.PutUint64(buf[24:32], info.Flags)
+	binary.NativeEndian.PutUint64(buf[32:40], info.UblksrvFlags)
+	binary.NativeEndian.PutUint32(buf[40:44], info.OwnerUID)
+	binary.NativeEndian.PutUint32(buf[44:48], info.OwnerGID)
+	binary.NativeEndian.PutUint64(buf[48:56], info.Reserved1)
+	binary.NativeEndian.PutUint64(buf[56:64], info.Reserved2)
 
 	return buf
 }
@@ -267,32 +339,57 @@ func unmarshalCtrlDevInfo(data []byte, info *UblksrvCtrlDevInfo) error {
 		return ErrInsufficientData
 	}
 
-	info.NrHwQueues = binary.LittleEndian.Uint16(data[0:2])
-	info.QueueDepth = binary.LittleEndian.Uint16(data[2:4])
-	info.State = binary.LittleEndian.Uint16(data[4:6])
-	info.Pad0 = binary.LittleEndian.Uint16(data[6:8])
-	info.MaxIOBufBytes = binary.LittleEndian.Uint32(data[8:12])
-	info.DevID = binary.LittleEndian.Uint32(data[12:16])
-	info.UblksrvPID = int32(binary.LittleEndian.Uint32(data[16:20]))
-	info.Pad1 = binary.LittleEndian.Uint32(data[20:24])
-	info.Flags = binary.LittleEndian.Uint64(data[24:32])
-	info.UblksrvFlags = binary.LittleEndian.Uint64(data[32:40])
+	info.NrHwQueues = binary.NativeEndian.Uint16(data[0:2])
+	info.QueueDepth = binary.NativeEndian.Uint16(data[2:4])
+	info.State = binary.NativeEndian.Uint16(data[4:6])
+	info.Pad0 = binary.NativeEndian.Uint16(data[6:8])
+	info.MaxIOBufBytes = binary.NativeEndian.Uint32(data[8:12])
+	info.DevID = binary.NativeEndian.Uint32(data[12:16])
+	info.UblksrvPID = int32(binary.NativeEndian.Uint32(data[16:20]))
+	info.Pad1 = binary.NativeEndian.Uint32(data[20:24])
+	info.Flags = binary.NativeEndian.Uint64(data[24:32])
+	info.UblksrvFlags = binary.NativeEndian.Uint64(data[32:40])
 
 	// OwnerUID/GID are at bytes 40-48 in the 64-byte struct
 	if len(data) >= 48 {
-		info.OwnerUID = binary.LittleEndian.Uint32(data[40:44])
-		info.OwnerGID = binary.LittleEndian.Uint32(data[44:48])
+		info.OwnerUID = binary.NativeEndian.Uint32(data[40:44])
+		info.OwnerGID = binary.NativeEndian.Uint32(data[44:48])
 	}
 
 	// Reserved fields at bytes 48-64
 	if len(data) >= 64 {
-		info.Reserved1 = binary.LittleEndian.Uint64(data[48:56])
-		info.Reserved2 = binary.LittleEndian.Uint64(data[56:64])
+		info.Reserved1 = binary.NativeEndian.Uint64(data[48:56])
+		info.Reserved2 = binary.NativeEndian.Uint64(data[56:64])
 	}
 
 	return nil
 }
 
+// EncodeBlkZones writes zones into buf as consecutive struct blk_zone
+// entries, as expected in the buffer of a REPORT_ZONES request. Entries that
+// do not fit are dropped; the remainder of buf is zeroed so the kernel sees a
+// zero-length zone as the end of the report. It returns the number of zones
+// written.
+func EncodeBlkZones(buf []byte, zones []BlkZone) int {
+	n := min(len(zones), len(buf)/BlkZoneSize)
+	for i := 0; i < n; i++ {
+		z := &zones[i]
+		b := buf[i*BlkZoneSize : (i+1)*BlkZoneSize]
+		binary.NativeEndian.PutUint64(b[0:8], z.Start)
+		binary.NativeEndian.PutUint64(b[8:16], z.Len)
+		binary.NativeEndian.PutUint64(b[16:24], z.WritePointer)
+		b[24] = z.Type
+		b[25] = z.Cond
+		b[26] = z.NonSeq
+		b[27] = z.Reset
+		copy(b[28:32], z.Resv[:])
+		binary.NativeEndian.PutUint64(b[32:40], z.Capacity)
+		copy(b[40:64], z.Reserved[:])
+	}
+	clear(buf[n*BlkZoneSize:])
+	return n
+}
+
 // MarshalCtrlDevInfo is a convenience function for external use
 func MarshalCtrlDevInfo(info *UblksrvCtrlDevInfo) []byte {
 	return marshalCtrlDevInfo(info)
@@ -0,0 +1,371 @@
+package uapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"unsafe"
+)
+
+func TestEncodeBlkZones_Layout(t *testing.T) {
+	zones := []BlkZone{
+		{
+			Start: 0, Len: 0x80000, WritePointer: 0x100, Capacity: 0x7f000,
+			Type: BLK_ZONE_TYPE_SEQWRITE_REQ, Cond: BLK_ZONE_COND_IMP_OPEN,
+		},
+		{
+			Start: 0x80000, Len: 0x80000, WritePointer: 0x80000, Capacity: 0x80000,
+			Type: BLK_ZONE_TYPE_CONVENTIONAL, Cond: BLK_ZONE_COND_NOT_WP,
+		},
+	}
+	buf := bytes.Repeat([]byte{0xAA}, 3*BlkZoneSize)
+
+	n := EncodeBlkZones(buf, zones)
+	if n != 2 {
+		t.Fatalf("EncodeBlkZones() = %d, want 2", n)
+	}
+
+	first := buf[:BlkZoneSize]
+	if got := binary.NativeEndian.Uint64(first[8:16]); got != 0x80000 {
+		t.Errorf("len = %#x, want 0x80000", got)
+	}
+	if got := binary.NativeEndian.Uint64(first[16:24]); got != 0x100 {
+		t.Errorf("wp = %#x, want 0x100", got)
+	}
+	if first[24] != BLK_ZONE_TYPE_SEQWRITE_REQ || first[25] != BLK_ZONE_COND_IMP_OPEN {
+		t.Errorf("type/cond = %d/%d", first[24], first[25])
+	}
+	if got := binary.NativeEndian.Uint64(first[32:40]); got != 0x7f000 {
+		t.Errorf("capacity = %#x, want 0x7f000", got)
+	}
+
+	second := buf[BlkZoneSize : 2*BlkZoneSize]
+	if got := binary.NativeEndian.Uint64(second[0:8]); got != 0x80000 {
+		t.Errorf("second start = %#x, want 0x80000", got)
+	}
+
+	// The unused tail must read as a zero-length zone to terminate the report
+	if !bytes.Equal(buf[2*BlkZoneSize:], make([]byte, BlkZoneSize)) {
+		t.Error("tail after last zone was not zeroed")
+	}
+}
+
+func TestEncodeBlkZones_Truncates(t *testing.T) {
+	zones := make([]BlkZone, 4)
+	buf := make([]byte, 2*BlkZoneSize+10)
+
+	if n := EncodeBlkZones(buf, zones); n != 2 {
+		t.Errorf("EncodeBlkZones() = %d, want 2", n)
+	}
+}
+
+// Known-good encodings as produced by ublksrv (ublk_cmd.h, little-endian).
+var (
+	// ADD_DEV control header: dev_id=-1, queue_id=-1, len=64, addr, data[0]=0.
+	ublksrvAddDevCmd = []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x40, 0x00,
+		0x00, 0x10, 0x32, 0x54, 0x76, 0x98, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	// COMMIT_AND_FETCH_REQ for q_id=1, tag=7, result=4096.
+	ublksrvCommitCmd = []byte{
+		0x01, 0x00, 0x07, 0x00, 0x00, 0x10, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x40, 0x12, 0x7f, 0x00, 0x00,
+	}
+)
+
+// skipUnlessLittleEndian skips tests whose expected bytes were captured on
+// a little-endian host.
+func skipUnlessLittleEndian(t *testing.T) {
+	t.Helper()
+	if binary.NativeEndian.Uint16([]byte{1, 0}) != 1 {
+		t.Skip("known-good bytes were captured on a little-endian host")
+	}
+}
+
+func TestCtrlCmd_KnownBytes(t *testing.T) {
+	skipUnlessLittleEndian(t)
+	cmd := UblksrvCtrlCmd{
+		DevID:   0xFFFFFFFF,
+		QueueID: 0xFFFF,
+		Len:     64,
+		Addr:    0x987654321000,
+	}
+	if got := Marshal(&cmd); !bytes.Equal(got, ublksrvAddDevCmd) {
+		t.Fatalf("Marshal() = % x\nwant       % x", got, ublksrvAddDevCmd)
+	}
+
+	var back UblksrvCtrlCmd
+	if err := Unmarshal(ublksrvAddDevCmd, &back); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if back != cmd {
+		t.Errorf("Unmarshal() = %+v, want %+v", back, cmd)
+	}
+
+	if err := Unmarshal(ublksrvAddDevCmd[:UblksrvCtrlCmdSize-1], &back); err != ErrInsufficientData {
+		t.Errorf("Unmarshal(short) error = %v, want ErrInsufficientData", err)
+	}
+}
+
+func TestIOCmd_KnownBytes(t *testing.T) {
+	skipUnlessLittleEndian(t)
+	cmd := UblksrvIOCmd{QID: 1, Tag: 7, Result: 4096, Addr: 0x7f1240000000}
+	if got := Marshal(&cmd); !bytes.Equal(got, ublksrvCommitCmd) {
+		t.Fatalf("Marshal() = % x\nwant       % x", got, ublksrvCommitCmd)
+	}
+
+	var back UblksrvIOCmd
+	if err := Unmarshal(ublksrvCommitCmd, &back); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if back != cmd {
+		t.Errorf("Unmarshal() = %+v, want %+v", back, cmd)
+	}
+}
+
+func TestIoctlEncodedCommands(t *testing.T) {
+	// Values from the UBLK_U_* macros as built by ublksrv.
+	tests := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"UBLK_U_CMD_GET_DEV_INFO", UBLK_U_CMD_GET_DEV_INFO, 0xc0207502},
+		{"UBLK_U_CMD_ADD_DEV", UBLK_U_CMD_ADD_DEV, 0xc0207504},
+		{"UBLK_U_CMD_DEL_DEV", UBLK_U_CMD_DEL_DEV, 0xc0207505},
+		{"UBLK_U_CMD_START_DEV", UBLK_U_CMD_START_DEV, 0xc0207506},
+		{"UBLK_U_CMD_STOP_DEV", UBLK_U_CMD_STOP_DEV, 0xc0207507},
+		{"UBLK_U_CMD_SET_PARAMS", UBLK_U_CMD_SET_PARAMS, 0xc0207508},
+		{"UBLK_U_CMD_GET_PARAMS", UBLK_U_CMD_GET_PARAMS, 0xc0207509},
+		{"UBLK_U_CMD_UPDATE_SIZE", UBLK_U_CMD_UPDATE_SIZE, 0xc0207515},
+		{"UBLK_U_CMD_DEL_DEV_ASYNC", UBLK_U_CMD_DEL_DEV_ASYNC, 0x80207514},
+		{"UBLK_U_IO_FETCH_REQ", UBLK_U_IO_FETCH_REQ, 0xc0107520},
+		{"UBLK_U_IO_COMMIT_AND_FETCH_REQ", UBLK_U_IO_COMMIT_AND_FETCH_REQ, 0xc0107521},
+		{"UBLK_U_IO_NEED_GET_DATA", UBLK_U_IO_NEED_GET_DATA, 0xc0107522},
+		{"UblkCtrlCmd(ADD_DEV)", UblkCtrlCmd(UBLK_CMD_ADD_DEV), 0xc0207504},
+		{"UblkIOCmd(FETCH_REQ)", UblkIOCmd(UBLK_IO_FETCH_REQ), 0xc0107520},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %#x, want %#x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestParams_FixedOffsets(t *testing.T) {
+	// The offsets are part of the kernel ABI and must not vary by GOARCH.
+	offsets := []struct {
+		name      string
+		got, want int
+	}{
+		{"basic", ublkParamBasicOffset, 8},
+		{"discard", ublkParamDiscardOffset, 40},
+		{"devt", ublkParamDevtOffset, 60},
+		{"zoned", ublkParamZonedOffset, 76},
+		{"dma", ublkParamDMAOffset, 108},
+		{"seg", ublkParamSegOffset, 120},
+		{"size", UblkParamsSize, 136},
+	}
+	for _, o := range offsets {
+		if o.got != o.want {
+			t.Errorf("%s offset = %d, want %d", o.name, o.got, o.want)
+		}
+	}
+
+	// Zoned without discard/devt must still land at its fixed offset.
+	params := UblkParams{
+		Types: UBLK_PARAM_TYPE_BASIC | UBLK_PARAM_TYPE_ZONED,
+		Basic: UblkParamBasic{LogicalBSShift: 9, MaxSectors: 128, DevSectors: 1 << 20},
+		Zoned: UblkParamZoned{MaxOpenZones: 14, MaxActiveZones: 16, MaxZoneAppendSectors: 256},
+	}
+	buf := Marshal(&params)
+	if len(buf) != UblkParamsSize {
+		t.Fatalf("len(Marshal()) = %d, want %d", len(buf), UblkParamsSize)
+	}
+	if got := binary.NativeEndian.Uint32(buf[0:4]); got != uint32(UblkParamsSize) {
+		t.Errorf("len field = %d, want %d", got, UblkParamsSize)
+	}
+	if got := binary.NativeEndian.Uint32(buf[76:80]); got != 14 {
+		t.Errorf("max_open_zones at 76 = %d, want 14", got)
+	}
+	if got := binary.NativeEndian.Uint64(buf[24:32]); got != 1<<20 {
+		t.Errorf("dev_sectors at 24 = %d, want %d", got, 1<<20)
+	}
+	if !bytes.Equal(buf[40:76], make([]byte, 36)) {
+		t.Errorf("absent discard/devt area not zeroed: % x", buf[40:76])
+	}
+
+	var back UblkParams
+	if err := Unmarshal(buf, &back); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	params.Len = uint32(UblkParamsSize)
+	if back != params {
+		t.Errorf("Unmarshal() = %+v, want %+v", back, params)
+	}
+}
+
+func TestParams_RoundTripAllTypes(t *testing.T) {
+	params := UblkParams{
+		Types: UBLK_PARAM_TYPE_BASIC | UBLK_PARAM_TYPE_DISCARD | UBLK_PARAM_TYPE_DEVT |
+			UBLK_PARAM_TYPE_ZONED | UBLK_PARAM_TYPE_DMA_ALIGN | UBLK_PARAM_TYPE_SEGMENT,
+		Basic: UblkParamBasic{
+			Attrs:          UBLK_ATTR_VOLATILE_CACHE,
+			LogicalBSShift: 12, PhysicalBSShift: 12, IOOptShift: 16, IOMinShift: 12,
+			MaxSectors: 2048, ChunkSectors: 8, DevSectors: 123456, VirtBoundaryMask: 0xfff,
+		},
+		Discard: UblkParamDiscard{
+			DiscardAlignment: 4096, DiscardGranularity: 4096,
+			MaxDiscardSectors: 8192, MaxWriteZeroesSectors: 8192, MaxDiscardSegments: 1,
+		},
+		Devt:  UblkParamDevt{CharMajor: 240, CharMinor: 1, DiskMajor: 259, DiskMinor: 3},
+		Zoned: UblkParamZoned{MaxOpenZones: 1, MaxActiveZones: 2, MaxZoneAppendSectors: 3},
+		DMA:   UblkParamDMAAlign{Alignment: 511},
+		Seg:   UblkParamSegment{SegBoundaryMask: 0xffff, MaxSegmentSize: 65536, MaxSegments: 32},
+	}
+	buf := Marshal(&params)
+
+	var back UblkParams
+	if err := Unmarshal(buf, &back); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	params.Len = uint32(UblkParamsSize)
+	if back != params {
+		t.Errorf("Unmarshal() = %+v, want %+v", back, params)
+	}
+
+	// A reply whose len cuts off a flagged type is rejected.
+	binary.NativeEndian.PutUint32(buf[0:4], uint32(ublkParamSegOffset))
+	if err := Unmarshal(buf, &back); err != ErrInsufficientData {
+		t.Errorf("Unmarshal(truncated) error = %v, want ErrInsufficientData", err)
+	}
+}
+
+func TestMarshal_UnknownType(t *testing.T) {
+	if got := Marshal(&BlkZone{}); got != nil {
+		t.Errorf("Marshal(unknown) = % x, want nil", got)
+	}
+	if err := Unmarshal(make([]byte, 64), &BlkZone{}); err != ErrInvalidType {
+		t.Errorf("Unmarshal(unknown) error = %v, want ErrInvalidType", err)
+	}
+}
+
+// memoryImage decodes data by copying it over v's memory, the way the kernel
+// sees the struct. Field-by-field decoding must agree with it wherever the
+// layouts are supposed to match.
+func memoryImage[T any](data []byte) T {
+	var v T
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&v)), unsafe.Sizeof(v)), data)
+	return v
+}
+
+func FuzzUnmarshalCtrlDevInfo(f *testing.F) {
+	f.Add(MarshalCtrlDevInfo(&UblksrvCtrlDevInfo{
+		NrHwQueues: 4, QueueDepth: 128, MaxIOBufBytes: 1 << 20, DevID: 3, UblksrvPID: 42, Flags: UBLK_F_CMD_IOCTL_ENCODE,
+	}))
+	f.Add(make([]byte, 80))
+	f.Add(make([]byte, 63))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var info UblksrvCtrlDevInfo
+		err := Unmarshal(data, &info)
+		if len(data) < 64 {
+			if err != ErrInsufficientData {
+				t.Fatalf("Unmarshal(%d bytes) error = %v, want ErrInsufficientData", len(data), err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		if want := memoryImage[UblksrvCtrlDevInfo](data); info != want {
+			t.Fatalf("Unmarshal() = %+v, memory layout gives %+v", info, want)
+		}
+		if got := Marshal(&info); !bytes.Equal(got, data[:64]) {
+			t.Fatalf("Marshal(Unmarshal()) = % x, want % x", got, data[:64])
+		}
+	})
+}
+
+func FuzzUnmarshalParams(f *testing.F) {
+	f.Add(Marshal(&UblkParams{
+		Types: UBLK_PARAM_TYPE_BASIC | UBLK_PARAM_TYPE_DISCARD | UBLK_PARAM_TYPE_SEGMENT,
+		Basic: UblkParamBasic{LogicalBSShift: 9, MaxSectors: 128, DevSectors: 1 << 20},
+		Seg:   UblkParamSegment{MaxSegmentSize: 65536, MaxSegments: 128},
+	}))
+	f.Add(Marshal(&UblkParams{Types: 0x3f}))
+	f.Add([]byte{8, 0, 0, 0, 0xff, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 1, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var params UblkParams
+		if err := Unmarshal(data, &params); err != nil {
+			if err != ErrInsufficientData {
+				t.Fatalf("Unmarshal() error = %v, want nil or ErrInsufficientData", err)
+			}
+			return
+		}
+		if int(params.Len) > len(data) {
+			t.Fatalf("decoded len %d exceeds %d bytes of input", params.Len, len(data))
+		}
+
+		image := memoryImage[UblkParams](data[:params.Len])
+		types := []struct {
+			name    string
+			present bool
+			got     any
+			want    any
+		}{
+			{"basic", params.HasBasic(), params.Basic, image.Basic},
+			{"discard", params.HasDiscard(), params.Discard, image.Discard},
+			{"devt", params.HasDevt(), params.Devt, image.Devt},
+			{"zoned", params.HasZoned(), params.Zoned, image.Zoned},
+			{"dma", params.HasDMAAlign(), params.DMA, image.DMA},
+			{"seg", params.HasSegment(), params.Seg, image.Seg},
+		}
+		for _, tt := range types {
+			if tt.present && tt.got != tt.want {
+				t.Errorf("%s = %+v, memory layout gives %+v", tt.name, tt.got, tt.want)
+			}
+		}
+
+		var back UblkParams
+		if err := Unmarshal(Marshal(&params), &back); err != nil {
+			t.Fatalf("Unmarshal(Marshal()) error = %v", err)
+		}
+		back.Len = params.Len
+		if back != params {
+			t.Errorf("round trip = %+v, want %+v", back, params)
+		}
+	})
+}
+
+func FuzzDescriptorOpFlags(f *testing.F) {
+	f.Add(uint32(UBLK_IO_OP_WRITE | UBLK_IO_F_FUA))
+	f.Add(uint32(UBLK_IO_OP_WRITE_ZEROES | UBLK_IO_F_NOUNMAP))
+	f.Add(^uint32(0))
+
+	f.Fuzz(func(t *testing.T, opFlags uint32) {
+		desc := UblksrvIODesc{OpFlags: opFlags}
+		if got := uint32(desc.GetOp()) | desc.GetFlags(); got != opFlags {
+			t.Errorf("GetOp() | GetFlags() = %#x, want %#x", got, opFlags)
+		}
+		if desc.GetFlags()&0xff != 0 {
+			t.Errorf("GetFlags() = %#x overlaps the op byte", desc.GetFlags())
+		}
+	})
+}
+
+func TestFeatureNames(t *testing.T) {
+	flags := uint64(UBLK_F_USER_RECOVERY|UBLK_F_URING_CMD_COMP_IN_TASK|UBLK_F_NO_AUTO_PART_SCAN) | 1<<12 | 1<<63
+	want := []string{"URING_CMD_COMP_IN_TASK", "USER_RECOVERY", "NO_AUTO_PART_SCAN", "BIT_12", "BIT_63"}
+	if got := FeatureNames(flags); !slices.Equal(got, want) {
+		t.Errorf("FeatureNames(%#x) = %q, want %q", flags, got, want)
+	}
+	if got := FeatureNames(0); got != nil {
+		t.Errorf("FeatureNames(0) = %q, want nil", got)
+	}
+}
@@ -29,8 +29,13 @@ type UblksrvCtrlCmd struct {
 	Reserved   uint32 // must be zero
 }
 
-// Compile-time size check - must be exactly 32 bytes to fit in SQE cmd area
-var _ [32]byte = [unsafe.Sizeof(UblksrvCtrlCmd{})]byte{}
+// UblksrvCtrlCmdSize is sizeof(struct ublksrv_ctrl_cmd). It is the size
+// encoded into every UBLK_U_CMD_* ioctl number and the number of bytes
+// placed in the SQE128 command area.
+const UblksrvCtrlCmdSize = 32
+
+// Compile-time size check - must match the kernel struct to fit in SQE cmd area
+var _ [UblksrvCtrlCmdSize]byte = [unsafe.Sizeof(UblksrvCtrlCmd{})]byte{}
 
 // UblksrvCtrlDevInfo contains device information
 type UblksrvCtrlDevInfo struct {
@@ -70,9 +75,10 @@ func (d *UblksrvIODesc) GetOp() uint8 {
 	return uint8(d.OpFlags & 0xff)
 }
 
-// GetFlags extracts the flags from OpFlags
+// GetFlags extracts the flags from OpFlags, in place so they can be
+// tested against the UBLK_IO_F_* constants
 func (d *UblksrvIODesc) GetFlags() uint32 {
-	return d.OpFlags >> 8
+	return d.OpFlags &^ 0xff
 }
 
 // UblksrvIOCmd is issued to ublk driver via /dev/ublkcN
@@ -86,8 +92,12 @@ type UblksrvIOCmd struct {
 	// ZoneAppendLBA uint64 // for UBLK_IO_OP_ZONE_APPEND with UBLK_F_ZONED
 }
 
+// UblksrvIOCmdSize is sizeof(struct ublksrv_io_cmd), encoded into every
+// UBLK_U_IO_* ioctl number.
+const UblksrvIOCmdSize = 16
+
 // Compile-time size check
-var _ [16]byte = [unsafe.Sizeof(UblksrvIOCmd{})]byte{}
+var _ [UblksrvIOCmdSize]byte = [unsafe.Sizeof(UblksrvIOCmd{})]byte{}
 
 // SetZoneAppendLBA sets the zone append LBA (reuses Addr field)
 func (c *UblksrvIOCmd) SetZoneAppendLBA(lba uint64) {
@@ -99,6 +109,28 @@ func (c *UblksrvIOCmd) GetZoneAppendLBA() uint64 {
 	return c.Addr
 }
 
+// BlkZone describes one zone in a REPORT_ZONES reply.
+// Layout must match Linux's struct blk_zone exactly (64 bytes); all
+// positions and lengths are in 512-byte sectors.
+type BlkZone struct {
+	Start        uint64   // zone start sector
+	Len          uint64   // zone length in sectors
+	WritePointer uint64   // zone write pointer position
+	Type         uint8    // zone type (BLK_ZONE_TYPE_*)
+	Cond         uint8    // zone condition (BLK_ZONE_COND_*)
+	NonSeq       uint8    // non-sequential write resources active
+	Reset        uint8    // reset write pointer recommended
+	Resv         [4]uint8 // reserved
+	Capacity     uint64   // zone capacity in sectors
+	Reserved     [24]uint8
+}
+
+// Compile-time size check - kernel struct is 64 bytes.
+var _ [64]byte = [unsafe.Sizeof(BlkZone{})]byte{}
+
+// BlkZoneSize is the size of one encoded struct blk_zone
+const BlkZoneSize = 64
+
 // UblkParamBasic contains basic device parameters
 type UblkParamBasic struct {
 	Attrs            uint32 // attribute flags (UBLK_ATTR_*)
@@ -138,14 +170,31 @@ type UblkParamZoned struct {
 	Reserved             [20]uint8 // reserved for future use
 }
 
+// UblkParamDMAAlign contains the DMA alignment required of I/O buffers
+type UblkParamDMAAlign struct {
+	Alignment uint32   // buffer address alignment mask
+	Pad       [4]uint8 // padding
+}
+
+// UblkParamSegment contains scatter/gather limits (Linux 6.15+). The
+// kernel's behavior is undefined if any of the three limits is 0.
+type UblkParamSegment struct {
+	SegBoundaryMask uint64   // segments may not cross a (mask+1) boundary
+	MaxSegmentSize  uint32   // max bytes per segment
+	MaxSegments     uint16   // max segments per request
+	Pad             [2]uint8 // padding
+}
+
 // UblkParams contains all device parameters
 type UblkParams struct {
-	Len     uint32           // total length of parameters
-	Types   uint32           // types of parameters included (UBLK_PARAM_TYPE_*)
-	Basic   UblkParamBasic   // basic parameters
-	Discard UblkParamDiscard // discard parameters
-	Devt    UblkParamDevt    // device numbers (read-only)
-	Zoned   UblkParamZoned   // zoned device parameters
+	Len     uint32            // total length of parameters
+	Types   uint32            // types of parameters included (UBLK_PARAM_TYPE_*)
+	Basic   UblkParamBasic    // basic parameters
+	Discard UblkParamDiscard  // discard parameters
+	Devt    UblkParamDevt     // device numbers (read-only)
+	Zoned   UblkParamZoned    // zoned device parameters
+	DMA     UblkParamDMAAlign // DMA alignment
+	Seg     UblkParamSegment  // segment limits
 }
 
 // Helper methods for UblkParams
@@ -170,6 +219,16 @@ func (p *UblkParams) HasZoned() bool {
 	return (p.Types & UBLK_PARAM_TYPE_ZONED) != 0
 }
 
+// HasDMAAlign returns true if DMA alignment parameters are included
+func (p *UblkParams) HasDMAAlign() bool {
+	return (p.Types & UBLK_PARAM_TYPE_DMA_ALIGN) != 0
+}
+
+// HasSegment returns true if segment parameters are included
+func (p *UblkParams) HasSegment() bool {
+	return (p.Types & UBLK_PARAM_TYPE_SEGMENT) != 0
+}
+
 // SetBasic enables basic parameters
 func (p *UblkParams) SetBasic() {
 	p.Types |= UBLK_PARAM_TYPE_BASIC
@@ -190,6 +249,16 @@ func (p *UblkParams) SetZoned() {
 	p.Types |= UBLK_PARAM_TYPE_ZONED
 }
 
+// SetDMAAlign enables DMA alignment parameters
+func (p *UblkParams) SetDMAAlign() {
+	p.Types |= UBLK_PARAM_TYPE_DMA_ALIGN
+}
+
+// SetSegment enables segment parameters
+func (p *UblkParams) SetSegment() {
+	p.Types |= UBLK_PARAM_TYPE_SEGMENT
+}
+
 // Device file paths
 const (
 	UBLK_CONTROL_DEV = "/dev/ublk-control"
@@ -0,0 +1,58 @@
+package uring
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// asyncPollInterval is how often Wait polls a handle that cannot block:
+// it balances responsiveness with CPU overhead.
+const asyncPollInterval = 10 * time.Millisecond
+
+// AsyncHandle represents a pending io_uring operation
+type AsyncHandle struct {
+	poll func() (Result, error)
+	// block waits until a completion may have been posted or timeout
+	// passes; nil to sleep between polls instead
+	block func(timeout time.Duration)
+}
+
+// NewAsyncHandle returns a handle whose Wait calls poll until it returns
+// the operation's result rather than an error. Ring implementations
+// outside this package use it for SubmitCtrlCmdAsync.
+func NewAsyncHandle(poll func() (Result, error)) *AsyncHandle {
+	return &AsyncHandle{poll: poll}
+}
+
+// Wait returns the operation's result, or an error once timeout passes
+// without it. Handles from this package's rings block in io_uring_enter
+// until a completion arrives; others are polled every asyncPollInterval.
+func (h *AsyncHandle) Wait(timeout time.Duration) (Result, error) {
+	logger := logging.For(logging.ComponentUring)
+	logger.Debug("waiting for completion", "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+
+	attempts := 0
+	for {
+		attempts++
+		result, err := h.poll()
+		if err == nil {
+			logger.Debug("found completion", "attempts", attempts, "result", result.Value())
+			return result, nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		if h.block != nil {
+			h.block(remaining)
+		} else {
+			time.Sleep(min(asyncPollInterval, remaining))
+		}
+	}
+
+	logger.Debug("timeout waiting for completion", "attempts", attempts)
+	return nil, fmt.Errorf("timeout waiting for completion after %d attempts", attempts)
+}
@@ -1,20 +1,28 @@
+//go:build !arm64
+
 package uring
 
 import "sync/atomic"
 
-// barrierDummy is used for atomic operations that provide memory barrier semantics.
-// On x86-64, atomic.AddInt64 compiles to LOCK XADD which has full fence semantics.
+// The ring itself needs no explicit fences: the SQ and CQ indices are read
+// and written with sync/atomic, whose loads and stores are acquire and
+// release on every architecture Go supports, which is exactly the ordering
+// io_uring asks of userspace. Sfence and Mfence are for ordering plain
+// accesses to memory shared with the kernel that no index guards.
+//
+// On arm64 they are DMB instructions (barrier_arm64.s). Elsewhere they are
+// a locked read-modify-write, which Go's memory model makes sequentially
+// consistent; on x86-64 that is LOCK XADD, a full fence.
+
+// barrierDummy is the target of the read-modify-write.
 var barrierDummy int64
 
-// Sfence issues a store fence equivalent.
-// atomic.AddInt64 with 0 compiles to LOCK XADD on x86-64, which provides
-// full memory fence semantics with no contention and minimal overhead (~20 cycles).
+// Sfence orders earlier stores before later stores.
 func Sfence() {
 	atomic.AddInt64(&barrierDummy, 0)
 }
 
-// Mfence issues a full memory fence equivalent.
-// Same implementation as Sfence - LOCK XADD provides full fence on x86-64.
+// Mfence orders earlier loads and stores before later loads and stores.
 func Mfence() {
 	atomic.AddInt64(&barrierDummy, 0)
 }
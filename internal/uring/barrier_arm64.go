@@ -0,0 +1,13 @@
+package uring
+
+// An atomic read-modify-write is not a full fence on arm64: without LSE it
+// is a load-acquire/store-release exclusive pair, which lets a later plain
+// load be satisfied before the store. The fences are DMB instructions
+// instead, as in the kernel's smp_wmb and smp_mb (see barrier.go).
+
+// Sfence orders earlier stores before later stores (DMB ISHST).
+func Sfence()
+
+// Mfence orders earlier loads and stores before later loads and stores
+// (DMB ISH).
+func Mfence()
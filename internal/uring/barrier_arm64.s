@@ -0,0 +1,11 @@
+#include "textflag.h"
+
+// func Sfence()
+TEXT ·Sfence(SB), NOSPLIT|NOFRAME, $0-0
+	DMB	$0xa // ISHST
+	RET
+
+// func Mfence()
+TEXT ·Mfence(SB), NOSPLIT|NOFRAME, $0-0
+	DMB	$0xb // ISH
+	RET
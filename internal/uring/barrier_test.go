@@ -0,0 +1,46 @@
+package uring
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestFences passes messages between goroutines with the fences around
+// the flag, so the arm64 assembly is linked and run on whichever CPUs the
+// goroutines land on. The waits yield, so the test also runs with one CPU.
+func TestFences(t *testing.T) {
+	const rounds = 1000
+	var data, flag, ack atomic.Uint64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(1); i <= rounds; i++ {
+			for ack.Load() != i-1 {
+				runtime.Gosched()
+			}
+			data.Store(i)
+			Sfence()
+			flag.Store(i)
+		}
+	}()
+	for i := uint64(1); i <= rounds; i++ {
+		for flag.Load() != i {
+			runtime.Gosched()
+		}
+		Mfence()
+		if got := data.Load(); got != i {
+			t.Fatalf("round %d read data %d", i, got)
+		}
+		ack.Store(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkMfence(b *testing.B) {
+	for b.Loop() {
+		Mfence()
+	}
+}
@@ -0,0 +1,70 @@
+package uring
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ResultError is the error of a ublk command whose completion carried a
+// negative result. It wraps the errno, so errors.Is(err, syscall.ENODEV)
+// works, and its message names the errno and, where it is known, what the
+// errno means for the command.
+type ResultError struct {
+	Op    string // The command, e.g. "START_DEV"; "" if unknown
+	Errno syscall.Errno
+}
+
+// NewResultError returns the error for a completion of op with the
+// negative result res.
+func NewResultError(op string, res int32) *ResultError {
+	return &ResultError{Op: op, Errno: syscall.Errno(-res)}
+}
+
+func (e *ResultError) Error() string {
+	op := e.Op
+	if op == "" {
+		op = "operation"
+	}
+	msg := fmt.Sprintf("%s failed: %s (%v)", op, ErrnoName(e.Errno), e.Errno)
+	if hint := resultHint(e.Op, e.Errno); hint != "" {
+		msg += ": " + hint
+	}
+	return msg
+}
+
+func (e *ResultError) Unwrap() error {
+	return e.Errno
+}
+
+// resultHint explains what errno means for a ublk command op, where that
+// is not plain from the errno's own description.
+func resultHint(op string, errno syscall.Errno) string {
+	queueOp := op == "FETCH_REQ" || op == "COMMIT_AND_FETCH_REQ"
+	switch errno {
+	case syscall.ENODEV:
+		if queueOp {
+			return "the kernel aborted the queue; the device is stopping or was deleted"
+		}
+		return "no such ublk device"
+	case syscall.EOPNOTSUPP:
+		return "not supported by this kernel's ublk driver"
+	case syscall.EEXIST:
+		if op == "ADD_DEV" {
+			return "the device ID is in use"
+		}
+	case syscall.EBUSY:
+		if op == "START_DEV" || op == "END_USER_RECOVERY" {
+			return "the device is busy, e.g. still being set up; the command may be retried"
+		}
+		if queueOp {
+			return "the tag already has a command in the kernel"
+		}
+	case syscall.EPERM, syscall.EACCES:
+		return "needs CAP_SYS_ADMIN, or an unprivileged device owned by the caller"
+	case syscall.EINVAL:
+		if !queueOp {
+			return "the kernel rejected the parameters, or the device's state does not allow the command"
+		}
+	}
+	return ""
+}
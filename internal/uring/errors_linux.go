@@ -0,0 +1,17 @@
+package uring
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrnoName returns the symbolic name of errno, such as "ENODEV", or its
+// number if it has none.
+func ErrnoName(errno syscall.Errno) string {
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+	return fmt.Sprintf("errno %d", int(errno))
+}
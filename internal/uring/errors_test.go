@@ -0,0 +1,31 @@
+package uring
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestResultError(t *testing.T) {
+	tests := []struct {
+		op   string
+		res  int32
+		want string
+	}{
+		{"ADD_DEV", -int32(syscall.EEXIST), "ADD_DEV failed: EEXIST (file exists): the device ID is in use"},
+		{"COMMIT_AND_FETCH_REQ", -int32(syscall.ENODEV), "COMMIT_AND_FETCH_REQ failed: ENODEV (no such device): " +
+			"the kernel aborted the queue; the device is stopping or was deleted"},
+		{"GET_PARAMS", -int32(syscall.ENODEV), "GET_PARAMS failed: ENODEV (no such device): no such ublk device"},
+		{"", -int32(syscall.EIO), "operation failed: EIO (input/output error)"},
+		{"", -4096, "operation failed: errno 4096 (errno 4096)"},
+	}
+	for _, tt := range tests {
+		err := NewResultError(tt.op, tt.res)
+		if got := err.Error(); got != tt.want {
+			t.Errorf("NewResultError(%q, %d) = %q, want %q", tt.op, tt.res, got, tt.want)
+		}
+		if !errors.Is(err, syscall.Errno(-tt.res)) {
+			t.Errorf("NewResultError(%q, %d) does not wrap its errno", tt.op, tt.res)
+		}
+	}
+}
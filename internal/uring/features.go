@@ -0,0 +1,74 @@
+package uring
+
+import (
+	"errors"
+	"sync"
+)
+
+const (
+	IORING_SETUP_SQPOLL        = 1 << 1
+	IORING_SETUP_CQSIZE        = 1 << 3  // cq_entries sizes the CQ
+	IORING_SETUP_ATTACH_WQ     = 1 << 5  // share the async workers of the ring at wq_fd
+	IORING_SETUP_R_DISABLED    = 1 << 6  // created disabled until IORING_REGISTER_ENABLE_RINGS
+	IORING_SETUP_COOP_TASKRUN  = 1 << 8  // no IPI to run completions (Linux 5.19+)
+	IORING_SETUP_SINGLE_ISSUER = 1 << 12 // one task submits (Linux 6.0+)
+	IORING_SETUP_DEFER_TASKRUN = 1 << 13 // completions run only when the issuer waits (Linux 6.1+)
+)
+
+// Features describes available io_uring features
+type Features struct {
+	SQE128       bool // 128-byte SQEs supported
+	CQE32        bool // 32-byte CQEs supported
+	UringCmd     bool // URING_CMD operation supported
+	SQPOLL       bool // Kernel-side polling supported (and permitted)
+	CoopTaskrun  bool // IORING_SETUP_COOP_TASKRUN supported
+	SingleIssuer bool // IORING_SETUP_SINGLE_ISSUER supported
+	DeferTaskrun bool // IORING_SETUP_DEFER_TASKRUN supported
+}
+
+// singleIssuerFlags returns the setup flags for a ring used from one
+// thread: as many of SINGLE_ISSUER, COOP_TASKRUN and DEFER_TASKRUN as the
+// kernel supports. The ring starts disabled so the thread that enables it,
+// rather than the one that creates it, becomes the issuer.
+func (f Features) singleIssuerFlags() uint32 {
+	var flags uint32
+	if f.CoopTaskrun {
+		flags |= IORING_SETUP_COOP_TASKRUN
+	}
+	if f.SingleIssuer {
+		flags |= IORING_SETUP_SINGLE_ISSUER | IORING_SETUP_R_DISABLED
+		if f.DeferTaskrun {
+			flags |= IORING_SETUP_DEFER_TASKRUN
+		}
+	}
+	return flags
+}
+
+// probeFeatures is evaluated once per process; the answer cannot change
+// without a reboot or sysctl change.
+var probeFeatures = sync.OnceValues(detectFeatures)
+
+// GetFeatures probes the running kernel by creating throwaway rings with
+// each setup flag and querying IORING_REGISTER_PROBE. It returns an error
+// only if io_uring itself is unusable.
+func GetFeatures() (Features, error) {
+	return probeFeatures()
+}
+
+// SupportsFeatures checks if the kernel supports required features for ublk.
+// The returned error explains what is missing and how to fix it.
+func SupportsFeatures() error {
+	f, err := GetFeatures()
+	if err != nil {
+		return err
+	}
+	switch {
+	case !f.SQE128:
+		return errors.New("io_uring does not support IORING_SETUP_SQE128 (requires Linux 5.19+)")
+	case !f.CQE32:
+		return errors.New("io_uring does not support IORING_SETUP_CQE32 (requires Linux 5.19+)")
+	case !f.UringCmd:
+		return ErrUringCmdUnsupported
+	}
+	return nil
+}
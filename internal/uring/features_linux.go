@@ -0,0 +1,64 @@
+package uring
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func detectFeatures() (Features, error) {
+	var f Features
+
+	fd, errno := setupProbeRing(0)
+	if errno != 0 {
+		return f, setupError(errno)
+	}
+	probe, err := probeOps(fd)
+	syscall.Close(fd)
+	if err != nil {
+		return f, err
+	}
+	f.UringCmd = probe.supports(IORING_OP_URING_CMD)
+
+	f.SQE128 = trySetupFlags(IORING_SETUP_SQE128)
+	f.CQE32 = trySetupFlags(IORING_SETUP_CQE32)
+	f.SQPOLL = trySetupFlags(IORING_SETUP_SQPOLL)
+	f.CoopTaskrun = trySetupFlags(IORING_SETUP_COOP_TASKRUN)
+	f.SingleIssuer = trySetupFlags(IORING_SETUP_SINGLE_ISSUER)
+	f.DeferTaskrun = f.SingleIssuer && trySetupFlags(IORING_SETUP_SINGLE_ISSUER|IORING_SETUP_DEFER_TASKRUN)
+	return f, nil
+}
+
+// trySetupFlags reports whether io_uring_setup accepts flags.
+func trySetupFlags(flags uint32) bool {
+	fd, errno := setupProbeRing(flags)
+	if errno != 0 {
+		return false
+	}
+	syscall.Close(fd)
+	return true
+}
+
+// setupProbeRing creates a single-entry ring with the given setup flags.
+func setupProbeRing(flags uint32) (int, syscall.Errno) {
+	params := io_uring_params{flags: flags}
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, 1, uintptr(unsafe.Pointer(&params)), 0)
+	return int(fd), errno
+}
+
+// setupError turns an io_uring_setup failure into an actionable error.
+func setupError(errno syscall.Errno) error {
+	switch errno {
+	case syscall.ENOSYS:
+		return fmt.Errorf("io_uring is not available: kernel built without CONFIG_IO_URING: %w", errno)
+	case syscall.EPERM:
+		return fmt.Errorf("io_uring is disabled for this process: check the kernel.io_uring_disabled sysctl: %w", errno)
+	case syscall.EMFILE, syscall.ENFILE:
+		return fmt.Errorf("io_uring_setup: out of file descriptors: %w", errno)
+	case syscall.ENOMEM:
+		return fmt.Errorf("io_uring_setup: out of memory, check RLIMIT_MEMLOCK: %w", errno)
+	}
+	return fmt.Errorf("io_uring_setup failed: %w", errno)
+}
@@ -4,7 +4,6 @@ package uring
 import (
 	"errors"
 
-	"github.com/ehrlich-b/go-ublk/internal/logging"
 	"github.com/ehrlich-b/go-ublk/internal/uapi"
 )
 
@@ -13,21 +12,13 @@ import (
 // guarantees at most depth in-flight operations.
 var ErrRingFull = errors.New("submission queue full")
 
-// Ring provides the interface for io_uring operations needed by ublk
-type Ring interface {
+// QueueRing is the part of a ring a queue loop uses: batched ublk I/O
+// commands, a wakeup poll and completions. It is all an alternative ring
+// implementation needs to provide.
+type QueueRing interface {
 	// Close closes the ring and releases resources
 	Close() error
 
-	// SubmitCtrlCmd submits a control command and returns the result
-	SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (Result, error)
-
-	// SubmitCtrlCmdAsync submits a control command without waiting for completion
-	SubmitCtrlCmdAsync(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (*AsyncHandle, error)
-
-	// SubmitIOCmd submits an I/O command and returns the result.
-	// This is a convenience method that calls PrepareIOCmd + FlushSubmissions.
-	SubmitIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData uint64) (Result, error)
-
 	// PrepareIOCmd prepares an I/O command SQE without submitting to the kernel.
 	// The SQE is written to ring memory but not visible to the kernel until
 	// FlushSubmissions is called. This enables batching multiple I/O commands
@@ -35,6 +26,11 @@ type Ring interface {
 	// Returns ErrRingFull if the submission queue is full.
 	PrepareIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData uint64) error
 
+	// PreparePollAdd prepares a one-shot poll for POLLIN on fd. Its
+	// completion carries userData. Like PrepareIOCmd, it is only submitted
+	// by the next FlushSubmissions.
+	PreparePollAdd(fd int32, userData uint64) error
+
 	// FlushSubmissions submits all prepared SQEs with a single io_uring_enter syscall.
 	// Returns the number of SQEs submitted.
 	FlushSubmissions() (uint32, error)
@@ -42,6 +38,83 @@ type Ring interface {
 	// WaitForCompletion waits for completion events and returns them
 	WaitForCompletion(timeout int) ([]Result, error)
 
+	// Enable starts a ring created with Config.SingleIssuer and makes the
+	// calling thread its only submitter; it must be called, from a thread
+	// locked with runtime.LockOSThread, before anything is submitted. It
+	// also applies Config.IOWQ for the calling thread, which should be the
+	// one that submits.
+	Enable() error
+}
+
+// OverflowCounter is implemented by rings that count CQ overflows: how
+// many times completions did not fit in the CQ and were collected from the
+// kernel's backlog. CQOverflows must be safe to call from any goroutine.
+type OverflowCounter interface {
+	CQOverflows() uint64
+}
+
+// ParamsReporter is implemented by rings that can report how the kernel
+// set them up. Params must be safe to call from any goroutine.
+type ParamsReporter interface {
+	Params() Params
+}
+
+// StatsReporter is implemented by rings that count their traffic.
+// RingStats must be safe to call from any goroutine.
+type StatsReporter interface {
+	RingStats() RingStats
+}
+
+// RingStats counts a ring's traffic since it was created.
+type RingStats struct {
+	Enters      uint64 // io_uring_enter calls
+	Submitted   uint64 // SQEs the kernel consumed in those calls
+	Reaps       uint64 // Times posted CQEs were collected
+	Completions uint64 // CQEs collected
+	SQFull      uint64 // SQEs refused with ErrRingFull
+	PeakSQ      uint32 // Most SQEs handed to one io_uring_enter
+	PeakCQ      uint32 // Most CQEs found posted at once
+}
+
+// SubmitsPerEnter is the mean number of SQEs each io_uring_enter
+// submitted; higher means better batching.
+func (s RingStats) SubmitsPerEnter() float64 {
+	if s.Enters == 0 {
+		return 0
+	}
+	return float64(s.Submitted) / float64(s.Enters)
+}
+
+// CQEsPerReap is the mean number of CQEs collected together.
+func (s RingStats) CQEsPerReap() float64 {
+	if s.Reaps == 0 {
+		return 0
+	}
+	return float64(s.Completions) / float64(s.Reaps)
+}
+
+// Params are a ring's setup parameters as io_uring_setup returned them.
+type Params struct {
+	SQEntries uint32 // Submission queue entries, after the kernel's rounding
+	CQEntries uint32 // Completion queue entries
+	Flags     uint32 // IORING_SETUP_* flags
+	Features  uint32 // IORING_FEAT_* flags the kernel reported
+}
+
+// Ring provides the interface for io_uring operations needed by ublk
+type Ring interface {
+	QueueRing
+
+	// SubmitCtrlCmd submits a control command and returns the result
+	SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (Result, error)
+
+	// SubmitCtrlCmdAsync submits a control command without waiting for completion
+	SubmitCtrlCmdAsync(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (*AsyncHandle, error)
+
+	// SubmitIOCmd submits an I/O command and returns the result.
+	// This is a convenience method that calls PrepareIOCmd + FlushSubmissions.
+	SubmitIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData uint64) (Result, error)
+
 	// NewBatch creates a new batch for bulk operations
 	NewBatch() Batch
 }
@@ -73,50 +146,48 @@ type Result interface {
 	Error() error
 }
 
-// Features describes available io_uring features
-type Features struct {
-	SQE128   bool // 128-byte SQEs supported
-	CQE32    bool // 32-byte CQEs supported
-	UringCmd bool // URING_CMD operation supported
-	SQPOLL   bool // Kernel-side polling supported
-}
-
-// SupportsFeatures checks if the kernel supports required features for ublk
-func SupportsFeatures() error {
-	// This would be implemented by concrete types
-	// For now, assume features are available if we're on Linux 6.1+
-	return nil
-}
-
-// GetFeatures returns information about supported features
-func GetFeatures() (Features, error) {
-	// This would probe actual kernel capabilities
-	return Features{
-		SQE128:   true,
-		CQE32:    true,
-		UringCmd: true,
-		SQPOLL:   false, // Assume not available by default
-	}, nil
-}
-
 // Config contains configuration for creating a ring
 type Config struct {
 	Entries uint32 // Number of entries in the ring
 	FD      int32  // File descriptor for operations
 	Flags   uint32 // Additional flags
-}
 
-// NewRing creates a new Ring implementation using pure Go io_uring
-func NewRing(config Config) (Ring, error) {
-	logger := logging.Default()
-	logger.Debug("creating io_uring", "entries", config.Entries, "fd", config.FD)
-
-	ring, err := NewMinimalRing(config.Entries, config.FD)
-	if err != nil {
-		logger.Error("failed to create io_uring", "error", err)
-		return nil, err
-	}
+	// CQEntries sizes the completion queue (0 = twice Entries). A ring
+	// that can have more requests in the kernel than its CQ holds may
+	// overflow it; the kernel then keeps the extra completions until they
+	// are collected (see OverflowCounter), which costs a syscall.
+	CQEntries uint32
+
+	// SingleIssuer promises that one OS thread submits to and reaps the
+	// ring, letting the kernel skip locking and cross-CPU wakeups
+	// (SINGLE_ISSUER, COOP_TASKRUN and DEFER_TASKRUN where supported). The
+	// ring starts disabled until that thread calls Enable.
+	SingleIssuer bool
+
+	// IOWQ limits the kernel worker threads serving the ring's requests
+	// that cannot complete inline. It is applied by Enable.
+	IOWQ IOWQConfig
+
+	// AttachWQ, if set, is a ring whose async workers this one shares
+	// (IORING_SETUP_ATTACH_WQ) rather than having its own. It must stay
+	// open until this ring is created. Rings this package did not create
+	// cannot be attached to and are ignored, as is an attachment the
+	// kernel refuses.
+	AttachWQ QueueRing
+}
 
-	logger.Info("created io_uring", "entries", config.Entries)
-	return ring, nil
+// IOWQConfig limits a ring's async worker pool (io-wq). The kernel keeps
+// one pool per submitting thread and starts a worker (iou-wrk) for each
+// request that must block, so on a big machine a busy ring can spawn
+// hundreds of them. The zero value leaves the kernel defaults.
+type IOWQConfig struct {
+	// MaxBounded caps workers for bounded work such as regular file and
+	// block I/O (kernel default: one per CPU), MaxUnbounded those for
+	// work that may block indefinitely, such as sockets and commands like
+	// URING_CMD (default: RLIMIT_NPROC). 0 leaves a limit unchanged.
+	MaxBounded   uint32
+	MaxUnbounded uint32
+
+	// CPUs restricts the workers to these CPUs (nil = any).
+	CPUs []int
 }
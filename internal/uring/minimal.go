@@ -1,3 +1,5 @@
+//go:build linux
+
 // Package uring provides minimal URING_CMD implementation for ublk control operations
 package uring
 
@@ -21,6 +23,17 @@ const (
 	IORING_SETUP_SQE128 = 1 << 10
 	IORING_SETUP_CQE32  = 1 << 11
 
+	// IORING_OP_NOP completes at once without doing anything.
+	IORING_OP_NOP = 0
+
+	// IORING_OP_POLL_ADD completes once the target fd reports the requested
+	// poll events (one-shot).
+	IORING_OP_POLL_ADD = 6
+
+	// IORING_SQ_CQ_OVERFLOW is set in the SQ ring flags while the kernel
+	// holds completions that did not fit in the CQ.
+	IORING_SQ_CQ_OVERFLOW = 1 << 1
+
 	// io_uring mmap offsets
 	IORING_OFF_SQ_RING = 0
 	IORING_OFF_CQ_RING = 0x8000000
@@ -55,6 +68,13 @@ type sqe128 struct {
 	cmd [80]byte // 48..127
 }
 
+// Compile-time layout checks: the cmd area starts at byte 48 and must hold
+// the larger of the two ublk command payloads.
+var (
+	_ [48]byte = [unsafe.Offsetof(sqe128{}.cmd)]byte{}
+	_ [len(sqe128{}.cmd) - uapi.UblksrvCtrlCmdSize]byte
+)
+
 // setCmdOp sets the cmd_op field in the union AND ensures the adjacent pad is zero
 func (sqe *sqe128) setCmdOp(cmdOp uint32) {
 	// cmd_op is at bytes 8-11
@@ -71,42 +91,6 @@ type cqe32 struct {
 	bigCQE   [16]uint8 // Extra data for CQE32
 }
 
-// AsyncHandle represents a pending io_uring operation
-type AsyncHandle struct {
-	userData uint64
-	ring     *minimalRing
-}
-
-// Wait polls for completion of async operation
-func (h *AsyncHandle) Wait(timeout time.Duration) (Result, error) {
-	logger := logging.Default()
-	logger.Debug("waiting for completion", "userData", h.userData, "timeout", timeout)
-	deadline := time.Now().Add(timeout)
-
-	attempts := 0
-	for time.Now().Before(deadline) {
-		attempts++
-		// Try to get completion without blocking
-		result, err := h.ring.tryGetCompletion(h.userData)
-		if err == nil {
-			logger.Debug("found completion", "attempts", attempts, "result", result.Value())
-			return result, nil
-		}
-
-		// Log every 100 attempts (1 second)
-		if attempts%100 == 0 {
-			logger.Debug("still waiting for completion", "attempts", attempts, "error", err.Error())
-		}
-
-		// Not ready yet, sleep briefly.
-		// 10ms balances responsiveness with CPU overhead for async polling.
-		time.Sleep(10 * time.Millisecond)
-	}
-
-	logger.Debug("timeout waiting for completion", "attempts", attempts)
-	return nil, fmt.Errorf("timeout waiting for completion after %d attempts", attempts)
-}
-
 // Minimal ring structures
 type io_uring_params struct {
 	sqEntries    uint32
@@ -150,6 +134,17 @@ type minimalRing struct {
 	cqAddr   unsafe.Pointer // CQ ring mapping base
 	sqesAddr unsafe.Pointer // SQEs mapping base
 
+	// Shared ring indices, cached from params offsets. See the memory
+	// ordering notes above prepareSQE for how each one is accessed.
+	sqHead  *uint32 // advanced by the kernel
+	sqTail  *uint32 // advanced by us
+	sqFlags *uint32 // set by the kernel (IORING_SQ_*)
+	cqHead  *uint32 // advanced by us
+	cqTail  *uint32 // advanced by the kernel
+
+	cqOverflows atomic.Uint64 // times completions overflowed the CQ; see flushOverflow
+	stats       ringCounters  // see RingStats
+
 	// Pre-allocated fields to avoid hot path allocations
 	sqePool      sqe128          // Reusable SQE (submissions are sequential per ring)
 	resultsPool  []Result        // Reusable results slice
@@ -161,17 +156,63 @@ type minimalRing struct {
 	// The kernel only sees submissions when we store sqTailLocal to the shared tail.
 	// This enables batching multiple SQEs into a single io_uring_enter syscall.
 	sqTailLocal uint32
+
+	enabled bool       // Enable has run
+	iowq    IOWQConfig // applied by Enable
 }
 
-// kernelUringCmdOpcode returns the runtime kernel's IORING_OP_URING_CMD
-// value when built with cgo on Linux. On non-cgo builds, a reasonable
-// fallback is used. See kernelopcode_linux.go and kernelopcode_stub.go.
-// kernelUringCmdOpcode provided by platform-specific files
+// NewRing creates a new Ring implementation using pure Go io_uring
+func NewRing(config Config) (Ring, error) {
+	logger := logging.For(logging.ComponentUring)
+	logger.Debug("creating io_uring", "entries", config.Entries, "fd", config.FD)
+
+	if err := SupportsFeatures(); err != nil {
+		logger.Error("io_uring prerequisites missing", "error", err)
+		return nil, err
+	}
+
+	flags := config.Flags
+	if config.SingleIssuer {
+		f, _ := GetFeatures() // Cached; SupportsFeatures succeeded
+		flags |= f.singleIssuerFlags()
+	}
+
+	if config.CQEntries > 0 {
+		flags |= IORING_SETUP_CQSIZE
+	}
+
+	wqFd := -1
+	if anchor, ok := config.AttachWQ.(*minimalRing); ok {
+		flags |= IORING_SETUP_ATTACH_WQ
+		wqFd = anchor.ringFd
+	}
+
+	ring, err := newMinimalRing(config.Entries, config.CQEntries, config.FD, flags, wqFd)
+	if err != nil {
+		logger.Error("failed to create io_uring", "error", err)
+		return nil, err
+	}
+	ring.(*minimalRing).iowq = config.IOWQ
+
+	logger.Info("created io_uring", "entries", config.Entries)
+	return ring, nil
+}
 
 // NewMinimalRing creates a minimal io_uring for ublk control operations
 func NewMinimalRing(entries uint32, ctrlFd int32) (Ring, error) {
-	logger := logging.Default()
-	logger.Debug("creating minimal io_uring", "entries", entries, "ctrl_fd", ctrlFd)
+	return newMinimalRing(entries, 0, ctrlFd, 0, -1)
+}
+
+// newMinimalRing creates a ring with extra setup flags on top of
+// SQE128|CQE32. If the kernel rejects them, it falls back to the base
+// flags rather than failing, after first trying without just
+// IORING_SETUP_ATTACH_WQ. cqEntries sizes the CQ if the flags include
+// IORING_SETUP_CQSIZE; otherwise the kernel makes it twice entries. wqFd
+// is the ring to attach to with IORING_SETUP_ATTACH_WQ.
+func newMinimalRing(entries, cqEntries uint32, ctrlFd int32, extraFlags uint32, wqFd int) (Ring, error) {
+	logger := logging.For(logging.ComponentUring)
+	logger.Debug("creating minimal io_uring",
+		"entries", entries, "ctrl_fd", ctrlFd, "extra_flags", fmt.Sprintf("0x%x", extraFlags))
 
 	// Verify SQE structure size is exactly 128 bytes
 	sqeSize := unsafe.Sizeof(sqe128{})
@@ -184,8 +225,11 @@ func NewMinimalRing(entries uint32, ctrlFd int32) (Ring, error) {
 	// Note: Some kernels may require both flags for URING_CMD operations
 	params := io_uring_params{
 		sqEntries: entries,
-		cqEntries: entries * 2, // Usually CQ is 2x SQ size
-		flags:     IORING_SETUP_SQE128 | IORING_SETUP_CQE32,
+		cqEntries: cqEntries,
+		flags:     IORING_SETUP_SQE128 | IORING_SETUP_CQE32 | extraFlags,
+	}
+	if extraFlags&IORING_SETUP_ATTACH_WQ != 0 {
+		params.wqFd = uint32(wqFd)
 	}
 
 	logger.Debug("calling io_uring_setup", "flags", fmt.Sprintf("0x%x", params.flags))
@@ -195,6 +239,14 @@ func NewMinimalRing(entries uint32, ctrlFd int32) (Ring, error) {
 		uintptr(entries),
 		uintptr(unsafe.Pointer(&params)),
 		0)
+	if errno != 0 && extraFlags&IORING_SETUP_ATTACH_WQ != 0 {
+		logger.Debug("io_uring_setup rejected ATTACH_WQ, retrying without", "wq_fd", wqFd, "errno", errno)
+		return newMinimalRing(entries, cqEntries, ctrlFd, extraFlags&^IORING_SETUP_ATTACH_WQ, -1)
+	}
+	if errno == syscall.EINVAL && extraFlags != 0 {
+		logger.Debug("io_uring_setup rejected extra flags, retrying without", "flags", fmt.Sprintf("0x%x", extraFlags))
+		return newMinimalRing(entries, 0, ctrlFd, 0, -1)
+	}
 	if errno != 0 {
 		logger.Error("io_uring_setup failed", "errno", errno)
 		return nil, fmt.Errorf("io_uring_setup failed: %v", errno)
@@ -210,6 +262,11 @@ func NewMinimalRing(entries uint32, ctrlFd int32) (Ring, error) {
 	}
 	logger.Debug("Kernel accepted SQE128 flag", "params.flags", fmt.Sprintf("0x%x", params.flags))
 
+	if err := verifyUringCmd(int(ringFd)); err != nil {
+		syscall.Close(int(ringFd))
+		return nil, err
+	}
+
 	// Map SQ ring
 	sqSize := params.sqOff.array + params.sqEntries*4
 	sqAddr, err := unix.Mmap(int(ringFd), IORING_OFF_SQ_RING, int(sqSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
@@ -254,10 +311,15 @@ func NewMinimalRing(entries uint32, ctrlFd int32) (Ring, error) {
 		cqePool:     make([]minimalResult, cqePoolSize),
 	}
 
+	r.sqHead = (*uint32)(unsafe.Add(r.sqAddr, params.sqOff.head))
+	r.sqTail = (*uint32)(unsafe.Add(r.sqAddr, params.sqOff.tail))
+	r.sqFlags = (*uint32)(unsafe.Add(r.sqAddr, params.sqOff.flags))
+	r.cqHead = (*uint32)(unsafe.Add(r.cqAddr, params.cqOff.head))
+	r.cqTail = (*uint32)(unsafe.Add(r.cqAddr, params.cqOff.tail))
+
 	// Initialize sqTailLocal from the shared tail pointer.
 	// At ring creation, shared tail is 0, so sqTailLocal starts at 0.
-	sqTail := (*uint32)(unsafe.Add(r.sqAddr, params.sqOff.tail))
-	r.sqTailLocal = atomic.LoadUint32(sqTail)
+	r.sqTailLocal = atomic.LoadUint32(r.sqTail)
 
 	// Register the char device FD with io_uring (like C code does)
 	// Required for queue operations
@@ -276,7 +338,7 @@ func NewMinimalRing(entries uint32, ctrlFd int32) (Ring, error) {
 
 // SubmitCtrlCmdAsync submits command without waiting
 func (r *minimalRing) SubmitCtrlCmdAsync(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (*AsyncHandle, error) {
-	logger := logging.Default()
+	logger := logging.For(logging.ComponentUring)
 	logger.Debug("submitting async ctrl command", "cmd_hex", fmt.Sprintf("0x%08x", cmd), "dev_id", ctrlCmd.DevID)
 
 	// Create URING_CMD SQE for control operations (same as synchronous version)
@@ -292,7 +354,7 @@ func (r *minimalRing) SubmitCtrlCmdAsync(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCm
 	}
 
 	// Set the base SQE fields
-	sqe.opcode = kernelUringCmdOpcode()
+	sqe.opcode = IORING_OP_URING_CMD
 	sqe.flags = 0
 	sqe.ioprio = 0
 	sqe.fd = int32(r.targetFd)
@@ -307,79 +369,77 @@ func (r *minimalRing) SubmitCtrlCmdAsync(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCm
 
 	// Marshal and place control command
 	ctrlCmdBytes := uapi.Marshal(ctrlCmd)
-	if len(ctrlCmdBytes) != 32 {
-		return nil, fmt.Errorf("control command marshal returned %d bytes, expected 32", len(ctrlCmdBytes))
+	if len(ctrlCmdBytes) != uapi.UblksrvCtrlCmdSize {
+		return nil, fmt.Errorf("control command marshal returned %d bytes, expected %d",
+			len(ctrlCmdBytes), uapi.UblksrvCtrlCmdSize)
 	}
 
 	sqe.setCmdOp(cmd)
 
 	// Place control command at byte 48
-	controlCmdArea := (*[32]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(sqe)) + 48))
-	copy(controlCmdArea[:], ctrlCmdBytes)
+	copy(sqe.cmd[:uapi.UblksrvCtrlCmdSize], ctrlCmdBytes)
 
 	// Submit without waiting
-	if err := r.submitToRing(sqe); err != nil {
+	if err := r.prepareSQE(sqe); err != nil {
 		return nil, err
 	}
-
-	// Call io_uring_enter to submit but don't wait
-	submitted, errno := r.submitOnly(1)
-	if errno != 0 || submitted != 1 {
-		return nil, fmt.Errorf("failed to submit: %v", errno)
+	submitted, err := r.flushSubmissions()
+	if err != nil {
+		return nil, err
+	}
+	if submitted != 1 {
+		return nil, fmt.Errorf("failed to submit: kernel accepted %d SQEs", submitted)
 	}
 
 	logger.Debug("command submitted without waiting", "userData", userData)
 
-	// Return handle for later polling
+	// Return handle that blocks for completions between checks
 	return &AsyncHandle{
-		userData: userData,
-		ring:     r,
+		poll:  func() (Result, error) { return r.tryGetCompletion(userData) },
+		block: r.waitNewCQE,
 	}, nil
 }
 
-// submitToRing prepares and submits an SQE to the ring without calling io_uring_enter
-func (r *minimalRing) submitToRing(sqe *sqe128) error {
-	logger := logging.Default()
-
-	// Get SQ head and tail
-	sqHead := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.head))
-	sqTail := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.tail))
-	sqMask := r.params.sqEntries - 1
-
-	// Check if queue is full
-	if (*sqTail - *sqHead) >= r.params.sqEntries {
-		return fmt.Errorf("submission queue full")
-	}
-
-	// Get SQE slot and copy our prepared SQE
-	sqArray := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.array))
-	sqIndex := *sqTail & sqMask
-	sqeSlot := unsafe.Add(r.sqesAddr, 128*uintptr(sqIndex))
-	*(*sqe128)(sqeSlot) = *sqe
-
-	// Copy control command to correct offset if URING_CMD
-	if sqe.opcode == kernelUringCmdOpcode() {
-		srcCmd := (*[32]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(sqe)) + 48))
-		dstCmd := (*[32]byte)(unsafe.Pointer(uintptr(sqeSlot) + 48))
-		copy(dstCmd[:], srcCmd[:])
-	}
-
-	// Update array entry
-	*(*uint32)(unsafe.Add(unsafe.Pointer(sqArray), unsafe.Sizeof(uint32(0))*uintptr(sqIndex))) = sqIndex
-
-	// CRITICAL: Store fence before tail update to ensure SQE is visible to kernel
-	Sfence()
-
-	// Update tail atomically
-	atomic.StoreUint32(sqTail, *sqTail+1)
+// getEventsArg is struct io_uring_getevents_arg, passed to io_uring_enter
+// with IORING_ENTER_EXT_ARG.
+type getEventsArg struct {
+	sigmask   uint64
+	sigmaskSz uint32
+	pad       uint32
+	ts        uint64 // *unix.Timespec
+}
 
-	logger.Debug("SQE prepared in ring", "index", sqIndex, "tail", *sqTail)
-	return nil
+// waitNewCQE blocks in io_uring_enter until a CQE is posted beyond those
+// already in the CQ, or timeout passes. The kernel counts the wait from
+// the CQ head, so completions no one has claimed yet do not end it early.
+// Timeouts (ETIME) and signals (EINTR) just return; the caller checks the
+// CQ and its deadline again.
+func (r *minimalRing) waitNewCQE(timeout time.Duration) {
+	const (
+		IORING_ENTER_GETEVENTS = 1 << 0
+		IORING_ENTER_EXT_ARG   = 1 << 3
+	)
+	head, tail := r.cqReady()
+	toSubmit := r.unsubmitted()
+	ts := new(unix.Timespec) // On the heap, so the address the kernel reads stays put
+	*ts = unix.NsecToTimespec(int64(timeout))
+	arg := &getEventsArg{ts: uint64(uintptr(unsafe.Pointer(ts)))}
+	r1, _, errno := syscall.Syscall6(
+		unix.SYS_IO_URING_ENTER,
+		uintptr(r.ringFd),
+		uintptr(toSubmit),
+		uintptr(tail-head+1),
+		IORING_ENTER_GETEVENTS|IORING_ENTER_EXT_ARG,
+		uintptr(unsafe.Pointer(arg)),
+		unsafe.Sizeof(*arg))
+	runtime.KeepAlive(ts)
+	r.stats.enter(toSubmit, uint32(r1), errno)
 }
 
-// tryGetCompletion checks CQ for a specific completion
+// tryGetCompletion checks CQ for a specific completion. A match consumes it
+// together with every CQE ahead of it.
 func (r *minimalRing) tryGetCompletion(userData uint64) (Result, error) {
-	logger := logging.Default()
+	logger := logging.For(logging.ComponentUring)
 
 	// First, call io_uring_enter to force kernel to process any pending completions
 	// This is critical for async operations as the kernel might not have pushed completions yet
@@ -388,34 +448,18 @@ func (r *minimalRing) tryGetCompletion(userData uint64) (Result, error) {
 		logger.Debug("io_uring_enter for completion processing failed", "errno", errno)
 	}
 
-	// Check CQ head/tail with proper atomic acquire semantics
-	cqHead := (*uint32)(unsafe.Add(r.cqAddr, r.params.cqOff.head))
-	cqTail := (*uint32)(unsafe.Add(r.cqAddr, r.params.cqOff.tail))
+	head, tail := r.cqReady()
+	logger.Debug("checking completions", "cqHead", head, "cqTail", tail, "looking_for", userData)
 
-	// Load tail with acquire semantics (kernel publishes with release)
-	currentTail := atomic.LoadUint32(cqTail)
-	currentHead := atomic.LoadUint32(cqHead)
-
-	logger.Debug("checking completions", "cqHead", currentHead, "cqTail", currentTail, "looking_for", userData)
-
-	if currentHead == currentTail {
+	if head == tail {
 		return nil, fmt.Errorf("no completions available")
 	}
 
-	// Process completions looking for our userData
-	cqMask := r.params.cqEntries - 1
-
-	for currentHead != currentTail {
-		index := currentHead & cqMask
-		cqeSlot := unsafe.Add(r.cqAddr, uintptr(r.params.cqOff.cqes)+uintptr(unsafe.Sizeof(cqe32{})*uintptr(index)))
-		cqe := (*cqe32)(cqeSlot)
-
-		logger.Debug("found completion", "index", index, "userData", cqe.userData, "res", cqe.res)
+	for ; head != tail; head++ {
+		cqe := r.cqeAt(head)
+		logger.Debug("found completion", "userData", cqe.userData, "res", cqe.res)
 
 		if cqe.userData == userData {
-			// Found our completion - advance head with release semantics
-			atomic.StoreUint32(cqHead, currentHead+1)
-
 			result := &minimalResult{
 				userData: cqe.userData,
 				value:    cqe.res,
@@ -423,20 +467,77 @@ func (r *minimalRing) tryGetCompletion(userData uint64) (Result, error) {
 			}
 
 			if cqe.res < 0 {
-				result.err = fmt.Errorf("operation failed with result: %d", cqe.res)
+				result.err = NewResultError("", cqe.res)
 			}
 
+			r.cqRelease(head + 1)
 			logger.Debug("found matching completion", "userData", userData, "result", cqe.res)
 			return result, nil
 		}
-
-		currentHead++
 	}
 
 	// Didn't find our completion - don't modify head
 	return nil, fmt.Errorf("completion not found")
 }
 
+// Enable enables a ring set up with IORING_SETUP_R_DISABLED. With
+// SINGLE_ISSUER the calling thread becomes the only one allowed to submit.
+// It also applies the ring's IOWQConfig to the calling thread's io-wq.
+func (r *minimalRing) Enable() error {
+	const IORING_REGISTER_ENABLE_RINGS = 12
+
+	if r.enabled {
+		return nil
+	}
+	if r.params.flags&IORING_SETUP_R_DISABLED != 0 {
+		if errno := register(r.ringFd, IORING_REGISTER_ENABLE_RINGS, nil, 0); errno != 0 {
+			return fmt.Errorf("io_uring_register enable rings failed: %v", errno)
+		}
+	}
+	if err := r.registerIOWQ(); err != nil {
+		return err
+	}
+	r.enabled = true
+	return nil
+}
+
+// registerIOWQ applies r.iowq. The kernel keeps io-wq per task, so the
+// affinity only covers the calling thread's workers; the worker limits
+// also cover threads that submit to the ring later.
+func (r *minimalRing) registerIOWQ() error {
+	const (
+		IORING_REGISTER_IOWQ_AFF         = 17
+		IORING_REGISTER_IOWQ_MAX_WORKERS = 19
+	)
+
+	if len(r.iowq.CPUs) > 0 {
+		// A thread only gets an io-wq with its first submission
+		sqe := &r.sqePool
+		*sqe = sqe128{opcode: IORING_OP_NOP}
+		if _, err := r.submitAndWait(sqe); err != nil {
+			return fmt.Errorf("failed to attach thread to ring: %w", err)
+		}
+
+		var set unix.CPUSet
+		for _, cpu := range r.iowq.CPUs {
+			set.Set(cpu)
+		}
+		if errno := register(r.ringFd, IORING_REGISTER_IOWQ_AFF, unsafe.Pointer(&set), unsafe.Sizeof(set)); errno != 0 {
+			return fmt.Errorf("io_uring_register iowq affinity failed: %v", errno)
+		}
+	}
+
+	if r.iowq.MaxBounded > 0 || r.iowq.MaxUnbounded > 0 {
+		// The kernel leaves zero entries unchanged and writes back the
+		// previous limits
+		limits := [2]uint32{r.iowq.MaxBounded, r.iowq.MaxUnbounded}
+		if errno := register(r.ringFd, IORING_REGISTER_IOWQ_MAX_WORKERS, unsafe.Pointer(&limits), 2); errno != 0 {
+			return fmt.Errorf("io_uring_register iowq max workers failed: %v", errno)
+		}
+	}
+	return nil
+}
+
 func (r *minimalRing) Close() error {
 	// This is a minimal implementation - full cleanup would unmap regions
 	return syscall.Close(r.ringFd)
@@ -452,22 +553,14 @@ func (r *minimalRing) RegisterFiles(fds []int32) error {
 		ptr = unsafe.Pointer(&fds[0])
 	}
 
-	_, _, errno := syscall.Syscall6(
-		unix.SYS_IO_URING_REGISTER,
-		uintptr(r.ringFd),
-		IORING_REGISTER_FILES,
-		uintptr(ptr),
-		uintptr(len(fds)),
-		0, 0)
-
-	if errno != 0 {
+	if errno := register(r.ringFd, IORING_REGISTER_FILES, ptr, uintptr(len(fds))); errno != 0 {
 		return fmt.Errorf("io_uring_register files failed: %v", errno)
 	}
 	return nil
 }
 
 func (r *minimalRing) SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, userData uint64) (Result, error) {
-	logger := logging.Default()
+	logger := logging.For(logging.ComponentUring)
 
 	logger.Debug("submitting ctrl command", "cmd_hex", fmt.Sprintf("0x%08x", cmd), "dev_id", ctrlCmd.DevID)
 	logger.Debug("preparing URING_CMD", "cmd", cmd, "dev_id", ctrlCmd.DevID)
@@ -489,7 +582,7 @@ func (r *minimalRing) SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, us
 	}
 
 	// Set the base SQE fields
-	sqe.opcode = kernelUringCmdOpcode()
+	sqe.opcode = IORING_OP_URING_CMD
 	sqe.flags = 0
 	sqe.ioprio = 0
 	sqe.fd = int32(r.targetFd)
@@ -506,18 +599,19 @@ func (r *minimalRing) SubmitCtrlCmd(cmd uint32, ctrlCmd *uapi.UblksrvCtrlCmd, us
 	// Set userData from caller
 	sqe.userData = userData
 
-	// Marshal the 32-byte control command
+	// Marshal the control command
 	ctrlCmdBytes := uapi.Marshal(ctrlCmd)
-	if len(ctrlCmdBytes) != 32 {
-		return nil, fmt.Errorf("control command marshal returned %d bytes, expected 32", len(ctrlCmdBytes))
+	if len(ctrlCmdBytes) != uapi.UblksrvCtrlCmdSize {
+		return nil, fmt.Errorf("control command marshal returned %d bytes, expected %d",
+			len(ctrlCmdBytes), uapi.UblksrvCtrlCmdSize)
 	}
 
 	// Set cmd_op field to ioctl-encoded value (like working C implementation)
 	sqe.setCmdOp(cmd)
 
 	// With sqe128 layout, sqe.cmd starts at byte 48
-	// Copy the 32-byte control command to the cmd area
-	copy(sqe.cmd[:32], ctrlCmdBytes)
+	// Copy the control command to the cmd area
+	copy(sqe.cmd[:uapi.UblksrvCtrlCmdSize], ctrlCmdBytes)
 
 	logger.Debug("SQE prepared", "fd", sqe.fd, "cmd", cmd, "addr", sqe.addr)
 
@@ -553,22 +647,22 @@ func (r *minimalRing) PrepareIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userDat
 	sqe := &r.sqePool
 
 	// Set minimal SQE fields (kernel expects these)
-	sqe.opcode = kernelUringCmdOpcode()
+	sqe.opcode = IORING_OP_URING_CMD
 	sqe.flags = 0
 	sqe.ioprio = 0
 	sqe.fd = int32(r.targetFd)
 	sqe.setCmdOp(cmd)
 	sqe.userData = userData
-	sqe.len = 16 // 16-byte ublksrv_io_cmd payload
+	sqe.len = uapi.UblksrvIOCmdSize
 	sqe.opcodeFlags = 0
 	sqe.bufIndex = 0
 	sqe.personality = 0
 	sqe.spliceFdIn = 0
 	sqe.addr = 0
 
-	// Copy the ublksrv_io_cmd (16 bytes) to cmd area
+	// Copy the ublksrv_io_cmd to cmd area
 	// Using direct assignment is faster than copy() for small fixed sizes
-	*(*[16]byte)(unsafe.Pointer(&sqe.cmd[0])) = *(*[16]byte)(unsafe.Pointer(ioCmd))
+	*(*[uapi.UblksrvIOCmdSize]byte)(unsafe.Pointer(&sqe.cmd[0])) = *(*[uapi.UblksrvIOCmdSize]byte)(unsafe.Pointer(ioCmd))
 
 	// Zero remaining cmd area (bytes 16-79) - required for kernel
 	// Use 64-bit writes for efficiency
@@ -592,6 +686,23 @@ func (r *minimalRing) PrepareIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userDat
 	return nil
 }
 
+// PreparePollAdd prepares a one-shot POLL_ADD SQE that completes with
+// userData once fd is readable.
+func (r *minimalRing) PreparePollAdd(fd int32, userData uint64) error {
+	sqe := &r.sqePool
+	*sqe = sqe128{
+		opcode:      IORING_OP_POLL_ADD,
+		fd:          fd,
+		opcodeFlags: unix.POLLIN, // poll32_events
+		userData:    userData,
+	}
+
+	if err := r.prepareSQE(sqe); err != nil {
+		return fmt.Errorf("failed to prepare poll: %w", err)
+	}
+	return nil
+}
+
 // FlushSubmissions submits all prepared SQEs with a single io_uring_enter syscall.
 // Returns the number of SQEs submitted.
 func (r *minimalRing) FlushSubmissions() (uint32, error) {
@@ -613,63 +724,18 @@ func (r *minimalRing) SubmitIOCmd(cmd uint32, ioCmd *uapi.UblksrvIOCmd, userData
 	return &minimalResult{userData: userData, value: 0, err: nil}, nil
 }
 
+// WaitForCompletion returns every CQE currently posted. With timeout 0 it
+// blocks in io_uring_enter until at least one arrives; otherwise it only
+// polls. The returned slice and results are reused by the next call.
 func (r *minimalRing) WaitForCompletion(timeout int) ([]Result, error) {
 	// Hot path optimization: Reuse pre-allocated results slice
 	// Reset length to 0 but keep capacity
 	r.resultsPool = r.resultsPool[:0]
 	r.cqePoolIndex = 0 // Reset pool index for this batch
 
-	drain := func() {
-		cqHead := (*uint32)(unsafe.Add(r.cqAddr, r.params.cqOff.head))
-		cqTail := (*uint32)(unsafe.Add(r.cqAddr, r.params.cqOff.tail))
-
-		// Load tail with acquire semantics (kernel publishes with release)
-		currentTail := atomic.LoadUint32(cqTail)
-
-		// CRITICAL: Full memory barrier to ensure CQE data is visible
-		// after we see the updated tail from the kernel. The kernel does
-		// a release store to tail after writing CQE data, so we need an
-		// acquire barrier here to ensure we see that data.
-		Mfence()
-
-		currentHead := atomic.LoadUint32(cqHead)
-
-		// Pre-calculate constant offset for cqe slot computation
-		cqMask := r.params.cqEntries - 1
-		cqeBase := uintptr(r.params.cqOff.cqes)
-		cqeSize := uintptr(unsafe.Sizeof(cqe32{}))
-
-		for currentHead != currentTail {
-			cqIndex := currentHead & cqMask
-			cqeSlot := unsafe.Add(r.cqAddr, cqeBase+cqeSize*uintptr(cqIndex))
-			cqe := (*cqe32)(cqeSlot)
-
-			// Use pre-allocated result struct from pool
-			var res *minimalResult
-			if r.cqePoolIndex < r.cqePoolSize {
-				res = &r.cqePool[r.cqePoolIndex]
-				r.cqePoolIndex++
-			} else {
-				// Pool exhausted - fall back to allocation (rare)
-				res = &minimalResult{}
-			}
-
-			res.userData = cqe.userData
-			res.value = cqe.res
-			res.err = nil // Don't allocate error string - caller checks Value()
-
-			r.resultsPool = append(r.resultsPool, res)
-			currentHead++
-		}
-
-		// Update head with release semantics only if we consumed completions
-		if currentHead != atomic.LoadUint32(cqHead) {
-			atomic.StoreUint32(cqHead, currentHead)
-		}
-	}
-
 	// First, non-blocking drain
-	drain()
+	r.drainCQ()
+	r.flushOverflow()
 	if len(r.resultsPool) > 0 {
 		return r.resultsPool, nil
 	}
@@ -677,28 +743,168 @@ func (r *minimalRing) WaitForCompletion(timeout int) ([]Result, error) {
 	// If timeout is specified, don't block forever
 	if timeout > 0 {
 		// Don't wait for any completions, just check if there are any
-		_, _, _ = r.submitAndWaitRing(0, 0)
-		drain()
+		_, _, _ = r.submitAndWaitRing(r.unsubmitted(), 0)
+		r.drainCQ()
+		r.flushOverflow()
 		return r.resultsPool, nil // Return empty slice if no work - NOT an error
 	}
 
 	// Block for at least one completion (only if no timeout)
-	// Retry on EINTR - signals can interrupt the syscall
+	if err := r.waitCQ(); err != nil {
+		return nil, err
+	}
+
+	// Drain whatever arrived
+	r.drainCQ()
+	r.flushOverflow()
+	return r.resultsPool, nil // Always return slice, even if empty
+}
+
+// flushOverflow collects completions the kernel held back because the CQ
+// was full: having just been drained, the CQ has room, and io_uring_enter
+// with GETEVENTS moves the backlog into it. A queue ring's CQ holds twice
+// its SQ entries, more than the commands a queue can have in the kernel,
+// so this only happens with rings sized or shared some other way.
+func (r *minimalRing) flushOverflow() {
+	const IORING_ENTER_GETEVENTS = 1 << 0
+
+	for atomic.LoadUint32(r.sqFlags)&IORING_SQ_CQ_OVERFLOW != 0 {
+		r.cqOverflows.Add(1)
+		_, _, errno := syscall.Syscall6(
+			unix.SYS_IO_URING_ENTER,
+			uintptr(r.ringFd),
+			0, 0,
+			IORING_ENTER_GETEVENTS,
+			0, 0)
+		r.stats.enter(0, 0, errno)
+		if errno != 0 && errno != syscall.EINTR {
+			return // The next wait flushes the backlog too
+		}
+		r.drainCQ()
+	}
+}
+
+// CQOverflows returns how many times completions overflowed the CQ and had
+// to be collected from the kernel's backlog. It is safe to call from any
+// goroutine.
+func (r *minimalRing) CQOverflows() uint64 {
+	return r.cqOverflows.Load()
+}
+
+// Params implements ParamsReporter.
+func (r *minimalRing) Params() Params {
+	return Params{
+		SQEntries: r.params.sqEntries,
+		CQEntries: r.params.cqEntries,
+		Flags:     r.params.flags,
+		Features:  r.params.features,
+	}
+}
+
+// ringCounters back RingStats.
+type ringCounters struct {
+	enters      atomic.Uint64
+	submitted   atomic.Uint64
+	reaps       atomic.Uint64
+	completions atomic.Uint64
+	sqFull      atomic.Uint64
+	peakSQ      atomic.Uint32
+	peakCQ      atomic.Uint32
+}
+
+// enter counts an io_uring_enter call offered toSubmit SQEs.
+func (c *ringCounters) enter(toSubmit, submitted uint32, errno syscall.Errno) {
+	c.enters.Add(1)
+	if errno == 0 {
+		c.submitted.Add(uint64(submitted))
+	}
+	raise(&c.peakSQ, toSubmit)
+}
+
+// reap counts n CQEs collected together.
+func (c *ringCounters) reap(n uint32) {
+	c.reaps.Add(1)
+	c.completions.Add(uint64(n))
+	raise(&c.peakCQ, n)
+}
+
+// raise sets peak to n if n is higher.
+func raise(peak *atomic.Uint32, n uint32) {
 	for {
-		_, _, errno := r.submitAndWaitRing(0, 1)
-		if errno == 0 {
-			break
+		old := peak.Load()
+		if n <= old || peak.CompareAndSwap(old, n) {
+			return
 		}
-		if errno == syscall.EINTR {
-			// Signal interrupted us, retry
-			continue
+	}
+}
+
+// RingStats implements StatsReporter.
+func (r *minimalRing) RingStats() RingStats {
+	return RingStats{
+		Enters:      r.stats.enters.Load(),
+		Submitted:   r.stats.submitted.Load(),
+		Reaps:       r.stats.reaps.Load(),
+		Completions: r.stats.completions.Load(),
+		SQFull:      r.stats.sqFull.Load(),
+		PeakSQ:      r.stats.peakSQ.Load(),
+		PeakCQ:      r.stats.peakCQ.Load(),
+	}
+}
+
+// drainCQ appends every posted CQE to resultsPool and hands the slots back
+// to the kernel with a single head store.
+func (r *minimalRing) drainCQ() {
+	head, tail := r.cqReady()
+	if head == tail {
+		return
+	}
+	r.stats.reap(tail - head)
+
+	for ; head != tail; head++ {
+		cqe := r.cqeAt(head)
+
+		// Use pre-allocated result struct from pool
+		var res *minimalResult
+		if r.cqePoolIndex < r.cqePoolSize {
+			res = &r.cqePool[r.cqePoolIndex]
+			r.cqePoolIndex++
+		} else {
+			// Pool exhausted - fall back to allocation (rare)
+			res = &minimalResult{}
 		}
-		return nil, fmt.Errorf("io_uring_enter wait failed: %v", errno)
+
+		res.userData = cqe.userData
+		res.value = cqe.res
+		res.err = nil // Don't allocate error string - caller checks Value()
+
+		r.resultsPool = append(r.resultsPool, res)
 	}
 
-	// Drain whatever arrived
-	drain()
-	return r.resultsPool, nil // Always return slice, even if empty
+	r.cqRelease(tail)
+}
+
+// waitCQ blocks in io_uring_enter until at least one CQE is posted,
+// submitting any SQEs an earlier io_uring_enter left in the ring on the
+// way. Signals (the runtime's preemption SIGURG, a SIGUSR1 stack dump)
+// interrupt the wait with EINTR, which is retried. EAGAIN and EBUSY mean
+// the kernel could not take the SQEs until completions are reaped, so the
+// wait is retried without them; they go with the next submission.
+func (r *minimalRing) waitCQ() error {
+	toSubmit := r.unsubmitted()
+	for {
+		_, _, errno := r.submitAndWaitRing(toSubmit, 1)
+		switch {
+		case errno == 0:
+			return nil
+		case errno == syscall.EINTR:
+			continue
+		case (errno == syscall.EAGAIN || errno == syscall.EBUSY) && toSubmit > 0:
+			toSubmit = 0
+			continue
+		default:
+			return fmt.Errorf("io_uring_enter wait failed: %w", errno)
+		}
+	}
 }
 
 func (r *minimalRing) NewBatch() Batch {
@@ -726,83 +932,41 @@ func (b *minimalBatch) Len() int {
 
 // submitAndWait submits an SQE and waits for completion using real io_uring
 func (r *minimalRing) submitAndWait(sqe *sqe128) (Result, error) {
-	logger := logging.Default()
-	logger.Debug("submitAndWait called", "fd", sqe.fd, "opcode", sqe.opcode)
+	logger := logging.For(logging.ComponentUring)
 	logger.Debug("submitting URING_CMD via io_uring", "fd", sqe.fd, "opcode", sqe.opcode)
 
-	// This is the real io_uring submission implementation
-	// Step 1: Get next available SQ entry
-	sqHead := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.head))
-	sqTail := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.tail))
-	sqMask := r.params.sqEntries - 1
-
-	// Check if queue is full
-	if (*sqTail - *sqHead) >= r.params.sqEntries {
-		return nil, fmt.Errorf("submission queue full")
-	}
-
-	// Step 2: Get SQE slot and copy our prepared SQE into SQEs mapping
-	sqArray := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.array))
-	sqIndex := *sqTail & sqMask
-
-	// Calculate SQE slot offset
-	sqeSize := unsafe.Sizeof(*sqe)
-	if sqeSize != 128 {
-		logger.Error("SQE size mismatch during submission", "size", sqeSize)
-	}
-	sqeSlot := unsafe.Add(r.sqesAddr, sqeSize*uintptr(sqIndex))
-
-	// Copy our SQE to the SQEs array
-	*(*sqe128)(sqeSlot) = *sqe
-
-	// For URING_CMD, write control command directly to sqeSlot at byte 48
-	if sqe.opcode == kernelUringCmdOpcode() {
-		// Extract and copy the control command
-		srcCmd := (*[32]byte)(unsafe.Pointer(uintptr(unsafe.Pointer(sqe)) + 48))
-		dstCmd := (*[32]byte)(unsafe.Pointer(uintptr(sqeSlot) + 48))
-		copy(dstCmd[:], srcCmd[:])
+	if err := r.prepareSQE(sqe); err != nil {
+		return nil, err
 	}
-
-	// Update array entry
-	*(*uint32)(unsafe.Add(unsafe.Pointer(sqArray), uintptr(4*sqIndex))) = sqIndex
-
-	// Step 3: Update tail to submit the entry
-	oldTail := *sqTail
-	newTail := oldTail + 1
-
-	// CRITICAL: Full store fence to ensure SQE writes are visible to kernel
-	// before we update the tail. runtime.KeepAlive and atomic operations
-	// do NOT provide this guarantee for non-atomic stores.
-	Sfence()
-
-	// Use atomic store to ensure the tail update is visible to the kernel
-	atomic.StoreUint32(sqTail, newTail)
-
-	logger.Debug("updated SQ tail", "old", oldTail, "new", newTail)
-
-	// Submit and wait for completion
-	submitted, completed, errno := r.submitAndWaitRing(1, 1)
-	if errno != 0 {
+	pending := r.publishSQ()
+
+	// Submit and wait for completion. If a signal or a busy kernel cut
+	// this short, processCompletion's wait submits what is left.
+	submitted, completed, errno := r.submitAndWaitRing(pending, 1)
+	switch errno {
+	case 0, syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+	default:
 		logger.Error("io_uring_enter failed", "errno", errno, "submitted", submitted, "completed", completed)
-		return nil, fmt.Errorf("io_uring_enter failed: %v", errno)
+		return nil, fmt.Errorf("io_uring_enter failed: %w", errno)
 	}
 
 	logger.Debug("io_uring_enter succeeded", "submitted", submitted, "completed", completed)
 
-	// Step 5: Process completion
 	return r.processCompletion()
 }
 
 // submitAndWaitRing calls io_uring_enter to submit and wait for completions
 func (r *minimalRing) submitAndWaitRing(toSubmit, minComplete uint32) (submitted, completed uint32, errno syscall.Errno) {
-	logger := logging.Default()
+	logger := logging.For(logging.ComponentUring)
 	const (
 		IORING_ENTER_GETEVENTS = 1 << 0
 	)
 
-	// Only use GETEVENTS flag if we're actually waiting for completions
+	// Only use GETEVENTS flag if we're actually waiting for completions,
+	// or on DEFER_TASKRUN rings, where completions are only posted when
+	// the issuer asks for events
 	var flags uint32
-	if minComplete > 0 {
+	if minComplete > 0 || r.params.flags&IORING_SETUP_DEFER_TASKRUN != 0 {
 		flags = IORING_ENTER_GETEVENTS
 	}
 
@@ -818,6 +982,7 @@ func (r *minimalRing) submitAndWaitRing(toSubmit, minComplete uint32) (submitted
 
 	logger.Debug("io_uring_enter returned", "r1", r1, "r2", r2, "err", err)
 
+	r.stats.enter(toSubmit, uint32(r1), err)
 	return uint32(r1), uint32(r2), err
 }
 
@@ -831,19 +996,55 @@ func (r *minimalRing) submitOnly(toSubmit uint32) (submitted uint32, errno sysca
 		0, // no flags
 		0, 0)
 
+	r.stats.enter(toSubmit, uint32(r1), err)
 	return uint32(r1), err
 }
 
+// register calls io_uring_register, retrying when a signal interrupts it.
+func register(ringFd int, opcode uintptr, arg unsafe.Pointer, nrArgs uintptr) syscall.Errno {
+	for {
+		_, _, errno := syscall.Syscall6(
+			unix.SYS_IO_URING_REGISTER,
+			uintptr(ringFd),
+			opcode,
+			uintptr(arg),
+			nrArgs,
+			0, 0)
+		if errno != syscall.EINTR {
+			return errno
+		}
+	}
+}
+
+// Ring memory ordering
+//
+// The SQ and CQ rings are single-producer/single-consumer queues shared with
+// the kernel. Access follows the same acquire/release protocol as liburing:
+//
+//   - SQ (we produce, kernel consumes): SQEs and array slots are written with
+//     plain stores, then published by a release store of sq.tail. The kernel
+//     advances sq.head, so it is read with an acquire load before reusing a
+//     slot.
+//   - CQ (kernel produces, we consume): cq.tail is read with an acquire load,
+//     which makes the CQEs up to it visible; CQEs are then read with plain
+//     loads. Consumed slots are returned by a release store of cq.head, which
+//     guarantees the kernel cannot overwrite a CQE we are still reading.
+//
+// Only we write sq.tail and cq.head, so reading our own copy needs no
+// ordering. Go's sync/atomic loads and stores are sequentially consistent,
+// which is at least as strong as acquire/release on every architecture, so
+// no separate fence instructions are needed on these paths.
+
 // prepareSQE writes an SQE to the ring buffer without submitting to the kernel.
 // The SQE is visible to us (sqTailLocal is incremented) but not to the kernel
-// until flushSubmissions() is called. This enables batching.
+// until publishSQ is called. This enables batching.
 func (r *minimalRing) prepareSQE(sqe *sqe128) error {
-	sqHead := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.head))
 	sqMask := r.params.sqEntries - 1
 
 	// Check if ring is full. In normal operation this should never happen
 	// because the state machine guarantees at most depth in-flight operations.
-	if r.sqTailLocal-atomic.LoadUint32(sqHead) >= r.params.sqEntries {
+	if r.sqTailLocal-atomic.LoadUint32(r.sqHead) >= r.params.sqEntries {
+		r.stats.sqFull.Add(1)
 		return ErrRingFull
 	}
 
@@ -861,122 +1062,88 @@ func (r *minimalRing) prepareSQE(sqe *sqe128) error {
 	// Increment LOCAL tail - kernel doesn't see this yet
 	r.sqTailLocal++
 
-	// NO memory barrier here - that happens in flushSubmissions
 	// NO syscall here - that's the whole point of batching
 	return nil
 }
 
-// flushSubmissions submits all prepared SQEs with a single io_uring_enter syscall.
-// This publishes sqTailLocal to the shared tail, making all prepared SQEs visible
-// to the kernel, then calls io_uring_enter to wake the kernel.
-func (r *minimalRing) flushSubmissions() (uint32, error) {
-	sqTail := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.tail))
-	currentTail := atomic.LoadUint32(sqTail)
-	pending := r.sqTailLocal - currentTail
+// publishSQ makes every prepared SQE visible to the kernel with a release
+// store of sq.tail and returns how many were published.
+func (r *minimalRing) publishSQ() uint32 {
+	pending := r.sqTailLocal - *r.sqTail
+	if pending != 0 {
+		atomic.StoreUint32(r.sqTail, r.sqTailLocal)
+	}
+	return pending
+}
 
+// unsubmitted returns how many published SQEs the kernel has not yet
+// consumed: a short submission or one refused with EAGAIN or EBUSY leaves
+// them in the ring for the next io_uring_enter.
+func (r *minimalRing) unsubmitted() uint32 {
+	return atomic.LoadUint32(r.sqTail) - atomic.LoadUint32(r.sqHead)
+}
+
+// flushSubmissions submits all prepared SQEs, and any an earlier call left
+// in the ring, with a single io_uring_enter syscall. EINTR is retried;
+// EAGAIN and EBUSY (the kernel is short of memory or its CQ overflowed)
+// leave the SQEs for the next io_uring_enter, which waitCQ makes once the
+// caller reaps completions, rather than failing the queue.
+func (r *minimalRing) flushSubmissions() (uint32, error) {
+	r.publishSQ()
+	pending := r.unsubmitted()
 	if pending == 0 {
 		return 0, nil // Nothing to submit
 	}
 
-	// CRITICAL: Memory barrier ensures all SQE writes are visible to kernel
-	// before we update the shared tail pointer. Without this, the kernel might
-	// see the new tail value but read stale/garbage SQE data.
-	Sfence()
-
-	// Publish new tail to kernel - this makes all prepared SQEs visible
-	atomic.StoreUint32(sqTail, r.sqTailLocal)
-
 	// ONE syscall for the entire batch
-	submitted, errno := r.submitOnly(pending)
-	if errno != 0 {
-		return 0, fmt.Errorf("io_uring_enter failed: %v", errno)
+	for {
+		submitted, errno := r.submitOnly(pending)
+		switch errno {
+		case 0:
+			return submitted, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EAGAIN, syscall.EBUSY:
+			return 0, nil
+		default:
+			return 0, fmt.Errorf("io_uring_enter failed: %w", errno)
+		}
 	}
-
-	return submitted, nil
 }
 
-// submitOnlyCmd submits a command SQE without waiting for completion
-func (r *minimalRing) submitOnlyCmd(sqe *sqe128) (uint32, error) {
-	// Get SQ head and tail
-	sqHead := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.head))
-	sqTail := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.tail))
-	sqMask := r.params.sqEntries - 1
-
-	// Check if queue is full
-	if (*sqTail - *sqHead) >= r.params.sqEntries {
-		return 0, fmt.Errorf("submission queue full")
-	}
-
-	// Get SQE slot and copy our prepared SQE
-	sqArray := (*uint32)(unsafe.Add(r.sqAddr, r.params.sqOff.array))
-	sqIndex := *sqTail & sqMask
-	sqeSlot := unsafe.Add(r.sqesAddr, 128*uintptr(sqIndex))
-	*(*sqe128)(sqeSlot) = *sqe
-	// NOTE: No extra copy needed - the struct copy includes the cmd area at bytes 48-127
-
-	// Update array entry
-	*(*uint32)(unsafe.Add(unsafe.Pointer(sqArray), unsafe.Sizeof(uint32(0))*uintptr(sqIndex))) = sqIndex
-
-	// Update tail with proper memory ordering
-	oldTail := *sqTail
-	newTail := oldTail + 1
-
-	// CRITICAL: Full store fence to ensure SQE writes are visible to kernel
-	// before we update the tail. This is the key fix for the race condition.
-	Sfence()
-
-	atomic.StoreUint32(sqTail, newTail)
+// cqReady returns our CQ head and the kernel's CQ tail. The acquire load of
+// the tail makes every CQE in [head, tail) safe to read.
+func (r *minimalRing) cqReady() (head, tail uint32) {
+	return *r.cqHead, atomic.LoadUint32(r.cqTail)
+}
 
-	// Submit without waiting
-	submitted, errno := r.submitOnly(1)
-	if errno != 0 {
-		return 0, fmt.Errorf("io_uring_enter failed: %v", errno)
-	}
+// cqeAt returns the CQE at ring position pos.
+func (r *minimalRing) cqeAt(pos uint32) *cqe32 {
+	index := pos & (r.params.cqEntries - 1)
+	return (*cqe32)(unsafe.Add(r.cqAddr, uintptr(r.params.cqOff.cqes)+unsafe.Sizeof(cqe32{})*uintptr(index)))
+}
 
-	return submitted, nil
+// cqRelease hands CQ slots before head back to the kernel (release store).
+func (r *minimalRing) cqRelease(head uint32) {
+	atomic.StoreUint32(r.cqHead, head)
 }
 
-// processCompletion processes a completion from the CQ ring
+// processCompletion consumes the completion at the CQ head, blocking until
+// one is posted.
 func (r *minimalRing) processCompletion() (Result, error) {
-	logger := logging.Default()
-
-	// Get CQ head and tail
-	cqHead := (*uint32)(unsafe.Add(r.cqAddr, r.params.cqOff.head))
-	cqTail := (*uint32)(unsafe.Add(r.cqAddr, r.params.cqOff.tail))
-
-	// Read tail with acquire semantics (kernel publishes with release)
-	currentTail := atomic.LoadUint32(cqTail)
-	currentHead := *cqHead
-
-	// Check if we have completions, with a retry loop for memory visibility.
-	// After io_uring_enter returns, the kernel has updated CQ tail, but the
-	// store may not be visible to this CPU yet due to cache coherence latency.
-	// 5 retries * 10µs = 50µs max wait, which is sufficient for cross-CPU
-	// visibility on modern x86-64 systems (typically <1µs).
-	const maxRetries = 5
-	const retryDelay = 10 * time.Microsecond
-	for i := 0; i < maxRetries; i++ {
-		currentTail = atomic.LoadUint32(cqTail)
-		if currentHead != currentTail {
-			break
-		}
-		time.Sleep(retryDelay)
-	}
+	logger := logging.For(logging.ComponentUring)
 
-	if currentHead == currentTail {
-		logger.Warn("no completions available after retries")
-		return nil, fmt.Errorf("no completions available after retries")
+	head, tail := r.cqReady()
+	for head == tail {
+		if err := r.waitCQ(); err != nil {
+			return nil, err
+		}
+		head, tail = r.cqReady()
 	}
 
-	// Get CQE
-	cqMask := r.params.cqEntries - 1
-	cqIndex := currentHead & cqMask
-	cqeSlot := unsafe.Add(r.cqAddr, uintptr(r.params.cqOff.cqes)+uintptr(unsafe.Sizeof(cqe32{})*uintptr(cqIndex)))
-	cqe := (*cqe32)(cqeSlot)
-
+	cqe := r.cqeAt(head)
 	logger.Debug("processing completion", "user_data", cqe.userData, "res", cqe.res, "flags", cqe.flags)
 
-	// Extract result
 	result := &minimalResult{
 		userData: cqe.userData,
 		value:    cqe.res,
@@ -984,11 +1151,9 @@ func (r *minimalRing) processCompletion() (Result, error) {
 	}
 
 	if cqe.res < 0 {
-		result.err = fmt.Errorf("operation failed with result: %d", cqe.res)
+		result.err = NewResultError("", cqe.res)
 	}
 
-	// Update head with release semantics to consume the completion
-	atomic.StoreUint32(cqHead, currentHead+1)
-
+	r.cqRelease(head + 1)
 	return result, nil
 }
@@ -0,0 +1,430 @@
+//go:build linux
+
+package uring
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// IORING_OP_NOP completes immediately without touching any file.
+const ioringOpNop = 0
+
+// TestRingStress drives the SQ from one goroutine and drains the CQ from
+// another, the same split the acquire/release protocol in minimal.go is
+// written for. Run with -race to check the Go side of the handoff; the
+// exactly-once accounting checks the ring indices themselves.
+func TestRingStress(t *testing.T) {
+	const (
+		entries = 64
+		total   = 200000
+	)
+
+	ring, err := NewMinimalRing(entries, -1)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+	r := ring.(*minimalRing)
+
+	// Every in-flight NOP holds one credit, so the producer can never overrun
+	// the SQ and the CQ (2x entries) can never overflow.
+	credits := make(chan struct{}, entries)
+	for range entries {
+		credits <- struct{}{}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := range total {
+			<-credits
+			sqe := &sqe128{opcode: ioringOpNop, fd: -1, userData: uint64(i)}
+			if err := r.prepareSQE(sqe); err != nil {
+				errs <- err
+				return
+			}
+			// Flush in small, uneven batches to vary the tail/head interleaving.
+			if i%7 == 0 || len(credits) == 0 {
+				if _, err := r.flushSubmissions(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}
+		if _, err := r.flushSubmissions(); err != nil {
+			errs <- err
+		}
+	}()
+
+	seen := make([]bool, total)
+	go func() {
+		defer wg.Done()
+		for done := 0; done < total; {
+			results, err := r.WaitForCompletion(0)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for _, res := range results {
+				id := res.UserData()
+				if id >= total {
+					t.Errorf("unexpected userData %d", id)
+					continue
+				}
+				if seen[id] {
+					t.Errorf("userData %d completed twice", id)
+				}
+				if res.Value() != 0 {
+					t.Errorf("NOP %d returned %d", id, res.Value())
+				}
+				seen[id] = true
+				done++
+				credits <- struct{}{}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for id, ok := range seen {
+		if !ok {
+			t.Fatalf("userData %d never completed", id)
+		}
+	}
+}
+
+// TestSingleIssuerRing enables a SINGLE_ISSUER ring on a locked thread and
+// reaps an eventfd poll that completes after submission, so on
+// DEFER_TASKRUN rings the completion is only posted once the poll asks the
+// kernel for events.
+func TestSingleIssuerRing(t *testing.T) {
+	f, err := GetFeatures()
+	if err != nil || !f.SingleIssuer {
+		t.Skipf("IORING_SETUP_SINGLE_ISSUER unavailable: %v", err)
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ring, err := newMinimalRing(4, 0, -1, f.singleIssuerFlags(), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Close()
+	if ring.(*minimalRing).params.flags&IORING_SETUP_SINGLE_ISSUER == 0 {
+		t.Fatal("ring was set up without SINGLE_ISSUER")
+	}
+	if err := ring.Enable(); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(efd)
+	if err := ring.PreparePollAdd(int32(efd), 42); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.FlushSubmissions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Write(efd, []byte{1, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []Result
+	for attempt := 0; len(results) == 0 && attempt < 100; attempt++ {
+		if results, err = ring.WaitForCompletion(1); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(results) != 1 || results[0].UserData() != 42 {
+		t.Errorf("polling WaitForCompletion = %d results, want the eventfd poll", len(results))
+	}
+}
+
+// TestIOWQConfig applies worker limits and affinity from a thread other
+// than the one that created the ring, as a queue loop does.
+func TestIOWQConfig(t *testing.T) {
+	f, err := GetFeatures()
+	if err != nil || !f.SingleIssuer {
+		t.Skipf("IORING_SETUP_SINGLE_ISSUER unavailable: %v", err)
+	}
+	ring, err := newMinimalRing(4, 0, -1, f.singleIssuerFlags(), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Close()
+	ring.(*minimalRing).iowq = IOWQConfig{MaxBounded: 2, MaxUnbounded: 4, CPUs: []int{0}}
+
+	errc := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		errc <- ring.Enable()
+	}()
+	if err := <-errc; err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+}
+
+// TestRingSignalStorm blocks in WaitForCompletion while signals keep
+// interrupting the waiting thread, as SIGURG preemption or a SIGUSR1 stack
+// dump do, and checks that every wait still returns its completion.
+func TestRingSignalStorm(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ring, err := NewMinimalRing(8, -1)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(efd)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	go func() {
+		for range sigs { // Drained so the runtime keeps delivering
+		}
+	}()
+
+	pid, tid := unix.Getpid(), unix.Gettid()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = unix.Tgkill(pid, tid, syscall.SIGUSR1)
+			time.Sleep(50 * time.Microsecond)
+		}
+	}()
+
+	var buf [8]byte
+	for i := range 50 {
+		if err := ring.PreparePollAdd(int32(efd), uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ring.FlushSubmissions(); err != nil {
+			t.Fatalf("FlushSubmissions under signals: %v", err)
+		}
+		time.AfterFunc(2*time.Millisecond, func() {
+			_, _ = unix.Write(efd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+		})
+		results, err := ring.WaitForCompletion(0)
+		if err != nil {
+			t.Fatalf("WaitForCompletion under signals: %v", err)
+		}
+		if len(results) != 1 || results[0].UserData() != uint64(i) {
+			t.Fatalf("wait %d returned %d results, want its poll", i, len(results))
+		}
+		_, _ = unix.Read(efd, buf[:])
+	}
+}
+
+func TestRingCQOverflow(t *testing.T) {
+	ring, err := NewRing(Config{Entries: 4, CQEntries: 4, FD: -1})
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+	if ring.(*minimalRing).params.flags&IORING_SETUP_CQSIZE == 0 {
+		t.Skip("kernel rejected IORING_SETUP_CQSIZE")
+	}
+
+	efd, err := unix.Eventfd(1, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK) // Readable, so polls complete at once
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(efd)
+
+	// Two batches of four completions into a CQ of four: the second
+	// batch waits in the kernel's backlog
+	for i := range 8 {
+		if err := ring.PreparePollAdd(int32(efd), uint64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if i%4 == 3 {
+			if _, err := ring.FlushSubmissions(); err != nil {
+				t.Fatalf("FlushSubmissions: %v", err)
+			}
+		}
+	}
+
+	var got []uint64
+	for len(got) < 8 {
+		results, err := ring.WaitForCompletion(0)
+		if err != nil {
+			t.Fatalf("WaitForCompletion: %v", err)
+		}
+		for _, r := range results {
+			got = append(got, r.UserData())
+		}
+	}
+	slices.Sort(got)
+	if want := []uint64{0, 1, 2, 3, 4, 5, 6, 7}; !slices.Equal(got, want) {
+		t.Errorf("completions = %v, want %v", got, want)
+	}
+	if n := ring.(OverflowCounter).CQOverflows(); n == 0 {
+		t.Error("CQOverflows = 0 after the CQ overflowed")
+	}
+}
+
+// TestAttachWQ attaches a ring to another's workers, and falls back to
+// its own when the ring to attach to is gone.
+func TestAttachWQ(t *testing.T) {
+	anchor, err := NewMinimalRing(4, -1)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer anchor.Close()
+
+	ring, err := NewRing(Config{Entries: 4, FD: -1, AttachWQ: anchor})
+	if err != nil {
+		t.Skipf("NewRing: %v", err)
+	}
+	defer ring.Close()
+	if flags := ring.(ParamsReporter).Params().Flags; flags&IORING_SETUP_ATTACH_WQ == 0 {
+		t.Errorf("attached ring flags = %#x, want ATTACH_WQ", flags)
+	}
+
+	closed, err := NewMinimalRing(4, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	ring2, err := NewRing(Config{Entries: 4, FD: -1, AttachWQ: closed})
+	if err != nil {
+		t.Fatalf("NewRing attached to a closed ring: %v", err)
+	}
+	defer ring2.Close()
+	if flags := ring2.(ParamsReporter).Params().Flags; flags&IORING_SETUP_ATTACH_WQ != 0 {
+		t.Errorf("ring attached to a closed ring has flags %#x, want no ATTACH_WQ", flags)
+	}
+}
+
+func TestRingStats(t *testing.T) {
+	const entries = 8
+	ring, err := NewMinimalRing(entries, -1)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+	r := ring.(*minimalRing)
+
+	for i := range entries {
+		if err := r.prepareSQE(&sqe128{opcode: ioringOpNop, fd: -1, userData: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.prepareSQE(&sqe128{opcode: ioringOpNop, fd: -1}); err != ErrRingFull {
+		t.Fatalf("prepareSQE on a full SQ = %v, want ErrRingFull", err)
+	}
+	if _, err := r.flushSubmissions(); err != nil {
+		t.Fatal(err)
+	}
+	for done := 0; done < entries; {
+		results, err := r.WaitForCompletion(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done += len(results)
+	}
+
+	stats := ring.(StatsReporter).RingStats()
+	if stats.Submitted != entries || stats.Completions != entries || stats.SQFull != 1 {
+		t.Errorf("stats = %+v, want %d submitted and completed and 1 SQ full", stats, entries)
+	}
+	if stats.Enters == 0 || stats.Reaps == 0 || stats.PeakSQ != entries || stats.PeakCQ == 0 {
+		t.Errorf("stats = %+v, want enters, reaps and peaks counted", stats)
+	}
+}
+
+// TestAsyncHandleBlocks checks that a ring's handle sleeps in the kernel
+// until its completion arrives, past a completion it does not claim, and
+// gives up at its deadline.
+func TestAsyncHandleBlocks(t *testing.T) {
+	const ioringOpTimeout = 11
+	ring, err := NewMinimalRing(8, -1)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	defer ring.Close()
+	r := ring.(*minimalRing)
+	polls := 0
+	handle := func(userData uint64) *AsyncHandle {
+		return &AsyncHandle{
+			poll: func() (Result, error) {
+				polls++
+				return r.tryGetCompletion(userData)
+			},
+			block: r.waitNewCQE,
+		}
+	}
+
+	start := time.Now()
+	if _, err := handle(1).Wait(30 * time.Millisecond); err == nil {
+		t.Fatal("Wait with nothing submitted succeeded")
+	}
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Wait gave up after %v, want about 30ms", elapsed)
+	}
+
+	// A NOP completes at once, unclaimed; the timeout completes 100ms later
+	ts := &unix.Timespec{Nsec: int64(100 * time.Millisecond)}
+	if err := r.prepareSQE(&sqe128{opcode: ioringOpNop, fd: -1, userData: 1}); err != nil {
+		t.Fatal(err)
+	}
+	timeout := &sqe128{opcode: ioringOpTimeout, fd: -1, len: 1, userData: 2}
+	timeout.addr = uint64(uintptr(unsafe.Pointer(ts)))
+	if err := r.prepareSQE(timeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.flushSubmissions(); err != nil {
+		t.Fatal(err)
+	}
+	polls = 0
+	start = time.Now()
+	result, err := handle(2).Wait(5 * time.Second)
+	runtime.KeepAlive(ts)
+	if err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if result.Value() != -int32(syscall.ETIME) {
+		t.Errorf("timeout completed with %d, want -ETIME", result.Value())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wait took %v for a 100ms completion", elapsed)
+	}
+	// Woken by the completion, not polling for it
+	if polls > 3 {
+		t.Errorf("Wait polled %d times for one completion", polls)
+	}
+}
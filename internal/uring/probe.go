@@ -0,0 +1,71 @@
+package uring
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// IORING_OP_URING_CMD is the io_uring opcode used for every ublk command.
+// Its value is fixed by the kernel UAPI (Linux 5.19+); NewMinimalRing
+// verifies at runtime that the kernel actually supports it.
+const IORING_OP_URING_CMD = 46
+
+const (
+	IORING_REGISTER_PROBE = 8
+	IO_URING_OP_SUPPORTED = 1 << 0
+
+	// probeOpsLen is the number of op slots requested from the kernel.
+	// Opcodes are a u8, so 256 covers every possible value.
+	probeOpsLen = 256
+)
+
+// ErrUringCmdUnsupported is returned when the kernel's io_uring does not
+// implement IORING_OP_URING_CMD, which ublk requires.
+var ErrUringCmdUnsupported = errors.New("io_uring does not support IORING_OP_URING_CMD (requires Linux 5.19+)")
+
+// ioUringProbeOp mirrors struct io_uring_probe_op.
+type ioUringProbeOp struct {
+	op    uint8
+	resv  uint8
+	flags uint16
+	resv2 uint32
+}
+
+// ioUringProbe mirrors struct io_uring_probe with a fixed-size ops array.
+type ioUringProbe struct {
+	lastOp uint8
+	opsLen uint8
+	resv   uint16
+	resv2  [3]uint32
+	ops    [probeOpsLen]ioUringProbeOp
+}
+
+// supports reports whether the kernel flagged op as supported.
+func (p *ioUringProbe) supports(op uint8) bool {
+	if op > p.lastOp || int(op) >= int(p.opsLen) {
+		return false
+	}
+	return p.ops[op].flags&IO_URING_OP_SUPPORTED != 0
+}
+
+// probeOps asks the kernel which opcodes ringFd supports.
+func probeOps(ringFd int) (*ioUringProbe, error) {
+	probe := &ioUringProbe{}
+	if errno := register(ringFd, IORING_REGISTER_PROBE, unsafe.Pointer(probe), probeOpsLen); errno != 0 {
+		return nil, fmt.Errorf("io_uring_register probe failed: %w", errno)
+	}
+	return probe, nil
+}
+
+// verifyUringCmd checks that ringFd accepts IORING_OP_URING_CMD.
+func verifyUringCmd(ringFd int) error {
+	probe, err := probeOps(ringFd)
+	if err != nil {
+		return err
+	}
+	if !probe.supports(IORING_OP_URING_CMD) {
+		return ErrUringCmdUnsupported
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package uring
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestProbeLayout(t *testing.T) {
+	if got := unsafe.Sizeof(ioUringProbeOp{}); got != 8 {
+		t.Errorf("sizeof(io_uring_probe_op) = %d, want 8", got)
+	}
+	if got := unsafe.Offsetof(ioUringProbe{}.ops); got != 16 {
+		t.Errorf("offsetof(io_uring_probe.ops) = %d, want 16", got)
+	}
+}
+
+func TestProbeSupports(t *testing.T) {
+	p := &ioUringProbe{lastOp: IORING_OP_URING_CMD, opsLen: IORING_OP_URING_CMD + 1}
+	p.ops[IORING_OP_URING_CMD].flags = IO_URING_OP_SUPPORTED
+
+	if !p.supports(IORING_OP_URING_CMD) {
+		t.Error("supports(URING_CMD) = false, want true")
+	}
+	if p.supports(0) {
+		t.Error("supports(0) = true for an op without the supported flag")
+	}
+	if p.supports(IORING_OP_URING_CMD + 1) {
+		t.Error("supports() = true for an op past last_op")
+	}
+}
+
+func TestVerifyUringCmd(t *testing.T) {
+	var params io_uring_params
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, 1, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		t.Skipf("io_uring unavailable: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	err := verifyUringCmd(int(fd))
+	if errors.Is(err, ErrUringCmdUnsupported) {
+		t.Skip("kernel predates IORING_OP_URING_CMD")
+	}
+	if err != nil {
+		t.Fatalf("verifyUringCmd() error = %v", err)
+	}
+}
+
+func TestGetFeatures(t *testing.T) {
+	f, err := GetFeatures()
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	t.Logf("features: %+v", f)
+
+	err = SupportsFeatures()
+	if f.SQE128 && f.CQE32 && f.UringCmd {
+		if err != nil {
+			t.Errorf("SupportsFeatures() = %v with all prerequisites present", err)
+		}
+	} else if err == nil {
+		t.Errorf("SupportsFeatures() = nil with features %+v", f)
+	}
+}
+
+func TestSetupError(t *testing.T) {
+	err := setupError(syscall.EPERM)
+	if !errors.Is(err, syscall.EPERM) {
+		t.Errorf("setupError(EPERM) does not wrap EPERM: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+
+package uring
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// errNotLinux is returned by every ring constructor off Linux, where
+// there is no io_uring. It wraps ENOSYS.
+var errNotLinux = fmt.Errorf("io_uring requires Linux: %w", syscall.ENOSYS)
+
+// NewRing returns an error wrapping ENOSYS.
+func NewRing(config Config) (Ring, error) {
+	return nil, errNotLinux
+}
+
+// NewMinimalRing returns an error wrapping ENOSYS.
+func NewMinimalRing(entries uint32, ctrlFd int32) (Ring, error) {
+	return nil, errNotLinux
+}
+
+// ErrnoName returns the number of errno; the names are Linux's.
+func ErrnoName(errno syscall.Errno) string {
+	return fmt.Sprintf("errno %d", int(errno))
+}
+
+func detectFeatures() (Features, error) {
+	return Features{}, errNotLinux
+}
+
+func register(ringFd int, opcode uintptr, arg unsafe.Pointer, nrArgs uintptr) syscall.Errno {
+	return syscall.ENOSYS
+}
@@ -0,0 +1,44 @@
+package ublk
+
+import "github.com/ehrlich-b/go-ublk/internal/logging"
+
+// LogLevel is the least severity of the library's log messages that are
+// written.
+type LogLevel = logging.LogLevel
+
+// Log levels
+const (
+	LogLevelDebug = logging.LevelDebug
+	LogLevelInfo  = logging.LevelInfo
+	LogLevelWarn  = logging.LevelWarn
+	LogLevelError = logging.LevelError
+)
+
+// Components of the library whose logging can be filtered apart with
+// SetComponentLogLevel.
+const (
+	LogComponentCtrl  = logging.ComponentCtrl  // Control plane: device add, start, stop
+	LogComponentQueue = logging.ComponentQueue // Queue runners and their I/O loops
+	LogComponentUring = logging.ComponentUring // io_uring setup and submission
+)
+
+// SetLogLevel changes the level of the library's default logger, and of
+// the components without a level of their own, while devices run. Queues
+// log to Options.Logger instead; when that is the default logger, as in
+// the examples, it covers them too.
+func SetLogLevel(level LogLevel) {
+	logging.Default().SetLevel(level)
+}
+
+// SetComponentLogLevel changes the level of one component's logging while
+// devices run, so that, say, LogComponentUring can log at LogLevelDebug
+// without the debug output of the queues.
+func SetComponentLogLevel(component string, level LogLevel) {
+	logging.Default().SetComponentLevel(component, level)
+}
+
+// ParseLogLevel returns the level named s: "debug", "info", "warn" or
+// "error".
+func ParseLogLevel(s string) (LogLevel, error) {
+	return logging.ParseLevel(s)
+}
@@ -0,0 +1,324 @@
+package ublk
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// ErrManagerClosed is returned when a device is created on a closed Manager.
+var ErrManagerClosed = errors.New("ublk: manager is closed")
+
+// Manager creates and tracks several devices over one shared control
+// channel. Unlike the package-level Create and CreateAndServe, which open
+// /dev/ublk-control for every call, a Manager opens it once.
+//
+// All methods are safe for concurrent use. Devices may be added from several
+// goroutines while others serve I/O; with DeviceID set to AutoAssignDeviceID
+// the kernel assigns each a distinct ID, since control commands are
+// serialized on the shared channel.
+type Manager struct {
+	ctrl *ctrl.Controller
+
+	mu      sync.Mutex
+	devices map[uint32]*Device
+	order   []*Device             // open devices, oldest first
+	deps    map[*Device][]*Device // devices each one is built on; see AddDependency
+	closed  bool
+	active  sync.WaitGroup // creates in progress
+
+	// wqRing is the ring whose workers the devices' queue rings share
+	// (IOWQShareManager); nil until first needed, or if it failed
+	wqRing   uring.QueueRing
+	wqFailed bool
+}
+
+// NewManager opens the ublk control device. Call LoadModule first to load
+// ublk_drv if it may not be loaded.
+func NewManager() (*Manager, error) {
+	c, err := createController(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create controller: %w", err)
+	}
+	return &Manager{
+		ctrl:    c,
+		devices: make(map[uint32]*Device),
+	}, nil
+}
+
+// CreateAndServe is like the package-level CreateAndServe but uses the
+// manager's control channel and tracks the device until it is closed.
+func (m *Manager) CreateAndServe(ctx context.Context, params DeviceParams, options *Options) (*Device, error) {
+	if err := m.begin(); err != nil {
+		return nil, err
+	}
+	defer m.active.Done()
+
+	device, err := createAndServe(ctx, m.ctrl, m, params, options)
+	if err != nil {
+		return nil, err
+	}
+	m.add(device)
+	return device, nil
+}
+
+// Create is like the package-level Create but uses the manager's control
+// channel and tracks the device until it is closed.
+func (m *Manager) Create(params DeviceParams, options *Options) (*Device, error) {
+	if err := m.begin(); err != nil {
+		return nil, err
+	}
+	defer m.active.Done()
+
+	device, err := create(context.Background(), m.ctrl, m, params, options)
+	if err != nil {
+		return nil, err
+	}
+	m.add(device)
+	return device, nil
+}
+
+// Devices returns the manager's open devices, ordered by ID.
+func (m *Manager) Devices() []*Device {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	devices := make([]*Device, 0, len(m.devices))
+	for _, d := range m.devices {
+		devices = append(devices, d)
+	}
+	slices.SortFunc(devices, func(a, b *Device) int { return cmp.Compare(a.ID, b.ID) })
+	return devices
+}
+
+// AddDependency records that dependent is built on dependency, as a
+// device-mapper table or an md array over it is, so Close and Shutdown
+// close dependent first. Both must be open devices of the manager, and
+// the dependency must not close a cycle.
+func (m *Manager) AddDependency(dependent, dependency *Device) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if dependent == nil || dependency == nil || dependent == dependency ||
+		!slices.Contains(m.order, dependent) || !slices.Contains(m.order, dependency) {
+		return ErrInvalidParameters
+	}
+	if m.dependsOnLocked(dependency, dependent) {
+		return fmt.Errorf("%s already depends on %s", dependency.Path, dependent.Path)
+	}
+	if m.deps == nil {
+		m.deps = make(map[*Device][]*Device)
+	}
+	if !slices.Contains(m.deps[dependent], dependency) {
+		m.deps[dependent] = append(m.deps[dependent], dependency)
+	}
+	return nil
+}
+
+// dependsOnLocked reports whether d is built on other, directly or not.
+func (m *Manager) dependsOnLocked(d, other *Device) bool {
+	for _, dep := range m.deps[d] {
+		if dep == other || m.dependsOnLocked(dep, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close waits for creates in progress, closes every open device and then
+// the control channel. Devices close newest first, and after every device
+// declared (AddDependency) to be built on them. It returns the errors
+// from closing devices, one per device that is still open.
+func (m *Manager) Close() error {
+	return m.Shutdown(0).Err()
+}
+
+// ShutdownReport is how each device fared in Manager.Shutdown.
+type ShutdownReport struct {
+	Closed []uint32          // IDs of the devices closed, in order
+	Failed []ShutdownFailure // devices still open
+}
+
+// ShutdownFailure is a device Manager.Shutdown could not close.
+type ShutdownFailure struct {
+	ID   uint32
+	Path string
+	Err  error
+}
+
+// Err joins the report's failures, or returns nil if every device closed.
+func (r *ShutdownReport) Err() error {
+	errs := make([]error, 0, len(r.Failed))
+	for _, f := range r.Failed {
+		errs = append(errs, fmt.Errorf("failed to close %s: %w", f.Path, f.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown is Close with each device given at most timeout to close (0 =
+// as long as Device.Close takes) and a report of the outcome, for
+// process exit. A device that fails or runs out of time is left open,
+// along with every device it is built on, since removing those would
+// pull storage from under it. If any device is left still closing, the
+// control channel stays open for it. Shutdown on a closed manager
+// reports nothing.
+func (m *Manager) Shutdown(timeout time.Duration) *ShutdownReport {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return &ShutdownReport{}
+	}
+	m.closed = true
+	m.mu.Unlock()
+
+	m.active.Wait()
+
+	m.mu.Lock()
+	devices := slices.Clone(m.order)
+	deps := make(map[*Device][]*Device, len(m.deps))
+	for d, on := range m.deps {
+		deps[d] = slices.Clone(on)
+	}
+	m.mu.Unlock()
+
+	stuck := false
+	report := closeInOrder(devices, deps, func(d *Device) error {
+		pending, err := closeWithin(d, timeout)
+		stuck = stuck || pending
+		return err
+	})
+	if stuck {
+		logging.Default().Warn("devices did not close in time; leaving the control channel open")
+		return report
+	}
+	m.ctrl.Close()
+	m.mu.Lock()
+	if m.wqRing != nil {
+		m.wqRing.Close()
+		m.wqRing = nil
+	}
+	m.mu.Unlock()
+	return report
+}
+
+// closeInOrder closes devices, oldest first in the slice, with closeFn:
+// newest first, each after the devices built on it (deps). A device that
+// fails to close keeps those it is built on open.
+func closeInOrder(devices []*Device, deps map[*Device][]*Device, closeFn func(*Device) error) *ShutdownReport {
+	report := &ShutdownReport{}
+	remaining := slices.Clone(devices)
+	held := make(map[*Device]*Device) // device -> a dependent left open
+	for len(remaining) > 0 {
+		i := nextToClose(remaining, deps)
+		d := remaining[i]
+		remaining = slices.Delete(remaining, i, i+1)
+
+		var err error
+		if holder, ok := held[d]; ok {
+			err = fmt.Errorf("%s is built on it and is still open", holder.Path)
+		} else {
+			err = closeFn(d)
+		}
+		if err == nil {
+			report.Closed = append(report.Closed, d.ID)
+			continue
+		}
+		report.Failed = append(report.Failed, ShutdownFailure{ID: d.ID, Path: d.Path, Err: err})
+		for _, dep := range deps[d] {
+			if _, ok := held[dep]; !ok {
+				held[dep] = d
+			}
+		}
+	}
+	return report
+}
+
+// nextToClose returns the index in devices, oldest first, of the newest
+// device no other device in it is built on.
+func nextToClose(devices []*Device, deps map[*Device][]*Device) int {
+	for i := len(devices) - 1; i >= 0; i-- {
+		needed := slices.ContainsFunc(devices, func(other *Device) bool {
+			return slices.Contains(deps[other], devices[i])
+		})
+		if !needed {
+			return i
+		}
+	}
+	return len(devices) - 1 // Unreachable: AddDependency refuses cycles
+}
+
+// closeWithin closes d, giving up after timeout unless it is 0. After a
+// timeout the close carries on in the background and pending is true.
+func closeWithin(d *Device, timeout time.Duration) (pending bool, err error) {
+	if timeout <= 0 {
+		return false, d.Close()
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.Close() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return false, err
+	case <-timer.C:
+		return true, &Error{
+			Op:    "CLOSE",
+			DevID: d.ID,
+			Queue: NoQueue,
+			Code:  ErrCodeTimeout,
+			Msg:   fmt.Sprintf("not closed within %v", timeout),
+		}
+	}
+}
+
+// workerRing returns the ring the manager's devices attach their queue
+// rings to, creating it on first use, or nil if it cannot be created.
+func (m *Manager) workerRing() uring.QueueRing {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.wqRing == nil && !m.wqFailed {
+		ring, err := uring.NewRing(uring.Config{Entries: 1, FD: -1})
+		if err != nil {
+			logging.Default().Warn("queue rings will not share workers", "error", err)
+			m.wqFailed = true
+			return nil
+		}
+		m.wqRing = ring
+	}
+	return m.wqRing
+}
+
+// begin registers a create in progress, failing if the manager is closed.
+func (m *Manager) begin() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	m.active.Add(1)
+	return nil
+}
+
+func (m *Manager) add(d *Device) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices[d.ID] = d
+	m.order = append(m.order, d)
+}
+
+func (m *Manager) remove(d *Device) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.devices, d.ID)
+	m.order = slices.DeleteFunc(m.order, func(other *Device) bool { return other == d })
+	delete(m.deps, d)
+	for other, on := range m.deps {
+		m.deps[other] = slices.DeleteFunc(on, func(dep *Device) bool { return dep == d })
+	}
+}
@@ -0,0 +1,146 @@
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManagerTracksDevices(t *testing.T) {
+	m := &Manager{devices: make(map[uint32]*Device)}
+	for _, id := range []uint32{7, 2, 5} {
+		m.add(&Device{ID: id, manager: m})
+	}
+
+	devices := m.Devices()
+	if len(devices) != 3 || devices[0].ID != 2 || devices[1].ID != 5 || devices[2].ID != 7 {
+		t.Fatalf("Devices() = %v, want IDs 2, 5, 7", devices)
+	}
+
+	m.remove(devices[1])
+	if n := len(m.Devices()); n != 2 {
+		t.Errorf("Devices() has %d entries after remove, want 2", n)
+	}
+}
+
+func TestManagerClosed(t *testing.T) {
+	m := &Manager{devices: make(map[uint32]*Device), closed: true}
+	if _, err := m.Create(DeviceParams{}, nil); !errors.Is(err, ErrManagerClosed) {
+		t.Errorf("Create on closed manager = %v, want ErrManagerClosed", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close = %v, want nil", err)
+	}
+}
+
+// nopRing stands in for a ring that is never used, only compared.
+type nopRing struct{ Ring }
+
+func TestDeviceWorkerRing(t *testing.T) {
+	shared := &nopRing{}
+	m := &Manager{devices: make(map[uint32]*Device), wqRing: shared}
+	for _, tc := range []struct {
+		name    string
+		sharing IOWQSharing
+		manager *Manager
+		want    Ring
+	}{
+		{"standalone default", IOWQShareDefault, nil, nil},
+		{"standalone manager sharing", IOWQShareManager, nil, nil},
+		{"managed default", IOWQShareDefault, m, nil},
+		{"managed manager sharing", IOWQShareManager, m, shared},
+		{"managed none", IOWQShareNone, m, nil},
+		{"managed device sharing, first queue", IOWQShareDevice, m, nil},
+	} {
+		d := &Device{params: DeviceParams{IOWQSharing: tc.sharing}, manager: tc.manager}
+		if got := d.workerRing(0); got != tc.want {
+			t.Errorf("%s: workerRing(0) = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestManagerAddDependency(t *testing.T) {
+	m := &Manager{devices: make(map[uint32]*Device)}
+	a, b, c := &Device{ID: 1, manager: m}, &Device{ID: 2, manager: m}, &Device{ID: 3, manager: m}
+	for _, d := range []*Device{a, b, c} {
+		m.add(d)
+	}
+
+	if err := m.AddDependency(b, a); err != nil {
+		t.Fatalf("AddDependency(b, a): %v", err)
+	}
+	if err := m.AddDependency(c, b); err != nil {
+		t.Fatalf("AddDependency(c, b): %v", err)
+	}
+	if err := m.AddDependency(a, c); err == nil {
+		t.Error("AddDependency(a, c) closing a cycle succeeded")
+	}
+	if err := m.AddDependency(a, a); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("AddDependency(a, a) = %v, want ErrInvalidParameters", err)
+	}
+	if err := m.AddDependency(a, &Device{ID: 9}); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("AddDependency on an untracked device = %v, want ErrInvalidParameters", err)
+	}
+
+	m.remove(b)
+	if len(m.deps[c]) != 0 {
+		t.Errorf("c still depends on %v after b was removed", m.deps[c])
+	}
+	if err := m.AddDependency(a, c); err != nil {
+		t.Errorf("AddDependency(a, c) once b is gone: %v", err)
+	}
+}
+
+func TestCloseInOrder(t *testing.T) {
+	// Created 1..4; 2 is built on 3 (created after it), 4 on 1.
+	devs := make([]*Device, 4)
+	for i := range devs {
+		devs[i] = &Device{ID: uint32(i + 1), Path: fmt.Sprintf("/dev/ublkb%d", i+1)}
+	}
+	deps := map[*Device][]*Device{devs[1]: {devs[2]}, devs[3]: {devs[0]}}
+
+	var order []uint32
+	report := closeInOrder(devs, deps, func(d *Device) error {
+		order = append(order, d.ID)
+		return nil
+	})
+	if want := []uint32{4, 2, 3, 1}; !slices.Equal(order, want) || !slices.Equal(report.Closed, want) {
+		t.Errorf("closed %v (report %v), want %v", order, report.Closed, want)
+	}
+	if err := report.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+
+	// A device that fails keeps the one it is built on open; others close.
+	order = nil
+	report = closeInOrder(devs, deps, func(d *Device) error {
+		order = append(order, d.ID)
+		if d.ID == 2 {
+			return errors.New("busy")
+		}
+		return nil
+	})
+	if want := []uint32{4, 2, 1}; !slices.Equal(order, want) {
+		t.Errorf("tried to close %v, want %v", order, want)
+	}
+	if len(report.Failed) != 2 || report.Failed[0].ID != 2 || report.Failed[1].ID != 3 {
+		t.Fatalf("Failed = %+v, want devices 2 and 3", report.Failed)
+	}
+	if err := report.Err(); err == nil || !strings.Contains(err.Error(), "/dev/ublkb2 is built on it") {
+		t.Errorf("Err() = %v, want it to say why device 3 was left open", err)
+	}
+}
+
+func TestCloseWithinTimeout(t *testing.T) {
+	d := &Device{ID: 5}
+	d.life.Lock() // Close blocks until the test lets it go
+	pending, err := closeWithin(d, 10*time.Millisecond)
+	if !pending || !IsCode(err, ErrCodeTimeout) {
+		t.Errorf("closeWithin = %v, %v; want pending and a timeout", pending, err)
+	}
+	d.closed = true
+	d.life.Unlock()
+}
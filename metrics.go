@@ -3,7 +3,10 @@ package ublk
 import (
 	"fmt"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/uring"
 )
 
 // LatencyBuckets defines the latency histogram buckets in nanoseconds.
@@ -19,13 +22,39 @@ var LatencyBuckets = []uint64{
 	10_000_000_000, // 10s
 }
 
+// SizeBuckets defines the request size histogram buckets in bytes, from
+// 4KiB to 1MiB in powers of two. Size histograms are not cumulative: a
+// request counts in the first bucket at least its size, or in a last,
+// extra bucket past the largest.
+var SizeBuckets = []uint64{
+	4 << 10,   // 4KiB
+	8 << 10,   // 8KiB
+	16 << 10,  // 16KiB
+	32 << 10,  // 32KiB
+	64 << 10,  // 64KiB
+	128 << 10, // 128KiB
+	256 << 10, // 256KiB
+	512 << 10, // 512KiB
+	1 << 20,   // 1MiB
+}
+
+// maxCountedErrno is the largest errno Metrics counts kernel errors of
+// separately (EHWPOISON); larger ones share slot 0.
+const maxCountedErrno = 133
+
 // numLatencyBuckets must match len(LatencyBuckets) - verified at init time
 const numLatencyBuckets = 8
 
+// numSizeBuckets must match len(SizeBuckets) - verified at init time
+const numSizeBuckets = 9
+
 func init() {
 	if len(LatencyBuckets) != numLatencyBuckets {
 		panic(fmt.Sprintf("numLatencyBuckets (%d) does not match len(LatencyBuckets) (%d)", numLatencyBuckets, len(LatencyBuckets)))
 	}
+	if len(SizeBuckets) != numSizeBuckets {
+		panic(fmt.Sprintf("numSizeBuckets (%d) does not match len(SizeBuckets) (%d)", numSizeBuckets, len(SizeBuckets)))
+	}
 }
 
 // Metrics tracks performance and operational statistics for ublk devices
@@ -52,6 +81,28 @@ type Metrics struct {
 	QueueDepthCount atomic.Uint64 // Number of queue depth measurements
 	MaxQueueDepth   atomic.Uint32 // Maximum observed queue depth
 
+	// Backpressure
+	RingFullEvents atomic.Uint64 // Commits deferred because the submission ring was full
+	QueueStalls    atomic.Uint64 // Requests held in userspace past the stall threshold
+	CQOverflows    atomic.Uint64 // Completions collected from the kernel's backlog after the CQ filled
+
+	// Requests with an op the queues do not handle, e.g. from a newer kernel
+	UnknownOps atomic.Uint64
+	// Requests with UBLK_IO_F_* flags the queues do not know, served without them
+	UnknownFlags atomic.Uint64
+
+	// Queue command completions the kernel failed, by errno (see
+	// RecordKernelError); slot 0 counts errnos above maxCountedErrno
+	kernelErrors [maxCountedErrno + 1]atomic.Uint64
+
+	// Background scrubber (DeviceParams.Scrub)
+	ScrubBytes     atomic.Uint64 // Bytes read by the scrubber
+	ScrubErrors    atomic.Uint64 // Scrub reads that failed or did not verify
+	ScrubPasses    atomic.Uint64 // Completed passes over the whole device
+	ScrubOffset    atomic.Int64  // Position in the current pass
+	ScrubSize      atomic.Int64  // Length of the current pass (0 = none started)
+	ScrubPassStart atomic.Int64  // Current pass start timestamp (UnixNano)
+
 	// Performance tracking
 	TotalLatencyNs atomic.Uint64 // Cumulative operation latency in nanoseconds
 	OpCount        atomic.Uint64 // Total operations (for average latency calculation)
@@ -60,9 +111,75 @@ type Metrics struct {
 	// Each bucket[i] contains the count of operations with latency <= LatencyBuckets[i]
 	LatencyBuckets [numLatencyBuckets]atomic.Uint64
 
+	// Where each request's time went, to tell a slow backend from slow
+	// plumbing (see PhaseObserver)
+	DispatchLatency LatencyHistogram // From the request's arrival (FETCH completion) to the backend call
+	BackendLatency  LatencyHistogram // In the backend call
+	RefetchLatency  LatencyHistogram // From the tag's previous commit to the request's arrival
+
+	// The workload's request sizes, by op, for choosing MaxIOSize, chunk
+	// sizes and cache policies
+	ReadSizes    SizeHistogram
+	WriteSizes   SizeHistogram
+	DiscardSizes SizeHistogram
+
 	// Device lifecycle
-	StartTime atomic.Int64 // Device start timestamp (UnixNano)
-	StopTime  atomic.Int64 // Device stop timestamp (UnixNano)
+	StartTime   atomic.Int64  // Device start timestamp (UnixNano)
+	StopTime    atomic.Int64  // Device stop timestamp (UnixNano)
+	StopFlushNs atomic.Uint64 // Duration of the last flush on stop (Options.FlushOnStop)
+
+	// Reads the queue threads' CPU time; set by the device when its queues
+	// start
+	queueCPU atomic.Pointer[func() []QueueCPU]
+	// Reads the queue rings' statistics; set with queueCPU
+	queueRings atomic.Pointer[func() []QueueRingStats]
+}
+
+// QueueCPU is the CPU time a queue thread has used since the device's
+// queues were last started. A thread that uses close to a full second per
+// second has saturated its core; more queues spread the load. Backend calls
+// on DeviceParams.BackendWorkers run on other threads and are not counted.
+type QueueCPU struct {
+	Queue    int    // Queue ID; with SharedRing one entry, queue 0, covers the shared thread
+	UserNs   uint64 // Time in userspace
+	SystemNs uint64 // Time in the kernel, including io_uring submission
+}
+
+// setQueueCPU makes Snapshot report the CPU time read by f.
+func (m *Metrics) setQueueCPU(f func() []QueueCPU) {
+	m.queueCPU.Store(&f)
+}
+
+// QueueRingStats is a queue ring's io_uring traffic since the queues were
+// last started, for sizing QueueDepth and the rings from data: a low
+// SubmitsPerEnter means commits are not being batched, peaks near the
+// ring sizes or SQFull events mean the ring is too small.
+type QueueRingStats struct {
+	Queue     int    // Queue ID; with SharedRing one entry, queue 0, covers the shared ring
+	SQEntries uint32 // Ring sizes, 0 if the ring does not report them
+	CQEntries uint32
+	RingStats
+}
+
+// SQUtilization is the peak share of the SQ one io_uring_enter used (0-1).
+func (s QueueRingStats) SQUtilization() float64 {
+	if s.SQEntries == 0 {
+		return 0
+	}
+	return float64(s.PeakSQ) / float64(s.SQEntries)
+}
+
+// CQUtilization is the peak share of the CQ found full at once (0-1).
+func (s QueueRingStats) CQUtilization() float64 {
+	if s.CQEntries == 0 {
+		return 0
+	}
+	return float64(s.PeakCQ) / float64(s.CQEntries)
+}
+
+// setQueueRings makes Snapshot report the ring statistics read by f.
+func (m *Metrics) setQueueRings(f func() []QueueRingStats) {
+	m.queueRings.Store(&f)
 }
 
 // NewMetrics creates a new metrics instance
@@ -75,6 +192,7 @@ func NewMetrics() *Metrics {
 // RecordRead records a read operation
 func (m *Metrics) RecordRead(bytes uint64, latencyNs uint64, success bool) {
 	m.ReadOps.Add(1)
+	m.ReadSizes.record(bytes)
 	if success {
 		m.ReadBytes.Add(bytes)
 	} else {
@@ -86,6 +204,7 @@ func (m *Metrics) RecordRead(bytes uint64, latencyNs uint64, success bool) {
 // RecordWrite records a write operation
 func (m *Metrics) RecordWrite(bytes uint64, latencyNs uint64, success bool) {
 	m.WriteOps.Add(1)
+	m.WriteSizes.record(bytes)
 	if success {
 		m.WriteBytes.Add(bytes)
 	} else {
@@ -97,6 +216,7 @@ func (m *Metrics) RecordWrite(bytes uint64, latencyNs uint64, success bool) {
 // RecordDiscard records a discard operation
 func (m *Metrics) RecordDiscard(bytes uint64, latencyNs uint64, success bool) {
 	m.DiscardOps.Add(1)
+	m.DiscardSizes.record(bytes)
 	if success {
 		m.DiscardBytes.Add(bytes)
 	} else {
@@ -144,6 +264,144 @@ func (m *Metrics) recordLatency(latencyNs uint64) {
 	}
 }
 
+// RecordPhases records where a request's time went.
+func (m *Metrics) RecordPhases(dispatchNs, backendNs, refetchNs uint64) {
+	m.DispatchLatency.record(dispatchNs)
+	m.BackendLatency.record(backendNs)
+	if refetchNs > 0 { // 0 for a tag's first request
+		m.RefetchLatency.record(refetchNs)
+	}
+}
+
+// RecordKernelError records a queue command completion the kernel failed
+// with errno.
+func (m *Metrics) RecordKernelError(errno syscall.Errno) {
+	if errno > maxCountedErrno {
+		errno = 0
+	}
+	m.kernelErrors[errno].Add(1)
+}
+
+// kernelErrorCounts returns the kernel errors recorded, by errno name.
+func (m *Metrics) kernelErrorCounts() map[string]uint64 {
+	var counts map[string]uint64
+	for i := range m.kernelErrors {
+		n := m.kernelErrors[i].Load()
+		if n == 0 {
+			continue
+		}
+		if counts == nil {
+			counts = make(map[string]uint64)
+		}
+		name := "other"
+		if i > 0 {
+			name = uring.ErrnoName(syscall.Errno(i))
+		}
+		counts[name] += n
+	}
+	return counts
+}
+
+// LatencyHistogram counts durations in the LatencyBuckets.
+type LatencyHistogram struct {
+	Buckets [numLatencyBuckets]atomic.Uint64 // Cumulative: Buckets[i] counts durations <= LatencyBuckets[i]
+	TotalNs atomic.Uint64
+	Count   atomic.Uint64
+}
+
+func (h *LatencyHistogram) record(ns uint64) {
+	h.TotalNs.Add(ns)
+	h.Count.Add(1)
+	for i, bucket := range LatencyBuckets {
+		if ns <= bucket {
+			h.Buckets[i].Add(1)
+		}
+	}
+}
+
+func (h *LatencyHistogram) reset() {
+	h.TotalNs.Store(0)
+	h.Count.Store(0)
+	for i := range h.Buckets {
+		h.Buckets[i].Store(0)
+	}
+}
+
+// LatencySummary is a point-in-time view of a LatencyHistogram.
+type LatencySummary struct {
+	Count     uint64
+	AvgNs     uint64
+	P50Ns     uint64
+	P99Ns     uint64
+	Histogram [numLatencyBuckets]uint64 // Cumulative bucket counts
+}
+
+func (h *LatencyHistogram) summary() LatencySummary {
+	s := LatencySummary{Count: h.Count.Load()}
+	for i := range s.Histogram {
+		s.Histogram[i] = h.Buckets[i].Load()
+	}
+	if s.Count > 0 {
+		s.AvgNs = h.TotalNs.Load() / s.Count
+		s.P50Ns = histogramPercentile(s.Histogram, s.Count, 0.50)
+		s.P99Ns = histogramPercentile(s.Histogram, s.Count, 0.99)
+	}
+	return s
+}
+
+// SizeHistogram counts request sizes in the SizeBuckets, failed requests
+// included.
+type SizeHistogram struct {
+	Buckets [numSizeBuckets + 1]atomic.Uint64 // Last: larger than every bucket
+}
+
+func (h *SizeHistogram) record(bytes uint64) {
+	for i, bucket := range SizeBuckets {
+		if bytes <= bucket {
+			h.Buckets[i].Add(1)
+			return
+		}
+	}
+	h.Buckets[numSizeBuckets].Add(1)
+}
+
+func (h *SizeHistogram) reset() {
+	for i := range h.Buckets {
+		h.Buckets[i].Store(0)
+	}
+}
+
+func (h *SizeHistogram) counts() SizeCounts {
+	var c SizeCounts
+	for i := range c {
+		c[i] = h.Buckets[i].Load()
+	}
+	return c
+}
+
+// SizeCounts is a point-in-time view of a SizeHistogram: c[i] requests
+// were larger than SizeBuckets[i-1] and at most SizeBuckets[i], and the
+// last entry counts those larger than every bucket.
+type SizeCounts [numSizeBuckets + 1]uint64
+
+// Total is the number of requests counted.
+func (c SizeCounts) Total() uint64 {
+	var total uint64
+	for _, n := range c {
+		total += n
+	}
+	return total
+}
+
+// Share is the fraction of requests counted in bucket i (0-1).
+func (c SizeCounts) Share(i int) float64 {
+	total := c.Total()
+	if total == 0 || i < 0 || i >= len(c) {
+		return 0
+	}
+	return float64(c[i]) / float64(total)
+}
+
 // Stop marks the device as stopped
 func (m *Metrics) Stop() {
 	m.StopTime.Store(time.Now().UnixNano())
@@ -172,9 +430,37 @@ type MetricsSnapshot struct {
 	AvgQueueDepth float64
 	MaxQueueDepth uint32
 
+	// Backpressure
+	RingFullEvents uint64
+	QueueStalls    uint64
+	CQOverflows    uint64
+
+	// Requests with an op the queues do not handle
+	UnknownOps uint64
+	// Requests with flags the queues do not know
+	UnknownFlags uint64
+
+	// Queue command completions the kernel failed, by errno name (e.g.
+	// "ENODEV" when it aborted the queues); nil if there were none
+	KernelErrors map[string]uint64
+
+	// Background scrubber
+	ScrubBytes    uint64
+	ScrubErrors   uint64
+	ScrubPasses   uint64
+	ScrubProgress float64 // Fraction of the current pass done (0-1)
+	ScrubETANs    uint64  // Estimated time left in the current pass
+
 	// Performance
 	AvgLatencyNs uint64
 	UptimeNs     uint64
+	StopFlushNs  uint64 // Duration of the last flush on stop
+
+	// CPU time of each queue thread
+	QueueCPU []QueueCPU
+
+	// io_uring traffic of each queue ring that reports it
+	QueueRings []QueueRingStats
 
 	// Latency percentiles (in nanoseconds)
 	LatencyP50Ns  uint64 // 50th percentile (median)
@@ -184,6 +470,16 @@ type MetricsSnapshot struct {
 	// Histogram bucket counts (cumulative)
 	LatencyHistogram [numLatencyBuckets]uint64
 
+	// Request time split into plumbing and backend
+	Dispatch LatencySummary // Arrival to backend call
+	Backend  LatencySummary // Backend call
+	Refetch  LatencySummary // Previous commit on the tag to arrival
+
+	// Request sizes by op (see SizeCounts)
+	ReadSizes    SizeCounts
+	WriteSizes   SizeCounts
+	DiscardSizes SizeCounts
+
 	// Computed statistics
 	ReadIOPS       float64 // Operations per second
 	WriteIOPS      float64
@@ -209,7 +505,28 @@ func (m *Metrics) Snapshot() MetricsSnapshot {
 		DiscardErrors: m.DiscardErrors.Load(),
 		FlushErrors:   m.FlushErrors.Load(),
 		MaxQueueDepth: m.MaxQueueDepth.Load(),
+
+		RingFullEvents: m.RingFullEvents.Load(),
+		QueueStalls:    m.QueueStalls.Load(),
+		CQOverflows:    m.CQOverflows.Load(),
+		UnknownOps:     m.UnknownOps.Load(),
+		UnknownFlags:   m.UnknownFlags.Load(),
+
+		ScrubBytes:  m.ScrubBytes.Load(),
+		ScrubErrors: m.ScrubErrors.Load(),
+		ScrubPasses: m.ScrubPasses.Load(),
+
+		StopFlushNs: m.StopFlushNs.Load(),
 	}
+	if f := m.queueCPU.Load(); f != nil {
+		snap.QueueCPU = (*f)()
+	}
+	if f := m.queueRings.Load(); f != nil {
+		snap.QueueRings = (*f)()
+	}
+	snap.KernelErrors = m.kernelErrorCounts()
+	scrubProgress, scrubETA := m.scrubProgress()
+	snap.ScrubProgress, snap.ScrubETANs = scrubProgress, uint64(scrubETA)
 
 	// Calculate derived statistics
 	snap.TotalOps = snap.ReadOps + snap.WriteOps + snap.DiscardOps + snap.FlushOps
@@ -258,6 +575,13 @@ func (m *Metrics) Snapshot() MetricsSnapshot {
 		snap.LatencyHistogram[i] = m.LatencyBuckets[i].Load()
 	}
 
+	snap.Dispatch = m.DispatchLatency.summary()
+	snap.Backend = m.BackendLatency.summary()
+	snap.Refetch = m.RefetchLatency.summary()
+	snap.ReadSizes = m.ReadSizes.counts()
+	snap.WriteSizes = m.WriteSizes.counts()
+	snap.DiscardSizes = m.DiscardSizes.counts()
+
 	// Calculate percentiles from histogram
 	if opCount > 0 {
 		snap.LatencyP50Ns = m.calculatePercentile(0.50)
@@ -271,7 +595,16 @@ func (m *Metrics) Snapshot() MetricsSnapshot {
 // calculatePercentile estimates the latency at the given percentile (0.0-1.0)
 // using linear interpolation between histogram buckets.
 func (m *Metrics) calculatePercentile(percentile float64) uint64 {
-	totalOps := m.OpCount.Load()
+	var hist [numLatencyBuckets]uint64
+	for i := range hist {
+		hist[i] = m.LatencyBuckets[i].Load()
+	}
+	return histogramPercentile(hist, m.OpCount.Load(), percentile)
+}
+
+// histogramPercentile estimates the latency at the given percentile from
+// cumulative bucket counts over totalOps operations.
+func histogramPercentile(hist [numLatencyBuckets]uint64, totalOps uint64, percentile float64) uint64 {
 	if totalOps == 0 {
 		return 0
 	}
@@ -281,12 +614,12 @@ func (m *Metrics) calculatePercentile(percentile float64) uint64 {
 	// Find the bucket containing the target percentile
 	prevBucket := uint64(0)
 	for i, bucket := range LatencyBuckets {
-		bucketCount := m.LatencyBuckets[i].Load()
+		bucketCount := hist[i]
 		if bucketCount >= targetCount {
 			// Linear interpolation within bucket
 			prevCount := uint64(0)
 			if i > 0 {
-				prevCount = m.LatencyBuckets[i-1].Load()
+				prevCount = hist[i-1]
 			}
 			if bucketCount == prevCount {
 				return bucket
@@ -318,11 +651,32 @@ func (m *Metrics) Reset() {
 	m.QueueDepthTotal.Store(0)
 	m.QueueDepthCount.Store(0)
 	m.MaxQueueDepth.Store(0)
+	m.RingFullEvents.Store(0)
+	m.QueueStalls.Store(0)
+	m.CQOverflows.Store(0)
+	m.UnknownOps.Store(0)
+	m.UnknownFlags.Store(0)
+	for i := range m.kernelErrors {
+		m.kernelErrors[i].Store(0)
+	}
+	m.ScrubBytes.Store(0)
+	m.ScrubErrors.Store(0)
+	m.ScrubPasses.Store(0)
+	m.ScrubOffset.Store(0)
+	m.ScrubSize.Store(0)
+	m.ScrubPassStart.Store(0)
+	m.StopFlushNs.Store(0)
 	m.TotalLatencyNs.Store(0)
 	m.OpCount.Store(0)
 	for i := 0; i < numLatencyBuckets; i++ {
 		m.LatencyBuckets[i].Store(0)
 	}
+	m.DispatchLatency.reset()
+	m.BackendLatency.reset()
+	m.RefetchLatency.reset()
+	m.ReadSizes.reset()
+	m.WriteSizes.reset()
+	m.DiscardSizes.reset()
 	m.StartTime.Store(time.Now().UnixNano())
 	m.StopTime.Store(0)
 }
@@ -345,6 +699,54 @@ type Observer interface {
 	ObserveQueueDepth(depth uint32)
 }
 
+// QueueObserver is an optional extension of Observer. If the Observer in
+// Options also implements QueueObserver, it additionally receives events from
+// the ublk protocol layer, not just backend operations. Methods are called
+// from the queue I/O loops (OnIOError also from backend workers) and must be
+// thread-safe and fast.
+type QueueObserver interface {
+	// OnFetchCompleted is called when the kernel hands a request to a tag,
+	// i.e. a FETCH_REQ or COMMIT_AND_FETCH_REQ completes. result is the
+	// CQE result (0 = request ready, negative = errno).
+	OnFetchCompleted(queueID, tag uint16, result int32)
+
+	// OnCommitSubmitted is called when a tag's COMMIT_AND_FETCH_REQ is
+	// prepared. result is the value reported to the kernel: bytes
+	// transferred, or a negative errno.
+	OnCommitSubmitted(queueID, tag uint16, result int32)
+
+	// OnQueueStall is called when a request stayed in userspace (fetched
+	// but not committed) for longer than DeviceParams.StallThreshold.
+	OnQueueStall(queueID, tag uint16, stalled time.Duration)
+
+	// OnRingFull is called when a commit could not be queued because the
+	// submission ring was full. The commit is retried after the loop's next
+	// flush.
+	OnRingFull(queueID uint16)
+
+	// OnIOError is called when the backend fails a request. op is the
+	// UBLK_IO_OP_* code; offset and length are in bytes.
+	OnIOError(queueID, tag uint16, op uint8, offset uint64, length uint32, err error)
+}
+
+// PhaseObserver is an optional extension of Observer. If the Observer in
+// Options also implements PhaseObserver, it receives, for every request
+// the backend served, how long the request took in each phase:
+//
+//   - dispatchNs, from the FETCH completion that handed the request to
+//     the queue until the backend call, covering the queue loop and
+//     waiting for a BackendWorker;
+//   - backendNs, the backend call itself;
+//   - refetchNs, from the commit of the tag's previous request until this
+//     request arrived, which is kernel and io_uring time under load and
+//     idle time otherwise (0 for a tag's first request).
+//
+// It is called from the queue I/O loops or backend workers and must be
+// thread-safe and fast. MetricsObserver records the phases in Metrics.
+type PhaseObserver interface {
+	ObservePhases(dispatchNs, backendNs, refetchNs uint64)
+}
+
 // NoOpObserver is a no-op implementation of Observer
 type NoOpObserver struct{}
 
@@ -384,6 +786,31 @@ func (o *MetricsObserver) ObserveQueueDepth(depth uint32) {
 	o.metrics.RecordQueueDepth(depth)
 }
 
+func (o *MetricsObserver) ObservePhases(dispatchNs, backendNs, refetchNs uint64) {
+	o.metrics.RecordPhases(dispatchNs, backendNs, refetchNs)
+}
+
+func (o *MetricsObserver) OnFetchCompleted(queueID, tag uint16, result int32) {
+	if result < 0 {
+		o.metrics.RecordKernelError(syscall.Errno(-result))
+	}
+}
+
+func (o *MetricsObserver) OnCommitSubmitted(queueID, tag uint16, result int32) {}
+
+func (o *MetricsObserver) OnQueueStall(queueID, tag uint16, stalled time.Duration) {
+	o.metrics.QueueStalls.Add(1)
+}
+
+func (o *MetricsObserver) OnRingFull(queueID uint16) {
+	o.metrics.RingFullEvents.Add(1)
+}
+
+func (o *MetricsObserver) OnIOError(queueID, tag uint16, op uint8, offset uint64, length uint32, err error) {
+}
+
 // Compile-time interface check
 var _ Observer = (*MetricsObserver)(nil)
+var _ QueueObserver = (*MetricsObserver)(nil)
+var _ PhaseObserver = (*MetricsObserver)(nil)
 var _ Observer = (*NoOpObserver)(nil)
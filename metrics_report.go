@@ -0,0 +1,135 @@
+package ublk
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultMetricsInterval is used when Options.MetricsFile or
+// Options.LogMetrics is set without an interval.
+const DefaultMetricsInterval = 10 * time.Second
+
+// metricsReporter periodically writes a device's MetricsSnapshot to a file
+// and/or logs a one-line summary of the last interval.
+type metricsReporter struct {
+	metrics  *Metrics
+	name     string // prefix for log lines, e.g. "ublkb0"
+	file     string // "" to skip the file
+	logger   Logger // nil to skip the summary
+	interval time.Duration
+
+	prev   MetricsSnapshot
+	prevAt time.Time
+}
+
+// newMetricsReporter returns nil if options ask for neither a metrics file
+// nor a log summary.
+func newMetricsReporter(metrics *Metrics, name string, options *Options) *metricsReporter {
+	if metrics == nil || options == nil {
+		return nil
+	}
+	var logger Logger
+	if options.LogMetrics {
+		logger = options.Logger
+	}
+	if options.MetricsFile == "" && logger == nil {
+		return nil
+	}
+	interval := options.MetricsInterval
+	if interval <= 0 {
+		interval = DefaultMetricsInterval
+	}
+	return &metricsReporter{
+		metrics:  metrics,
+		name:     name,
+		file:     options.MetricsFile,
+		logger:   logger,
+		interval: interval,
+	}
+}
+
+// run reports every interval until ctx is done, then writes the file one
+// last time so it reflects the final counters.
+func (r *metricsReporter) run(ctx context.Context) {
+	r.prev = r.metrics.Snapshot()
+	r.prevAt = time.Now()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if r.file != "" {
+				r.writeFile(r.metrics.Snapshot())
+			}
+			return
+		case now := <-ticker.C:
+			r.report(now)
+		}
+	}
+}
+
+// report writes and/or logs one snapshot.
+func (r *metricsReporter) report(now time.Time) {
+	snap := r.metrics.Snapshot()
+	if r.file != "" {
+		r.writeFile(snap)
+	}
+	if r.logger != nil {
+		r.logger.Printf("%s: %s", r.name, metricsSummary(r.prev, snap, now.Sub(r.prevAt)))
+	}
+	r.prev, r.prevAt = snap, now
+}
+
+func (r *metricsReporter) writeFile(snap MetricsSnapshot) {
+	if err := replaceJSONFile(r.file, snap); err != nil && r.logger != nil {
+		r.logger.Printf("%s: failed to write metrics file: %v", r.name, err)
+	}
+}
+
+// metricsSummary describes the interval between prev and cur in one line.
+// Rates, p99 and the busiest queue thread's CPU use cover only that
+// interval; the error count is cumulative.
+func metricsSummary(prev, cur MetricsSnapshot, elapsed time.Duration) string {
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+
+	readOps := cur.ReadOps - prev.ReadOps
+	writeOps := cur.WriteOps - prev.WriteOps
+	bytes := cur.TotalBytes - prev.TotalBytes
+
+	var hist [numLatencyBuckets]uint64
+	for i := range hist {
+		hist[i] = cur.LatencyHistogram[i] - prev.LatencyHistogram[i]
+	}
+	p99 := histogramPercentile(hist, cur.TotalOps-prev.TotalOps, 0.99)
+
+	errors := cur.ReadErrors + cur.WriteErrors + cur.DiscardErrors + cur.FlushErrors
+	summary := fmt.Sprintf("%.0f IOPS (read %.0f, write %.0f), %.1f MB/s, p99 %v, errors %d",
+		float64(readOps+writeOps)/seconds,
+		float64(readOps)/seconds,
+		float64(writeOps)/seconds,
+		float64(bytes)/seconds/1e6,
+		time.Duration(p99),
+		errors)
+
+	if len(cur.QueueCPU) > 0 && len(prev.QueueCPU) == len(cur.QueueCPU) {
+		busiest, busiestNs := 0, uint64(0)
+		for i, q := range cur.QueueCPU {
+			used := q.UserNs + q.SystemNs
+			// Restarted queues count from zero again
+			if before := prev.QueueCPU[i].UserNs + prev.QueueCPU[i].SystemNs; before <= used {
+				used -= before
+			}
+			if used > busiestNs {
+				busiest, busiestNs = q.Queue, used
+			}
+		}
+		summary += fmt.Sprintf(", busiest queue %d at %.0f%% CPU", busiest, float64(busiestNs)/1e9/seconds*100)
+	}
+	return summary
+}
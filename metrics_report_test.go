@@ -0,0 +1,155 @@
+package ublk
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.json")
+
+	m := NewMetrics()
+	m.RecordRead(4096, 50_000, true)
+	if err := replaceJSONFile(path, m.Snapshot()); err != nil {
+		t.Fatalf("replaceJSONFile: %v", err)
+	}
+	m.RecordWrite(8192, 50_000, true)
+	if err := replaceJSONFile(path, m.Snapshot()); err != nil {
+		t.Fatalf("replaceJSONFile (replace): %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap MetricsSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatalf("metrics file is not valid JSON: %v", err)
+	}
+	if snap.ReadOps != 1 || snap.WriteOps != 1 || snap.WriteBytes != 8192 {
+		t.Errorf("unexpected snapshot in file: %+v", snap)
+	}
+
+	// The temporary file must have been renamed, not left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the metrics file in %s, got %d entries", dir, len(entries))
+	}
+}
+
+func TestMetricsSummary(t *testing.T) {
+	m := NewMetrics()
+	m.RecordRead(4096, 5_000_000, true) // Before the interval; must not count
+	m.RecordWrite(0, 5_000, false)      // Errors are reported cumulatively
+	prev := m.Snapshot()
+
+	for i := 0; i < 100; i++ {
+		m.RecordRead(1_000_000, 5_000, true)
+		m.RecordWrite(1_000_000, 5_000, true)
+	}
+	cur := m.Snapshot()
+
+	// 200 ops over 2s; p99 interpolates inside the 1us-10us bucket
+	got := metricsSummary(prev, cur, 2*time.Second)
+	want := "100 IOPS (read 50, write 50), 100.0 MB/s, p99 9.91µs, errors 1"
+	if got != want {
+		t.Errorf("metricsSummary = %q, want %q", got, want)
+	}
+}
+
+func TestMetricsSummaryQueueCPU(t *testing.T) {
+	m := NewMetrics()
+	cpu := []QueueCPU{{Queue: 0}, {Queue: 1}}
+	m.setQueueCPU(func() []QueueCPU { return slices.Clone(cpu) })
+	prev := m.Snapshot()
+
+	// Queue 1 used 1.5s of CPU over the 2s interval
+	cpu[0].UserNs, cpu[0].SystemNs = 100e6, 100e6
+	cpu[1].UserNs, cpu[1].SystemNs = 500e6, 1000e6
+	cur := m.Snapshot()
+	if !slices.Equal(cur.QueueCPU, cpu) {
+		t.Fatalf("Snapshot().QueueCPU = %+v, want %+v", cur.QueueCPU, cpu)
+	}
+
+	got := metricsSummary(prev, cur, 2*time.Second)
+	want := "0 IOPS (read 0, write 0), 0.0 MB/s, p99 0s, errors 0, busiest queue 1 at 75% CPU"
+	if got != want {
+		t.Errorf("metricsSummary = %q, want %q", got, want)
+	}
+}
+
+type recordingLogger struct {
+	lines chan string
+}
+
+func (l *recordingLogger) Printf(format string, args ...interface{}) {
+	l.lines <- fmt.Sprintf(format, args...)
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {}
+
+func TestMetricsReporter(t *testing.T) {
+	if r := newMetricsReporter(NewMetrics(), "ublkb0", &Options{}); r != nil {
+		t.Error("expected no reporter when nothing is configured")
+	}
+	if r := newMetricsReporter(NewMetrics(), "ublkb0", &Options{LogMetrics: true}); r != nil {
+		t.Error("expected no reporter for LogMetrics without a Logger")
+	}
+
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	logger := &recordingLogger{lines: make(chan string, 16)}
+	m := NewMetrics()
+	r := newMetricsReporter(m, "ublkb0", &Options{
+		Logger:          logger,
+		LogMetrics:      true,
+		MetricsFile:     path,
+		MetricsInterval: 10 * time.Millisecond,
+	})
+	if r == nil {
+		t.Fatal("expected a reporter")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.run(ctx)
+		close(done)
+	}()
+
+	select {
+	case line := <-logger.lines:
+		if !strings.HasPrefix(line, "ublkb0: ") || !strings.Contains(line, "IOPS") {
+			t.Errorf("unexpected summary line %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no summary logged")
+	}
+
+	// The final write on shutdown must include operations after the last tick
+	m.RecordWrite(512, 1_000, true)
+	cancel()
+	<-done
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap MetricsSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.WriteOps != 1 {
+		t.Errorf("expected final snapshot with 1 write, got %d", snap.WriteOps)
+	}
+}
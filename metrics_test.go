@@ -1,8 +1,14 @@
 package ublk
 
 import (
+	"bytes"
+	"maps"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
 )
 
 func TestMetrics(t *testing.T) {
@@ -174,6 +180,17 @@ func TestObserver(t *testing.T) {
 	if snap.WriteBytes != 2048 {
 		t.Errorf("Expected 2048 write bytes from observer, got %d", snap.WriteBytes)
 	}
+
+	metricsObserver.OnRingFull(0)
+	metricsObserver.OnRingFull(1)
+	metricsObserver.OnQueueStall(0, 3, 2*time.Second)
+	snap = m.Snapshot()
+	if snap.RingFullEvents != 2 {
+		t.Errorf("Expected 2 ring-full events from observer, got %d", snap.RingFullEvents)
+	}
+	if snap.QueueStalls != 1 {
+		t.Errorf("Expected 1 queue stall from observer, got %d", snap.QueueStalls)
+	}
 }
 
 func TestMetricsRates(t *testing.T) {
@@ -253,3 +270,154 @@ func TestMetricsHistogram(t *testing.T) {
 		t.Error("Expected histogram buckets to be populated")
 	}
 }
+
+func TestMetricsPhases(t *testing.T) {
+	m := NewMetrics()
+	obs := NewMetricsObserver(m)
+	obs.ObservePhases(20_000, 500_000, 0) // A tag's first request
+	for range 9 {
+		obs.ObservePhases(20_000, 500_000, 2_000_000)
+	}
+
+	snap := m.Snapshot()
+	if snap.Dispatch.Count != 10 || snap.Backend.Count != 10 {
+		t.Errorf("counted %d dispatch and %d backend phases, want 10", snap.Dispatch.Count, snap.Backend.Count)
+	}
+	if snap.Refetch.Count != 9 {
+		t.Errorf("counted %d refetch phases, want 9 (not the first request)", snap.Refetch.Count)
+	}
+	if snap.Backend.AvgNs != 500_000 || snap.Refetch.AvgNs != 2_000_000 {
+		t.Errorf("average backend %dns, refetch %dns", snap.Backend.AvgNs, snap.Refetch.AvgNs)
+	}
+	if snap.Dispatch.P99Ns > snap.Backend.P50Ns {
+		t.Errorf("dispatch P99 %dns above backend P50 %dns", snap.Dispatch.P99Ns, snap.Backend.P50Ns)
+	}
+
+	m.Reset()
+	if snap := m.Snapshot(); snap.Dispatch.Count != 0 || snap.Refetch.Histogram != [numLatencyBuckets]uint64{} {
+		t.Errorf("phases survived Reset: %+v", snap.Dispatch)
+	}
+}
+
+func TestMetricsRequestSizes(t *testing.T) {
+	m := NewMetrics()
+	obs := NewMetricsObserver(m)
+	for range 3 {
+		obs.ObserveRead(4096, 1000, true)
+	}
+	obs.ObserveRead(512, 1000, true)      // Below the smallest bucket
+	obs.ObserveRead(6<<10, 1000, false)   // Failed requests count too
+	obs.ObserveWrite(128<<10, 1000, true) // On a bucket edge
+	obs.ObserveWrite(4<<20, 1000, true)   // Past the largest bucket
+	obs.ObserveDiscard(1<<20, 1000, true)
+
+	snap := m.Snapshot()
+	if snap.ReadSizes[0] != 4 || snap.ReadSizes[1] != 1 || snap.ReadSizes.Total() != 5 {
+		t.Errorf("read sizes %v", snap.ReadSizes)
+	}
+	if got := snap.ReadSizes.Share(0); got != 0.8 {
+		t.Errorf("4KiB share of reads = %v, want 0.8", got)
+	}
+	if snap.WriteSizes[5] != 1 || snap.WriteSizes[numSizeBuckets] != 1 {
+		t.Errorf("write sizes %v", snap.WriteSizes)
+	}
+	if snap.DiscardSizes[numSizeBuckets-1] != 1 || snap.DiscardSizes.Total() != 1 {
+		t.Errorf("discard sizes %v", snap.DiscardSizes)
+	}
+
+	m.Reset()
+	if snap := m.Snapshot(); snap.ReadSizes.Total() != 0 || snap.WriteSizes != (SizeCounts{}) {
+		t.Errorf("sizes survived Reset: %v %v", snap.ReadSizes, snap.WriteSizes)
+	}
+}
+
+func TestMetricsKernelErrors(t *testing.T) {
+	m := NewMetrics()
+	obs := NewMetricsObserver(m)
+	obs.OnFetchCompleted(0, 1, 0)
+	obs.OnFetchCompleted(0, 1, -int32(syscall.ENODEV))
+	obs.OnFetchCompleted(1, 2, -int32(syscall.ENODEV))
+	obs.OnFetchCompleted(0, 3, -int32(syscall.EBUSY))
+	obs.OnFetchCompleted(0, 3, -4096)
+
+	want := map[string]uint64{"ENODEV": 2, "EBUSY": 1, "other": 1}
+	if got := m.Snapshot().KernelErrors; !maps.Equal(got, want) {
+		t.Errorf("KernelErrors = %v, want %v", got, want)
+	}
+	m.Reset()
+	if got := m.Snapshot().KernelErrors; got != nil {
+		t.Errorf("KernelErrors after Reset = %v, want nil", got)
+	}
+}
+
+func TestMetricsQueueRings(t *testing.T) {
+	m := NewMetrics()
+	if got := m.Snapshot().QueueRings; got != nil {
+		t.Errorf("QueueRings before the queues start = %v, want nil", got)
+	}
+
+	ring := QueueRingStats{
+		Queue:     1,
+		SQEntries: 64,
+		CQEntries: 128,
+		RingStats: RingStats{Enters: 10, Submitted: 40, Reaps: 8, Completions: 48, PeakSQ: 16, PeakCQ: 32},
+	}
+	m.setQueueRings(func() []QueueRingStats { return []QueueRingStats{ring} })
+	got := m.Snapshot().QueueRings
+	if len(got) != 1 || got[0] != ring {
+		t.Fatalf("QueueRings = %+v, want %+v", got, ring)
+	}
+	if s := got[0].SubmitsPerEnter(); s != 4 {
+		t.Errorf("SubmitsPerEnter = %v, want 4", s)
+	}
+	if c := got[0].CQEsPerReap(); c != 6 {
+		t.Errorf("CQEsPerReap = %v, want 6", c)
+	}
+	if sq, cq := got[0].SQUtilization(), got[0].CQUtilization(); sq != 0.25 || cq != 0.25 {
+		t.Errorf("utilization = %v SQ, %v CQ; want 0.25 each", sq, cq)
+	}
+	if u := (QueueRingStats{}).SQUtilization(); u != 0 {
+		t.Errorf("SQUtilization of an unsized ring = %v, want 0", u)
+	}
+}
+
+func TestDeviceUnknownOp(t *testing.T) {
+	var buf bytes.Buffer
+	prev := logging.Default()
+	logging.SetDefault(logging.NewLogger(&logging.Config{Level: logging.LevelInfo, Output: &buf}))
+	defer logging.SetDefault(prev)
+
+	d := &Device{Path: "/dev/ublkb3", metrics: NewMetrics()}
+	d.unknownOp(0, 0x30)
+	d.unknownOp(1, 0x30)
+	d.unknownOp(0, 0xc1)
+
+	if n := d.metrics.Snapshot().UnknownOps; n != 3 {
+		t.Errorf("UnknownOps = %d, want 3", n)
+	}
+	if n := strings.Count(buf.String(), "op this version does not handle"); n != 2 {
+		t.Errorf("logged %d lines, want one per op:\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "op=48") || !strings.Contains(buf.String(), "op=193") {
+		t.Errorf("log %q does not name both ops", buf.String())
+	}
+}
+
+func TestDeviceUnknownFlags(t *testing.T) {
+	var buf bytes.Buffer
+	prev := logging.Default()
+	logging.SetDefault(logging.NewLogger(&logging.Config{Level: logging.LevelInfo, Output: &buf}))
+	defer logging.SetDefault(prev)
+
+	d := &Device{Path: "/dev/ublkb3", metrics: NewMetrics()}
+	d.unknownFlags(0, 1<<20)
+	d.unknownFlags(1, 1<<20)
+	d.unknownFlags(0, 1<<20|1<<21) // One new bit
+
+	if n := d.metrics.Snapshot().UnknownFlags; n != 3 {
+		t.Errorf("UnknownFlags = %d, want 3", n)
+	}
+	if n := strings.Count(buf.String(), "flags this version does not know"); n != 2 {
+		t.Errorf("logged %d lines, want one per new bit:\n%s", n, buf.String())
+	}
+}
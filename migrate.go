@@ -0,0 +1,323 @@
+package ublk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// Migration defaults, used for zero fields of MigratePolicy
+const (
+	DefaultMigrateChunkSize    = 1 << 20
+	DefaultMigrateCutoverBytes = 16 << 20
+	DefaultMigrateMaxPasses    = 10
+)
+
+// MigratePolicy controls how Device.MigrateBackend copies data.
+type MigratePolicy struct {
+	// ChunkSize is the unit of copying and of dirty tracking, rounded
+	// down to whole logical blocks (default: DefaultMigrateChunkSize).
+	ChunkSize int
+
+	// Rate caps the background copy in bytes per second. 0 copies as fast
+	// as the backends allow. The final copy at cutover is never throttled.
+	Rate int64
+
+	// CutoverBytes is how much dirty data may be left when I/O is quiesced
+	// for the final copy; it bounds the pause the guest sees (default:
+	// DefaultMigrateCutoverBytes).
+	CutoverBytes int64
+
+	// MaxPasses limits the passes over dirty data. If writes keep dirtying
+	// more than CutoverBytes, the cutover happens after this many passes
+	// anyway and the pause is longer (default: DefaultMigrateMaxPasses).
+	MaxPasses int
+
+	// SkipZeroes leaves chunks that read as zeros unwritten on the first
+	// pass, for targets that already read as zeros (new sparse files, thin
+	// volumes). Chunks dirtied later are always written.
+	SkipZeroes bool
+}
+
+// MigrateBackend moves the device onto newBackend while it keeps serving
+// I/O, so storage can be migrated under a mounted filesystem. It copies the
+// current backend to newBackend chunk by chunk, tracking chunks that are
+// written during the copy and copying them again, until little enough is
+// dirty to quiesce I/O briefly, copy the rest, flush newBackend and switch
+// the queues over.
+//
+// newBackend must be at least as large as the current backend and support
+// discard if it does. If ctx is cancelled or a copy fails, the device stays
+// on the current backend and the error is returned. On success d.Backend is
+// newBackend; the old backend is not closed, so the caller can close or
+// keep it. Stop, Start and Close must not be called during a migration.
+func (d *Device) MigrateBackend(ctx context.Context, newBackend Backend, policy MigratePolicy) error {
+	if d == nil || newBackend == nil {
+		return ErrInvalidParameters
+	}
+	if d.closed {
+		return fmt.Errorf("device is closed")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if !d.migrating.CompareAndSwap(false, true) {
+		return d.migrateError(ErrCodeDeviceBusy, "a migration is already in progress", nil)
+	}
+	defer d.migrating.Store(false)
+
+	m, err := newMigration(d, newBackend, policy)
+	if err != nil {
+		return err
+	}
+	return m.run(ctx)
+}
+
+func (d *Device) migrateError(code UblkErrorCode, msg string, err error) error {
+	return &Error{
+		Op:    "MIGRATE",
+		DevID: d.ID,
+		Queue: NoQueue,
+		Code:  code,
+		Msg:   msg,
+		Inner: err,
+	}
+}
+
+// migration copies one backend to another. Writes reach the source through
+// tracker, which marks the chunks they touch dirty.
+type migration struct {
+	d        *Device
+	from, to Backend
+	policy   MigratePolicy // defaults filled in
+	size     int64
+	dirty    *dirtyMap
+	tracker  Backend
+}
+
+func newMigration(d *Device, to Backend, policy MigratePolicy) (*migration, error) {
+	from := d.Backend
+	if _, ok := from.(ZonedBackend); ok {
+		return nil, d.migrateError(ErrCodeNotImplemented, "zoned backends cannot be migrated", nil)
+	}
+	size := from.Size()
+	if to.Size() < size {
+		return nil, d.migrateError(ErrCodeInvalidParameters,
+			fmt.Sprintf("new backend holds %d bytes, the device needs %d", to.Size(), size), nil)
+	}
+	if _, ok := from.(DiscardBackend); ok {
+		if _, ok := to.(DiscardBackend); !ok {
+			return nil, d.migrateError(ErrCodeInvalidParameters,
+				"the device advertises discard but the new backend does not implement DiscardBackend", nil)
+		}
+	}
+	if _, ok := from.(WriteZeroesBackend); ok {
+		if _, ok := to.(WriteZeroesBackend); !ok {
+			return nil, d.migrateError(ErrCodeInvalidParameters,
+				"the device advertises write zeroes but the new backend does not implement WriteZeroesBackend", nil)
+		}
+	}
+
+	if policy.ChunkSize <= 0 {
+		policy.ChunkSize = DefaultMigrateChunkSize
+	}
+	if d.blockSize > 0 {
+		policy.ChunkSize = max(policy.ChunkSize/d.blockSize*d.blockSize, d.blockSize)
+	}
+	if policy.CutoverBytes <= 0 {
+		policy.CutoverBytes = DefaultMigrateCutoverBytes
+	}
+	if policy.MaxPasses <= 0 {
+		policy.MaxPasses = DefaultMigrateMaxPasses
+	}
+
+	m := &migration{
+		d:      d,
+		from:   from,
+		to:     to,
+		policy: policy,
+		size:   size,
+		dirty:  newDirtyMap(size, int64(policy.ChunkSize)),
+	}
+	m.dirty.markAll()
+	m.tracker = newTrackingBackend(from, m.dirty)
+	return m, nil
+}
+
+func (m *migration) run(ctx context.Context) error {
+	d, logger := m.d, logging.Default()
+	start := time.Now()
+	logger.Info("migration started", "device", d.Path, "bytes", m.size)
+
+	d.gate.Lock()
+	d.setQueueBackend(m.tracker)
+	d.gate.Unlock()
+
+	// Copy everything once, then whatever the guest dirtied meanwhile,
+	// until what is left is small enough to copy with I/O quiesced
+	for pass := 0; pass < m.policy.MaxPasses; pass++ {
+		dirty := m.dirty.count() * int64(m.policy.ChunkSize)
+		if dirty <= m.policy.CutoverBytes {
+			break
+		}
+		logger.Debug("migration pass", "device", d.Path, "pass", pass, "dirty", dirty)
+		if err := m.copyDirty(ctx, pass == 0 && m.policy.SkipZeroes, true); err != nil {
+			return m.abort(err)
+		}
+	}
+
+	d.gate.Lock()
+	defer d.gate.Unlock()
+	pause := time.Now()
+	err := m.copyDirty(ctx, false, false)
+	if err == nil {
+		err = m.to.Flush()
+	}
+	if err != nil {
+		d.setQueueBackend(m.from)
+		return d.migrateError(ErrCodeIOError, "migration failed at cutover", err)
+	}
+
+	d.setQueueBackend(m.to)
+	d.Backend = m.to
+	if d.scrub != nil {
+		d.scrub.backend = m.to
+	}
+	d.events.recordDevice(EventMigrated)
+	d.saveRecord()
+	logger.Info("migration complete", "device", d.Path, "duration", time.Since(start), "paused", time.Since(pause))
+	return nil
+}
+
+// abort puts the queues back on the source, which has every write, and
+// wraps the error that ended the migration.
+func (m *migration) abort(err error) error {
+	m.d.gate.Lock()
+	m.d.setQueueBackend(m.from)
+	m.d.gate.Unlock()
+	return m.d.migrateError(ErrCodeIOError, "migration aborted", err)
+}
+
+// copyDirty copies every dirty chunk from the source to the target. Each
+// chunk's bit is cleared before it is read, so a write that lands during
+// the copy marks it dirty again.
+func (m *migration) copyDirty(ctx context.Context, skipZeroes, throttle bool) error {
+	buf := make([]byte, m.policy.ChunkSize)
+	for chunk := m.dirty.next(0); chunk >= 0; chunk = m.dirty.next(chunk + 1) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !m.dirty.clear(chunk) {
+			continue
+		}
+
+		off := chunk * int64(len(buf))
+		p := buf[:min(int64(len(buf)), m.size-off)]
+		start := time.Now()
+		if err := m.copyChunk(p, off, skipZeroes); err != nil {
+			return fmt.Errorf("copy at offset %d: %w", off, err)
+		}
+
+		if throttle && m.policy.Rate > 0 {
+			pace := time.Duration(len(p)) * time.Second / time.Duration(m.policy.Rate)
+			if !sleepContext(ctx, pace-time.Since(start)) {
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+func (m *migration) copyChunk(p []byte, off int64, skipZeroes bool) error {
+	n, err := m.from.ReadAt(p, off)
+	if err == io.EOF {
+		// The source reads as zeros past the end of its data
+		clear(p[n:])
+	} else if err != nil {
+		return err
+	}
+	if skipZeroes && isZeroChunk(p) {
+		return nil
+	}
+	if n, err := m.to.WriteAt(p, off); err != nil {
+		return err
+	} else if n < len(p) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// setQueueBackend points every queue at backend. The caller must hold the
+// gate exclusively.
+func (d *Device) setQueueBackend(backend Backend) {
+	for _, runner := range d.runners {
+		runner.SetBackend(backend)
+	}
+}
+
+func isZeroChunk(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// newTrackingBackend wraps b so that writes and discards mark dirty. The
+// wrapper implements DiscardBackend only if b does, so the queues see the
+// same capabilities as before.
+func newTrackingBackend(b Backend, dirty *dirtyMap) Backend {
+	t := &trackingBackend{Backend: b, dirty: dirty}
+	if db, ok := b.(DiscardBackend); ok {
+		return &trackingDiscardBackend{trackingBackend: t, discard: db}
+	}
+	return t
+}
+
+// trackingBackend marks chunks dirty after the write reaches the source, so
+// a copy that read the chunk before the write landed is always redone.
+type trackingBackend struct {
+	Backend
+	dirty *dirtyMap
+}
+
+func (t *trackingBackend) WriteAt(p []byte, off int64) (int, error) {
+	n, err := t.Backend.WriteAt(p, off)
+	t.dirty.mark(off, int64(len(p)))
+	return n, err
+}
+
+// WriteZeroes is always present: whether the kernel sends WRITE_ZEROES
+// was fixed when the device was created, from the source backend.
+func (t *trackingBackend) WriteZeroes(offset, length int64, flags RequestFlags) error {
+	zb, ok := t.Backend.(WriteZeroesBackend)
+	if !ok {
+		return syscall.EOPNOTSUPP
+	}
+	err := zb.WriteZeroes(offset, length, flags)
+	t.dirty.mark(offset, length)
+	return err
+}
+
+type trackingDiscardBackend struct {
+	*trackingBackend
+	discard DiscardBackend
+}
+
+func (t *trackingDiscardBackend) Discard(offset, length int64) error {
+	err := t.discard.Discard(offset, length)
+	t.dirty.mark(offset, length)
+	return err
+}
+
+// Compile-time interface checks
+var (
+	_ Backend            = (*trackingBackend)(nil)
+	_ DiscardBackend     = (*trackingDiscardBackend)(nil)
+	_ WriteZeroesBackend = (*trackingBackend)(nil)
+)
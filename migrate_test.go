@@ -0,0 +1,156 @@
+package ublk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+// hookBackend calls onRead before the first read at offset hookAt
+type hookBackend struct {
+	*MockBackend
+	hookAt int64
+	onRead func()
+}
+
+func (b *hookBackend) ReadAt(p []byte, off int64) (int, error) {
+	if off == b.hookAt && b.onRead != nil {
+		hook := b.onRead
+		b.onRead = nil
+		hook()
+	}
+	return b.MockBackend.ReadAt(p, off)
+}
+
+func fillPattern(t *testing.T, b Backend) {
+	t.Helper()
+	buf := make([]byte, b.Size())
+	for i := range buf {
+		buf[i] = byte(i / 512)
+	}
+	if _, err := b.WriteAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertSameContents(t *testing.T, want, got Backend) {
+	t.Helper()
+	a, b := make([]byte, want.Size()), make([]byte, want.Size())
+	want.ReadAt(a, 0)
+	got.ReadAt(b, 0)
+	if !bytes.Equal(a, b) {
+		t.Error("target contents differ from the source")
+	}
+}
+
+func TestMigrateBackend(t *testing.T) {
+	src, dst := NewMockBackend(1<<20), NewMockBackend(2<<20)
+	fillPattern(t, src)
+	device := &Device{ID: 1, Path: "/dev/ublkb1", Backend: src, blockSize: 512, events: newEventLog(0)}
+
+	policy := MigratePolicy{ChunkSize: 64 << 10, CutoverBytes: 64 << 10}
+	if err := device.MigrateBackend(context.Background(), dst, policy); err != nil {
+		t.Fatalf("MigrateBackend: %v", err)
+	}
+	if device.Backend != dst {
+		t.Error("device was not switched to the new backend")
+	}
+	if !dst.IsFlushed() {
+		t.Error("new backend was not flushed at cutover")
+	}
+	if src.IsClosed() {
+		t.Error("old backend was closed")
+	}
+	assertSameContents(t, src, dst)
+	if got := device.Events(); len(got) != 1 || got[0].Type != EventMigrated {
+		t.Errorf("events = %v, want one migrated event", got)
+	}
+}
+
+func TestMigrateRecopiesDirtyChunks(t *testing.T) {
+	src := &hookBackend{MockBackend: NewMockBackend(1 << 20), hookAt: 512 << 10}
+	dst := NewMockBackend(1 << 20)
+	fillPattern(t, src)
+	device := &Device{ID: 1, Backend: src, blockSize: 512}
+
+	m, err := newMigration(device, dst, MigratePolicy{ChunkSize: 64 << 10, CutoverBytes: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Half way through the first pass, the guest rewrites chunks on both
+	// sides of the copy position, discards one already copied and zeroes
+	// part of another
+	src.onRead = func() {
+		m.tracker.WriteAt(bytes.Repeat([]byte{0xEE}, 4096), 0)
+		m.tracker.WriteAt(bytes.Repeat([]byte{0xDD}, 4096), 900<<10)
+		m.tracker.(DiscardBackend).Discard(128<<10, 64<<10)
+		m.tracker.(WriteZeroesBackend).WriteZeroes(256<<10, 4096, RequestNoUnmap)
+	}
+	if err := m.run(context.Background()); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	assertSameContents(t, src, dst)
+}
+
+func TestMigrateSkipZeroes(t *testing.T) {
+	src, dst := NewMockBackend(256<<10), NewMockBackend(256<<10)
+	src.WriteAt([]byte("data"), 64<<10)
+	device := &Device{ID: 1, Backend: src, blockSize: 512}
+
+	before := dst.CallCounts()["write"]
+	policy := MigratePolicy{ChunkSize: 64 << 10, CutoverBytes: 1, SkipZeroes: true}
+	if err := device.MigrateBackend(context.Background(), dst, policy); err != nil {
+		t.Fatalf("MigrateBackend: %v", err)
+	}
+	if got := dst.CallCounts()["write"] - before; got != 1 {
+		t.Errorf("target got %d writes, want only the one non-zero chunk", got)
+	}
+	assertSameContents(t, src, dst)
+}
+
+func TestMigrateRejects(t *testing.T) {
+	src := NewMockBackend(1 << 20)
+	device := &Device{ID: 1, Backend: src, blockSize: 512}
+
+	tests := []struct {
+		name   string
+		target Backend
+	}{
+		{"too small", NewMockBackend(512 << 10)},
+		{"no discard", struct{ Backend }{NewMockBackend(1 << 20)}},
+		{"no write zeroes", struct{ DiscardBackend }{NewMockBackend(1 << 20)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := device.MigrateBackend(context.Background(), tt.target, MigratePolicy{})
+			if !errors.Is(err, ErrInvalidParameters) {
+				t.Errorf("err = %v, want invalid parameters", err)
+			}
+			if device.Backend != src {
+				t.Error("device left its backend")
+			}
+		})
+	}
+}
+
+func TestMigrateCancelled(t *testing.T) {
+	src, dst := NewMockBackend(1<<20), NewMockBackend(1<<20)
+	device := &Device{ID: 1, Backend: src, blockSize: 512}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := device.MigrateBackend(ctx, dst, MigratePolicy{ChunkSize: 64 << 10, CutoverBytes: 64 << 10})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if device.Backend != src {
+		t.Error("cancelled migration switched the backend")
+	}
+
+	// A later migration is not blocked by the failed one
+	if err := device.MigrateBackend(context.Background(), dst, MigratePolicy{}); err != nil {
+		t.Errorf("MigrateBackend after cancel: %v", err)
+	}
+}
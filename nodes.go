@@ -0,0 +1,92 @@
+//go:build linux
+
+package ublk
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ehrlich-b/go-ublk/internal/devnode"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"golang.org/x/sys/unix"
+)
+
+// makeNode creates the device node path, of type mode, for the device
+// whose sysfs directory is sysDir.
+func makeNode(path, sysDir string, mode uint32) error {
+	dev, err := devnode.Devt(sysDir)
+	if err != nil {
+		return err
+	}
+	return devnode.Mknod(path, mode, dev)
+}
+
+// makeCharNode creates the character device node for device id at path.
+func makeCharNode(path string, id uint32) error {
+	return makeNode(path, filepath.Join(charClassDir, fmt.Sprintf("ublkc%d", id)), unix.S_IFCHR)
+}
+
+// MakeBlockNode creates a block device node for the started device at
+// path, from its device number in /sys/class/block, for environments such
+// as containers where udev does not populate /dev. It needs CAP_MKNOD. An
+// existing node for the same device is kept; Options.CreateNodes does this
+// for BlockPath when the device starts.
+func (d *Device) MakeBlockNode(path string) error {
+	return makeNode(path, filepath.Join(blockClassDir, fmt.Sprintf("ublkb%d", d.ID)), unix.S_IFBLK)
+}
+
+// paramsGetter reads a device's parameters back from the kernel.
+type paramsGetter interface {
+	GetParams(deviceID uint32) (*uapi.UblkParams, error)
+}
+
+// resolveNodes replaces the device paths built from the device ID with the
+// nodes the kernel registered for the started device, found through the
+// device numbers in its parameters. Paths set in Options are kept, and so
+// is a built path whose replacement cannot be verified, e.g. because udev
+// has not created it yet.
+func (d *Device) resolveNodes(g paramsGetter) {
+	params, err := g.GetParams(d.ID)
+	if err != nil || !params.HasDevt() {
+		logging.Default().Debug("no device numbers to resolve nodes from", "device", d.Path, "error", err)
+		return
+	}
+	// Only changed paths are written: restarts resolve them again while
+	// other goroutines may be reading them
+	devt := params.Devt
+	if d.options == nil || d.options.BlockDevicePath == "" {
+		path := d.options.resolveNode(d.Path, "block", unix.S_IFBLK, unix.Mkdev(devt.DiskMajor, devt.DiskMinor))
+		if path != d.Path {
+			d.Path = path
+		}
+	}
+	if d.options == nil || d.options.CharDevicePath == "" {
+		path := d.options.resolveNode(d.CharPath, "char", unix.S_IFCHR, unix.Mkdev(devt.CharMajor, devt.CharMinor))
+		if path != d.CharPath {
+			d.CharPath = path
+		}
+	}
+}
+
+// resolveNode returns the node in the device directory that sysfs names
+// for device dev of class, or path if there is no such node of type mode.
+func (o *Options) resolveNode(path, class string, mode uint32, dev uint64) string {
+	name, err := devnode.Name(sysDevDir, class, dev)
+	if err != nil {
+		logging.Default().Debug("could not name device node", "path", path, "error", err)
+		return path
+	}
+	node := filepath.Join(o.deviceDir(), name)
+	var st unix.Stat_t
+	if err := unix.Stat(node, &st); err != nil {
+		logging.Default().Debug("device node not found", "path", node, "error", err)
+		return path
+	}
+	if st.Mode&unix.S_IFMT != mode || uint64(st.Rdev) != dev {
+		logging.Default().Warn("device node is for another device", "path", node,
+			"want", fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev)))
+		return path
+	}
+	return node
+}
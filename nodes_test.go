@@ -0,0 +1,102 @@
+//go:build linux
+
+package ublk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"golang.org/x/sys/unix"
+)
+
+// fakeClassDirs points the sysfs class directories at a temp tree where
+// ublkc7 and ublkb7 have /dev/null's device number.
+func fakeClassDirs(t *testing.T) {
+	t.Helper()
+	root := t.TempDir()
+	for dir, name := range map[*string]string{&charClassDir: "ublkc7", &blockClassDir: "ublkb7"} {
+		old := *dir
+		*dir = filepath.Join(root, filepath.Base(old))
+		t.Cleanup(func() { *dir = old })
+		if err := os.MkdirAll(filepath.Join(*dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(*dir, name, "dev"), []byte("1:3\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMakeNodes(t *testing.T) {
+	fakeClassDirs(t)
+	dir := t.TempDir()
+
+	charPath := filepath.Join(dir, "ublkc7")
+	if err := makeCharNode(charPath, 7); errors.Is(err, syscall.EPERM) {
+		t.Skip("mknod needs CAP_MKNOD")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	blockPath := filepath.Join(dir, "ublkb7")
+	if err := (&Device{ID: 7}).MakeBlockNode(blockPath); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, mode := range map[string]uint32{charPath: unix.S_IFCHR, blockPath: unix.S_IFBLK} {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode&unix.S_IFMT != mode || uint64(st.Rdev) != unix.Mkdev(1, 3) {
+			t.Errorf("%s: mode %o rdev %x", path, st.Mode, st.Rdev)
+		}
+	}
+
+	if err := (&Device{ID: 8}).MakeBlockNode(filepath.Join(dir, "ublkb8")); err == nil {
+		t.Error("MakeBlockNode succeeded for a device without sysfs entry")
+	}
+}
+
+// fakeParams returns parameters with the given device numbers.
+type fakeParams struct{ devt uapi.UblkParamDevt }
+
+func (f fakeParams) GetParams(uint32) (*uapi.UblkParams, error) {
+	params := &uapi.UblkParams{Devt: f.devt}
+	params.SetDevt()
+	return params, nil
+}
+
+func TestResolveNodes(t *testing.T) {
+	saved := sysDevDir
+	sysDevDir = t.TempDir()
+	t.Cleanup(func() { sysDevDir = saved })
+	// Both device numbers are /dev/null's, which is not a block device
+	for _, class := range []string{"char", "block"} {
+		dir := filepath.Join(sysDevDir, class, "1:3")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "uevent"), []byte("MAJOR=1\nMINOR=3\nDEVNAME=null\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := &Device{ID: 7, Path: "/dev/ublkb7", CharPath: "/dev/ublkc7", options: &Options{}}
+	d.resolveNodes(fakeParams{uapi.UblkParamDevt{CharMajor: 1, CharMinor: 3, DiskMajor: 1, DiskMinor: 3}})
+	if d.CharPath != "/dev/null" {
+		t.Errorf("CharPath = %q, want the node sysfs names", d.CharPath)
+	}
+	if d.Path != "/dev/ublkb7" {
+		t.Errorf("Path = %q, want the built path kept when the named node is not a block device", d.Path)
+	}
+
+	d = &Device{ID: 7, CharPath: "/custom/ublkc7", options: &Options{CharDevicePath: "/custom/ublkc7"}}
+	d.resolveNodes(fakeParams{uapi.UblkParamDevt{CharMajor: 1, CharMinor: 3}})
+	if d.CharPath != "/custom/ublkc7" {
+		t.Errorf("CharPath = %q, want Options.CharDevicePath kept", d.CharPath)
+	}
+}
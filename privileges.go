@@ -0,0 +1,68 @@
+package ublk
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Credentials are the identity a device server drops to once the
+// privileged control-plane setup is done. Serving I/O on the already open
+// character device and io_uring needs no privileges.
+type Credentials struct {
+	UID int
+	GID int
+
+	// Groups are the supplementary groups (default: none).
+	Groups []int
+
+	// KeepCapabilities are capabilities, such as unix.CAP_SYS_ADMIN, to keep
+	// across the switch; all others are dropped. Keeping any needs a build
+	// without cgo.
+	KeepCapabilities []int
+}
+
+// dropped holds the credentials DropPrivileges switched the process to,
+// nil until it succeeds.
+var dropped struct {
+	sync.Mutex
+	creds *Credentials
+}
+
+// DropPrivileges switches every thread of the process to c and drops all
+// capabilities but c.KeepCapabilities. It cannot be undone.
+//
+// Stop, Close and the other control commands still need CAP_SYS_ADMIN, and
+// a Device without a Manager also reopens /dev/ublk-control for them. A
+// server that drops everything therefore cannot delete its devices: when
+// it exits the kernel stops them, and a privileged process deletes them.
+// Keep CAP_SYS_ADMIN, and serve devices through a Manager, whose control
+// device stays open, to manage them after dropping.
+func DropPrivileges(c Credentials) error {
+	dropped.Lock()
+	defer dropped.Unlock()
+	if err := dropPrivileges(c); err != nil {
+		return err
+	}
+	dropped.creds = &c
+	return nil
+}
+
+// runAs drops the process to c for Options.RunAs. Only the first call
+// drops: the process cannot change its IDs again, so a device that resumes
+// or restarts, or another device with the same RunAs, skips it.
+func runAs(c Credentials) error {
+	dropped.Lock()
+	defer dropped.Unlock()
+	if prev := dropped.creds; prev != nil {
+		if prev.UID != c.UID || prev.GID != c.GID {
+			return NewError("SETUID", ErrCodePermissionDenied,
+				fmt.Sprintf("privileges were already dropped to %d:%d", prev.UID, prev.GID))
+		}
+		return nil
+	}
+	if err := dropPrivileges(c); err != nil {
+		return err
+	}
+	dropped.creds = &c
+	return nil
+}
@@ -0,0 +1,97 @@
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges implements DropPrivileges.
+func dropPrivileges(c Credentials) error {
+	if c.UID < 0 || c.GID < 0 {
+		return NewError("SETUID", ErrCodeInvalidParameters, "UID and GID must not be negative")
+	}
+	var keep [2]uint32
+	for _, capability := range c.KeepCapabilities {
+		if capability < 0 || capability >= 64 {
+			return NewError("SETUID", ErrCodeInvalidParameters, fmt.Sprintf("invalid capability %d", capability))
+		}
+		keep[capability/32] |= 1 << (capability % 32)
+	}
+	keeping := len(c.KeepCapabilities) > 0
+
+	// Capabilities survive the UID change only with KEEPCAPS set, which,
+	// like the capability sets, is per thread
+	if keeping {
+		if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0); errno != 0 {
+			return privilegeError("PR_SET_KEEPCAPS", errno)
+		}
+	}
+	// The syscall package applies these to every thread
+	if err := syscall.Setgroups(c.Groups); err != nil {
+		return privilegeError("setgroups", err)
+	}
+	if err := syscall.Setgid(c.GID); err != nil {
+		return privilegeError("setgid", err)
+	}
+	if err := syscall.Setuid(c.UID); err != nil {
+		return privilegeError("setuid", err)
+	}
+
+	// Switching to a non-root UID cleared every set; otherwise narrow them
+	// to the capabilities asked for
+	if keeping || c.UID == 0 {
+		if err := setCapabilities(keep); err != nil {
+			return err
+		}
+	}
+	if keeping {
+		if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0); errno != 0 {
+			return privilegeError("PR_SET_KEEPCAPS", errno)
+		}
+	}
+
+	// Make sure there is no way back
+	if c.UID != 0 && !hasCapability(unix.CAP_SETUID) {
+		ruid, euid, suid := unix.Getresuid()
+		if ruid == 0 || euid == 0 || suid == 0 {
+			return NewError("SETUID", ErrCodePermissionDenied, "root could be regained after dropping privileges")
+		}
+	}
+	return nil
+}
+
+// setCapabilities sets the permitted and effective capabilities of every
+// thread to keep and clears the inheritable ones.
+func setCapabilities(keep [2]uint32) error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{
+		{Effective: keep[0], Permitted: keep[0]},
+		{Effective: keep[1], Permitted: keep[1]},
+	}
+	_, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET,
+		uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	runtime.KeepAlive(&header)
+	runtime.KeepAlive(&data)
+	if errno != 0 {
+		return privilegeError("capset", errno)
+	}
+	return nil
+}
+
+func privilegeError(call string, err error) error {
+	msg := fmt.Sprintf("dropping privileges: %s failed", call)
+	if errors.Is(err, syscall.ENOTSUP) {
+		msg += " (changing capabilities of every thread needs a build without cgo)"
+	}
+	e := &Error{Op: "SETUID", Code: ErrCodePermissionDenied, Msg: msg, Inner: err, Queue: NoQueue}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		e.Errno = errno
+	}
+	return e
+}
@@ -0,0 +1,96 @@
+//go:build linux
+
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropEnv selects the credentials TestDropPrivileges' child process drops
+// to; dropping cannot be undone, so it never happens in the test process.
+const dropEnv = "GO_UBLK_TEST_DROP"
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	for _, mode := range []string{"nobody", "keep-sys-admin"} {
+		t.Run(mode, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivilegesChild$")
+			cmd.Env = append(os.Environ(), dropEnv+"="+mode)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+		})
+	}
+}
+
+func TestDropPrivilegesChild(t *testing.T) {
+	mode := os.Getenv(dropEnv)
+	if mode == "" {
+		t.Skip("run by TestDropPrivileges")
+	}
+	creds := Credentials{UID: 65534, GID: 65534}
+	if mode == "keep-sys-admin" {
+		creds.KeepCapabilities = []int{unix.CAP_SYS_ADMIN}
+	}
+	err := DropPrivileges(creds)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every thread, not just this one, has switched
+	done := make(chan error)
+	for range 8 {
+		go func() {
+			if uid, gid := unix.Getuid(), unix.Getgid(); uid != 65534 || gid != 65534 {
+				done <- fmt.Errorf("thread still runs as %d:%d", uid, gid)
+				return
+			}
+			done <- nil
+		}()
+	}
+	for range 8 {
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}
+	if err := unix.Setuid(0); err == nil {
+		t.Error("regained root")
+	}
+	if got, want := hasCapSysAdmin(), mode == "keep-sys-admin"; got != want {
+		t.Errorf("CAP_SYS_ADMIN = %v, want %v", got, want)
+	}
+}
+
+func TestDropPrivilegesInvalid(t *testing.T) {
+	for _, creds := range []Credentials{{UID: -1}, {UID: 1, KeepCapabilities: []int{64}}} {
+		if err := DropPrivileges(creds); !errors.Is(err, ErrInvalidParameters) {
+			t.Errorf("DropPrivileges(%+v) = %v, want ErrInvalidParameters", creds, err)
+		}
+	}
+}
+
+func TestRunAsOnce(t *testing.T) {
+	saved := dropped.creds
+	t.Cleanup(func() { dropped.creds = saved })
+
+	// Already dropped: a restart with the same RunAs changes nothing, and
+	// one with other credentials cannot be honored
+	dropped.creds = &Credentials{UID: 65534, GID: 65534}
+	if err := runAs(Credentials{UID: 65534, GID: 65534}); err != nil {
+		t.Errorf("runAs after dropping = %v, want nil", err)
+	}
+	if err := runAs(Credentials{UID: 1000, GID: 1000}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("runAs to other credentials = %v, want ErrPermissionDenied", err)
+	}
+}
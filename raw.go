@@ -0,0 +1,89 @@
+package ublk
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk/internal/interfaces"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// RawRequest is a block request as the kernel sent it, for a RawHandler:
+// its queue and tag, op (OpRead and the others, or any op the kernel
+// sends), flags, range, and for reads and writes the tag buffer as Data.
+type RawRequest = interfaces.RawRequest
+
+// Request ops, as in RawRequest.Op, matching UBLK_IO_OP_* in
+// include/uapi/linux/ublk_cmd.h.
+const (
+	OpRead        uint8 = uapi.UBLK_IO_OP_READ
+	OpWrite       uint8 = uapi.UBLK_IO_OP_WRITE
+	OpFlush       uint8 = uapi.UBLK_IO_OP_FLUSH
+	OpDiscard     uint8 = uapi.UBLK_IO_OP_DISCARD
+	OpWriteZeroes uint8 = uapi.UBLK_IO_OP_WRITE_ZEROES
+)
+
+// RawHandler serves the requests of a device created with ServeRaw. It
+// fills req.Data for a read and consumes it for a write, and returns nil
+// for the request to complete with its full length, or an error to fail
+// it with the errno the device's ErrnoMapper chooses (syscall.EOPNOTSUPP
+// for an op it does not serve). It is called from the queue threads, or
+// from backend workers with DeviceParams.BackendWorkers, so it must be
+// safe for concurrent use, and must not retain req or its Data.
+type RawHandler func(req *RawRequest) error
+
+// ServeRaw is CreateAndServe for a device of size bytes whose requests go
+// to handler as the kernel sent them, bypassing the Backend methods: for
+// SCSI-like semantics, custom ops, or control over each request. The
+// device advertises discard and write zeroes; the handler declines them
+// with syscall.EOPNOTSUPP if it does not serve them. params.Backend is
+// ignored.
+//
+// Requests are still validated (reads and writes fit a tag buffer and the
+// device) and go through BackendWorkers, IOTimeout, metrics and traces
+// like Backend calls. Features that use the Backend directly, such as
+// snapshots, scrubbing and MigrateBackend, do not work on the device.
+func ServeRaw(
+	ctx context.Context, params DeviceParams, size int64, handler RawHandler, options *Options,
+) (*Device, error) {
+	if handler == nil {
+		return nil, fmt.Errorf("ServeRaw needs a handler")
+	}
+	if size <= 0 {
+		return nil, fmt.Errorf("device size %d is not positive", size)
+	}
+	params.Backend = &rawBackend{size: size, handler: handler}
+	return CreateAndServe(ctx, params, options)
+}
+
+// rawBackend stands in for the Backend of a ServeRaw device. It sizes the
+// device and, by implementing the optional interfaces, makes it advertise
+// the ops the handler may serve; the queues pass requests to handler
+// instead of calling it.
+type rawBackend struct {
+	size    int64
+	handler RawHandler
+}
+
+func (b *rawBackend) ReadAt([]byte, int64) (int, error)            { return 0, syscall.EOPNOTSUPP }
+func (b *rawBackend) WriteAt([]byte, int64) (int, error)           { return 0, syscall.EOPNOTSUPP }
+func (b *rawBackend) Size() int64                                  { return b.size }
+func (b *rawBackend) Close() error                                 { return nil }
+func (b *rawBackend) Flush() error                                 { return nil }
+func (b *rawBackend) Discard(int64, int64) error                   { return syscall.EOPNOTSUPP }
+func (b *rawBackend) WriteZeroes(int64, int64, RequestFlags) error { return syscall.EOPNOTSUPP }
+
+// rawHandler returns the device's RawHandler, or nil if it has a Backend.
+func (d *Device) rawHandler() func(req *interfaces.RawRequest) error {
+	if b, ok := d.Backend.(*rawBackend); ok {
+		return b.handler
+	}
+	return nil
+}
+
+// Compile-time interface checks
+var (
+	_ DiscardBackend     = (*rawBackend)(nil)
+	_ WriteZeroesBackend = (*rawBackend)(nil)
+)
@@ -0,0 +1,37 @@
+package ublk
+
+import (
+	"context"
+	"testing"
+)
+
+func TestServeRawValidates(t *testing.T) {
+	handler := func(*RawRequest) error { return nil }
+	if _, err := ServeRaw(context.Background(), DeviceParams{}, 1<<20, nil, nil); err == nil {
+		t.Error("ServeRaw accepted a nil handler")
+	}
+	if _, err := ServeRaw(context.Background(), DeviceParams{}, 0, handler, nil); err == nil {
+		t.Error("ServeRaw accepted an empty device")
+	}
+}
+
+func TestRunnerConfigRawHandler(t *testing.T) {
+	var called bool
+	d := &Device{Backend: &rawBackend{size: 1 << 20, handler: func(*RawRequest) error {
+		called = true
+		return nil
+	}}}
+	config := d.runnerConfig(0, -1)
+	if config.RawHandler == nil {
+		t.Fatal("raw device's queues get no handler")
+	}
+	_ = config.RawHandler(&RawRequest{Op: OpFlush})
+	if !called {
+		t.Error("queue handler is not the device's")
+	}
+
+	d = &Device{Backend: NewMockBackend(1 << 20)}
+	if d.runnerConfig(0, -1).RawHandler != nil {
+		t.Error("device with a Backend gets a raw handler")
+	}
+}
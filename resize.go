@@ -0,0 +1,105 @@
+package ublk
+
+import (
+	"fmt"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// Resize changes the size of a running device to newSize bytes, a positive
+// multiple of the logical block size. The backend must implement
+// ResizeBackend and the device must have been created with
+// DeviceParams.EnableResize.
+//
+// I/O is quiesced while the backend resizes. A device grows in the backend
+// first and then in the kernel, and shrinks the other way round, so the
+// kernel never sends a request past the end of the backend. The kernel
+// resizes the block node and sends a change uevent; a filesystem on the
+// device still has to be grown or shrunk on its own (resize2fs,
+// xfs_growfs).
+func (d *Device) Resize(newSize int64) error {
+	if d == nil {
+		return ErrInvalidParameters
+	}
+	d.life.Lock()
+	defer d.life.Unlock()
+
+	if d.closed {
+		return fmt.Errorf("device is closed")
+	}
+	if !d.started || d.paused {
+		return d.resizeError(ErrCodeDeviceOffline, "device is not serving I/O", nil)
+	}
+	if !d.params.EnableResize {
+		return d.resizeError(ErrCodeNotImplemented, "device was created without EnableResize", nil)
+	}
+	if d.changes != nil {
+		return d.resizeError(ErrCodeNotImplemented, "change tracking cannot follow a resize", nil)
+	}
+	if newSize <= 0 || newSize%int64(d.blockSize) != 0 {
+		return d.resizeError(ErrCodeInvalidParameters,
+			fmt.Sprintf("size %d is not a positive multiple of the %d-byte logical block", newSize, d.blockSize), nil)
+	}
+	if d.migrating.Load() {
+		return d.resizeError(ErrCodeDeviceBusy, "a migration is in progress", nil)
+	}
+
+	// The gate also keeps MigrateBackend from swapping the backend
+	d.gate.Lock()
+	defer d.gate.Unlock()
+
+	rb, ok := d.Backend.(ResizeBackend)
+	if !ok {
+		return d.resizeError(ErrCodeNotImplemented, "backend does not implement ResizeBackend", nil)
+	}
+	oldSize := rb.Size()
+	if newSize == oldSize {
+		return nil
+	}
+
+	controller, release, err := d.controller()
+	if err != nil {
+		return fmt.Errorf("failed to create controller for resize: %v", err)
+	}
+	defer release()
+
+	updateKernel := func() error {
+		if err := controller.UpdateSize(d.ID, uint64(newSize)>>9); err != nil {
+			return d.resizeError(ErrCodeIOError, "kernel refused the new size", err)
+		}
+		return nil
+	}
+
+	if newSize > oldSize {
+		if err := rb.Resize(newSize); err != nil {
+			return d.resizeError(ErrCodeIOError, "backend resize failed", err)
+		}
+		if err := updateKernel(); err != nil {
+			_ = rb.Resize(oldSize) // Cleanup, ignore error
+			return err
+		}
+	} else {
+		if err := updateKernel(); err != nil {
+			return err
+		}
+		if err := rb.Resize(newSize); err != nil {
+			// The kernel sends no I/O past newSize, so the device stays
+			// usable at its new size
+			return d.resizeError(ErrCodeIOError, "backend resize failed after the device shrank", err)
+		}
+	}
+
+	logging.Default().Info("device resized", "device", d.Path, "old_size", oldSize, "new_size", newSize)
+	return nil
+}
+
+func (d *Device) resizeError(code UblkErrorCode, msg string, err error) error {
+	return &Error{
+		Op:    "RESIZE",
+		DevID: d.ID,
+		Queue: NoQueue,
+		Code:  code,
+		Msg:   msg,
+		Inner: err,
+	}
+}
@@ -0,0 +1,43 @@
+package ublk
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeviceResizeRejects(t *testing.T) {
+	resizable := DeviceParams{EnableResize: true}
+	tests := []struct {
+		name   string
+		device *Device
+		size   int64
+		want   UblkErrorCode
+	}{
+		{"not started", &Device{Backend: NewMockBackend(1 << 20), blockSize: 512, params: resizable},
+			2 << 20, ErrCodeDeviceOffline},
+		{"paused", &Device{Backend: NewMockBackend(1 << 20), blockSize: 512, params: resizable, started: true, paused: true},
+			2 << 20, ErrCodeDeviceOffline},
+		{"without EnableResize", &Device{Backend: NewMockBackend(1 << 20), blockSize: 512, started: true},
+			2 << 20, ErrCodeNotImplemented},
+		{"change tracking", &Device{Backend: NewMockBackend(1 << 20), blockSize: 512, params: resizable, started: true,
+			changes: &changeTracker{}}, 2 << 20, ErrCodeNotImplemented},
+		{"partial block", &Device{Backend: NewMockBackend(1 << 20), blockSize: 4096, params: resizable, started: true},
+			2<<20 + 512, ErrCodeInvalidParameters},
+		{"zero", &Device{Backend: NewMockBackend(1 << 20), blockSize: 512, params: resizable, started: true},
+			0, ErrCodeInvalidParameters},
+		{"fixed-size backend", &Device{Backend: struct{ Backend }{NewMockBackend(1 << 20)}, blockSize: 512,
+			params: resizable, started: true}, 2 << 20, ErrCodeNotImplemented},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.device.Resize(tt.size)
+			var ue *Error
+			if !errors.As(err, &ue) || ue.Code != tt.want || ue.Op != "RESIZE" {
+				t.Fatalf("Resize(%d) = %v, want a RESIZE error with code %q", tt.size, err, tt.want)
+			}
+			if got := tt.device.Backend.Size(); got != 1<<20 {
+				t.Errorf("backend size = %d after a rejected resize, want %d", got, 1<<20)
+			}
+		})
+	}
+}
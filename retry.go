@@ -0,0 +1,103 @@
+package ublk
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// Control retry defaults, used for zero fields of RetryPolicy
+const (
+	DefaultControlRetryAttempts   = 5
+	DefaultControlRetryBackoff    = 10 * time.Millisecond
+	DefaultControlRetryMaxBackoff = 500 * time.Millisecond
+)
+
+// DefaultRetryErrnos are the errors a control command is retried on: an
+// interrupted command, and the module or udev being busy while devices are
+// being added.
+var DefaultRetryErrnos = []syscall.Errno{syscall.EINTR, syscall.EAGAIN, syscall.EBUSY}
+
+// RetryPolicy controls how ADD_DEV, SET_PARAMS and START_DEV are retried
+// when they fail transiently, as they can while the module is loading or
+// udev is busy. The zero value retries with the defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the number of tries, the first included
+	// (default: DefaultControlRetryAttempts). 1 disables retries.
+	MaxAttempts int
+
+	// Backoff is the wait before the first retry, doubled for each one
+	// after it up to MaxBackoff (defaults: DefaultControlRetryBackoff,
+	// DefaultControlRetryMaxBackoff).
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Errnos are the errors worth retrying (default: DefaultRetryErrnos).
+	Errnos []syscall.Errno
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultControlRetryAttempts
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = DefaultControlRetryBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultControlRetryMaxBackoff
+	}
+	if p.Errnos == nil {
+		p.Errnos = DefaultRetryErrnos
+	}
+	return p
+}
+
+// retryable reports whether err wraps one of the policy's errnos.
+func (p RetryPolicy) retryable(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && slices.Contains(p.Errnos, errno)
+}
+
+// retryControl runs the control command op until it succeeds, fails with a
+// non-transient error, runs out of attempts or ctx is done, and returns
+// the last error.
+func retryControl(ctx context.Context, policy RetryPolicy, op string, fn func() error) error {
+	policy = policy.withDefaults()
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return err
+		}
+		logging.Default().Debug("control command failed, retrying",
+			"op", op, "attempt", attempt, "backoff", backoff, "error", err)
+		if !sleepContext(ctx, backoff) {
+			return err
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+// retryingAdder retries ADD_DEV according to a policy. addDevice walks an
+// ID range on EEXIST, which is never retried, so each ID gets the full
+// policy.
+type retryingAdder struct {
+	ctx    context.Context
+	adder  deviceAdder
+	policy RetryPolicy
+}
+
+func (a retryingAdder) AddDevice(params *ctrl.DeviceParams) (uint32, error) {
+	var id uint32
+	err := retryControl(a.ctx, a.policy, "ADD_DEV", func() error {
+		var err error
+		id, err = a.adder.AddDevice(params)
+		return err
+	})
+	return id, err
+}
@@ -0,0 +1,95 @@
+package ublk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+)
+
+// failingCommand fails with errs in turn, then succeeds
+type failingCommand struct {
+	errs  []error
+	calls int
+}
+
+func (f *failingCommand) run() error {
+	f.calls++
+	if f.calls <= len(f.errs) {
+		return f.errs[f.calls-1]
+	}
+	return nil
+}
+
+func TestRetryControl(t *testing.T) {
+	transient := fmt.Errorf("START_DEV failed: %w", syscall.EBUSY)
+	fast := RetryPolicy{Backoff: time.Microsecond}
+
+	tests := []struct {
+		name      string
+		policy    RetryPolicy
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", fast, nil, 1, false},
+		{"transient then success", fast, []error{transient, transient}, 3, false},
+		{"permanent", fast, []error{fmt.Errorf("ADD_DEV failed: %w", syscall.EINVAL)}, 1, true},
+		{"attempts exhausted", RetryPolicy{MaxAttempts: 3, Backoff: time.Microsecond},
+			[]error{transient, transient, transient, transient}, 3, true},
+		{"disabled", RetryPolicy{MaxAttempts: 1}, []error{transient}, 1, true},
+		{"custom errnos", RetryPolicy{Backoff: time.Microsecond, Errnos: []syscall.Errno{syscall.ENODEV}},
+			[]error{fmt.Errorf("x: %w", syscall.ENODEV), transient}, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := &failingCommand{errs: tt.errs}
+			err := retryControl(context.Background(), tt.policy, "TEST", cmd.run)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cmd.calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", cmd.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryControlCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cmd := &failingCommand{errs: []error{syscall.EAGAIN, syscall.EAGAIN}}
+	err := retryControl(ctx, RetryPolicy{Backoff: time.Hour}, "TEST", cmd.run)
+	if !errors.Is(err, syscall.EAGAIN) || cmd.calls != 1 {
+		t.Errorf("err = %v after %d calls, want EAGAIN after 1", err, cmd.calls)
+	}
+}
+
+// flakyAdder fails the first busy calls with EBUSY, then behaves like adder
+type flakyAdder struct {
+	fakeAdder
+	busy int
+}
+
+func (f *flakyAdder) AddDevice(params *ctrl.DeviceParams) (uint32, error) {
+	if f.busy > 0 {
+		f.busy--
+		return 0, fmt.Errorf("ADD_DEV failed: %w", syscall.EBUSY)
+	}
+	return f.fakeAdder.AddDevice(params)
+}
+
+func TestRetryingAdderWalksRange(t *testing.T) {
+	inner := &flakyAdder{fakeAdder: fakeAdder{taken: map[int32]bool{100: true}}, busy: 2}
+	adder := retryingAdder{ctx: context.Background(), adder: inner, policy: RetryPolicy{Backoff: time.Microsecond}}
+
+	params := &ctrl.DeviceParams{DeviceID: AutoAssignDeviceID}
+	id, err := addDevice(adder, params, IDRange{First: 100, Count: 4})
+	if err != nil || id != 101 {
+		t.Fatalf("addDevice = %d, %v, want 101", id, err)
+	}
+}
@@ -0,0 +1,43 @@
+package ublk
+
+import (
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+)
+
+// Ring is the io_uring a queue loop serves ublk I/O commands on. The
+// built-in implementation uses raw syscalls; Options.RingProvider swaps in
+// another (liburing through cgo, an io_uring library, an instrumented
+// ring) without forking the queue code.
+//
+// An implementation must:
+//   - create the ring with 128-byte SQEs (IORING_SETUP_SQE128);
+//   - submit each IOCmd as an IORING_OP_URING_CMD on RingConfig.FD with cmd
+//     as the command op and the IOCmd copied into the SQE's command area;
+//   - hand back the userData it was given, unchanged, in the Result;
+//   - with RingConfig.SingleIssuer, accept submissions only from the
+//     thread that called Enable, which is also where RingConfig.IOWQ
+//     applies.
+//
+// The queue loop calls every method from its own locked OS thread, so the
+// ring need not be safe for concurrent use.
+type Ring = uring.QueueRing
+
+// RingConfig is how a queue wants its ring set up.
+type RingConfig = uring.Config
+
+// RingResult is one completion reaped from a Ring.
+type RingResult = uring.Result
+
+// IOCmd is the ublk I/O command (struct ublksrv_io_cmd) a Ring places in
+// a URING_CMD SQE.
+type IOCmd = uapi.UblksrvIOCmd
+
+// RingStats counts a ring's io_uring traffic. A Ring with a
+// RingStats() RingStats method, as the built-in one has, is reported in
+// MetricsSnapshot.QueueRings.
+type RingStats = uring.RingStats
+
+// RingProvider creates the ring for a queue, or for all of them with
+// DeviceParams.SharedRing. The queue closes it when it stops.
+type RingProvider func(RingConfig) (Ring, error)
@@ -66,33 +66,41 @@ run_fio_test() {
     RESULTS+=("$name|${iops_k}|${bw_mbs}")
 }
 
-# Start ublk device
-# Using multi-queue with depth=64 for optimal performance
-echo "Starting ublk memory device (256MB, multi-queue, depth=64)..."
-sudo ./ublk-mem --size=256M --depth=64 &
-UBLK_PID=$!
-sleep 3
-
-# Verify device exists
-if [ ! -b /dev/ublkb0 ]; then
-    echo "Failed to create ublk device"
-    sudo kill $UBLK_PID 2>/dev/null || true
-    exit 1
-fi
+# Run the ublk workloads against a fresh ublk-mem started with the given
+# extra arguments; label distinguishes the result rows.
+run_ublk_suite() {
+    local label=$1
+    shift
+
+    echo "Starting ublk memory device (256MB, multi-queue, depth=64, $label)..."
+    sudo ./ublk-mem --size=256M --depth=64 "$@" &
+    UBLK_PID=$!
+    sleep 3
+
+    # Verify device exists
+    if [ ! -b /dev/ublkb0 ]; then
+        echo "Failed to create ublk device"
+        sudo kill $UBLK_PID 2>/dev/null || true
+        exit 1
+    fi
 
-echo "Device created at /dev/ublkb0"
-echo ""
+    echo "Device created at /dev/ublkb0"
+    echo ""
+
+    # Single job and multi-job to test scaling
+    run_fio_test /dev/ublkb0 randread 64 1 "ublk $label 4K Read (1 job)"
+    run_fio_test /dev/ublkb0 randread 64 4 "ublk $label 4K Read (4 jobs)"
+    run_fio_test /dev/ublkb0 randwrite 64 4 "ublk $label 4K Write (4 jobs)"
 
-# Run ublk tests - single job and multi-job to test scaling
-run_fio_test /dev/ublkb0 randread 64 1 "ublk 4K Read (1 job, QD=64)"
-run_fio_test /dev/ublkb0 randread 64 4 "ublk 4K Read (4 jobs, QD=64)"
-run_fio_test /dev/ublkb0 randwrite 64 4 "ublk 4K Write (4 jobs, QD=64)"
+    echo "Stopping ublk device..."
+    sudo kill -SIGINT $UBLK_PID
+    wait $UBLK_PID 2>/dev/null || true
+    sleep 1
+}
 
-# Stop ublk device
-echo "Stopping ublk device..."
-sudo kill -SIGINT $UBLK_PID
-wait $UBLK_PID 2>/dev/null || true
-sleep 1
+# Ring-per-queue (default) versus all queues on one shared ring
+run_ublk_suite "ring/q"
+run_ublk_suite "shared" --shared-ring
 
 # Create RAM-backed loop device for fair comparison
 echo ""
@@ -115,11 +123,11 @@ sudo umount /tmp/ramdisk 2>/dev/null || true
 
 echo "=== Summary ==="
 echo ""
-printf "%-30s %12s %12s\n" "Workload" "IOPS" "Throughput"
-printf "%-30s %12s %12s\n" "--------" "----" "----------"
+printf "%-34s %12s %12s\n" "Workload" "IOPS" "Throughput"
+printf "%-34s %12s %12s\n" "--------" "----" "----------"
 for result in "${RESULTS[@]}"; do
     IFS='|' read -r name iops bw <<< "$result"
-    printf "%-30s %10sk %10s MB/s\n" "$name" "$iops" "$bw"
+    printf "%-34s %10sk %10s MB/s\n" "$name" "$iops" "$bw"
 done
 echo ""
 echo "Multi-job scaling shows how well go-ublk utilizes multiple queues."
@@ -0,0 +1,319 @@
+package ublk
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// Scrubber defaults, used for zero fields of ScrubParams
+const (
+	DefaultScrubRate      = 16 << 20 // bytes per second
+	DefaultScrubChunkSize = 1 << 20
+	DefaultScrubIdleTime  = time.Second
+)
+
+// ScrubParams configures the background scrubber, which reads the whole
+// device while it is idle so that unreadable or corrupt blocks are found
+// before a reader hits them. Backends implementing VerifyBackend also have
+// their checksums checked. Scrubbing is off unless Interval is set.
+type ScrubParams struct {
+	// Interval is how long the scrubber rests after finishing a pass before
+	// starting the next. 0 disables scrubbing.
+	Interval time.Duration
+
+	// Rate caps scrub reads in bytes per second (default:
+	// DefaultScrubRate).
+	Rate int64
+
+	// ChunkSize is how much each backend call reads, rounded down to whole
+	// logical blocks (default: DefaultScrubChunkSize).
+	ChunkSize int
+
+	// IdleTime is how long the device must go without a request before
+	// scrubbing resumes. Any request pauses scrubbing after the chunk in
+	// progress (default: DefaultScrubIdleTime).
+	IdleTime time.Duration
+}
+
+// ScrubStatus describes the scrubber's progress, as returned by
+// Device.ScrubStatus. It is JSON-friendly like HealthReport.
+type ScrubStatus struct {
+	Enabled bool `json:"enabled"`
+	// Active is true while chunks are being read, false while the
+	// scrubber waits for the device to go idle or for the next pass
+	Active bool `json:"active"`
+
+	Passes   uint64        `json:"passes"`   // completed passes
+	Offset   int64         `json:"offset"`   // position in the current pass
+	Size     int64         `json:"size"`     // length of the current pass
+	Progress float64       `json:"progress"` // Offset/Size
+	ETA      time.Duration `json:"eta_ns"`   // estimated time to finish the pass, idle waits included
+
+	ScrubbedBytes   uint64    `json:"scrubbed_bytes"`
+	Errors          uint64    `json:"errors"`
+	LastError       string    `json:"last_error,omitempty"`
+	LastErrorOffset int64     `json:"last_error_offset,omitempty"`
+	LastPass        time.Time `json:"last_pass,omitempty"` // when the last complete pass finished
+}
+
+// ScrubStatus reports the background scrubber's progress. Progress is kept
+// across Stop and Start, so a paused device resumes its pass where it left
+// off.
+func (d *Device) ScrubStatus() ScrubStatus {
+	if d == nil || d.metrics == nil {
+		return ScrubStatus{}
+	}
+	m := d.metrics
+	status := ScrubStatus{
+		Enabled:       d.params.Scrub.Interval > 0,
+		Passes:        m.ScrubPasses.Load(),
+		Offset:        m.ScrubOffset.Load(),
+		Size:          m.ScrubSize.Load(),
+		ScrubbedBytes: m.ScrubBytes.Load(),
+		Errors:        m.ScrubErrors.Load(),
+	}
+	status.Progress, status.ETA = m.scrubProgress()
+	if s := d.scrub; s != nil {
+		status.Active = s.active.Load()
+		s.mu.Lock()
+		if s.lastErr != nil {
+			status.LastError = s.lastErr.Error()
+			status.LastErrorOffset = s.lastErrOffset
+		}
+		status.LastPass = s.lastPass
+		s.mu.Unlock()
+	}
+	return status
+}
+
+// scrubProgress returns how far through its current pass the scrubber is
+// and, from the pace so far, how long the rest will take.
+func (m *Metrics) scrubProgress() (progress float64, eta time.Duration) {
+	offset, size := m.ScrubOffset.Load(), m.ScrubSize.Load()
+	if size <= 0 {
+		return 0, 0
+	}
+	progress = float64(offset) / float64(size)
+	if offset > 0 && offset < size {
+		elapsed := time.Since(time.Unix(0, m.ScrubPassStart.Load()))
+		eta = time.Duration(float64(elapsed) * float64(size-offset) / float64(offset))
+	}
+	return progress, eta
+}
+
+// startScrubber starts the background scrubber if DeviceParams.Scrub asks
+// for one. It runs until the device context is cancelled.
+func (d *Device) startScrubber() {
+	if d.params.Scrub.Interval <= 0 {
+		return
+	}
+	if d.scrub == nil {
+		d.scrub = newScrubber(d.Backend, d.params.Scrub, d.blockSize, &d.gate, &d.activity, d.metrics, d.events, d.Path)
+	}
+	d.scrub.start(d.ctx)
+}
+
+// scrubber reads a device's backend in the background. Reads hold the
+// device gate shared, like requests from the queues, so they never overlap
+// a snapshot.
+type scrubber struct {
+	params   ScrubParams // defaults filled in
+	backend  Backend
+	gate     *sync.RWMutex
+	activity *atomic.Uint64 // bumped by the queues for every request
+	metrics  *Metrics
+	events   *eventLog
+	path     string
+
+	// Owned by the run goroutine
+	seen  uint64    // activity when last checked
+	quiet time.Time // when activity last changed
+
+	active atomic.Bool
+	done   chan struct{} // closed when run returns; nil if never started
+
+	mu            sync.Mutex
+	lastErr       error
+	lastErrOffset int64
+	lastPass      time.Time
+}
+
+func newScrubber(
+	backend Backend, params ScrubParams, blockSize int, gate *sync.RWMutex,
+	activity *atomic.Uint64, metrics *Metrics, events *eventLog, path string,
+) *scrubber {
+	if params.Rate <= 0 {
+		params.Rate = DefaultScrubRate
+	}
+	if params.ChunkSize <= 0 {
+		params.ChunkSize = DefaultScrubChunkSize
+	}
+	if blockSize > 0 {
+		params.ChunkSize = max(params.ChunkSize/blockSize*blockSize, blockSize)
+	}
+	if params.IdleTime <= 0 {
+		params.IdleTime = DefaultScrubIdleTime
+	}
+	return &scrubber{
+		params:   params,
+		backend:  backend,
+		gate:     gate,
+		activity: activity,
+		metrics:  metrics,
+		events:   events,
+		path:     path,
+	}
+}
+
+// start runs the scrubber until ctx is done, beginning once the device has
+// been idle for IdleTime. The caller must wait for a previous run to finish
+// first.
+func (s *scrubber) start(ctx context.Context) {
+	s.seen, s.quiet = s.activity.Load(), time.Now()
+	s.done = make(chan struct{})
+	go s.run(ctx)
+}
+
+// wait blocks until the scrubber has stopped, so the backend can be
+// closed. It is a no-op on a nil or never-started scrubber.
+func (s *scrubber) wait() {
+	if s != nil && s.done != nil {
+		<-s.done
+	}
+}
+
+func (s *scrubber) run(ctx context.Context) {
+	defer close(s.done)
+	defer s.active.Store(false)
+	for {
+		if err := s.pass(ctx); err != nil {
+			return
+		}
+		if !sleepContext(ctx, s.params.Interval) {
+			return
+		}
+	}
+}
+
+// pass scrubs from the saved offset to the end of the device, starting a
+// new pass if the last one finished. It only returns an error when ctx is
+// done; read errors are recorded and the pass moves on.
+func (s *scrubber) pass(ctx context.Context) error {
+	m := s.metrics
+	offset, size := m.ScrubOffset.Load(), m.ScrubSize.Load()
+	if size <= 0 || offset >= size {
+		// The backend is swapped under the gate by MigrateBackend
+		s.gate.RLock()
+		offset, size = 0, s.backend.Size()
+		s.gate.RUnlock()
+		m.ScrubOffset.Store(0)
+		m.ScrubSize.Store(size)
+		m.ScrubPassStart.Store(time.Now().UnixNano())
+	}
+
+	var failed uint64
+	buf := make([]byte, s.params.ChunkSize)
+	for offset < size {
+		if err := s.waitIdle(ctx); err != nil {
+			return err
+		}
+		s.active.Store(true)
+
+		n := min(int64(len(buf)), size-offset)
+		start := time.Now()
+		if err := s.scrubChunk(buf[:n], offset); err != nil {
+			s.recordError(offset, n, err)
+			failed++
+		}
+		offset += n
+		m.ScrubOffset.Store(offset)
+		m.ScrubBytes.Add(uint64(n))
+
+		// Pace reads to the configured rate
+		pace := time.Duration(n) * time.Second / time.Duration(s.params.Rate)
+		if !sleepContext(ctx, pace-time.Since(start)) {
+			return ctx.Err()
+		}
+	}
+	s.active.Store(false)
+
+	m.ScrubPasses.Add(1)
+	s.mu.Lock()
+	s.lastPass = time.Now()
+	s.mu.Unlock()
+	logging.Default().Info("scrub pass complete", "device", s.path, "bytes", size, "errors", failed,
+		"duration", time.Since(time.Unix(0, m.ScrubPassStart.Load())))
+	return nil
+}
+
+// waitIdle returns once no request has arrived for IdleTime.
+func (s *scrubber) waitIdle(ctx context.Context) error {
+	for {
+		seen := s.activity.Load()
+		if seen != s.seen {
+			s.seen, s.quiet = seen, time.Now()
+			s.active.Store(false)
+		}
+		wait := s.params.IdleTime - time.Since(s.quiet)
+		if wait <= 0 {
+			return nil
+		}
+		if !sleepContext(ctx, wait) {
+			return ctx.Err()
+		}
+	}
+}
+
+// scrubChunk reads p from off, verifying it if the backend can.
+func (s *scrubber) scrubChunk(p []byte, off int64) error {
+	s.gate.RLock()
+	defer s.gate.RUnlock()
+
+	if vb, ok := s.backend.(VerifyBackend); ok {
+		return vb.Verify(p, off)
+	}
+	// A backend may end its data early and read as zeros from there
+	if _, err := s.backend.ReadAt(p, off); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (s *scrubber) recordError(off, n int64, err error) {
+	s.metrics.ScrubErrors.Add(1)
+	s.mu.Lock()
+	s.lastErr, s.lastErrOffset = err, off
+	s.mu.Unlock()
+
+	s.events.record(Event{
+		Type:   EventScrubError,
+		Queue:  -1,
+		Tag:    -1,
+		Op:     "scrub",
+		Offset: uint64(off),
+		Length: uint32(n),
+		Error:  err.Error(),
+	})
+	logging.Default().Warn("scrub read failed", "device", s.path, "offset", off, "length", n, "error", err)
+}
+
+// sleepContext sleeps for d or until ctx is done, and reports whether ctx
+// is still live.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,175 @@
+package ublk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// corruptBackend fails verification of the chunk holding bad
+type corruptBackend struct {
+	*MockBackend
+	bad int64
+}
+
+func (b *corruptBackend) Verify(p []byte, off int64) error {
+	if _, err := b.ReadAt(p, off); err != nil {
+		return err
+	}
+	if b.bad >= off && b.bad < off+int64(len(p)) {
+		return fmt.Errorf("checksum mismatch at %d: %w", b.bad, syscall.EILSEQ)
+	}
+	return nil
+}
+
+type scrubHarness struct {
+	*scrubber
+	gate     sync.RWMutex
+	activity atomic.Uint64
+	metrics  *Metrics
+	events   *eventLog
+}
+
+func newScrubHarness(backend Backend, params ScrubParams) *scrubHarness {
+	h := &scrubHarness{metrics: NewMetrics(), events: newEventLog(0)}
+	h.scrubber = newScrubber(backend, params, 512, &h.gate, &h.activity, h.metrics, h.events, "/dev/ublkb0")
+	return h
+}
+
+func TestScrubberPass(t *testing.T) {
+	backend := NewMockBackend(1 << 20)
+	h := newScrubHarness(backend, ScrubParams{
+		Interval:  time.Hour,
+		Rate:      1 << 40,
+		ChunkSize: 64 << 10,
+		IdleTime:  time.Millisecond,
+	})
+
+	if err := h.pass(context.Background()); err != nil {
+		t.Fatalf("pass: %v", err)
+	}
+	if got := backend.CallCounts()["read"]; got != 16 {
+		t.Errorf("backend reads = %d, want 16", got)
+	}
+	snap := h.metrics.Snapshot()
+	if snap.ScrubPasses != 1 || snap.ScrubBytes != 1<<20 || snap.ScrubErrors != 0 {
+		t.Errorf("scrub metrics = %d passes, %d bytes, %d errors", snap.ScrubPasses, snap.ScrubBytes, snap.ScrubErrors)
+	}
+	if snap.ScrubProgress != 1 || snap.ScrubETANs != 0 {
+		t.Errorf("progress = %v, eta = %d after a full pass", snap.ScrubProgress, snap.ScrubETANs)
+	}
+}
+
+func TestScrubberVerifyError(t *testing.T) {
+	backend := &corruptBackend{MockBackend: NewMockBackend(256 << 10), bad: 100 << 10}
+	h := newScrubHarness(backend, ScrubParams{
+		Interval:  time.Hour,
+		Rate:      1 << 40,
+		ChunkSize: 64 << 10,
+		IdleTime:  time.Millisecond,
+	})
+	device := &Device{metrics: h.metrics, scrub: h.scrubber, params: DeviceParams{Scrub: h.params}}
+
+	if err := h.pass(context.Background()); err != nil {
+		t.Fatalf("pass: %v", err)
+	}
+	status := device.ScrubStatus()
+	if status.Errors != 1 || status.LastErrorOffset != 64<<10 || status.LastError == "" {
+		t.Errorf("status = %+v, want one error at 64KiB", status)
+	}
+	if !status.Enabled || status.Passes != 1 || status.LastPass.IsZero() {
+		t.Errorf("status = %+v, want one completed pass", status)
+	}
+	if got := h.events.snapshot(); len(got) != 1 || got[0].Type != EventScrubError || got[0].Offset != 64<<10 {
+		t.Errorf("events = %v, want one scrub error", got)
+	}
+}
+
+func TestScrubberWaitsForIdle(t *testing.T) {
+	backend := NewMockBackend(64 << 10)
+	h := newScrubHarness(backend, ScrubParams{
+		Interval:  time.Hour,
+		Rate:      1 << 40,
+		ChunkSize: 4096,
+		IdleTime:  50 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Requests keep arriving, so nothing may be scrubbed
+	stop := make(chan struct{})
+	busy := make(chan struct{})
+	go func() {
+		defer close(busy)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				h.activity.Add(1)
+			}
+		}
+	}()
+	h.start(ctx)
+	time.Sleep(150 * time.Millisecond)
+	if got := h.metrics.ScrubBytes.Load(); got != 0 {
+		t.Errorf("scrubbed %d bytes while the device was busy", got)
+	}
+
+	close(stop)
+	<-busy
+	deadline := time.Now().Add(5 * time.Second)
+	for h.metrics.ScrubPasses.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("scrub pass did not finish once the device went idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	h.wait()
+}
+
+func TestScrubberResumes(t *testing.T) {
+	backend := NewMockBackend(64 << 10)
+	h := newScrubHarness(backend, ScrubParams{
+		Interval:  time.Hour,
+		Rate:      1 << 40,
+		ChunkSize: 4096,
+		IdleTime:  time.Millisecond,
+	})
+
+	// A pass interrupted half way picks up where it stopped
+	h.metrics.ScrubSize.Store(64 << 10)
+	h.metrics.ScrubOffset.Store(32 << 10)
+	h.metrics.ScrubPassStart.Store(time.Now().UnixNano())
+	if err := h.pass(context.Background()); err != nil {
+		t.Fatalf("pass: %v", err)
+	}
+	if got := h.metrics.ScrubBytes.Load(); got != 32<<10 {
+		t.Errorf("scrubbed %d bytes, want the remaining %d", got, 32<<10)
+	}
+}
+
+func TestScrubProgress(t *testing.T) {
+	m := NewMetrics()
+	if progress, eta := m.scrubProgress(); progress != 0 || eta != 0 {
+		t.Errorf("before any pass: progress = %v, eta = %v", progress, eta)
+	}
+
+	// A quarter done in 10s leaves about 30s
+	m.ScrubSize.Store(400)
+	m.ScrubOffset.Store(100)
+	m.ScrubPassStart.Store(time.Now().Add(-10 * time.Second).UnixNano())
+	progress, eta := m.scrubProgress()
+	if progress != 0.25 {
+		t.Errorf("progress = %v, want 0.25", progress)
+	}
+	if eta < 29*time.Second || eta > 31*time.Second {
+		t.Errorf("eta = %v, want about 30s", eta)
+	}
+}
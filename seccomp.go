@@ -0,0 +1,26 @@
+package ublk
+
+// SeccompAction is what a seccomp filter does with a syscall it does not
+// allow.
+type SeccompAction int
+
+const (
+	// SeccompErrno fails the syscall with EPERM.
+	SeccompErrno SeccompAction = iota
+	// SeccompKill kills the process.
+	SeccompKill
+	// SeccompLog allows the syscall but logs it to the audit log, to find
+	// out what a backend needs before enforcing a filter.
+	SeccompLog
+)
+
+// SeccompOptions configure InstallSeccomp.
+type SeccompOptions struct {
+	// Action is taken on syscalls that are not allowed (default: SeccompErrno).
+	Action SeccompAction
+
+	// Allow adds syscall numbers (unix.SYS_*) the backend needs beyond
+	// SeccompSyscalls, such as SeccompNetworkSyscalls for a backend that
+	// talks to a remote store.
+	Allow []uintptr
+}
@@ -0,0 +1,161 @@
+//go:build amd64 || arm64
+
+package ublk
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SeccompSyscalls are the syscalls a device server needs after setup:
+//
+//   - io_uring_enter and io_uring_register run every queue's I/O loop;
+//     io_uring_setup, openat and mmap are also needed to reopen the control
+//     device for Stop, Close and the other control commands
+//   - read, write, pread64, pwrite64 and their vectored forms move data to
+//     and from backends and the character device (user copy), and write
+//     the eventfds that wake queues; fsync, fdatasync, fallocate and
+//     ftruncate serve flush, discard and write-zeroes in file backends
+//   - close, fcntl, lseek and fstat are used by os.File; mkdirat,
+//     renameat, unlinkat and getdents64 replace Options.MetricsFile and
+//     the records in Options.StateDir, and read directories
+//   - sched_setaffinity pins queues to Options.CPUAffinity again when the
+//     supervisor restarts them or a device resumes, and capget explains a
+//     control device that cannot be opened
+//   - the rest serve the Go runtime: threads, signals, memory, timers and
+//     the netpoller
+//
+// Setup itself (creating devices, opening backend files) needs more, so
+// install a filter only once devices have started.
+var SeccompSyscalls = append([]uintptr{
+	// io_uring
+	unix.SYS_IO_URING_SETUP, unix.SYS_IO_URING_ENTER, unix.SYS_IO_URING_REGISTER,
+
+	// I/O
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_PREAD64, unix.SYS_PWRITE64,
+	unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREADV, unix.SYS_PWRITEV,
+	unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_FALLOCATE, unix.SYS_FTRUNCATE,
+	unix.SYS_OPENAT, unix.SYS_CLOSE, unix.SYS_FCNTL, unix.SYS_LSEEK,
+	unix.SYS_FSTAT, unix.SYS_NEWFSTATAT, unix.SYS_MKDIRAT, unix.SYS_RENAMEAT,
+	unix.SYS_RENAMEAT2, unix.SYS_UNLINKAT, unix.SYS_GETDENTS64,
+
+	// Memory
+	unix.SYS_MMAP, unix.SYS_MUNMAP, unix.SYS_MADVISE, unix.SYS_MPROTECT,
+
+	// Threads and scheduling
+	unix.SYS_CLONE, unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_FUTEX,
+	unix.SYS_GETTID, unix.SYS_GETPID, unix.SYS_SCHED_YIELD,
+	unix.SYS_SCHED_GETAFFINITY, unix.SYS_SCHED_SETAFFINITY, unix.SYS_NANOSLEEP,
+	unix.SYS_CLOCK_NANOSLEEP, unix.SYS_CLOCK_GETTIME, unix.SYS_RESTART_SYSCALL,
+	unix.SYS_GETRANDOM, unix.SYS_CAPGET,
+
+	// Signals
+	unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN,
+	unix.SYS_SIGALTSTACK, unix.SYS_TGKILL,
+
+	// Timers (profiling) and the netpoller
+	unix.SYS_TIMER_CREATE, unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_DELETE,
+	unix.SYS_SETITIMER, unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL,
+	unix.SYS_EPOLL_PWAIT, unix.SYS_EVENTFD2, unix.SYS_PIPE2,
+}, archSeccompSyscalls...)
+
+// SeccompNetworkSyscalls are the extra syscalls a backend that talks over
+// the network, such as backend/httprange, needs.
+var SeccompNetworkSyscalls = []uintptr{
+	unix.SYS_SOCKET, unix.SYS_CONNECT, unix.SYS_GETSOCKOPT, unix.SYS_SETSOCKOPT,
+	unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME, unix.SYS_SENDTO, unix.SYS_RECVFROM,
+	unix.SYS_SENDMSG, unix.SYS_RECVMSG, unix.SYS_SHUTDOWN, unix.SYS_UNAME,
+}
+
+// InstallSeccomp confines every thread of the process to SeccompSyscalls
+// and opts.Allow with a seccomp filter, which cannot be removed. It also
+// sets no_new_privs. Call it after the devices have started, and after
+// DropPrivileges, which the filter forbids.
+func InstallSeccomp(opts SeccompOptions) error {
+	prog, err := seccompFilter(slices.Concat(SeccompSyscalls, opts.Allow), opts.Action)
+	if err != nil {
+		return err
+	}
+
+	// no_new_privs is per thread; TSYNC copies it along with the filter to
+	// the other threads
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return seccompError("PR_SET_NO_NEW_PRIVS", err)
+	}
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	r, _, errno := syscall.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(prog)
+	if errno != 0 {
+		return seccompError("seccomp", errno)
+	}
+	if r != 0 {
+		return seccompError("seccomp", fmt.Errorf("thread %d could not be synchronized", r))
+	}
+	return nil
+}
+
+// seccompFilter builds a BPF program that kills the process on a foreign
+// architecture, allows the syscalls in allow and takes action on the rest.
+func seccompFilter(allow []uintptr, action SeccompAction) ([]unix.SockFilter, error) {
+	var deny uint32
+	switch action {
+	case SeccompErrno:
+		deny = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	case SeccompKill:
+		deny = unix.SECCOMP_RET_KILL_PROCESS
+	case SeccompLog:
+		deny = unix.SECCOMP_RET_LOG
+	default:
+		return nil, NewError("SECCOMP", ErrCodeInvalidParameters, fmt.Sprintf("unknown seccomp action %d", action))
+	}
+	// Each syscall takes one jump, whose offset must fit in a byte
+	if len(allow) > 255 {
+		return nil, NewError("SECCOMP", ErrCodeInvalidParameters, "too many syscalls to allow")
+	}
+
+	const (
+		ldAbs = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq   = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		ret   = unix.BPF_RET | unix.BPF_K
+		// Offsets in struct seccomp_data
+		nrOffset   = 0
+		archOffset = 4
+	)
+	prog := []unix.SockFilter{
+		{Code: ldAbs, K: archOffset},
+		{Code: jeq, Jt: 1, K: auditArch},
+		{Code: ret, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: ldAbs, K: nrOffset},
+	}
+	for i, nr := range allow {
+		// Jump over the remaining checks and the deny to the allow
+		prog = append(prog, unix.SockFilter{Code: jeq, Jt: uint8(len(allow) - i), K: uint32(nr)})
+	}
+	prog = append(prog,
+		unix.SockFilter{Code: ret, K: deny},
+		unix.SockFilter{Code: ret, K: unix.SECCOMP_RET_ALLOW},
+	)
+	return prog, nil
+}
+
+func seccompError(call string, err error) error {
+	e := &Error{
+		Op:    "SECCOMP",
+		Code:  ErrCodePermissionDenied,
+		Msg:   fmt.Sprintf("installing seccomp filter: %s failed", call),
+		Inner: err,
+		Queue: NoQueue,
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		e.Errno = errno
+	}
+	return e
+}
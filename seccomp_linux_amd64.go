@@ -0,0 +1,12 @@
+package ublk
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_X86_64
+
+// archSeccompSyscalls are the amd64 syscalls without a generic equivalent
+// that the Go runtime and os package may still use.
+var archSeccompSyscalls = []uintptr{
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_EPOLL_WAIT,
+	unix.SYS_PIPE, unix.SYS_ARCH_PRCTL,
+}
@@ -0,0 +1,8 @@
+package ublk
+
+import "golang.org/x/sys/unix"
+
+const auditArch = unix.AUDIT_ARCH_AARCH64
+
+// archSeccompSyscalls is empty: arm64 only has the generic syscalls.
+var archSeccompSyscalls []uintptr
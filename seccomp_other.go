@@ -0,0 +1,33 @@
+//go:build linux && !amd64 && !arm64
+
+package ublk
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// The syscall tables are only written for amd64 and arm64; elsewhere the
+// allow lists are empty and InstallSeccomp fails.
+
+// auditArch is zero where InstallSeccomp does not know the architecture.
+const auditArch = 0
+
+// SeccompSyscalls and SeccompNetworkSyscalls are empty on this architecture.
+var (
+	SeccompSyscalls        []uintptr
+	SeccompNetworkSyscalls []uintptr
+)
+
+// InstallSeccomp fails with ErrKernelNotSupported on this architecture.
+func InstallSeccomp(opts SeccompOptions) error {
+	_, err := seccompFilter(nil, opts.Action)
+	return err
+}
+
+func seccompFilter(allow []uintptr, action SeccompAction) ([]unix.SockFilter, error) {
+	return nil, NewError("SECCOMP", ErrCodeKernelNotSupported,
+		fmt.Sprintf("seccomp filters are not supported on %s", runtime.GOARCH))
+}
@@ -0,0 +1,206 @@
+//go:build linux
+
+package ublk
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+	"github.com/ehrlich-b/go-ublk/internal/uring"
+	"golang.org/x/sys/unix"
+)
+
+// seccompEnv makes TestSeccompChild install the filter; it cannot be
+// removed, so it never happens in the test process.
+const seccompEnv = "GO_UBLK_TEST_SECCOMP"
+
+func TestSeccomp(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("seccomp not supported on", runtime.GOARCH)
+	}
+	// One process per filter: filters stack and cannot be removed
+	for _, child := range []string{"TestSeccompChild", "TestSeccompErrnoChild", "TestSeccompDeviceChild"} {
+		t.Run(child, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^"+child+"$", "-test.v")
+			cmd.Env = append(os.Environ(), seccompEnv+"=1")
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+			if !strings.Contains(string(out), "--- PASS") {
+				t.Fatalf("child did not pass:\n%s", out)
+			}
+		})
+	}
+}
+
+// TestSeccompChild exercises a data plane under a filter that kills the
+// process on any syscall it does not allow.
+func TestSeccompChild(t *testing.T) {
+	if os.Getenv(seccompEnv) == "" {
+		t.Skip("run by TestSeccomp")
+	}
+	ring, err := uring.NewRing(uring.Config{Entries: 8, FD: -1})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ring.Close()
+	efd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(efd)
+	// Unlinked up front: removing a directory needs getdents64
+	file, err := os.CreateTemp("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+
+	if err := InstallSeccomp(SeccompOptions{Action: SeccompKill}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An io_uring round trip, as a queue's I/O loop makes
+	if err := ring.PreparePollAdd(int32(efd), 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.FlushSubmissions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Write(efd, []byte{1, 0, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ring.WaitForCompletion(1000); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backend I/O across goroutines, timers and garbage collection
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			file.WriteAt(buf, int64(i)*4096)
+			file.ReadAt(buf, int64(i)*4096)
+			time.Sleep(time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	runtime.GC()
+	if err := file.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSeccompDeviceChild runs what a started device does after setup under
+// the killing filter: restarting pinned queues, writing the metrics file
+// and device record and stopping and closing. No control device is needed: Stop and Close
+// fail once they reach it, but must not be killed on the way.
+func TestSeccompDeviceChild(t *testing.T) {
+	if os.Getenv(seccompEnv) == "" {
+		t.Skip("run by TestSeccomp")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := NewMockBackend(1 << 20)
+	runner, sim, err := queue.NewSimRunner(ctx, queue.Config{Depth: 4, Backend: backend, CPUAffinity: []int{0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	metricsFile := filepath.Join(dir, "metrics.json")
+	stateDir := filepath.Join(t.TempDir(), "state") // Created by Stop
+	device := &Device{
+		// Beyond any ID the driver hands out, should a control device exist
+		ID:      1 << 20,
+		Path:    "/dev/ublkb-seccomp",
+		Backend: backend,
+		started: true,
+		ctx:     ctx,
+		cancel:  cancel,
+		runners: []*queue.Runner{runner},
+		events:  newEventLog(0),
+		failed:  make(chan struct{}),
+		params:  DefaultParams(backend),
+		options: &Options{MetricsFile: metricsFile, FlushOnStop: true, StateDir: stateDir},
+	}
+
+	// The simulated ring waits in ppoll where a real one enters io_uring
+	if err := InstallSeccomp(SeccompOptions{Action: SeccompKill, Allow: []uintptr{unix.SYS_PPOLL}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The I/O loop pins itself, as it does again after a restart
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4096)
+	req := sim.Submit(uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, NrSectors: 8}, data)
+	<-req.Done()
+	if res := req.Result(); res != 4096 {
+		t.Fatalf("write = %d, want 4096", res)
+	}
+
+	// Two metrics file ticks: create, then replace
+	for range 2 {
+		if err := replaceJSONFile(metricsFile, NewMetrics().Snapshot()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Fatalf("ReadDir = %v, %v; want the metrics file alone", entries, err)
+	}
+
+	if err := device.Stop(); err == nil {
+		t.Error("Stop succeeded without a control device")
+	}
+	if err := device.Close(); err == nil {
+		t.Error("Close succeeded without a control device")
+	}
+	if records, err := ReadDeviceRecords(stateDir); err != nil || len(records) != 1 {
+		t.Fatalf("records = %+v, %v; want the stopped device", records, err)
+	}
+	device.removeRecord()
+}
+
+func TestSeccompErrnoChild(t *testing.T) {
+	if os.Getenv(seccompEnv) == "" {
+		t.Skip("run by TestSeccomp")
+	}
+	if err := InstallSeccomp(SeccompOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0); !errors.Is(err, unix.EPERM) {
+		t.Errorf("socket under the filter = %v, want EPERM", err)
+	}
+}
+
+func TestSeccompFilter(t *testing.T) {
+	if auditArch == 0 {
+		t.Skip("seccomp not supported on", runtime.GOARCH)
+	}
+	prog, err := seccompFilter([]uintptr{1, 2, 3}, SeccompErrno)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Arch check, syscall load, three checks, deny and allow
+	if len(prog) != 9 || prog[4].Jt != 3 || prog[6].Jt != 1 || prog[8].K != unix.SECCOMP_RET_ALLOW {
+		t.Errorf("unexpected program %+v", prog)
+	}
+	if _, err := seccompFilter(nil, SeccompAction(9)); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("unknown action: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package ublk
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// slowIOLogInterval is the least time between two slow I/O log lines of
+// a device; slow requests in between are counted in the next line.
+const slowIOLogInterval = time.Second
+
+// slowIOLog logs requests the backend took longer than a threshold to
+// serve, at most once per slowIOLogInterval.
+type slowIOLog struct {
+	deviceID  uint32
+	threshold time.Duration
+
+	mu         sync.Mutex
+	lastLogged time.Time
+	suppressed int // Slow requests not logged since lastLogged
+}
+
+// newSlowIOLog returns nil if threshold does not enable the log.
+func newSlowIOLog(deviceID uint32, threshold time.Duration) *slowIOLog {
+	if threshold <= 0 {
+		return nil
+	}
+	return &slowIOLog{deviceID: deviceID, threshold: threshold}
+}
+
+// record logs the request in desc if it was slow. It is a queue.TraceFunc.
+func (l *slowIOLog) record(
+	queueID, tag uint16, desc uapi.UblksrvIODesc, start time.Time, latency time.Duration, errno syscall.Errno,
+) {
+	if latency < l.threshold {
+		return
+	}
+	suppressed, ok := l.allow(start.Add(latency))
+	if !ok {
+		return
+	}
+	args := []any{
+		"device", l.deviceID,
+		"op", opName(desc.GetOp()),
+		"offset", desc.StartSector << 9,
+		"length", desc.NrSectors << 9,
+		"queue", queueID,
+		"tag", tag,
+		"duration", latency,
+	}
+	if errno != 0 {
+		args = append(args, "error", errno.Error())
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logging.Default().Warn("slow I/O", args...)
+}
+
+// allow reports whether a slow request that finished at now may be logged,
+// and how many were not since the last line.
+func (l *slowIOLog) allow(now time.Time) (suppressed int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastLogged) < slowIOLogInterval {
+		l.suppressed++
+		return 0, false
+	}
+	suppressed = l.suppressed
+	l.lastLogged = now
+	l.suppressed = 0
+	return suppressed, true
+}
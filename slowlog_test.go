@@ -0,0 +1,73 @@
+package ublk
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+func TestSlowIOLog(t *testing.T) {
+	var buf bytes.Buffer
+	prev := logging.Default()
+	logging.SetDefault(logging.NewLogger(&logging.Config{Level: logging.LevelInfo, Output: &buf}))
+	defer logging.SetDefault(prev)
+
+	if newSlowIOLog(1, 0) != nil {
+		t.Error("slow I/O log enabled without a threshold")
+	}
+	l := newSlowIOLog(3, 10*time.Millisecond)
+	desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE, StartSector: 8, NrSectors: 16}
+	start := time.Now()
+
+	l.record(0, 1, desc, start, time.Millisecond, 0)
+	if buf.Len() != 0 {
+		t.Fatalf("fast request logged: %q", buf.String())
+	}
+
+	l.record(2, 5, desc, start, 20*time.Millisecond, 0)
+	line := buf.String()
+	for _, want := range []string{
+		"WARN", "slow I/O", "device=3", "op=write", "offset=4096", "length=8192", "queue=2", "tag=5", "duration=20ms",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("log line %q lacks %q", line, want)
+		}
+	}
+
+	// Within the interval slow requests are only counted
+	buf.Reset()
+	l.record(0, 1, desc, start.Add(100*time.Millisecond), 50*time.Millisecond, 0)
+	l.record(0, 2, desc, start.Add(200*time.Millisecond), 50*time.Millisecond, 0)
+	if buf.Len() != 0 {
+		t.Fatalf("slow request logged within the interval: %q", buf.String())
+	}
+	l.record(0, 1, desc, start.Add(2*slowIOLogInterval), 50*time.Millisecond, 0)
+	if line := buf.String(); !strings.Contains(line, "suppressed=2") {
+		t.Errorf("log line %q does not count the 2 requests left out", line)
+	}
+}
+
+func TestRequestHook(t *testing.T) {
+	var d Device
+	if d.requestHook() != nil {
+		t.Error("hook without a trace or slow I/O log")
+	}
+	var trace bytes.Buffer
+	d.trace = NewTraceWriter(&trace, 512)
+	d.slowIO = newSlowIOLog(0, time.Hour)
+	d.requestHook()(0, 0, uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_READ, NrSectors: 8}, time.Now(), time.Millisecond, 0)
+	if err := d.trace.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewTraceReader(&trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, err := r.Next(); err != nil || rec.Op != TraceRead {
+		t.Errorf("traced %+v, %v; want the read", rec, err)
+	}
+}
@@ -0,0 +1,85 @@
+package ublk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeviceSnapshot(t *testing.T) {
+	backend := NewMockBackend(1 << 20)
+	device := &Device{ID: 1, Path: "/dev/ublkb1", Backend: backend, events: newEventLog(0)}
+
+	backend.WriteAt([]byte("before"), 0)
+	snap, err := device.Snapshot("base")
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+	if snap.Name != "base" || snap.Source != "/dev/ublkb1" || snap.Size != 1<<20 {
+		t.Errorf("snapshot = %+v", snap)
+	}
+	if !backend.IsFlushed() {
+		t.Error("backend was not flushed before the snapshot")
+	}
+	if got := device.Events(); len(got) != 1 || got[0].Type != EventSnapshot {
+		t.Errorf("events = %v, want one snapshot event", got)
+	}
+
+	// Later writes to the origin do not reach clones of the snapshot
+	backend.WriteAt([]byte("after!"), 0)
+	clone, err := cloneBackend(snap, "")
+	if err != nil {
+		t.Fatalf("cloneBackend: %v", err)
+	}
+	buf := make([]byte, 6)
+	clone.ReadAt(buf, 0)
+	if !bytes.Equal(buf, []byte("before")) {
+		t.Errorf("clone reads %q, want %q", buf, "before")
+	}
+}
+
+func TestDeviceSnapshotQuiesces(t *testing.T) {
+	device := &Device{ID: 1, Backend: NewMockBackend(4096)}
+
+	// A request in the backend holds the gate shared, as the queues do
+	device.gate.RLock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := device.Snapshot("s")
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("snapshot was taken while a request was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	device.gate.RUnlock()
+	if err := <-done; err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+}
+
+func TestDeviceSnapshotErrors(t *testing.T) {
+	plain := struct{ Backend }{NewMockBackend(4096)}
+	device := &Device{ID: 1, Backend: plain}
+	if _, err := device.Snapshot("s"); !errors.Is(err, ErrNotImplemented) {
+		t.Errorf("Snapshot without SnapshotBackend = %v, want ErrNotImplemented", err)
+	}
+
+	device = &Device{ID: 1, Backend: NewMockBackend(4096)}
+	if _, err := device.Snapshot(""); !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("Snapshot with empty name = %v, want ErrInvalidParameters", err)
+	}
+	device.closed = true
+	if _, err := device.Snapshot("s"); err == nil {
+		t.Error("Snapshot of a closed device succeeded")
+	}
+
+	_, err := CloneDevice(context.Background(), &Snapshot{Name: "s"}, DefaultParams(nil), nil)
+	if !errors.Is(err, ErrInvalidParameters) {
+		t.Errorf("CloneDevice of a foreign snapshot = %v, want ErrInvalidParameters", err)
+	}
+}
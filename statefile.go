@@ -0,0 +1,184 @@
+package ublk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// DefaultStateDir is where tooling looks for device records by default;
+// pass it as Options.StateDir to keep records there.
+const DefaultStateDir = "/run/go-ublk"
+
+// DeviceRecord is what Options.StateDir keeps about a device from creation
+// until Close. A record whose process is gone names a device that was
+// never closed: it may still be in the kernel, waiting to be deleted or
+// recovered by a process serving the same parameters and backend.
+type DeviceRecord struct {
+	ID        uint32      `json:"id"`
+	PID       int         `json:"pid"` // Process serving the device
+	State     DeviceState `json:"state"`
+	BlockPath string      `json:"block_path"`
+	CharPath  string      `json:"char_path"`
+	// ParamsHash is a hex SHA-256 of the parameters the device was
+	// created with, for telling whether a new process would recreate it
+	ParamsHash string    `json:"params_hash"`
+	Backend    string    `json:"backend"` // Backend's String(), or its type
+	Size       int64     `json:"size"`
+	Updated    time.Time `json:"updated"`
+}
+
+// Alive reports whether the process that wrote r is still running. A
+// process with the same PID started since would also count.
+func (r DeviceRecord) Alive() bool {
+	return r.PID > 0 && processAlive(r.PID)
+}
+
+// ReadDeviceRecords returns the records in dir, ordered by device ID. A
+// missing dir holds no records.
+func ReadDeviceRecords(dir string) ([]DeviceRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "ublk*.json"))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]DeviceRecord, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Closed since the glob
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record DeviceRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records, nil
+}
+
+// recordPath is where dir keeps the record of device id.
+func recordPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("ublk%d.json", id))
+}
+
+// saveRecord replaces d's record in Options.StateDir, if set. A record
+// that cannot be written is logged, not returned: the device serves the
+// same without it.
+func (d *Device) saveRecord() {
+	if d.options == nil || d.options.StateDir == "" {
+		return
+	}
+	record := DeviceRecord{
+		ID:         d.ID,
+		PID:        os.Getpid(),
+		State:      d.State(),
+		BlockPath:  d.Path,
+		CharPath:   d.CharPath,
+		ParamsHash: paramsHash(d.params),
+		Backend:    backendName(d.Backend),
+		Size:       d.Size(),
+		Updated:    time.Now(),
+	}
+	err := os.MkdirAll(d.options.StateDir, 0o755)
+	if err == nil {
+		err = replaceJSONFile(recordPath(d.options.StateDir, d.ID), record)
+	}
+	if err != nil {
+		logging.Default().Warn("failed to write device record", "device", d.Path, "error", err)
+	}
+}
+
+// removeRecord deletes d's record once it is closed.
+func (d *Device) removeRecord() {
+	if d.options == nil || d.options.StateDir == "" {
+		return
+	}
+	err := os.Remove(recordPath(d.options.StateDir, d.ID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logging.Default().Warn("failed to remove device record", "device", d.Path, "error", err)
+	}
+}
+
+// replaceJSONFile replaces path with v as indented JSON, for device records
+// and Options.MetricsFile. The data goes to a temporary file in the same
+// directory, is synced and renamed into place, and the directory is synced
+// after: readers never see a partial file, and a crash leaves either the
+// old file or the new one.
+func replaceJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the entries renamed into dir durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// paramsHash hashes the parameters the kernel sees, leaving out the
+// backend, which DeviceRecord describes on its own.
+func paramsHash(params DeviceParams) string {
+	ctrlParams := convertToCtrlParams(params)
+	ctrlParams.Backend = nil
+	data, err := json.Marshal(ctrlParams)
+	if err != nil {
+		return "" // Plain values only; cannot happen
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// backendName describes backend for DeviceRecord.
+func backendName(backend Backend) string {
+	if backend == nil {
+		return ""
+	}
+	if s, ok := backend.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", backend)
+}
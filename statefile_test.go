@@ -0,0 +1,93 @@
+package ublk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeviceRecord(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state") // Created on first write
+	backend := NewMockBackend(1024 * 1024)
+	params := DefaultParams(backend)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	device := &Device{
+		ID:       7,
+		Path:     "/dev/ublkb7",
+		CharPath: "/dev/ublkc7",
+		Backend:  backend,
+		params:   params,
+		options:  &Options{StateDir: dir},
+		started:  true,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	device.saveRecord()
+
+	records, err := ReadDeviceRecords(dir)
+	if err != nil {
+		t.Fatalf("ReadDeviceRecords: %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	record := records[0]
+	if record.ID != 7 || record.State != DeviceStateRunning || record.BlockPath != "/dev/ublkb7" {
+		t.Errorf("unexpected record: %+v", record)
+	}
+	if record.PID != os.Getpid() || !record.Alive() {
+		t.Errorf("record PID = %d, want this process (%d), alive", record.PID, os.Getpid())
+	}
+	if record.Size != 1024*1024 || !strings.Contains(record.Backend, "MockBackend") {
+		t.Errorf("record size %d, backend %q", record.Size, record.Backend)
+	}
+	if record.ParamsHash != paramsHash(params) || len(record.ParamsHash) != 64 {
+		t.Errorf("record params hash %q", record.ParamsHash)
+	}
+
+	// Stopping replaces the record in place, leaving no temporary files
+	device.started = false
+	device.halted = true
+	device.saveRecord()
+	records, err = ReadDeviceRecords(dir)
+	if err != nil || len(records) != 1 || records[0].State != DeviceStateStopped {
+		t.Fatalf("after stop: %+v, %v", records, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("state dir holds %d files, want 1", len(entries))
+	}
+
+	device.removeRecord()
+	records, err = ReadDeviceRecords(dir)
+	if err != nil || len(records) != 0 {
+		t.Errorf("after close: %+v, %v", records, err)
+	}
+}
+
+func TestParamsHash(t *testing.T) {
+	params := DefaultParams(NewMockBackend(1024 * 1024))
+	other := params
+	other.Backend = NewMockBackend(2048 * 1024)
+	if paramsHash(params) != paramsHash(other) {
+		t.Error("hash depends on the backend")
+	}
+	other.QueueDepth = params.QueueDepth * 2
+	if paramsHash(params) == paramsHash(other) {
+		t.Error("hash ignores the queue depth")
+	}
+}
+
+func TestReadDeviceRecordsMissingDir(t *testing.T) {
+	records, err := ReadDeviceRecords(filepath.Join(t.TempDir(), "none"))
+	if err != nil || len(records) != 0 {
+		t.Errorf("ReadDeviceRecords = %+v, %v; want none", records, err)
+	}
+}
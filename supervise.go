@@ -0,0 +1,140 @@
+package ublk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+)
+
+// superviseQueues watches the queue loops just started. A loop only exits
+// on its own when it fails, and the I/O its queue was serving then hangs,
+// so the first failure is handled for the whole device: the queues are
+// restarted if DeviceParams.AutoRestart allows, and otherwise the device
+// fails.
+func (d *Device) superviseQueues() {
+	loops := d.runners
+	if d.group != nil {
+		loops = loops[:1] // One loop serves them all
+	}
+	parent := d.ctx
+	g, ctx := errgroup.WithContext(parent)
+	for _, runner := range loops {
+		g.Go(runner.Wait)
+	}
+	go func() {
+		<-ctx.Done()
+		if parent.Err() != nil {
+			return // Stop or Close ended the loops
+		}
+		d.queueFailed(parent, context.Cause(ctx))
+	}()
+}
+
+// queueFailed handles a queue loop that exited with err while the queues
+// started with parent were serving.
+func (d *Device) queueFailed(parent context.Context, err error) {
+	d.life.Lock()
+	defer d.life.Unlock()
+	if parent.Err() != nil || !d.started {
+		return // Stop or Close got here first
+	}
+
+	d.events.record(Event{Type: EventQueueFailed, Queue: -1, Tag: -1, Error: err.Error()})
+	logging.Default().Error("queue failed", "device", d.Path, "error", err)
+
+	if restartErr := d.restartQueues(err); restartErr == nil {
+		return
+	} else if !errors.Is(restartErr, errNoRestart) {
+		err = fmt.Errorf("%w; restarting the queues failed: %v", err, restartErr)
+	}
+	d.fail(err)
+}
+
+// errNoRestart means restartQueues did not try to restart.
+var errNoRestart = errors.New("queues not restarted")
+
+// restartQueues restarts the queues through the recovery path, if
+// DeviceParams.AutoRestart allows it for err.
+func (d *Device) restartQueues(err error) error {
+	if !d.params.AutoRestart || !d.params.EnableRecovery || errors.Is(err, queue.ErrAborted) {
+		return errNoRestart
+	}
+	now := time.Now()
+	recent := d.restarts[:0]
+	for _, t := range d.restarts {
+		if now.Sub(t) < constants.QueueRestartWindow {
+			recent = append(recent, t)
+		}
+	}
+	d.restarts = recent
+	if len(d.restarts) >= constants.QueueRestartLimit {
+		logging.Default().Error("queues failed too often, not restarting", "device", d.Path,
+			"restarts", len(d.restarts), "window", constants.QueueRestartWindow)
+		return errNoRestart
+	}
+	d.restarts = append(d.restarts, now)
+
+	if err := d.stop(); err != nil {
+		return err
+	}
+	if err := d.start(d.startCtx); err != nil {
+		return err
+	}
+	d.events.recordDevice(EventQueuesRestarted)
+	logging.Default().Warn("queues restarted", "device", d.Path)
+	if d.options != nil && d.options.Logger != nil {
+		d.options.Logger.Printf("Device %s: queues restarted after a failure", d.Path)
+	}
+	return nil
+}
+
+// fail marks the device failed with err and stops it, so I/O on the
+// healthy queues does not carry on while the failed queue's I/O hangs.
+// With EnableRecovery the kernel holds I/O until Start resumes the device;
+// otherwise it fails.
+func (d *Device) fail(err error) {
+	if d.options != nil && d.options.Logger != nil {
+		d.options.Logger.Printf("Device %s failed: %v", d.Path, err)
+	}
+	if d.started {
+		if stopErr := d.stop(); stopErr != nil {
+			logging.Default().Error("stopping failed device", "device", d.Path, "error", stopErr)
+		}
+	}
+
+	d.failMu.Lock()
+	defer d.failMu.Unlock()
+	if d.failErr == nil {
+		d.failErr = err
+		if d.failed != nil {
+			close(d.failed)
+		}
+	}
+}
+
+// Failed returns a channel that is closed once the device has failed and
+// stopped because one of its queues stopped serving I/O and could not be
+// restarted. Err then reports why.
+func (d *Device) Failed() <-chan struct{} {
+	if d == nil {
+		return nil
+	}
+	return d.failed
+}
+
+// Err returns why the device failed, or nil if it has not.
+func (d *Device) Err() error {
+	if d == nil {
+		return nil
+	}
+	d.failMu.Lock()
+	defer d.failMu.Unlock()
+	return d.failErr
+}
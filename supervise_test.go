@@ -0,0 +1,110 @@
+//go:build linux
+
+package ublk
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+)
+
+func TestSuperviseQueuesFailsDevice(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runner, sim, err := queue.NewSimRunner(ctx, queue.Config{Depth: 4, Backend: NewMockBackend(1 << 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer runner.Close()
+
+	device := &Device{
+		ID:      1,
+		Path:    "/dev/ublkb1",
+		Backend: NewMockBackend(1 << 20),
+		started: true,
+		ctx:     ctx,
+		cancel:  cancel,
+		runners: []*queue.Runner{runner},
+		events:  newEventLog(0),
+		failed:  make(chan struct{}),
+		// Restart is not possible without recovery
+		params: DeviceParams{AutoRestart: true},
+	}
+	device.superviseQueues()
+
+	sim.FailWait(syscall.EBADF)
+	select {
+	case <-device.Failed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("device did not fail when its queue loop died")
+	}
+	if err := device.Err(); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Err = %v, want the queue loop's error", err)
+	}
+	if device.started {
+		t.Error("failed device still started")
+	}
+	var failed bool
+	for _, e := range device.Events() {
+		failed = failed || e.Type == EventQueueFailed
+	}
+	if !failed {
+		t.Error("queue failure not in the event log")
+	}
+}
+
+func TestSuperviseQueuesIgnoresStop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runner, _, err := queue.NewSimRunner(ctx, queue.Config{Depth: 4, Backend: NewMockBackend(1 << 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	device := &Device{ID: 1, started: true, ctx: ctx, runners: []*queue.Runner{runner}, failed: make(chan struct{})}
+	device.superviseQueues()
+	cancel()
+	runner.Close()
+
+	select {
+	case <-device.Failed():
+		t.Fatalf("stopped device failed: %v", device.Err())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRestartQueuesBudget(t *testing.T) {
+	device := &Device{params: DeviceParams{AutoRestart: true, EnableRecovery: true}}
+	if err := device.restartQueues(queue.ErrAborted); !errors.Is(err, errNoRestart) {
+		t.Errorf("restart after the kernel aborted the queue = %v, want errNoRestart", err)
+	}
+
+	now := time.Now()
+	for range constants.QueueRestartLimit {
+		device.restarts = append(device.restarts, now)
+	}
+	if err := device.restartQueues(syscall.EINTR); !errors.Is(err, errNoRestart) {
+		t.Errorf("restart over the limit = %v, want errNoRestart", err)
+	}
+
+	// Restarts outside the window no longer count
+	device.restarts = []time.Time{now.Add(-2 * constants.QueueRestartWindow)}
+	device.closed = true // So the restart itself fails without a kernel
+	if err := device.restartQueues(syscall.EINTR); err == nil || errors.Is(err, errNoRestart) {
+		t.Errorf("restart within budget = %v, want a stop error", err)
+	}
+	if len(device.restarts) != 1 {
+		t.Errorf("%d restarts counted, want 1", len(device.restarts))
+	}
+}
@@ -0,0 +1,75 @@
+package ublk
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The system calls the package makes directly, kept here so it builds
+// where they do not exist (see sys_other.go).
+
+// checkPlatform reports why ublk cannot run here; on Linux it can.
+func checkPlatform() error {
+	return nil
+}
+
+// probeControl opens and closes the control device at path.
+func probeControl(path string) error {
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	return syscall.Close(fd)
+}
+
+func closeFd(fd int) {
+	_ = syscall.Close(fd) // Cleanup, ignore error
+}
+
+// openDirect opens the block device at path for O_DIRECT reads and writes.
+func openDirect(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|unix.O_DIRECT, 0)
+}
+
+// openBlock opens the block device at path as flags ask.
+func openBlock(path string, flags BlockOpenFlags) (*os.File, error) {
+	flag := os.O_RDWR
+	if flags&OpenReadOnly != 0 {
+		flag = os.O_RDONLY
+	}
+	if flags&OpenDirect != 0 {
+		flag |= unix.O_DIRECT
+	}
+	if flags&OpenExclusive != 0 {
+		flag |= os.O_EXCL
+	}
+	return os.OpenFile(path, flag, 0)
+}
+
+// mmapAnon allocates size bytes of page-aligned anonymous memory.
+func mmapAnon(size int) ([]byte, error) {
+	return unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+}
+
+func munmapAnon(buf []byte) {
+	_ = unix.Munmap(buf) // Cleanup, ignore error
+}
+
+// processAlive reports whether a process with this PID exists. EPERM means
+// it does, owned by someone else.
+func processAlive(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// hasCapability reports whether capability is in the effective set.
+func hasCapability(capability int) bool {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return false
+	}
+	return data[capability/32].Effective&(1<<(capability%32)) != 0
+}
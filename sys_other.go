@@ -0,0 +1,85 @@
+//go:build !linux
+
+package ublk
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// Off Linux the package builds, so programs can carry ublk support behind
+// a runtime switch, but no device can be created: CheckSystem, LoadModule
+// and so every constructor fail with ErrKernelNotSupported, and the calls
+// below fail with ENOSYS.
+
+func checkPlatform() error {
+	return &Error{
+		Op:    "CHECK",
+		Code:  ErrCodeKernelNotSupported,
+		Errno: syscall.ENOSYS,
+		Msg:   "ublk needs Linux 6.0+ with CONFIG_BLK_DEV_UBLK, not " + runtime.GOOS,
+		Queue: NoQueue,
+	}
+}
+
+func probeControl(path string) error {
+	return syscall.ENOSYS
+}
+
+func closeFd(fd int) {}
+
+func openDirect(path string) (*os.File, error) {
+	return nil, syscall.ENOSYS
+}
+
+func openBlock(path string, flags BlockOpenFlags) (*os.File, error) {
+	return nil, syscall.ENOSYS
+}
+
+func mmapAnon(size int) ([]byte, error) {
+	return nil, syscall.ENOSYS
+}
+
+func munmapAnon(buf []byte) {}
+
+func processAlive(pid int) bool {
+	return false
+}
+
+func hasCapability(capability int) bool {
+	return false
+}
+
+func makeCharNode(path string, id uint32) error {
+	return syscall.ENOSYS
+}
+
+// MakeBlockNode fails off Linux.
+func (d *Device) MakeBlockNode(path string) error {
+	return checkPlatform()
+}
+
+// paramsGetter reads a device's parameters back from the kernel.
+type paramsGetter interface {
+	GetParams(deviceID uint32) (*uapi.UblkParams, error)
+}
+
+func (d *Device) resolveNodes(g paramsGetter) {}
+
+func dropPrivileges(c Credentials) error {
+	return checkPlatform()
+}
+
+// SeccompSyscalls and SeccompNetworkSyscalls are empty off Linux.
+var (
+	SeccompSyscalls        []uintptr
+	SeccompNetworkSyscalls []uintptr
+)
+
+// InstallSeccomp fails off Linux.
+func InstallSeccomp(opts SeccompOptions) error {
+	return checkPlatform()
+}
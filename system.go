@@ -0,0 +1,234 @@
+package ublk
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/ctrl"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// Host paths consulted by CheckSystem, variables so tests can point them
+// at a fake tree
+var (
+	controlPath    = ctrl.UblkControlPath
+	moduleParamDir = "/sys/module/ublk_drv/parameters"
+	charClassDir   = "/sys/class/ublk-char"
+	blockClassDir  = "/sys/class/block"
+	sysDevDir      = "/sys/dev"
+	cpuPossible    = "/sys/devices/system/cpu/possible"
+	modprobe       = func() ([]byte, error) { return exec.Command("modprobe", "ublk_drv").CombinedOutput() }
+)
+
+// moduleLoadTimeout bounds the wait for udev to create /dev/ublk-control
+// after modprobe.
+const moduleLoadTimeout = 5 * time.Second
+
+// capSysAdmin is CAP_SYS_ADMIN's bit in the capability sets.
+const capSysAdmin = 21
+
+// SystemStatus describes whether the host is ready to serve ublk devices.
+type SystemStatus struct {
+	ModuleLoaded  bool // /dev/ublk-control exists
+	ControlAccess bool // /dev/ublk-control can be opened for reading and writing
+	CapSysAdmin   bool // the process holds CAP_SYS_ADMIN
+	MaxDevices    int  // the ublk_drv ublks_max limit, 0 if unknown
+	Devices       int  // ublk devices that currently exist
+}
+
+// CheckSystem inspects the host and returns its status, with an error
+// explaining the first problem that would stop a device from being added:
+// ErrKernelNotSupported if ublk_drv is not loaded, ErrPermissionDenied if
+// /dev/ublk-control cannot be opened or, unless unprivileged is set (see
+// DeviceParams.EnableUnprivileged), the process lacks CAP_SYS_ADMIN, and
+// ErrDeviceBusy if ublks_max devices already exist. Off Linux it always
+// fails with ErrKernelNotSupported.
+func CheckSystem(unprivileged bool) (SystemStatus, error) {
+	var status SystemStatus
+
+	if err := checkPlatform(); err != nil {
+		return status, err
+	}
+
+	err := probeControl(controlPath)
+	switch {
+	case err == nil:
+		status.ModuleLoaded, status.ControlAccess = true, true
+	case errors.Is(err, syscall.ENOENT):
+	default:
+		status.ModuleLoaded = true
+	}
+	status.CapSysAdmin = hasCapSysAdmin()
+	status.MaxDevices = readModuleParam("ublks_max")
+	if entries, err := os.ReadDir(charClassDir); err == nil {
+		status.Devices = len(entries)
+	}
+
+	switch {
+	case !status.ModuleLoaded:
+		return status, &Error{
+			Op:    "CHECK",
+			Code:  ErrCodeKernelNotSupported,
+			Errno: syscall.ENOENT,
+			Msg: fmt.Sprintf("%s does not exist: load the driver with 'modprobe ublk_drv' "+
+				"(Linux 6.0+ with CONFIG_BLK_DEV_UBLK) or set Options.LoadModule", controlPath),
+			Inner: err,
+			Queue: NoQueue,
+		}
+	case !status.ControlAccess:
+		return status, &Error{
+			Op:    "CHECK",
+			Code:  ErrCodePermissionDenied,
+			Msg:   fmt.Sprintf("cannot open %s: run as root or grant this user access with a udev rule", controlPath),
+			Inner: err,
+			Queue: NoQueue,
+		}
+	case !unprivileged && !status.CapSysAdmin:
+		return status, &Error{
+			Op:    "CHECK",
+			Code:  ErrCodePermissionDenied,
+			Errno: syscall.EPERM,
+			Msg:   "adding a ublk device needs CAP_SYS_ADMIN; run as root or set DeviceParams.EnableUnprivileged",
+			Queue: NoQueue,
+		}
+	case status.MaxDevices > 0 && status.Devices >= status.MaxDevices:
+		return status, &Error{
+			Op:   "CHECK",
+			Code: ErrCodeDeviceBusy,
+			Msg: fmt.Sprintf("%d of %d ublk devices in use: delete one or reload ublk_drv with a larger ublks_max",
+				status.Devices, status.MaxDevices),
+			Queue: NoQueue,
+		}
+	}
+	return status, nil
+}
+
+// LoadModule loads ublk_drv with modprobe if /dev/ublk-control is missing
+// and waits for udev to create it. It needs root.
+func LoadModule() error {
+	if err := checkPlatform(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(controlPath); err == nil {
+		return nil
+	}
+	if out, err := modprobe(); err != nil {
+		return &Error{
+			Op:    "MODPROBE",
+			Code:  ErrCodeKernelNotSupported,
+			Msg:   fmt.Sprintf("modprobe ublk_drv failed: %s", strings.TrimSpace(string(out))),
+			Inner: err,
+			Queue: NoQueue,
+		}
+	}
+	deadline := time.Now().Add(moduleLoadTimeout)
+	for {
+		if _, err := os.Stat(controlPath); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return NewError("MODPROBE", ErrCodeKernelNotSupported,
+				fmt.Sprintf("ublk_drv loaded but %s did not appear", controlPath))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasCapSysAdmin() bool {
+	return hasCapability(capSysAdmin)
+}
+
+// readModuleParam returns an integer ublk_drv parameter, or 0 if it cannot
+// be read.
+func readModuleParam(name string) int {
+	data, err := os.ReadFile(filepath.Join(moduleParamDir, name))
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n
+}
+
+// possibleCPUs returns the kernel's nr_cpu_ids, one more than the highest
+// CPU in the possible mask ("0-63", "0,2-5"), or 0 if it cannot be read.
+func possibleCPUs() int {
+	data, err := os.ReadFile(cpuPossible)
+	if err != nil {
+		return 0
+	}
+	mask := strings.TrimSpace(string(data))
+	last := mask[strings.LastIndexAny(mask, ",-")+1:]
+	n, err := strconv.Atoi(last)
+	if err != nil {
+		return 0
+	}
+	return n + 1
+}
+
+// queueLimit is the most queues a device can have on this host: the
+// driver's UBLK_MAX_NR_QUEUES, and the kernel's CPU count, which ADD_DEV
+// silently caps the queues at. The driver exports neither through its
+// module parameters or GET_FEATURES; AddDevice still serves the count
+// ADD_DEV reports should the two disagree.
+func queueLimit() int {
+	limit := MaxQueues
+	if n := possibleCPUs(); n > 0 {
+		limit = min(limit, n)
+	}
+	return limit
+}
+
+// resolveNumQueues returns the queue count to ask ADD_DEV for:
+// DeviceParams.NumQueues, one per CPU if that is 0, clamped to queueLimit
+// with a warning instead of leaving a large machine to fail ADD_DEV or
+// start queues the kernel never made.
+func resolveNumQueues(requested int) int {
+	n := requested
+	if n == 0 {
+		n = runtime.NumCPU()
+	}
+	if limit := queueLimit(); n > limit {
+		logging.Default().Warn("too many queues for the kernel, clamping", "requested", n, "queues", limit)
+		n = limit
+	}
+	return n
+}
+
+// openController opens the control device, first loading ublk_drv if
+// loadModule is set. If the open fails, the error is CheckSystem's
+// explanation when it has one.
+func openController(loadModule bool) (*ctrl.Controller, error) {
+	if loadModule {
+		if err := LoadModule(); err != nil {
+			return nil, err
+		}
+	}
+	c, err := ctrl.NewController()
+	if err != nil {
+		if _, checkErr := CheckSystem(true); checkErr != nil {
+			return nil, checkErr
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkCanAdd fails early, with an actionable error, when ADD_DEV would be
+// refused for lack of privilege or for the device limit; the kernel
+// reports both as a bare EPERM or EACCES.
+func checkCanAdd(params DeviceParams) error {
+	_, err := CheckSystem(params.EnableUnprivileged)
+	var ublkErr *Error
+	if errors.As(err, &ublkErr) && (ublkErr.Code == ErrCodePermissionDenied || ublkErr.Code == ErrCodeDeviceBusy) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package ublk
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckSystemNotLinux(t *testing.T) {
+	if _, err := CheckSystem(true); !errors.Is(err, ErrKernelNotSupported) {
+		t.Errorf("CheckSystem = %v, want ErrKernelNotSupported", err)
+	}
+	if err := LoadModule(); !errors.Is(err, ErrKernelNotSupported) {
+		t.Errorf("LoadModule = %v, want ErrKernelNotSupported", err)
+	}
+	_, err := CreateAndServe(t.Context(), DefaultParams(NewMockBackend(1<<20)), &Options{})
+	if !errors.Is(err, ErrKernelNotSupported) {
+		t.Errorf("CreateAndServe = %v, want ErrKernelNotSupported", err)
+	}
+}
@@ -0,0 +1,136 @@
+//go:build linux
+
+package ublk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeSystem points the host paths at a temporary tree and returns it
+func fakeSystem(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	saved := []string{controlPath, moduleParamDir, charClassDir}
+	savedModprobe := modprobe
+	t.Cleanup(func() {
+		controlPath, moduleParamDir, charClassDir = saved[0], saved[1], saved[2]
+		modprobe = savedModprobe
+	})
+	controlPath = filepath.Join(root, "ublk-control")
+	moduleParamDir = filepath.Join(root, "parameters")
+	charClassDir = filepath.Join(root, "ublk-char")
+	for _, dir := range []string{moduleParamDir, charClassDir} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSystemModuleMissing(t *testing.T) {
+	fakeSystem(t)
+	status, err := CheckSystem(true)
+	if !errors.Is(err, ErrKernelNotSupported) {
+		t.Errorf("err = %v, want kernel not supported", err)
+	}
+	if status.ModuleLoaded {
+		t.Error("ModuleLoaded with no control device")
+	}
+}
+
+func TestCheckSystemDeviceLimit(t *testing.T) {
+	fakeSystem(t)
+	touch(t, controlPath)
+	if err := os.WriteFile(filepath.Join(moduleParamDir, "ublks_max"), []byte("2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, filepath.Join(charClassDir, "ublkc0"))
+
+	status, err := CheckSystem(true)
+	if err != nil {
+		t.Fatalf("CheckSystem with one of two devices used: %v", err)
+	}
+	if !status.ControlAccess || status.MaxDevices != 2 || status.Devices != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	touch(t, filepath.Join(charClassDir, "ublkc1"))
+	if _, err := CheckSystem(true); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("err = %v at the device limit, want device busy", err)
+	}
+	if err := checkCanAdd(DeviceParams{EnableUnprivileged: true}); !errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("checkCanAdd err = %v at the device limit, want device busy", err)
+	}
+}
+
+func TestLoadModule(t *testing.T) {
+	fakeSystem(t)
+	calls := 0
+	modprobe = func() ([]byte, error) {
+		calls++
+		return nil, os.WriteFile(controlPath, nil, 0o644)
+	}
+	if err := LoadModule(); err != nil {
+		t.Fatalf("LoadModule: %v", err)
+	}
+	if err := LoadModule(); err != nil || calls != 1 {
+		t.Errorf("second LoadModule = %v after %d modprobes, want no new modprobe", err, calls)
+	}
+}
+
+func TestLoadModuleFails(t *testing.T) {
+	fakeSystem(t)
+	modprobe = func() ([]byte, error) {
+		return []byte("modprobe: FATAL: Module ublk_drv not found\n"), errors.New("exit status 1")
+	}
+	if err := LoadModule(); !errors.Is(err, ErrKernelNotSupported) {
+		t.Errorf("err = %v, want kernel not supported", err)
+	}
+}
+
+func TestResolveNumQueues(t *testing.T) {
+	saved := cpuPossible
+	t.Cleanup(func() { cpuPossible = saved })
+	cpuPossible = filepath.Join(t.TempDir(), "possible")
+
+	// Unreadable: nothing below the driver's limit, which Validate enforces
+	if got := resolveNumQueues(MaxQueues); got != MaxQueues {
+		t.Errorf("without a CPU mask: %d queues, want %d", got, MaxQueues)
+	}
+
+	for _, tc := range []struct {
+		mask      string
+		requested int
+		want      int
+	}{
+		{"0-7\n", 4, 4},
+		{"0-7\n", 16, 8},
+		{"0,2-5\n", 16, 6},
+		{"0\n", 2, 1},
+	} {
+		if err := os.WriteFile(cpuPossible, []byte(tc.mask), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if got := resolveNumQueues(tc.requested); got != tc.want {
+			t.Errorf("mask %q, %d requested: %d queues, want %d", tc.mask, tc.requested, got, tc.want)
+		}
+	}
+
+	// The default, one queue per CPU, is never above the limit
+	if err := os.WriteFile(cpuPossible, []byte("0-1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolveNumQueues(0); got < 1 || got > 2 {
+		t.Errorf("default: %d queues, want 1-2", got)
+	}
+}
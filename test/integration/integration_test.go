@@ -4,13 +4,21 @@
 package integration
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/ehrlich-b/go-ublk"
+	"github.com/ehrlich-b/go-ublk/backend/file"
 )
 
 // requireRoot skips the test if not running as root
@@ -80,6 +88,61 @@ func TestIntegrationDeviceLifecycle(t *testing.T) {
 	t.Logf("Successfully created device: %s", device.Path)
 }
 
+func TestIntegrationManagerConcurrentCreate(t *testing.T) {
+	requireRoot(t)
+	requireKernel(t, "6.1")
+	requireUblkModule(t)
+
+	manager, err := ublk.NewManager()
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	defer manager.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Several auto-assigned devices added at once must all get distinct IDs
+	const numDevices = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, numDevices)
+	for i := 0; i < numDevices; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			params := ublk.DefaultParams(&mockBackend{data: make([]byte, 16<<20), size: 16 << 20})
+			params.DeviceID = ublk.AutoAssignDeviceID
+			params.QueueDepth = 32
+			params.NumQueues = 1
+			if _, err := manager.CreateAndServe(ctx, params, nil); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("CreateAndServe: %v", err)
+	}
+
+	devices := manager.Devices()
+	if len(devices) != numDevices {
+		t.Fatalf("manager tracks %d devices, want %d", len(devices), numDevices)
+	}
+	for i := 1; i < len(devices); i++ {
+		if devices[i].ID == devices[i-1].ID {
+			t.Errorf("devices share ID %d", devices[i].ID)
+		}
+	}
+
+	if err := devices[0].Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if n := len(manager.Devices()); n != numDevices-1 {
+		t.Errorf("manager tracks %d devices after one closed, want %d", n, numDevices-1)
+	}
+}
+
 func TestIntegrationBasicIO(t *testing.T) {
 	requireRoot(t)
 	requireKernel(t, "6.1")
@@ -109,6 +172,342 @@ func TestIntegrationFilesystemMount(t *testing.T) {
 	// 5. Unmount and cleanup
 }
 
+func TestIntegrationPauseResumeMountedFilesystem(t *testing.T) {
+	requireRoot(t)
+	requireKernel(t, "6.1")
+	requireUblkModule(t)
+
+	mkfs, err := exec.LookPath("mkfs.ext4")
+	if err != nil {
+		t.Skip("mkfs.ext4 not available")
+	}
+
+	backend := &mockBackend{
+		data: make([]byte, 64<<20),
+		size: 64 << 20,
+	}
+	params := ublk.DefaultParams(backend)
+	params.QueueDepth = 32
+	params.NumQueues = 1
+	params.EnableRecovery = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, nil)
+	if err != nil {
+		t.Fatalf("CreateAndServe: %v", err)
+	}
+	defer device.Close()
+
+	if out, err := exec.Command(mkfs, "-q", "-F", device.Path).CombinedOutput(); err != nil {
+		t.Fatalf("mkfs.ext4: %v\n%s", err, out)
+	}
+	mnt := t.TempDir()
+	if out, err := exec.Command("mount", device.Path, mnt).CombinedOutput(); err != nil {
+		t.Fatalf("mount: %v\n%s", err, out)
+	}
+	defer exec.Command("umount", mnt).Run()
+
+	file := filepath.Join(mnt, "data")
+	want := bytes.Repeat([]byte("pause-resume"), 4096)
+
+	for cycle := 0; cycle < 3; cycle++ {
+		if err := device.Stop(); err != nil {
+			t.Fatalf("cycle %d: Stop: %v", cycle, err)
+		}
+		if got := device.State(); got != ublk.DeviceStatePaused {
+			t.Fatalf("cycle %d: state after Stop = %s, want %s", cycle, got, ublk.DeviceStatePaused)
+		}
+
+		// I/O issued while paused must wait for the device, not fail
+		written := make(chan error, 1)
+		go func() {
+			written <- writeAndSync(file, want)
+		}()
+		select {
+		case err := <-written:
+			t.Fatalf("cycle %d: synced write completed while paused: %v", cycle, err)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if err := device.Start(ctx); err != nil {
+			t.Fatalf("cycle %d: Start: %v", cycle, err)
+		}
+		select {
+		case err := <-written:
+			if err != nil {
+				t.Fatalf("cycle %d: write after resume: %v", cycle, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("cycle %d: write did not complete after resume", cycle)
+		}
+
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("cycle %d: read back: %v", cycle, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("cycle %d: file contents changed across pause", cycle)
+		}
+	}
+}
+
+func TestIntegrationSignalStorm(t *testing.T) {
+	requireRoot(t)
+	requireKernel(t, "6.1")
+	requireUblkModule(t)
+
+	fio, err := exec.LookPath("fio")
+	if err != nil {
+		t.Skip("fio not available")
+	}
+
+	backend := &mockBackend{
+		data: make([]byte, 64<<20),
+		size: 64 << 20,
+	}
+	params := ublk.DefaultParams(backend)
+	params.QueueDepth = 32
+	params.NumQueues = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, nil)
+	if err != nil {
+		t.Fatalf("CreateAndServe: %v", err)
+	}
+	defer device.Close()
+
+	// Interrupt the queue threads' io_uring_enter calls as a SIGUSR1 stack
+	// dump handler would, for as long as fio runs
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	defer signal.Stop(sigs)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-sigs:
+			default:
+				_ = syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}()
+
+	out, err := exec.Command(fio, "--name=signal-storm", "--filename="+device.Path,
+		"--direct=1", "--ioengine=libaio", "--iodepth=32", "--rw=randrw", "--bs=4k",
+		"--verify=crc32c", "--runtime=5", "--time_based").CombinedOutput()
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("fio under SIGUSR1: %v\n%s", err, out)
+	}
+	select {
+	case <-device.Failed():
+		t.Fatalf("device failed under signals: %v", device.Err())
+	default:
+	}
+}
+
+// writeAndSync replaces path with data and waits for it to reach the device
+func writeAndSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func TestIntegrationRestartWithoutRecovery(t *testing.T) {
+	requireRoot(t)
+	requireKernel(t, "6.1")
+	requireUblkModule(t)
+
+	backend := &mockBackend{
+		data: make([]byte, 16<<20),
+		size: 16 << 20,
+	}
+	params := ublk.DefaultParams(backend)
+	params.NumQueues = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, nil)
+	if err != nil {
+		t.Fatalf("CreateAndServe: %v", err)
+	}
+	defer device.Close()
+
+	if err := device.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := device.Start(ctx); !errors.Is(err, ublk.ErrRestartNotSupported) {
+		t.Fatalf("Start after Stop = %v, want ErrRestartNotSupported", err)
+	}
+}
+
+// gptImage returns a file backend over a GPT image with two partitions.
+func gptImage(t *testing.T) *file.File {
+	t.Helper()
+	sfdisk, err := exec.LookPath("sfdisk")
+	if err != nil {
+		t.Skip("sfdisk not available")
+	}
+
+	image := filepath.Join(t.TempDir(), "gpt.img")
+	if err := os.WriteFile(image, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(sfdisk, "--quiet", image)
+	cmd.Stdin = strings.NewReader("label: gpt\n,16M\n,\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sfdisk: %v\n%s", err, out)
+	}
+
+	backend, err := file.Open(image, file.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+func TestIntegrationPartitionScan(t *testing.T) {
+	requireRoot(t)
+	requireKernel(t, "6.1")
+	requireUblkModule(t)
+
+	backend := gptImage(t)
+
+	params := ublk.DefaultParams(backend)
+	params.NumQueues = 1
+	params.PhysicalBlockSize = 4096
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, nil)
+	if err != nil {
+		t.Fatalf("CreateAndServe: %v", err)
+	}
+	defer device.Close()
+
+	for _, part := range []string{device.Path + "p1", device.Path + "p2"} {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := os.Stat(part); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s did not appear", part)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	disk := filepath.Base(device.Path)
+	got, err := os.ReadFile(filepath.Join("/sys/block", disk, "queue/physical_block_size"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(got)) != "4096" {
+		t.Errorf("physical_block_size = %s, want 4096", got)
+	}
+}
+
+func TestIntegrationNoPartitionScan(t *testing.T) {
+	requireRoot(t)
+	requireKernel(t, "6.19")
+	requireUblkModule(t)
+
+	params := ublk.DefaultParams(gptImage(t))
+	params.NumQueues = 1
+	params.NoPartitionScan = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	device, err := ublk.CreateAndServe(ctx, params, nil)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		t.Skip("kernel cannot skip the partition scan")
+	}
+	if err != nil {
+		t.Fatalf("CreateAndServe: %v", err)
+	}
+	defer device.Close()
+
+	// Partitions are registered in sysfs by START_DEV's scan itself
+	disk := filepath.Base(device.Path)
+	if _, err := os.Stat(filepath.Join("/sys/block", disk, disk+"p1")); err == nil {
+		t.Errorf("%s was scanned for partitions with NoPartitionScan", disk)
+	}
+}
+
+func TestIntegrationQueueAttributes(t *testing.T) {
+	requireRoot(t)
+	requireKernel(t, "6.1")
+	requireUblkModule(t)
+
+	tests := []struct {
+		name          string
+		rotational    bool
+		volatileCache bool
+		want          map[string]string
+	}{
+		{"defaults", false, false, map[string]string{"rotational": "0", "write_cache": "write through"}},
+		{"rotational write-back", true, true, map[string]string{"rotational": "1", "write_cache": "write back"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := &mockBackend{data: make([]byte, 16<<20), size: 16 << 20}
+			params := ublk.DefaultParams(backend)
+			params.NumQueues = 1
+			params.Rotational = tt.rotational
+			params.VolatileCache = tt.volatileCache
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			device, err := ublk.CreateAndServe(ctx, params, nil)
+			if err != nil {
+				t.Fatalf("CreateAndServe: %v", err)
+			}
+			defer device.Close()
+
+			queue := filepath.Join("/sys/block", filepath.Base(device.Path), "queue")
+			for attr, want := range tt.want {
+				got, err := os.ReadFile(filepath.Join(queue, attr))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.TrimSpace(string(got)) != want {
+					t.Errorf("%s = %q, want %q", attr, strings.TrimSpace(string(got)), want)
+				}
+			}
+		})
+	}
+}
+
 func TestIntegrationStress(t *testing.T) {
 	requireRoot(t)
 	requireKernel(t, "6.1")
@@ -146,6 +146,25 @@ func TestFeatureFlags(t *testing.T) {
 	}
 }
 
+func TestPublicLimits(t *testing.T) {
+	// The public re-exports match the driver's definitions
+	if ublk.MaxQueueDepth != uapi.UBLK_MAX_QUEUE_DEPTH || ublk.MaxQueues != uapi.UBLK_MAX_NR_QUEUES {
+		t.Error("queue limits differ from uapi")
+	}
+	if ublk.FeatureZeroCopy != uapi.UBLK_F_SUPPORT_ZERO_COPY ||
+		ublk.FeatureNoAutoPartScan != uapi.UBLK_F_NO_AUTO_PART_SCAN {
+		t.Error("feature bits differ from uapi")
+	}
+
+	// The defaults sit within the limits
+	if ublk.DefaultQueueDepth > ublk.MaxQueueDepth {
+		t.Errorf("DefaultQueueDepth %d exceeds MaxQueueDepth %d", ublk.DefaultQueueDepth, ublk.MaxQueueDepth)
+	}
+	if ublk.IOBufferSizePerTag > ublk.MaxDriverIOSize || ublk.IOBufferSizePerTag%ublk.MinLogicalBlockSize != 0 {
+		t.Errorf("IOBufferSizePerTag %d does not fit the driver's limits", ublk.IOBufferSizePerTag)
+	}
+}
+
 func TestErrorTypes(t *testing.T) {
 	// Test that error types implement error interface
 	var _ error = ublk.ErrNotImplemented
@@ -223,7 +242,7 @@ func (m *mockBackend) Discard(offset, length int64) error {
 	return nil
 }
 
-func (m *mockBackend) WriteZeroes(offset, length int64) error {
+func (m *mockBackend) WriteZeroes(offset, length int64, flags ublk.RequestFlags) error {
 	return m.Discard(offset, length)
 }
 
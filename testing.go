@@ -12,6 +12,8 @@ type MockBackend struct {
 	synced  bool
 	stats   map[string]interface{}
 
+	snapshots map[string][]byte
+
 	// Method call tracking
 	mu         sync.RWMutex
 	readCalls  int
@@ -129,7 +131,7 @@ func (m *MockBackend) Discard(offset, length int64) error {
 }
 
 // WriteZeroes implements the WriteZeroesBackend interface
-func (m *MockBackend) WriteZeroes(offset, length int64) error {
+func (m *MockBackend) WriteZeroes(offset, length int64, flags RequestFlags) error {
 	return m.Discard(offset, length)
 }
 
@@ -243,6 +245,35 @@ func (m *MockBackend) Reset() {
 	m.synced = false
 }
 
+// Snapshot implements the SnapshotBackend interface
+func (m *MockBackend) Snapshot(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrDeviceNotFound
+	}
+	if m.snapshots == nil {
+		m.snapshots = make(map[string][]byte)
+	}
+	m.snapshots[name] = append([]byte(nil), m.data...)
+	return nil
+}
+
+// Clone implements the SnapshotBackend interface. The name is ignored.
+func (m *MockBackend) Clone(snapshot, name string) (Backend, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	data, ok := m.snapshots[snapshot]
+	if !ok {
+		return nil, ErrDeviceNotFound
+	}
+	clone := NewMockBackend(int64(len(data)))
+	copy(clone.data, data)
+	return clone, nil
+}
+
 // SetCustomStats allows setting custom statistics for testing
 func (m *MockBackend) SetCustomStats(stats map[string]interface{}) {
 	m.mu.Lock()
@@ -262,4 +293,5 @@ var (
 	_ SyncBackend        = (*MockBackend)(nil)
 	_ StatBackend        = (*MockBackend)(nil)
 	_ ResizeBackend      = (*MockBackend)(nil)
+	_ SnapshotBackend    = (*MockBackend)(nil)
 )
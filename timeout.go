@@ -0,0 +1,37 @@
+package ublk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/constants"
+	"github.com/ehrlich-b/go-ublk/internal/logging"
+)
+
+// kernelIOTimeout returns the block layer timeout matching a backend
+// deadline of timeout, 0 to leave the kernel default.
+func kernelIOTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return 0
+	}
+	return timeout + constants.IOTimeoutSlack
+}
+
+// setKernelIOTimeout sets the block layer timeout of the started device to
+// match DeviceParams.IOTimeout. The device works without it, only with
+// the kernel's default timeout, so failing is logged rather than returned.
+func (d *Device) setKernelIOTimeout() {
+	timeout := kernelIOTimeout(d.params.IOTimeout)
+	if timeout == 0 {
+		return
+	}
+	path := filepath.Join(blockClassDir, fmt.Sprintf("ublkb%d", d.ID), "queue", "io_timeout")
+	ms := strconv.FormatInt(timeout.Milliseconds(), 10)
+	if err := os.WriteFile(path, []byte(ms), 0); err != nil {
+		logging.Default().Warn("could not set the block layer I/O timeout", "device", d.Path,
+			"timeout", timeout, "error", err)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package ublk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSetKernelIOTimeout(t *testing.T) {
+	fakeClassDirs(t)
+	queueDir := filepath.Join(blockClassDir, "ublkb7", "queue")
+	if err := os.MkdirAll(queueDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(queueDir, "io_timeout")
+	if err := os.WriteFile(path, []byte("30000\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Device{ID: 7, params: DeviceParams{}}
+	d.setKernelIOTimeout()
+	if got, _ := os.ReadFile(path); string(got) != "30000\n" {
+		t.Errorf("io_timeout = %q without an IOTimeout, want the default kept", got)
+	}
+
+	d.params.IOTimeout = 5 * time.Second
+	d.setKernelIOTimeout()
+	if got, _ := os.ReadFile(path); string(got) != "6000" {
+		t.Errorf("io_timeout = %q, want 6000 (IOTimeout plus the slack)", got)
+	}
+}
@@ -0,0 +1,499 @@
+package ublk
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// maxReplayIO bounds the buffer a replayed read or write may need; larger
+// records, which no kernel sends, fail as backend errors.
+const maxReplayIO = 64 << 20
+
+// traceMagic starts every trace; the last byte is the format version.
+var traceMagic = [8]byte{'U', 'B', 'L', 'K', 'T', 'R', 'C', 1}
+
+// TraceOp is the operation of a traced request, as the kernel numbers it.
+type TraceOp uint8
+
+const (
+	TraceRead        TraceOp = uapi.UBLK_IO_OP_READ
+	TraceWrite       TraceOp = uapi.UBLK_IO_OP_WRITE
+	TraceFlush       TraceOp = uapi.UBLK_IO_OP_FLUSH
+	TraceDiscard     TraceOp = uapi.UBLK_IO_OP_DISCARD
+	TraceWriteZeroes TraceOp = uapi.UBLK_IO_OP_WRITE_ZEROES
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	case TraceRead:
+		return "read"
+	case TraceWrite:
+		return "write"
+	case TraceFlush:
+		return "flush"
+	case TraceDiscard:
+		return "discard"
+	case TraceWriteZeroes:
+		return "write-zeroes"
+	default:
+		return fmt.Sprintf("op%d", uint8(op))
+	}
+}
+
+// TraceRecord is one request in an I/O trace: the kernel's descriptor and
+// how serving it went. Sector and Sectors are in units of the trace's
+// block size.
+type TraceRecord struct {
+	Queue   uint16
+	Tag     uint16
+	Op      TraceOp
+	Flags   RequestFlags
+	Sector  uint64
+	Sectors uint32
+
+	Start   time.Duration // When the backend call began, since the trace began
+	Latency time.Duration // How long the backend call took
+	Errno   syscall.Errno // Error committed to the kernel, 0 on success
+}
+
+// TraceWriter encodes an I/O trace: a header followed by one compact,
+// varint-encoded record per request, in the order requests completed. It is
+// safe for concurrent use. Set Options.Trace to record a device's requests;
+// a TraceWriter is only needed to write traces by hand.
+type TraceWriter struct {
+	mu        sync.Mutex
+	w         *bufio.Writer
+	start     time.Time
+	lastStart time.Duration
+	err       error  // First write error; later records are dropped
+	scale     uint64 // 512-byte sectors per trace block
+	buf       [9 * binary.MaxVarintLen64]byte
+}
+
+// NewTraceWriter starts a trace of a device with the given logical block
+// size (512 if 0) on w. Errors writing to w are reported by Flush.
+func NewTraceWriter(w io.Writer, blockSize int) *TraceWriter {
+	if blockSize <= 0 {
+		blockSize = 512
+	}
+	t := &TraceWriter{w: bufio.NewWriter(w), start: time.Now(), scale: max(uint64(blockSize)/512, 1)}
+	b := append(traceMagic[:0:0], traceMagic[:]...)
+	b = binary.AppendUvarint(b, uint64(blockSize))
+	b = binary.AppendVarint(b, t.start.UnixNano())
+	_, t.err = t.w.Write(b)
+	return t
+}
+
+// Write appends rec to the trace.
+func (t *TraceWriter) Write(rec TraceRecord) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	b := append(t.buf[:0], byte(rec.Op))
+	b = binary.AppendUvarint(b, uint64(rec.Flags)>>8)
+	b = binary.AppendUvarint(b, uint64(rec.Queue))
+	b = binary.AppendUvarint(b, uint64(rec.Tag))
+	b = binary.AppendUvarint(b, rec.Sector)
+	b = binary.AppendUvarint(b, uint64(rec.Sectors))
+	b = binary.AppendVarint(b, int64(rec.Start-t.lastStart)) // Requests on other queues may have started earlier
+	b = binary.AppendUvarint(b, uint64(max(rec.Latency, 0)))
+	b = binary.AppendUvarint(b, uint64(rec.Errno))
+	t.lastStart = rec.Start
+	_, t.err = t.w.Write(b)
+	return t.err
+}
+
+// Flush writes buffered records to the underlying writer. It returns the
+// first error seen writing the trace, after which records are dropped.
+func (t *TraceWriter) Flush() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	return t.err
+}
+
+// record is the queue runners' trace hook. Descriptors count 512-byte
+// sectors, which it converts to the trace's blocks.
+func (t *TraceWriter) record(
+	queueID, tag uint16, desc uapi.UblksrvIODesc, start time.Time, latency time.Duration, errno syscall.Errno,
+) {
+	_ = t.Write(TraceRecord{ // A failed trace is reported by Flush when the device stops
+		Queue:   queueID,
+		Tag:     tag,
+		Op:      TraceOp(desc.GetOp()),
+		Flags:   RequestFlags(desc.GetFlags()),
+		Sector:  desc.StartSector / t.scale,
+		Sectors: desc.NrSectors / uint32(t.scale),
+		Start:   start.Sub(t.start),
+		Latency: latency,
+		Errno:   errno,
+	})
+}
+
+// TraceReader decodes a trace written by TraceWriter.
+type TraceReader struct {
+	r         *bufio.Reader
+	blockSize int
+	start     time.Time
+	lastStart time.Duration
+}
+
+// NewTraceReader reads the trace header from r.
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	br := bufio.NewReader(r)
+	var magic [8]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, fmt.Errorf("reading trace header: %w", err)
+	}
+	if magic != traceMagic {
+		return nil, fmt.Errorf("not a ublk trace (or an unsupported version)")
+	}
+	blockSize, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading trace header: %w", unexpectedEOF(err))
+	}
+	if blockSize == 0 || blockSize > 1<<16 {
+		return nil, fmt.Errorf("trace has invalid block size %d", blockSize)
+	}
+	start, err := binary.ReadVarint(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading trace header: %w", unexpectedEOF(err))
+	}
+	return &TraceReader{r: br, blockSize: int(blockSize), start: time.Unix(0, start)}, nil
+}
+
+// BlockSize is the size of the trace's sectors in bytes.
+func (t *TraceReader) BlockSize() int { return t.blockSize }
+
+// Start is when the trace began.
+func (t *TraceReader) Start() time.Time { return t.start }
+
+// Next returns the next record, or io.EOF after the last one. A trace cut
+// off mid-record, as by a crash, fails with io.ErrUnexpectedEOF.
+func (t *TraceReader) Next() (TraceRecord, error) {
+	op, err := t.r.ReadByte()
+	if err != nil {
+		return TraceRecord{}, err
+	}
+	var fields [8]uint64
+	for i := range fields {
+		if i == 5 {
+			var delta int64
+			delta, err = binary.ReadVarint(t.r)
+			fields[i] = uint64(delta)
+		} else {
+			fields[i], err = binary.ReadUvarint(t.r)
+		}
+		if err != nil {
+			return TraceRecord{}, unexpectedEOF(err)
+		}
+	}
+	if fields[0] > 0xffffff || fields[1] > 0xffff || fields[2] > 0xffff || fields[4] > 0xffffffff ||
+		fields[6] > math.MaxInt64 || fields[7] > 0xffff {
+		return TraceRecord{}, fmt.Errorf("corrupt trace record")
+	}
+	t.lastStart += time.Duration(int64(fields[5]))
+	return TraceRecord{
+		Op:      TraceOp(op),
+		Flags:   RequestFlags(fields[0] << 8),
+		Queue:   uint16(fields[1]),
+		Tag:     uint16(fields[2]),
+		Sector:  fields[3],
+		Sectors: uint32(fields[4]),
+		Start:   t.lastStart,
+		Latency: time.Duration(fields[6]),
+		Errno:   syscall.Errno(fields[7]),
+	}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReplayOptions controls ReplayTrace.
+type ReplayOptions struct {
+	// Speed scales the trace's timing: 1 issues each request when it was
+	// issued in the trace, 2 twice as fast. 0 issues them back to back.
+	Speed float64
+
+	// Verify checks that every read returns what the replay last wrote to
+	// the blocks it covers, and counts the blocks that do not. Blocks the
+	// replay has not written, or has discarded, are not checked.
+	Verify bool
+}
+
+// ReplayStats summarizes a replay.
+type ReplayStats struct {
+	Requests     int64
+	Reads        int64
+	Writes       int64
+	Flushes      int64
+	Discards     int64
+	WriteZeroes  int64
+	BytesRead    int64
+	BytesWritten int64
+	Errors       int64         // Failed requests, including ops the backend does not support
+	Mismatches   int64         // Blocks whose data did not verify
+	FirstBad     int64         // Offset of the first mismatched block, -1 if none
+	Elapsed      time.Duration // Wall time of the replay
+}
+
+// ReplayTrace issues the requests of a trace to backend, one at a time in
+// the order they completed when recorded. Writes carry data derived from
+// the block and the record's position in the trace, so replaying the same
+// trace twice writes the same bytes; with Verify set, reads are checked
+// against it. Backend errors are counted, not returned: the replay stops
+// only on a corrupt trace or when ctx ends.
+func ReplayTrace(ctx context.Context, backend Backend, trace *TraceReader, opts ReplayOptions) (*ReplayStats, error) {
+	rp := replayer{
+		backend:   backend,
+		blockSize: int64(trace.BlockSize()),
+		stats:     ReplayStats{FirstBad: -1},
+	}
+	if opts.Verify {
+		rp.written = make(map[uint64]uint64)
+	}
+
+	began := time.Now()
+	for seq := uint64(1); ; seq++ {
+		rec, err := trace.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			rp.stats.Elapsed = time.Since(began)
+			return &rp.stats, fmt.Errorf("trace record %d: %w", seq, err)
+		}
+		if opts.Speed > 0 {
+			due := began.Add(time.Duration(float64(rec.Start) / opts.Speed))
+			if err := sleepUntil(ctx, due); err != nil {
+				rp.stats.Elapsed = time.Since(began)
+				return &rp.stats, err
+			}
+		} else if err := ctx.Err(); err != nil {
+			rp.stats.Elapsed = time.Since(began)
+			return &rp.stats, err
+		}
+		rp.issue(rec, seq)
+	}
+	rp.stats.Elapsed = time.Since(began)
+	return &rp.stats, nil
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// replayer issues trace records to a backend.
+type replayer struct {
+	backend   Backend
+	blockSize int64
+	buf       []byte
+	stats     ReplayStats
+
+	// written maps each block the replay wrote to the sequence number of
+	// the write (0 for write-zeroes), when verifying
+	written map[uint64]uint64
+}
+
+func (rp *replayer) issue(rec TraceRecord, seq uint64) {
+	rp.stats.Requests++
+	off := int64(rec.Sector) * rp.blockSize
+	length := int64(rec.Sectors) * rp.blockSize
+
+	var err error
+	switch rec.Op {
+	case TraceRead, TraceWrite:
+		if length > maxReplayIO {
+			rp.stats.Errors++
+			return
+		}
+	}
+	switch rec.Op {
+	case TraceRead:
+		rp.stats.Reads++
+		buf := rp.buffer(length)
+		if err = rp.read(rec, buf, off); err == nil {
+			rp.stats.BytesRead += length
+			rp.verify(rec.Sector, buf)
+		}
+	case TraceWrite:
+		rp.stats.Writes++
+		buf := rp.buffer(length)
+		for i := range uint64(rec.Sectors) {
+			replayPattern(buf[int64(i)*rp.blockSize:][:rp.blockSize], rec.Sector+i, seq)
+		}
+		if err = rp.write(rec, buf, off); err == nil {
+			rp.stats.BytesWritten += length
+		}
+		rp.remember(rec, seq)
+	case TraceFlush:
+		rp.stats.Flushes++
+		err = rp.backend.Flush()
+	case TraceDiscard:
+		rp.stats.Discards++
+		if db, ok := rp.backend.(DiscardBackend); ok {
+			err = db.Discard(off, length)
+		} else {
+			err = syscall.EOPNOTSUPP
+		}
+		rp.forget(rec)
+	case TraceWriteZeroes:
+		rp.stats.WriteZeroes++
+		if zb, ok := rp.backend.(WriteZeroesBackend); ok {
+			err = zb.WriteZeroes(off, length, rec.Flags)
+		} else {
+			err = syscall.EOPNOTSUPP
+		}
+		if err == nil {
+			rp.remember(rec, 0)
+		} else {
+			rp.forget(rec)
+		}
+	default:
+		err = syscall.EOPNOTSUPP
+	}
+	if err != nil {
+		rp.stats.Errors++
+	}
+}
+
+// buffer returns a scratch buffer of length bytes.
+func (rp *replayer) buffer(length int64) []byte {
+	if int64(cap(rp.buf)) < length {
+		rp.buf = make([]byte, length)
+	}
+	return rp.buf[:length]
+}
+
+// remember records that rec's blocks hold the data of write seq.
+func (rp *replayer) remember(rec TraceRecord, seq uint64) {
+	if rp.written == nil {
+		return
+	}
+	for i := range uint64(rec.Sectors) {
+		rp.written[rec.Sector+i] = seq
+	}
+}
+
+// forget stops checking rec's blocks, whose contents are now undefined.
+func (rp *replayer) forget(rec TraceRecord) {
+	if len(rp.written) == 0 {
+		return
+	}
+	end := rec.Sector + uint64(rec.Sectors)
+	if int(rec.Sectors) > len(rp.written) {
+		// A large discard: cheaper to scan what is tracked
+		for sector := range rp.written {
+			if sector >= rec.Sector && sector < end {
+				delete(rp.written, sector)
+			}
+		}
+		return
+	}
+	for sector := rec.Sector; sector < end; sector++ {
+		delete(rp.written, sector)
+	}
+}
+
+// verify checks the blocks read from sector onwards against the writes
+// that last covered them.
+func (rp *replayer) verify(sector uint64, buf []byte) {
+	if rp.written == nil {
+		return
+	}
+	want := make([]byte, rp.blockSize)
+	for i := int64(0); i*rp.blockSize < int64(len(buf)); i++ {
+		seq, ok := rp.written[sector+uint64(i)]
+		if !ok {
+			continue
+		}
+		replayPattern(want, sector+uint64(i), seq)
+		if string(buf[i*rp.blockSize:][:rp.blockSize]) != string(want) {
+			if rp.stats.Mismatches == 0 {
+				rp.stats.FirstBad = int64(sector+uint64(i)) * rp.blockSize
+			}
+			rp.stats.Mismatches++
+		}
+	}
+}
+
+// replayPattern fills block with data identifying the block and the write
+// that produced it; seq 0 is all zeros.
+func replayPattern(block []byte, sector, seq uint64) {
+	if seq == 0 {
+		clear(block)
+		return
+	}
+	x := sector*0x9e3779b97f4a7c15 ^ seq
+	for i := 0; i+8 <= len(block); i += 8 {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		binary.LittleEndian.PutUint64(block[i:], z^z>>31)
+	}
+}
+
+// read reads buf at off, through ReadAtRequest if the backend takes
+// request flags. A short read is an error.
+func (rp *replayer) read(rec TraceRecord, buf []byte, off int64) error {
+	var n int
+	var err error
+	if rb, ok := rp.backend.(RequestBackend); ok {
+		n, err = rb.ReadAtRequest(buf, off, Request{Queue: rec.Queue, Flags: rec.Flags})
+	} else {
+		n, err = rp.backend.ReadAt(buf, off)
+	}
+	if n < len(buf) && err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	if n == len(buf) && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return err
+}
+
+// write writes buf at off, through WriteAtRequest if the backend takes
+// request flags. A short write is an error.
+func (rp *replayer) write(rec TraceRecord, buf []byte, off int64) error {
+	var n int
+	var err error
+	if rb, ok := rp.backend.(RequestBackend); ok {
+		n, err = rb.WriteAtRequest(buf, off, Request{Queue: rec.Queue, Flags: rec.Flags})
+	} else {
+		n, err = rp.backend.WriteAt(buf, off)
+	}
+	if n < len(buf) && err == nil {
+		err = io.ErrShortWrite
+	}
+	return err
+}
@@ -0,0 +1,213 @@
+package ublk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// writeTrace encodes records as a trace with 512-byte sectors
+func writeTrace(t *testing.T, records []TraceRecord) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := NewTraceWriter(&buf, 512)
+	for _, rec := range records {
+		if err := tw.Write(rec); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	records := []TraceRecord{
+		{
+			Queue: 0, Op: TraceWrite, Flags: RequestFUA, Sector: 2048, Sectors: 8,
+			Start: time.Millisecond, Latency: 20 * time.Microsecond,
+		},
+		// Completed second but started first, on another queue
+		{
+			Queue: 3, Tag: 63, Op: TraceRead, Sector: 1 << 40, Sectors: 128,
+			Start: 500 * time.Microsecond, Latency: time.Millisecond, Errno: syscall.EIO,
+		},
+		{Queue: 1, Op: TraceWriteZeroes, Flags: RequestNoUnmap, Sector: 0, Sectors: 1 << 20, Start: 2 * time.Millisecond},
+		{Queue: 1, Op: TraceFlush, Start: 2 * time.Millisecond},
+	}
+	data := writeTrace(t, records)
+
+	tr, err := NewTraceReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("NewTraceReader: %v", err)
+	}
+	if tr.BlockSize() != 512 {
+		t.Errorf("BlockSize = %d, want 512", tr.BlockSize())
+	}
+	for i, want := range records {
+		got, err := tr.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("record %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next after last record = %v, want io.EOF", err)
+	}
+
+	// A trace cut off mid-record
+	tr, _ = NewTraceReader(bytes.NewReader(data[:len(data)-1]))
+	for err == nil {
+		_, err = tr.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated trace: %v, want io.ErrUnexpectedEOF", err)
+	}
+
+	if _, err := NewTraceReader(bytes.NewReader([]byte("not a trace file"))); err == nil {
+		t.Error("NewTraceReader accepted a file without the trace header")
+	}
+}
+
+func TestTraceRecordHook(t *testing.T) {
+	var buf bytes.Buffer
+	tw := NewTraceWriter(&buf, 4096)
+	// Sectors 128-143 are 4K blocks 16 and 17
+	desc := uapi.UblksrvIODesc{OpFlags: uapi.UBLK_IO_OP_WRITE | uapi.UBLK_IO_F_FUA, StartSector: 128, NrSectors: 16}
+	tw.record(2, 5, desc, tw.start.Add(time.Second), time.Millisecond, syscall.ENOSPC)
+	if err := tw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	tr, err := NewTraceReader(&buf)
+	if err != nil {
+		t.Fatalf("NewTraceReader: %v", err)
+	}
+	if tr.BlockSize() != 4096 {
+		t.Errorf("BlockSize = %d, want 4096", tr.BlockSize())
+	}
+	got, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	want := TraceRecord{
+		Queue: 2, Tag: 5, Op: TraceWrite, Flags: RequestFUA, Sector: 16, Sectors: 2,
+		Start: time.Second, Latency: time.Millisecond, Errno: syscall.ENOSPC,
+	}
+	if got != want {
+		t.Errorf("record = %+v, want %+v", got, want)
+	}
+}
+
+// failWriter fails every write
+type failWriter struct{}
+
+func (failWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestTraceWriterError(t *testing.T) {
+	tw := NewTraceWriter(failWriter{}, 512)
+	tw.record(0, 0, uapi.UblksrvIODesc{NrSectors: 1}, time.Now(), 0, 0)
+	if err := tw.Flush(); err == nil {
+		t.Fatal("Flush succeeded on a failing writer")
+	}
+	d := &Device{trace: tw}
+	if err := d.flushTrace(); err == nil {
+		t.Error("flushTrace succeeded on a failing writer")
+	}
+}
+
+// corruptingBackend flips a byte of every write that covers offset bad
+type corruptingBackend struct {
+	*MockBackend
+	bad int64
+}
+
+func (c *corruptingBackend) WriteAt(p []byte, off int64) (int, error) {
+	if off <= c.bad && c.bad < off+int64(len(p)) {
+		p = bytes.Clone(p)
+		p[c.bad-off] ^= 0xff
+	}
+	return c.MockBackend.WriteAt(p, off)
+}
+
+func TestReplayTrace(t *testing.T) {
+	data := writeTrace(t, []TraceRecord{
+		{Op: TraceWrite, Sector: 0, Sectors: 16},
+		{Op: TraceWrite, Sector: 8, Sectors: 8}, // Overwrites the second half
+		{Op: TraceRead, Sector: 0, Sectors: 16},
+		{Op: TraceWriteZeroes, Sector: 4, Sectors: 2},
+		{Op: TraceRead, Sector: 0, Sectors: 8},
+		{Op: TraceDiscard, Sector: 0, Sectors: 4},
+		{Op: TraceRead, Sector: 0, Sectors: 8},
+		{Op: TraceFlush},
+		{Op: TraceRead, Sector: 1 << 20, Sectors: 8}, // Beyond the backend
+	})
+	replay := func(backend Backend) *ReplayStats {
+		t.Helper()
+		tr, err := NewTraceReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("NewTraceReader: %v", err)
+		}
+		stats, err := ReplayTrace(context.Background(), backend, tr, ReplayOptions{Verify: true})
+		if err != nil {
+			t.Fatalf("ReplayTrace: %v", err)
+		}
+		return stats
+	}
+
+	first := NewMockBackend(1 << 20)
+	stats := replay(first)
+	want := ReplayStats{
+		Requests: 9, Reads: 4, Writes: 2, Flushes: 1, Discards: 1, WriteZeroes: 1,
+		BytesRead: 16<<9 + 8<<9 + 8<<9, BytesWritten: 24 << 9,
+		Errors: 1, FirstBad: -1, Elapsed: stats.Elapsed,
+	}
+	if *stats != want {
+		t.Errorf("stats = %+v, want %+v", *stats, want)
+	}
+
+	// Replays are deterministic
+	second := NewMockBackend(1 << 20)
+	replay(second)
+	if !bytes.Equal(first.data, second.data) {
+		t.Error("two replays of the same trace wrote different data")
+	}
+
+	// A backend that corrupts data is caught by the reads
+	stats = replay(&corruptingBackend{MockBackend: NewMockBackend(1 << 20), bad: 12<<9 + 100})
+	if stats.Mismatches != 1 || stats.FirstBad != 12<<9 {
+		t.Errorf("corrupting backend: %d mismatches, first at %d; want 1 at %d", stats.Mismatches, stats.FirstBad, 12<<9)
+	}
+}
+
+func TestReplayTraceTiming(t *testing.T) {
+	data := writeTrace(t, []TraceRecord{
+		{Op: TraceFlush, Start: 0},
+		{Op: TraceFlush, Start: 100 * time.Millisecond},
+	})
+
+	tr, _ := NewTraceReader(bytes.NewReader(data))
+	stats, err := ReplayTrace(context.Background(), NewMockBackend(4096), tr, ReplayOptions{Speed: 2})
+	if err != nil {
+		t.Fatalf("ReplayTrace: %v", err)
+	}
+	if stats.Elapsed < 50*time.Millisecond {
+		t.Errorf("replay at speed 2 took %v, want at least 50ms", stats.Elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tr, _ = NewTraceReader(bytes.NewReader(data))
+	if _, err := ReplayTrace(ctx, NewMockBackend(4096), tr, ReplayOptions{Speed: 1}); !errors.Is(err, context.Canceled) {
+		t.Errorf("ReplayTrace with cancelled context = %v, want context.Canceled", err)
+	}
+}
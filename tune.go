@@ -0,0 +1,275 @@
+package ublk
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+	"github.com/ehrlich-b/go-ublk/internal/uapi"
+)
+
+// DefaultTuneInterval is used when Options.AutoTune is set without an
+// interval.
+const DefaultTuneInterval = time.Minute
+
+const (
+	// minTuneRequests is how many requests advice needs to be based on;
+	// fewer say nothing about the load.
+	minTuneRequests = 1000
+	// minAdvisedDepth is the smallest QueueDepth advice shrinks a device to.
+	minAdvisedDepth = 32
+)
+
+// QueueAdvice recommends a queue shape for a device, from how busy its
+// queues have been. Queue shape is fixed when a device is created; use
+// Apply on the parameters a device is recreated with to follow the advice.
+type QueueAdvice struct {
+	QueueDepth     int    // Recommended DeviceParams.QueueDepth
+	NumQueues      int    // Recommended DeviceParams.NumQueues
+	BackendWorkers int    // Recommended DeviceParams.BackendWorkers
+	SharedRing     bool   // Recommended DeviceParams.SharedRing
+	Reason         string // Why the shape should change; empty if it suits the load
+
+	Requests   uint64        // Requests the advice is based on
+	AvgInUse   float64       // Mean tags in use in a queue when a request arrived
+	PeakInUse  int           // Most tags in use in one queue at once, since the queues started
+	Saturation float64       // Fraction of requests that left every tag of their queue in use
+	QueueCPU   float64       // The busiest queue thread's CPU use, in cores
+	AvgLatency time.Duration // Mean backend latency, 0 unless the device feeds its Metrics
+}
+
+// Changed reports whether the advice differs from the device's shape.
+func (a QueueAdvice) Changed() bool {
+	return a.Reason != ""
+}
+
+// Apply sets the recommended shape in params.
+func (a QueueAdvice) Apply(params *DeviceParams) {
+	params.QueueDepth = a.QueueDepth
+	params.NumQueues = a.NumQueues
+	params.BackendWorkers = a.BackendWorkers
+	params.SharedRing = a.SharedRing
+}
+
+// String formats the advice for a log line.
+func (a QueueAdvice) String() string {
+	s := fmt.Sprintf("depth %d, queues %d, workers %d", a.QueueDepth, a.NumQueues, a.BackendWorkers)
+	if a.SharedRing {
+		s += ", shared ring"
+	}
+	s += fmt.Sprintf(" (%d requests, %.1f tags in use on average, %.0f%% saturated, busiest queue at %.0f%% CPU",
+		a.Requests, a.AvgInUse, a.Saturation*100, a.QueueCPU*100)
+	if a.AvgLatency > 0 {
+		s += fmt.Sprintf(", backend latency %v", a.AvgLatency)
+	}
+	s += ")"
+	if a.Reason != "" {
+		s = "recommend " + s + ": " + a.Reason
+	}
+	return s
+}
+
+// queueShape is how a device's queues are set up.
+type queueShape struct {
+	depth, queues, workers int
+	sharedRing             bool
+}
+
+// queueLoad is what the queues did over a period.
+type queueLoad struct {
+	depth   queue.DepthStats // Summed over the queues; Peak is the highest
+	cpu     []time.Duration  // CPU time of each queue thread
+	elapsed time.Duration
+	latency time.Duration // Mean backend latency, 0 if unknown
+}
+
+// adviseQueues recommends a shape for load. A queue that is often full
+// is given more concurrency where its bottleneck is: workers if the thread
+// mostly waits on the backend, queues (or threads, with a shared ring) if
+// it is out of CPU, and otherwise a deeper queue. A queue that never fills
+// and uses a fraction of its tags is made shallower, since every tag holds
+// an I/O buffer.
+func adviseQueues(shape queueShape, load queueLoad) QueueAdvice {
+	a := QueueAdvice{
+		QueueDepth:     shape.depth,
+		NumQueues:      shape.queues,
+		BackendWorkers: shape.workers,
+		SharedRing:     shape.sharedRing,
+		Requests:       load.depth.Requests,
+		PeakInUse:      load.depth.Peak,
+		AvgLatency:     load.latency,
+	}
+	if load.depth.Requests == 0 || load.elapsed <= 0 {
+		return a
+	}
+	a.AvgInUse = float64(load.depth.InUse) / float64(load.depth.Requests)
+	a.Saturation = float64(load.depth.Full) / float64(load.depth.Requests)
+	a.QueueCPU = slices.Max(append(load.cpu, 0)).Seconds() / load.elapsed.Seconds()
+	if load.depth.Requests < minTuneRequests {
+		return a
+	}
+
+	switch {
+	case a.Saturation >= 0.25:
+		switch {
+		case shape.workers == 0 && a.QueueCPU < 0.5:
+			a.BackendWorkers = shape.depth
+			a.Reason = fmt.Sprintf("%.0f%% of requests found every tag busy while the queue thread mostly waited "+
+				"on the backend; serve them concurrently with workers", a.Saturation*100)
+		case a.QueueCPU >= 0.9 && shape.sharedRing:
+			a.SharedRing = false
+			a.Reason = "the shared ring's thread is out of CPU; give each queue its own thread"
+		case a.QueueCPU >= 0.9 && shape.queues < runtime.NumCPU():
+			a.NumQueues = min(shape.queues*2, runtime.NumCPU())
+			a.Reason = "a queue thread is out of CPU; spread requests over more queues"
+		case shape.depth < uapi.UBLK_MAX_QUEUE_DEPTH:
+			a.QueueDepth = min(shape.depth*2, uapi.UBLK_MAX_QUEUE_DEPTH)
+			a.Reason = fmt.Sprintf("%.0f%% of requests found every tag busy; the kernel held the rest back", a.Saturation*100)
+		}
+	case load.depth.Full == 0 && shape.depth > minAdvisedDepth && load.depth.Peak*4 <= shape.depth:
+		a.QueueDepth = max(minAdvisedDepth, 1<<bits.Len(uint(load.depth.Peak*2-1)))
+		a.Reason = fmt.Sprintf("at most %d of %d tags were ever in use, and each holds a %d KiB buffer",
+			load.depth.Peak, shape.depth, IOBufferSizePerTag>>10)
+	}
+	return a
+}
+
+// queueTuner measures the load on a device's queues for QueueAdvice.
+type queueTuner struct {
+	shape   queueShape
+	runners []*queue.Runner // Every queue, for DepthStats
+	threads []*queue.Runner // One runner per thread, for CPUTime
+	metrics *Metrics        // nil to skip latency
+	started time.Time
+}
+
+// measure returns the queues' load since they started.
+func (t *queueTuner) measure() queueLoad {
+	var load queueLoad
+	for _, r := range t.runners {
+		s := r.DepthStats()
+		load.depth.Requests += s.Requests
+		load.depth.InUse += s.InUse
+		load.depth.Full += s.Full
+		load.depth.Peak = max(load.depth.Peak, s.Peak)
+	}
+	for _, r := range t.threads {
+		user, system := r.CPUTime()
+		load.cpu = append(load.cpu, user+system)
+	}
+	load.elapsed = time.Since(t.started)
+	if t.metrics != nil {
+		if ops := t.metrics.OpCount.Load(); ops > 0 {
+			load.latency = time.Duration(t.metrics.TotalLatencyNs.Load() / ops)
+		}
+	}
+	return load
+}
+
+// since returns the load between prev and cur, two measurements of the
+// same queues.
+func (cur queueLoad) since(prev queueLoad) queueLoad {
+	cpu := make([]time.Duration, len(cur.cpu))
+	for i := range cpu {
+		cpu[i] = cur.cpu[i] - prev.cpu[i]
+	}
+	return queueLoad{
+		depth: queue.DepthStats{
+			Requests: cur.depth.Requests - prev.depth.Requests,
+			InUse:    cur.depth.InUse - prev.depth.InUse,
+			Full:     cur.depth.Full - prev.depth.Full,
+			Peak:     cur.depth.Peak,
+		},
+		cpu:     cpu,
+		elapsed: cur.elapsed - prev.elapsed,
+		latency: cur.latency,
+	}
+}
+
+// run gives advice for every interval until ctx is done, logging it and
+// passing it to report when it recommends a change it did not recommend
+// for the previous interval.
+func (t *queueTuner) run(
+	ctx context.Context, interval time.Duration, logger Logger, name string, report func(QueueAdvice),
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	prev := t.measure()
+	var last QueueAdvice
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cur := t.measure()
+		advice := adviseQueues(t.shape, cur.since(prev))
+		prev = cur
+		if !advice.Changed() || advice.Reason == last.Reason {
+			continue
+		}
+		last = advice
+		if logger != nil {
+			logger.Printf("%s: %s", name, advice)
+		}
+		if report != nil {
+			report(advice)
+		}
+	}
+}
+
+// queueShape returns the shape the device's queues were created with.
+func (d *Device) queueShape() queueShape {
+	return queueShape{
+		depth:      d.depth,
+		queues:     d.queues,
+		workers:    d.params.BackendWorkers,
+		sharedRing: d.params.SharedRing,
+	}
+}
+
+// watchQueues starts measuring the load on the queues served by runners,
+// on one thread per runner in threads.
+func (d *Device) watchQueues(runners, threads []*queue.Runner) {
+	d.tuner.Store(&queueTuner{
+		shape:   d.queueShape(),
+		runners: runners,
+		threads: threads,
+		metrics: d.metrics,
+		started: time.Now(),
+	})
+}
+
+// startTuner gives queue advice as configured in Options until the device
+// context is cancelled by Stop or Close.
+func (d *Device) startTuner() {
+	tuner := d.tuner.Load()
+	if tuner == nil || d.options == nil || !d.options.AutoTune {
+		return
+	}
+	interval := d.options.TuneInterval
+	if interval <= 0 {
+		interval = DefaultTuneInterval
+	}
+	go tuner.run(d.ctx, interval, d.options.Logger, filepath.Base(d.Path), d.options.OnQueueAdvice)
+}
+
+// QueueAdvice recommends a queue shape for the load the device's queues
+// have served since they last started. Below a thousand requests the load
+// says too little, and the advice is the current shape.
+func (d *Device) QueueAdvice() QueueAdvice {
+	if d == nil {
+		return QueueAdvice{}
+	}
+	tuner := d.tuner.Load()
+	if tuner == nil {
+		return adviseQueues(d.queueShape(), queueLoad{})
+	}
+	return adviseQueues(tuner.shape, tuner.measure())
+}
@@ -0,0 +1,106 @@
+package ublk
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ehrlich-b/go-ublk/internal/queue"
+)
+
+func TestAdviseQueues(t *testing.T) {
+	cpus := runtime.NumCPU()
+	// load builds a second of load with the given saturation, tags in use
+	// and CPU use of the one queue thread
+	load := func(saturation float64, avgInUse float64, peak int, cpu float64) queueLoad {
+		const requests = 10000
+		return queueLoad{
+			depth: queue.DepthStats{
+				Requests: requests,
+				InUse:    uint64(avgInUse * requests),
+				Full:     uint64(saturation * requests),
+				Peak:     peak,
+			},
+			cpu:     []time.Duration{time.Duration(cpu * float64(time.Second))},
+			elapsed: time.Second,
+		}
+	}
+
+	tests := []struct {
+		name  string
+		shape queueShape
+		load  queueLoad
+		want  queueShape // zero if unchanged
+	}{
+		{"suits the load", queueShape{depth: 64, queues: 1}, load(0.05, 40, 64, 0.5), queueShape{}},
+		{"too few requests", queueShape{depth: 64, queues: 1},
+			queueLoad{depth: queue.DepthStats{Requests: 10, Full: 10}, elapsed: time.Second}, queueShape{}},
+		{"waiting on the backend", queueShape{depth: 64, queues: 1},
+			load(0.6, 60, 64, 0.1), queueShape{depth: 64, queues: 1, workers: 64}},
+		{"shared ring out of CPU", queueShape{depth: 64, queues: 4, sharedRing: true},
+			load(0.6, 60, 64, 0.95), queueShape{depth: 64, queues: 4}},
+		{"too shallow", queueShape{depth: 64, queues: 1, workers: 8},
+			load(0.6, 60, 64, 0.3), queueShape{depth: 128, queues: 1, workers: 8}},
+		{"deepest already", queueShape{depth: 4096, queues: 1, workers: 8}, load(0.6, 60, 4096, 0.3), queueShape{}},
+		{"mostly idle tags", queueShape{depth: 256, queues: 1}, load(0, 3, 20, 0.1), queueShape{depth: 64, queues: 1}},
+		{"idle but small", queueShape{depth: 32, queues: 1}, load(0, 1, 1, 0.1), queueShape{}},
+	}
+	if cpus > 1 {
+		tests = append(tests, struct {
+			name  string
+			shape queueShape
+			load  queueLoad
+			want  queueShape
+		}{"queue out of CPU", queueShape{depth: 64, queues: 1}, load(0.6, 60, 64, 0.95), queueShape{depth: 64, queues: 2}})
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := adviseQueues(tt.shape, tt.load)
+			want := tt.want
+			if want == (queueShape{}) {
+				want = tt.shape
+			}
+			got := queueShape{depth: a.QueueDepth, queues: a.NumQueues, workers: a.BackendWorkers, sharedRing: a.SharedRing}
+			if got != want {
+				t.Errorf("advised %+v, want %+v (reason %q)", got, want, a.Reason)
+			}
+			if a.Changed() != (want != tt.shape) {
+				t.Errorf("Changed() = %v with reason %q", a.Changed(), a.Reason)
+			}
+		})
+	}
+}
+
+func TestQueueAdviceApply(t *testing.T) {
+	a := adviseQueues(queueShape{depth: 16, queues: 2, workers: 4}, queueLoad{
+		depth:   queue.DepthStats{Requests: 5000, InUse: 5000 * 16, Full: 5000, Peak: 16},
+		cpu:     []time.Duration{100 * time.Millisecond, 50 * time.Millisecond},
+		elapsed: time.Second,
+		latency: 2 * time.Millisecond,
+	})
+	params := DefaultParams(NewMockBackend(1 << 20))
+	a.Apply(&params)
+	if params.QueueDepth != 32 || params.NumQueues != 2 || params.BackendWorkers != 4 {
+		t.Errorf("applied depth %d, queues %d, workers %d; want 32, 2, 4",
+			params.QueueDepth, params.NumQueues, params.BackendWorkers)
+	}
+	s := a.String()
+	if !strings.HasPrefix(s, "recommend depth 32") || !strings.Contains(s, "10% CPU") ||
+		!strings.Contains(s, "backend latency 2ms") {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestDeviceQueueAdvice(t *testing.T) {
+	d := &Device{depth: 128, queues: 2, params: DeviceParams{BackendWorkers: 4}}
+	if a := d.QueueAdvice(); a.QueueDepth != 128 || a.NumQueues != 2 || a.BackendWorkers != 4 || a.Changed() {
+		t.Errorf("advice before the queues start = %+v, want the current shape", a)
+	}
+
+	var nilDevice *Device
+	if a := nilDevice.QueueAdvice(); a != (QueueAdvice{}) {
+		t.Errorf("nil device advice = %+v", a)
+	}
+}